@@ -0,0 +1,100 @@
+package audit
+
+import (
+	"apollosolutions/uplink-relay/config"
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// sink writes audit records to the configured file.
+type sink struct {
+	logger *slog.Logger
+	file   *os.File
+}
+
+// current is the sink audit records are written to, or nil when auditing is disabled.
+var current atomic.Pointer[sink]
+
+// Configure opens the audit file from the configuration and closes the previous one, so a reloaded configuration takes effect.
+// When auditing is disabled, records are discarded.
+func Configure(auditConfig config.AuditConfig) error {
+	if !auditConfig.Enabled {
+		closeSink(current.Swap(nil))
+		return nil
+	}
+
+	file, err := os.OpenFile(auditConfig.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open audit file: %w", err)
+	}
+	// The audit logger has its own handler, so records are written whatever the level of the operational logs
+	logger := slog.New(slog.NewJSONHandler(file, &slog.HandlerOptions{Level: slog.LevelInfo}))
+	closeSink(current.Swap(&sink{logger: logger, file: file}))
+	return nil
+}
+
+func closeSink(s *sink) {
+	if s != nil {
+		s.file.Close()
+	}
+}
+
+// callKey is the context key for the graph and operation of an upstream request.
+type callKey struct{}
+
+// call identifies the graph and operation an upstream request was made for.
+type call struct {
+	graphRef      string
+	operationName string
+}
+
+// WithCall returns a context that identifies the graph and operation of upstream requests made with it in their audit records.
+func WithCall(ctx context.Context, graphRef string, operationName string) context.Context {
+	return context.WithValue(ctx, callKey{}, call{graphRef: graphRef, operationName: operationName})
+}
+
+// Transport returns a RoundTripper that writes an audit record for each request sent with base.
+func Transport(base http.RoundTripper) http.RoundTripper {
+	return &transport{base: base}
+}
+
+type transport struct {
+	base http.RoundTripper
+}
+
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := t.base.RoundTrip(req)
+	record(req, resp, err, start)
+	return resp, err
+}
+
+// record writes the audit record of an upstream request, if auditing is enabled.
+func record(req *http.Request, resp *http.Response, err error, start time.Time) {
+	s := current.Load()
+	if s == nil {
+		return
+	}
+
+	c, _ := req.Context().Value(callKey{}).(call)
+	attrs := []slog.Attr{
+		slog.Time("start", start),
+		slog.String("graphRef", c.graphRef),
+		slog.String("operationName", c.operationName),
+		slog.String("method", req.Method),
+		slog.String("url", req.URL.Redacted()),
+		slog.Int64("durationMs", time.Since(start).Milliseconds()),
+	}
+	if resp != nil {
+		attrs = append(attrs, slog.Int("status", resp.StatusCode))
+	}
+	if err != nil {
+		attrs = append(attrs, slog.String("err", err.Error()))
+	}
+	s.logger.LogAttrs(context.Background(), slog.LevelInfo, "Upstream request", attrs...)
+}
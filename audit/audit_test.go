@@ -0,0 +1,107 @@
+package audit
+
+import (
+	"apollosolutions/uplink-relay/config"
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// readRecords reads the audit records written to the file.
+func readRecords(t *testing.T, path string) []map[string]interface{} {
+	t.Helper()
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Failed to open audit file: %v", err)
+	}
+	defer file.Close()
+
+	var records []map[string]interface{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var record map[string]interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatalf("Failed to unmarshal audit record %q: %v", scanner.Text(), err)
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+func TestTransport(t *testing.T) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}))
+	defer mockServer.Close()
+	closedServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	closedServer.Close()
+
+	auditFile := filepath.Join(t.TempDir(), "audit.log")
+	if err := Configure(config.AuditConfig{Enabled: true, Path: auditFile}); err != nil {
+		t.Fatalf("Failed to configure auditing: %v", err)
+	}
+	defer Configure(config.AuditConfig{})
+
+	client := &http.Client{Transport: Transport(http.DefaultTransport)}
+	send := func(url string) {
+		req, _ := http.NewRequestWithContext(WithCall(context.Background(), "graph@local", "SupergraphSdlQuery"), http.MethodPost, url, nil)
+		if resp, err := client.Do(req); err == nil {
+			resp.Body.Close()
+		}
+	}
+	send(mockServer.URL)
+	send(closedServer.URL)
+
+	records := readRecords(t, auditFile)
+	if len(records) != 2 {
+		t.Fatalf("Expected 2 audit records, got %d", len(records))
+	}
+	for _, record := range records {
+		if record["graphRef"] != "graph@local" || record["operationName"] != "SupergraphSdlQuery" || record["method"] != http.MethodPost {
+			t.Errorf("Expected the graph and operation of the request, got %v", record)
+		}
+		if _, ok := record["start"]; !ok {
+			t.Errorf("Expected the start time of the request, got %v", record)
+		}
+	}
+	if records[0]["url"] != mockServer.URL || records[0]["status"] != float64(http.StatusTeapot) {
+		t.Errorf("Expected the upstream URL and status, got %v", records[0])
+	}
+	if records[1]["url"] != closedServer.URL || records[1]["err"] == nil {
+		t.Errorf("Expected the upstream URL and error, got %v", records[1])
+	}
+}
+
+func TestConfigureDisabled(t *testing.T) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer mockServer.Close()
+
+	auditFile := filepath.Join(t.TempDir(), "audit.log")
+	if err := Configure(config.AuditConfig{Enabled: true, Path: auditFile}); err != nil {
+		t.Fatalf("Failed to configure auditing: %v", err)
+	}
+	// Disabling auditing, e.g. on reload, stops writing records
+	if err := Configure(config.AuditConfig{Path: auditFile}); err != nil {
+		t.Fatalf("Failed to disable auditing: %v", err)
+	}
+
+	resp, err := (&http.Client{Transport: Transport(http.DefaultTransport)}).Get(mockServer.URL)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	resp.Body.Close()
+	if records := readRecords(t, auditFile); len(records) != 0 {
+		t.Errorf("Expected no audit records, got %v", records)
+	}
+}
+
+func TestConfigureInvalidPath(t *testing.T) {
+	if err := Configure(config.AuditConfig{Enabled: true, Path: filepath.Join(t.TempDir(), "missing", "audit.log")}); err == nil {
+		t.Errorf("Expected an error for a file in a missing directory")
+	}
+}
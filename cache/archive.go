@@ -0,0 +1,129 @@
+package cache
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+	"time"
+)
+
+// ArchiveVersion is the version of the archive format written by ExportArchive.
+const ArchiveVersion = 1
+
+// maxArchiveEntryBytes is the average size allowed for each entry a cache can hold when decoding an archive, well above the size of most cached items.
+const maxArchiveEntryBytes = 1 << 20
+
+// Archive holds every entry of a cache, so a warm cache can be moved to another relay instance.
+type Archive struct {
+	Version    int            `json:"version"`    // Version of the archive format.
+	ExportedAt time.Time      `json:"exportedAt"` // Time the entries were read from the cache.
+	Entries    []ArchiveEntry `json:"entries"`    // Cache entries, sorted by key.
+}
+
+// ArchiveEntry is a single cache entry in an archive.
+// Keys don't include the key version, so entries are imported under the key version of the importing relay.
+type ArchiveEntry struct {
+	Key     string `json:"key"`
+	Content []byte `json:"content"`
+	TTL     int    `json:"ttl"` // Seconds left until the entry expired when it was exported, or -1 if it never expires.
+}
+
+// ExportArchive reads every entry cached with the current key version into an archive, with the time it has left in the cache.
+// The relay's internal entries are skipped, such as the shared content entries of a deduplicated cache, as the items referencing them are read with their content.
+func ExportArchive(systemCache Cache, now time.Time) (*Archive, error) {
+	prefix := KeyPrefix()
+	keys, err := systemCache.KeysWithPrefix(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	archive := &Archive{Version: ArchiveVersion, ExportedAt: now, Entries: make([]ArchiveEntry, 0, len(keys))}
+	for _, key := range keys {
+		// Internal entries are named with a leading @, as graph refs can't contain one once parsed
+		entryKey := strings.TrimPrefix(key, prefix)
+		if strings.HasPrefix(entryKey, "@") {
+			continue
+		}
+		// Entries may expire or be deleted while the keys are read
+		content, ok := systemCache.Get(key)
+		if !ok {
+			continue
+		}
+		ttl, ok := systemCache.TTL(key)
+		if !ok {
+			continue
+		}
+		archive.Entries = append(archive.Entries, ArchiveEntry{Key: entryKey, Content: content, TTL: ttl})
+	}
+	return archive, nil
+}
+
+// ImportArchive writes the entries of an archive to the cache, returning the number of entries imported.
+// Entries keep the time they had left when exported, less the time since, so entries that expired since the export are skipped.
+func ImportArchive(systemCache Cache, archive *Archive, now time.Time) (int, error) {
+	elapsed := int(math.Ceil(now.Sub(archive.ExportedAt).Seconds()))
+	imported := 0
+	for _, entry := range archive.Entries {
+		entryDuration := entry.TTL
+		if entryDuration != -1 {
+			entryDuration -= max(elapsed, 0)
+			if entryDuration <= 0 {
+				continue
+			}
+		}
+		if err := systemCache.Set(KeyPrefix()+entry.Key, string(entry.Content), entryDuration); err != nil {
+			return imported, fmt.Errorf("failed to import %s: %w", entry.Key, err)
+		}
+		imported++
+	}
+	return imported, nil
+}
+
+// Encode encodes the archive as gzipped JSON in base64, so it can be passed around as a string, e.g. through the management API.
+func (a *Archive) Encode() (string, error) {
+	var buffer bytes.Buffer
+	writer := gzip.NewWriter(&buffer)
+	if err := json.NewEncoder(writer).Encode(a); err != nil {
+		return "", err
+	}
+	if err := writer.Close(); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(buffer.Bytes()), nil
+}
+
+// DecodeArchive decodes an archive encoded by Encode, rejecting archives written in another version of the format.
+// Archives are decompressed up to a size bounded by the maximum number of entries of the cache they're imported into, so a small
+// archive can't decompress into more than the cache could hold.
+func DecodeArchive(encoded string, maxEntries int) (*Archive, error) {
+	compressed, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, fmt.Errorf("invalid cache archive: %w", err)
+	}
+	reader, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return nil, fmt.Errorf("invalid cache archive: %w", err)
+	}
+	defer reader.Close()
+	maxBytes := int64(maxEntries) * maxArchiveEntryBytes
+	content, err := io.ReadAll(io.LimitReader(reader, maxBytes+1))
+	if err != nil {
+		return nil, fmt.Errorf("invalid cache archive: %w", err)
+	}
+	if int64(len(content)) > maxBytes {
+		return nil, fmt.Errorf("cache archive is larger than %d bytes", maxBytes)
+	}
+	var archive Archive
+	if err := json.Unmarshal(content, &archive); err != nil {
+		return nil, fmt.Errorf("invalid cache archive: %w", err)
+	}
+	if archive.Version != ArchiveVersion {
+		return nil, fmt.Errorf("unsupported cache archive version %d", archive.Version)
+	}
+	return &archive, nil
+}
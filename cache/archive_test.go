@@ -0,0 +1,154 @@
+package cache
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestArchiveRoundTrip(t *testing.T) {
+	now := time.Now()
+	item := func(content string, expiration time.Time) string {
+		encoded, _ := json.Marshal(CacheItem{ID: "1", Hash: "hash", Content: []byte(content), Expiration: expiration, LastModified: now})
+		return string(encoded)
+	}
+
+	source := NewMemoryCache(100)
+	source.Set(DefaultCacheKey("graph@current", "SupergraphSdlQuery"), item("schema", IndefiniteTimestamp), -1)
+	source.Set(DefaultCacheKey("graph@current", "LicenseQuery"), item("license", now.Add(time.Hour)), 3600)
+	source.Set(DefaultCacheKey("graph@staging", "SupergraphSdlQuery"), item("expiring", now.Add(30*time.Second)), 30)
+	source.Set("chunk:1234", `{"operations":[]}`, 3600)
+	// Pinned chunks are stored as-is and never expire, and internal entries aren't exported
+	source.Set("chunk:pinned", "\x78\x9c compressed chunk", -1)
+	source.Set(KeyPrefix()+"@readiness", "ready", 300)
+
+	archive, err := ExportArchive(source, now)
+	if err != nil {
+		t.Fatalf("Failed to export the cache: %v", err)
+	}
+	encoded, err := archive.Encode()
+	if err != nil {
+		t.Fatalf("Failed to encode the archive: %v", err)
+	}
+
+	// The archive is imported into another relay's cache, which uses a key version
+	SetKeyVersion("v2")
+	defer SetKeyVersion("")
+	decoded, err := DecodeArchive(encoded, 100)
+	if err != nil {
+		t.Fatalf("Failed to decode the archive: %v", err)
+	}
+	destination := NewMemoryCache(100)
+	// The archive is imported a minute after it was exported
+	imported, err := ImportArchive(destination, decoded, now.Add(time.Minute))
+	if err != nil {
+		t.Fatalf("Failed to import the archive: %v", err)
+	}
+	if imported != 4 {
+		t.Errorf("Expected 4 entries to be imported, got %d", imported)
+	}
+
+	for key, expected := range map[string]string{
+		DefaultCacheKey("graph@current", "SupergraphSdlQuery"): "schema",
+		DefaultCacheKey("graph@current", "LicenseQuery"):       "license",
+	} {
+		content, ok := destination.Get(key)
+		if !ok {
+			t.Errorf("Expected %s to be imported", key)
+			continue
+		}
+		var cacheItem CacheItem
+		if err := json.Unmarshal(content, &cacheItem); err != nil || string(cacheItem.Content) != expected {
+			t.Errorf("Expected %s to be imported with its content, got %s", key, content)
+		}
+	}
+	if content, ok := destination.Get("v2:chunk:1234"); !ok || string(content) != `{"operations":[]}` {
+		t.Errorf("Expected entries other than cache items to be imported as-is, got %s", content)
+	}
+	// Entries keep the time they had left, less the time since the export
+	for key, expected := range map[string]int{
+		DefaultCacheKey("graph@current", "SupergraphSdlQuery"): -1,
+		DefaultCacheKey("graph@current", "LicenseQuery"):       3540,
+		"v2:chunk:1234":   3540,
+		"v2:chunk:pinned": -1,
+	} {
+		if ttl, ok := destination.TTL(key); !ok || ttl != expected {
+			t.Errorf("Expected %s to be imported with a TTL of %d, got %d", key, expected, ttl)
+		}
+	}
+	for _, entry := range archive.Entries {
+		if strings.HasPrefix(entry.Key, "@") {
+			t.Errorf("Expected internal entries not to be exported, got %s", entry.Key)
+		}
+	}
+	// Entries that expired since the export aren't imported
+	if _, ok := destination.Get(DefaultCacheKey("graph@staging", "SupergraphSdlQuery")); ok {
+		t.Errorf("Expected the expired entry not to be imported")
+	}
+
+	if _, err := DecodeArchive("not an archive", 100); err == nil {
+		t.Errorf("Expected an error decoding an invalid archive")
+	}
+
+	// Archives decompressing to more than the cache could hold are rejected
+	large := &Archive{Version: ArchiveVersion, ExportedAt: now, Entries: []ArchiveEntry{{Key: "chunk:large", Content: make([]byte, 2*maxArchiveEntryBytes), TTL: -1}}}
+	encodedLarge, _ := large.Encode()
+	if _, err := DecodeArchive(encodedLarge, 1); err == nil || !strings.Contains(err.Error(), "larger than") {
+		t.Errorf("Expected an error decoding an archive larger than the cache, got %v", err)
+	}
+	if _, err := DecodeArchive(encodedLarge, 3); err != nil {
+		t.Errorf("Expected an archive within the size of the cache to be decoded, got %v", err)
+	}
+}
+
+func TestArchiveStaleGrace(t *testing.T) {
+	now := time.Now()
+	source := NewStaleCache(NewMemoryCache(100), 30)
+	source.Set("chunk:1234", `{"operations":[]}`, 3600)
+
+	// Entries are exported with their duration, without the grace period
+	archive, err := ExportArchive(source, now)
+	if err != nil {
+		t.Fatalf("Failed to export the cache: %v", err)
+	}
+	if len(archive.Entries) != 1 || archive.Entries[0].TTL != 3600 {
+		t.Fatalf("Expected the entry to be exported with a TTL of 3600, got %+v", archive.Entries)
+	}
+
+	// The grace period is added once on import
+	backend := NewMemoryCache(100)
+	if _, err := ImportArchive(NewStaleCache(backend, 30), archive, now); err != nil {
+		t.Fatalf("Failed to import the archive: %v", err)
+	}
+	if ttl, ok := backend.TTL("chunk:1234"); !ok || ttl != 3630 {
+		t.Errorf("Expected the entry to be imported with a TTL of 3630, got %d", ttl)
+	}
+}
+
+func TestArchiveSkipsSharedContent(t *testing.T) {
+	now := time.Now()
+	source := NewDedupCache(NewMemoryCache(100))
+	encoded, _ := json.Marshal(CacheItem{ID: "1", Hash: "hash", Content: []byte("schema"), Expiration: IndefiniteTimestamp, LastModified: now})
+	source.Set(DefaultCacheKey("graph@current", "SupergraphSdlQuery"), string(encoded), -1)
+	source.Set(DefaultCacheKey("graph@staging", "SupergraphSdlQuery"), string(encoded), -1)
+
+	archive, err := ExportArchive(source, now)
+	if err != nil {
+		t.Fatalf("Failed to export the cache: %v", err)
+	}
+	if len(archive.Entries) != 2 {
+		t.Fatalf("Expected only the items to be exported, got %+v", archive.Entries)
+	}
+
+	// Items are exported with their content, and deduplicated again on import
+	destination := NewDedupCache(NewMemoryCache(100))
+	if _, err := ImportArchive(destination, archive, now); err != nil {
+		t.Fatalf("Failed to import the archive: %v", err)
+	}
+	content, ok := destination.Get(DefaultCacheKey("graph@staging", "SupergraphSdlQuery"))
+	var cacheItem CacheItem
+	if !ok || json.Unmarshal(content, &cacheItem) != nil || string(cacheItem.Content) != "schema" {
+		t.Errorf("Expected the item to be imported with its content, got %s", content)
+	}
+}
@@ -2,9 +2,11 @@ package cache
 
 import (
 	"apollosolutions/uplink-relay/internal/util"
+	"apollosolutions/uplink-relay/metrics"
 	"encoding/json"
 	"fmt"
 	"log/slog"
+	"sync/atomic"
 	"time"
 )
 
@@ -13,6 +15,8 @@ type Cache interface {
 	Get(key string) ([]byte, bool)                      // Get retrieves an item from the cache if it exists and hasn't expired.
 	Set(key string, content string, duration int) error // Set adds an item to the cache with a specified duration until expiration.
 	DeleteWithPrefix(prefix string) error
+	KeysWithPrefix(prefix string) ([]string, error) // KeysWithPrefix lists the keys of all items with the given prefix.
+	TTL(key string) (int, bool)                     // TTL returns the seconds left until an item expires, or -1 if it never does, and false if it isn't cached.
 	Name() string
 }
 
@@ -26,11 +30,57 @@ var IndefiniteTimestamp = time.Unix(0, 0)
 
 // CacheItem represents a single cached item.
 type CacheItem struct {
-	Content      []byte    `json:"content"`      // Byte content of the cached item.
-	Expiration   time.Time `json:"expiration"`   // Expiration time of the cached item for in-memory use.
-	Hash         string    `json:"hash"`         // sha256 hash of the cached item.
-	LastModified time.Time `json:"lastModified"` // Last modified time of the cached item.
-	ID           string    `json:"id"`           // ID of the cached item.
+	Content         []byte          `json:"content"`                   // Byte content of the cached item.
+	Expiration      time.Time       `json:"expiration"`                // Expiration time of the cached item for in-memory use.
+	Hash            string          `json:"hash"`                      // sha256 hash of the cached item.
+	LastModified    time.Time       `json:"lastModified"`              // Last modified time of the cached item.
+	ID              string          `json:"id"`                        // ID of the cached item.
+	MinDelaySeconds float64         `json:"minDelaySeconds,omitempty"` // minDelaySeconds returned by uplink with the item, replayed to routers on cache hits.
+	Version         string          `json:"version,omitempty"`         // Pinned launch ID or persisted query version the item was fetched for.
+	ExtraFields     json.RawMessage `json:"extraFields,omitempty"`     // Fields of uplink's response the relay doesn't model, replayed to routers with the item.
+	Typename        string          `json:"typename,omitempty"`        // __typename of uplink's response, for items whose content doesn't tell them apart, such as a license response without an entitlement.
+	ContentRef      string          `json:"contentRef,omitempty"`      // Key of the shared entry holding the content of an item stored by a DedupCache, which resolves it on read.
+}
+
+// cacheItemMetadata mirrors CacheItem without its content, which is the bulk of an encoded item.
+type cacheItemMetadata struct {
+	Expiration      time.Time       `json:"expiration"`
+	Hash            string          `json:"hash"`
+	LastModified    time.Time       `json:"lastModified"`
+	ID              string          `json:"id"`
+	MinDelaySeconds float64         `json:"minDelaySeconds,omitempty"`
+	Version         string          `json:"version,omitempty"`
+	ExtraFields     json.RawMessage `json:"extraFields,omitempty"`
+	Typename        string          `json:"typename,omitempty"`
+	ContentRef      string          `json:"contentRef,omitempty"`
+}
+
+// DecodeMetadata decodes an encoded CacheItem without its content, which avoids decoding and copying the content when only the metadata is needed.
+// Gob-encoded items are decoded in full.
+func DecodeMetadata(content []byte) (*CacheItem, error) {
+	if isGob(content) {
+		var item CacheItem
+		if err := DecodeItem(content, &item); err != nil {
+			return nil, err
+		}
+		item.Content = nil
+		return &item, nil
+	}
+	var metadata cacheItemMetadata
+	if err := json.Unmarshal(content, &metadata); err != nil {
+		return nil, err
+	}
+	return &CacheItem{
+		Expiration:      metadata.Expiration,
+		Hash:            metadata.Hash,
+		LastModified:    metadata.LastModified,
+		ID:              metadata.ID,
+		MinDelaySeconds: metadata.MinDelaySeconds,
+		Version:         metadata.Version,
+		ExtraFields:     metadata.ExtraFields,
+		Typename:        metadata.Typename,
+		ContentRef:      metadata.ContentRef,
+	}, nil
 }
 
 // CurrentCacheMetadata represents the current cache metadata. It points to the various cache keys to more easily retrieve the schema, for example. These will only point to the latest cache key with actual data- that is, those that aren't Unchanged.
@@ -41,6 +91,22 @@ type CurrentCacheMetadata struct {
 	EntitlementKey    string    `json:"entitlementKey"`    // Entitlement key of the cache.
 }
 
+// keyVersion is the configured cache key version, prepended to every cache key so bumping it invalidates every entry cached before.
+var keyVersion atomic.Value
+
+// SetKeyVersion sets the version prepended to every cache key generated from now on. Entries cached with another version are no longer read and age out.
+func SetKeyVersion(version string) {
+	keyVersion.Store(version)
+}
+
+// KeyPrefix returns the prefix of every cache key: the key version followed by a colon, or nothing if no key version is set.
+func KeyPrefix() string {
+	if version, _ := keyVersion.Load().(string); version != "" {
+		return version + ":"
+	}
+	return ""
+}
+
 // makeCacheKey generates a cache key from the provided graphID, variantID, and operationName.
 func MakeCacheKey(graphRef, operationName string, extraArgs ...interface{}) string {
 	prefix := MakeCachePrefix(graphRef, operationName)
@@ -57,7 +123,7 @@ func MakeCachePrefix(graphRef string, operationName string) string {
 	if err != nil {
 		return ""
 	}
-	return fmt.Sprintf("%s:%s:%s", graphID, variantID, operationName)
+	return fmt.Sprintf("%s%s:%s:%s", KeyPrefix(), graphID, variantID, operationName)
 }
 
 // UpdateNewest updates the base cache entry with the passed item if it is newer.
@@ -75,7 +141,7 @@ func UpdateNewest(systemCache Cache, logger *slog.Logger, graphRef string, opera
 	entry, ok := systemCache.Get(cacheKey)
 	if ok {
 		// Unmarshal the first entry
-		if err := json.Unmarshal([]byte(entry), &firstEntry); err != nil {
+		if err := DecodeItem(entry, &firstEntry); err != nil {
 			logger.Error("Error unmarshalling cache entry", "cacheKey", cacheKey)
 			return err
 		}
@@ -91,10 +157,14 @@ func UpdateNewest(systemCache Cache, logger *slog.Logger, graphRef string, opera
 
 	// If the passed item is newer than the first entry, update the first entry (aka the one without arguments)
 	if firstEntry.LastModified.Before(passedItem.LastModified) && firstEntry.Hash != passedItem.Hash {
-		cacheBytes, err := json.Marshal(passedItem)
+		cacheBytes, err := EncodeItem(passedItem)
 		if err != nil {
 			return err
 		}
+		// Keep the version being replaced, if a history is configured, so prior versions can still be retrieved
+		if err := recordHistory(systemCache, graphRef, operationName, firstEntry); err != nil {
+			logger.Error("Error recording cache entry history", "cacheKey", cacheKey, "err", err)
+		}
 		// default args to set the first entry
 		return systemCache.Set(cacheKey, string(cacheBytes[:]), -1)
 	}
@@ -119,3 +189,18 @@ func ExpirationTime(duration int) time.Time {
 	}
 	return time.Now().Add(time.Duration(duration) * time.Second)
 }
+
+// RecordItemAge sets the cache item age gauge for the given artifact using the LastModified time of the item stored at key.
+// It returns false if there is no valid item at the key.
+func RecordItemAge(systemCache Cache, graphRef string, artifact string, key string, now time.Time) bool {
+	entry, ok := systemCache.Get(key)
+	if !ok {
+		return false
+	}
+	var item CacheItem
+	if err := DecodeItem(entry, &item); err != nil || item.LastModified.IsZero() {
+		return false
+	}
+	metrics.CacheItemAge.Set(now.Sub(item.LastModified).Seconds(), graphRef, artifact)
+	return true
+}
@@ -2,8 +2,11 @@ package cache
 
 import (
 	"apollosolutions/uplink-relay/logger"
+	"apollosolutions/uplink-relay/metrics"
 	"encoding/json"
 	"fmt"
+	"reflect"
+	"strings"
 	"testing"
 	"time"
 )
@@ -62,6 +65,96 @@ func TestMemoryCacheSet(t *testing.T) {
 	}
 }
 
+func TestMemoryCacheOverwrite(t *testing.T) {
+	cache := NewMemoryCache(3)
+	cache.Set("key1", "content", 10)
+	cache.Set("key2", "content", 20)
+
+	// Overwriting a key doesn't count as another item, so it never evicts the others
+	for i := 0; i < 10; i++ {
+		cache.Set("probe", fmt.Sprintf("content%d", i), 30)
+	}
+	for _, key := range []string{"key1", "key2"} {
+		if _, found := cache.Get(key); !found {
+			t.Errorf("Expected %s not to be evicted by overwrites", key)
+		}
+	}
+	if content, _ := cache.Get("probe"); string(content) != "content9" {
+		t.Errorf("Expected the latest content, got %q", content)
+	}
+}
+
+func TestShardedMemoryCache(t *testing.T) {
+	cache := NewShardedMemoryCache(40, 4)
+	for i := 0; i < 20; i++ {
+		cache.Set(fmt.Sprintf("graph:key%02d", i), "content", 10)
+	}
+	cache.Set("other:key", "content", 10)
+
+	// Keys are spread across the shards, but listed and deleted across all of them
+	spread := 0
+	for _, shard := range cache.shards {
+		if len(shard.items) > 0 {
+			spread++
+		}
+	}
+	if spread < 2 {
+		t.Errorf("Expected the keys to be spread across shards, got %d non-empty shards", spread)
+	}
+	keys, _ := cache.KeysWithPrefix("graph:")
+	if len(keys) != 20 || keys[0] != "graph:key00" || keys[19] != "graph:key19" {
+		t.Errorf("Expected the sorted keys of every shard, got %v", keys)
+	}
+	cache.DeleteWithPrefix("graph:")
+	if keys, _ := cache.KeysWithPrefix(""); len(keys) != 1 || keys[0] != "other:key" {
+		t.Errorf("Expected only the keys without the prefix to be left, got %v", keys)
+	}
+
+	// Each shard evicts its own oldest item once it holds its share of the maximum size
+	for i := 0; i < 100; i++ {
+		cache.Set(fmt.Sprintf("graph:key%02d", i), "content", 10+i)
+	}
+	for _, shard := range cache.shards {
+		if len(shard.items) > 10 {
+			t.Errorf("Expected each shard to hold at most 10 items, got %d", len(shard.items))
+		}
+	}
+	if _, found := cache.Get("graph:key99"); !found {
+		t.Errorf("Expected the newest item to be found in cache")
+	}
+}
+
+// BenchmarkMemoryCacheParallel compares lock contention with and without sharding when many goroutines read and write distinct keys, e.g.
+// go test -run xxx -bench BenchmarkMemoryCacheParallel -cpu 8 ./cache/
+func BenchmarkMemoryCacheParallel(b *testing.B) {
+	keys := make([]string, 1000)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("graph@variant:SupergraphSdlQuery:%d", i)
+	}
+	for _, shards := range []int{1, 16} {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			cache := NewShardedMemoryCache(len(keys)*2, shards)
+			for _, key := range keys {
+				cache.Set(key, defaultCacheContent, 60)
+			}
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				i := 0
+				for pb.Next() {
+					key := keys[i%len(keys)]
+					// Mostly cache hits, with the occasional write as entries are refreshed
+					if i%10 == 0 {
+						cache.Set(key, defaultCacheContent, 60)
+					} else {
+						cache.Get(key)
+					}
+					i++
+				}
+			})
+		})
+	}
+}
+
 func TestMakeCacheKey(t *testing.T) {
 	// Test case 1: Generate cache key with only required arguments
 	key := MakeCacheKey("graphID1@variantID1", "operationName1")
@@ -77,6 +170,34 @@ func TestMakeCacheKey(t *testing.T) {
 		t.Errorf("Expected key to be '%s', got '%s'", expectedKey, key)
 	}
 }
+
+func TestMakeCacheKeyVersion(t *testing.T) {
+	defer SetKeyVersion("")
+
+	SetKeyVersion("v1")
+	v1Key := MakeCacheKey("graph@current", "SupergraphSdlQuery", map[string]interface{}{"graph_ref": "graph@current"})
+	v1Prefix := MakeCachePrefix("graph@current", "SupergraphSdlQuery")
+	SetKeyVersion("v2")
+	v2Key := MakeCacheKey("graph@current", "SupergraphSdlQuery", map[string]interface{}{"graph_ref": "graph@current"})
+
+	if v1Key == v2Key {
+		t.Errorf("Expected different key versions to generate different keys, got %s", v1Key)
+	}
+	if !strings.HasPrefix(v1Key, "v1:graph:current:SupergraphSdlQuery:") || !strings.HasPrefix(v1Key, v1Prefix) {
+		t.Errorf("Expected the key to start with its version, got %s", v1Key)
+	}
+	// Prefixes of the new version don't match keys of the old one, so deleting them leaves old entries to age out
+	if strings.HasPrefix(v1Key, MakeCachePrefix("graph@current", "SupergraphSdlQuery")) {
+		t.Errorf("Expected the v2 prefix not to match the v1 key %s", v1Key)
+	}
+
+	// Without a version, keys are unchanged
+	SetKeyVersion("")
+	if key := MakeCacheKey("graph@current", "SupergraphSdlQuery"); key != "graph:current:SupergraphSdlQuery" {
+		t.Errorf("Expected an unversioned key, got %s", key)
+	}
+}
+
 func TestCacheDeleteWithPrefix(t *testing.T) {
 	cache := NewMemoryCache(10)
 
@@ -110,6 +231,22 @@ func TestCacheDeleteWithPrefix(t *testing.T) {
 	}
 }
 
+func TestCacheKeysWithPrefix(t *testing.T) {
+	cache := NewMemoryCache(10)
+
+	cache.Set("prefix1_key2", "content1", 10)
+	cache.Set("prefix1_key1", "content2", -1)
+	cache.Set("prefix2_key1", "content3", 10)
+
+	keys, err := cache.KeysWithPrefix("prefix1")
+	if err != nil {
+		t.Errorf("Expected no error, got '%s'", err.Error())
+	}
+	if !reflect.DeepEqual(keys, []string{"prefix1_key1", "prefix1_key2"}) {
+		t.Errorf("Expected the keys with prefix1, got %v", keys)
+	}
+}
+
 func TestUpdateNewest(t *testing.T) {
 	cache := NewMemoryCache(10)
 
@@ -211,3 +348,63 @@ func TestExpirationTime(t *testing.T) {
 		t.Errorf("Expected expiration time to be %d seconds in the future", duration)
 	}
 }
+
+func TestRecordItemAge(t *testing.T) {
+	cache := NewMemoryCache(10)
+	now := time.Now()
+
+	item := CacheItem{
+		Content:      []byte("content1"),
+		LastModified: now.Add(-4 * time.Hour),
+		ID:           "id1",
+	}
+	itemBytes, _ := json.Marshal(item)
+	cache.Set("key1", string(itemBytes[:]), -1)
+
+	if !RecordItemAge(cache, "graph@variant", "supergraph", "key1", now) {
+		t.Fatalf("Expected item age to be recorded")
+	}
+	age, ok := metrics.CacheItemAge.Get("graph@variant", "supergraph")
+	if !ok {
+		t.Fatalf("Expected item age gauge to be set")
+	}
+	if age != (4 * time.Hour).Seconds() {
+		t.Errorf("Expected item age to be %v, got %v", (4 * time.Hour).Seconds(), age)
+	}
+
+	// Missing items shouldn't record an age
+	if RecordItemAge(cache, "graph@variant", "entitlement", "missing", now) {
+		t.Errorf("Expected no item age for a missing key")
+	}
+}
+
+func TestDecodeMetadata(t *testing.T) {
+	item := CacheItem{
+		Content:         []byte("supergraph sdl"),
+		Expiration:      time.Date(2024, 2, 9, 12, 0, 0, 0, time.UTC),
+		Hash:            "hash",
+		LastModified:    time.Date(2024, 2, 9, 11, 0, 0, 0, time.UTC),
+		ID:              "id",
+		MinDelaySeconds: 30,
+		Version:         "1",
+		ExtraFields:     json.RawMessage(`{"extra":true}`),
+	}
+	content, err := json.Marshal(item)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	metadata, err := DecodeMetadata(content)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	// Everything but the content is decoded
+	item.Content = nil
+	if !reflect.DeepEqual(*metadata, item) {
+		t.Errorf("Expected %+v, got %+v", item, *metadata)
+	}
+
+	if _, err := DecodeMetadata([]byte("not json")); err == nil {
+		t.Errorf("Expected an error for invalid content")
+	}
+}
@@ -0,0 +1,87 @@
+package cache
+
+import (
+	"bytes"
+	"compress/zlib"
+	"io"
+)
+
+// compressedPrefix marks a zlib-compressed entry. It can't appear at the start of the JSON entries stored by the relay.
+const compressedPrefix = "\x00zlib\x00"
+
+// CompressedCache wraps a cache and transparently zlib-compresses entries at or above a minimum size, decompressing them on read.
+// Wrapping the outermost cache (e.g. a tiered cache) compresses entries in every backend.
+type CompressedCache struct {
+	cache   Cache // Underlying cache the compressed entries are stored in.
+	minSize int   // Minimum size of an entry, in bytes, before it's compressed.
+}
+
+// NewCompressedCache creates a new CompressedCache around the given cache.
+func NewCompressedCache(cache Cache, minSize int) *CompressedCache {
+	return &CompressedCache{cache: cache, minSize: minSize}
+}
+
+// Get retrieves an item from the underlying cache, decompressing it if needed.
+func (c *CompressedCache) Get(key string) ([]byte, bool) {
+	content, ok := c.cache.Get(key)
+	if !ok || !bytes.HasPrefix(content, []byte(compressedPrefix)) {
+		return content, ok
+	}
+
+	reader, err := zlib.NewReader(bytes.NewReader(content[len(compressedPrefix):]))
+	if err != nil {
+		return nil, false
+	}
+	defer reader.Close()
+	decompressed, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, false
+	}
+	return decompressed, true
+}
+
+// Set adds an item to the underlying cache, compressing it if it's at least the minimum size and compression makes it smaller.
+func (c *CompressedCache) Set(key string, content string, duration int) error {
+	if len(content) < c.minSize {
+		return c.cache.Set(key, content, duration)
+	}
+
+	compressed, err := compress(content)
+	if err != nil || len(compressed)+len(compressedPrefix) >= len(content) {
+		return c.cache.Set(key, content, duration)
+	}
+	return c.cache.Set(key, compressedPrefix+string(compressed), duration)
+}
+
+// DeleteWithPrefix deletes all items with the given prefix from the underlying cache.
+func (c *CompressedCache) DeleteWithPrefix(prefix string) error {
+	return c.cache.DeleteWithPrefix(prefix)
+}
+
+// KeysWithPrefix lists the keys of all items with the given prefix in the underlying cache.
+func (c *CompressedCache) KeysWithPrefix(prefix string) ([]string, error) {
+	return c.cache.KeysWithPrefix(prefix)
+}
+
+// TTL returns the seconds left until an item of the underlying cache expires.
+func (c *CompressedCache) TTL(key string) (int, bool) {
+	return c.cache.TTL(key)
+}
+
+// Name returns the name of the underlying cache.
+func (c *CompressedCache) Name() string {
+	return "Compressed " + c.cache.Name()
+}
+
+// compress zlib-compresses the given content.
+func compress(content string) ([]byte, error) {
+	var b bytes.Buffer
+	w := zlib.NewWriter(&b)
+	if _, err := w.Write([]byte(content)); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
@@ -0,0 +1,113 @@
+package cache
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// largeSupergraphEntry builds a cache entry for a supergraph SDL of roughly the given size.
+func largeSupergraphEntry(size int) string {
+	var sdl strings.Builder
+	for i := 0; sdl.Len() < size; i++ {
+		fmt.Fprintf(&sdl, "type Type%d @join__type(graph: PRODUCTS, key: \"id\") {\n  id: ID!\n  name: String @join__field(graph: PRODUCTS)\n}\n", i)
+	}
+	entry, _ := json.Marshal(CacheItem{
+		Content:      []byte(sdl.String()),
+		Expiration:   IndefiniteTimestamp,
+		LastModified: time.Now(),
+		ID:           "launch",
+	})
+	return string(entry)
+}
+
+func TestCompressedCacheRoundTrip(t *testing.T) {
+	underlying := NewMemoryCache(10)
+	cache := NewCompressedCache(underlying, 1024)
+
+	large := largeSupergraphEntry(200 * 1024)
+	if err := cache.Set("large", large, 10); err != nil {
+		t.Fatalf("Expected no error, got '%s'", err.Error())
+	}
+
+	// The underlying cache holds the compressed entry
+	stored, _ := underlying.Get("large")
+	if !strings.HasPrefix(string(stored), compressedPrefix) {
+		t.Errorf("Expected the large entry to be stored compressed")
+	}
+	if len(stored) >= len(large) {
+		t.Errorf("Expected the compressed entry to be smaller, got %d bytes for %d bytes of content", len(stored), len(large))
+	}
+
+	content, found := cache.Get("large")
+	if !found {
+		t.Fatalf("Expected item to be found in cache")
+	}
+	if string(content) != large {
+		t.Errorf("Expected the decompressed content to match the original")
+	}
+
+	// Small entries are stored as-is
+	if err := cache.Set("small", defaultCacheContent, 10); err != nil {
+		t.Fatalf("Expected no error, got '%s'", err.Error())
+	}
+	stored, _ = underlying.Get("small")
+	if string(stored) != defaultCacheContent {
+		t.Errorf("Expected the small entry to be stored uncompressed, got '%s'", string(stored))
+	}
+	content, found = cache.Get("small")
+	if !found || string(content) != defaultCacheContent {
+		t.Errorf("Expected content to be '%s', got '%s'", defaultCacheContent, string(content))
+	}
+
+	// Entries written before compression was enabled can still be read
+	underlying.Set("existing", large, 10)
+	content, found = cache.Get("existing")
+	if !found || string(content) != large {
+		t.Errorf("Expected the uncompressed entry to be returned as-is")
+	}
+
+	if _, found := cache.Get("non_existing_key"); found {
+		t.Errorf("Expected item to not be found in cache")
+	}
+
+	if err := cache.DeleteWithPrefix("lar"); err != nil {
+		t.Errorf("Expected no error, got '%s'", err.Error())
+	}
+	if _, found := cache.Get("large"); found {
+		t.Errorf("Expected item to be deleted from cache")
+	}
+}
+
+func TestCompressedCacheCorruptEntry(t *testing.T) {
+	underlying := NewMemoryCache(10)
+	cache := NewCompressedCache(underlying, 1024)
+
+	underlying.Set("corrupt", compressedPrefix+"not zlib", 10)
+	if _, found := cache.Get("corrupt"); found {
+		t.Errorf("Expected a corrupt entry to be treated as a cache miss")
+	}
+}
+
+func BenchmarkCompressedCacheSet(b *testing.B) {
+	cache := NewCompressedCache(NewMemoryCache(10), 1024)
+	large := largeSupergraphEntry(500 * 1024)
+	b.SetBytes(int64(len(large)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		cache.Set("large", large, 10)
+	}
+}
+
+func BenchmarkCompressedCacheGet(b *testing.B) {
+	cache := NewCompressedCache(NewMemoryCache(10), 1024)
+	large := largeSupergraphEntry(500 * 1024)
+	cache.Set("large", large, 10)
+	b.SetBytes(int64(len(large)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		cache.Get("large")
+	}
+}
@@ -0,0 +1,139 @@
+package cache
+
+import (
+	"apollosolutions/uplink-relay/internal/util"
+	"bytes"
+	"math"
+	"time"
+)
+
+// DedupCache wraps a cache and stores the content of the CacheItems written to it once per content hash, so variants and graphs
+// sharing the same supergraph, for example, don't each store a copy. Items are stored without their content, referencing a shared
+// content entry instead, and the content is added back on read, so callers are unaffected. Other entries are stored as-is.
+// Content entries are kept as long as the longest-lived item referencing them; an item whose content entry is gone, e.g. evicted, is a cache miss.
+// Wrapping the outermost cache (e.g. a compressed cache) deduplicates content in every backend.
+type DedupCache struct {
+	cache Cache // Underlying cache the items and their content are stored in.
+}
+
+// NewDedupCache creates a new DedupCache around the given cache.
+func NewDedupCache(cache Cache) *DedupCache {
+	return &DedupCache{cache: cache}
+}
+
+// contentKeyMarker is part of every content key, so items that can't reference a content entry are returned without being decoded.
+const contentKeyMarker = "@content:"
+
+// ContentKey returns the cache key of the content entry shared by every item with the given content hash.
+// Graph refs can't contain an @ once parsed, so content entries never share a prefix with a graph's entries.
+func ContentKey(hash string) string {
+	return KeyPrefix() + contentKeyMarker + hash
+}
+
+// Get retrieves an item from the underlying cache, adding back its content if it references a content entry.
+func (c *DedupCache) Get(key string) ([]byte, bool) {
+	content, ok := c.cache.Get(key)
+	if !ok || !bytes.Contains(content, []byte(contentKeyMarker)) {
+		return content, ok
+	}
+
+	var item CacheItem
+	if err := DecodeItem(content, &item); err != nil || item.ContentRef == "" {
+		return content, ok
+	}
+	sharedContent, ok := c.cache.Get(item.ContentRef)
+	if !ok {
+		return nil, false
+	}
+	var contentItem CacheItem
+	if err := DecodeItem(sharedContent, &contentItem); err != nil {
+		return nil, false
+	}
+	item.Content = contentItem.Content
+	item.ContentRef = ""
+	decoded, err := EncodeItem(item)
+	if err != nil {
+		return nil, false
+	}
+	return decoded, true
+}
+
+// Set adds an item to the underlying cache. If the content is an encoded CacheItem with content, the content is stored in
+// the entry shared by every item with the same content, extending its lifetime if needed, and the item references it.
+func (c *DedupCache) Set(key string, content string, duration int) error {
+	if len(content) == 0 || (content[0] != '{' && !isGob([]byte(content))) {
+		return c.cache.Set(key, content, duration)
+	}
+	var item CacheItem
+	if err := DecodeItem([]byte(content), &item); err != nil || len(item.Content) == 0 || item.ContentRef != "" {
+		return c.cache.Set(key, content, duration)
+	}
+
+	contentKey := ContentKey(util.HashString(string(item.Content)))
+	if err := c.setContent(contentKey, item.Content, duration); err != nil {
+		return err
+	}
+	item.Content = nil
+	item.ContentRef = contentKey
+	reference, err := EncodeItem(item)
+	if err != nil {
+		return err
+	}
+	return c.cache.Set(key, string(reference), duration)
+}
+
+// setContent stores the shared content entry for the given duration, unless it's already stored for longer.
+func (c *DedupCache) setContent(contentKey string, content []byte, duration int) error {
+	now := time.Now()
+	expiration := ExpirationTime(duration)
+	if existing, ok := c.cache.Get(contentKey); ok {
+		if metadata, err := DecodeMetadata(existing); err == nil && outlives(metadata.Expiration, expiration) {
+			expiration = metadata.Expiration
+			duration = -1
+			if !expiration.Equal(IndefiniteTimestamp) {
+				duration = int(math.Ceil(expiration.Sub(now).Seconds()))
+			}
+		}
+	}
+
+	contentItem, err := EncodeItem(CacheItem{
+		Content:      content,
+		Expiration:   expiration,
+		Hash:         util.HashString(string(content)),
+		LastModified: now,
+	})
+	if err != nil {
+		return err
+	}
+	return c.cache.Set(contentKey, string(contentItem), duration)
+}
+
+// outlives returns whether the expiration time is later than the other, indefinite expirations being the latest.
+// Expirations are compared with Equal, as decoded ones lose the location of IndefiniteTimestamp.
+func outlives(expiration time.Time, other time.Time) bool {
+	if other.Equal(IndefiniteTimestamp) {
+		return false
+	}
+	return expiration.Equal(IndefiniteTimestamp) || expiration.After(other)
+}
+
+// DeleteWithPrefix deletes all items with the given prefix from the underlying cache.
+// Content entries are shared, so they aren't deleted with the items referencing them.
+func (c *DedupCache) DeleteWithPrefix(prefix string) error {
+	return c.cache.DeleteWithPrefix(prefix)
+}
+
+// KeysWithPrefix lists the keys of all items with the given prefix in the underlying cache.
+func (c *DedupCache) KeysWithPrefix(prefix string) ([]string, error) {
+	return c.cache.KeysWithPrefix(prefix)
+}
+
+// TTL returns the seconds left until an item of the underlying cache expires.
+func (c *DedupCache) TTL(key string) (int, bool) {
+	return c.cache.TTL(key)
+}
+
+// Name returns the name of the underlying cache.
+func (c *DedupCache) Name() string {
+	return c.cache.Name()
+}
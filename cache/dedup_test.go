@@ -0,0 +1,95 @@
+package cache
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDedupCacheSharedContent(t *testing.T) {
+	sdl := []byte(strings.Repeat("type Query { hello: String }\n", 100))
+	encodedSDL := base64.StdEncoding.EncodeToString(sdl)
+
+	t.Cleanup(func() { SetGobEncoding(false) })
+	for _, encode := range []bool{false, true} {
+		SetGobEncoding(encode)
+		backend := NewMemoryCache(10)
+		dedupCache := NewDedupCache(backend)
+
+		// Two variants cache the same supergraph
+		items := map[string]string{}
+		for _, graphRef := range []string{"graph@current", "graph@staging", "other@current"} {
+			item, _ := EncodeItem(CacheItem{
+				Content:      sdl,
+				Expiration:   IndefiniteTimestamp,
+				Hash:         "hash",
+				LastModified: time.Date(2024, 10, 3, 12, 0, 0, 0, time.UTC),
+				ID:           graphRef,
+			})
+			key := DefaultCacheKey(graphRef, "SupergraphSdlQuery")
+			items[key] = string(item)
+			if err := dedupCache.Set(key, string(item), -1); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// The content is stored once, with one reference per graph
+		keys, _ := backend.KeysWithPrefix("")
+		if len(keys) != len(items)+1 {
+			t.Errorf("Expected %d entries, got %v", len(items)+1, keys)
+		}
+		copies := 0
+		for _, key := range keys {
+			stored, _ := backend.Get(key)
+			if strings.Contains(string(stored), encodedSDL) || strings.Contains(string(stored), string(sdl)) {
+				copies++
+			}
+		}
+		if copies != 1 {
+			t.Errorf("Expected the content to be stored once (gob: %v), got %d copies", encode, copies)
+		}
+
+		// Each item reads back as it was written
+		for key, item := range items {
+			if content, ok := dedupCache.Get(key); !ok || string(content) != item {
+				t.Errorf("Expected %s to round trip (gob: %v), got %s", key, encode, content)
+			}
+		}
+	}
+}
+
+func TestDedupCacheContentLifetime(t *testing.T) {
+	backend := NewMemoryCache(10)
+	dedupCache := NewDedupCache(backend)
+	item, _ := json.Marshal(CacheItem{Content: []byte("schema"), Expiration: IndefiniteTimestamp, ID: "id"})
+
+	dedupCache.Set("indefinite", string(item), -1)
+	dedupCache.Set("short", string(item), 1)
+	keys, _ := backend.KeysWithPrefix(ContentKey(""))
+	if len(keys) != 1 {
+		t.Fatalf("Expected a single content entry, got %v", keys)
+	}
+	contentKey := keys[0]
+
+	// A shorter-lived item doesn't shorten the lifetime of content referenced by an indefinite one
+	stored, _ := backend.Get(contentKey)
+	if metadata, err := DecodeMetadata(stored); err != nil || !metadata.Expiration.Equal(IndefiniteTimestamp) {
+		t.Errorf("Expected the content to be kept indefinitely, got %+v, %v", metadata, err)
+	}
+
+	// Items whose content is gone are cache misses
+	backend.DeleteWithPrefix(ContentKey(""))
+	if content, ok := dedupCache.Get("indefinite"); ok {
+		t.Errorf("Expected a cache miss without the content, got %s", content)
+	}
+
+	// Entries that aren't cache items with content are stored as-is
+	for _, content := range []string{"\x78\x9cchunk", `{"supergraphKey":"key"}`} {
+		dedupCache.Set("raw", content, 60)
+		if stored, _ := backend.Get("raw"); string(stored) != content {
+			t.Errorf("Expected %q to be stored as-is, got %q", content, stored)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package cache
+
+import (
+	"log/slog"
+	"sort"
+	"sync/atomic"
+)
+
+// FallbackCache wraps a cache backend, such as Redis, with a short-lived in-process cache that entries are written to when the backend fails.
+// While the backend is unavailable, every request would otherwise be a cache miss, multiplying the load on uplink by the number of routers.
+type FallbackCache struct {
+	cache    Cache        // Underlying cache backend.
+	fallback *MemoryCache // In-process cache holding entries that couldn't be written to the backend.
+	duration int          // Duration to keep entries in the fallback cache, in seconds.
+	logger   *slog.Logger
+	degraded atomic.Bool // Whether the last write to the backend failed.
+}
+
+// NewFallbackCache creates a new FallbackCache around the given cache, keeping up to maxSize entries for the given duration when the backend fails.
+func NewFallbackCache(cache Cache, logger *slog.Logger, maxSize int, duration int) *FallbackCache {
+	return &FallbackCache{cache: cache, fallback: NewMemoryCache(maxSize), duration: duration, logger: logger}
+}
+
+// Get retrieves an item from the backend, or from the fallback cache if the backend doesn't have it.
+func (c *FallbackCache) Get(key string) ([]byte, bool) {
+	if content, ok := c.cache.Get(key); ok {
+		return content, true
+	}
+	return c.fallback.Get(key)
+}
+
+// Set adds an item to the backend. If the write fails, the item is kept in the fallback cache and the backend's error is returned.
+func (c *FallbackCache) Set(key string, content string, duration int) error {
+	err := c.cache.Set(key, content, duration)
+	if err != nil {
+		if !c.degraded.Swap(true) {
+			c.logger.Warn("Cache backend unavailable, using the fallback cache", "cache", c.cache.Name(), "duration", c.duration, "err", err)
+		}
+		fallbackDuration := c.duration
+		if duration >= 0 && duration < fallbackDuration {
+			fallbackDuration = duration
+		}
+		c.fallback.Set(key, content, fallbackDuration)
+		return err
+	}
+
+	if c.degraded.Swap(false) {
+		c.logger.Info("Cache backend recovered", "cache", c.cache.Name())
+	}
+	return nil
+}
+
+// DeleteWithPrefix deletes all items with the given prefix from both the backend and the fallback cache.
+func (c *FallbackCache) DeleteWithPrefix(prefix string) error {
+	c.fallback.DeleteWithPrefix(prefix)
+	return c.cache.DeleteWithPrefix(prefix)
+}
+
+// KeysWithPrefix lists the keys of all items with the given prefix in either the backend or the fallback cache.
+func (c *FallbackCache) KeysWithPrefix(prefix string) ([]string, error) {
+	fallbackKeys, _ := c.fallback.KeysWithPrefix(prefix)
+	keys, err := c.cache.KeysWithPrefix(prefix)
+	if err != nil {
+		return fallbackKeys, err
+	}
+
+	seen := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		seen[key] = true
+	}
+	for _, key := range fallbackKeys {
+		if !seen[key] {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// TTL returns the seconds left until an item of the backend, or of the fallback cache if the backend doesn't have it, expires.
+func (c *FallbackCache) TTL(key string) (int, bool) {
+	if ttl, ok := c.cache.TTL(key); ok {
+		return ttl, true
+	}
+	return c.fallback.TTL(key)
+}
+
+// Name returns the name of the underlying cache.
+func (c *FallbackCache) Name() string {
+	return c.cache.Name()
+}
@@ -0,0 +1,67 @@
+package cache
+
+import (
+	"apollosolutions/uplink-relay/logger"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// unavailableCache wraps a MemoryCache whose writes fail while down is set, e.g. a Redis backend that is unreachable.
+type unavailableCache struct {
+	*MemoryCache
+	down bool
+}
+
+func (c *unavailableCache) Set(key string, content string, duration int) error {
+	if c.down {
+		return errors.New("connection refused")
+	}
+	return c.MemoryCache.Set(key, content, duration)
+}
+
+func TestFallbackCache(t *testing.T) {
+	pFalse := false
+	backend := &unavailableCache{MemoryCache: NewMemoryCache(10), down: true}
+	cache := NewFallbackCache(backend, logger.MakeLogger(&pFalse), 10, 30)
+
+	// Writes to an unavailable backend are kept in the fallback cache, but the failure is still reported
+	if err := cache.Set("graph:current:key1", defaultCacheContent, -1); err == nil {
+		t.Errorf("Expected the backend error to be returned")
+	}
+	content, found := cache.Get("graph:current:key1")
+	if !found || string(content) != defaultCacheContent {
+		t.Errorf("Expected the entry to be served from the fallback cache, got %q", string(content))
+	}
+	if _, found := backend.Get("graph:current:key1"); found {
+		t.Errorf("Expected the entry not to be in the backend")
+	}
+
+	// Once the backend recovers, writes go to it again
+	backend.down = false
+	if err := cache.Set("graph:current:key2", "content2", -1); err != nil {
+		t.Errorf("Expected no error, got %v", err)
+	}
+	if _, found := backend.Get("graph:current:key2"); !found {
+		t.Errorf("Expected the entry to be in the backend")
+	}
+
+	keys, err := cache.KeysWithPrefix("graph:current:")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if expected := []string{"graph:current:key1", "graph:current:key2"}; !reflect.DeepEqual(keys, expected) {
+		t.Errorf("Expected keys %v, got %v", expected, keys)
+	}
+
+	// Deleting removes entries from both caches
+	if err := cache.DeleteWithPrefix("graph:current:"); err != nil {
+		t.Errorf("Expected no error, got %v", err)
+	}
+	if _, found := cache.Get("graph:current:key1"); found {
+		t.Errorf("Expected the fallback entry to be deleted")
+	}
+	if _, found := cache.Get("graph:current:key2"); found {
+		t.Errorf("Expected the backend entry to be deleted")
+	}
+}
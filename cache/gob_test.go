@@ -0,0 +1,145 @@
+package cache
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEncodeItemRoundTrip(t *testing.T) {
+	t.Cleanup(func() { SetGobEncoding(false) })
+	item := CacheItem{
+		Content:         []byte(strings.Repeat("type Query { hello: String }\n", 100)),
+		Expiration:      time.Date(2024, 10, 3, 12, 0, 0, 0, time.UTC),
+		Hash:            "hash",
+		LastModified:    time.Date(2024, 10, 3, 11, 0, 0, 0, time.FixedZone("", 2*60*60)),
+		ID:              "id",
+		MinDelaySeconds: 30,
+		Version:         "version",
+		ExtraFields:     json.RawMessage(`{"messages":[]}`),
+		Typename:        "RouterConfigResult",
+	}
+	itemJSON, _ := json.Marshal(item)
+
+	tests := []struct {
+		name string
+		gob  bool
+	}{
+		{name: "json item", gob: false},
+		{name: "gob item", gob: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			SetGobEncoding(tt.gob)
+			encoded, err := EncodeItem(item)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if isGob := bytes.HasPrefix(encoded, []byte(gobPrefix)); isGob != tt.gob {
+				t.Fatalf("Expected the item to be gob-encoded: %v, got %v", tt.gob, isGob)
+			}
+			if tt.gob && len(encoded) >= len(itemJSON) {
+				t.Errorf("Expected the gob-encoded item to be smaller than %d bytes, got %d", len(itemJSON), len(encoded))
+			}
+
+			var decoded CacheItem
+			if err := DecodeItem(encoded, &decoded); err != nil {
+				t.Fatal(err)
+			}
+			if decodedJSON, _ := json.Marshal(decoded); string(decodedJSON) != string(itemJSON) {
+				t.Errorf("Expected the item to round trip, got %s", decodedJSON)
+			}
+		})
+	}
+
+	// gob can't tell empty content apart from no content, which both mean the item has no content
+	SetGobEncoding(true)
+	encoded, _ := EncodeItem(CacheItem{Content: []byte{}, Expiration: IndefiniteTimestamp, Typename: "RouterEntitlementsResult"})
+	var decoded CacheItem
+	if err := DecodeItem(encoded, &decoded); err != nil || len(decoded.Content) != 0 || decoded.Typename != "RouterEntitlementsResult" {
+		t.Errorf("Expected an item without content, got %+v, %v", decoded, err)
+	}
+}
+
+func TestDecodeItemSwitchFormat(t *testing.T) {
+	t.Cleanup(func() { SetGobEncoding(false) })
+	item := CacheItem{Content: []byte("schema"), Expiration: IndefiniteTimestamp, ID: "id"}
+
+	// Items encoded in either format are decoded whatever the current format
+	SetGobEncoding(false)
+	jsonItem, _ := EncodeItem(item)
+	SetGobEncoding(true)
+	gobItem, _ := EncodeItem(item)
+	for _, gob := range []bool{true, false} {
+		SetGobEncoding(gob)
+		for name, encoded := range map[string][]byte{"json": jsonItem, "gob": gobItem} {
+			var decoded CacheItem
+			if err := DecodeItem(encoded, &decoded); err != nil || string(decoded.Content) != "schema" || decoded.ID != "id" {
+				t.Errorf("Expected the %s item to be decoded (gob: %v), got %+v, %v", name, gob, decoded, err)
+			}
+		}
+	}
+
+	// The metadata of gob-encoded items is decoded as well, without their content
+	metadata, err := DecodeMetadata(gobItem)
+	if err != nil || metadata.ID != "id" || !metadata.Expiration.Equal(IndefiniteTimestamp) || metadata.Content != nil {
+		t.Errorf("Expected the metadata of the gob-encoded item, got %+v, %v", metadata, err)
+	}
+
+	// Corrupt items aren't decoded
+	var decoded CacheItem
+	if err := DecodeItem([]byte(gobPrefix+"corrupt"), &decoded); err == nil {
+		t.Errorf("Expected a corrupt gob item not to be decoded")
+	}
+}
+
+// benchmarkItem is a CacheItem with about 1 MB of content, the size of a large supergraph.
+var benchmarkItem = CacheItem{
+	Content:      bytes.Repeat([]byte("type Query { hello: String }\n"), 1<<20/29),
+	Expiration:   IndefiniteTimestamp,
+	Hash:         "hash",
+	LastModified: time.Date(2024, 10, 3, 12, 0, 0, 0, time.UTC),
+	ID:           "id",
+}
+
+func BenchmarkCacheItemSet(b *testing.B) {
+	b.Cleanup(func() { SetGobEncoding(false) })
+	for _, format := range []string{"json", "gob"} {
+		b.Run(format, func(b *testing.B) {
+			SetGobEncoding(format == "gob")
+			systemCache := NewMemoryCache(10)
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				encoded, err := EncodeItem(benchmarkItem)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if err := systemCache.Set("key", string(encoded), -1); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkCacheItemGet(b *testing.B) {
+	b.Cleanup(func() { SetGobEncoding(false) })
+	for _, format := range []string{"json", "gob"} {
+		b.Run(format, func(b *testing.B) {
+			SetGobEncoding(format == "gob")
+			systemCache := NewMemoryCache(10)
+			encoded, _ := EncodeItem(benchmarkItem)
+			systemCache.Set("key", string(encoded), -1)
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				content, _ := systemCache.Get("key")
+				var item CacheItem
+				if err := DecodeItem(content, &item); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
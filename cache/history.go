@@ -0,0 +1,77 @@
+package cache
+
+import (
+	"encoding/json"
+	"sync/atomic"
+	"time"
+)
+
+// historyDepth is the configured number of previous versions of each artifact kept when a newer one is cached; 0 keeps none.
+var historyDepth atomic.Int32
+
+// SetHistoryDepth sets the number of previous versions of each artifact kept from now on when a newer version replaces the default entry.
+func SetHistoryDepth(depth int) {
+	historyDepth.Store(int32(depth))
+}
+
+// HistoryKey returns the cache key of the previous versions of an artifact kept for the graph.
+// It's under the operation's prefix, so deleting the operation's cache entries deletes its history as well.
+func HistoryKey(graphRef string, operationName string) string {
+	return MakeCachePrefix(graphRef, operationName) + ":history"
+}
+
+// History returns the previous versions of an artifact kept for the graph, newest first.
+// Like a pinned entry, the history entry wraps the encoded list of versions in its content.
+func History(systemCache Cache, graphRef string, operationName string) ([]CacheItem, error) {
+	entry, ok := systemCache.Get(HistoryKey(graphRef, operationName))
+	if !ok {
+		return nil, nil
+	}
+	var historyItem CacheItem
+	if err := DecodeItem(entry, &historyItem); err != nil {
+		return nil, err
+	}
+	var versions []CacheItem
+	if err := json.Unmarshal(historyItem.Content, &versions); err != nil {
+		return nil, err
+	}
+	return versions, nil
+}
+
+// recordHistory adds the version being replaced to the history of the artifact, dropping the oldest versions beyond the history depth.
+func recordHistory(systemCache Cache, graphRef string, operationName string, replaced CacheItem) error {
+	depth := int(historyDepth.Load())
+	if depth <= 0 || len(replaced.Content) == 0 {
+		return nil
+	}
+	versions, err := History(systemCache, graphRef, operationName)
+	if err != nil {
+		// A corrupt history is started over rather than blocking the update of the default entry
+		versions = nil
+	}
+
+	history := []CacheItem{replaced}
+	for _, version := range versions {
+		if len(history) >= depth {
+			break
+		}
+		if version.Hash != replaced.Hash {
+			history = append(history, version)
+		}
+	}
+	content, err := json.Marshal(history)
+	if err != nil {
+		return err
+	}
+	historyItem, err := EncodeItem(CacheItem{
+		ID:           replaced.ID,
+		Hash:         replaced.Hash,
+		Expiration:   IndefiniteTimestamp,
+		LastModified: time.Now(),
+		Content:      content,
+	})
+	if err != nil {
+		return err
+	}
+	return systemCache.Set(HistoryKey(graphRef, operationName), string(historyItem), -1)
+}
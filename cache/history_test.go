@@ -0,0 +1,57 @@
+package cache
+
+import (
+	"apollosolutions/uplink-relay/logger"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestUpdateNewestHistory(t *testing.T) {
+	defer SetHistoryDepth(0)
+	pFalse := false
+	testLogger := logger.MakeLogger(&pFalse)
+	graphRef := "graph@current"
+	start := time.Now()
+	update := func(systemCache Cache, version int) {
+		item := CacheItem{
+			ID:           fmt.Sprintf("id%d", version),
+			Hash:         fmt.Sprintf("hash%d", version),
+			Content:      []byte(fmt.Sprintf("schema%d", version)),
+			LastModified: start.Add(time.Duration(version) * time.Second),
+		}
+		if err := UpdateNewest(systemCache, testLogger, graphRef, "SupergraphSdlQuery", item); err != nil {
+			t.Fatalf("UpdateNewest returned an error: %v", err)
+		}
+	}
+
+	// Without a history depth, replaced versions aren't kept
+	systemCache := NewMemoryCache(10)
+	update(systemCache, 1)
+	update(systemCache, 2)
+	if history, err := History(systemCache, graphRef, "SupergraphSdlQuery"); err != nil || len(history) != 0 {
+		t.Errorf("Expected no history, got %v, %v", history, err)
+	}
+
+	// Replaced versions are kept newest first, up to the history depth
+	SetHistoryDepth(2)
+	systemCache = NewMemoryCache(10)
+	for version := 1; version <= 4; version++ {
+		update(systemCache, version)
+	}
+	history, err := History(systemCache, graphRef, "SupergraphSdlQuery")
+	if err != nil {
+		t.Fatalf("History returned an error: %v", err)
+	}
+	if len(history) != 2 || history[0].ID != "id3" || history[1].ID != "id2" || string(history[0].Content) != "schema3" {
+		t.Errorf("Expected versions 3 and 2 in the history, got %+v", history)
+	}
+
+	// The history is deleted along with the operation's entries
+	if err := systemCache.DeleteWithPrefix(MakeCachePrefix(graphRef, "SupergraphSdlQuery")); err != nil {
+		t.Fatal(err)
+	}
+	if history, _ := History(systemCache, graphRef, "SupergraphSdlQuery"); len(history) != 0 {
+		t.Errorf("Expected the history to be deleted, got %+v", history)
+	}
+}
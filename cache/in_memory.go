@@ -1,32 +1,100 @@
 package cache
 
 import (
-	"fmt"
+	"hash/fnv"
+	"math"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 )
 
 // MemoryCache provides a simple in-memory cache.
+// Items are spread across shards, each with its own lock, so requests for different keys don't contend for a single lock.
 type MemoryCache struct {
+	shards []*memoryShard // Shards the items are spread across by the hash of their key.
+}
+
+// memoryShard holds the items of a MemoryCache hashed to it.
+type memoryShard struct {
 	items        map[string]*CacheItem // Map of cache keys to CacheItems.
 	mu           sync.RWMutex          // Read/Write mutex for thread-safe access.
-	maxItems     int                   // Maximum size of the cache.
-	currentItems int                   // Current size of the cache.
+	maxItems     int                   // Maximum size of the shard.
+	currentItems int                   // Current size of the shard.
 }
 
-// NewMemoryCache initializes a new empty MemoryCache.
+// NewMemoryCache initializes a new empty MemoryCache with a single shard.
 func NewMemoryCache(maxItems int) *MemoryCache {
-	return &MemoryCache{items: make(map[string]*CacheItem), maxItems: maxItems}
+	return NewShardedMemoryCache(maxItems, 1)
+}
+
+// NewShardedMemoryCache initializes a new empty MemoryCache spreading its items across the given number of shards.
+// Each shard holds an equal share of maxItems, rounded up, and evicts its own oldest item when full, so eviction is approximate across the cache.
+func NewShardedMemoryCache(maxItems int, shards int) *MemoryCache {
+	if shards < 1 {
+		shards = 1
+	}
+	shardItems := (maxItems + shards - 1) / shards
+	c := &MemoryCache{shards: make([]*memoryShard, shards)}
+	for i := range c.shards {
+		c.shards[i] = &memoryShard{items: make(map[string]*CacheItem), maxItems: shardItems}
+	}
+	return c
+}
+
+// shard returns the shard holding the given key.
+func (c *MemoryCache) shard(key string) *memoryShard {
+	if len(c.shards) == 1 {
+		return c.shards[0]
+	}
+	hash := fnv.New32a()
+	hash.Write([]byte(key))
+	return c.shards[hash.Sum32()%uint32(len(c.shards))]
 }
 
 // Get retrieves an item from the cache if it exists and hasn't expired.
 func (c *MemoryCache) Get(key string) ([]byte, bool) {
-	c.mu.RLock()
-	defer c.mu.RUnlock()
+	return c.shard(key).get(key)
+}
 
-	item, found := c.items[key]
+// Set adds an item to the cache with a specified duration until expiration.
+// If duration is -1, the item never expires and will never be removed, even if it is above the cache capacity.
+func (c *MemoryCache) Set(key string, content string, duration int) error {
+	return c.shard(key).set(key, content, duration)
+}
+
+func (c *MemoryCache) DeleteWithPrefix(prefix string) error {
+	for _, shard := range c.shards {
+		shard.deleteWithPrefix(prefix)
+	}
+	return nil
+}
+
+// KeysWithPrefix lists the keys of all unexpired items with the given prefix.
+func (c *MemoryCache) KeysWithPrefix(prefix string) ([]string, error) {
+	keys := make([]string, 0)
+	for _, shard := range c.shards {
+		keys = shard.appendKeysWithPrefix(keys, prefix)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// TTL returns the seconds left until an item expires, or -1 if it never does, and false if it isn't cached.
+func (c *MemoryCache) TTL(key string) (int, bool) {
+	return c.shard(key).ttl(key)
+}
+
+func (c *MemoryCache) Name() string {
+	return "Memory"
+}
+
+func (s *memoryShard) get(key string) ([]byte, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	item, found := s.items[key]
 
-	fmt.Printf("item: %v\n", item)
 	// If the item is not found or has expired, return a cache miss.
 	// The special case of time.Unix(1<<63-1, 0) is used to indicate that an item never expires- and
 	// time.Before will always return true for this case.
@@ -36,17 +104,30 @@ func (c *MemoryCache) Get(key string) ([]byte, bool) {
 	return item.Content, true
 }
 
-// Set adds an item to the cache with a specified duration until expiration.
-// If duration is -1, the item never expires and will never be removed, even if it is above the cache capacity.
-func (c *MemoryCache) Set(key string, content string, duration int) error {
-	c.mu.Lock()
-	defer c.mu.Unlock()
+func (s *memoryShard) ttl(key string) (int, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	item, found := s.items[key]
+	if !found || timeBeforeWithIndefinite(item.Expiration, time.Now()) {
+		return 0, false
+	}
+	if isIndefinite(item.Expiration) {
+		return -1, true
+	}
+	return int(math.Ceil(time.Until(item.Expiration).Seconds())), true
+}
+
+func (s *memoryShard) set(key string, content string, duration int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	// If the cache is full, remove the oldest item.
-	if c.currentItems >= c.maxItems {
+	// If the shard is full, remove the oldest item; overwriting an item doesn't add to the shard.
+	_, exists := s.items[key]
+	if !exists && s.currentItems >= s.maxItems {
 		var oldestKey string
 		var oldestExpiration time.Time
-		for k, v := range c.items {
+		for k, v := range s.items {
 			if oldestKey == "" || timeBeforeWithIndefinite(v.Expiration, oldestExpiration) {
 				if isIndefinite(v.Expiration) {
 					continue
@@ -55,8 +136,11 @@ func (c *MemoryCache) Set(key string, content string, duration int) error {
 				oldestExpiration = v.Expiration
 			}
 		}
-		delete(c.items, oldestKey)
-		c.currentItems--
+		// Items that never expire are never removed, so the shard may be left above its capacity
+		if oldestKey != "" {
+			delete(s.items, oldestKey)
+			s.currentItems--
+		}
 	}
 
 	expiration := time.Now().Add(time.Duration(duration) * time.Second)
@@ -64,26 +148,35 @@ func (c *MemoryCache) Set(key string, content string, duration int) error {
 		expiration = IndefiniteTimestamp
 	}
 
-	c.items[key] = &CacheItem{Content: []byte(content), Expiration: expiration}
-	c.currentItems++
+	s.items[key] = &CacheItem{Content: []byte(content), Expiration: expiration}
+	if !exists {
+		s.currentItems++
+	}
 
 	return nil
 }
 
-func (c *MemoryCache) DeleteWithPrefix(prefix string) error {
-	c.mu.Lock()
-	defer c.mu.Unlock()
+func (s *memoryShard) deleteWithPrefix(prefix string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	for k := range c.items {
+	for k := range s.items {
 		if len(prefix) < len(k) && k[:len(prefix)] == prefix {
-			delete(c.items, k)
-			c.currentItems--
+			delete(s.items, k)
+			s.currentItems--
 		}
 	}
-
-	return nil
 }
 
-func (c *MemoryCache) Name() string {
-	return "Memory"
+// appendKeysWithPrefix appends the keys of the shard's unexpired items with the given prefix to keys.
+func (s *memoryShard) appendKeysWithPrefix(keys []string, prefix string) []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for k, item := range s.items {
+		if strings.HasPrefix(k, prefix) && !timeBeforeWithIndefinite(item.Expiration, time.Now()) {
+			keys = append(keys, k)
+		}
+	}
+	return keys
 }
@@ -0,0 +1,126 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// Loader fetches the content of a key missing from the cache, e.g. from uplink. Loaders cache the content themselves,
+// as only they know how long it should be cached for, and return the content that was cached.
+type Loader func() ([]byte, error)
+
+// LoadingCache wraps a cache, loading the content of keys missing from it with a loader.
+// Concurrent loads of the same key are shared, so many routers missing the cache at once result in a single request to uplink.
+type LoadingCache struct {
+	cache Cache // Underlying cache.
+
+	mu    sync.Mutex
+	loads map[string]*load // Loads in flight, by key.
+}
+
+// load is a load in flight, whose result is shared by every caller waiting for it.
+type load struct {
+	done    chan struct{} // Closed once the load completes.
+	content []byte
+	err     error
+}
+
+// NewLoadingCache creates a new LoadingCache around the given cache.
+func NewLoadingCache(cache Cache) *LoadingCache {
+	return &LoadingCache{cache: cache, loads: make(map[string]*load)}
+}
+
+// GetOrLoad retrieves an item from the underlying cache, or loads it with the loader on a cache miss.
+// The loader runs in the calling goroutine; callers missing the cache while a load of the key is in flight wait for it and share its result,
+// or return the context's error if it's done first.
+func (c *LoadingCache) GetOrLoad(ctx context.Context, key string, loader Loader) ([]byte, error) {
+	if content, ok := c.cache.Get(key); ok {
+		return content, nil
+	}
+	return c.Load(ctx, key, loader)
+}
+
+// Load loads the key with the loader even if it's cached, e.g. to replace an entry too old to be served.
+// Like GetOrLoad, the loader runs in the calling goroutine, and callers loading the key while a load of it is in flight wait for it and share its result.
+func (c *LoadingCache) Load(ctx context.Context, key string, loader Loader) ([]byte, error) {
+	l, leader := c.join(key)
+	if leader {
+		c.run(key, l, loader)
+		return l.content, l.err
+	}
+	select {
+	case <-l.done:
+		return l.content, l.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Refresh loads the key with the loader in the background, even if it's cached, so expired entries can be refreshed while they're still served.
+// Cache misses for the key wait for the refresh rather than loading it themselves. It returns false, without loading the key, if a load of the key is already in flight.
+func (c *LoadingCache) Refresh(key string, loader Loader) bool {
+	l, leader := c.join(key)
+	if !leader {
+		return false
+	}
+	go c.run(key, l, loader)
+	return true
+}
+
+// join returns the load in flight for the key, or registers a new one if there's none, in which case the caller leads it and must run it.
+func (c *LoadingCache) join(key string) (*load, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if l, ok := c.loads[key]; ok {
+		return l, false
+	}
+	l := &load{done: make(chan struct{})}
+	c.loads[key] = l
+	return l, true
+}
+
+// run runs the loader for the load, releasing the callers waiting for it once it completes, even if the loader panics.
+func (c *LoadingCache) run(key string, l *load, loader Loader) {
+	l.err = fmt.Errorf("loading %s didn't complete", key) // Shared if the loader panics.
+	defer c.finish(key, l)
+	l.content, l.err = loader()
+}
+
+// finish removes the load from the loads in flight and releases the callers waiting for it.
+func (c *LoadingCache) finish(key string, l *load) {
+	c.mu.Lock()
+	delete(c.loads, key)
+	c.mu.Unlock()
+	close(l.done)
+}
+
+// Get retrieves an item from the underlying cache, without loading it on a miss.
+func (c *LoadingCache) Get(key string) ([]byte, bool) {
+	return c.cache.Get(key)
+}
+
+// Set adds an item to the underlying cache.
+func (c *LoadingCache) Set(key string, content string, duration int) error {
+	return c.cache.Set(key, content, duration)
+}
+
+// DeleteWithPrefix deletes all items with the given prefix from the underlying cache.
+func (c *LoadingCache) DeleteWithPrefix(prefix string) error {
+	return c.cache.DeleteWithPrefix(prefix)
+}
+
+// KeysWithPrefix lists the keys of all items with the given prefix in the underlying cache.
+func (c *LoadingCache) KeysWithPrefix(prefix string) ([]string, error) {
+	return c.cache.KeysWithPrefix(prefix)
+}
+
+// TTL returns the seconds left until an item of the underlying cache expires.
+func (c *LoadingCache) TTL(key string) (int, bool) {
+	return c.cache.TTL(key)
+}
+
+// Name returns the name of the underlying cache.
+func (c *LoadingCache) Name() string {
+	return c.cache.Name()
+}
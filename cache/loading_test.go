@@ -0,0 +1,181 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLoadingCacheGetOrLoadConcurrent(t *testing.T) {
+	loadingCache := NewLoadingCache(NewMemoryCache(10))
+
+	var loads atomic.Int32
+	release := make(chan struct{})
+	loader := func() ([]byte, error) {
+		loads.Add(1)
+		<-release
+		loadingCache.Set("key", "content", 60)
+		return []byte("content"), nil
+	}
+
+	// Every concurrent miss waits for the first one's load rather than loading the key itself
+	var wg sync.WaitGroup
+	results := make(chan string, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			content, err := loadingCache.GetOrLoad(context.Background(), "key", loader)
+			if err != nil {
+				t.Errorf("GetOrLoad returned an error: %v", err)
+			}
+			results <- string(content)
+		}()
+	}
+	// Give the callers time to join the load before it completes
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	close(results)
+
+	if loads.Load() != 1 {
+		t.Errorf("Expected a single load, got %d", loads.Load())
+	}
+	for content := range results {
+		if content != "content" {
+			t.Errorf("Expected every caller to get the loaded content, got %q", content)
+		}
+	}
+
+	// Cached keys aren't loaded again
+	if content, err := loadingCache.GetOrLoad(context.Background(), "key", loader); err != nil || string(content) != "content" || loads.Load() != 1 {
+		t.Errorf("Expected the cached content without loading it, got %q, %v after %d loads", content, err, loads.Load())
+	}
+}
+
+func TestLoadingCacheGetOrLoadError(t *testing.T) {
+	loadingCache := NewLoadingCache(NewMemoryCache(10))
+	errUplink := errors.New("uplink unavailable")
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	leaderErr := make(chan error, 1)
+	go func() {
+		_, err := loadingCache.GetOrLoad(context.Background(), "key", func() ([]byte, error) {
+			close(started)
+			<-release
+			return nil, errUplink
+		})
+		leaderErr <- err
+	}()
+	<-started
+
+	// A caller whose context is done stops waiting for the load
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := loadingCache.GetOrLoad(ctx, "key", nil); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected the context's error, got %v", err)
+	}
+
+	// The load's error is shared with the callers waiting for it
+	waiterErr := make(chan error, 1)
+	go func() {
+		_, err := loadingCache.GetOrLoad(context.Background(), "key", nil)
+		waiterErr <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	if err := <-leaderErr; !errors.Is(err, errUplink) {
+		t.Errorf("Expected the loader's error, got %v", err)
+	}
+	if err := <-waiterErr; !errors.Is(err, errUplink) {
+		t.Errorf("Expected the waiting caller to get the loader's error, got %v", err)
+	}
+
+	// Failed loads aren't remembered, so the next miss loads the key again
+	content, err := loadingCache.GetOrLoad(context.Background(), "key", func() ([]byte, error) {
+		return []byte("content"), nil
+	})
+	if err != nil || string(content) != "content" {
+		t.Errorf("Expected the key to be loaded again, got %q, %v", content, err)
+	}
+}
+
+func TestLoadingCacheRefresh(t *testing.T) {
+	loadingCache := NewLoadingCache(NewMemoryCache(10))
+	loadingCache.Set("key", "stale", 60)
+
+	release := make(chan struct{})
+	refresh := func() ([]byte, error) {
+		<-release
+		loadingCache.Set("key", "fresh", 60)
+		return []byte("fresh"), nil
+	}
+	if !loadingCache.Refresh("key", refresh) {
+		t.Fatalf("Expected the cached key to be refreshed")
+	}
+	if loadingCache.Refresh("key", refresh) {
+		t.Errorf("Expected a single refresh of the key at a time")
+	}
+
+	// Misses for the key wait for the refresh rather than loading it themselves
+	loadingCache.DeleteWithPrefix("k")
+	done := make(chan []byte, 1)
+	go func() {
+		content, _ := loadingCache.GetOrLoad(context.Background(), "key", func() ([]byte, error) {
+			t.Errorf("Expected the miss to wait for the refresh")
+			return nil, nil
+		})
+		done <- content
+	}()
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	if content := <-done; string(content) != "fresh" {
+		t.Errorf("Expected the refreshed content, got %q", content)
+	}
+}
+
+func TestLoadingCacheLoad(t *testing.T) {
+	loadingCache := NewLoadingCache(NewMemoryCache(10))
+	loadingCache.Set("key", "old", 60)
+
+	var loads atomic.Int32
+	release := make(chan struct{})
+	loader := func() ([]byte, error) {
+		loads.Add(1)
+		<-release
+		loadingCache.Set("key", "new", 60)
+		return []byte("new"), nil
+	}
+
+	// Cached keys are loaded again, and concurrent loads share a single load
+	var wg sync.WaitGroup
+	results := make(chan string, 5)
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			content, err := loadingCache.Load(context.Background(), "key", loader)
+			if err != nil {
+				t.Errorf("Load returned an error: %v", err)
+			}
+			results <- string(content)
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	close(results)
+
+	if loads.Load() != 1 {
+		t.Errorf("Expected a single load, got %d", loads.Load())
+	}
+	for content := range results {
+		if content != "new" {
+			t.Errorf("Expected every caller to get the loaded content, got %q", content)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package cache
+
+import "time"
+
+// StaleCache wraps a cache, keeping entries for a grace period after their duration, so expired entries can still be served while they're refreshed.
+type StaleCache struct {
+	cache Cache // Underlying cache.
+	grace int   // Seconds to keep entries after their duration.
+}
+
+// NewStaleCache creates a new StaleCache around the given cache, keeping entries for the given grace period in seconds.
+func NewStaleCache(cache Cache, grace int) *StaleCache {
+	return &StaleCache{cache: cache, grace: grace}
+}
+
+// Get retrieves an item from the underlying cache, including items past their duration but within the grace period.
+func (c *StaleCache) Get(key string) ([]byte, bool) {
+	return c.cache.Get(key)
+}
+
+// Set adds an item to the underlying cache for the given duration plus the grace period. Items without an expiration are stored as-is.
+func (c *StaleCache) Set(key string, content string, duration int) error {
+	if duration >= 0 {
+		duration += c.grace
+	}
+	return c.cache.Set(key, content, duration)
+}
+
+// DeleteWithPrefix deletes all items with the given prefix from the underlying cache.
+func (c *StaleCache) DeleteWithPrefix(prefix string) error {
+	return c.cache.DeleteWithPrefix(prefix)
+}
+
+// KeysWithPrefix lists the keys of all items with the given prefix in the underlying cache.
+func (c *StaleCache) KeysWithPrefix(prefix string) ([]string, error) {
+	return c.cache.KeysWithPrefix(prefix)
+}
+
+// TTL returns the seconds left until an item's duration is over, not counting the grace period, so an item written again with it,
+// e.g. when importing a cache archive, isn't given the grace period twice. Items within their grace period have no time left.
+func (c *StaleCache) TTL(key string) (int, bool) {
+	ttl, ok := c.cache.TTL(key)
+	if !ok || ttl < 0 {
+		return ttl, ok
+	}
+	return max(ttl-c.grace, 0), true
+}
+
+// Name returns the name of the underlying cache.
+func (c *StaleCache) Name() string {
+	return c.cache.Name()
+}
+
+// IsStale returns whether the item was last modified longer ago than the given duration in seconds, meaning it's only still cached because of a grace period.
+// Items cached indefinitely, or without a LastModified time, are never stale.
+func IsStale(item *CacheItem, duration int, now time.Time) bool {
+	if duration < 0 || item.LastModified.IsZero() {
+		return false
+	}
+	return now.Sub(item.LastModified) > time.Duration(duration)*time.Second
+}
@@ -0,0 +1,64 @@
+package cache
+
+import (
+	"testing"
+	"time"
+)
+
+// durationCache wraps a MemoryCache, recording the duration of the last write.
+type durationCache struct {
+	*MemoryCache
+	duration int
+}
+
+func (c *durationCache) Set(key string, content string, duration int) error {
+	c.duration = duration
+	return c.MemoryCache.Set(key, content, duration)
+}
+
+func TestStaleCache(t *testing.T) {
+	backend := &durationCache{MemoryCache: NewMemoryCache(10)}
+	cache := NewStaleCache(backend, 30)
+
+	// Entries are kept for the grace period after their duration
+	cache.Set("graph:current:key1", defaultCacheContent, 60)
+	if backend.duration != 90 {
+		t.Errorf("Expected the entry to be stored for 90 seconds, got %d", backend.duration)
+	}
+	if content, found := cache.Get("graph:current:key1"); !found || string(content) != defaultCacheContent {
+		t.Errorf("Expected the entry to be found, got %q", string(content))
+	}
+	// The TTL doesn't count the grace period
+	if ttl, ok := cache.TTL("graph:current:key1"); !ok || ttl != 60 {
+		t.Errorf("Expected a TTL of 60 seconds, got %d", ttl)
+	}
+
+	// Indefinite entries stay indefinite
+	cache.Set("graph:current:key2", defaultCacheContent, -1)
+	if backend.duration != -1 {
+		t.Errorf("Expected the entry to be stored indefinitely, got %d", backend.duration)
+	}
+}
+
+func TestIsStale(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name     string
+		item     CacheItem
+		duration int
+		expected bool
+	}{
+		{"fresh", CacheItem{LastModified: now.Add(-30 * time.Second)}, 60, false},
+		{"stale", CacheItem{LastModified: now.Add(-90 * time.Second)}, 60, true},
+		{"indefinite", CacheItem{LastModified: now.Add(-90 * time.Second)}, -1, false},
+		{"no last modified", CacheItem{}, 60, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if stale := IsStale(&tt.item, tt.duration, now); stale != tt.expected {
+				t.Errorf("Expected stale to be %v, got %v", tt.expected, stale)
+			}
+		})
+	}
+}
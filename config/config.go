@@ -2,13 +2,27 @@ package config
 
 import (
 	"bytes"
+	"crypto"
+	"crypto/x509"
 	"encoding/json"
+	"encoding/pem"
+	"errors"
 	"fmt"
+	"io"
 	"log/slog"
+	"net"
+	"net/netip"
 	"net/url"
 	"os"
 	"reflect"
+	"regexp"
 	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"apollosolutions/uplink-relay/internal/relayerrors"
+	"apollosolutions/uplink-relay/uplink"
 
 	"github.com/invopop/jsonschema"
 	"github.com/robfig/cron/v3"
@@ -18,22 +32,73 @@ import (
 // Config represents the application's configuration structure,
 // housing Relay, Uplink, and Cache configurations.
 type Config struct {
-	Relay           RelayConfig           `yaml:"relay" json:"relay"`                           // RelayConfig for incoming connections.
-	Uplink          UplinkConfig          `yaml:"uplink" json:"uplink"`                         // UplinkConfig for managing uplink configuration.
-	Cache           CacheConfig           `yaml:"cache" json:"cache,omitempty"`                 // CacheConfig for cache settings.
-	Redis           RedisConfig           `yaml:"redis" json:"redis,omitempty"`                 // RedisConfig for using redis as cache.
-	FilesystemCache FilesystemCacheConfig `yaml:"filesystem" json:"filesystem,omitempty"`       // FilesystemCacheConfig for using filesystem as cache.
-	Supergraphs     []SupergraphConfig    `yaml:"supergraphs" json:"supergraphs,omitempty"`     // SupergraphConfig for supergraph settings.
-	Webhook         WebhookConfig         `yaml:"webhook" json:"webhook,omitempty"`             // WebhookConfig for webhook handling.
-	Polling         PollingConfig         `yaml:"polling" json:"polling,omitempty"`             // PollingConfig for polling settings.
-	ManagementAPI   ManagementAPIConfig   `yaml:"managementAPI" json:"managementAPI,omitempty"` // ManagementAPIConfig for management API settings.
+	Relay            RelayConfig            `yaml:"relay" json:"relay"`                                 // RelayConfig for incoming connections.
+	Uplink           UplinkConfig           `yaml:"uplink" json:"uplink"`                               // UplinkConfig for managing uplink configuration.
+	Cache            CacheConfig            `yaml:"cache" json:"cache,omitempty"`                       // CacheConfig for cache settings.
+	Redis            RedisConfig            `yaml:"redis" json:"redis,omitempty"`                       // RedisConfig for using redis as cache.
+	FilesystemCache  FilesystemCacheConfig  `yaml:"filesystem" json:"filesystem,omitempty"`             // FilesystemCacheConfig for using filesystem as cache.
+	Supergraphs      []SupergraphConfig     `yaml:"supergraphs" json:"supergraphs,omitempty"`           // SupergraphConfig for supergraph settings.
+	Webhook          WebhookConfig          `yaml:"webhook" json:"webhook,omitempty"`                   // WebhookConfig for webhook handling.
+	Polling          PollingConfig          `yaml:"polling" json:"polling,omitempty"`                   // PollingConfig for polling settings.
+	ManagementAPI    ManagementAPIConfig    `yaml:"managementAPI" json:"managementAPI,omitempty"`       // ManagementAPIConfig for management API settings.
+	Metrics          MetricsConfig          `yaml:"metrics" json:"metrics,omitempty"`                   // MetricsConfig for metrics settings.
+	PersistedQueries PersistedQueriesConfig `yaml:"persistedQueries" json:"persistedQueries,omitempty"` // PersistedQueriesConfig for persisted query chunk caching.
+	Audit            AuditConfig            `yaml:"audit" json:"audit,omitempty"`                       // AuditConfig for the audit trail of upstream requests.
+	Health           HealthConfig           `yaml:"health" json:"health,omitempty"`                     // HealthConfig for the health checks.
+	OfflineLicenses  OfflineLicenseConfig   `yaml:"offlineLicenses" json:"offlineLicenses,omitempty"`   // OfflineLicenseConfig for verifying offline licenses before they're pinned.
+
+	cacheDuration atomic.Int64 // Cache duration set at runtime with SetCacheDuration, in seconds; 0 when unset.
+}
+
+// CacheDuration returns the duration, in seconds, to cache content for: the one set at runtime with SetCacheDuration, or else Cache.Duration.
+// Handlers read it while the management API may change it, so it's read atomically.
+func (c *Config) CacheDuration() int {
+	if duration := c.cacheDuration.Load(); duration != 0 {
+		return int(duration)
+	}
+	return c.Cache.Duration
+}
+
+// SetCacheDuration changes the duration, in seconds, that content is cached for from now on, until the configuration is reloaded.
+func (c *Config) SetCacheDuration(seconds int) {
+	c.cacheDuration.Store(int64(seconds))
 }
 
 // RelayConfig defines the address the proxy server listens on.
 type RelayConfig struct {
-	Address   string         `yaml:"address" json:"address,omitempty" jsonschema:"default=localhost:8080,example=0.0.0.0:8000"` // Address to bind the relay server on.
-	TLS       RelayTlsConfig `yaml:"tls" json:"tls,omitempty"`                                                                  // TLS configuration for the relay server.
-	PublicURL string         `yaml:"publicURL" json:"publicURL,omitempty"`                                                      // Public URL for the relay server.
+	Address                  string            `yaml:"address" json:"address,omitempty" jsonschema:"default=localhost:8080,example=0.0.0.0:8000"` // Address to bind the relay server on. Use unix:/path/to.sock to listen on a Unix domain socket.
+	Addresses                []string          `yaml:"addresses" json:"addresses,omitempty" jsonschema:"example=[::1]:8080"`                      // Additional addresses to bind the relay server on, e.g. both an IPv4 and an IPv6 address; every address serves the same handlers.
+	TLS                      RelayTlsConfig    `yaml:"tls" json:"tls,omitempty"`                                                                  // TLS configuration for the relay server.
+	PublicURL                string            `yaml:"publicURL" json:"publicURL,omitempty"`                                                      // Public URL for the relay server.
+	EmitCacheHeaders         bool              `yaml:"emitCacheHeaders" json:"emitCacheHeaders,omitempty" jsonschema:"default=false"`             // Whether to set Cache-Control and Age headers on cached responses.
+	ErrorMinDelaySeconds     int               `yaml:"errorMinDelaySeconds" json:"errorMinDelaySeconds,omitempty" jsonschema:"default=30"`        // minDelaySeconds returned to routers in FetchError responses when uplink can't be reached.
+	StrictOperations         bool              `yaml:"strictOperations" json:"strictOperations,omitempty" jsonschema:"default=false"`             // Whether to reject requests for operations other than the known uplink operations instead of proxying them.
+	OperationAliases         map[string]string `yaml:"operationAliases" json:"operationAliases,omitempty"`                                        // Alternate operation names sent by some router versions, mapped to the uplink operation they're handled as, e.g. PersistedQueriesQuery to PersistedQueriesManifestQuery.
+	RestrictGraphs           bool              `yaml:"restrictGraphs" json:"restrictGraphs,omitempty" jsonschema:"default=false"`                 // Whether to reject requests for graphs that aren't configured instead of proxying them with the router's API key.
+	SocketMode               string            `yaml:"socketMode" json:"socketMode,omitempty" jsonschema:"default=0660"`                          // Octal file permissions of the socket file when listening on a Unix domain socket.
+	Path                     string            `yaml:"path" json:"path,omitempty" jsonschema:"default=/,example=/uplink"`                         // Path to mount the relay under, e.g. when sharing a gateway with other services.
+	CORS                     CORSConfig        `yaml:"cors" json:"cors,omitempty"`                                                                // CORS configuration for the relay and persisted query endpoints.
+	HealthPing               HealthPingConfig  `yaml:"healthPing" json:"healthPing,omitempty"`                                                    // Fixed response to load balancer health pings on the relay path, i.e. GET or HEAD requests without a body.
+	AllowedCIDRs             []string          `yaml:"allowedCIDRs" json:"allowedCIDRs,omitempty" jsonschema:"example=10.0.0.0/8"`                // Client IPs or CIDR ranges allowed to call the relay and persisted query endpoints; when empty, any client is allowed. Clients on a unix: address aren't checked, as the socket's file permissions control access to it.
+	TrustedProxies           []string          `yaml:"trustedProxies" json:"trustedProxies,omitempty" jsonschema:"example=10.0.0.0/8"`            // IPs or CIDR ranges of proxies, such as load balancers, whose X-Forwarded-For and Forwarded headers are trusted to identify the client.
+	MaxConcurrentConnections int               `yaml:"maxConcurrentConnections" json:"maxConcurrentConnections,omitempty" jsonschema:"default=0"` // Maximum number of connections each listener keeps open; connections beyond it are closed as soon as they're accepted. 0 disables the limit.
+	RedactedVariables        []string          `yaml:"redactedVariables" json:"redactedVariables,omitempty" jsonschema:"default=apiKey"`          // Operation variables whose values are redacted when request bodies are logged in debug mode.
+	RedactedHeaders          []string          `yaml:"redactedHeaders" json:"redactedHeaders,omitempty" jsonschema:"example=Authorization"`       // Request and response headers whose values are redacted when headers are logged in debug mode.
+	PinnedClockSkew          int               `yaml:"pinnedClockSkew" json:"pinnedClockSkew,omitempty" jsonschema:"default=5"`                   // Seconds a pinned entry may be modified before a router's ifAfterId and still be served in full, allowing for clock differences; -1 disables it.
+}
+
+// HealthPingConfig defines the response to load balancer health pings, which would otherwise be rejected, as uplink requests are POSTs.
+type HealthPingConfig struct {
+	Enabled *bool  `yaml:"enabled" json:"enabled,omitempty" jsonschema:"default=true"` // Whether to respond to health pings with 200 OK, or 503 Service Unavailable while shutting down, instead of rejecting them with 405 Method Not Allowed, like other requests that aren't POSTs.
+	Body    string `yaml:"body" json:"body,omitempty" jsonschema:"default=OK"`         // Body of the response to health pings.
+}
+
+// CORSConfig defines the CORS headers returned to browsers calling the relay directly, e.g. Apollo Sandbox.
+type CORSConfig struct {
+	Enabled        bool     `yaml:"enabled" json:"enabled" jsonschema:"default=false"`       // Whether to answer preflight requests and set CORS headers.
+	AllowedOrigins []string `yaml:"allowedOrigins" json:"allowedOrigins,omitempty"`          // Origins allowed to call the relay; "*" allows any origin.
+	AllowedHeaders []string `yaml:"allowedHeaders" json:"allowedHeaders,omitempty"`          // Request headers allowed in CORS requests.
+	MaxAge         int      `yaml:"maxAge" json:"maxAge,omitempty" jsonschema:"default=600"` // How long browsers may cache preflight responses, in seconds.
 }
 
 // RelayTlsConfig defines the TLS configuration for the relay server.
@@ -44,17 +109,113 @@ type RelayTlsConfig struct {
 
 // UplinkConfig details the configuration for connecting to upstream servers.
 type UplinkConfig struct {
-	URLs         []string `yaml:"urls" json:"urls"`                           // List of URLs to use as uplink targets.
-	Timeout      int      `yaml:"timeout" json:"timeout,omitempty"`           // Timeout for uplink requests, in seconds.
-	RetryCount   int      `yaml:"retryCount" json:"retryCount,omitempty"`     // Number of times to retry on uplink failure.
-	StudioAPIURL string   `yaml:"studioAPIURL" json:"studioAPIURL,omitempty"` // URL for the Studio API.
+	URLs                []string          `yaml:"urls" json:"urls"`                                                                                                // List of URLs to use as uplink targets.
+	Timeout             int               `yaml:"timeout" json:"timeout,omitempty"`                                                                                // Timeout for uplink requests, in seconds.
+	DialTimeout         int               `yaml:"dialTimeout" json:"dialTimeout,omitempty" jsonschema:"default=10"`                                                // Timeout for connecting to uplink and the Studio API, in seconds, so an unreachable URL fails fast rather than after the request timeout.
+	TLSHandshakeTimeout int               `yaml:"tlsHandshakeTimeout" json:"tlsHandshakeTimeout,omitempty" jsonschema:"default=10"`                                // Timeout for the TLS handshake with uplink and the Studio API, in seconds.
+	RetryCount          int               `yaml:"retryCount" json:"retryCount,omitempty"`                                                                          // Number of times to retry on uplink failure.
+	StudioAPIURL        string            `yaml:"studioAPIURL" json:"studioAPIURL,omitempty"`                                                                      // URL for the Studio API.
+	StudioRetryCount    *int              `yaml:"studioRetryCount" json:"studioRetryCount,omitempty" jsonschema:"default=3"`                                       // Number of times to retry transient Studio API failures when pinning; 0 disables retries.
+	Strategy            string            `yaml:"strategy" json:"strategy,omitempty" jsonschema:"enum=roundrobin,enum=random,enum=leastloaded,default=roundrobin"` // Strategy for selecting the uplink URL for each request.
+	VerifyKeysOnStart   bool              `yaml:"verifyKeysOnStart" json:"verifyKeysOnStart,omitempty" jsonschema:"default=false"`                                 // Whether to verify each supergraph's API key against uplink on startup.
+	RequireValidKeys    bool              `yaml:"requireValidKeys" json:"requireValidKeys,omitempty" jsonschema:"default=false"`                                   // Whether to refuse to start if any API key fails verification.
+	StrictDecode        bool              `yaml:"strictDecode" json:"strictDecode,omitempty" jsonschema:"default=false"`                                           // Whether to reject, and log, uplink responses with fields the relay doesn't expect, to detect changes to uplink's response format.
+	SkipUnchangedPins   bool              `yaml:"skipUnchangedPins" json:"skipUnchangedPins,omitempty" jsonschema:"default=false"`                                 // Whether to skip fetching pinned launches and persisted query versions from Studio on startup and reload when they're already cached.
+	DefaultApolloKey    string            `yaml:"defaultApolloKey" json:"defaultApolloKey,omitempty"`                                                              // API key for supergraphs that don't set their own apolloKey, e.g. when every graph uses the same service key.
+	RetryBudget         RetryBudgetConfig `yaml:"retryBudget" json:"retryBudget,omitempty"`                                                                        // Budget of retries shared by every relay request, so retries stop when most requests to uplink fail.
+}
+
+// RetryBudgetConfig throttles retries to uplink across all requests, like gRPC retry throttling: each failed request spends a token,
+// each successful request earns back tokenRatio of one, and requests are only retried while more than half of maxTokens remain.
+type RetryBudgetConfig struct {
+	Enabled    bool    `yaml:"enabled" json:"enabled,omitempty" jsonschema:"default=false"`     // Whether retries are limited by the budget rather than only by retryCount.
+	MaxTokens  int     `yaml:"maxTokens" json:"maxTokens,omitempty" jsonschema:"default=100"`   // Number of tokens in the budget, which starts full.
+	TokenRatio float64 `yaml:"tokenRatio" json:"tokenRatio,omitempty" jsonschema:"default=0.1"` // Fraction of a token earned back by each successful request.
 }
 
 // CacheConfig specifies the cache duration and max size.
 type CacheConfig struct {
-	Enabled  bool `yaml:"enabled" json:"enabled" jsonschema:"default=true"` // Whether in-memory caching is enabled.
-	Duration int  `yaml:"duration" json:"duration,omitempty"`               // Duration to keep in-memory cached content, in seconds.
-	MaxSize  int  `yaml:"maxSize" json:"maxSize,omitempty"`                 // Maximum size of the in-memory cache.
+	Enabled             bool                  `yaml:"enabled" json:"enabled" jsonschema:"default=true"`                                                          // Whether in-memory caching is enabled.
+	Duration            int                   `yaml:"duration" json:"duration,omitempty"`                                                                        // Duration to keep in-memory cached content, in seconds.
+	MaxSize             int                   `yaml:"maxSize" json:"maxSize,omitempty"`                                                                          // Maximum size of the in-memory cache.
+	Shards              int                   `yaml:"shards" json:"shards,omitempty" jsonschema:"default=1"`                                                     // Number of shards the in-memory cache is split into, each with its own lock and an equal share of maxSize, reducing lock contention with many distinct keys; eviction is then per shard.
+	Compress            bool                  `yaml:"compress" json:"compress,omitempty" jsonschema:"default=false"`                                             // Whether to compress large entries in every cache backend.
+	CompressMinSize     int                   `yaml:"compressMinSize" json:"compressMinSize,omitempty" jsonschema:"default=1024"`                                // Minimum size of an entry, in bytes, before it's compressed.
+	Fallback            *bool                 `yaml:"fallback" json:"fallback,omitempty" jsonschema:"default=true"`                                              // Whether to keep entries in memory when the filesystem or Redis cache fails, so routers aren't all sent to uplink.
+	FallbackDuration    int                   `yaml:"fallbackDuration" json:"fallbackDuration,omitempty" jsonschema:"default=30"`                                // Duration to keep entries in the fallback cache, in seconds.
+	StaleGrace          int                   `yaml:"staleGrace" json:"staleGrace,omitempty" jsonschema:"default=0"`                                             // Seconds after the duration during which expired entries are still served while they're refreshed in the background; 0 disables it.
+	MaxServeAge         int                   `yaml:"maxServeAge" json:"maxServeAge,omitempty" jsonschema:"default=0"`                                           // Maximum age, in seconds, of a cached item served on a cache hit regardless of its duration; older items are fetched again and only served if uplink fails. 0 disables it.
+	Operations          CacheOperationsConfig `yaml:"operations" json:"operations,omitempty"`                                                                    // Per-artifact caching toggles, defaulting to the enabled setting.
+	MissingEntitlement  string                `yaml:"missingEntitlement" json:"missingEntitlement,omitempty" jsonschema:"enum=none,enum=unchanged,default=none"` // How cached license responses for graphs without an entitlement are replayed: "none" replays uplink's result without an entitlement, and "unchanged" replays them as Unchanged, like earlier versions.
+	Deduplicate         bool                  `yaml:"deduplicate" json:"deduplicate,omitempty" jsonschema:"default=false"`                                       // Whether to store identical content, such as a supergraph shared by several variants, once in every cache backend.
+	HistoryDepth        int                   `yaml:"historyDepth" json:"historyDepth,omitempty" jsonschema:"default=0"`                                         // Number of previous versions of each graph's supergraph, license and persisted query manifest kept when a newer one is cached, so they can be retrieved from the management API; 0 keeps none.
+	KeyVersion          string                `yaml:"keyVersion" json:"keyVersion,omitempty" jsonschema:"example=v2"`                                            // Version prepended to every cache key; changing it invalidates every cached entry at once, as entries cached with another version are no longer read and age out.
+	SerializationFormat string                `yaml:"serializationFormat" json:"serializationFormat,omitempty" jsonschema:"enum=json,enum=gob,default=json"`     // Encoding of cached items in every cache backend: "json", or the more compact "gob". Items in either format are read regardless.
+	Tiers               []CacheTierConfig     `yaml:"tiers" json:"tiers,omitempty"`                                                                              // Lookup order and access modes of the enabled cache backends; backends that aren't listed are looked up after the listed ones, in the default memory, filesystem, Redis order.
+}
+
+// CacheTierConfig defines the position and access mode of a cache backend in the tiered cache.
+type CacheTierConfig struct {
+	Name string `yaml:"name" json:"name" jsonschema:"enum=memory,enum=filesystem,enum=redis"`                                  // Cache backend: "memory", "filesystem" or "redis".
+	Mode string `yaml:"mode" json:"mode,omitempty" jsonschema:"enum=readWrite,enum=readOnly,enum=writeOnly,default=readWrite"` // Whether the backend is read and written, only read (e.g. a cache populated by another relay), or only written.
+}
+
+// Cache backends, in their default lookup order.
+const (
+	CacheTierMemory     = "memory"
+	CacheTierFilesystem = "filesystem"
+	CacheTierRedis      = "redis"
+)
+
+// Access modes of cache backends in the tiered cache.
+const (
+	CacheTierReadWrite = "readWrite" // Entries are looked up in the backend and written to it.
+	CacheTierReadOnly  = "readOnly"  // Entries are looked up in the backend, but never written to or deleted from it.
+	CacheTierWriteOnly = "writeOnly" // Entries are written to and deleted from the backend, but never looked up in it.
+)
+
+// Ways of replaying cached license responses for graphs without an entitlement.
+const (
+	MissingEntitlementNone      = "none"      // Replay uplink's RouterEntitlementsResult without an entitlement, so routers drop their license.
+	MissingEntitlementUnchanged = "unchanged" // Replay the response as Unchanged, so routers keep their current license.
+)
+
+// Encodings of cached items.
+const (
+	SerializationFormatJSON = "json" // Items are stored as JSON, as written by the relay.
+	SerializationFormatGob  = "gob"  // Items are stored gob-encoded, which doesn't base64-encode their content.
+)
+
+// CacheOperationsConfig enables or disables caching per artifact, so some artifacts can always be proxied to uplink.
+type CacheOperationsConfig struct {
+	Supergraph       *bool `yaml:"supergraph" json:"supergraph,omitempty"`             // Whether supergraph responses are cached.
+	Entitlement      *bool `yaml:"entitlement" json:"entitlement,omitempty"`           // Whether license responses are cached.
+	PersistedQueries *bool `yaml:"persistedQueries" json:"persistedQueries,omitempty"` // Whether persisted query manifest responses are cached.
+}
+
+// CanonicalOperationName returns the uplink operation the given operation name is an alias of, or the name itself if it isn't an alias.
+func (c RelayConfig) CanonicalOperationName(operationName string) string {
+	if canonical, ok := c.OperationAliases[operationName]; ok {
+		return canonical
+	}
+	return operationName
+}
+
+// OperationEnabled returns whether responses to the given uplink operation are cached. Operations without a toggle follow Enabled.
+func (c CacheConfig) OperationEnabled(operationName string) bool {
+	if !c.Enabled {
+		return false
+	}
+	var enabled *bool
+	switch operationName {
+	case uplink.SupergraphQuery:
+		enabled = c.Operations.Supergraph
+	case uplink.LicenseQuery:
+		enabled = c.Operations.Entitlement
+	case uplink.PersistedQueriesQuery:
+		enabled = c.Operations.PersistedQueries
+	}
+	return enabled == nil || *enabled
 }
 
 // RedisConfig defines the configuration for connecting to a Redis cache.
@@ -73,9 +234,42 @@ type FilesystemCacheConfig struct {
 
 // WebhookConfig defines the configuration for webhook handling.
 type WebhookConfig struct {
-	Enabled bool   `yaml:"enabled" json:"enabled" jsonschema:"default=false"` // Whether webhook handling is enabled.
-	Path    string `yaml:"path" json:"path"`                                  // Path to bind the webhook handler on.
-	Secret  string `yaml:"secret" json:"secret"`                              // Secret for verifying webhook requests.
+	Enabled       bool     `yaml:"enabled" json:"enabled" jsonschema:"default=false"`                              // Whether webhook handling is enabled.
+	Path          string   `yaml:"path" json:"path"`                                                               // Path to bind the webhook handler on.
+	Secret        string   `yaml:"secret" json:"secret"`                                                           // Secret for verifying webhook requests.
+	Secrets       []string `yaml:"secrets" json:"secrets,omitempty"`                                               // Additional secrets accepted for verifying webhook requests, e.g. while rotating the secret.
+	IgnoreChanges []string `yaml:"ignoreChanges" json:"ignoreChanges,omitempty" jsonschema:"example=^Description"` // Regular expressions matched against the descriptions of schema changes; events whose changes all match one of them are acknowledged without refetching the schema.
+	Algorithms    []string `yaml:"algorithms" json:"algorithms,omitempty" jsonschema:"default=sha256"`             // HMAC algorithms accepted in the x-apollo-signature header, e.g. sha256 in sha256=<signature>: "sha256", "sha384" or "sha512".
+}
+
+// WebhookSignatureAlgorithms lists the HMAC algorithms webhook signatures can be verified with.
+var WebhookSignatureAlgorithms = []string{"sha256", "sha384", "sha512"}
+
+// AcceptedSecrets returns every configured webhook secret; a request signed with any of them is accepted.
+func (c WebhookConfig) AcceptedSecrets() []string {
+	secrets := make([]string, 0, len(c.Secrets)+1)
+	if c.Secret != "" {
+		secrets = append(secrets, c.Secret)
+	}
+	for _, secret := range c.Secrets {
+		if secret != "" {
+			secrets = append(secrets, secret)
+		}
+	}
+	return secrets
+}
+
+// IgnoredChangePatterns compiles the regular expressions of the schema changes to ignore.
+func (c WebhookConfig) IgnoredChangePatterns() ([]*regexp.Regexp, error) {
+	patterns := make([]*regexp.Regexp, 0, len(c.IgnoreChanges))
+	for _, expression := range c.IgnoreChanges {
+		pattern, err := regexp.Compile(expression)
+		if err != nil {
+			return nil, fmt.Errorf("invalid webhook ignoreChanges expression %s: %s", expression, err)
+		}
+		patterns = append(patterns, pattern)
+	}
+	return patterns, nil
 }
 
 // PollingConfig defines the configuration for polling from uplink.
@@ -87,21 +281,88 @@ type PollingConfig struct {
 	Entitlements     *bool    `yaml:"entitlements" json:"entitlements,omitempty" jsonschema:"default=true"`          // Whether to poll for entitlements.
 	Supergraph       *bool    `yaml:"supergraph" json:"supergraph,omitempty" jsonschema:"default=true"`              // Whether to poll for supergraph.
 	PersistedQueries *bool    `yaml:"persistedQueries" json:"persistedQueries,omitempty" jsonschema:"default=false"` // Whether to poll for persisted queries.
+	Concurrency      int      `yaml:"concurrency" json:"concurrency,omitempty" jsonschema:"default=4"`               // Maximum number of graphs to poll at the same time.
+	OnlyChanged      *bool    `yaml:"onlyChanged" json:"onlyChanged,omitempty" jsonschema:"default=true"`            // Whether to send the cached supergraph's ID as ifAfterId, so unchanged supergraphs aren't re-downloaded.
+	CycleTimeout     int      `yaml:"cycleTimeout" json:"cycleTimeout,omitempty" jsonschema:"default=0"`             // Maximum duration of a polling cycle across all graphs, in seconds; graphs not polled by then are skipped until the next cycle. 0 disables the limit.
 }
 
 // SupergraphConfig defines the list of graphs to use.
 type SupergraphConfig struct {
-	GraphRef              string `yaml:"graphRef" json:"graphRef"`
-	ApolloKey             string `yaml:"apolloKey" json:"apolloKey"`
-	LaunchID              string `yaml:"launchID" json:"launchID,omitempty"`
-	PersistedQueryVersion string `yaml:"persistedQueryVersion" json:"persistedQueryVersion,omitempty"`
-	OfflineLicense        string `yaml:"offlineLicense" json:"offlineLicense,omitempty"`
+	GraphRef              string   `yaml:"graphRef" json:"graphRef"`
+	ApolloKey             string   `yaml:"apolloKey" json:"apolloKey"`
+	LaunchID              string   `yaml:"launchID" json:"launchID,omitempty"`
+	PersistedQueryVersion string   `yaml:"persistedQueryVersion" json:"persistedQueryVersion,omitempty"`
+	OfflineLicense        string   `yaml:"offlineLicense" json:"offlineLicense,omitempty"`
+	OfflineLicenseFile    string   `yaml:"offlineLicenseFile" json:"offlineLicenseFile,omitempty"` // Path to a file containing the offline license JWT, read when the configuration is loaded. Can't be used with `offlineLicense`.
+	FallbackSchemaFile    string   `yaml:"fallbackSchemaFile" json:"fallbackSchemaFile,omitempty"` // Path to a known-good supergraph SDL, served as a last resort when the supergraph isn't cached and uplink can't be reached.
+	UplinkURLs            []string `yaml:"uplinkURLs" json:"uplinkURLs,omitempty"`                 // Uplink URLs used for this graph instead of the uplink urls, e.g. a region-specific mirror.
+}
+
+// OfflineLicenseConfig defines how offline licenses are verified before they're pinned.
+// Without a public key, licenses are only parsed, so a tampered or mistyped license is only rejected by the routers.
+type OfflineLicenseConfig struct {
+	PublicKey     string `yaml:"publicKey" json:"publicKey,omitempty"`         // PEM-encoded public key offline licenses must be signed with.
+	PublicKeyFile string `yaml:"publicKeyFile" json:"publicKeyFile,omitempty"` // Path to a file containing the PEM-encoded public key, read when the configuration is loaded. Can't be used with `publicKey`.
+	Issuer        string `yaml:"issuer" json:"issuer,omitempty"`               // Issuer (iss claim) offline licenses must have; not checked when empty.
+	Audience      string `yaml:"audience" json:"audience,omitempty"`           // Audience (aud claim) offline licenses must include; not checked when empty.
+}
+
+// VerificationKey parses the public key offline licenses must be signed with. It returns nil if no public key is configured.
+func (c OfflineLicenseConfig) VerificationKey() (crypto.PublicKey, error) {
+	if c.PublicKey == "" {
+		return nil, nil
+	}
+	block, _ := pem.Decode([]byte(c.PublicKey))
+	if block == nil {
+		return nil, fmt.Errorf("invalid offlineLicenses publicKey: no PEM block found")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid offlineLicenses publicKey: %s", err)
+	}
+	return key, nil
 }
 
 type ManagementAPIConfig struct {
-	Enabled bool   `yaml:"enabled" json:"enabled" jsonschema:"default=false"` // Whether the management API is enabled.
-	Path    string `yaml:"path" json:"path,omitempty"`                        // Path to bind the management API handler on.
-	Secret  string `yaml:"secret" json:"secret,omitempty"`                    // Secret for verifying management API requests.
+	Enabled       bool   `yaml:"enabled" json:"enabled" jsonschema:"default=false"`                   // Whether the management API is enabled.
+	Path          string `yaml:"path" json:"path,omitempty"`                                          // Path to bind the management API handler on.
+	Secret        string `yaml:"secret" json:"secret,omitempty"`                                      // Secret for verifying management API requests.
+	Address       string `yaml:"address" json:"address,omitempty"`                                    // Separate address to serve the management API on; defaults to the relay address.
+	CacheDuration int    `yaml:"cacheDuration" json:"cacheDuration,omitempty" jsonschema:"default=5"` // Duration to reuse the assembled currentConfiguration result, in seconds; -1 disables it.
+	StatsWindow   int    `yaml:"statsWindow" json:"statsWindow,omitempty" jsonschema:"default=300"`   // Sliding window for the cacheStats hit rates, in seconds.
+	ReadOnly      bool   `yaml:"readOnly" json:"readOnly,omitempty" jsonschema:"default=false"`       // Whether every mutation is rejected, so the management API can only be used for observability.
+	Cooldown      int    `yaml:"cooldown" json:"cooldown,omitempty" jsonschema:"default=0"`           // Minimum interval between runs of each mutation calling Apollo's APIs for a graph, in seconds; 0 disables it.
+}
+
+// MetricsConfig defines the configuration for the metrics endpoint.
+type MetricsConfig struct {
+	Enabled bool   `yaml:"enabled" json:"enabled" jsonschema:"default=false"` // Whether the metrics endpoint is enabled.
+	Path    string `yaml:"path" json:"path,omitempty"`                        // Path to bind the metrics handler on.
+	Address string `yaml:"address" json:"address,omitempty"`                  // Separate address to serve the metrics endpoint on; defaults to the relay address.
+}
+
+// HealthConfig defines the thresholds of the health checks.
+type HealthConfig struct {
+	MaxArtifactAge int `yaml:"maxArtifactAge" json:"maxArtifactAge,omitempty" jsonschema:"default=0"` // Maximum age of a graph's cached supergraph, in seconds, before the graph is reported unhealthy; 0 disables the check.
+}
+
+// AuditConfig defines the audit trail of requests to uplink and the Studio API, written separately from the operational logs.
+type AuditConfig struct {
+	Enabled bool   `yaml:"enabled" json:"enabled" jsonschema:"default=false"`                               // Whether audit records are written.
+	Path    string `yaml:"path" json:"path,omitempty" jsonschema:"example=/var/log/uplink-relay/audit.log"` // Path of the file audit records are appended to, one JSON object per line.
+}
+
+// PersistedQueriesConfig defines how persisted query chunks are cached, the hosts they may be fetched from, and the limits for caching them.
+type PersistedQueriesConfig struct {
+	RehostChunks      *bool    `yaml:"rehostChunks" json:"rehostChunks,omitempty" jsonschema:"default=true"`        // Whether chunks are downloaded and served by the relay; otherwise routers fetch them from the upstream chunk URLs.
+	MaxChunks         int      `yaml:"maxChunks" json:"maxChunks,omitempty" jsonschema:"default=100"`               // Maximum number of chunk URLs in a manifest before it's rejected.
+	MaxChunkBytes     int64    `yaml:"maxChunkBytes" json:"maxChunkBytes,omitempty" jsonschema:"default=104857600"` // Maximum total size of the chunks in a manifest, in bytes, before it's rejected.
+	ChunkAllowedHosts []string `yaml:"chunkAllowedHosts" json:"chunkAllowedHosts,omitempty"`                        // Hosts persisted query chunks may be fetched from, e.g. "*.apollographql.com". When empty, any host except loopback, private and link-local addresses is allowed.
+}
+
+// Rehost returns whether persisted query chunks are downloaded and served by the relay, which is the default.
+func (p PersistedQueriesConfig) Rehost() bool {
+	return p.RehostChunks == nil || *p.RehostChunks
 }
 
 var currentConfig *Config
@@ -110,37 +371,82 @@ var currentConfig *Config
 func NewDefaultConfig() *Config {
 	pTrue := true
 	pFalse := false
+	studioRetryCount := 3
 	currentConfig = &Config{
 		Relay: RelayConfig{
-			Address: "localhost:8080",
-			TLS:     RelayTlsConfig{},
+			Address:              "localhost:8080",
+			TLS:                  RelayTlsConfig{},
+			ErrorMinDelaySeconds: 30,
+			SocketMode:           "0660",
+			PinnedClockSkew:      5,
+			Path:                 "/",
+			RedactedVariables:    []string{"apiKey"},
+			RedactedHeaders:      []string{"Authorization", "Cookie", "Set-Cookie", "X-Api-Key", "X-Apollo-Signature"},
+			HealthPing: HealthPingConfig{
+				Enabled: &pTrue,
+				Body:    "OK",
+			},
+			CORS: CORSConfig{
+				Enabled:        false,
+				AllowedOrigins: []string{"*"},
+				AllowedHeaders: []string{"Content-Type", "apollo-client-name", "apollo-client-version", "X-Request-ID"},
+				MaxAge:         600,
+			},
 		},
 		Uplink: UplinkConfig{
-			URLs:         []string{"http://localhost:8081"},
-			Timeout:      30,
-			RetryCount:   -1,
-			StudioAPIURL: "https://graphql.api.apollographql.com/api/graphql",
+			URLs:                []string{"http://localhost:8081"},
+			Timeout:             30,
+			DialTimeout:         10,
+			TLSHandshakeTimeout: 10,
+			RetryCount:          -1,
+			StudioAPIURL:        "https://graphql.api.apollographql.com/api/graphql",
+			StudioRetryCount:    &studioRetryCount,
+			Strategy:            "roundrobin",
+			RetryBudget: RetryBudgetConfig{
+				MaxTokens:  100,
+				TokenRatio: 0.1,
+			},
 		},
 		Cache: CacheConfig{
-			Enabled:  true,
-			Duration: -1,
-			MaxSize:  1000,
+			Enabled:             true,
+			Duration:            -1,
+			MaxSize:             1000,
+			Shards:              1,
+			CompressMinSize:     1024,
+			Fallback:            &pTrue,
+			FallbackDuration:    30,
+			MissingEntitlement:  MissingEntitlementNone,
+			SerializationFormat: SerializationFormatJSON,
 		},
 		Webhook: WebhookConfig{
-			Enabled: false,
-			Path:    "/webhook",
-			Secret:  "",
+			Enabled:    false,
+			Path:       "/webhook",
+			Secret:     "",
+			Algorithms: []string{"sha256"},
 		},
 		Polling: PollingConfig{
 			Enabled:          false,
 			PersistedQueries: &pFalse,
 			Entitlements:     &pTrue,
 			Supergraph:       &pTrue,
+			Concurrency:      4,
+			OnlyChanged:      &pTrue,
 		},
 		ManagementAPI: ManagementAPIConfig{
+			Enabled:       false,
+			Path:          "/graphql",
+			Secret:        "",
+			CacheDuration: 5,
+			StatsWindow:   300,
+		},
+		Metrics: MetricsConfig{
 			Enabled: false,
-			Path:    "/graphql",
-			Secret:  "",
+			Path:    "/metrics",
+		},
+		PersistedQueries: PersistedQueriesConfig{
+			RehostChunks:  &pTrue,
+			MaxChunks:     100,
+			MaxChunkBytes: 100 * 1024 * 1024,
 		},
 	}
 
@@ -153,10 +459,53 @@ const ConfigKey keyType = "config"
 
 // MergeWithDefaultConfig merges the default configuration with the loaded configuration.
 func MergeWithDefaultConfig(defaultConfig *Config, loadedConfig *Config, enableDebug *bool, logger *slog.Logger) *Config {
-	if loadedConfig.Relay.Address == "" {
+	if loadedConfig.Relay.Address == "" && len(loadedConfig.Relay.Addresses) == 0 {
 		loadedConfig.Relay.Address = defaultConfig.Relay.Address
 	}
 
+	if loadedConfig.Relay.ErrorMinDelaySeconds == 0 {
+		loadedConfig.Relay.ErrorMinDelaySeconds = defaultConfig.Relay.ErrorMinDelaySeconds
+	}
+
+	if loadedConfig.Relay.SocketMode == "" {
+		loadedConfig.Relay.SocketMode = defaultConfig.Relay.SocketMode
+	}
+	if loadedConfig.Relay.PinnedClockSkew == 0 {
+		loadedConfig.Relay.PinnedClockSkew = defaultConfig.Relay.PinnedClockSkew
+	}
+
+	if loadedConfig.Relay.Path == "" {
+		loadedConfig.Relay.Path = defaultConfig.Relay.Path
+	}
+
+	if loadedConfig.Relay.RedactedVariables == nil {
+		loadedConfig.Relay.RedactedVariables = defaultConfig.Relay.RedactedVariables
+	}
+
+	if loadedConfig.Relay.RedactedHeaders == nil {
+		loadedConfig.Relay.RedactedHeaders = defaultConfig.Relay.RedactedHeaders
+	}
+
+	if loadedConfig.Relay.HealthPing.Enabled == nil {
+		loadedConfig.Relay.HealthPing.Enabled = defaultConfig.Relay.HealthPing.Enabled
+	}
+
+	if loadedConfig.Relay.HealthPing.Body == "" {
+		loadedConfig.Relay.HealthPing.Body = defaultConfig.Relay.HealthPing.Body
+	}
+
+	if len(loadedConfig.Relay.CORS.AllowedOrigins) == 0 {
+		loadedConfig.Relay.CORS.AllowedOrigins = defaultConfig.Relay.CORS.AllowedOrigins
+	}
+
+	if len(loadedConfig.Relay.CORS.AllowedHeaders) == 0 {
+		loadedConfig.Relay.CORS.AllowedHeaders = defaultConfig.Relay.CORS.AllowedHeaders
+	}
+
+	if loadedConfig.Relay.CORS.MaxAge == 0 {
+		loadedConfig.Relay.CORS.MaxAge = defaultConfig.Relay.CORS.MaxAge
+	}
+
 	if len(loadedConfig.Uplink.URLs) == 0 {
 		loadedConfig.Uplink.URLs = defaultConfig.Uplink.URLs
 	}
@@ -165,10 +514,34 @@ func MergeWithDefaultConfig(defaultConfig *Config, loadedConfig *Config, enableD
 		loadedConfig.Uplink.Timeout = defaultConfig.Uplink.Timeout
 	}
 
+	if loadedConfig.Uplink.DialTimeout == 0 {
+		loadedConfig.Uplink.DialTimeout = defaultConfig.Uplink.DialTimeout
+	}
+
+	if loadedConfig.Uplink.TLSHandshakeTimeout == 0 {
+		loadedConfig.Uplink.TLSHandshakeTimeout = defaultConfig.Uplink.TLSHandshakeTimeout
+	}
+
 	if loadedConfig.Uplink.RetryCount == -1 {
 		loadedConfig.Uplink.RetryCount = defaultConfig.Uplink.RetryCount
 	}
 
+	if loadedConfig.Uplink.StudioRetryCount == nil {
+		loadedConfig.Uplink.StudioRetryCount = defaultConfig.Uplink.StudioRetryCount
+	}
+
+	if loadedConfig.Uplink.Strategy == "" {
+		loadedConfig.Uplink.Strategy = defaultConfig.Uplink.Strategy
+	}
+
+	if loadedConfig.Uplink.RetryBudget.MaxTokens == 0 {
+		loadedConfig.Uplink.RetryBudget.MaxTokens = defaultConfig.Uplink.RetryBudget.MaxTokens
+	}
+
+	if loadedConfig.Uplink.RetryBudget.TokenRatio == 0 {
+		loadedConfig.Uplink.RetryBudget.TokenRatio = defaultConfig.Uplink.RetryBudget.TokenRatio
+	}
+
 	if loadedConfig.Cache.Duration == 0 {
 		loadedConfig.Cache.Duration = defaultConfig.Cache.Duration
 	}
@@ -177,6 +550,30 @@ func MergeWithDefaultConfig(defaultConfig *Config, loadedConfig *Config, enableD
 		loadedConfig.Cache.MaxSize = defaultConfig.Cache.MaxSize
 	}
 
+	if loadedConfig.Cache.Shards == 0 {
+		loadedConfig.Cache.Shards = defaultConfig.Cache.Shards
+	}
+
+	if loadedConfig.Cache.CompressMinSize == 0 {
+		loadedConfig.Cache.CompressMinSize = defaultConfig.Cache.CompressMinSize
+	}
+
+	if loadedConfig.Cache.Fallback == nil {
+		loadedConfig.Cache.Fallback = defaultConfig.Cache.Fallback
+	}
+
+	if loadedConfig.Cache.FallbackDuration == 0 {
+		loadedConfig.Cache.FallbackDuration = defaultConfig.Cache.FallbackDuration
+	}
+
+	if loadedConfig.Cache.MissingEntitlement == "" {
+		loadedConfig.Cache.MissingEntitlement = defaultConfig.Cache.MissingEntitlement
+	}
+
+	if loadedConfig.Cache.SerializationFormat == "" {
+		loadedConfig.Cache.SerializationFormat = defaultConfig.Cache.SerializationFormat
+	}
+
 	if len(loadedConfig.Supergraphs) == 0 {
 		loadedConfig.Supergraphs = defaultConfig.Supergraphs
 	}
@@ -184,6 +581,9 @@ func MergeWithDefaultConfig(defaultConfig *Config, loadedConfig *Config, enableD
 	if loadedConfig.Webhook.Path == "" {
 		loadedConfig.Webhook.Path = defaultConfig.Webhook.Path
 	}
+	if loadedConfig.Webhook.Algorithms == nil {
+		loadedConfig.Webhook.Algorithms = defaultConfig.Webhook.Algorithms
+	}
 
 	if loadedConfig.Polling.Interval == 0 {
 		loadedConfig.Polling.Interval = defaultConfig.Polling.Interval
@@ -201,10 +601,42 @@ func MergeWithDefaultConfig(defaultConfig *Config, loadedConfig *Config, enableD
 		loadedConfig.Polling.PersistedQueries = defaultConfig.Polling.PersistedQueries
 	}
 
+	if loadedConfig.Polling.Concurrency == 0 {
+		loadedConfig.Polling.Concurrency = defaultConfig.Polling.Concurrency
+	}
+
+	if loadedConfig.Polling.OnlyChanged == nil {
+		loadedConfig.Polling.OnlyChanged = defaultConfig.Polling.OnlyChanged
+	}
+
 	if loadedConfig.ManagementAPI.Path == "" {
 		loadedConfig.ManagementAPI.Path = defaultConfig.ManagementAPI.Path
 	}
 
+	if loadedConfig.ManagementAPI.CacheDuration == 0 {
+		loadedConfig.ManagementAPI.CacheDuration = defaultConfig.ManagementAPI.CacheDuration
+	}
+
+	if loadedConfig.ManagementAPI.StatsWindow == 0 {
+		loadedConfig.ManagementAPI.StatsWindow = defaultConfig.ManagementAPI.StatsWindow
+	}
+
+	if loadedConfig.Metrics.Path == "" {
+		loadedConfig.Metrics.Path = defaultConfig.Metrics.Path
+	}
+
+	if loadedConfig.PersistedQueries.RehostChunks == nil {
+		loadedConfig.PersistedQueries.RehostChunks = defaultConfig.PersistedQueries.RehostChunks
+	}
+
+	if loadedConfig.PersistedQueries.MaxChunks == 0 {
+		loadedConfig.PersistedQueries.MaxChunks = defaultConfig.PersistedQueries.MaxChunks
+	}
+
+	if loadedConfig.PersistedQueries.MaxChunkBytes == 0 {
+		loadedConfig.PersistedQueries.MaxChunkBytes = defaultConfig.PersistedQueries.MaxChunkBytes
+	}
+
 	if loadedConfig.Uplink.StudioAPIURL == "" {
 		loadedConfig.Uplink.StudioAPIURL = defaultConfig.Uplink.StudioAPIURL
 	}
@@ -216,33 +648,195 @@ func MergeWithDefaultConfig(defaultConfig *Config, loadedConfig *Config, enableD
 	return loadedConfig
 }
 
+// StdinConfigPath is the configuration path that reads the configuration from standard input.
+const StdinConfigPath = "-"
+
+// IsStdinPath reports whether the configuration path reads from standard input.
+// Standard input can only be read once, so a configuration read from it can't be reloaded.
+func IsStdinPath(configPath string) bool {
+	return configPath == StdinConfigPath || configPath == "/dev/stdin"
+}
+
 // LoadConfig reads and unmarshals a YAML configuration file into a Config struct.
+// The configuration is read from standard input if the path is "-" or "/dev/stdin".
 func LoadConfig(configPath string) (*Config, error) {
-	configFile, err := os.Open(configPath)
+	if IsStdinPath(configPath) {
+		return LoadConfigFromReader(os.Stdin)
+	}
+	document, err := readConfigNode(configPath, nil)
 	if err != nil {
 		return nil, err
 	}
-	defer configFile.Close()
+	return decodeConfig(document)
+}
 
-	decoder := yaml.NewDecoder(configFile)
+// LoadConfigFromReader reads and unmarshals a YAML configuration from the reader into a Config struct.
+// Included files are relative to the working directory.
+func LoadConfigFromReader(reader io.Reader) (*Config, error) {
+	workingDir, err := os.Getwd()
+	if err != nil {
+		return nil, err
+	}
+	document, err := decodeConfigNode(reader, workingDir, nil)
+	if errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("no configuration was read")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return decodeConfig(document)
+}
 
+// decodeConfig unmarshals the parsed configuration, expanding environment variables and loading offline licenses.
+func decodeConfig(document *yaml.Node) (*Config, error) {
 	var config Config
-	if err := decoder.Decode(&config); err != nil {
+	if err := document.Decode(&config); err != nil {
 		return nil, err
 	}
 
 	expandEnvInStruct(reflect.ValueOf(&config))
 
+	if err := loadOfflineLicenseFiles(&config); err != nil {
+		return nil, err
+	}
+	if err := loadLicensePublicKeyFile(&config.OfflineLicenses); err != nil {
+		return nil, err
+	}
+
 	return &config, nil
 }
 
+// loadOfflineLicenseFiles reads the offline license of each supergraph configured with an offlineLicenseFile.
+func loadOfflineLicenseFiles(config *Config) error {
+	for i := range config.Supergraphs {
+		supergraph := &config.Supergraphs[i]
+		if supergraph.OfflineLicenseFile == "" {
+			continue
+		}
+		if supergraph.OfflineLicense != "" {
+			return fmt.Errorf("supergraph %s cannot set both offlineLicense and offlineLicenseFile", supergraph.GraphRef)
+		}
+		license, err := os.ReadFile(supergraph.OfflineLicenseFile)
+		if err != nil {
+			return fmt.Errorf("failed to read offline license for supergraph %s: %w", supergraph.GraphRef, err)
+		}
+		supergraph.OfflineLicense = strings.TrimSpace(string(license))
+		if supergraph.OfflineLicense == "" {
+			return fmt.Errorf("offline license file %s for supergraph %s is empty", supergraph.OfflineLicenseFile, supergraph.GraphRef)
+		}
+	}
+	return nil
+}
+
+// loadLicensePublicKeyFile reads the public key offline licenses are verified with, if it's configured with a publicKeyFile.
+func loadLicensePublicKeyFile(licenseConfig *OfflineLicenseConfig) error {
+	if licenseConfig.PublicKeyFile == "" {
+		return nil
+	}
+	if licenseConfig.PublicKey != "" {
+		return fmt.Errorf("offlineLicenses cannot set both publicKey and publicKeyFile")
+	}
+	publicKey, err := os.ReadFile(licenseConfig.PublicKeyFile)
+	if err != nil {
+		return fmt.Errorf("failed to read offline license public key: %w", err)
+	}
+	licenseConfig.PublicKey = string(publicKey)
+	return nil
+}
+
 func FindSupergraphConfigFromGraphRef(graphRef string, userConfig *Config) (*SupergraphConfig, error) {
 	for _, supergraph := range userConfig.Supergraphs {
 		if supergraph.GraphRef == graphRef {
 			return &supergraph, nil
 		}
 	}
-	return nil, fmt.Errorf("supergraph not found for graphRef: %s", graphRef)
+	return nil, fmt.Errorf("%w for graphRef: %s", relayerrors.ErrGraphNotFound, graphRef)
+}
+
+// ListenAddresses returns every address the relay server binds: the address, if set, followed by the additional addresses, without duplicates.
+func (r *RelayConfig) ListenAddresses() []string {
+	addresses := make([]string, 0, len(r.Addresses)+1)
+	for _, address := range append([]string{r.Address}, r.Addresses...) {
+		if address != "" && !slices.Contains(addresses, address) {
+			addresses = append(addresses, address)
+		}
+	}
+	return addresses
+}
+
+// AllowedPrefixes parses the relay's allowed client IPs and CIDR ranges, where a bare IP allows only that address.
+func (r *RelayConfig) AllowedPrefixes() ([]netip.Prefix, error) {
+	return parsePrefixes("allowedCIDRs", r.AllowedCIDRs)
+}
+
+// TrustedProxyPrefixes parses the IPs and CIDR ranges of the relay's trusted proxies, where a bare IP trusts only that address.
+func (r *RelayConfig) TrustedProxyPrefixes() ([]netip.Prefix, error) {
+	return parsePrefixes("trustedProxies", r.TrustedProxies)
+}
+
+// parsePrefixes parses a list of IPs and CIDR ranges from the relay option with the given name.
+func parsePrefixes(option string, cidrs []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		if addr, err := netip.ParseAddr(cidr); err == nil {
+			prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid relay %s entry %s: must be an IP address or CIDR range, e.g. 10.0.0.0/8", option, cidr)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// APIKey returns the supergraph's API key, falling back to the default key, usually uplink's defaultApolloKey.
+// It returns an error wrapping relayerrors.ErrAPIKeyMissing if neither is set.
+func (s *SupergraphConfig) APIKey(defaultKey string) (string, error) {
+	if s.ApolloKey != "" {
+		return s.ApolloKey, nil
+	}
+	if defaultKey == "" {
+		return "", fmt.Errorf("%w for graphRef: %s", relayerrors.ErrAPIKeyMissing, s.GraphRef)
+	}
+	return defaultKey, nil
+}
+
+// CacheTiers returns the enabled cache backends in lookup order, with their access mode: the configured tiers first,
+// then the enabled backends that aren't listed, in the default memory, filesystem, Redis order, all read and written.
+func (c *Config) CacheTiers() []CacheTierConfig {
+	enabled := map[string]bool{
+		CacheTierMemory:     c.Cache.Enabled,
+		CacheTierFilesystem: c.FilesystemCache.Enabled,
+		CacheTierRedis:      c.Redis.Enabled,
+	}
+	tiers := make([]CacheTierConfig, 0, len(enabled))
+	for _, tier := range c.Cache.Tiers {
+		if enabled[tier.Name] {
+			if tier.Mode == "" {
+				tier.Mode = CacheTierReadWrite
+			}
+			tiers = append(tiers, tier)
+			enabled[tier.Name] = false
+		}
+	}
+	for _, name := range []string{CacheTierMemory, CacheTierFilesystem, CacheTierRedis} {
+		if enabled[name] {
+			tiers = append(tiers, CacheTierConfig{Name: name, Mode: CacheTierReadWrite})
+		}
+	}
+	return tiers
+}
+
+// UplinkURLsForGraph returns the uplink URLs to use for the graph: its own uplinkURLs if set, or the uplink urls.
+func (c *Config) UplinkURLsForGraph(graphRef string) []string {
+	for _, supergraph := range c.Supergraphs {
+		if supergraph.GraphRef == graphRef && len(supergraph.UplinkURLs) > 0 {
+			return supergraph.UplinkURLs
+		}
+	}
+	return c.Uplink.URLs
 }
 
 // expandEnvInStruct expands environment variables in a struct.
@@ -297,12 +891,29 @@ func expandEnvInStruct(v reflect.Value) {
 	}
 }
 
+// reservedPaths are the routes always registered on the relay address, which no other endpoint can use.
+var reservedPaths = []string{"/version", "/livez", "/readyz", "/persisted-queries/"}
+
+// servedOnRelay reports whether an endpoint with the given address is served by the relay's listeners rather than its own.
+func (c *Config) servedOnRelay(address string) bool {
+	return address == "" || slices.Contains(c.Relay.ListenAddresses(), address)
+}
+
 // Validate validates the configuration.
 func (c *Config) Validate() error {
 	// Validate Relay configuration
-	if c.Relay.Address == "" {
+	if len(c.Relay.ListenAddresses()) == 0 {
 		return fmt.Errorf("relay address cannot be empty")
 	}
+	for _, address := range c.Relay.ListenAddresses() {
+		if socketPath, ok := strings.CutPrefix(address, "unix:"); ok {
+			if socketPath == "" {
+				return fmt.Errorf("relay address must include a socket path after unix:")
+			}
+		} else if _, _, err := net.SplitHostPort(address); err != nil {
+			return fmt.Errorf("invalid relay address %s: %s", address, err)
+		}
+	}
 
 	if c.Relay.PublicURL != "" {
 		allowedProtocols := []string{"http", "https"}
@@ -320,6 +931,60 @@ func (c *Config) Validate() error {
 		}
 
 	}
+
+	if c.Relay.ErrorMinDelaySeconds < 0 {
+		return fmt.Errorf("relay errorMinDelaySeconds cannot be negative")
+	}
+	for alias, operationName := range c.Relay.OperationAliases {
+		if alias == "" || slices.Contains(uplink.Operations, alias) {
+			return fmt.Errorf(`invalid relay operationAliases alias "%s"; must not be empty or an uplink operation`, alias)
+		}
+		if !slices.Contains(uplink.Operations, operationName) {
+			return fmt.Errorf(`invalid relay operationAliases operation "%s" for alias "%s"; must be one of %s`, operationName, alias, strings.Join(uplink.Operations, ", "))
+		}
+	}
+	if c.Relay.PinnedClockSkew < -1 {
+		return fmt.Errorf("relay pinnedClockSkew must be positive or -1")
+	}
+	if c.Relay.MaxConcurrentConnections < 0 {
+		return fmt.Errorf("relay maxConcurrentConnections cannot be negative")
+	}
+	if c.Relay.Path != "" && !strings.HasPrefix(c.Relay.Path, "/") {
+		return fmt.Errorf("relay path must start with /")
+	}
+	if relayPath := "/" + strings.Trim(c.Relay.Path, "/"); relayPath != "/" {
+		// The relay can't share a route with the other handlers on the relay address
+		if slices.Contains(reservedPaths, relayPath) || strings.HasPrefix(relayPath+"/", "/persisted-queries/") ||
+			(c.Webhook.Enabled && relayPath == c.Webhook.Path) ||
+			(c.ManagementAPI.Enabled && c.servedOnRelay(c.ManagementAPI.Address) && relayPath == c.ManagementAPI.Path) ||
+			(c.Metrics.Enabled && c.servedOnRelay(c.Metrics.Address) && relayPath == c.Metrics.Path) {
+			return fmt.Errorf("relay path %s conflicts with another endpoint", c.Relay.Path)
+		}
+	}
+	// Registering a route twice on the relay address panics at startup
+	if c.Webhook.Enabled && slices.Contains(reservedPaths, c.Webhook.Path) {
+		return fmt.Errorf("webhook path %s conflicts with another endpoint", c.Webhook.Path)
+	}
+	if c.ManagementAPI.Enabled && c.servedOnRelay(c.ManagementAPI.Address) && slices.Contains(reservedPaths, c.ManagementAPI.Path) {
+		return fmt.Errorf("managementAPI path %s conflicts with another endpoint", c.ManagementAPI.Path)
+	}
+	if c.Metrics.Enabled && c.servedOnRelay(c.Metrics.Address) && slices.Contains(reservedPaths, c.Metrics.Path) {
+		return fmt.Errorf("metrics path %s conflicts with another endpoint", c.Metrics.Path)
+	}
+	if c.Relay.CORS.MaxAge < 0 {
+		return fmt.Errorf("relay cors maxAge cannot be negative")
+	}
+	if _, err := c.Relay.AllowedPrefixes(); err != nil {
+		return err
+	}
+	if _, err := c.Relay.TrustedProxyPrefixes(); err != nil {
+		return err
+	}
+	if c.Relay.SocketMode != "" {
+		if _, err := strconv.ParseUint(c.Relay.SocketMode, 8, 32); err != nil {
+			return fmt.Errorf("invalid relay socketMode %s: must be an octal file mode, e.g. 0660", c.Relay.SocketMode)
+		}
+	}
 	// Validate Uplink configuration
 	if len(c.Uplink.URLs) == 0 {
 		return fmt.Errorf("uplink URLs cannot be empty")
@@ -327,9 +992,48 @@ func (c *Config) Validate() error {
 	if c.Uplink.Timeout < 0 {
 		return fmt.Errorf("uplink timeout cannot be negative")
 	}
+	if c.Uplink.DialTimeout < 0 {
+		return fmt.Errorf("uplink dialTimeout cannot be negative")
+	}
+	if c.Uplink.TLSHandshakeTimeout < 0 {
+		return fmt.Errorf("uplink tlsHandshakeTimeout cannot be negative")
+	}
 	if c.Uplink.RetryCount < 1 {
 		return fmt.Errorf("uplink retryCount must be at least 1")
 	}
+	if c.Uplink.StudioRetryCount != nil && *c.Uplink.StudioRetryCount < 0 {
+		return fmt.Errorf("uplink studioRetryCount cannot be negative")
+	}
+	if c.Uplink.RetryBudget.MaxTokens < 0 {
+		return fmt.Errorf("uplink retryBudget maxTokens cannot be negative")
+	}
+	if c.Uplink.RetryBudget.TokenRatio < 0 {
+		return fmt.Errorf("uplink retryBudget tokenRatio cannot be negative")
+	}
+	if c.Uplink.Strategy != "" && !slices.Contains(uplink.Strategies, c.Uplink.Strategy) {
+		return fmt.Errorf(`invalid uplink strategy "%s"; must be one of "roundrobin", "random" or "leastloaded"`, c.Uplink.Strategy)
+	}
+
+	// Validate Supergraph configuration
+	for _, supergraph := range c.Supergraphs {
+		if _, err := supergraph.APIKey(c.Uplink.DefaultApolloKey); err != nil {
+			return fmt.Errorf("%w: set its apolloKey or uplink defaultApolloKey", err)
+		}
+		if supergraph.FallbackSchemaFile != "" {
+			if _, err := os.Stat(supergraph.FallbackSchemaFile); err != nil {
+				return fmt.Errorf("invalid fallbackSchemaFile for supergraph %s: %w", supergraph.GraphRef, err)
+			}
+		}
+		for _, uplinkURL := range supergraph.UplinkURLs {
+			if uplinkURL == "" {
+				return fmt.Errorf("uplinkURLs for supergraph %s cannot contain an empty URL", supergraph.GraphRef)
+			}
+		}
+	}
+
+	if _, err := c.OfflineLicenses.VerificationKey(); err != nil {
+		return err
+	}
 
 	// Validate Cache configuration
 	if c.Cache.Duration <= 0 && c.Cache.Duration != -1 {
@@ -338,11 +1042,112 @@ func (c *Config) Validate() error {
 	if c.Cache.MaxSize <= 0 {
 		return fmt.Errorf("cache maxSize must be positive")
 	}
+	if c.Cache.Shards <= 0 {
+		return fmt.Errorf("cache shards must be positive")
+	}
+	if c.Cache.Shards > c.Cache.MaxSize {
+		return fmt.Errorf("cache shards cannot exceed maxSize")
+	}
+	if c.Cache.CompressMinSize < 0 {
+		return fmt.Errorf("cache compressMinSize cannot be negative")
+	}
+	if c.Cache.FallbackDuration < 0 {
+		return fmt.Errorf("cache fallbackDuration cannot be negative")
+	}
+	if c.Cache.StaleGrace < 0 {
+		return fmt.Errorf("cache staleGrace cannot be negative")
+	}
+	if c.Cache.MaxServeAge < 0 {
+		return fmt.Errorf("cache maxServeAge cannot be negative")
+	}
+	if c.Cache.HistoryDepth < 0 {
+		return fmt.Errorf("cache historyDepth cannot be negative")
+	}
+	if c.Cache.MissingEntitlement != "" && c.Cache.MissingEntitlement != MissingEntitlementNone && c.Cache.MissingEntitlement != MissingEntitlementUnchanged {
+		return fmt.Errorf(`invalid cache missingEntitlement "%s"; must be one of "none" or "unchanged"`, c.Cache.MissingEntitlement)
+	}
+	if c.Cache.SerializationFormat != "" && c.Cache.SerializationFormat != SerializationFormatJSON && c.Cache.SerializationFormat != SerializationFormatGob {
+		return fmt.Errorf(`invalid cache serializationFormat "%s"; must be one of "json" or "gob"`, c.Cache.SerializationFormat)
+	}
+	// Keys are file names in the filesystem cache, so the key version is restricted to characters that are safe in them
+	if strings.IndexFunc(c.Cache.KeyVersion, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '.' || r == '_' || r == '-')
+	}) != -1 {
+		return fmt.Errorf(`invalid cache keyVersion "%s"; must only contain letters, digits, ".", "_" and "-"`, c.Cache.KeyVersion)
+	}
+	enabledTiers := map[string]bool{CacheTierMemory: c.Cache.Enabled, CacheTierFilesystem: c.FilesystemCache.Enabled, CacheTierRedis: c.Redis.Enabled}
+	listedTiers := map[string]bool{}
+	for _, tier := range c.Cache.Tiers {
+		if _, ok := enabledTiers[tier.Name]; !ok {
+			return fmt.Errorf(`invalid cache tier "%s"; must be one of "memory", "filesystem" or "redis"`, tier.Name)
+		}
+		if !enabledTiers[tier.Name] {
+			return fmt.Errorf("cache tier %s isn't enabled", tier.Name)
+		}
+		if listedTiers[tier.Name] {
+			return fmt.Errorf("cache tier %s is listed more than once", tier.Name)
+		}
+		listedTiers[tier.Name] = true
+		if tier.Mode != "" && tier.Mode != CacheTierReadWrite && tier.Mode != CacheTierReadOnly && tier.Mode != CacheTierWriteOnly {
+			return fmt.Errorf(`invalid mode "%s" for cache tier %s; must be one of "readWrite", "readOnly" or "writeOnly"`, tier.Mode, tier.Name)
+		}
+	}
+	// Entries must be both read from and written to some backend, or nothing would ever be served from the cache
+	readable, writable := false, false
+	for _, tier := range c.CacheTiers() {
+		readable = readable || tier.Mode != CacheTierWriteOnly
+		writable = writable || tier.Mode != CacheTierReadOnly
+	}
+	if len(c.Cache.Tiers) > 0 && (!readable || !writable) {
+		return fmt.Errorf("cache tiers must include a backend that isn't writeOnly and one that isn't readOnly")
+	}
+
+	// Validate PersistedQueries configuration
+	if c.PersistedQueries.MaxChunks < 0 {
+		return fmt.Errorf("persistedQueries maxChunks cannot be negative")
+	}
+	if c.PersistedQueries.MaxChunkBytes < 0 {
+		return fmt.Errorf("persistedQueries maxChunkBytes cannot be negative")
+	}
 
 	// Validate Webhook configuration
 	if c.Webhook.Enabled && c.Webhook.Path == "" {
 		return fmt.Errorf("webhook path cannot be empty when webhook is enabled")
 	}
+	if _, err := c.Webhook.IgnoredChangePatterns(); err != nil {
+		return err
+	}
+	for _, algorithm := range c.Webhook.Algorithms {
+		if !slices.Contains(WebhookSignatureAlgorithms, algorithm) {
+			return fmt.Errorf(`invalid webhook algorithm "%s"; must be one of "sha256", "sha384" or "sha512"`, algorithm)
+		}
+	}
+
+	// Validate ManagementAPI configuration
+	if c.ManagementAPI.CacheDuration <= 0 && c.ManagementAPI.CacheDuration != -1 {
+		return fmt.Errorf("managementAPI cacheDuration must be positive or -1")
+	}
+	if c.ManagementAPI.StatsWindow < 0 {
+		return fmt.Errorf("managementAPI statsWindow cannot be negative")
+	}
+	if c.ManagementAPI.Cooldown < 0 {
+		return fmt.Errorf("managementAPI cooldown cannot be negative")
+	}
+
+	// Validate Metrics configuration
+	if c.Metrics.Enabled && c.Metrics.Path == "" {
+		return fmt.Errorf("metrics path cannot be empty when metrics are enabled")
+	}
+
+	// Validate Health configuration
+	if c.Health.MaxArtifactAge < 0 {
+		return fmt.Errorf("health maxArtifactAge cannot be negative")
+	}
+
+	// Validate Audit configuration
+	if c.Audit.Enabled && c.Audit.Path == "" {
+		return fmt.Errorf("audit path cannot be empty when auditing is enabled")
+	}
 
 	// Validate Polling configuration
 	if c.Polling.Enabled {
@@ -361,11 +1166,42 @@ func (c *Config) Validate() error {
 			}
 
 		}
+		if c.Polling.Concurrency < 0 {
+			return fmt.Errorf("polling concurrency cannot be negative")
+		}
+		if c.Polling.CycleTimeout < 0 {
+			return fmt.Errorf("polling cycleTimeout cannot be negative")
+		}
 	}
 
 	return nil
 }
 
+// WarningIndefiniteCacheWithPolling is the code of the warning for an indefinite cache duration combined with polling.
+const WarningIndefiniteCacheWithPolling = "indefinite_cache_with_polling"
+
+// Warning describes a configuration that's valid, but likely to behave unexpectedly.
+type Warning struct {
+	Code    string // Stable identifier for the warning, e.g. for metric labels.
+	Message string // Explanation of the warning and how to address it.
+}
+
+// Warnings returns the warnings for combinations of options that Validate accepts, but that are likely misconfigured.
+func (c *Config) Warnings() []Warning {
+	warnings := []Warning{}
+
+	// Polling only refreshes each graph's latest entry, while routers request the entry for the ID they already have;
+	// those entries never expire with an indefinite duration, so routers keep receiving the response cached for their ID
+	if c.Cache.Duration == -1 && c.Polling.Enabled {
+		warnings = append(warnings, Warning{
+			Code: WarningIndefiniteCacheWithPolling,
+			Message: "cache duration is -1 (indefinite) while polling is enabled: polling only updates the latest entry for each graph, " +
+				"so entries cached for a router's ifAfterId never expire and the router may never receive updates; set a positive cache duration",
+		})
+	}
+	return warnings
+}
+
 func PrintConfigJSONSchema() (string, error) {
 	r := new(jsonschema.Reflector)
 	r.AddGoComments("apollosolutions/uplink-relay", "./config")
@@ -0,0 +1,421 @@
+package config
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+
+	"apollosolutions/uplink-relay/internal/relayerrors"
+	"apollosolutions/uplink-relay/uplink"
+)
+
+func TestValidateAPIKeys(t *testing.T) {
+	tests := []struct {
+		name          string
+		defaultKey    string
+		supergraphs   []SupergraphConfig
+		expectMissing bool
+	}{
+		{"every graph has its own key", "", []SupergraphConfig{{GraphRef: "a@current", ApolloKey: "key-a"}, {GraphRef: "b@current", ApolloKey: "key-b"}}, false},
+		{"graphs fall back to the default key", "default-key", []SupergraphConfig{{GraphRef: "a@current"}, {GraphRef: "b@current", ApolloKey: "key-b"}}, false},
+		{"graph without any key", "", []SupergraphConfig{{GraphRef: "a@current", ApolloKey: "key-a"}, {GraphRef: "b@current"}}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			userConfig := NewDefaultConfig()
+			userConfig.Uplink.RetryCount = 1
+			userConfig.Uplink.DefaultApolloKey = tt.defaultKey
+			userConfig.Supergraphs = tt.supergraphs
+
+			err := userConfig.Validate()
+			if tt.expectMissing && !errors.Is(err, relayerrors.ErrAPIKeyMissing) {
+				t.Errorf("Expected ErrAPIKeyMissing, got %v", err)
+			}
+			if !tt.expectMissing && err != nil {
+				t.Errorf("Expected the configuration to be valid, got %v", err)
+			}
+		})
+	}
+}
+
+func TestWarningsIndefiniteCacheWithPolling(t *testing.T) {
+	tests := []struct {
+		name           string
+		duration       int
+		pollingEnabled bool
+		expectWarning  bool
+	}{
+		{"indefinite cache with polling", -1, true, true},
+		{"indefinite cache without polling", -1, false, false},
+		{"expiring cache with polling", 300, true, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			userConfig := NewDefaultConfig()
+			userConfig.Uplink.RetryCount = 1
+			userConfig.Cache.Duration = tt.duration
+			userConfig.Polling.Enabled = tt.pollingEnabled
+			userConfig.Polling.Interval = 60
+
+			// The combination is valid, so it's only warned about
+			if err := userConfig.Validate(); err != nil {
+				t.Fatalf("Expected the configuration to be valid, got %v", err)
+			}
+			warnings := userConfig.Warnings()
+			warned := len(warnings) == 1 && warnings[0].Code == WarningIndefiniteCacheWithPolling
+			if warned != tt.expectWarning {
+				t.Errorf("Expected warning %v, got %+v", tt.expectWarning, warnings)
+			}
+		})
+	}
+}
+
+func TestCacheDuration(t *testing.T) {
+	userConfig := NewDefaultConfig()
+	userConfig.Cache.Duration = 60
+	if duration := userConfig.CacheDuration(); duration != 60 {
+		t.Errorf("Expected the configured duration, got %d", duration)
+	}
+	userConfig.SetCacheDuration(-1)
+	if duration := userConfig.CacheDuration(); duration != -1 {
+		t.Errorf("Expected the duration set at runtime, got %d", duration)
+	}
+	if userConfig.Cache.Duration != 60 {
+		t.Errorf("Expected the configured duration to be kept, got %d", userConfig.Cache.Duration)
+	}
+}
+
+func TestValidateAudit(t *testing.T) {
+	userConfig := NewDefaultConfig()
+	userConfig.Uplink.RetryCount = 1
+	userConfig.Supergraphs = []SupergraphConfig{{GraphRef: "a@current", ApolloKey: "key-a"}}
+
+	userConfig.Audit = AuditConfig{Enabled: true}
+	if err := userConfig.Validate(); err == nil {
+		t.Errorf("Expected an error when auditing is enabled without a path")
+	}
+	userConfig.Audit.Path = "audit.log"
+	if err := userConfig.Validate(); err != nil {
+		t.Errorf("Expected the configuration to be valid, got %v", err)
+	}
+}
+
+func TestValidateEndpointPaths(t *testing.T) {
+	tests := []struct {
+		name      string
+		configure func(*Config)
+		expectErr bool
+	}{
+		{"relay path /livez", func(c *Config) { c.Relay.Path = "/livez" }, true},
+		{"relay path /readyz", func(c *Config) { c.Relay.Path = "/readyz" }, true},
+		{"relay path /version", func(c *Config) { c.Relay.Path = "/version" }, true},
+		{"relay path /uplink", func(c *Config) { c.Relay.Path = "/uplink" }, false},
+		{"webhook path /livez", func(c *Config) { c.Webhook.Enabled = true; c.Webhook.Path = "/livez" }, true},
+		{"webhook path /readyz", func(c *Config) { c.Webhook.Enabled = true; c.Webhook.Path = "/readyz" }, true},
+		{"management API path /readyz", func(c *Config) { c.ManagementAPI.Enabled = true; c.ManagementAPI.Path = "/readyz" }, true},
+		{"management API path /livez on its own address", func(c *Config) {
+			c.ManagementAPI.Enabled = true
+			c.ManagementAPI.Path = "/livez"
+			c.ManagementAPI.Address = "localhost:8081"
+		}, false},
+		{"metrics path /livez", func(c *Config) { c.Metrics.Enabled = true; c.Metrics.Path = "/livez" }, true},
+		{"metrics path /readyz on the relay address", func(c *Config) {
+			c.Metrics.Enabled = true
+			c.Metrics.Path = "/readyz"
+			c.Metrics.Address = c.Relay.Address
+		}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			userConfig := NewDefaultConfig()
+			userConfig.Uplink.RetryCount = 1
+			userConfig.Webhook.Secret = "secret"
+			tt.configure(userConfig)
+			if err := userConfig.Validate(); (err != nil) != tt.expectErr {
+				t.Errorf("Expected error %v, got %v", tt.expectErr, err)
+			}
+		})
+	}
+}
+
+func TestValidateRetryBudget(t *testing.T) {
+	userConfig := NewDefaultConfig()
+	userConfig.Uplink.RetryCount = 1
+	userConfig.Supergraphs = []SupergraphConfig{{GraphRef: "a@current", ApolloKey: "key-a"}}
+
+	userConfig.Uplink.RetryBudget = RetryBudgetConfig{Enabled: true, MaxTokens: -1, TokenRatio: 0.1}
+	if err := userConfig.Validate(); err == nil {
+		t.Errorf("Expected an error for negative maxTokens")
+	}
+	userConfig.Uplink.RetryBudget = RetryBudgetConfig{Enabled: true, MaxTokens: 100, TokenRatio: -0.1}
+	if err := userConfig.Validate(); err == nil {
+		t.Errorf("Expected an error for a negative tokenRatio")
+	}
+	userConfig.Uplink.RetryBudget.TokenRatio = 0.1
+	if err := userConfig.Validate(); err != nil {
+		t.Errorf("Expected the configuration to be valid, got %v", err)
+	}
+}
+
+func TestValidateMissingEntitlement(t *testing.T) {
+	userConfig := NewDefaultConfig()
+	userConfig.Uplink.RetryCount = 1
+	userConfig.Supergraphs = []SupergraphConfig{{GraphRef: "a@current", ApolloKey: "key-a"}}
+
+	for _, missingEntitlement := range []string{MissingEntitlementNone, MissingEntitlementUnchanged} {
+		userConfig.Cache.MissingEntitlement = missingEntitlement
+		if err := userConfig.Validate(); err != nil {
+			t.Errorf("Expected %s to be valid, got %v", missingEntitlement, err)
+		}
+	}
+	userConfig.Cache.MissingEntitlement = "ignore"
+	if err := userConfig.Validate(); err == nil {
+		t.Errorf("Expected an error for an invalid missingEntitlement")
+	}
+}
+
+func TestValidateSerializationFormat(t *testing.T) {
+	userConfig := NewDefaultConfig()
+	userConfig.Uplink.RetryCount = 1
+	userConfig.Supergraphs = []SupergraphConfig{{GraphRef: "a@current", ApolloKey: "key-a"}}
+
+	for _, format := range []string{SerializationFormatJSON, SerializationFormatGob} {
+		userConfig.Cache.SerializationFormat = format
+		if err := userConfig.Validate(); err != nil {
+			t.Errorf("Expected %s to be valid, got %v", format, err)
+		}
+	}
+	userConfig.Cache.SerializationFormat = "msgpack"
+	if err := userConfig.Validate(); err == nil {
+		t.Errorf("Expected an error for an invalid serializationFormat")
+	}
+}
+
+func TestValidateKeyVersion(t *testing.T) {
+	userConfig := NewDefaultConfig()
+	userConfig.Uplink.RetryCount = 1
+	userConfig.Supergraphs = []SupergraphConfig{{GraphRef: "a@current", ApolloKey: "key-a"}}
+
+	for _, version := range []string{"", "v2", "2024-10-03_1.0"} {
+		userConfig.Cache.KeyVersion = version
+		if err := userConfig.Validate(); err != nil {
+			t.Errorf("Expected key version %q to be valid, got %v", version, err)
+		}
+	}
+	for _, version := range []string{"../v2", "v 2", "v:2"} {
+		userConfig.Cache.KeyVersion = version
+		if err := userConfig.Validate(); err == nil {
+			t.Errorf("Expected an error for key version %q", version)
+		}
+	}
+}
+
+func TestCacheTiers(t *testing.T) {
+	userConfig := NewDefaultConfig()
+	userConfig.Uplink.RetryCount = 1
+	userConfig.Supergraphs = []SupergraphConfig{{GraphRef: "a@current", ApolloKey: "key-a"}}
+	userConfig.FilesystemCache.Enabled = true
+	userConfig.Redis.Enabled = true
+
+	// Unlisted backends are looked up after the listed ones, in the default order
+	userConfig.Cache.Tiers = []CacheTierConfig{{Name: CacheTierFilesystem}, {Name: CacheTierRedis, Mode: CacheTierReadOnly}}
+	if err := userConfig.Validate(); err != nil {
+		t.Fatalf("Expected the tiers to be valid, got %v", err)
+	}
+	expected := []CacheTierConfig{{CacheTierFilesystem, CacheTierReadWrite}, {CacheTierRedis, CacheTierReadOnly}, {CacheTierMemory, CacheTierReadWrite}}
+	if tiers := userConfig.CacheTiers(); !reflect.DeepEqual(tiers, expected) {
+		t.Errorf("Expected tiers %v, got %v", expected, tiers)
+	}
+
+	for _, tiers := range [][]CacheTierConfig{
+		{{Name: "s3"}},
+		{{Name: CacheTierRedis}, {Name: CacheTierRedis}},
+		{{Name: CacheTierRedis, Mode: "readwrite"}},
+		{{Name: CacheTierMemory, Mode: CacheTierWriteOnly}, {Name: CacheTierFilesystem, Mode: CacheTierWriteOnly}, {Name: CacheTierRedis, Mode: CacheTierWriteOnly}},
+	} {
+		userConfig.Cache.Tiers = tiers
+		if err := userConfig.Validate(); err == nil {
+			t.Errorf("Expected an error for tiers %v", tiers)
+		}
+	}
+	userConfig.Redis.Enabled = false
+	userConfig.Cache.Tiers = []CacheTierConfig{{Name: CacheTierRedis}}
+	if err := userConfig.Validate(); err == nil {
+		t.Errorf("Expected an error for a tier that isn't enabled")
+	}
+}
+
+func TestValidateWebhook(t *testing.T) {
+	userConfig := NewDefaultConfig()
+	userConfig.Uplink.RetryCount = 1
+	userConfig.Supergraphs = []SupergraphConfig{{GraphRef: "a@current", ApolloKey: "key-a"}}
+
+	userConfig.Webhook.IgnoreChanges = []string{"^Description", "deprecat(ed|ion)"}
+	if err := userConfig.Validate(); err != nil {
+		t.Errorf("Expected the ignoreChanges expressions to be valid, got %v", err)
+	}
+	userConfig.Webhook.IgnoreChanges = []string{"^Description("}
+	if err := userConfig.Validate(); err == nil {
+		t.Errorf("Expected an error for an invalid ignoreChanges expression")
+	}
+	userConfig.Webhook.IgnoreChanges = nil
+
+	userConfig.Webhook.Algorithms = []string{"sha256", "sha512"}
+	if err := userConfig.Validate(); err != nil {
+		t.Errorf("Expected the webhook algorithms to be valid, got %v", err)
+	}
+	userConfig.Webhook.Algorithms = []string{"md5"}
+	if err := userConfig.Validate(); err == nil {
+		t.Errorf("Expected an error for an unsupported webhook algorithm")
+	}
+}
+
+func TestValidateOperationAliases(t *testing.T) {
+	userConfig := NewDefaultConfig()
+	userConfig.Uplink.RetryCount = 1
+	userConfig.Supergraphs = []SupergraphConfig{{GraphRef: "a@current", ApolloKey: "key-a"}}
+
+	userConfig.Relay.OperationAliases = map[string]string{"PersistedQueriesQuery": uplink.PersistedQueriesQuery}
+	if err := userConfig.Validate(); err != nil {
+		t.Errorf("Expected the operation aliases to be valid, got %v", err)
+	}
+	if operationName := userConfig.Relay.CanonicalOperationName("PersistedQueriesQuery"); operationName != uplink.PersistedQueriesQuery {
+		t.Errorf("Expected the alias to map to %s, got %s", uplink.PersistedQueriesQuery, operationName)
+	}
+	if operationName := userConfig.Relay.CanonicalOperationName(uplink.LicenseQuery); operationName != uplink.LicenseQuery {
+		t.Errorf("Expected operation names that aren't aliases to be kept, got %s", operationName)
+	}
+
+	for _, aliases := range []map[string]string{
+		{"PersistedQueriesQuery": "UnknownQuery"},
+		{uplink.LicenseQuery: uplink.SupergraphQuery},
+		{"": uplink.SupergraphQuery},
+	} {
+		userConfig.Relay.OperationAliases = aliases
+		if err := userConfig.Validate(); err == nil {
+			t.Errorf("Expected an error for the operation aliases %v", aliases)
+		}
+	}
+}
+
+func TestValidateOfflineLicensePublicKey(t *testing.T) {
+	userConfig := NewDefaultConfig()
+	userConfig.Uplink.RetryCount = 1
+	userConfig.Supergraphs = []SupergraphConfig{{GraphRef: "a@current", ApolloKey: "key-a"}}
+
+	userConfig.OfflineLicenses.PublicKey = "-----BEGIN PUBLIC KEY-----\nMCowBQYDK2VwAyEAGb9ECWmEzf6FQbrBZ9w7lshQhqowtrbLDFw4rXAxZuE=\n-----END PUBLIC KEY-----\n"
+	if err := userConfig.Validate(); err != nil {
+		t.Errorf("Expected the public key to be valid, got %v", err)
+	}
+	for _, publicKey := range []string{"not a key", "-----BEGIN PUBLIC KEY-----\nbm90IGEga2V5\n-----END PUBLIC KEY-----\n"} {
+		userConfig.OfflineLicenses.PublicKey = publicKey
+		if err := userConfig.Validate(); err == nil {
+			t.Errorf("Expected an error for the public key %q", publicKey)
+		}
+	}
+}
+
+func TestValidateRelayAddresses(t *testing.T) {
+	tests := []struct {
+		name      string
+		address   string
+		addresses []string
+		expected  []string // Addresses the relay listens on, or nil if the configuration is invalid.
+	}{
+		{name: "address only", address: "localhost:8080", expected: []string{"localhost:8080"}},
+		{name: "dual stack", address: "0.0.0.0:8080", addresses: []string{"[::]:8080"}, expected: []string{"0.0.0.0:8080", "[::]:8080"}},
+		{name: "addresses only", addresses: []string{"127.0.0.1:8080", "unix:/tmp/relay.sock"}, expected: []string{"127.0.0.1:8080", "unix:/tmp/relay.sock"}},
+		{name: "duplicates", address: "localhost:8080", addresses: []string{"localhost:8080"}, expected: []string{"localhost:8080"}},
+		{name: "missing port", address: "localhost:8080", addresses: []string{"::1"}},
+		{name: "missing socket path", addresses: []string{"unix:"}},
+		{name: "no address"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			userConfig := NewDefaultConfig()
+			userConfig.Uplink.RetryCount = 1
+			userConfig.Supergraphs = []SupergraphConfig{{GraphRef: "a@current", ApolloKey: "key-a"}}
+			userConfig.Relay.Address = tt.address
+			userConfig.Relay.Addresses = tt.addresses
+
+			err := userConfig.Validate()
+			if tt.expected == nil {
+				if err == nil {
+					t.Errorf("Expected an error for relay addresses %v", userConfig.Relay.ListenAddresses())
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Expected the relay addresses to be valid, got %v", err)
+			}
+			if addresses := userConfig.Relay.ListenAddresses(); !slices.Equal(addresses, tt.expected) {
+				t.Errorf("Expected the relay to listen on %v, got %v", tt.expected, addresses)
+			}
+		})
+	}
+}
+
+func TestUplinkURLsForGraph(t *testing.T) {
+	userConfig := NewDefaultConfig()
+	userConfig.Uplink.RetryCount = 1
+	userConfig.Uplink.URLs = []string{"https://uplink.example.com"}
+	userConfig.Supergraphs = []SupergraphConfig{
+		{GraphRef: "a@current", ApolloKey: "key-a"},
+		{GraphRef: "b@current", ApolloKey: "key-b", UplinkURLs: []string{"https://eu.uplink.example.com"}},
+	}
+
+	if urls := userConfig.UplinkURLsForGraph("a@current"); !reflect.DeepEqual(urls, userConfig.Uplink.URLs) {
+		t.Errorf("Expected the uplink URLs, got %v", urls)
+	}
+	if urls := userConfig.UplinkURLsForGraph("b@current"); !reflect.DeepEqual(urls, []string{"https://eu.uplink.example.com"}) {
+		t.Errorf("Expected the graph's uplink URLs, got %v", urls)
+	}
+	if urls := userConfig.UplinkURLsForGraph("unknown@current"); !reflect.DeepEqual(urls, userConfig.Uplink.URLs) {
+		t.Errorf("Expected the uplink URLs for an unconfigured graph, got %v", urls)
+	}
+
+	userConfig.Supergraphs[1].UplinkURLs = []string{""}
+	if err := userConfig.Validate(); err == nil {
+		t.Errorf("Expected an error for an empty uplink URL")
+	}
+}
+
+func TestStudioRetryCount(t *testing.T) {
+	pFalse := false
+	tests := []struct {
+		name     string
+		yaml     string
+		expected int
+	}{
+		{"defaults to 3", `{"relay": {"address": "localhost:8080"}}`, 3},
+		{"0 disables retries", `{"relay": {"address": "localhost:8080"}, "uplink": {"studioRetryCount": 0}}`, 0},
+		{"configured count", `{"relay": {"address": "localhost:8080"}, "uplink": {"studioRetryCount": 5}}`, 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			loadedConfig, err := LoadConfigFromReader(strings.NewReader(tt.yaml))
+			if err != nil {
+				t.Fatalf("Failed to load the configuration: %v", err)
+			}
+			mergedConfig := MergeWithDefaultConfig(NewDefaultConfig(), loadedConfig, &pFalse, slog.New(slog.NewTextHandler(io.Discard, nil)))
+			if *mergedConfig.Uplink.StudioRetryCount != tt.expected {
+				t.Errorf("Expected a studioRetryCount of %d, got %d", tt.expected, *mergedConfig.Uplink.StudioRetryCount)
+			}
+		})
+	}
+
+	negative := -1
+	userConfig := NewDefaultConfig()
+	userConfig.Uplink.RetryCount = 1
+	userConfig.Supergraphs = []SupergraphConfig{{GraphRef: "a@current", ApolloKey: "key-a"}}
+	userConfig.Uplink.StudioRetryCount = &negative
+	if err := userConfig.Validate(); err == nil || !strings.Contains(err.Error(), "studioRetryCount") {
+		t.Errorf("Expected an error for a negative studioRetryCount, got %v", err)
+	}
+}
@@ -0,0 +1,101 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// includeTag replaces a value with the contents of another YAML file, e.g. supergraphs: !include graphs.yml.
+// Paths are relative to the including file. An included list is spliced into an enclosing list, to which an empty file adds nothing.
+const includeTag = "!include"
+
+// readConfigNode parses the YAML file at the given path and resolves its includes.
+// includeStack holds the files currently being included, so cycles are rejected rather than recursing forever.
+func readConfigNode(path string, includeStack []string) (*yaml.Node, error) {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	if slices.Contains(includeStack, absPath) {
+		return nil, fmt.Errorf("config include cycle: %s -> %s", strings.Join(includeStack, " -> "), absPath)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return decodeConfigNode(file, filepath.Dir(absPath), append(includeStack, absPath))
+}
+
+// decodeConfigNode parses the YAML read from the reader and resolves its includes relative to dir.
+func decodeConfigNode(reader io.Reader, dir string, includeStack []string) (*yaml.Node, error) {
+	var document yaml.Node
+	if err := yaml.NewDecoder(reader).Decode(&document); err != nil {
+		return nil, err
+	}
+	if err := resolveIncludes(&document, dir, includeStack); err != nil {
+		return nil, err
+	}
+	return &document, nil
+}
+
+// resolveIncludes replaces each included value under the node with the contents of its file, in place so anchors and aliases see the included values.
+func resolveIncludes(node *yaml.Node, dir string, includeStack []string) error {
+	if node.Tag == includeTag {
+		included, err := readInclude(node, dir, includeStack)
+		if err != nil {
+			return err
+		}
+		*node = *included
+		return nil
+	}
+
+	content := make([]*yaml.Node, 0, len(node.Content))
+	for _, child := range node.Content {
+		isInclude := child.Tag == includeTag
+		if err := resolveIncludes(child, dir, includeStack); err != nil {
+			return err
+		}
+		if isInclude && node.Kind == yaml.SequenceNode {
+			if child.Kind == yaml.SequenceNode {
+				content = append(content, child.Content...)
+				continue
+			}
+			if child.Tag == "!!null" {
+				continue
+			}
+		}
+		content = append(content, child)
+	}
+	node.Content = content
+	return nil
+}
+
+// readInclude reads the file named by an include, returning the value it holds; an empty file holds null.
+func readInclude(node *yaml.Node, dir string, includeStack []string) (*yaml.Node, error) {
+	if node.Kind != yaml.ScalarNode || node.Value == "" {
+		return nil, fmt.Errorf("line %d: %s must be followed by a file path", node.Line, includeTag)
+	}
+	path := os.ExpandEnv(node.Value)
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(dir, path)
+	}
+
+	document, err := readConfigNode(path, includeStack)
+	if errors.Is(err, io.EOF) {
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!null"}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to include %s on line %d: %w", node.Value, node.Line, err)
+	}
+	return document.Content[0], nil
+}
@@ -0,0 +1,226 @@
+package config
+
+import (
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeConfigFiles writes each file under a temporary directory, returning the directory.
+func writeConfigFiles(t *testing.T, files map[string]string) string {
+	dir := t.TempDir()
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatalf("Failed to create directory for %s: %v", name, err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+	}
+	return dir
+}
+
+func TestLoadConfigIncludes(t *testing.T) {
+	t.Setenv("TEST_INCLUDE_APOLLO_KEY", "service:key")
+	dir := writeConfigFiles(t, map[string]string{
+		"config.yml": `
+relay:
+  address: localhost:8080
+polling: !include shared/polling.yml
+supergraphs: !include graphs.yml
+`,
+		// Included paths are relative to the including file
+		"shared/polling.yml": `
+enabled: true
+interval: 60
+cronExpressions: !include cron.yml
+`,
+		"shared/cron.yml": `["0 * * * *"]`,
+		// Anchors factor out settings shared by the graphs in the file, and values are still expanded from the environment
+		"graphs.yml": `
+- &graph
+  graphRef: first@current
+  apolloKey: ${TEST_INCLUDE_APOLLO_KEY}
+- <<: *graph
+  graphRef: second@current
+`,
+	})
+
+	loadedConfig, err := LoadConfig(filepath.Join(dir, "config.yml"))
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+
+	if loadedConfig.Relay.Address != "localhost:8080" {
+		t.Errorf("Expected the relay address from the base config, got %s", loadedConfig.Relay.Address)
+	}
+	if !loadedConfig.Polling.Enabled || loadedConfig.Polling.Interval != 60 {
+		t.Errorf("Expected the polling settings to be included, got %+v", loadedConfig.Polling)
+	}
+	if len(loadedConfig.Polling.Expressions) != 1 || loadedConfig.Polling.Expressions[0] != "0 * * * *" {
+		t.Errorf("Expected the nested include to be resolved, got %v", loadedConfig.Polling.Expressions)
+	}
+	if len(loadedConfig.Supergraphs) != 2 {
+		t.Fatalf("Expected 2 supergraphs, got %d", len(loadedConfig.Supergraphs))
+	}
+	for i, graphRef := range []string{"first@current", "second@current"} {
+		supergraph := loadedConfig.Supergraphs[i]
+		if supergraph.GraphRef != graphRef || supergraph.ApolloKey != "service:key" {
+			t.Errorf("Expected %s with the expanded API key, got %+v", graphRef, supergraph)
+		}
+	}
+}
+
+func TestLoadConfigIncludesSpliceLists(t *testing.T) {
+	dir := writeConfigFiles(t, map[string]string{
+		"config.yml": `
+supergraphs:
+  - !include team-a.yml
+  - graphRef: inline@current
+  - !include team-b.yml
+  - !include empty.yml
+`,
+		"team-a.yml": "- graphRef: a1@current\n- graphRef: a2@current\n",
+		"team-b.yml": "graphRef: b@current\n",
+		"empty.yml":  "",
+	})
+
+	loadedConfig, err := LoadConfig(filepath.Join(dir, "config.yml"))
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+
+	// An included list is spliced in, any other value becomes a single entry, and an empty file adds nothing
+	expected := []string{"a1@current", "a2@current", "inline@current", "b@current"}
+	if len(loadedConfig.Supergraphs) != len(expected) {
+		t.Fatalf("Expected %d supergraphs, got %+v", len(expected), loadedConfig.Supergraphs)
+	}
+	for i, graphRef := range expected {
+		if loadedConfig.Supergraphs[i].GraphRef != graphRef {
+			t.Errorf("Expected supergraph %d to be %q, got %q", i, graphRef, loadedConfig.Supergraphs[i].GraphRef)
+		}
+	}
+}
+
+func TestLoadConfigIncludeErrors(t *testing.T) {
+	tests := []struct {
+		name          string
+		files         map[string]string
+		expectedError string
+	}{
+		{
+			name:          "missing file",
+			files:         map[string]string{"config.yml": "supergraphs: !include missing.yml\n"},
+			expectedError: "failed to include missing.yml on line 1",
+		},
+		{
+			name:          "include without a path",
+			files:         map[string]string{"config.yml": "supergraphs: !include [graphs.yml]\n"},
+			expectedError: "must be followed by a file path",
+		},
+		{
+			name:          "file includes itself",
+			files:         map[string]string{"config.yml": "supergraphs: !include config.yml\n"},
+			expectedError: "config include cycle",
+		},
+		{
+			name: "include cycle",
+			files: map[string]string{
+				"config.yml": "supergraphs: !include a.yml\n",
+				"a.yml":      "- !include b.yml\n",
+				"b.yml":      "- !include a.yml\n",
+			},
+			expectedError: "config include cycle",
+		},
+		{
+			name: "invalid included YAML",
+			files: map[string]string{
+				"config.yml": "supergraphs: !include graphs.yml\n",
+				"graphs.yml": "- graphRef: [\n",
+			},
+			expectedError: "failed to include graphs.yml",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := writeConfigFiles(t, tt.files)
+			_, err := LoadConfig(filepath.Join(dir, "config.yml"))
+			if err == nil || !strings.Contains(err.Error(), tt.expectedError) {
+				t.Errorf("Expected an error containing %q, got %v", tt.expectedError, err)
+			}
+		})
+	}
+}
+
+func TestLoadConfigIncludeDiamond(t *testing.T) {
+	// Including the same file twice is fine, as long as it doesn't include itself
+	dir := writeConfigFiles(t, map[string]string{
+		"config.yml": "supergraphs:\n  - !include a.yml\n  - !include b.yml\n",
+		"a.yml":      "- !include shared.yml\n",
+		"b.yml":      "- !include shared.yml\n",
+		"shared.yml": "graphRef: shared@current\n",
+	})
+
+	loadedConfig, err := LoadConfig(filepath.Join(dir, "config.yml"))
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	if len(loadedConfig.Supergraphs) != 2 {
+		t.Errorf("Expected the shared file to be included twice, got %+v", loadedConfig.Supergraphs)
+	}
+}
+
+func TestLoadConfigFromReader(t *testing.T) {
+	t.Setenv("TEST_READER_APOLLO_KEY", "service:key")
+	// Included paths are relative to the working directory
+	dir := writeConfigFiles(t, map[string]string{"graphs.yml": `[{"graphRef": "included@current"}]`})
+	workingDir, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(workingDir)
+
+	loadedConfig, err := LoadConfigFromReader(strings.NewReader(`
+relay:
+  address: localhost:8080
+supergraphs:
+  - graphRef: first@current
+    apolloKey: ${TEST_READER_APOLLO_KEY}
+  - !include graphs.yml
+`))
+	if err != nil {
+		t.Fatalf("Failed to load the configuration: %v", err)
+	}
+	if loadedConfig.Relay.Address != "localhost:8080" {
+		t.Errorf("Expected the relay address to be read, got %q", loadedConfig.Relay.Address)
+	}
+	if len(loadedConfig.Supergraphs) != 2 || loadedConfig.Supergraphs[1].GraphRef != "included@current" {
+		t.Fatalf("Expected the included supergraph to be spliced in, got %+v", loadedConfig.Supergraphs)
+	}
+	if loadedConfig.Supergraphs[0].ApolloKey != "service:key" {
+		t.Errorf("Expected the API key to be expanded from the environment, got %q", loadedConfig.Supergraphs[0].ApolloKey)
+	}
+
+	// JSON is read as well, and the merged configuration is validated as for a file
+	loadedConfig, err = LoadConfigFromReader(strings.NewReader(`{"relay": {"address": "localhost:8080"}, "uplink": {"retryCount": -2}}`))
+	if err != nil {
+		t.Fatalf("Failed to load the JSON configuration: %v", err)
+	}
+	pFalse := false
+	mergedConfig := MergeWithDefaultConfig(NewDefaultConfig(), loadedConfig, &pFalse, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err := mergedConfig.Validate(); err == nil {
+		t.Errorf("Expected the configuration read to be validated")
+	}
+
+	if _, err := LoadConfigFromReader(strings.NewReader("")); err == nil {
+		t.Errorf("Expected an error when no configuration is read")
+	}
+}
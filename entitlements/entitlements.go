@@ -6,7 +6,8 @@ import (
 	"apollosolutions/uplink-relay/internal/util"
 	"apollosolutions/uplink-relay/pinning"
 	"apollosolutions/uplink-relay/uplink"
-	"encoding/json"
+	"context"
+	"fmt"
 	"log/slog"
 	"time"
 )
@@ -21,6 +22,8 @@ type UplinkRouterEntitlements struct {
 	Typename        string  `json:"__typename"`
 	MinDelaySeconds float64 `json:"minDelaySeconds"`
 	Entitlement     *Jwt    `json:"entitlement,omitempty"`
+	Code            string  `json:"code,omitempty"`    // Only exists if __typename is "FetchError"
+	Message         string  `json:"message,omitempty"` // Only exists if __typename is "FetchError"
 }
 
 // UplinkLicenseResponse struct
@@ -30,24 +33,7 @@ type UplinkLicenseResponse struct {
 	} `json:"data"`
 }
 
-// FetchRouterLicense fetches the router license for the specified graph.
-func FetchRouterLicense(userConfig *config.Config, systemCache cache.Cache, logger *slog.Logger, graphRef string) error {
-	supergraphConfig, err := config.FindSupergraphConfigFromGraphRef(graphRef, userConfig)
-	if err != nil {
-		return err
-	}
-
-	if supergraphConfig.OfflineLicense != "" {
-		return pinning.PinOfflineLicense(userConfig, logger, systemCache, supergraphConfig.LaunchID, graphRef)
-	}
-
-	variables := map[string]interface{}{
-		"apiKey":    supergraphConfig.ApolloKey,
-		"graph_ref": graphRef,
-		"ifAfterId": "",
-	}
-
-	query := `query LicenseQuery($apiKey: String!, $graph_ref: String!, $ifAfterId: ID) {
+const licenseQuery = `query LicenseQuery($apiKey: String!, $graph_ref: String!, $ifAfterId: ID) {
 			routerEntitlements(ifAfterId: $ifAfterId, apiKey: $apiKey, ref: $graph_ref) {
 					__typename
 					... on RouterEntitlementsResult {
@@ -68,43 +54,79 @@ func FetchRouterLicense(userConfig *config.Config, systemCache cache.Cache, logg
 			}
 		}`
 
-	operationName := "LicenseQuery"
+// FetchRouterLicense fetches the router license for the specified graph.
+func FetchRouterLicense(ctx context.Context, userConfig *config.Config, systemCache cache.Cache, logger *slog.Logger, graphRef string) error {
+	supergraphConfig, err := config.FindSupergraphConfigFromGraphRef(graphRef, userConfig)
+	if err != nil {
+		return err
+	}
 
-	resp, err := util.UplinkRequest(userConfig, logger, query, variables, operationName)
+	if supergraphConfig.OfflineLicense != "" {
+		return pinning.PinOfflineLicense(userConfig, logger, systemCache, supergraphConfig.LaunchID, graphRef)
+	}
+	apiKey, err := supergraphConfig.APIKey(userConfig.Uplink.DefaultApolloKey)
 	if err != nil {
 		return err
 	}
 
-	// Unmarshal the response body into the LicenseQueryResponse struct
-	var response UplinkLicenseResponse
-	err = json.Unmarshal(resp, &response)
+	variables := map[string]interface{}{
+		"apiKey":    apiKey,
+		"graph_ref": graphRef,
+		"ifAfterId": "",
+	}
+
+	resp, err := util.UplinkRequest(ctx, userConfig, logger, licenseQuery, variables, uplink.LicenseQuery)
 	if err != nil {
 		return err
 	}
 
-	expiration, err := time.Parse(time.RFC3339, response.Data.RouterEntitlements.ID)
+	// Unmarshal the response body into the LicenseQueryResponse struct
+	var response UplinkLicenseResponse
+	err = util.DecodeUplinkResponse(resp, &response, userConfig.Uplink.StrictDecode)
 	if err != nil {
-		logger.Error("Failed to parse license expiration", "graphRef", supergraphConfig.GraphRef, "err", err)
+		logger.Error("Failed to decode uplink response", "graphRef", graphRef, "err", err)
 		return err
 	}
 
+	expiration := util.ParseUplinkTimestampOrNow(logger, response.Data.RouterEntitlements.ID, "graphRef", graphRef)
+
 	if userConfig.Cache.Enabled {
 		// Cache the license
-		return CacheLicense(systemCache, logger, graphRef, response.Data.RouterEntitlements.Entitlement.Jwt, expiration, userConfig.Cache.Duration, "")
+		typename, jwt := CachedEntitlement(response.Data.RouterEntitlements, userConfig.Cache.MissingEntitlement)
+		return CacheLicense(systemCache, logger, graphRef, typename, jwt, response.Data.RouterEntitlements.ID, expiration, response.Data.RouterEntitlements.MinDelaySeconds, userConfig.CacheDuration(), "")
 	}
 	return nil
 }
 
-func CacheLicense(systemCache cache.Cache, logger *slog.Logger, graphRef string, entitlementJWT string, id time.Time, duration int, ifAfterId string) error {
+// CachedEntitlement returns the __typename and JWT to cache for a license response. Results without an entitlement are cached as uplink returned them,
+// unless missingEntitlement is "unchanged", when they're cached as Unchanged so routers keep their current license.
+func CachedEntitlement(entitlements UplinkRouterEntitlements, missingEntitlement string) (string, string) {
+	if entitlements.Entitlement != nil {
+		return entitlements.Typename, entitlements.Entitlement.Jwt
+	}
+	if entitlements.Typename == "RouterEntitlementsResult" && missingEntitlement == config.MissingEntitlementUnchanged {
+		return "Unchanged", ""
+	}
+	return entitlements.Typename, ""
+}
+
+// CacheLicense caches a license response; typename distinguishes results without an entitlement from Unchanged responses, as neither has a JWT.
+func CacheLicense(systemCache cache.Cache, logger *slog.Logger, graphRef string, typename string, entitlementJWT string, id string, expiration time.Time, minDelaySeconds float64, duration int, ifAfterId string) error {
+	// Keep uplink's ID as-is, so it's replayed to routers exactly
+	if id == "" {
+		id = expiration.Format(time.RFC3339)
+	}
 	cacheItem := cache.CacheItem{
-		ID:           id.Format(time.RFC3339),
-		Content:      []byte(entitlementJWT),
-		Hash:         util.HashString(entitlementJWT),
-		LastModified: time.Now(),
-		Expiration:   id,
+		ID:              id,
+		Content:         []byte(entitlementJWT),
+		Hash:            util.HashString(entitlementJWT),
+		LastModified:    time.Now(),
+		Expiration:      expiration,
+		MinDelaySeconds: minDelaySeconds,
+		Typename:        typename,
 	}
 
-	cacheBytes, err := json.Marshal(cacheItem)
+	cacheBytes, err := cache.EncodeItem(cacheItem)
 	if err != nil {
 		logger.Error("Failed to marshal license", "graphRef", graphRef, "err", err)
 		return err
@@ -114,9 +136,39 @@ func CacheLicense(systemCache cache.Cache, logger *slog.Logger, graphRef string,
 	// Store the schema in the cache
 	cacheKey := cache.MakeCacheKey(graphRef, uplink.LicenseQuery, map[string]interface{}{"graph_ref": graphRef, "ifAfterId": ifAfterId})
 
-	if cacheItem.Content == nil {
-		cache.UpdateNewest(systemCache, logger, graphRef, uplink.LicenseQuery, cacheItem)
+	// Keep the default entry, read by the management API and new routers, in line with the entries routers request with their ifAfterId
+	if err := cache.UpdateNewest(systemCache, logger, graphRef, uplink.LicenseQuery, cacheItem); err != nil {
+		logger.Error("Failed to update the default license cache entry", "graphRef", graphRef, "err", err)
 	}
 
 	return systemCache.Set(cacheKey, string(cacheBytes[:]), duration)
 }
+
+// VerifyAPIKey makes a single license query to uplink to confirm the API key is valid for the given graphRef.
+// The license query is used as it's the smallest uplink response, and succeeds even for graphs without an entitlement.
+func VerifyAPIKey(ctx context.Context, userConfig *config.Config, logger *slog.Logger, graphRef string, apiKey string) error {
+	variables := map[string]interface{}{
+		"apiKey":    apiKey,
+		"graph_ref": graphRef,
+		"ifAfterId": "",
+	}
+
+	resp, err := util.UplinkRequest(ctx, userConfig, logger, licenseQuery, variables, uplink.LicenseQuery)
+	if err != nil {
+		return err
+	}
+
+	var response UplinkLicenseResponse
+	if err := util.DecodeUplinkResponse(resp, &response, userConfig.Uplink.StrictDecode); err != nil {
+		return fmt.Errorf("failed to decode uplink response: %w", err)
+	}
+
+	result := response.Data.RouterEntitlements
+	if result.Typename == "FetchError" {
+		return fmt.Errorf("uplink rejected the API key for %s: %s (%s)", graphRef, result.Message, result.Code)
+	}
+	if result.Typename != "RouterEntitlementsResult" && result.Typename != "Unchanged" {
+		return fmt.Errorf("unexpected uplink response for %s: %s", graphRef, result.Typename)
+	}
+	return nil
+}
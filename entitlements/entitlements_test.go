@@ -1,13 +1,18 @@
 package entitlements
 
 import (
+	"context"
+	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 
 	"apollosolutions/uplink-relay/cache"
 	"apollosolutions/uplink-relay/config"
+	"apollosolutions/uplink-relay/internal/util"
 	"apollosolutions/uplink-relay/logger"
+	"apollosolutions/uplink-relay/uplink"
 )
 
 func TestFetchRouterLicense(t *testing.T) {
@@ -34,14 +39,14 @@ func TestFetchRouterLicense(t *testing.T) {
 
 	// Test case 1: Fetching a valid router license
 	graphRef := "example-graph@current"
-	err := FetchRouterLicense(userConfig, systemCache, logger, graphRef)
+	err := FetchRouterLicense(context.Background(), userConfig, systemCache, logger, graphRef)
 	if err != nil {
 		t.Errorf("Failed to fetch router license: %v", err)
 	}
 
 	// Test case 2: Fetching a router license with an invalid graph reference
 	invalidGraphRef := "invalid-graph"
-	err = FetchRouterLicense(userConfig, systemCache, logger, invalidGraphRef)
+	err = FetchRouterLicense(context.Background(), userConfig, systemCache, logger, invalidGraphRef)
 	if err == nil {
 		t.Errorf("Expected error when fetching router license with invalid graph reference")
 	}
@@ -49,15 +54,88 @@ func TestFetchRouterLicense(t *testing.T) {
 	// Test case 3: Fetching a router license with expired cache
 	expiredGraphRef := "example-graph@current"
 	systemCache.Set(expiredGraphRef, "expired-license", -10)
-	err = FetchRouterLicense(userConfig, systemCache, logger, expiredGraphRef)
+	err = FetchRouterLicense(context.Background(), userConfig, systemCache, logger, expiredGraphRef)
 	if err != nil {
 		t.Errorf("Failed to fetch router license with expired cache: %v", err)
 	}
 
 	// Test case 4: Fetching a router license with invalid user configuration
 	invalidUserConfig := &config.Config{}
-	err = FetchRouterLicense(invalidUserConfig, systemCache, logger, graphRef)
+	err = FetchRouterLicense(context.Background(), invalidUserConfig, systemCache, logger, graphRef)
 	if err == nil {
 		t.Errorf("Expected error when fetching router license with invalid user configuration")
 	}
 }
+
+func TestFetchRouterLicenseNoEntitlement(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"data":{"routerEntitlements":{"__typename":"RouterEntitlementsResult","id":"2024-10-03T12:00:00Z","minDelaySeconds":60,"entitlement":null}}}`))
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		missingEntitlement string
+		typename           string
+	}{
+		{missingEntitlement: config.MissingEntitlementNone, typename: "RouterEntitlementsResult"},
+		{missingEntitlement: config.MissingEntitlementUnchanged, typename: "Unchanged"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.missingEntitlement, func(t *testing.T) {
+			userConfig := config.NewDefaultConfig()
+			userConfig.Uplink.URLs = []string{server.URL}
+			userConfig.Cache.MissingEntitlement = tt.missingEntitlement
+			userConfig.Supergraphs = []config.SupergraphConfig{{GraphRef: "unlicensed@current", ApolloKey: "1234"}}
+			systemCache := cache.NewMemoryCache(10)
+
+			if err := FetchRouterLicense(context.Background(), userConfig, systemCache, logger.MakeLogger(nil), "unlicensed@current"); err != nil {
+				t.Fatalf("Failed to fetch router license: %v", err)
+			}
+			cacheBytes, ok := systemCache.Get(cache.DefaultCacheKey("unlicensed@current", uplink.LicenseQuery))
+			if !ok {
+				t.Fatalf("Expected the license response to be cached")
+			}
+			var cacheItem cache.CacheItem
+			if err := json.Unmarshal(cacheBytes, &cacheItem); err != nil {
+				t.Fatalf("Failed to unmarshal cache item: %v", err)
+			}
+			if len(cacheItem.Content) != 0 || cacheItem.Typename != tt.typename {
+				t.Errorf("Expected no JWT cached as %s, got %q as %s", tt.typename, cacheItem.Content, cacheItem.Typename)
+			}
+		})
+	}
+}
+
+func TestVerifyAPIKey(t *testing.T) {
+	userConfig := config.NewDefaultConfig()
+	logger := logger.MakeLogger(nil)
+
+	// Create a new test server that only accepts a single API key
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request util.UplinkRelayRequest
+		json.NewDecoder(r.Body).Decode(&request)
+		w.WriteHeader(http.StatusOK)
+		if request.Variables["apiKey"] == "valid-key" {
+			w.Write([]byte(`{"data":{"routerEntitlements":{"__typename":"RouterEntitlementsResult","id":"2024-10-03T12:00:00Z","minDelaySeconds":60,"entitlement":null}}}`))
+			return
+		}
+		w.Write([]byte(`{"data":{"routerEntitlements":{"__typename":"FetchError","code":"AUTHENTICATION_FAILED","message":"invalid api key"}}}`))
+	}))
+	defer server.Close()
+
+	userConfig.Uplink.URLs = []string{server.URL}
+
+	// Test case 1: A valid key passes verification
+	if err := VerifyAPIKey(context.Background(), userConfig, logger, "example-graph@current", "valid-key"); err != nil {
+		t.Errorf("Expected valid key to pass verification, got %v", err)
+	}
+
+	// Test case 2: An invalid key fails verification with the uplink error
+	err := VerifyAPIKey(context.Background(), userConfig, logger, "example-graph@current", "invalid-key")
+	if err == nil {
+		t.Fatalf("Expected invalid key to fail verification")
+	}
+	if !strings.Contains(err.Error(), "AUTHENTICATION_FAILED") {
+		t.Errorf("Expected error to contain the uplink error code, got %v", err)
+	}
+}
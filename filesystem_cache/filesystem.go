@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"os"
 	"path"
+	"strings"
 )
 
 const PERMISSIONS = 0644
@@ -77,6 +78,32 @@ func (c *FilesystemCache) DeleteWithPrefix(prefix string) error {
 	return nil
 }
 
+func (c *FilesystemCache) KeysWithPrefix(prefix string) ([]string, error) {
+	// List all files with the given prefix, as each file name is a cache key
+	files, err := os.ReadDir(c.path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read directory %s: %v", c.path, err)
+	}
+	keys := make([]string, 0)
+	for _, file := range files {
+		if !file.Type().IsRegular() {
+			continue
+		}
+		if strings.HasPrefix(file.Name(), prefix) {
+			keys = append(keys, file.Name())
+		}
+	}
+	return keys, nil
+}
+
+func (c *FilesystemCache) TTL(key string) (int, bool) {
+	// Files are never pruned, so entries that exist never expire
+	if _, err := os.Stat(fmt.Sprintf("%v/%v", c.path, key)); err != nil {
+		return 0, false
+	}
+	return -1, true
+}
+
 func (c *FilesystemCache) Name() string {
 	return "Filesystem"
 }
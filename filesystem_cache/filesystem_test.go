@@ -3,6 +3,7 @@ package filesystem_cache
 import (
 	"os"
 	"path/filepath"
+	"reflect"
 	"testing"
 )
 
@@ -142,6 +143,27 @@ func TestFilesystemCache_DeleteWithPrefix(t *testing.T) {
 	}
 }
 
+func TestFilesystemCache_KeysWithPrefix(t *testing.T) {
+	cachePath, _ := os.MkdirTemp("", "filesystem_cache_test")
+	defer os.RemoveAll(cachePath)
+	cache, _ := NewFilesystemCache(cachePath)
+
+	// Create test entries with different prefixes
+	for _, key := range []string{"prefix1_key2", "prefix1_key1", "prefix2_key"} {
+		if err := cache.Set(key, "test_content", -1); err != nil {
+			t.Errorf("Failed to create test entry: %v", err)
+		}
+	}
+
+	keys, err := cache.KeysWithPrefix("prefix1")
+	if err != nil {
+		t.Errorf("Failed to list keys with prefix: %v", err)
+	}
+	if !reflect.DeepEqual(keys, []string{"prefix1_key1", "prefix1_key2"}) {
+		t.Errorf("Expected the keys with prefix1, got %v", keys)
+	}
+}
+
 func TestFilesystemCache_Name(t *testing.T) {
 	cachePath, _ := os.MkdirTemp("", "filesystem_cache_test")
 	defer os.RemoveAll(cachePath)
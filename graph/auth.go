@@ -0,0 +1,27 @@
+package graph
+
+import (
+	"apollosolutions/uplink-relay/internal/relayerrors"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// RequestAuthorized returns whether the request sends the management API secret as a bearer token in the Authorization header.
+// Requests are never authorized if no secret is configured.
+func RequestAuthorized(r *http.Request, secret string) bool {
+	if secret == "" {
+		return false
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(token), []byte(secret)) == 1
+}
+
+// checkWritable returns an unauthorized error for the given mutation if the management API is read-only.
+func (r *ResolverContext) checkWritable(mutation string) error {
+	if r.UserConfig != nil && r.UserConfig.ManagementAPI.ReadOnly {
+		return fmt.Errorf("%w: %s isn't allowed, as the management API is read-only", relayerrors.ErrUnauthorized, mutation)
+	}
+	return nil
+}
@@ -0,0 +1,39 @@
+package graph
+
+import (
+	"apollosolutions/uplink-relay/cache"
+	"apollosolutions/uplink-relay/graph/model"
+	"apollosolutions/uplink-relay/internal/relayerrors"
+	"fmt"
+	"time"
+)
+
+// ExportCache exports every entry of the cache as an encoded archive, to be imported into another relay with ImportCache.
+func (r *ResolverContext) ExportCache(now time.Time) (*model.CacheExport, error) {
+	archive, err := cache.ExportArchive(r.SystemCache, now)
+	if err != nil {
+		r.Logger.Error("Failed to export the cache", "err", err)
+		return nil, err
+	}
+	encoded, err := archive.Encode()
+	if err != nil {
+		return nil, err
+	}
+	r.Logger.Info("Exported the cache", "entries", len(archive.Entries))
+	return &model.CacheExport{Archive: encoded, Entries: len(archive.Entries)}, nil
+}
+
+// ImportCache imports the entries of an archive exported by ExportCache into the cache.
+func (r *ResolverContext) ImportCache(encoded string, now time.Time) (*model.ImportCacheResult, error) {
+	archive, err := cache.DecodeArchive(encoded, r.UserConfig.Cache.MaxSize)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", relayerrors.ErrInvalidRequest, err)
+	}
+	imported, err := cache.ImportArchive(r.SystemCache, archive, now)
+	if err != nil {
+		r.Logger.Error("Failed to import the cache", "imported", imported, "err", err)
+		return nil, err
+	}
+	r.Logger.Info("Imported the cache", "imported", imported, "exportedAt", archive.ExportedAt)
+	return &model.ImportCacheResult{Imported: imported, Skipped: len(archive.Entries) - imported}, nil
+}
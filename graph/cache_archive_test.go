@@ -0,0 +1,76 @@
+package graph
+
+import (
+	"apollosolutions/uplink-relay/cache"
+	"apollosolutions/uplink-relay/config"
+	"apollosolutions/uplink-relay/logger"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestExportImportCache(t *testing.T) {
+	pFalse := false
+	newResolverContext := func() *ResolverContext {
+		userConfig := config.NewDefaultConfig()
+		userConfig.Supergraphs = []config.SupergraphConfig{{GraphRef: "graph@current", ApolloKey: "1234"}}
+		return &ResolverContext{
+			Logger:      logger.MakeLogger(&pFalse),
+			SystemCache: cache.NewMemoryCache(100),
+			UserConfig:  userConfig,
+			Authorized:  true,
+		}
+	}
+	query := func(resolverContext *ResolverContext, query string, variables map[string]interface{}) map[string]interface{} {
+		return queryManagementAPI(t, resolverContext, query, variables)
+	}
+
+	// A warm relay exports its cache
+	source := newResolverContext()
+	schemaKey := cache.DefaultCacheKey("graph@current", "SupergraphSdlQuery")
+	schemaItem, _ := json.Marshal(cache.CacheItem{ID: "1", Hash: "hash", Content: []byte("schema"), Expiration: cache.IndefiniteTimestamp, LastModified: time.Now()})
+	source.SystemCache.Set(schemaKey, string(schemaItem), -1)
+	source.SystemCache.Set("chunk:1234", `{"operations":[]}`, 60)
+
+	response := query(source, `query { exportCache { archive entries } }`, nil)
+	if response["errors"] != nil {
+		t.Fatalf("Unexpected errors: %v", response["errors"])
+	}
+	export := response["data"].(map[string]interface{})["exportCache"].(map[string]interface{})
+	if export["entries"] != float64(2) {
+		t.Errorf("Expected 2 entries to be exported, got %v", export["entries"])
+	}
+
+	// ...which a new relay imports
+	destination := newResolverContext()
+	response = query(destination, `mutation($archive: String!) { importCache(archive: $archive) { imported skipped } }`, map[string]interface{}{"archive": export["archive"]})
+	if response["errors"] != nil {
+		t.Fatalf("Unexpected errors: %v", response["errors"])
+	}
+	if result := response["data"].(map[string]interface{})["importCache"].(map[string]interface{}); result["imported"] != float64(2) || result["skipped"] != float64(0) {
+		t.Errorf("Expected 2 entries to be imported, got %v", result)
+	}
+	for _, key := range []string{schemaKey, "chunk:1234"} {
+		expected, _ := source.SystemCache.Get(key)
+		if content, ok := destination.SystemCache.Get(key); !ok || string(content) != string(expected) {
+			t.Errorf("Expected %s to be imported, got %s", key, content)
+		}
+	}
+
+	// Invalid archives are rejected
+	response = query(destination, `mutation { importCache(archive: "not an archive") { imported } }`, nil)
+	if response["errors"] == nil {
+		t.Errorf("Expected an error importing an invalid archive")
+	}
+
+	// The management API secret is required, as the archive includes licenses
+	source.Authorized = false
+	if response := query(source, `query { exportCache { archive } }`, nil); response["errors"] == nil {
+		t.Errorf("Expected an unauthorized export to be rejected, got %v", response)
+	}
+	destination.Authorized = false
+	response = query(destination, `mutation($archive: String!) { importCache(archive: $archive) { imported } }`, map[string]interface{}{"archive": export["archive"]})
+	if response["errors"] == nil {
+		t.Errorf("Expected an unauthorized import to be rejected, got %v", response)
+	}
+}
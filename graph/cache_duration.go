@@ -0,0 +1,22 @@
+package graph
+
+import (
+	"apollosolutions/uplink-relay/internal/relayerrors"
+	"fmt"
+)
+
+// SetCacheDuration sets the duration, in seconds, that artifacts are cached for from now on, returning the new duration.
+// It only changes the running configuration, so reloading the configuration or restarting the relay resets it.
+func (r *ResolverContext) SetCacheDuration(seconds int) (int, error) {
+	if seconds <= 0 && seconds != -1 {
+		return 0, fmt.Errorf("%w: cache duration must be positive, or -1 to cache indefinitely", relayerrors.ErrInvalidRequest)
+	}
+	// Polled artifacts would never expire, so stale ones would be served if polling stops refreshing them
+	if seconds == -1 && r.UserConfig.Polling.Enabled {
+		return 0, fmt.Errorf("%w: cache duration can't be -1 while polling is enabled", relayerrors.ErrInvalidRequest)
+	}
+	previous := r.UserConfig.CacheDuration()
+	r.UserConfig.SetCacheDuration(seconds)
+	r.Logger.Warn("Cache duration changed until the configuration is reloaded", "duration", seconds, "previousDuration", previous)
+	return seconds, nil
+}
@@ -0,0 +1,84 @@
+package graph
+
+import (
+	"apollosolutions/uplink-relay/cache"
+	"apollosolutions/uplink-relay/config"
+	"apollosolutions/uplink-relay/logger"
+	"apollosolutions/uplink-relay/schema"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// durationCache records the duration of the last write to the underlying cache.
+type durationCache struct {
+	cache.Cache
+	duration int
+}
+
+func (c *durationCache) Set(key string, content string, duration int) error {
+	c.duration = duration
+	return c.Cache.Set(key, content, duration)
+}
+
+func TestSetCacheDuration(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"data":{"routerConfig":{"__typename":"RouterConfigResult","id":"1","supergraphSdl":"schema","minDelaySeconds":30}}}`))
+	}))
+	defer server.Close()
+
+	graphRef := "graph@current"
+	userConfig := config.NewDefaultConfig()
+	userConfig.Cache.Duration = 60
+	userConfig.Uplink.URLs = []string{server.URL}
+	userConfig.Supergraphs = []config.SupergraphConfig{{GraphRef: graphRef, ApolloKey: "1234"}}
+	systemCache := &durationCache{Cache: cache.NewMemoryCache(100)}
+	pFalse := false
+	resolverContext := &ResolverContext{
+		Logger:      logger.MakeLogger(&pFalse),
+		SystemCache: systemCache,
+		UserConfig:  userConfig,
+		Authorized:  true,
+	}
+	query := func(query string) map[string]interface{} {
+		return queryManagementAPI(t, resolverContext, query, nil)
+	}
+
+	response := query(`mutation { setCacheDuration(seconds: 5) }`)
+	if response["errors"] != nil {
+		t.Fatalf("Unexpected errors: %v", response["errors"])
+	}
+	if duration := response["data"].(map[string]interface{})["setCacheDuration"]; duration != float64(5) {
+		t.Errorf("Expected the new duration to be returned, got %v", duration)
+	}
+
+	// Artifacts cached from now on use the new duration
+	if err := schema.FetchSchema(context.Background(), userConfig, systemCache, resolverContext.Logger, graphRef, ""); err != nil {
+		t.Fatalf("Failed to fetch the schema: %v", err)
+	}
+	if systemCache.duration != 5 {
+		t.Errorf("Expected the schema to be cached for 5 seconds, got %d", systemCache.duration)
+	}
+
+	// Invalid durations are rejected, keeping the current one
+	response = query(`mutation { setCacheDuration(seconds: 0) }`)
+	if response["errors"] == nil || userConfig.CacheDuration() != 5 {
+		t.Errorf("Expected an invalid duration to be rejected, got %v with duration %d", response, userConfig.CacheDuration())
+	}
+
+	// Caching indefinitely is rejected while polling is enabled
+	userConfig.Polling.Enabled = true
+	response = query(`mutation { setCacheDuration(seconds: -1) }`)
+	if response["errors"] == nil || userConfig.CacheDuration() != 5 {
+		t.Errorf("Expected an indefinite duration to be rejected while polling, got %v with duration %d", response, userConfig.CacheDuration())
+	}
+	userConfig.Polling.Enabled = false
+
+	// The management API secret is required
+	resolverContext.Authorized = false
+	response = query(`mutation { setCacheDuration(seconds: -1) }`)
+	if response["errors"] == nil || userConfig.CacheDuration() != 5 {
+		t.Errorf("Expected an unauthorized request to be rejected, got %v with duration %d", response, userConfig.CacheDuration())
+	}
+}
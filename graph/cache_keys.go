@@ -0,0 +1,51 @@
+package graph
+
+import (
+	"apollosolutions/uplink-relay/cache"
+	"apollosolutions/uplink-relay/graph/model"
+	"apollosolutions/uplink-relay/internal/util"
+	"strings"
+	"time"
+)
+
+// GetCacheKeys lists the cache keys generated for the given graph, along with their operation and remaining TTL.
+func (r *ResolverContext) GetCacheKeys(graphRef string, now time.Time) ([]*model.CacheKeyInfo, error) {
+	if _, _, err := util.ParseGraphRef(graphRef); err != nil {
+		return nil, err
+	}
+
+	// All keys for a graph share the graphID:variantID: prefix, after the key version, followed by the operation name
+	prefix := cache.MakeCachePrefix(graphRef, "")
+	keys, err := r.SystemCache.KeysWithPrefix(prefix)
+	if err != nil {
+		r.Logger.Error("Error listing cache keys", "graphRef", graphRef, "error", err)
+		return nil, err
+	}
+
+	cacheKeys := make([]*model.CacheKeyInfo, 0, len(keys))
+	for _, key := range keys {
+		operation, _, _ := strings.Cut(strings.TrimPrefix(key, prefix), ":")
+		info := &model.CacheKeyInfo{
+			Key:       key,
+			Operation: operation,
+			IsDefault: key == cache.DefaultCacheKey(graphRef, operation),
+		}
+
+		if cacheBytes, ok := r.SystemCache.Get(key); ok {
+			var cacheItem cache.CacheItem
+			if err := cache.DecodeItem(cacheBytes, &cacheItem); err != nil {
+				r.Logger.Error("Error unmarshalling cache entry", "key", key, "error", err)
+			} else if !cacheItem.Expiration.IsZero() && !cacheItem.Expiration.Equal(cache.IndefiniteTimestamp) {
+				expiration := cacheItem.Expiration.UTC().Format(time.RFC3339)
+				ttlSeconds := int(cacheItem.Expiration.Sub(now).Seconds())
+				if ttlSeconds < 0 {
+					ttlSeconds = 0
+				}
+				info.Expiration = &expiration
+				info.TTLSeconds = &ttlSeconds
+			}
+		}
+		cacheKeys = append(cacheKeys, info)
+	}
+	return cacheKeys, nil
+}
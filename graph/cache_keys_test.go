@@ -0,0 +1,78 @@
+package graph
+
+import (
+	"apollosolutions/uplink-relay/cache"
+	"apollosolutions/uplink-relay/config"
+	"apollosolutions/uplink-relay/logger"
+	"apollosolutions/uplink-relay/pinning"
+	"apollosolutions/uplink-relay/uplink"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestGetCacheKeys(t *testing.T) {
+	now := time.Now()
+	pFalse := false
+	graphRef := "graph@current"
+	systemCache := cache.NewMemoryCache(100)
+
+	setItem := func(key string, expiration time.Time) {
+		item, _ := json.Marshal(cache.CacheItem{Content: []byte("content"), Expiration: expiration, LastModified: now})
+		systemCache.Set(key, string(item), -1)
+	}
+
+	// Seed the cache with a default key, a hashed-variant key, a pinned key and a key for another graph
+	defaultKey := cache.DefaultCacheKey(graphRef, uplink.SupergraphQuery)
+	variantKey := cache.MakeCacheKey(graphRef, uplink.SupergraphQuery, map[string]interface{}{"graph_ref": graphRef, "ifAfterId": "1234"})
+	pinnedKey := cache.MakeCacheKey(graphRef, pinning.LicensePinned)
+	setItem(defaultKey, cache.IndefiniteTimestamp)
+	setItem(variantKey, now.Add(time.Minute))
+	setItem(pinnedKey, cache.IndefiniteTimestamp)
+	setItem(cache.DefaultCacheKey("other@current", uplink.SupergraphQuery), cache.IndefiniteTimestamp)
+
+	resolverContext := &ResolverContext{
+		Logger:      logger.MakeLogger(&pFalse),
+		SystemCache: systemCache,
+		UserConfig:  config.NewDefaultConfig(),
+	}
+
+	cacheKeys, err := resolverContext.GetCacheKeys(graphRef, now)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(cacheKeys) != 3 {
+		t.Fatalf("Expected 3 cache keys, got %d", len(cacheKeys))
+	}
+
+	found := map[string]bool{}
+	for _, info := range cacheKeys {
+		found[info.Key] = true
+		switch info.Key {
+		case defaultKey:
+			if !info.IsDefault || info.Operation != uplink.SupergraphQuery || info.TTLSeconds != nil {
+				t.Errorf("Expected an indefinite default supergraph key, got %+v", info)
+			}
+		case variantKey:
+			if info.IsDefault || info.Operation != uplink.SupergraphQuery {
+				t.Errorf("Expected a hashed-variant supergraph key, got %+v", info)
+			}
+			if info.TTLSeconds == nil || *info.TTLSeconds != 60 || info.Expiration == nil {
+				t.Errorf("Expected a TTL of 60 seconds, got %+v", info)
+			}
+		case pinnedKey:
+			if info.IsDefault || info.Operation != pinning.LicensePinned {
+				t.Errorf("Expected a pinned license key, got %+v", info)
+			}
+		}
+	}
+	for _, key := range []string{defaultKey, variantKey, pinnedKey} {
+		if !found[key] {
+			t.Errorf("Expected key %s to be listed", key)
+		}
+	}
+
+	if _, err := resolverContext.GetCacheKeys("invalid", now); err == nil {
+		t.Errorf("Expected an error for an invalid graphRef")
+	}
+}
@@ -0,0 +1,40 @@
+package graph
+
+import (
+	"apollosolutions/uplink-relay/graph/model"
+	"apollosolutions/uplink-relay/metrics"
+	"fmt"
+	"time"
+)
+
+// GetCacheStats returns the cache hit rates within the sliding window ending at the given time, per operation and per graph.
+func (r *ResolverContext) GetCacheStats(now time.Time) (*model.CacheStats, error) {
+	if r.CacheHitRates == nil {
+		return nil, fmt.Errorf("cache stats are not available")
+	}
+
+	snapshot := r.CacheHitRates.Snapshot(now)
+	return &model.CacheStats{
+		WindowSeconds: int(snapshot.Window / time.Second),
+		Total:         cacheHitRate(snapshot.Total),
+		Operations:    cacheHitRates(snapshot.Operations),
+		Graphs:        cacheHitRates(snapshot.Graphs),
+	}, nil
+}
+
+func cacheHitRate(rate metrics.HitRate) *model.CacheHitRate {
+	return &model.CacheHitRate{
+		Name:    rate.Name,
+		Hits:    rate.Hits,
+		Misses:  rate.Misses,
+		HitRate: rate.Ratio(),
+	}
+}
+
+func cacheHitRates(rates []metrics.HitRate) []*model.CacheHitRate {
+	result := make([]*model.CacheHitRate, 0, len(rates))
+	for _, rate := range rates {
+		result = append(result, cacheHitRate(rate))
+	}
+	return result
+}
@@ -0,0 +1,43 @@
+package graph
+
+import (
+	"apollosolutions/uplink-relay/metrics"
+	"testing"
+	"time"
+)
+
+func TestGetCacheStats(t *testing.T) {
+	now := time.Now()
+	hitRates := metrics.NewHitRateWindow(5 * time.Minute)
+	hitRates.Record("graph@a", "SupergraphSdlQuery", false, now.Add(-time.Minute))
+	hitRates.Record("graph@a", "SupergraphSdlQuery", true, now)
+	hitRates.Record("graph@a", "SupergraphSdlQuery", true, now)
+	hitRates.Record("graph@b", "LicenseQuery", true, now)
+	// Outside the window, so it isn't counted
+	hitRates.Record("graph@b", "LicenseQuery", false, now.Add(-10*time.Minute))
+
+	resolverContext := &ResolverContext{CacheHitRates: hitRates}
+	stats, err := resolverContext.GetCacheStats(now)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if stats.WindowSeconds != 300 {
+		t.Errorf("Expected a window of 300 seconds, got %d", stats.WindowSeconds)
+	}
+	if stats.Total.Hits != 3 || stats.Total.Misses != 1 || stats.Total.HitRate != 0.75 {
+		t.Errorf("Expected 3 hits and 1 miss in total, got %+v", stats.Total)
+	}
+	if len(stats.Operations) != 2 || stats.Operations[0].Name != "LicenseQuery" || stats.Operations[0].HitRate != 1 ||
+		stats.Operations[1].Name != "SupergraphSdlQuery" || stats.Operations[1].HitRate != 2.0/3.0 {
+		t.Errorf("Unexpected operation hit rates: %+v, %+v", stats.Operations[0], stats.Operations[1])
+	}
+	if len(stats.Graphs) != 2 || stats.Graphs[0].Name != "graph@a" || stats.Graphs[0].Hits != 2 || stats.Graphs[0].Misses != 1 ||
+		stats.Graphs[1].Name != "graph@b" || stats.Graphs[1].Misses != 0 {
+		t.Errorf("Unexpected graph hit rates: %+v, %+v", stats.Graphs[0], stats.Graphs[1])
+	}
+
+	if _, err := (&ResolverContext{}).GetCacheStats(now); err == nil {
+		t.Errorf("Expected an error without a hit rate collector")
+	}
+}
@@ -8,12 +8,91 @@ import (
 	"apollosolutions/uplink-relay/uplink"
 	"bytes"
 	"compress/zlib"
+	"context"
 	"encoding/json"
 	"io"
 	"strconv"
+	"sync"
+	"time"
+
+	"github.com/99designs/gqlgen/graphql"
+	"github.com/vektah/gqlparser/v2/ast"
 )
 
-func (r *ResolverContext) GetConfigDetails() *model.Configuration {
+// ConfigDetailsCache memoizes the assembled configuration for a short time, as assembling it reads every supergraph's
+// cache entries and decompresses every persisted query chunk, which is expensive for dashboards polling the management API.
+type ConfigDetailsCache struct {
+	mu             sync.Mutex
+	ttl            time.Duration
+	configurations map[bool]memoizedConfiguration // Keyed by whether the persisted query chunk bodies are included.
+}
+
+type memoizedConfiguration struct {
+	configuration *model.Configuration
+	expiresAt     time.Time
+}
+
+// NewConfigDetailsCache creates a new ConfigDetailsCache keeping the configuration for the given TTL.
+func NewConfigDetailsCache(ttl time.Duration) *ConfigDetailsCache {
+	return &ConfigDetailsCache{ttl: ttl, configurations: make(map[bool]memoizedConfiguration)}
+}
+
+// Invalidate drops the memoized configuration, so the next request reassembles it.
+func (c *ConfigDetailsCache) Invalidate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	clear(c.configurations)
+}
+
+// InvalidateConfigDetails drops the memoized configuration after the management API changes the cache.
+func (r *ResolverContext) InvalidateConfigDetails() {
+	if r.ConfigDetails != nil {
+		r.ConfigDetails.Invalidate()
+	}
+}
+
+// GetConfigDetails returns the relay's configuration and the cached artifacts of each supergraph, reusing the memoized result if it hasn't expired.
+// Persisted query chunks are only decompressed if includeChunks is set, as they can be very large.
+func (r *ResolverContext) GetConfigDetails(includeChunks bool) *model.Configuration {
+	if r.ConfigDetails == nil {
+		return r.buildConfigDetails(includeChunks)
+	}
+
+	r.ConfigDetails.mu.Lock()
+	defer r.ConfigDetails.mu.Unlock()
+	if memoized, ok := r.ConfigDetails.configurations[includeChunks]; ok && time.Now().Before(memoized.expiresAt) {
+		return memoized.configuration
+	}
+
+	configuration := r.buildConfigDetails(includeChunks)
+	// Failures aren't memoized, so the next request retries
+	if configuration != nil {
+		r.ConfigDetails.configurations[includeChunks] = memoizedConfiguration{configuration: configuration, expiresAt: time.Now().Add(r.ConfigDetails.ttl)}
+	}
+	return configuration
+}
+
+// persistedQueryChunksRequested returns whether the persistedQueryChunks field is selected anywhere below the field being resolved.
+func persistedQueryChunksRequested(ctx context.Context) bool {
+	fieldContext := graphql.GetFieldContext(ctx)
+	if fieldContext == nil || !graphql.HasOperationContext(ctx) {
+		return true
+	}
+	return fieldSelected(graphql.GetOperationContext(ctx), fieldContext.Field.Selections, "persistedQueryChunks")
+}
+
+// fieldSelected returns whether a field with the given name is in the selection set or any nested selection set, including fragments.
+func fieldSelected(operationContext *graphql.OperationContext, selectionSet ast.SelectionSet, name string) bool {
+	for _, field := range graphql.CollectFields(operationContext, selectionSet, nil) {
+		if field.Name == name || fieldSelected(operationContext, field.Selections, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// buildConfigDetails assembles the configuration from the system cache.
+func (r *ResolverContext) buildConfigDetails(includeChunks bool) *model.Configuration {
 	supergraphs := make([]*model.Supergraph, 0)
 
 	for _, supergraph := range r.UserConfig.Supergraphs {
@@ -28,7 +107,7 @@ func (r *ResolverContext) GetConfigDetails() *model.Configuration {
 		supergrahCacheBytes, ok := r.SystemCache.Get(supergraphCacheKey)
 
 		if ok {
-			err := json.Unmarshal([]byte(supergrahCacheBytes), &supergraphCacheEntry)
+			err := cache.DecodeItem(supergrahCacheBytes, &supergraphCacheEntry)
 			// if successful, this will set currentSchema to the schema in the cache
 			if err == nil {
 				if len(supergraphCacheEntry.Content) == 0 {
@@ -66,8 +145,8 @@ func (r *ResolverContext) GetConfigDetails() *model.Configuration {
 
 		persistedQueryCacheBytes, ok := r.SystemCache.Get(persistedQueryCacheKey)
 		if ok {
-			var persistedQueryManifestCacheItem *cache.CacheItem
-			err := json.Unmarshal([]byte(persistedQueryCacheBytes), &persistedQueryManifestCacheItem)
+			var persistedQueryManifestCacheItem cache.CacheItem
+			err := cache.DecodeItem(persistedQueryCacheBytes, &persistedQueryManifestCacheItem)
 			if err != nil {
 				return nil
 			}
@@ -80,18 +159,21 @@ func (r *ResolverContext) GetConfigDetails() *model.Configuration {
 			}
 
 			chunks := make([]string, 0)
-			for index, chunk := range persistedQueryManifest.Data.PersistedQueries.Chunks {
-				pqBytes, ok := r.SystemCache.Get(persistedqueries.MakePersistedQueryCacheKey(chunk.ID, strconv.Itoa(index)))
-				if ok {
-					reader, err := zlib.NewReader(bytes.NewReader(pqBytes))
-					if err != nil {
-						r.Logger.Error("Error creating zlib reader", "error", err)
-						return nil
-					}
-					defer reader.Close()
-					b, err := io.ReadAll(reader)
-					if err == nil {
-						chunks = append(chunks, string(b[:]))
+			// Only decompress the chunks if they were requested, as they can be very large
+			if includeChunks {
+				for index, chunk := range persistedQueryManifest.Data.PersistedQueries.Chunks {
+					pqBytes, ok := r.SystemCache.Get(persistedqueries.MakePersistedQueryCacheKey(supergraph.GraphRef, chunk.ID, strconv.Itoa(index)))
+					if ok {
+						reader, err := zlib.NewReader(bytes.NewReader(pqBytes))
+						if err != nil {
+							r.Logger.Error("Error creating zlib reader", "error", err)
+							return nil
+						}
+						defer reader.Close()
+						b, err := io.ReadAll(reader)
+						if err == nil {
+							chunks = append(chunks, string(b[:]))
+						}
 					}
 				}
 			}
@@ -0,0 +1,140 @@
+package graph
+
+import (
+	"apollosolutions/uplink-relay/cache"
+	"apollosolutions/uplink-relay/config"
+	"apollosolutions/uplink-relay/logger"
+	persistedqueries "apollosolutions/uplink-relay/persisted_queries"
+	"apollosolutions/uplink-relay/uplink"
+	"bytes"
+	"compress/zlib"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/99designs/gqlgen/graphql/handler"
+)
+
+// countingCache counts the reads from the underlying cache.
+type countingCache struct {
+	cache.Cache
+	gets   atomic.Int32
+	mu     sync.Mutex
+	chunks int // Reads of persisted query chunks.
+}
+
+func (c *countingCache) Get(key string) ([]byte, bool) {
+	c.gets.Add(1)
+	if strings.HasPrefix(key, "pq:") {
+		c.mu.Lock()
+		c.chunks++
+		c.mu.Unlock()
+	}
+	return c.Cache.Get(key)
+}
+
+func TestGetConfigDetailsMemoized(t *testing.T) {
+	pFalse := false
+	graphRef := "graph@current"
+	systemCache := &countingCache{Cache: cache.NewMemoryCache(100)}
+	item, _ := json.Marshal(cache.CacheItem{ID: "1", Content: []byte("type Query { a: String }"), Expiration: cache.IndefiniteTimestamp, LastModified: time.Now()})
+	systemCache.Set(cache.DefaultCacheKey(graphRef, uplink.SupergraphQuery), string(item), -1)
+
+	userConfig := config.NewDefaultConfig()
+	userConfig.Supergraphs = []config.SupergraphConfig{{GraphRef: graphRef}}
+	resolverContext := &ResolverContext{
+		Logger:        logger.MakeLogger(&pFalse),
+		SystemCache:   systemCache,
+		UserConfig:    userConfig,
+		ConfigDetails: NewConfigDetailsCache(time.Minute),
+	}
+
+	configuration := resolverContext.GetConfigDetails(true)
+	if configuration == nil || len(configuration.Supergraphs) != 1 || configuration.Supergraphs[0].CurrentSchema == nil {
+		t.Fatalf("Expected the cached schema in the configuration, got %+v", configuration)
+	}
+	reads := systemCache.gets.Load()
+
+	// Repeated calls within the TTL don't read the cache again
+	for i := 0; i < 3; i++ {
+		if resolverContext.GetConfigDetails(true) != configuration {
+			t.Errorf("Expected the memoized configuration")
+		}
+	}
+	if systemCache.gets.Load() != reads {
+		t.Errorf("Expected no cache reads within the TTL, got %d", systemCache.gets.Load()-reads)
+	}
+
+	// Invalidating, e.g. after a mutation, reassembles the configuration
+	resolverContext.InvalidateConfigDetails()
+	resolverContext.GetConfigDetails(true)
+	if systemCache.gets.Load() == reads {
+		t.Errorf("Expected the cache to be read after invalidation")
+	}
+
+	// Without a ConfigDetailsCache, every call reads the cache
+	resolverContext.ConfigDetails = nil
+	reads = systemCache.gets.Load()
+	resolverContext.GetConfigDetails(true)
+	if systemCache.gets.Load() == reads {
+		t.Errorf("Expected the cache to be read without memoization")
+	}
+}
+
+func TestGetConfigDetailsChunksSelected(t *testing.T) {
+	pFalse := false
+	graphRef := "graph@current"
+	systemCache := &countingCache{Cache: cache.NewMemoryCache(100)}
+
+	// Seed the cache with a persisted query manifest and its compressed chunk
+	manifest := []byte(`{"data":{"persistedQueries":{"id":"manifest1","chunks":[{"id":"graph/chunk1","urls":[]}]}}}`)
+	item, _ := json.Marshal(cache.CacheItem{ID: "manifest1", Content: manifest, Expiration: cache.IndefiniteTimestamp, LastModified: time.Now()})
+	systemCache.Set(cache.MakeCacheKey(graphRef, uplink.PersistedQueriesQuery, map[string]interface{}{"graph_ref": graphRef, "ifAfterId": ""}), string(item), -1)
+	var chunk bytes.Buffer
+	writer := zlib.NewWriter(&chunk)
+	writer.Write([]byte(`{"operations":[]}`))
+	writer.Close()
+	systemCache.Set(persistedqueries.MakePersistedQueryCacheKey(graphRef, "graph/chunk1", "0"), chunk.String(), -1)
+
+	userConfig := config.NewDefaultConfig()
+	userConfig.Supergraphs = []config.SupergraphConfig{{GraphRef: graphRef}}
+	resolverContext := &ResolverContext{
+		Logger:      logger.MakeLogger(&pFalse),
+		SystemCache: systemCache,
+		UserConfig:  userConfig,
+	}
+	server := handler.NewDefaultServer(NewExecutableSchema(Config{Resolvers: &Resolver{}}))
+
+	query := func(query string) string {
+		body, _ := json.Marshal(map[string]string{"query": query})
+		req := httptest.NewRequest(http.MethodPost, "/graphql", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		rr := httptest.NewRecorder()
+		server.ServeHTTP(rr, req.WithContext(context.WithValue(req.Context(), ResolverKey, resolverContext)))
+		return rr.Body.String()
+	}
+
+	// Only the manifest ID is selected, so the chunks aren't read
+	response := query(`{ currentConfiguration { supergraphs { persistedQueryManifest { id } } } }`)
+	if !strings.Contains(response, "manifest1") {
+		t.Fatalf("Expected the manifest ID, got %s", response)
+	}
+	if systemCache.chunks != 0 {
+		t.Errorf("Expected no chunk reads, got %d", systemCache.chunks)
+	}
+
+	// Selecting the chunks, including through a fragment, decompresses them
+	response = query(`{ currentConfiguration { supergraphs { ...manifest } } } fragment manifest on Supergraph { persistedQueryManifest { persistedQueryChunks } }`)
+	if !strings.Contains(response, "operations") {
+		t.Errorf("Expected the chunk contents, got %s", response)
+	}
+	if systemCache.chunks == 0 {
+		t.Errorf("Expected the chunks to be read")
+	}
+}
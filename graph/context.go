@@ -3,6 +3,7 @@ package graph
 import (
 	"apollosolutions/uplink-relay/cache"
 	"apollosolutions/uplink-relay/config"
+	"apollosolutions/uplink-relay/metrics"
 	"context"
 	"log/slog"
 )
@@ -10,9 +11,14 @@ import (
 // This file will not be regenerated automatically.
 
 type ResolverContext struct {
-	Logger      *slog.Logger
-	SystemCache cache.Cache
-	UserConfig  *config.Config
+	Logger        *slog.Logger
+	SystemCache   cache.Cache
+	UserConfig    *config.Config
+	ConfigDetails *ConfigDetailsCache            // Memoizes GetConfigDetails across requests; nil disables it.
+	Authorized    bool                           // Whether the request was authenticated with the management API secret.
+	ReloadConfig  func() (*config.Config, error) // Reloads the configuration file, returning the new configuration; nil if reloading isn't supported.
+	CacheHitRates *metrics.HitRateWindow         // The relay's cache hits and misses, served by the cacheStats query.
+	Cooldown      *MutationCooldown              // Limits how often mutations calling Apollo's APIs run for each graph, across requests; nil disables it.
 }
 
 type keyType string
@@ -0,0 +1,57 @@
+package graph
+
+import (
+	"apollosolutions/uplink-relay/config"
+	"apollosolutions/uplink-relay/internal/relayerrors"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// MutationCooldown limits how often each mutation calling Apollo's APIs runs for a graph, so automation calling it in a loop
+// can't exhaust the API quota shared with every other client of the graph's organization.
+type MutationCooldown struct {
+	interval time.Duration        // Minimum interval between runs of a mutation for a graph.
+	mu       sync.Mutex           // Guards lastRuns.
+	lastRuns map[string]time.Time // Time of the last allowed run, keyed by mutation and graph ref.
+}
+
+// NewMutationCooldown creates a new MutationCooldown allowing a run of each mutation per graph every interval.
+func NewMutationCooldown(interval time.Duration) *MutationCooldown {
+	return &MutationCooldown{interval: interval, lastRuns: make(map[string]time.Time)}
+}
+
+// Allow records a run of the mutation for the graph at the given time, or returns a rate limited error telling when to try again
+// if it already ran within the interval. Runs are counted whether they succeed or not, as failed runs call Apollo's APIs as well.
+func (c *MutationCooldown) Allow(mutation string, graphRef string, now time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// Runs older than the interval no longer limit anything, so they're evicted to keep the map from growing
+	for key, lastRun := range c.lastRuns {
+		if !lastRun.Add(c.interval).After(now) {
+			delete(c.lastRuns, key)
+		}
+	}
+
+	key := mutation + ":" + graphRef
+	if lastRun, ok := c.lastRuns[key]; ok {
+		wait := lastRun.Add(c.interval).Sub(now)
+		return fmt.Errorf("%w: %s already ran for %s, try again later in %s", relayerrors.ErrRateLimited, mutation, graphRef, time.Duration(math.Ceil(wait.Seconds()))*time.Second)
+	}
+	c.lastRuns[key] = now
+	return nil
+}
+
+// checkCooldown returns a rate limited error if the mutation ran for the graph within the cooldown interval.
+// Graphs that aren't configured are rejected first, so arbitrary graph refs don't add runs to the cooldown.
+func (r *ResolverContext) checkCooldown(mutation string, graphRef string) error {
+	if r.Cooldown == nil {
+		return nil
+	}
+	if _, err := config.FindSupergraphConfigFromGraphRef(graphRef, r.UserConfig); err != nil {
+		return err
+	}
+	return r.Cooldown.Allow(mutation, graphRef, time.Now())
+}
@@ -0,0 +1,100 @@
+package graph
+
+import (
+	"apollosolutions/uplink-relay/cache"
+	"apollosolutions/uplink-relay/config"
+	"apollosolutions/uplink-relay/internal/relayerrors"
+	"apollosolutions/uplink-relay/logger"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestForceUpdateCooldown(t *testing.T) {
+	var upstreamCalls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamCalls.Add(1)
+		w.Write([]byte(`{"data":{"routerConfig":{"__typename":"RouterConfigResult","id":"1","supergraphSdl":"schema","minDelaySeconds":30}}}`))
+	}))
+	defer server.Close()
+
+	userConfig := config.NewDefaultConfig()
+	userConfig.Uplink.URLs = []string{server.URL}
+	userConfig.Uplink.RetryCount = 1
+	userConfig.Supergraphs = []config.SupergraphConfig{{GraphRef: "graph@current", ApolloKey: "1234"}, {GraphRef: "graph@staging", ApolloKey: "1234"}}
+	pFalse := false
+	resolverContext := &ResolverContext{
+		Logger:      logger.MakeLogger(&pFalse),
+		SystemCache: cache.NewMemoryCache(100),
+		UserConfig:  userConfig,
+		Cooldown:    NewMutationCooldown(time.Minute),
+	}
+	forceUpdate := func(graphRef string) map[string]interface{} {
+		query := fmt.Sprintf(`mutation { forceUpdate(input: {operations: [SCHEMA], graphRef: "%s"}) { success } }`, graphRef)
+		return queryManagementAPI(t, resolverContext, query, nil)
+	}
+
+	if response := forceUpdate("graph@current"); response["errors"] != nil {
+		t.Fatalf("Expected the first forceUpdate to succeed, got %v", response)
+	}
+
+	// Rapid calls for the same graph are rejected without calling uplink
+	for i := 0; i < 3; i++ {
+		response := forceUpdate("graph@current")
+		errs, _ := response["errors"].([]interface{})
+		if len(errs) == 0 {
+			t.Fatalf("Expected forceUpdate to be rate limited, got %v", response)
+		}
+		if code := errs[0].(map[string]interface{})["extensions"].(map[string]interface{})["code"]; code != "RATE_LIMITED" {
+			t.Errorf("Expected the RATE_LIMITED code, got %v", code)
+		}
+	}
+	if calls := upstreamCalls.Load(); calls != 1 {
+		t.Errorf("Expected 1 upstream call, got %d", calls)
+	}
+
+	// Other graphs have their own cooldown
+	if response := forceUpdate("graph@staging"); response["errors"] != nil {
+		t.Errorf("Expected forceUpdate for another graph to succeed, got %v", response)
+	}
+
+	// Graphs that aren't configured are rejected without being recorded
+	if response := forceUpdate("unknown@current"); response["errors"] == nil {
+		t.Errorf("Expected forceUpdate for an unknown graph to fail, got %v", response)
+	}
+	if len(resolverContext.Cooldown.lastRuns) != 2 {
+		t.Errorf("Expected only the configured graphs to be recorded, got %v", resolverContext.Cooldown.lastRuns)
+	}
+}
+
+func TestMutationCooldownAllow(t *testing.T) {
+	cooldown := NewMutationCooldown(time.Minute)
+	now := time.Now()
+
+	if err := cooldown.Allow("forceUpdate", "graph@current", now); err != nil {
+		t.Fatalf("Expected the first run to be allowed, got %v", err)
+	}
+	err := cooldown.Allow("forceUpdate", "graph@current", now.Add(30*time.Second))
+	if !errors.Is(err, relayerrors.ErrRateLimited) || err.Error() != "rate limited: forceUpdate already ran for graph@current, try again later in 30s" {
+		t.Errorf("Expected a run within the interval to be rate limited, got %v", err)
+	}
+	// Other mutations have their own cooldown
+	if err := cooldown.Allow("pinSchema", "graph@current", now.Add(30*time.Second)); err != nil {
+		t.Errorf("Expected another mutation to be allowed, got %v", err)
+	}
+	// Rejected runs don't extend the cooldown
+	if err := cooldown.Allow("forceUpdate", "graph@current", now.Add(time.Minute)); err != nil {
+		t.Errorf("Expected a run after the interval to be allowed, got %v", err)
+	}
+	// Runs older than the interval are evicted
+	if err := cooldown.Allow("forceUpdate", "graph@staging", now.Add(2*time.Minute)); err != nil {
+		t.Errorf("Expected a run for another graph to be allowed, got %v", err)
+	}
+	if len(cooldown.lastRuns) != 1 {
+		t.Errorf("Expected the runs older than the interval to be evicted, got %v", cooldown.lastRuns)
+	}
+}
@@ -0,0 +1,21 @@
+package graph
+
+import (
+	"apollosolutions/uplink-relay/internal/relayerrors"
+	"context"
+
+	"github.com/99designs/gqlgen/graphql"
+	"github.com/vektah/gqlparser/v2/gqlerror"
+)
+
+// ErrorPresenter adds a code extension to errors of a known class, e.g. GRAPH_NOT_FOUND, so management API clients don't need to match messages.
+func ErrorPresenter(ctx context.Context, err error) *gqlerror.Error {
+	presented := graphql.DefaultErrorPresenter(ctx, err)
+	if code := relayerrors.Code(err); code != "" {
+		if presented.Extensions == nil {
+			presented.Extensions = map[string]interface{}{}
+		}
+		presented.Extensions["code"] = code
+	}
+	return presented
+}
@@ -0,0 +1,58 @@
+package graph
+
+import (
+	"apollosolutions/uplink-relay/cache"
+	"apollosolutions/uplink-relay/config"
+	"apollosolutions/uplink-relay/logger"
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/99designs/gqlgen/graphql/handler"
+)
+
+func TestErrorPresenter(t *testing.T) {
+	pFalse := false
+	userConfig := config.NewDefaultConfig()
+	userConfig.Supergraphs = []config.SupergraphConfig{{GraphRef: "graph@current"}}
+	resolverContext := &ResolverContext{
+		Logger:      logger.MakeLogger(&pFalse),
+		SystemCache: cache.NewMemoryCache(100),
+		UserConfig:  userConfig,
+	}
+	server := handler.NewDefaultServer(NewExecutableSchema(Config{Resolvers: &Resolver{}}))
+	server.SetErrorPresenter(ErrorPresenter)
+
+	tests := []struct {
+		query string
+		code  string
+	}{
+		{`mutation { pinSchema(input: {graphRef: "graph@missing", launchID: "1"}) { success } }`, "GRAPH_NOT_FOUND"},
+		{`mutation { pinSchema(input: {graphRef: "graph@current", launchID: "1"}) { success } }`, "API_KEY_MISSING"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.code, func(t *testing.T) {
+			body, _ := json.Marshal(map[string]string{"query": tt.query})
+			req := httptest.NewRequest(http.MethodPost, "/graphql", bytes.NewReader(body))
+			req.Header.Set("Content-Type", "application/json")
+			rr := httptest.NewRecorder()
+			server.ServeHTTP(rr, req.WithContext(context.WithValue(req.Context(), ResolverKey, resolverContext)))
+
+			var response struct {
+				Errors []struct {
+					Extensions map[string]interface{} `json:"extensions"`
+				} `json:"errors"`
+			}
+			if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+				t.Fatalf("Failed to unmarshal response %s: %v", rr.Body.String(), err)
+			}
+			if len(response.Errors) != 1 || response.Errors[0].Extensions["code"] != tt.code {
+				t.Errorf("Expected an error with code %s, got %s", tt.code, rr.Body.String())
+			}
+		})
+	}
+}
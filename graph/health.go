@@ -0,0 +1,141 @@
+package graph
+
+import (
+	"apollosolutions/uplink-relay/cache"
+	"apollosolutions/uplink-relay/graph/model"
+	"apollosolutions/uplink-relay/pinning"
+	"apollosolutions/uplink-relay/schema"
+	"apollosolutions/uplink-relay/uplink"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// healthSeverity orders the health statuses so the most severe can be reported overall.
+var healthSeverity = map[model.HealthStatus]int{
+	model.HealthStatusOk:    0,
+	model.HealthStatusWarn:  1,
+	model.HealthStatusError: 2,
+	model.HealthStatusDown:  3,
+}
+
+// GetHealth checks each graph's cached license against its warnAt and haltAt times, and its cached supergraph against the health maxArtifactAge.
+// Graphs without a cached license, e.g. those without an entitlement, are reported as OK.
+// Configuration warnings are included as a note, without affecting the status.
+func (r *ResolverContext) GetHealth(now time.Time) *model.HealthReport {
+	report := &model.HealthReport{
+		Status:         model.HealthStatusOk,
+		Graphs:         make([]*model.GraphHealth, 0, len(r.UserConfig.Supergraphs)),
+		ConfigWarnings: []string{},
+	}
+	for _, warning := range r.UserConfig.Warnings() {
+		report.ConfigWarnings = append(report.ConfigWarnings, warning.Message)
+	}
+
+	for _, supergraph := range r.UserConfig.Supergraphs {
+		graphHealth := r.licenseHealth(supergraph.GraphRef, supergraph.OfflineLicense != "", now)
+		// Pinned supergraphs are never refreshed, so their age doesn't indicate a problem
+		if supergraph.LaunchID == "" {
+			if message := r.supergraphAgeMessage(supergraph.GraphRef, now); message != "" {
+				addGraphProblem(graphHealth, model.HealthStatusError, message)
+			}
+		}
+		if healthSeverity[graphHealth.Status] > healthSeverity[report.Status] {
+			report.Status = graphHealth.Status
+		}
+		report.Graphs = append(report.Graphs, graphHealth)
+	}
+	return report
+}
+
+// licenseHealth returns the health of a single graph based on its cached, or pinned, license.
+func (r *ResolverContext) licenseHealth(graphRef string, pinned bool, now time.Time) *model.GraphHealth {
+	graphHealth := &model.GraphHealth{GraphRef: graphRef, Status: model.HealthStatusOk}
+
+	licenseCacheKey := cache.DefaultCacheKey(graphRef, uplink.LicenseQuery)
+	if pinned {
+		licenseCacheKey = cache.MakeCacheKey(graphRef, pinning.LicensePinned)
+	}
+	licenseCacheBytes, ok := r.SystemCache.Get(licenseCacheKey)
+	if !ok {
+		return graphHealth
+	}
+
+	var licenseCacheEntry cache.CacheItem
+	if err := cache.DecodeItem(licenseCacheBytes, &licenseCacheEntry); err != nil {
+		r.Logger.Error("Error unmarshalling license cache entry", "graphRef", graphRef, "error", err)
+		return graphHealth
+	}
+	// Pinned licenses wrap the license cache entry in the pinned entry
+	if pinned {
+		var pinnedLicense cache.CacheItem
+		if err := json.Unmarshal(licenseCacheEntry.Content, &pinnedLicense); err == nil {
+			licenseCacheEntry = pinnedLicense
+		}
+	}
+	if len(licenseCacheEntry.Content) == 0 {
+		return graphHealth
+	}
+
+	claims, err := pinning.ParseLicenseClaims(string(licenseCacheEntry.Content))
+	if err != nil {
+		r.Logger.Error("Error parsing license", "graphRef", graphRef, "error", err)
+		message := "The cached license could not be parsed"
+		graphHealth.Status = model.HealthStatusError
+		graphHealth.Message = &message
+		return graphHealth
+	}
+
+	if claims.HaltAt != 0 && !now.Before(time.Unix(claims.HaltAt, 0)) {
+		message := fmt.Sprintf("The license expired at %s", time.Unix(claims.HaltAt, 0).UTC().Format(time.RFC3339))
+		graphHealth.Status = model.HealthStatusError
+		graphHealth.Message = &message
+	} else if claims.WarnAt != 0 && !now.Before(time.Unix(claims.WarnAt, 0)) {
+		message := fmt.Sprintf("The license is past its warnAt time of %s", time.Unix(claims.WarnAt, 0).UTC().Format(time.RFC3339))
+		graphHealth.Status = model.HealthStatusWarn
+		graphHealth.Message = &message
+	}
+	return graphHealth
+}
+
+// supergraphAgeMessage describes why the graph's cached supergraph is older than the health maxArtifactAge, e.g. because polling has stopped,
+// or returns an empty string if it's fresh, isn't cached, or the check is disabled.
+// The supergraph's age counts from when it was cached or uplink last confirmed it was unchanged, whichever is later.
+func (r *ResolverContext) supergraphAgeMessage(graphRef string, now time.Time) string {
+	maxAge := time.Duration(r.UserConfig.Health.MaxArtifactAge) * time.Second
+	if maxAge <= 0 {
+		return ""
+	}
+	cacheBytes, ok := r.SystemCache.Get(cache.DefaultCacheKey(graphRef, uplink.SupergraphQuery))
+	if !ok {
+		return ""
+	}
+	cacheItem, err := cache.DecodeMetadata(cacheBytes)
+	if err != nil {
+		r.Logger.Error("Error unmarshalling supergraph cache entry", "graphRef", graphRef, "error", err)
+		return ""
+	}
+	if cacheItem.LastModified.IsZero() {
+		return ""
+	}
+
+	updatedAt := cacheItem.LastModified
+	if confirmedAt, ok := schema.ConfirmedAt(graphRef); ok && confirmedAt.After(updatedAt) {
+		updatedAt = confirmedAt
+	}
+	if now.Sub(updatedAt) <= maxAge {
+		return ""
+	}
+	return fmt.Sprintf("The cached supergraph was last updated at %s, more than %s ago", updatedAt.UTC().Format(time.RFC3339), maxAge)
+}
+
+// addGraphProblem raises the graph's status to the given status if it's more severe, and adds the message to the graph's message.
+func addGraphProblem(graphHealth *model.GraphHealth, status model.HealthStatus, message string) {
+	if healthSeverity[status] > healthSeverity[graphHealth.Status] {
+		graphHealth.Status = status
+	}
+	if graphHealth.Message != nil {
+		message = *graphHealth.Message + "; " + message
+	}
+	graphHealth.Message = &message
+}
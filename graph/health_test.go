@@ -0,0 +1,197 @@
+package graph
+
+import (
+	"apollosolutions/uplink-relay/cache"
+	"apollosolutions/uplink-relay/config"
+	"apollosolutions/uplink-relay/graph/model"
+	"apollosolutions/uplink-relay/logger"
+	"apollosolutions/uplink-relay/pinning"
+	"apollosolutions/uplink-relay/schema"
+	"apollosolutions/uplink-relay/uplink"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// makeLicense builds an (unverified) license JWT with the given warnAt and haltAt times.
+func makeLicense(warnAt, haltAt time.Time) string {
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256"}`))
+	payload := base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf(`{"iss":"TEST","warnAt":%d,"haltAt":%d}`, warnAt.Unix(), haltAt.Unix())))
+	signature := base64.RawURLEncoding.EncodeToString([]byte("signature"))
+	return header + "." + payload + "." + signature
+}
+
+func cacheLicense(t *testing.T, systemCache cache.Cache, graphRef string, license string) {
+	item, err := json.Marshal(cache.CacheItem{
+		Content:      []byte(license),
+		Expiration:   cache.IndefiniteTimestamp,
+		LastModified: time.Now(),
+	})
+	if err != nil {
+		t.Fatalf("Failed to marshal cache item: %v", err)
+	}
+	systemCache.Set(cache.DefaultCacheKey(graphRef, uplink.LicenseQuery), string(item), -1)
+}
+
+func TestGetHealth(t *testing.T) {
+	now := time.Now()
+	pFalse := false
+	systemCache := cache.NewMemoryCache(100)
+	userConfig := config.NewDefaultConfig()
+	userConfig.Supergraphs = []config.SupergraphConfig{
+		{GraphRef: "valid@current"},
+		{GraphRef: "warn@current"},
+		{GraphRef: "expired@current"},
+		{GraphRef: "unlicensed@current"},
+		{GraphRef: "pinned@current", OfflineLicense: makeLicense(now.Add(-48*time.Hour), now.Add(-24*time.Hour))},
+	}
+	cacheLicense(t, systemCache, "valid@current", makeLicense(now.Add(24*time.Hour), now.Add(48*time.Hour)))
+	cacheLicense(t, systemCache, "warn@current", makeLicense(now.Add(-24*time.Hour), now.Add(24*time.Hour)))
+	cacheLicense(t, systemCache, "expired@current", makeLicense(now.Add(-48*time.Hour), now.Add(-24*time.Hour)))
+
+	if err := pinning.PinOfflineLicense(userConfig, logger.MakeLogger(&pFalse), systemCache, userConfig.Supergraphs[4].OfflineLicense, "pinned@current"); err != nil {
+		t.Fatalf("Failed to pin offline license: %v", err)
+	}
+
+	resolverContext := &ResolverContext{
+		Logger:      logger.MakeLogger(&pFalse),
+		SystemCache: systemCache,
+		UserConfig:  userConfig,
+	}
+
+	report := resolverContext.GetHealth(now)
+	if report.Status != model.HealthStatusError {
+		t.Errorf("Expected overall status %s, got %s", model.HealthStatusError, report.Status)
+	}
+
+	expected := map[string]model.HealthStatus{
+		"valid@current":      model.HealthStatusOk,
+		"warn@current":       model.HealthStatusWarn,
+		"expired@current":    model.HealthStatusError,
+		"unlicensed@current": model.HealthStatusOk,
+		"pinned@current":     model.HealthStatusError,
+	}
+	if len(report.Graphs) != len(expected) {
+		t.Fatalf("Expected %d graphs, got %d", len(expected), len(report.Graphs))
+	}
+	for _, graph := range report.Graphs {
+		if graph.Status != expected[graph.GraphRef] {
+			t.Errorf("Expected %s to be %s, got %s", graph.GraphRef, expected[graph.GraphRef], graph.Status)
+		}
+		if graph.Status != model.HealthStatusOk && graph.Message == nil {
+			t.Errorf("Expected a message for %s", graph.GraphRef)
+		}
+	}
+
+	// Without the expired license, the most severe status is a warning
+	userConfig.Supergraphs = userConfig.Supergraphs[:2]
+	if report := resolverContext.GetHealth(now); report.Status != model.HealthStatusWarn {
+		t.Errorf("Expected overall status %s, got %s", model.HealthStatusWarn, report.Status)
+	}
+}
+
+func TestGetHealthConfigWarnings(t *testing.T) {
+	pFalse := false
+	userConfig := config.NewDefaultConfig()
+	resolverContext := &ResolverContext{
+		Logger:      logger.MakeLogger(&pFalse),
+		SystemCache: cache.NewMemoryCache(10),
+		UserConfig:  userConfig,
+	}
+
+	if report := resolverContext.GetHealth(time.Now()); len(report.ConfigWarnings) != 0 {
+		t.Errorf("Expected no configuration warnings, got %v", report.ConfigWarnings)
+	}
+
+	// Configuration warnings are noted without affecting the status
+	userConfig.Cache.Duration = -1
+	userConfig.Polling.Enabled = true
+	report := resolverContext.GetHealth(time.Now())
+	if len(report.ConfigWarnings) != 1 || !strings.Contains(report.ConfigWarnings[0], "indefinite") {
+		t.Errorf("Expected a warning about the indefinite cache duration, got %v", report.ConfigWarnings)
+	}
+	if report.Status != model.HealthStatusOk {
+		t.Errorf("Expected overall status %s, got %s", model.HealthStatusOk, report.Status)
+	}
+}
+
+func cacheSupergraph(t *testing.T, systemCache cache.Cache, graphRef string, lastModified time.Time) {
+	item, err := json.Marshal(cache.CacheItem{
+		Content:      []byte("supergraph sdl"),
+		Expiration:   cache.IndefiniteTimestamp,
+		LastModified: lastModified,
+	})
+	if err != nil {
+		t.Fatalf("Failed to marshal cache item: %v", err)
+	}
+	systemCache.Set(cache.DefaultCacheKey(graphRef, uplink.SupergraphQuery), string(item), -1)
+}
+
+func TestGetHealthMaxArtifactAge(t *testing.T) {
+	now := time.Now()
+	pFalse := false
+	systemCache := cache.NewMemoryCache(100)
+	userConfig := config.NewDefaultConfig()
+	userConfig.Health.MaxArtifactAge = 3600
+	userConfig.Supergraphs = []config.SupergraphConfig{
+		{GraphRef: "fresh@current"},
+		{GraphRef: "stale@current"},
+		{GraphRef: "confirmed@current"},
+		{GraphRef: "expired@current"},
+		{GraphRef: "pinned@current", LaunchID: "1234"},
+		{GraphRef: "uncached@current"},
+	}
+	cacheSupergraph(t, systemCache, "fresh@current", now.Add(-30*time.Minute))
+	cacheSupergraph(t, systemCache, "stale@current", now.Add(-2*time.Hour))
+	// Uplink confirmed the supergraph is unchanged since it was cached, e.g. while polling with onlyChanged
+	cacheSupergraph(t, systemCache, "confirmed@current", now.Add(-2*time.Hour))
+	schema.MarkConfirmed("confirmed@current", now.Add(-10*time.Minute))
+	cacheSupergraph(t, systemCache, "expired@current", now.Add(-2*time.Hour))
+	cacheLicense(t, systemCache, "expired@current", makeLicense(now.Add(-48*time.Hour), now.Add(-24*time.Hour)))
+	cacheSupergraph(t, systemCache, "pinned@current", now.Add(-2*time.Hour))
+
+	resolverContext := &ResolverContext{
+		Logger:      logger.MakeLogger(&pFalse),
+		SystemCache: systemCache,
+		UserConfig:  userConfig,
+	}
+
+	report := resolverContext.GetHealth(now)
+	if report.Status != model.HealthStatusError {
+		t.Errorf("Expected overall status %s, got %s", model.HealthStatusError, report.Status)
+	}
+	expected := map[string]struct {
+		status  model.HealthStatus
+		message []string
+	}{
+		"fresh@current":     {model.HealthStatusOk, nil},
+		"stale@current":     {model.HealthStatusError, []string{"cached supergraph was last updated"}},
+		"confirmed@current": {model.HealthStatusOk, nil},
+		"expired@current":   {model.HealthStatusError, []string{"license expired", "cached supergraph was last updated"}},
+		"pinned@current":    {model.HealthStatusOk, nil},
+		"uncached@current":  {model.HealthStatusOk, nil},
+	}
+	for _, graphHealth := range report.Graphs {
+		want := expected[graphHealth.GraphRef]
+		if graphHealth.Status != want.status {
+			t.Errorf("Expected %s to be %s, got %s", graphHealth.GraphRef, want.status, graphHealth.Status)
+		}
+		if want.message == nil && graphHealth.Message != nil {
+			t.Errorf("Expected no message for %s, got %s", graphHealth.GraphRef, *graphHealth.Message)
+		}
+		for _, message := range want.message {
+			if graphHealth.Message == nil || !strings.Contains(*graphHealth.Message, message) {
+				t.Errorf("Expected the message for %s to contain %q, got %v", graphHealth.GraphRef, message, graphHealth.Message)
+			}
+		}
+	}
+
+	// The check is disabled by default
+	userConfig.Health.MaxArtifactAge = 0
+	if report := resolverContext.GetHealth(now); report.Graphs[1].Status != model.HealthStatusOk {
+		t.Errorf("Expected a stale supergraph to be OK when the check is disabled, got %s", report.Graphs[1].Status)
+	}
+}
@@ -8,6 +8,46 @@ import (
 	"strconv"
 )
 
+type CacheExport struct {
+	// The cache entries, as gzipped JSON encoded in base64.
+	Archive string `json:"archive"`
+	// The number of entries in the archive.
+	Entries int `json:"entries"`
+}
+
+type CacheHitRate struct {
+	// The operation name or graph ref; empty for the total.
+	Name   string `json:"name"`
+	Hits   int    `json:"hits"`
+	Misses int    `json:"misses"`
+	// The share of requests served from the cache, between 0 and 1; 0 when there were no requests.
+	HitRate float64 `json:"hitRate"`
+}
+
+type CacheKeyInfo struct {
+	// The raw cache key.
+	Key string `json:"key"`
+	// The operation the key was generated for, such as SupergraphSdlQuery or a pinned artifact.
+	Operation string `json:"operation"`
+	// The expiration time of the cache entry in RFC 3339 format, or null if it never expires.
+	Expiration *string `json:"expiration,omitempty"`
+	// The remaining time until the cache entry expires in seconds, or null if it never expires.
+	TTLSeconds *int `json:"ttlSeconds,omitempty"`
+	// Whether this is the default cache key, without an ifAfterId, that new routers are served from, rather than a key hashed from a request's variables.
+	IsDefault bool `json:"isDefault"`
+}
+
+type CacheStats struct {
+	// The length of the sliding window the hit rates are calculated over, in seconds.
+	WindowSeconds int `json:"windowSeconds"`
+	// The hit rate across every graph and operation.
+	Total *CacheHitRate `json:"total"`
+	// The hit rate of each operation, such as SupergraphSdlQuery.
+	Operations []*CacheHitRate `json:"operations"`
+	// The hit rate of each graph ref.
+	Graphs []*CacheHitRate `json:"graphs"`
+}
+
 type Configuration struct {
 	// The uplink relay's list of supported supergraphs.
 	Supergraphs []*Supergraph `json:"supergraphs"`
@@ -35,6 +75,28 @@ type ForceUpdateResult struct {
 	Configuration *Configuration `json:"configuration"`
 }
 
+type GraphHealth struct {
+	GraphRef string       `json:"graphRef"`
+	Status   HealthStatus `json:"status"`
+	// Describes why the graph isn't healthy; null when the status is OK
+	Message *string `json:"message,omitempty"`
+}
+
+type HealthReport struct {
+	// The overall status, which is the most severe status of any graph
+	Status HealthStatus   `json:"status"`
+	Graphs []*GraphHealth `json:"graphs"`
+	// Warnings about the configuration, such as options that can stop routers from receiving updates; they don't affect the status
+	ConfigWarnings []string `json:"configWarnings"`
+}
+
+type ImportCacheResult struct {
+	// The number of entries imported.
+	Imported int `json:"imported"`
+	// The number of entries skipped, as they expired since the export.
+	Skipped int `json:"skipped"`
+}
+
 type Mutation struct {
 }
 
@@ -54,6 +116,14 @@ type PinPersistedQueryManifestResult struct {
 	Configuration *Configuration `json:"configuration"`
 }
 
+type PinSchemaByHashInput struct {
+	// The core schema hash of the launch to pin. Either this or sdl is required.
+	Hash *string `json:"hash,omitempty"`
+	// The raw supergraph SDL document to pin; the hash is calculated from it. Either this or hash is required.
+	Sdl      *string `json:"sdl,omitempty"`
+	GraphRef string  `json:"graphRef"`
+}
+
 type PinSchemaInput struct {
 	LaunchID string `json:"launchID"`
 	GraphRef string `json:"graphRef"`
@@ -64,9 +134,23 @@ type PinSchemaResult struct {
 	Configuration *Configuration `json:"configuration"`
 }
 
+type PrewarmResult struct {
+	Success bool `json:"success"`
+	// The artifacts that were fetched and cached.
+	Operations []OperationType `json:"operations"`
+	// The number of persisted query chunks cached for the graph's manifest, which is 0 if routers fetch chunks from the upstream URLs.
+	PersistedQueryChunks int            `json:"persistedQueryChunks"`
+	Configuration        *Configuration `json:"configuration"`
+}
+
 type Query struct {
 }
 
+type ReloadConfigResult struct {
+	Success       bool           `json:"success"`
+	Configuration *Configuration `json:"configuration"`
+}
+
 type Schema struct {
 	// The ID of the schema.
 	ID string `json:"id"`
@@ -76,6 +160,19 @@ type Schema struct {
 	Schema string `json:"schema"`
 }
 
+type SchemaVersion struct {
+	// The uplink ID of the supergraph, as sent by routers in ifAfterId.
+	ID string `json:"id"`
+	// The sha256 hash of the supergraph SDL.
+	Hash string `json:"hash"`
+	// When the supergraph was cached, in RFC 3339 format.
+	LastModified string `json:"lastModified"`
+	// Whether this is the current version, served to new routers, rather than a previous one.
+	Current bool `json:"current"`
+	// The supergraph SDL.
+	SupergraphSdl string `json:"supergraphSdl"`
+}
+
 type Supergraph struct {
 	// The ID of the uplink relay.
 	GraphRef string `json:"graphRef"`
@@ -97,18 +194,24 @@ type Supergraph struct {
 type HealthStatus string
 
 const (
-	HealthStatusOk   HealthStatus = "OK"
-	HealthStatusDown HealthStatus = "DOWN"
+	HealthStatusOk HealthStatus = "OK"
+	// A graph needs attention, such as a license past its warnAt time
+	HealthStatusWarn HealthStatus = "WARN"
+	// A graph is unhealthy, such as a license past its haltAt time or a cached supergraph older than the health maxArtifactAge
+	HealthStatusError HealthStatus = "ERROR"
+	HealthStatusDown  HealthStatus = "DOWN"
 )
 
 var AllHealthStatus = []HealthStatus{
 	HealthStatusOk,
+	HealthStatusWarn,
+	HealthStatusError,
 	HealthStatusDown,
 }
 
 func (e HealthStatus) IsValid() bool {
 	switch e {
-	case HealthStatusOk, HealthStatusDown:
+	case HealthStatusOk, HealthStatusWarn, HealthStatusError, HealthStatusDown:
 		return true
 	}
 	return false
@@ -118,7 +221,7 @@ func (e HealthStatus) String() string {
 	return string(e)
 }
 
-func (e *HealthStatus) UnmarshalGQL(v interface{}) error {
+func (e *HealthStatus) UnmarshalGQL(v any) error {
 	str, ok := v.(string)
 	if !ok {
 		return fmt.Errorf("enums must be strings")
@@ -161,7 +264,7 @@ func (e OperationType) String() string {
 	return string(e)
 }
 
-func (e *OperationType) UnmarshalGQL(v interface{}) error {
+func (e *OperationType) UnmarshalGQL(v any) error {
 	str, ok := v.(string)
 	if !ok {
 		return fmt.Errorf("enums must be strings")
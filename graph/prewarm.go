@@ -0,0 +1,94 @@
+package graph
+
+import (
+	"apollosolutions/uplink-relay/cache"
+	"apollosolutions/uplink-relay/config"
+	"apollosolutions/uplink-relay/entitlements"
+	"apollosolutions/uplink-relay/graph/model"
+	persistedqueries "apollosolutions/uplink-relay/persisted_queries"
+	"apollosolutions/uplink-relay/pinning"
+	"apollosolutions/uplink-relay/schema"
+	"apollosolutions/uplink-relay/uplink"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+)
+
+// Prewarm fetches the schema, entitlement and persisted query manifest of the given graph into the cache,
+// and checks every persisted query chunk of the manifest was downloaded, so the first router request is served from the cache.
+func (r *ResolverContext) Prewarm(ctx context.Context, graphRef string) (*model.PrewarmResult, error) {
+	if !r.UserConfig.Cache.Enabled {
+		return nil, fmt.Errorf("prewarming requires the cache to be enabled")
+	}
+	supergraphConfig, err := config.FindSupergraphConfigFromGraphRef(graphRef, r.UserConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := schema.FetchSchema(ctx, r.UserConfig, r.SystemCache, r.Logger, graphRef, ""); err != nil {
+		return nil, fmt.Errorf("failed to prewarm the schema: %w", err)
+	}
+	if err := entitlements.FetchRouterLicense(ctx, r.UserConfig, r.SystemCache, r.Logger, graphRef); err != nil {
+		return nil, fmt.Errorf("failed to prewarm the entitlement: %w", err)
+	}
+	if err := persistedqueries.FetchPQManifest(ctx, r.UserConfig, r.SystemCache, r.Logger, graphRef, ""); err != nil {
+		return nil, fmt.Errorf("failed to prewarm the persisted query manifest: %w", err)
+	}
+
+	chunks, err := r.cachedPersistedQueryChunks(graphRef, supergraphConfig.PersistedQueryVersion != "")
+	if err != nil {
+		return nil, err
+	}
+	r.Logger.Info("Prewarmed graph", "graphRef", graphRef, "persistedQueryChunks", chunks)
+
+	return &model.PrewarmResult{
+		Success:              true,
+		Operations:           []model.OperationType{model.OperationTypeSchema, model.OperationTypeEntitlement, model.OperationTypePersistedQueryManifest},
+		PersistedQueryChunks: chunks,
+	}, nil
+}
+
+// cachedPersistedQueryChunks counts the chunks of the graph's cached persisted query manifest, returning an error if any of them isn't cached.
+func (r *ResolverContext) cachedPersistedQueryChunks(graphRef string, pinned bool) (int, error) {
+	manifestKey := cache.DefaultCacheKey(graphRef, uplink.PersistedQueriesQuery)
+	if pinned {
+		manifestKey = cache.MakeCacheKey(graphRef, pinning.PersistedQueriesPinned)
+	}
+	manifestBytes, ok := r.SystemCache.Get(manifestKey)
+	if !ok {
+		return 0, fmt.Errorf("persisted query manifest for %s isn't cached", graphRef)
+	}
+	var manifestItem cache.CacheItem
+	if err := cache.DecodeItem(manifestBytes, &manifestItem); err != nil {
+		return 0, err
+	}
+	var manifest persistedqueries.UplinkPersistedQueryResponse
+	if err := json.Unmarshal(manifestItem.Content, &manifest); err != nil {
+		return 0, err
+	}
+
+	// Routers fetch the chunks from the upstream URLs, so there are none to cache
+	if !r.UserConfig.PersistedQueries.Rehost() {
+		return 0, nil
+	}
+
+	chunks := 0
+	for _, chunk := range manifest.Data.PersistedQueries.Chunks {
+		for _, chunkURL := range chunk.URLs {
+			// Chunks are only downloaded when the relay can advertise its own URLs for them
+			if r.UserConfig.Relay.PublicURL == "" {
+				return 0, fmt.Errorf("persisted query chunks are only cached when the relay publicURL is set")
+			}
+			parsedURL, err := url.Parse(chunkURL)
+			if err != nil {
+				return 0, err
+			}
+			if _, ok := r.SystemCache.Get(persistedqueries.MakePersistedQueryCacheKey(graphRef, chunk.ID, parsedURL.Query().Get("i"))); !ok {
+				return 0, fmt.Errorf("persisted query chunk %s for %s isn't cached", chunk.ID, graphRef)
+			}
+			chunks++
+		}
+	}
+	return chunks, nil
+}
@@ -0,0 +1,106 @@
+package graph
+
+import (
+	"apollosolutions/uplink-relay/cache"
+	"apollosolutions/uplink-relay/config"
+	"apollosolutions/uplink-relay/internal/util"
+	"apollosolutions/uplink-relay/logger"
+	persistedqueries "apollosolutions/uplink-relay/persisted_queries"
+	"apollosolutions/uplink-relay/uplink"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPrewarm(t *testing.T) {
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/chunks/") {
+			fmt.Fprintf(w, `{"format":"apollo-persisted-query-manifest","version":1,"operations":[],"chunk":"%s"}`, r.URL.Path)
+			return
+		}
+		var request util.UplinkRelayRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			t.Errorf("Failed to decode request: %v", err)
+			return
+		}
+		switch request.OperationName {
+		case uplink.SupergraphQuery:
+			w.Write([]byte(`{"data":{"routerConfig":{"__typename":"RouterConfigResult","id":"2024-08-05T19:53:29.140664000Z","supergraphSdl":"schema","minDelaySeconds":30}}}`))
+		case uplink.LicenseQuery:
+			w.Write([]byte(`{"data":{"routerEntitlements":{"__typename":"RouterEntitlementsResult","id":"2024-10-03T12:00:00Z","minDelaySeconds":60,"entitlement":{"jwt":"jwt"}}}}`))
+		case uplink.PersistedQueriesQuery:
+			fmt.Fprintf(w, `{"data":{"persistedQueries":{"__typename":"PersistedQueriesResult","id":"manifest1","minDelaySeconds":60,"chunks":[{"id":"graph/1","urls":["%[1]s/chunks/1a","%[1]s/chunks/1b"]},{"id":"graph/2","urls":["%[1]s/chunks/2"]}]}}}`, server.URL)
+		}
+	}))
+	defer server.Close()
+
+	graphRef := "graph@current"
+	userConfig := config.NewDefaultConfig()
+	userConfig.Uplink.URLs = []string{server.URL}
+	userConfig.PersistedQueries.ChunkAllowedHosts = []string{"127.0.0.1"}
+	userConfig.Relay.PublicURL = "http://relay.example.com"
+	userConfig.Supergraphs = []config.SupergraphConfig{{GraphRef: graphRef, ApolloKey: "1234"}}
+	systemCache := cache.NewMemoryCache(100)
+	pFalse := false
+	resolverContext := &ResolverContext{
+		Logger:      logger.MakeLogger(&pFalse),
+		SystemCache: systemCache,
+		UserConfig:  userConfig,
+	}
+	query := func(query string) map[string]interface{} {
+		return queryManagementAPI(t, resolverContext, query, nil)
+	}
+
+	response := query(`mutation { prewarm(graphRef: "graph@current") { success operations persistedQueryChunks configuration { supergraphs { currentSchema { id } } } } }`)
+	if response["errors"] != nil {
+		t.Fatalf("Unexpected errors: %v", response["errors"])
+	}
+	result := response["data"].(map[string]interface{})["prewarm"].(map[string]interface{})
+	if result["success"] != true || result["persistedQueryChunks"] != float64(3) {
+		t.Errorf("Expected 3 prewarmed chunks, got %v", result)
+	}
+	if operations := fmt.Sprint(result["operations"]); operations != "[SCHEMA ENTITLEMENT PERSISTED_QUERY_MANIFEST]" {
+		t.Errorf("Expected every artifact to be prewarmed, got %s", operations)
+	}
+
+	// Every artifact and chunk is cached
+	for _, operationName := range []string{uplink.SupergraphQuery, uplink.LicenseQuery, uplink.PersistedQueriesQuery} {
+		if _, ok := systemCache.Get(cache.DefaultCacheKey(graphRef, operationName)); !ok {
+			t.Errorf("Expected %s to be cached", operationName)
+		}
+	}
+	for _, chunk := range []struct{ id, index string }{{"graph/1", "0"}, {"graph/1", "1"}, {"graph/2", "0"}} {
+		if _, ok := systemCache.Get(persistedqueries.MakePersistedQueryCacheKey(graphRef, chunk.id, chunk.index)); !ok {
+			t.Errorf("Expected chunk %s %s to be cached", chunk.id, chunk.index)
+		}
+	}
+
+	// Without a public URL, the chunks aren't downloaded, so prewarming fails
+	userConfig.Relay.PublicURL = ""
+	response = query(`mutation { prewarm(graphRef: "graph@current") { success } }`)
+	if response["errors"] == nil {
+		t.Errorf("Expected an error when the chunks can't be cached, got %v", response)
+	}
+
+	// Without rehosting, routers fetch the chunks upstream, so there are none to cache
+	userConfig.Relay.PublicURL = "http://relay.example.com"
+	userConfig.PersistedQueries.RehostChunks = &pFalse
+	response = query(`mutation { prewarm(graphRef: "graph@current") { success persistedQueryChunks } }`)
+	if response["errors"] != nil {
+		t.Fatalf("Unexpected errors: %v", response["errors"])
+	}
+	result = response["data"].(map[string]interface{})["prewarm"].(map[string]interface{})
+	if result["success"] != true || result["persistedQueryChunks"] != float64(0) {
+		t.Errorf("Expected no prewarmed chunks without rehosting, got %v", result)
+	}
+
+	// Unknown graphs are rejected
+	response = query(`mutation { prewarm(graphRef: "unknown@current") { success } }`)
+	if response["errors"] == nil {
+		t.Errorf("Expected an error for an unknown graph, got %v", response)
+	}
+}
@@ -0,0 +1,31 @@
+package graph
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/99designs/gqlgen/graphql/handler"
+)
+
+// queryManagementAPI executes a query with its variables against the management API as resolverContext, returning the decoded response.
+// Errors are presented like the management API presents them.
+func queryManagementAPI(t *testing.T, resolverContext *ResolverContext, query string, variables map[string]interface{}) map[string]interface{} {
+	t.Helper()
+	server := handler.NewDefaultServer(NewExecutableSchema(Config{Resolvers: &Resolver{}}))
+	server.SetErrorPresenter(ErrorPresenter)
+
+	body, _ := json.Marshal(map[string]interface{}{"query": query, "variables": variables})
+	req := httptest.NewRequest(http.MethodPost, "/graphql", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	rr := httptest.NewRecorder()
+	server.ServeHTTP(rr, req.WithContext(context.WithValue(req.Context(), ResolverKey, resolverContext)))
+	var response map[string]interface{}
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Failed to unmarshal response %s: %v", rr.Body.String(), err)
+	}
+	return response
+}
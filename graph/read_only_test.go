@@ -0,0 +1,63 @@
+package graph
+
+import (
+	"apollosolutions/uplink-relay/cache"
+	"apollosolutions/uplink-relay/config"
+	"apollosolutions/uplink-relay/logger"
+	"apollosolutions/uplink-relay/schema"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestReadOnlyManagementAPI(t *testing.T) {
+	graphRef := "graph@current"
+	userConfig := config.NewDefaultConfig()
+	userConfig.ManagementAPI.ReadOnly = true
+	userConfig.Supergraphs = []config.SupergraphConfig{{GraphRef: graphRef, ApolloKey: "1234"}}
+	systemCache := cache.NewMemoryCache(100)
+	pFalse := false
+	resolverContext := &ResolverContext{
+		Logger:      logger.MakeLogger(&pFalse),
+		SystemCache: systemCache,
+		UserConfig:  userConfig,
+		Authorized:  true,
+	}
+	if err := schema.CacheSchema(systemCache, resolverContext.Logger, graphRef, "schema", "id", "", 0, nil, -1); err != nil {
+		t.Fatal(err)
+	}
+	query := func(query string) map[string]interface{} {
+		return queryManagementAPI(t, resolverContext, query, nil)
+	}
+
+	// Every mutation is rejected, even with the management API secret
+	mutations := []string{
+		fmt.Sprintf(`mutation { deleteCacheEntry(input: {operation: [SCHEMA], graphRef: "%s"}) { success } }`, graphRef),
+		fmt.Sprintf(`mutation { pinSchema(input: {launchID: "launch", graphRef: "%s"}) { success } }`, graphRef),
+		fmt.Sprintf(`mutation { pinSchemaByHash(input: {hash: "hash", graphRef: "%s"}) { success } }`, graphRef),
+		fmt.Sprintf(`mutation { pinPersistedQueryManifest(input: {id: "id", graphRef: "%s"}) { success } }`, graphRef),
+		fmt.Sprintf(`mutation { forceUpdate(input: {operations: [SCHEMA], graphRef: "%s"}) { success } }`, graphRef),
+		fmt.Sprintf(`mutation { prewarm(graphRef: "%s") { success } }`, graphRef),
+		`mutation { reloadConfig { success } }`,
+		`mutation { setCacheDuration(seconds: 5) }`,
+	}
+	for _, mutation := range mutations {
+		response := query(mutation)
+		errors, _ := response["errors"].([]interface{})
+		if len(errors) == 0 || !strings.Contains(fmt.Sprint(errors[0]), "read-only") {
+			t.Errorf("Expected %s to be rejected as read-only, got %v", mutation, response)
+		}
+	}
+	if _, ok := systemCache.Get(cache.DefaultCacheKey(graphRef, "SupergraphSdlQuery")); !ok {
+		t.Errorf("Expected the cache entry to be kept")
+	}
+	if userConfig.CacheDuration() != -1 {
+		t.Errorf("Expected the cache duration to be kept, got %d", userConfig.CacheDuration())
+	}
+
+	// Queries still work
+	response := query(`query { health }`)
+	if response["errors"] != nil || response["data"].(map[string]interface{})["health"] == nil {
+		t.Errorf("Expected queries to be allowed, got %v", response)
+	}
+}
@@ -2,20 +2,21 @@ package graph
 
 // This file will be automatically regenerated based on the schema, any resolver implementations
 // will be copied through when generating and any unknown code will be moved to the end.
-// Code generated by github.com/99designs/gqlgen version v0.17.49
+// Code generated by github.com/99designs/gqlgen version v0.17.62
 
 import (
 	"apollosolutions/uplink-relay/cache"
 	"apollosolutions/uplink-relay/config"
 	"apollosolutions/uplink-relay/entitlements"
 	"apollosolutions/uplink-relay/graph/model"
-	"apollosolutions/uplink-relay/internal/util"
+	"apollosolutions/uplink-relay/internal/relayerrors"
 	persistedqueries "apollosolutions/uplink-relay/persisted_queries"
 	"apollosolutions/uplink-relay/pinning"
 	"apollosolutions/uplink-relay/schema"
 	"apollosolutions/uplink-relay/uplink"
 	"context"
 	"fmt"
+	"time"
 )
 
 // DeleteCacheEntry is the resolver for the deleteCacheEntry field.
@@ -24,6 +25,9 @@ func (r *mutationResolver) DeleteCacheEntry(ctx context.Context, input model.Del
 	if resolverContext == nil {
 		return nil, fmt.Errorf("error retrieving resolver context")
 	}
+	if err := resolverContext.checkWritable("deleteCacheEntry"); err != nil {
+		return nil, err
+	}
 
 	for _, operationName := range input.Operation {
 		prefix := ""
@@ -34,15 +38,12 @@ func (r *mutationResolver) DeleteCacheEntry(ctx context.Context, input model.Del
 			prefix = cache.MakeCachePrefix(input.GraphRef, uplink.LicenseQuery)
 		case model.OperationTypePersistedQueryManifest:
 			prefix = cache.MakeCachePrefix(input.GraphRef, uplink.PersistedQueriesQuery)
-			graphID, _, err := util.ParseGraphRef(input.GraphRef)
-			if err != nil {
-				return nil, err
-			}
 			// we also need to delete the persisted query chunks
-			err = resolverContext.SystemCache.DeleteWithPrefix(fmt.Sprintf("pq:%s/", graphID))
+			err := resolverContext.SystemCache.DeleteWithPrefix(persistedqueries.MakePersistedQueryCachePrefix(input.GraphRef))
 			if err != nil {
 				return nil, err
 			}
+			persistedqueries.RecordCachedChunks(input.GraphRef, 0)
 		default:
 			return nil, fmt.Errorf("invalid operation type: %s", operationName)
 		}
@@ -51,9 +52,10 @@ func (r *mutationResolver) DeleteCacheEntry(ctx context.Context, input model.Del
 			return nil, err
 		}
 	}
+	resolverContext.InvalidateConfigDetails()
 	return &model.DeleteCacheEntryResult{
 		Success:       true,
-		Configuration: resolverContext.GetConfigDetails(),
+		Configuration: resolverContext.GetConfigDetails(persistedQueryChunksRequested(ctx)),
 	}, nil
 }
 
@@ -63,6 +65,12 @@ func (r *mutationResolver) PinSchema(ctx context.Context, input model.PinSchemaI
 	if resolverContext == nil {
 		return nil, fmt.Errorf("error retrieving resolver context")
 	}
+	if err := resolverContext.checkWritable("pinSchema"); err != nil {
+		return nil, err
+	}
+	if err := resolverContext.checkCooldown("pinSchema", input.GraphRef); err != nil {
+		return nil, err
+	}
 
 	supergraphConfig, err := config.FindSupergraphConfigFromGraphRef(input.GraphRef, resolverContext.UserConfig)
 	if err != nil {
@@ -72,7 +80,7 @@ func (r *mutationResolver) PinSchema(ctx context.Context, input model.PinSchemaI
 	if supergraphConfig.LaunchID == input.LaunchID {
 		return &model.PinSchemaResult{
 			Success:       true,
-			Configuration: resolverContext.GetConfigDetails(),
+			Configuration: resolverContext.GetConfigDetails(persistedQueryChunksRequested(ctx)),
 		}, nil
 	}
 
@@ -81,9 +89,49 @@ func (r *mutationResolver) PinSchema(ctx context.Context, input model.PinSchemaI
 	if err != nil {
 		return nil, err
 	}
+	resolverContext.InvalidateConfigDetails()
+	return &model.PinSchemaResult{
+		Success:       true,
+		Configuration: resolverContext.GetConfigDetails(persistedQueryChunksRequested(ctx)),
+	}, nil
+}
+
+// PinSchemaByHash is the resolver for the pinSchemaByHash field.
+func (r *mutationResolver) PinSchemaByHash(ctx context.Context, input model.PinSchemaByHashInput) (*model.PinSchemaResult, error) {
+	resolverContext := resolverContext(ctx)
+	if resolverContext == nil {
+		return nil, fmt.Errorf("error retrieving resolver context")
+	}
+	if err := resolverContext.checkWritable("pinSchemaByHash"); err != nil {
+		return nil, err
+	}
+	if err := resolverContext.checkCooldown("pinSchemaByHash", input.GraphRef); err != nil {
+		return nil, err
+	}
+
+	_, err := config.FindSupergraphConfigFromGraphRef(input.GraphRef, resolverContext.UserConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	hash := ""
+	if input.Hash != nil {
+		hash = *input.Hash
+	}
+	sdl := ""
+	if input.Sdl != nil {
+		sdl = *input.Sdl
+	}
+
+	// Resolve the hash to a launch and pin the schema
+	err = pinning.PinSchemaByHash(resolverContext.UserConfig, resolverContext.Logger, resolverContext.SystemCache, hash, sdl, input.GraphRef)
+	if err != nil {
+		return nil, err
+	}
+	resolverContext.InvalidateConfigDetails()
 	return &model.PinSchemaResult{
 		Success:       true,
-		Configuration: resolverContext.GetConfigDetails(),
+		Configuration: resolverContext.GetConfigDetails(persistedQueryChunksRequested(ctx)),
 	}, nil
 }
 
@@ -93,6 +141,12 @@ func (r *mutationResolver) PinPersistedQueryManifest(ctx context.Context, input
 	if resolverContext == nil {
 		return nil, fmt.Errorf("error retrieving resolver context")
 	}
+	if err := resolverContext.checkWritable("pinPersistedQueryManifest"); err != nil {
+		return nil, err
+	}
+	if err := resolverContext.checkCooldown("pinPersistedQueryManifest", input.GraphRef); err != nil {
+		return nil, err
+	}
 
 	supergraphConfig, err := config.FindSupergraphConfigFromGraphRef(input.GraphRef, resolverContext.UserConfig)
 	if err != nil {
@@ -102,7 +156,7 @@ func (r *mutationResolver) PinPersistedQueryManifest(ctx context.Context, input
 	if supergraphConfig.PersistedQueryVersion == input.ID {
 		return &model.PinPersistedQueryManifestResult{
 			Success:       true,
-			Configuration: resolverContext.GetConfigDetails(),
+			Configuration: resolverContext.GetConfigDetails(persistedQueryChunksRequested(ctx)),
 		}, nil
 	}
 
@@ -111,10 +165,11 @@ func (r *mutationResolver) PinPersistedQueryManifest(ctx context.Context, input
 	if err != nil {
 		return nil, err
 	}
+	resolverContext.InvalidateConfigDetails()
 
 	return &model.PinPersistedQueryManifestResult{
 		Success:       true,
-		Configuration: resolverContext.GetConfigDetails(),
+		Configuration: resolverContext.GetConfigDetails(persistedQueryChunksRequested(ctx)),
 	}, nil
 }
 
@@ -124,21 +179,27 @@ func (r *mutationResolver) ForceUpdate(ctx context.Context, input model.ForceUpd
 	if resolverContext == nil {
 		return nil, fmt.Errorf("error retrieving resolver context")
 	}
+	if err := resolverContext.checkWritable("forceUpdate"); err != nil {
+		return nil, err
+	}
+	if err := resolverContext.checkCooldown("forceUpdate", input.GraphRef); err != nil {
+		return nil, err
+	}
 
 	for _, operation := range input.Operations {
 		switch operation {
 		case model.OperationTypeSchema:
-			err := schema.FetchSchema(resolverContext.UserConfig, resolverContext.SystemCache, resolverContext.Logger, input.GraphRef)
+			err := schema.FetchSchema(ctx, resolverContext.UserConfig, resolverContext.SystemCache, resolverContext.Logger, input.GraphRef, "")
 			if err != nil {
 				return nil, err
 			}
 		case model.OperationTypeEntitlement:
-			err := entitlements.FetchRouterLicense(resolverContext.UserConfig, resolverContext.SystemCache, resolverContext.Logger, input.GraphRef)
+			err := entitlements.FetchRouterLicense(ctx, resolverContext.UserConfig, resolverContext.SystemCache, resolverContext.Logger, input.GraphRef)
 			if err != nil {
 				return nil, err
 			}
 		case model.OperationTypePersistedQueryManifest:
-			err := persistedqueries.FetchPQManifest(resolverContext.UserConfig, resolverContext.SystemCache, resolverContext.Logger, input.GraphRef, "")
+			err := persistedqueries.FetchPQManifest(ctx, resolverContext.UserConfig, resolverContext.SystemCache, resolverContext.Logger, input.GraphRef, "")
 			if err != nil {
 				return nil, err
 			}
@@ -146,16 +207,126 @@ func (r *mutationResolver) ForceUpdate(ctx context.Context, input model.ForceUpd
 			return nil, fmt.Errorf("invalid operation type: %s", operation)
 		}
 	}
+	resolverContext.InvalidateConfigDetails()
 	return &model.ForceUpdateResult{
 		Success:       true,
-		Configuration: resolverContext.GetConfigDetails(),
+		Configuration: resolverContext.GetConfigDetails(persistedQueryChunksRequested(ctx)),
 	}, nil
 }
 
+// Prewarm is the resolver for the prewarm field.
+func (r *mutationResolver) Prewarm(ctx context.Context, graphRef string) (*model.PrewarmResult, error) {
+	resolverContext := resolverContext(ctx)
+	if resolverContext == nil {
+		return nil, fmt.Errorf("error retrieving resolver context")
+	}
+	if err := resolverContext.checkWritable("prewarm"); err != nil {
+		return nil, err
+	}
+	if err := resolverContext.checkCooldown("prewarm", graphRef); err != nil {
+		return nil, err
+	}
+
+	result, err := resolverContext.Prewarm(ctx, graphRef)
+	if err != nil {
+		return nil, err
+	}
+	resolverContext.InvalidateConfigDetails()
+	result.Configuration = resolverContext.GetConfigDetails(persistedQueryChunksRequested(ctx))
+	return result, nil
+}
+
+// ReloadConfig is the resolver for the reloadConfig field.
+func (r *mutationResolver) ReloadConfig(ctx context.Context) (*model.ReloadConfigResult, error) {
+	resolverContext := resolverContext(ctx)
+	if resolverContext == nil {
+		return nil, fmt.Errorf("error retrieving resolver context")
+	}
+	if err := resolverContext.checkWritable("reloadConfig"); err != nil {
+		return nil, err
+	}
+	if !resolverContext.Authorized {
+		return nil, fmt.Errorf("%w: reloadConfig requires the management API secret", relayerrors.ErrUnauthorized)
+	}
+	if resolverContext.ReloadConfig == nil {
+		return nil, fmt.Errorf("reloading the configuration isn't supported")
+	}
+
+	newConfig, err := resolverContext.ReloadConfig()
+	if err != nil {
+		return nil, err
+	}
+	// This request is still served with the current configuration, so describe the new one separately
+	reloaded := &ResolverContext{
+		Logger:      resolverContext.Logger,
+		SystemCache: resolverContext.SystemCache,
+		UserConfig:  newConfig,
+	}
+	return &model.ReloadConfigResult{
+		Success:       true,
+		Configuration: reloaded.GetConfigDetails(persistedQueryChunksRequested(ctx)),
+	}, nil
+}
+
+// SetCacheDuration is the resolver for the setCacheDuration field.
+func (r *mutationResolver) SetCacheDuration(ctx context.Context, seconds int) (int, error) {
+	resolverContext := resolverContext(ctx)
+	if resolverContext == nil {
+		return 0, fmt.Errorf("error retrieving resolver context")
+	}
+	if err := resolverContext.checkWritable("setCacheDuration"); err != nil {
+		return 0, err
+	}
+	if !resolverContext.Authorized {
+		return 0, fmt.Errorf("%w: setCacheDuration requires the management API secret", relayerrors.ErrUnauthorized)
+	}
+
+	duration, err := resolverContext.SetCacheDuration(seconds)
+	if err != nil {
+		return 0, err
+	}
+	resolverContext.InvalidateConfigDetails()
+	return duration, nil
+}
+
+// ImportCache is the resolver for the importCache field.
+func (r *mutationResolver) ImportCache(ctx context.Context, archive string) (*model.ImportCacheResult, error) {
+	resolverContext := resolverContext(ctx)
+	if resolverContext == nil {
+		return nil, fmt.Errorf("error retrieving resolver context")
+	}
+	if err := resolverContext.checkWritable("importCache"); err != nil {
+		return nil, err
+	}
+	if !resolverContext.Authorized {
+		return nil, fmt.Errorf("%w: importCache requires the management API secret", relayerrors.ErrUnauthorized)
+	}
+
+	result, err := resolverContext.ImportCache(archive, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	resolverContext.InvalidateConfigDetails()
+	return result, nil
+}
+
 // Health is the resolver for the health field.
 func (r *queryResolver) Health(ctx context.Context) (model.HealthStatus, error) {
-	// TODO: check for artifacts in the cache when using pinned artifacts
-	return model.HealthStatusOk, nil
+	resolverContext := resolverContext(ctx)
+	if resolverContext == nil {
+		return model.HealthStatusOk, nil
+	}
+	return resolverContext.GetHealth(time.Now()).Status, nil
+}
+
+// HealthDetails is the resolver for the healthDetails field.
+func (r *queryResolver) HealthDetails(ctx context.Context) (*model.HealthReport, error) {
+	resolverContext := resolverContext(ctx)
+	if resolverContext == nil {
+		return nil, fmt.Errorf("error retrieving resolver context")
+	}
+
+	return resolverContext.GetHealth(time.Now()), nil
 }
 
 // CurrentConfiguration is the resolver for the currentConfiguration field.
@@ -165,7 +336,60 @@ func (r *queryResolver) CurrentConfiguration(ctx context.Context) (*model.Config
 		return nil, fmt.Errorf("error retrieving resolver context")
 	}
 
-	return resolverContext.GetConfigDetails(), nil
+	return resolverContext.GetConfigDetails(persistedQueryChunksRequested(ctx)), nil
+}
+
+// CacheKeys is the resolver for the cacheKeys field.
+func (r *queryResolver) CacheKeys(ctx context.Context, graphRef string) ([]*model.CacheKeyInfo, error) {
+	resolverContext := resolverContext(ctx)
+	if resolverContext == nil {
+		return nil, fmt.Errorf("error retrieving resolver context")
+	}
+
+	return resolverContext.GetCacheKeys(graphRef, time.Now())
+}
+
+// CacheStats is the resolver for the cacheStats field.
+func (r *queryResolver) CacheStats(ctx context.Context) (*model.CacheStats, error) {
+	resolverContext := resolverContext(ctx)
+	if resolverContext == nil {
+		return nil, fmt.Errorf("error retrieving resolver context")
+	}
+
+	return resolverContext.GetCacheStats(time.Now())
+}
+
+// SchemaHistory is the resolver for the schemaHistory field.
+func (r *queryResolver) SchemaHistory(ctx context.Context, graphRef string) ([]*model.SchemaVersion, error) {
+	resolverContext := resolverContext(ctx)
+	if resolverContext == nil {
+		return nil, fmt.Errorf("error retrieving resolver context")
+	}
+
+	return resolverContext.GetSchemaHistory(graphRef)
+}
+
+// SchemaVersion is the resolver for the schemaVersion field.
+func (r *queryResolver) SchemaVersion(ctx context.Context, graphRef string, id string) (*model.SchemaVersion, error) {
+	resolverContext := resolverContext(ctx)
+	if resolverContext == nil {
+		return nil, fmt.Errorf("error retrieving resolver context")
+	}
+
+	return resolverContext.GetSchemaVersion(graphRef, id)
+}
+
+// ExportCache is the resolver for the exportCache field.
+func (r *queryResolver) ExportCache(ctx context.Context) (*model.CacheExport, error) {
+	resolverContext := resolverContext(ctx)
+	if resolverContext == nil {
+		return nil, fmt.Errorf("error retrieving resolver context")
+	}
+	if !resolverContext.Authorized {
+		return nil, fmt.Errorf("%w: exportCache requires the management API secret", relayerrors.ErrUnauthorized)
+	}
+
+	return resolverContext.ExportCache(time.Now())
 }
 
 // Mutation returns MutationResolver implementation.
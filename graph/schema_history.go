@@ -0,0 +1,63 @@
+package graph
+
+import (
+	"apollosolutions/uplink-relay/cache"
+	"apollosolutions/uplink-relay/graph/model"
+	"apollosolutions/uplink-relay/internal/util"
+	"apollosolutions/uplink-relay/uplink"
+	"time"
+)
+
+// GetSchemaHistory lists the supergraph versions cached for the given graph, newest first: the current version, if cached, followed by the previous versions kept in its history.
+func (r *ResolverContext) GetSchemaHistory(graphRef string) ([]*model.SchemaVersion, error) {
+	if _, _, err := util.ParseGraphRef(graphRef); err != nil {
+		return nil, err
+	}
+
+	versions := []*model.SchemaVersion{}
+	if cacheBytes, ok := r.SystemCache.Get(cache.DefaultCacheKey(graphRef, uplink.SupergraphQuery)); ok {
+		var current cache.CacheItem
+		if err := cache.DecodeItem(cacheBytes, &current); err != nil {
+			r.Logger.Error("Error unmarshalling cache entry", "graphRef", graphRef, "error", err)
+			return nil, err
+		}
+		if len(current.Content) > 0 {
+			versions = append(versions, schemaVersion(current, true))
+		}
+	}
+
+	history, err := cache.History(r.SystemCache, graphRef, uplink.SupergraphQuery)
+	if err != nil {
+		r.Logger.Error("Error reading the supergraph history", "graphRef", graphRef, "error", err)
+		return nil, err
+	}
+	for _, item := range history {
+		versions = append(versions, schemaVersion(item, false))
+	}
+	return versions, nil
+}
+
+// GetSchemaVersion returns the cached supergraph of the given graph with the given uplink ID, or nil if neither the current version nor a previous one has that ID.
+func (r *ResolverContext) GetSchemaVersion(graphRef string, id string) (*model.SchemaVersion, error) {
+	versions, err := r.GetSchemaHistory(graphRef)
+	if err != nil {
+		return nil, err
+	}
+	for _, version := range versions {
+		if version.ID == id {
+			return version, nil
+		}
+	}
+	return nil, nil
+}
+
+// schemaVersion converts a cached supergraph to its management API representation.
+func schemaVersion(item cache.CacheItem, current bool) *model.SchemaVersion {
+	return &model.SchemaVersion{
+		ID:            item.ID,
+		Hash:          item.Hash,
+		LastModified:  item.LastModified.UTC().Format(time.RFC3339),
+		Current:       current,
+		SupergraphSdl: string(item.Content),
+	}
+}
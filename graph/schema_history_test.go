@@ -0,0 +1,57 @@
+package graph
+
+import (
+	"apollosolutions/uplink-relay/cache"
+	"apollosolutions/uplink-relay/config"
+	"apollosolutions/uplink-relay/logger"
+	"apollosolutions/uplink-relay/schema"
+	"testing"
+	"time"
+)
+
+func TestGetSchemaHistory(t *testing.T) {
+	cache.SetHistoryDepth(2)
+	defer cache.SetHistoryDepth(0)
+	pFalse := false
+	graphRef := "graph@current"
+	resolverContext := &ResolverContext{
+		Logger:      logger.MakeLogger(&pFalse),
+		SystemCache: cache.NewMemoryCache(100),
+		UserConfig:  config.NewDefaultConfig(),
+	}
+
+	// Nothing is cached yet
+	if versions, err := resolverContext.GetSchemaHistory(graphRef); err != nil || len(versions) != 0 {
+		t.Fatalf("Expected no versions, got %v, %v", versions, err)
+	}
+
+	for _, version := range []string{"1", "2", "3"} {
+		if err := schema.CacheSchema(resolverContext.SystemCache, resolverContext.Logger, graphRef, "schema"+version, "id"+version, "", 30, nil, -1); err != nil {
+			t.Fatalf("Failed to cache schema: %v", err)
+		}
+		// LastModified must increase for a version to replace the current one
+		time.Sleep(time.Millisecond)
+	}
+
+	versions, err := resolverContext.GetSchemaHistory(graphRef)
+	if err != nil {
+		t.Fatalf("GetSchemaHistory returned an error: %v", err)
+	}
+	if len(versions) != 3 {
+		t.Fatalf("Expected the current version and 2 previous ones, got %d", len(versions))
+	}
+	for i, expectedID := range []string{"id3", "id2", "id1"} {
+		if versions[i].ID != expectedID || versions[i].Current != (i == 0) {
+			t.Errorf("Expected version %d to be %s (current: %v), got %+v", i, expectedID, i == 0, versions[i])
+		}
+	}
+
+	// A prior version is retrieved by its ID
+	version, err := resolverContext.GetSchemaVersion(graphRef, "id1")
+	if err != nil || version == nil || version.SupergraphSdl != "schema1" || version.Current {
+		t.Errorf("Expected the first supergraph, got %+v, %v", version, err)
+	}
+	if version, err := resolverContext.GetSchemaVersion(graphRef, "unknown"); err != nil || version != nil {
+		t.Errorf("Expected no version for an unknown ID, got %+v, %v", version, err)
+	}
+}
@@ -0,0 +1,71 @@
+package relayerrors
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+)
+
+// Classes of failures shared across packages, so callers can tell them apart with errors.Is rather than matching messages.
+var (
+	ErrInvalidRequest   = errors.New("invalid request")
+	ErrInvalidConfig    = errors.New("invalid configuration")
+	ErrUnauthorized     = errors.New("unauthorized")
+	ErrGraphNotFound    = errors.New("supergraph not found")
+	ErrGraphNotAllowed  = errors.New("supergraph not allowed")
+	ErrClientNotAllowed = errors.New("client not allowed")
+	ErrAPIKeyMissing    = errors.New("API key missing")
+	ErrRateLimited      = errors.New("rate limited")
+	ErrUpstreamFailure  = errors.New("uplink request failed")
+	ErrUpstreamTimeout  = errors.New("uplink request timed out") // Timeouts are also wrapped with ErrUpstreamFailure.
+)
+
+// codes maps each error class to the code returned in management API error extensions, and the HTTP status returned by the relay.
+// More specific classes come first, as an error can wrap several.
+var codes = []struct {
+	err    error
+	code   string
+	status int
+}{
+	{ErrInvalidRequest, "INVALID_REQUEST", http.StatusBadRequest},
+	{ErrInvalidConfig, "INVALID_CONFIG", http.StatusBadRequest},
+	{ErrUnauthorized, "UNAUTHORIZED", http.StatusUnauthorized},
+	{ErrGraphNotFound, "GRAPH_NOT_FOUND", http.StatusNotFound},
+	{ErrGraphNotAllowed, "GRAPH_NOT_ALLOWED", http.StatusForbidden},
+	{ErrClientNotAllowed, "CLIENT_NOT_ALLOWED", http.StatusForbidden},
+	{ErrAPIKeyMissing, "API_KEY_MISSING", http.StatusUnauthorized},
+	{ErrRateLimited, "RATE_LIMITED", http.StatusTooManyRequests},
+	{ErrUpstreamTimeout, "UPSTREAM_TIMEOUT", http.StatusGatewayTimeout},
+	{ErrUpstreamFailure, "UPSTREAM_FAILURE", http.StatusBadGateway},
+}
+
+// Code returns the code for the class of the error, e.g. GRAPH_NOT_FOUND, or an empty string if it doesn't match any class.
+func Code(err error) string {
+	for _, c := range codes {
+		if errors.Is(err, c.err) {
+			return c.code
+		}
+	}
+	return ""
+}
+
+// HTTPStatus returns the HTTP status code for the class of the error, defaulting to 500 Internal Server Error.
+func HTTPStatus(err error) int {
+	for _, c := range codes {
+		if errors.Is(err, c.err) {
+			return c.status
+		}
+	}
+	return http.StatusInternalServerError
+}
+
+// Upstream wraps an error from a request to uplink with ErrUpstreamFailure, and also with ErrUpstreamTimeout if the request timed out.
+func Upstream(err error) error {
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return fmt.Errorf("%w: %w: %w", ErrUpstreamFailure, ErrUpstreamTimeout, err)
+	}
+	return fmt.Errorf("%w: %w", ErrUpstreamFailure, err)
+}
@@ -0,0 +1,48 @@
+package relayerrors
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestCodeAndHTTPStatus(t *testing.T) {
+	tests := []struct {
+		err    error
+		code   string
+		status int
+	}{
+		{fmt.Errorf("%w for graphRef: graph@current", ErrGraphNotFound), "GRAPH_NOT_FOUND", http.StatusNotFound},
+		{fmt.Errorf("%w for graphRef: graph@current", ErrAPIKeyMissing), "API_KEY_MISSING", http.StatusUnauthorized},
+		{fmt.Errorf("%w: %w", ErrUpstreamFailure, errors.New("connection refused")), "UPSTREAM_FAILURE", http.StatusBadGateway},
+		{fmt.Errorf("%w: missing graph_ref", ErrInvalidRequest), "INVALID_REQUEST", http.StatusBadRequest},
+		{fmt.Errorf("%w: cache duration must be positive", ErrInvalidConfig), "INVALID_CONFIG", http.StatusBadRequest},
+		{fmt.Errorf("%w: missing secret", ErrUnauthorized), "UNAUTHORIZED", http.StatusUnauthorized},
+		{fmt.Errorf("%w: graph@current isn't configured", ErrGraphNotAllowed), "GRAPH_NOT_ALLOWED", http.StatusForbidden},
+		{fmt.Errorf("%w: 192.0.2.1", ErrClientNotAllowed), "CLIENT_NOT_ALLOWED", http.StatusForbidden},
+		{Upstream(context.DeadlineExceeded), "UPSTREAM_TIMEOUT", http.StatusGatewayTimeout},
+		{Upstream(errors.New("connection refused")), "UPSTREAM_FAILURE", http.StatusBadGateway},
+		{errors.New("something else"), "", http.StatusInternalServerError},
+	}
+
+	for _, tt := range tests {
+		if code := Code(tt.err); code != tt.code {
+			t.Errorf("Expected code %q for %v, got %q", tt.code, tt.err, code)
+		}
+		if status := HTTPStatus(tt.err); status != tt.status {
+			t.Errorf("Expected status %d for %v, got %d", tt.status, tt.err, status)
+		}
+	}
+}
+
+func TestUpstream(t *testing.T) {
+	err := Upstream(context.DeadlineExceeded)
+	if !errors.Is(err, ErrUpstreamFailure) || !errors.Is(err, ErrUpstreamTimeout) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected a timeout to wrap ErrUpstreamFailure, ErrUpstreamTimeout and the cause, got %v", err)
+	}
+	if err := Upstream(errors.New("connection refused")); errors.Is(err, ErrUpstreamTimeout) {
+		t.Errorf("Expected a non-timeout not to wrap ErrUpstreamTimeout, got %v", err)
+	}
+}
@@ -0,0 +1,86 @@
+package util
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// ClientIP returns the address of the client making the request.
+// The forwarding headers are only used when the immediate peer is one of the trusted proxies, as any client can set them;
+// the chain is then walked from the nearest hop, skipping trusted proxies, so addresses a client prepended are never used.
+// The Forwarded header takes precedence over X-Forwarded-For. It returns false if the address can't be determined,
+// e.g. when a trusted proxy forwarded a malformed chain.
+func ClientIP(r *http.Request, trustedProxies []netip.Prefix) (netip.Addr, bool) {
+	peer, ok := parseHostAddr(r.RemoteAddr)
+	if !ok || !PrefixesContain(trustedProxies, peer) {
+		return peer, ok
+	}
+
+	hops := forwardedHops(r)
+	if len(hops) == 0 {
+		return peer, true
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		addr, ok := parseHostAddr(hops[i])
+		if !ok {
+			return netip.Addr{}, false
+		}
+		if i == 0 || !PrefixesContain(trustedProxies, addr) {
+			return addr, true
+		}
+	}
+	return netip.Addr{}, false
+}
+
+// forwardedHops returns the addresses in the Forwarded header, or the X-Forwarded-For header if there isn't one, ordered from the client to the nearest proxy.
+func forwardedHops(r *http.Request) []string {
+	hops := []string{}
+	if forwarded := r.Header.Values("Forwarded"); len(forwarded) > 0 {
+		for _, header := range forwarded {
+			for _, element := range strings.Split(header, ",") {
+				// Every element must identify its hop, so an element without a for parameter breaks the chain
+				hop := ""
+				for _, pair := range strings.Split(element, ";") {
+					key, value, _ := strings.Cut(strings.TrimSpace(pair), "=")
+					if strings.EqualFold(key, "for") {
+						hop = strings.Trim(value, `"`)
+					}
+				}
+				hops = append(hops, hop)
+			}
+		}
+		return hops
+	}
+
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(header, ",") {
+			hops = append(hops, strings.TrimSpace(hop))
+		}
+	}
+	return hops
+}
+
+// parseHostAddr parses an IP address, with an optional port and IPv6 brackets, e.g. 192.0.2.1:1234 or [2001:db8::1]:1234.
+func parseHostAddr(hostPort string) (netip.Addr, bool) {
+	host, _, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		host = strings.TrimSuffix(strings.TrimPrefix(hostPort, "["), "]")
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr.Unmap(), true
+}
+
+// PrefixesContain returns whether the address is within any of the prefixes.
+func PrefixesContain(prefixes []netip.Prefix, addr netip.Addr) bool {
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
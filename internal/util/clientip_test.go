@@ -0,0 +1,78 @@
+package util
+
+import (
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	trustedProxies := []netip.Prefix{netip.MustParsePrefix("172.16.0.0/12"), netip.MustParsePrefix("fd00::/8")}
+
+	tests := []struct {
+		name         string
+		remoteAddr   string
+		forwardedFor []string
+		forwarded    []string
+		expectedIP   string
+		expectedOK   bool
+	}{
+		{"peer without headers", "203.0.113.5:1234", nil, nil, "203.0.113.5", true},
+		{"IPv4-mapped peer", "[::ffff:203.0.113.5]:1234", nil, nil, "203.0.113.5", true},
+		{"unparseable peer", "@", nil, nil, "", false},
+		// Headers from an untrusted peer are ignored, as the client could have set them
+		{"untrusted peer with X-Forwarded-For", "203.0.113.5:1234", []string{"198.51.100.7"}, nil, "203.0.113.5", true},
+		{"untrusted peer with Forwarded", "203.0.113.5:1234", nil, []string{"for=198.51.100.7"}, "203.0.113.5", true},
+		{"untrusted peer with malformed X-Forwarded-For", "203.0.113.5:1234", []string{"unknown"}, nil, "203.0.113.5", true},
+		{"trusted peer without headers", "172.16.0.1:1234", nil, nil, "172.16.0.1", true},
+		{"trusted peer with X-Forwarded-For", "172.16.0.1:1234", []string{"198.51.100.7"}, nil, "198.51.100.7", true},
+		{"trusted peer ignores addresses the client prepended", "172.16.0.1:1234", []string{"10.1.2.3, 198.51.100.7"}, nil, "198.51.100.7", true},
+		{"trusted peer across X-Forwarded-For headers", "172.16.0.1:1234", []string{"10.1.2.3", "198.51.100.7"}, nil, "198.51.100.7", true},
+		{"chain of trusted proxies", "172.16.0.1:1234", []string{"198.51.100.7, 172.16.0.3, 172.16.0.2"}, nil, "198.51.100.7", true},
+		{"chain of only trusted proxies", "172.16.0.1:1234", []string{"172.16.0.3, 172.16.0.2"}, nil, "172.16.0.3", true},
+		{"X-Forwarded-For with a port", "172.16.0.1:1234", []string{"198.51.100.7:5678"}, nil, "198.51.100.7", true},
+		{"trusted IPv6 peer", "[fd00::1]:1234", []string{"2001:db8::1"}, nil, "2001:db8::1", true},
+		{"Forwarded", "172.16.0.1:1234", nil, []string{"for=198.51.100.7;proto=https"}, "198.51.100.7", true},
+		{"Forwarded with a quoted IPv6 address and port", "172.16.0.1:1234", nil, []string{`for="[2001:db8::1]:5678"`}, "2001:db8::1", true},
+		{"Forwarded with several elements", "172.16.0.1:1234", nil, []string{"for=10.1.2.3, For=198.51.100.7;by=172.16.0.1"}, "198.51.100.7", true},
+		{"Forwarded takes precedence", "172.16.0.1:1234", []string{"10.1.2.3"}, []string{"for=198.51.100.7"}, "198.51.100.7", true},
+		// A malformed chain from a trusted proxy can't identify the client
+		{"malformed X-Forwarded-For", "172.16.0.1:1234", []string{"unknown"}, nil, "", false},
+		{"empty X-Forwarded-For hop", "172.16.0.1:1234", []string{"198.51.100.7,,"}, nil, "", false},
+		{"malformed hop behind a trusted proxy", "172.16.0.1:1234", []string{"198.51.100.7, not-an-ip, 172.16.0.2"}, nil, "", false},
+		{"obfuscated Forwarded identifier", "172.16.0.1:1234", nil, []string{"for=_hidden"}, "", false},
+		{"Forwarded element without for", "172.16.0.1:1234", nil, []string{"for=198.51.100.7, proto=https"}, "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.RemoteAddr = tt.remoteAddr
+			for _, value := range tt.forwardedFor {
+				req.Header.Add("X-Forwarded-For", value)
+			}
+			for _, value := range tt.forwarded {
+				req.Header.Add("Forwarded", value)
+			}
+
+			addr, ok := ClientIP(req, trustedProxies)
+			if ok != tt.expectedOK {
+				t.Fatalf("Expected ok %v, got %v (%s)", tt.expectedOK, ok, addr)
+			}
+			if ok && addr.String() != tt.expectedIP {
+				t.Errorf("Expected %s, got %s", tt.expectedIP, addr)
+			}
+		})
+	}
+}
+
+func TestClientIPWithoutTrustedProxies(t *testing.T) {
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "172.16.0.1:1234"
+	req.Header.Set("X-Forwarded-For", "198.51.100.7")
+
+	addr, ok := ClientIP(req, nil)
+	if !ok || addr.String() != "172.16.0.1" {
+		t.Errorf("Expected the remote address when no proxies are trusted, got %s (%v)", addr, ok)
+	}
+}
@@ -0,0 +1,22 @@
+package util
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+// DecodeUplinkResponse unmarshals an uplink response into v.
+// In strict mode, fields that v doesn't define are rejected, so changes to uplink's response format are detected rather than silently ignored.
+func DecodeUplinkResponse(body []byte, v interface{}, strict bool) error {
+	if !strict {
+		return json.Unmarshal(body, v)
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		return fmt.Errorf("uplink response doesn't match the expected schema: %w", err)
+	}
+	return nil
+}
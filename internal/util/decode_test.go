@@ -0,0 +1,47 @@
+package util
+
+import (
+	"testing"
+)
+
+func TestDecodeUplinkResponse(t *testing.T) {
+	type routerConfig struct {
+		Typename string `json:"__typename"`
+		ID       string `json:"id"`
+	}
+	type response struct {
+		Data struct {
+			RouterConfig routerConfig `json:"routerConfig"`
+		} `json:"data"`
+	}
+
+	tests := []struct {
+		name      string
+		body      string
+		strict    bool
+		expectErr bool
+	}{
+		{name: "expected fields, lenient", body: `{"data":{"routerConfig":{"__typename":"RouterConfigResult","id":"1"}}}`, strict: false, expectErr: false},
+		{name: "expected fields, strict", body: `{"data":{"routerConfig":{"__typename":"RouterConfigResult","id":"1"}}}`, strict: true, expectErr: false},
+		{name: "unexpected field, lenient", body: `{"data":{"routerConfig":{"__typename":"RouterConfigResult","id":"1","newField":true}}}`, strict: false, expectErr: false},
+		{name: "unexpected field, strict", body: `{"data":{"routerConfig":{"__typename":"RouterConfigResult","id":"1","newField":true}}}`, strict: true, expectErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var result response
+			err := DecodeUplinkResponse([]byte(test.body), &result, test.strict)
+			if test.expectErr {
+				if err == nil {
+					t.Errorf("Expected an error for the unexpected field")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+			if result.Data.RouterConfig.ID != "1" {
+				t.Errorf("Expected the response to be decoded, got %+v", result)
+			}
+		})
+	}
+}
@@ -0,0 +1,81 @@
+package util
+
+import (
+	"apollosolutions/uplink-relay/audit"
+	"apollosolutions/uplink-relay/config"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// transportKey identifies the connection timeouts of a transport.
+type transportKey struct {
+	dialTimeout         time.Duration
+	tlsHandshakeTimeout time.Duration
+	publicOnly          bool // Whether connections to internal addresses are refused.
+}
+
+// transports holds a transport for each combination of connection timeouts, so clients share connection pools rather than opening connections per request.
+var transports sync.Map
+
+// NewHTTPClient returns a client for requests to uplink and the Studio API, with the overall timeout and connection timeouts from the uplink configuration.
+// The connection timeouts bound how long an unreachable uplink can hold a request, e.g. when connections are silently dropped.
+// The reverse proxy uses the client's transport, so proxied requests have the same connection timeouts and are audited too.
+func NewHTTPClient(userConfig *config.Config) *http.Client {
+	return &http.Client{
+		Timeout:   time.Duration(userConfig.Uplink.Timeout) * time.Second,
+		Transport: uplinkTransport(userConfig, false),
+	}
+}
+
+// NewPublicHTTPClient returns a client like NewHTTPClient that refuses to connect to loopback, private and link-local addresses,
+// for fetching URLs taken from upstream responses. Addresses are checked when connecting, so hostnames resolving to internal addresses are refused too.
+func NewPublicHTTPClient(userConfig *config.Config) *http.Client {
+	return &http.Client{
+		Timeout:   time.Duration(userConfig.Uplink.Timeout) * time.Second,
+		Transport: uplinkTransport(userConfig, true),
+	}
+}
+
+// IsInternalIP reports whether ip is a loopback, private, link-local or unspecified address.
+func IsInternalIP(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsUnspecified()
+}
+
+// refuseInternalAddresses is a net.Dialer control function refusing connections to internal addresses.
+func refuseInternalAddresses(network string, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || IsInternalIP(ip) {
+		return fmt.Errorf("connecting to %s is not allowed", host)
+	}
+	return nil
+}
+
+// uplinkTransport returns the shared transport for the uplink configuration's connection timeouts, creating it if needed.
+// Requests sent with it are written to the audit trail when auditing is enabled.
+func uplinkTransport(userConfig *config.Config, publicOnly bool) http.RoundTripper {
+	key := transportKey{
+		dialTimeout:         time.Duration(userConfig.Uplink.DialTimeout) * time.Second,
+		tlsHandshakeTimeout: time.Duration(userConfig.Uplink.TLSHandshakeTimeout) * time.Second,
+		publicOnly:          publicOnly,
+	}
+	if transport, ok := transports.Load(key); ok {
+		return transport.(http.RoundTripper)
+	}
+
+	dialer := &net.Dialer{Timeout: key.dialTimeout, KeepAlive: 30 * time.Second}
+	if publicOnly {
+		dialer.Control = refuseInternalAddresses
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = dialer.DialContext
+	transport.TLSHandshakeTimeout = key.tlsHandshakeTimeout
+	actual, _ := transports.LoadOrStore(key, audit.Transport(transport))
+	return actual.(http.RoundTripper)
+}
@@ -0,0 +1,107 @@
+package util
+
+import (
+	"apollosolutions/uplink-relay/config"
+	"apollosolutions/uplink-relay/internal/relayerrors"
+	"apollosolutions/uplink-relay/logger"
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewHTTPClientDialTimeout(t *testing.T) {
+	// Connections to an unroutable address are never answered, so without a dial timeout the request would wait for the request timeout
+	testConfig := config.NewDefaultConfig()
+	testConfig.Uplink.URLs = []string{"http://10.255.255.1:81"}
+	testConfig.Uplink.Timeout = 30
+	testConfig.Uplink.DialTimeout = 1
+
+	start := time.Now()
+	_, err := UplinkRequest(context.Background(), testConfig, logger.MakeLogger(nil), "query Test {__typename}", nil, "Test")
+	if !errors.Is(err, relayerrors.ErrUpstreamFailure) {
+		t.Errorf("Expected ErrUpstreamFailure, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Expected the request to fail once the dial timed out, but it took %s", elapsed)
+	}
+}
+
+func TestNewHTTPClientTLSHandshakeTimeout(t *testing.T) {
+	// Accept connections but never respond, so the TLS handshake can't complete
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	testConfig := config.NewDefaultConfig()
+	testConfig.Uplink.URLs = []string{"https://" + listener.Addr().String()}
+	testConfig.Uplink.Timeout = 30
+	testConfig.Uplink.TLSHandshakeTimeout = 1
+
+	start := time.Now()
+	_, err = UplinkRequest(context.Background(), testConfig, logger.MakeLogger(nil), "query Test {__typename}", nil, "Test")
+	if !errors.Is(err, relayerrors.ErrUpstreamTimeout) {
+		t.Errorf("Expected ErrUpstreamTimeout, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Expected the request to fail once the TLS handshake timed out, but it took %s", elapsed)
+	}
+}
+
+func TestNewHTTPClientSharesTransport(t *testing.T) {
+	first := config.NewDefaultConfig()
+	second := config.NewDefaultConfig()
+	second.Uplink.Timeout = 5
+	other := config.NewDefaultConfig()
+	other.Uplink.DialTimeout = 3
+
+	// Only the connection timeouts are set on the transport, so clients with different request timeouts share it
+	if NewHTTPClient(first).Transport != NewHTTPClient(second).Transport {
+		t.Errorf("Expected clients with the same connection timeouts to share a transport")
+	}
+	if NewHTTPClient(first).Transport == NewHTTPClient(other).Transport {
+		t.Errorf("Expected clients with different connection timeouts to use different transports")
+	}
+	if timeout := NewHTTPClient(second).Timeout; timeout != 5*time.Second {
+		t.Errorf("Expected the request timeout of 5s, got %s", timeout)
+	}
+}
+
+func TestNewPublicHTTPClient(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+	testConfig := config.NewDefaultConfig()
+
+	// Hostnames are resolved before the address is checked, so localhost is refused like 127.0.0.1
+	for _, url := range []string{server.URL, strings.Replace(server.URL, "127.0.0.1", "localhost", 1)} {
+		if res, err := NewPublicHTTPClient(testConfig).Get(url); err == nil {
+			res.Body.Close()
+			t.Errorf("Expected the connection to %s to be refused", url)
+		}
+	}
+	res, err := NewHTTPClient(testConfig).Get(server.URL)
+	if err != nil {
+		t.Fatalf("Expected the connection to be allowed without the check, got %v", err)
+	}
+	res.Body.Close()
+	if NewPublicHTTPClient(testConfig).Transport == NewHTTPClient(testConfig).Transport {
+		t.Errorf("Expected the public client not to share connections with the uplink client")
+	}
+}
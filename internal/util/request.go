@@ -1,9 +1,14 @@
 package util
 
 import (
+	"apollosolutions/uplink-relay/audit"
 	"apollosolutions/uplink-relay/config"
+	"apollosolutions/uplink-relay/internal/relayerrors"
 	"apollosolutions/uplink-relay/uplink"
 	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -19,12 +24,28 @@ type UplinkRelayRequest struct {
 	OperationName string                 `json:"operationName"`
 }
 
-func UplinkRequest(userConfig *config.Config, logger *slog.Logger, query string, variables map[string]interface{}, operationName string) ([]byte, error) {
-	httpClient := http.DefaultClient
-	httpClient.Timeout = time.Duration(userConfig.Uplink.Timeout) * time.Second
+// RequestIDHeader is the header used to correlate requests between the router, the relay and uplink.
+const RequestIDHeader = "X-Request-ID"
 
-	// Select the next uplink URL
-	selector := uplink.NewRoundRobinSelector(userConfig.Uplink.URLs)
+// NewRequestID generates a random request ID.
+func NewRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%d", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
+
+// UplinkRequest sends the query to uplink and returns the response body.
+// Failures to reach uplink, or unsuccessful responses, are wrapped with relayerrors.ErrUpstreamFailure.
+// The request is abandoned when the context is cancelled, e.g. when polling is stopped.
+func UplinkRequest(ctx context.Context, userConfig *config.Config, logger *slog.Logger, query string, variables map[string]interface{}, operationName string) ([]byte, error) {
+	// Use a dedicated client rather than modifying http.DefaultClient, as requests can be made concurrently
+	httpClient := NewHTTPClient(userConfig)
+
+	// Select the next uplink URL, using the graph's own uplink URLs if it has them
+	graphRef, _ := variables["graph_ref"].(string)
+	selector := uplink.NewRoundRobinSelector(userConfig.UplinkURLsForGraph(graphRef))
 	uplinkURL := selector.Next()
 	body := &UplinkRelayRequest{
 		Query:         query,
@@ -38,8 +59,8 @@ func UplinkRequest(userConfig *config.Config, logger *slog.Logger, query string,
 		return nil, err
 	}
 
-	// Create a new request using http
-	req, err := http.NewRequest("POST", uplinkURL, bytes.NewBuffer(requestBody))
+	// Create a new request using http, identifying the graph and operation for the audit trail
+	req, err := http.NewRequestWithContext(audit.WithCall(ctx, graphRef, operationName), "POST", uplinkURL, bytes.NewBuffer(requestBody))
 	if err != nil {
 		logger.Error("Error creating request", "err", err)
 		return nil, err
@@ -55,12 +76,13 @@ func UplinkRequest(userConfig *config.Config, logger *slog.Logger, query string,
 	resp, err := httpClient.Do(req)
 	if err != nil {
 		logger.Error("Error on response", "err", err)
-		return nil, err
+		return nil, relayerrors.Upstream(err)
 	}
 
 	// Check if the response status code is not 200
 	if resp.StatusCode >= 300 || resp.StatusCode < 200 {
-		return nil, fmt.Errorf("API request failed with status %d", resp.StatusCode)
+		resp.Body.Close()
+		return nil, fmt.Errorf("%w: API request failed with status %d", relayerrors.ErrUpstreamFailure, resp.StatusCode)
 	}
 
 	// Read the response body
@@ -69,7 +91,7 @@ func UplinkRequest(userConfig *config.Config, logger *slog.Logger, query string,
 	// Check if the response body is empty
 	if len(bodyBytes) == 0 {
 		logger.Error("Empty response body")
-		return nil, fmt.Errorf("empty response body")
+		return nil, fmt.Errorf("%w: empty response body", relayerrors.ErrUpstreamFailure)
 	}
 	return bodyBytes, nil
 }
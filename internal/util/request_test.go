@@ -2,10 +2,14 @@ package util
 
 import (
 	"apollosolutions/uplink-relay/config"
+	"apollosolutions/uplink-relay/internal/relayerrors"
 	"apollosolutions/uplink-relay/logger"
+	"context"
+	"errors"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 )
 
 func TestUplinkRequest(t *testing.T) {
@@ -34,7 +38,7 @@ func TestUplinkRequest(t *testing.T) {
 	operationName := "Test"
 
 	// Call the UplinkRequest function
-	response, err := UplinkRequest(testConfig, logger, query, variables, operationName)
+	response, err := UplinkRequest(context.Background(), testConfig, logger, query, variables, operationName)
 
 	// Check if there was an error
 	if err != nil {
@@ -46,3 +50,93 @@ func TestUplinkRequest(t *testing.T) {
 		t.Errorf("UplinkRequest returned an empty response")
 	}
 }
+
+func TestUplinkRequestGraphUplinkURLs(t *testing.T) {
+	var globalCalls, mirrorCalls int
+	globalServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		globalCalls++
+		w.Write([]byte(`{"message": "Test response"}`))
+	}))
+	defer globalServer.Close()
+	mirrorServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mirrorCalls++
+		w.Write([]byte(`{"message": "Test response"}`))
+	}))
+	defer mirrorServer.Close()
+
+	testConfig := config.NewDefaultConfig()
+	testConfig.Uplink.URLs = []string{globalServer.URL}
+	testConfig.Supergraphs = []config.SupergraphConfig{{GraphRef: "graph@mirror", UplinkURLs: []string{mirrorServer.URL}}}
+
+	for _, graphRef := range []string{"graph@mirror", "graph@mirror", "graph@local"} {
+		if _, err := UplinkRequest(context.Background(), testConfig, logger.MakeLogger(nil), "query Test {__typename}", map[string]interface{}{"graph_ref": graphRef}, "Test"); err != nil {
+			t.Fatalf("UplinkRequest returned an error: %v", err)
+		}
+	}
+	if mirrorCalls != 2 || globalCalls != 1 {
+		t.Errorf("Expected 2 requests to the graph's uplink URLs and 1 to the uplink URLs, got %d and %d", mirrorCalls, globalCalls)
+	}
+}
+
+func TestNewRequestID(t *testing.T) {
+	first := NewRequestID()
+	second := NewRequestID()
+	if len(first) != 32 {
+		t.Errorf("Expected a 32 character request ID, got %s", first)
+	}
+	if first == second {
+		t.Errorf("Expected unique request IDs, got %s twice", first)
+	}
+}
+
+func TestUplinkRequestUpstreamFailure(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/error":
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case "/empty":
+			w.WriteHeader(http.StatusOK)
+		}
+	}))
+	closedServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	closedServer.Close()
+	defer server.Close()
+
+	for _, url := range []string{server.URL + "/error", server.URL + "/empty", closedServer.URL} {
+		testConfig := config.NewDefaultConfig()
+		testConfig.Uplink.URLs = []string{url}
+		_, err := UplinkRequest(context.Background(), testConfig, logger.MakeLogger(nil), "query Test {__typename}", nil, "Test")
+		if !errors.Is(err, relayerrors.ErrUpstreamFailure) {
+			t.Errorf("Expected ErrUpstreamFailure for %s, got %v", url, err)
+		}
+	}
+}
+
+func TestUplinkRequestCancelled(t *testing.T) {
+	// Uplink never responds within the test, so only cancelling the context can end the request
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer server.Close()
+	defer close(release)
+
+	testConfig := config.NewDefaultConfig()
+	testConfig.Uplink.URLs = []string{server.URL}
+	testConfig.Uplink.Timeout = 30
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	start := time.Now()
+	_, err := UplinkRequest(ctx, testConfig, logger.MakeLogger(nil), "query Test {__typename}", nil, "Test")
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected the request to return promptly once cancelled, but it took %s", elapsed)
+	}
+}
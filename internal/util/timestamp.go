@@ -0,0 +1,45 @@
+package util
+
+import (
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// timestampLayouts lists the timestamp formats seen in uplink IDs, tried in order.
+var timestampLayouts = []string{
+	time.RFC3339,
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05.000000000Z07:00", // 9-digit fractional seconds, e.g. 2024-02-09T19:34:43.322688000Z
+	"2006-01-02T15:04:05Z0700",            // Offsets without a colon, e.g. 2024-02-09T19:34:43+0000
+	"2006-01-02T15:04:05.999999999Z0700",
+}
+
+// ParseUplinkTimestamp parses a timestamp returned by uplink, such as a supergraph or license ID, accepting each of the formats uplink is known to use.
+func ParseUplinkTimestamp(value string) (time.Time, error) {
+	for _, layout := range timestampLayouts {
+		if parsed, err := time.Parse(layout, value); err == nil {
+			return parsed, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("unrecognized timestamp format: %q", value)
+}
+
+// ParseUplinkTimestampOrNow parses a timestamp returned by uplink, falling back to the current time with a warning if it can't be parsed,
+// so an unexpected ID format doesn't fail the request. The args are added to the warning.
+func ParseUplinkTimestampOrNow(logger *slog.Logger, value string, args ...any) time.Time {
+	parsed, err := ParseUplinkTimestamp(value)
+	if err != nil {
+		logger.Warn("Failed to parse uplink ID, using the current time", append([]any{"id", value, "err", err}, args...)...)
+		return time.Now()
+	}
+	return parsed
+}
+
+// UplinkIDOrNow returns a timestamp ID returned by uplink unchanged if it can be parsed, or the current time in RFC3339 with a warning if it can't.
+func UplinkIDOrNow(logger *slog.Logger, id string, args ...any) string {
+	if _, err := ParseUplinkTimestamp(id); err == nil {
+		return id
+	}
+	return ParseUplinkTimestampOrNow(logger, id, args...).UTC().Format(time.RFC3339)
+}
@@ -0,0 +1,73 @@
+package util
+
+import (
+	"apollosolutions/uplink-relay/logger"
+	"testing"
+	"time"
+)
+
+func TestParseUplinkTimestamp(t *testing.T) {
+	tests := []struct {
+		value         string
+		expected      time.Time
+		expectedError bool
+	}{
+		{"2024-08-02T12:00:00Z", time.Date(2024, 8, 2, 12, 0, 0, 0, time.UTC), false},
+		{"2024-02-09T19:34:43.322688000Z", time.Date(2024, 2, 9, 19, 34, 43, 322688000, time.UTC), false},
+		{"2024-08-05T19:53:29.140664Z", time.Date(2024, 8, 5, 19, 53, 29, 140664000, time.UTC), false},
+		{"2024-08-05T19:53:29.1Z", time.Date(2024, 8, 5, 19, 53, 29, 100000000, time.UTC), false},
+		{"2024-08-05T21:53:29+02:00", time.Date(2024, 8, 5, 19, 53, 29, 0, time.UTC), false},
+		{"2024-08-05T21:53:29+0200", time.Date(2024, 8, 5, 19, 53, 29, 0, time.UTC), false},
+		{"2024-08-05T21:53:29.140664000+0200", time.Date(2024, 8, 5, 19, 53, 29, 140664000, time.UTC), false},
+		{"id1", time.Time{}, true},
+		{"", time.Time{}, true},
+	}
+
+	for _, test := range tests {
+		parsed, err := ParseUplinkTimestamp(test.value)
+		if test.expectedError {
+			if err == nil {
+				t.Errorf("Expected an error for %q", test.value)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Unexpected error for %q: %v", test.value, err)
+			continue
+		}
+		if !parsed.Equal(test.expected) {
+			t.Errorf("Expected %q to parse as %v, got %v", test.value, test.expected, parsed)
+		}
+	}
+}
+
+func TestParseUplinkTimestampOrNow(t *testing.T) {
+	pFalse := false
+	logger := logger.MakeLogger(&pFalse)
+
+	expected := time.Date(2024, 8, 5, 19, 53, 29, 140664000, time.UTC)
+	if parsed := ParseUplinkTimestampOrNow(logger, "2024-08-05T19:53:29.140664000Z"); !parsed.Equal(expected) {
+		t.Errorf("Expected %v, got %v", expected, parsed)
+	}
+
+	// Unparseable IDs fall back to the current time rather than failing
+	before := time.Now()
+	if parsed := ParseUplinkTimestampOrNow(logger, "not-a-timestamp"); parsed.Before(before) || parsed.After(time.Now()) {
+		t.Errorf("Expected the current time, got %v", parsed)
+	}
+}
+
+func TestUplinkIDOrNow(t *testing.T) {
+	pFalse := false
+	logger := logger.MakeLogger(&pFalse)
+
+	// Parseable IDs are kept as-is, so they can be sent back to uplink as ifAfterId
+	if id := UplinkIDOrNow(logger, "2024-02-09T19:34:43.322688000Z"); id != "2024-02-09T19:34:43.322688000Z" {
+		t.Errorf("Expected the ID to be unchanged, got %s", id)
+	}
+
+	id := UplinkIDOrNow(logger, "not-a-timestamp")
+	if _, err := time.Parse(time.RFC3339, id); err != nil {
+		t.Errorf("Expected an RFC3339 timestamp, got %s", id)
+	}
+}
@@ -10,16 +10,22 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
 	"time"
 
 	"github.com/go-redis/redis"
 
+	"apollosolutions/uplink-relay/audit"
 	"apollosolutions/uplink-relay/cache"
 	"apollosolutions/uplink-relay/config"
+	"apollosolutions/uplink-relay/entitlements"
 	"apollosolutions/uplink-relay/filesystem_cache"
 	"apollosolutions/uplink-relay/graph"
+	"apollosolutions/uplink-relay/internal/relayerrors"
+	"apollosolutions/uplink-relay/internal/util"
 	"apollosolutions/uplink-relay/logger"
+	"apollosolutions/uplink-relay/metrics"
 	persistedqueries "apollosolutions/uplink-relay/persisted_queries"
 	"apollosolutions/uplink-relay/pinning"
 	"apollosolutions/uplink-relay/polling"
@@ -27,6 +33,7 @@ import (
 	apolloredis "apollosolutions/uplink-relay/redis"
 	"apollosolutions/uplink-relay/tiered_cache"
 	"apollosolutions/uplink-relay/uplink"
+	"apollosolutions/uplink-relay/version"
 	"apollosolutions/uplink-relay/webhooks"
 
 	"github.com/99designs/gqlgen/graphql/handler"
@@ -34,18 +41,20 @@ import (
 
 var (
 	// Parse command-line flags.
-	configPath   = flag.String("config", "config.yml", "Path to the configuration file")
+	configPath   = flag.String("config", "config.yml", "Path to the configuration file, or - to read it from standard input")
 	enableDebug  = flag.Bool("debug", false, "Enable debug logging")
 	configSchema = flag.Bool("config-schema", false, "Print the JSON schema for the configuration file")
+	verifyKeys   = flag.Bool("verify-keys", false, "Verify each supergraph's API key against uplink on startup")
+	showVersion  = flag.Bool("version", false, "Print the version and exit")
 )
 
-// init parses the command-line flags.
-func init() {
-	flag.Parse()
-}
-
 // main contains the main application logic.
 func main() {
+	flag.Parse()
+	if *showVersion {
+		fmt.Println(version.Get())
+		return
+	}
 	// Initialize the logger.
 	logger := logger.MakeLogger(enableDebug)
 	if *configSchema {
@@ -75,14 +84,25 @@ func main() {
 		os.Exit(1)
 	}
 
+	// Verify the configured API keys if requested, which surfaces misconfigured keys before polling or routers hit them.
+	if *verifyKeys {
+		mergedConfig.Uplink.VerifyKeysOnStart = true
+	}
+	if mergedConfig.Uplink.VerifyKeysOnStart {
+		if err := verifyAPIKeys(mergedConfig, logger); err != nil && mergedConfig.Uplink.RequireValidKeys {
+			logger.Error("API key verification failed", "err", err)
+			os.Exit(1)
+		}
+	}
+
 	// Initialize caching based on the configuration.
-	var uplinkCaches = make([]cache.Cache, 0)
+	var backends = make(map[string]cache.Cache)
 
 	var uplinkCache cache.Cache
 	// Initialize the cache based on the configuration.
-	// We want to use the first cache that is enabled, which should be the in-memory cache
+	// By default, we want to use the first cache that is enabled, which should be the in-memory cache
 	if mergedConfig.Cache.Enabled {
-		uplinkCaches = append(uplinkCaches, cache.NewMemoryCache(mergedConfig.Cache.MaxSize))
+		backends[config.CacheTierMemory] = cache.NewShardedMemoryCache(mergedConfig.Cache.MaxSize, mergedConfig.Cache.Shards)
 	}
 	if mergedConfig.FilesystemCache.Enabled {
 		logger.Info("Using filesystem cache", "directory", mergedConfig.FilesystemCache.Directory)
@@ -91,7 +111,7 @@ func main() {
 			logger.Error("Failed to create filesystem cache", "err", err)
 			os.Exit(1)
 		}
-		uplinkCaches = append(uplinkCaches, filesystemCache)
+		backends[config.CacheTierFilesystem] = filesystemCache
 	}
 	if mergedConfig.Redis.Enabled {
 		logger.Info("Using Redis cache", "address", mergedConfig.Redis.Address)
@@ -101,32 +121,55 @@ func main() {
 			DB:       mergedConfig.Redis.Database,
 		})
 		redisClient.Ping()
-		uplinkCaches = append(uplinkCaches, apolloredis.NewRedisCache(redisClient))
+		backends[config.CacheTierRedis] = apolloredis.NewRedisCache(redisClient)
+	}
+
+	// Look up the backends in the configured order
+	tiers := make([]tiered_cache.Tier, 0, len(backends))
+	for _, tier := range mergedConfig.CacheTiers() {
+		tiers = append(tiers, tiered_cache.Tier{Cache: backends[tier.Name], Mode: tiered_cache.TierMode(tier.Mode)})
 	}
 
-	if len(uplinkCaches) == 0 {
+	if len(tiers) == 0 {
 		logger.Error("No cache configured")
 		os.Exit(1)
-	} else if len(uplinkCaches) == 1 {
+	} else if len(tiers) == 1 {
 		logger.Debug("Using single cache")
-		uplinkCache = uplinkCaches[0]
+		uplinkCache = tiers[0].Cache
 	} else {
-		logger.Debug("Using tiered cache")
-		uplinkCache, err = tiered_cache.NewTieredCache(uplinkCaches, logger, mergedConfig.Cache.Duration)
+		logger.Debug("Using tiered cache", "tiers", mergedConfig.CacheTiers())
+		uplinkCache, err = tiered_cache.NewTieredCacheWithTiers(tiers, logger, mergedConfig.Cache.Duration)
 		if err != nil {
 			logger.Error("Failed to create tiered cache", "err", err)
 			os.Exit(1)
 		}
 	}
-	// Create a channel to stop polling on SIGHUP to avoid duplicate polling.
-	stopPolling := make(chan bool, 1)
 
-	server, err := startup(mergedConfig, logger, uplinkCache, stopPolling)
-	if err != nil {
-		logger.Error(err.Error())
-		os.Exit(1)
+	// Keep entries in memory if the filesystem or Redis cache fails, so a cache outage doesn't send every router to uplink.
+	if *mergedConfig.Cache.Fallback && (mergedConfig.FilesystemCache.Enabled || mergedConfig.Redis.Enabled) {
+		logger.Debug("Using fallback cache", "duration", mergedConfig.Cache.FallbackDuration)
+		uplinkCache = cache.NewFallbackCache(uplinkCache, logger, mergedConfig.Cache.MaxSize, mergedConfig.Cache.FallbackDuration)
+	}
+
+	// Keep entries past their duration for the grace period, so they can be served while they're refreshed in the background.
+	if mergedConfig.Cache.StaleGrace > 0 {
+		logger.Debug("Using stale cache", "grace", mergedConfig.Cache.StaleGrace)
+		uplinkCache = cache.NewStaleCache(uplinkCache, mergedConfig.Cache.StaleGrace)
 	}
 
+	// Compress large entries, such as supergraph SDLs, in every cache backend if enabled.
+	if mergedConfig.Cache.Compress {
+		logger.Debug("Using compressed cache", "minSize", mergedConfig.Cache.CompressMinSize)
+		uplinkCache = cache.NewCompressedCache(uplinkCache, mergedConfig.Cache.CompressMinSize)
+	}
+	// Store identical content once across graphs and variants, keeping references to it in the encoded items.
+	if mergedConfig.Cache.Deduplicate {
+		logger.Debug("Using deduplicated cache")
+		uplinkCache = cache.NewDedupCache(uplinkCache)
+	}
+	relay := newRelay(*configPath, defaultConfig, logger, uplinkCache)
+	relay.apply(mergedConfig)
+
 	update := make(chan os.Signal, 1)
 	signal.Notify(update, syscall.SIGHUP)
 	go func() {
@@ -134,17 +177,8 @@ func main() {
 			switch sig {
 			case syscall.SIGHUP:
 				logger.Info("Reloading configuration")
-				proxy.ShutdownServer(server, logger)
-				stopPolling <- true
-				newConfig, err := config.LoadConfig(*configPath)
-				if err != nil {
-					logger.Error("Could not load configuration", "err", err)
-					os.Exit(1)
-				}
-				server, err = startup(config.MergeWithDefaultConfig(defaultConfig, newConfig, enableDebug, logger), logger, uplinkCache, stopPolling)
-				if err != nil {
-					logger.Error(err.Error())
-					os.Exit(1)
+				if _, err := relay.reload(); err != nil {
+					logger.Error("Could not reload configuration, keeping the current configuration", "err", err)
 				}
 			}
 		}
@@ -158,22 +192,138 @@ func main() {
 	<-stop
 
 	// Shut down the server
-	proxy.ShutdownServer(server, logger)
+	relay.shutdown()
 }
 
-func startup(userConfig *config.Config, logger *slog.Logger, systemCache cache.Cache, stopPolling chan bool) (*http.Server, error) {
-	// Initialize the round-robin URL selector.
-	rrSelector := uplink.NewRoundRobinSelector(userConfig.Uplink.URLs)
+// relay holds the servers running with the current configuration, so the configuration can be reloaded on SIGHUP or from the management API.
+type relay struct {
+	mu            sync.Mutex
+	configPath    string
+	defaultConfig *config.Config
+	logger        *slog.Logger
+	systemCache   cache.Cache
+	stopPolling   chan bool // Stops polling on reload to avoid duplicate polling.
+	config        *config.Config
+	servers       []*http.Server
+}
 
-	// Configure the HTTP client with a timeout.
-	httpClient := &http.Client{
-		Timeout: time.Duration(userConfig.Uplink.Timeout) * time.Second,
+// newRelay creates a relay for the configuration file at the given path. No servers run until a configuration is applied.
+func newRelay(configPath string, defaultConfig *config.Config, logger *slog.Logger, systemCache cache.Cache) *relay {
+	return &relay{
+		configPath:    configPath,
+		defaultConfig: defaultConfig,
+		logger:        logger,
+		systemCache:   systemCache,
+		stopPolling:   make(chan bool, 1),
 	}
+}
+
+// loadConfig reads the configuration file, merging it with the default configuration and validating it.
+func (r *relay) loadConfig() (*config.Config, error) {
+	userConfig, err := config.LoadConfig(r.configPath)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", relayerrors.ErrInvalidConfig, err)
+	}
+	mergedConfig := config.MergeWithDefaultConfig(r.defaultConfig, userConfig, enableDebug, r.logger)
+	if err := mergedConfig.Validate(); err != nil {
+		return nil, fmt.Errorf("%w: %w", relayerrors.ErrInvalidConfig, err)
+	}
+	return mergedConfig, nil
+}
+
+// apply shuts down the running servers and polling, if any, and starts them again with the given configuration.
+// The relay can't serve requests if the servers fail to start, so it exits.
+func (r *relay) apply(newConfig *config.Config) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.servers != nil {
+		proxy.ShutdownServer(r.servers, r.logger)
+	}
+	if r.config != nil && r.config.Polling.Enabled {
+		r.stopPolling <- true
+	}
+
+	servers, err := startup(newConfig, r.logger, r.systemCache, r.stopPolling, r.reloadFromAPI)
+	if err != nil {
+		r.logger.Error(err.Error())
+		os.Exit(1)
+	}
+	r.config = newConfig
+	r.servers = servers
+}
+
+// reloadable returns an error if the configuration can't be reloaded, as standard input can only be read once.
+func (r *relay) reloadable() error {
+	if config.IsStdinPath(r.configPath) {
+		return fmt.Errorf("%w: a configuration read from standard input can't be reloaded", relayerrors.ErrInvalidConfig)
+	}
+	return nil
+}
+
+// reload reloads the configuration file and applies it. An invalid configuration is rejected, keeping the current one.
+func (r *relay) reload() (*config.Config, error) {
+	if err := r.reloadable(); err != nil {
+		return nil, err
+	}
+	newConfig, err := r.loadConfig()
+	if err != nil {
+		return nil, err
+	}
+	r.apply(newConfig)
+	return newConfig, nil
+}
+
+// reloadFromAPI reloads the configuration file for the management API. The configuration is validated immediately, but applied in the background,
+// as applying it shuts down the server handling the management API request, which waits for the request to complete.
+func (r *relay) reloadFromAPI() (*config.Config, error) {
+	if err := r.reloadable(); err != nil {
+		return nil, err
+	}
+	newConfig, err := r.loadConfig()
+	if err != nil {
+		return nil, err
+	}
+	r.logger.Info("Reloading configuration from the management API")
+	go r.apply(newConfig)
+	return newConfig, nil
+}
+
+// shutdown shuts down the running servers.
+func (r *relay) shutdown() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	proxy.ShutdownServer(r.servers, r.logger)
+	r.servers = nil
+}
+
+func startup(userConfig *config.Config, logger *slog.Logger, systemCache cache.Cache, stopPolling chan bool, reloadConfig func() (*config.Config, error)) ([]*http.Server, error) {
+	// Write the audit trail of upstream requests to its own file, separate from the operational logs
+	if err := audit.Configure(userConfig.Audit); err != nil {
+		return nil, err
+	}
+
+	// Initialize the uplink URL selector for the configured strategy.
+	selector := uplink.NewSelector(userConfig.Uplink.Strategy, userConfig.Uplink.URLs)
+
+	// Configure the HTTP client with the uplink timeouts, which the reverse proxy also uses to connect to uplink.
+	httpClient := util.NewHTTPClient(userConfig)
+
+	reportConfigWarnings(userConfig, logger)
+
+	// Generate cache keys with the configured version, so entries cached with another version are ignored
+	cache.SetKeyVersion(userConfig.Cache.KeyVersion)
+	// Keep the configured number of previous versions of each artifact
+	cache.SetHistoryDepth(userConfig.Cache.HistoryDepth)
+	// Encode cached items in the configured format. Items are read in either format, so it can be switched at any time.
+	cache.SetGobEncoding(userConfig.Cache.SerializationFormat == config.SerializationFormatGob)
 
 	proxy.DeregisterHandlers()
 	// Set up the main request handler
-	proxy.RegisterHandlers("/*", proxy.RelayHandler(userConfig, systemCache, rrSelector, httpClient, logger))
-	proxy.RegisterHandlers("/persisted-queries/*", persistedqueries.PersistedQueryHandler(logger, httpClient, systemCache))
+	proxy.RegisterRelayHandler(userConfig.Relay.Path, proxy.ClientAllowlistHandler(userConfig.Relay, logger, proxy.CORSHandler(userConfig.Relay.CORS, []string{http.MethodPost}, proxy.RelayHandler(userConfig, systemCache, selector, httpClient, logger))))
+	proxy.RegisterHandlers("/persisted-queries/", proxy.ClientAllowlistHandler(userConfig.Relay, logger, proxy.CORSHandler(userConfig.Relay.CORS, []string{http.MethodGet, http.MethodHead}, persistedqueries.PersistedQueryHandler(logger, httpClient, systemCache))))
+	proxy.RegisterHandlers("/version", version.Handler())
+	proxy.RegisterHandlers("/livez", proxy.LivenessHandler())
+	proxy.RegisterHandlers("/readyz", proxy.ReadinessHandler(logger, func() error { return checkReadiness(userConfig, systemCache) }))
 	// Set up the webhook handler if enabled
 	if userConfig.Webhook.Enabled {
 		proxy.RegisterHandlers(userConfig.Webhook.Path, webhooks.WebhookHandler(userConfig, systemCache, httpClient, logger))
@@ -184,12 +334,70 @@ func startup(userConfig *config.Config, logger *slog.Logger, systemCache cache.C
 		go polling.StartPolling(userConfig, systemCache, httpClient, logger, stopPolling)
 	}
 
+	pinSupergraphs(userConfig, logger, systemCache)
+	if userConfig.ManagementAPI.Enabled {
+		metrics.CacheHitRates.SetWindow(time.Duration(userConfig.ManagementAPI.StatsWindow) * time.Second)
+		logger.Info("Management API enabled", "path", userConfig.ManagementAPI.Path)
+		graphqlHandler := handler.NewDefaultServer(graph.NewExecutableSchema(graph.Config{Resolvers: &graph.Resolver{}}))
+		graphqlHandler.SetErrorPresenter(graph.ErrorPresenter)
+		// Shared across requests, so repeated currentConfiguration queries don't re-read every cache entry
+		var configDetails *graph.ConfigDetailsCache
+		if userConfig.ManagementAPI.CacheDuration > 0 {
+			configDetails = graph.NewConfigDetailsCache(time.Duration(userConfig.ManagementAPI.CacheDuration) * time.Second)
+		}
+		// Shared across requests, so automation calling the mutations in a loop can't exhaust Apollo's API quota
+		var cooldown *graph.MutationCooldown
+		if userConfig.ManagementAPI.Cooldown > 0 {
+			cooldown = graph.NewMutationCooldown(time.Duration(userConfig.ManagementAPI.Cooldown) * time.Second)
+		}
+		logger.Info("Starting management API", "path", userConfig.ManagementAPI.Path, "address", userConfig.ManagementAPI.Address)
+		proxy.RegisterHandlersOn(userConfig, userConfig.ManagementAPI.Address, userConfig.ManagementAPI.Path, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+			w.Header().Set("Access-Control-Allow-Headers", "*")
+			resolverContext := &graph.ResolverContext{
+				Logger:        logger,
+				SystemCache:   systemCache,
+				UserConfig:    userConfig,
+				ConfigDetails: configDetails,
+				Authorized:    graph.RequestAuthorized(r, userConfig.ManagementAPI.Secret),
+				ReloadConfig:  reloadConfig,
+				CacheHitRates: metrics.CacheHitRates,
+				Cooldown:      cooldown,
+			}
+			ctx := context.WithValue(r.Context(), graph.ResolverKey, resolverContext)
+			graphqlHandler.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+	if userConfig.Metrics.Enabled {
+		logger.Info("Metrics enabled", "path", userConfig.Metrics.Path, "address", userConfig.Metrics.Address)
+		metrics.DefaultRegistry.SetCollectors(
+			func() { collectCacheItemAges(userConfig, systemCache) },
+			func() { metrics.CollectNextPoll(time.Now()) },
+		)
+		proxy.RegisterHandlersOn(userConfig, userConfig.Metrics.Address, userConfig.Metrics.Path, metrics.Handler(metrics.DefaultRegistry))
+	}
+	// Start the servers and log their addresses.
+	servers, err := proxy.StartServer(userConfig, logger)
+	if err != nil {
+		logger.Error(err.Error())
+		return nil, err
+	}
+
+	return servers, nil
+}
+
+// pinSupergraphs caches the pinned launch, offline license and persisted query version of each supergraph.
+func pinSupergraphs(userConfig *config.Config, logger *slog.Logger, systemCache cache.Cache) {
+	// Pins that are already cached are kept, rather than fetched from Studio again on every reload
+	skipUnchanged := userConfig.Uplink.SkipUnchangedPins && userConfig.Cache.Enabled
 	for _, supergraph := range userConfig.Supergraphs {
-		if supergraph.LaunchID != "" {
+		if supergraph.LaunchID != "" && skipUnchanged && pinning.IsLaunchIDCached(systemCache, supergraph.GraphRef, supergraph.LaunchID) {
+			logger.Info("Launch ID already pinned, skipping", "graphRef", supergraph.GraphRef, "launchID", supergraph.LaunchID)
+		} else if supergraph.LaunchID != "" {
 			logger.Debug("Pinning launch ID", "graphRef", supergraph.GraphRef, "launchID", supergraph.LaunchID)
 			err := pinning.PinLaunchID(userConfig, logger, systemCache, supergraph.LaunchID, supergraph.GraphRef)
 			if err != nil {
-				logger.Error("Failed to pin launch ID", "graphRef", supergraph.GraphRef, "launchID", supergraph.LaunchID)
+				logger.Error("Failed to pin launch ID", "graphRef", supergraph.GraphRef, "launchID", supergraph.LaunchID, "err", err)
 			}
 		}
 		if supergraph.OfflineLicense != "" {
@@ -199,36 +407,120 @@ func startup(userConfig *config.Config, logger *slog.Logger, systemCache cache.C
 				logger.Error("Failed to pin offline license", "graphRef", supergraph.GraphRef)
 			}
 		}
-		if supergraph.PersistedQueryVersion != "" {
+		if supergraph.PersistedQueryVersion != "" && skipUnchanged && pinning.IsPersistedQueryVersionCached(systemCache, supergraph.GraphRef, supergraph.PersistedQueryVersion) {
+			logger.Info("Persisted query version already pinned, skipping", "graphRef", supergraph.GraphRef, "version", supergraph.PersistedQueryVersion)
+		} else if supergraph.PersistedQueryVersion != "" {
 			logger.Debug("Pinning persisted queries", "graphRef", supergraph.GraphRef, "version", supergraph.PersistedQueryVersion)
 			err := pinning.PinPersistedQueries(userConfig, logger, systemCache, supergraph.GraphRef, supergraph.PersistedQueryVersion)
 			if err != nil {
-				logger.Error("Failed to pin persisted queries", "graphRef", supergraph.GraphRef, "version", supergraph.PersistedQueryVersion)
+				logger.Error("Failed to pin persisted queries", "graphRef", supergraph.GraphRef, "version", supergraph.PersistedQueryVersion, "err", err)
 			}
 		}
 	}
-	if userConfig.ManagementAPI.Enabled {
-		logger.Info("Management API enabled", "path", userConfig.ManagementAPI.Path)
-		graphqlHandler := handler.NewDefaultServer(graph.NewExecutableSchema(graph.Config{Resolvers: &graph.Resolver{}}))
-		logger.Info("Starting management API", "path", userConfig.ManagementAPI.Path)
-		proxy.RegisterHandlers(userConfig.ManagementAPI.Path, func(w http.ResponseWriter, r *http.Request) {
-			w.Header().Set("Access-Control-Allow-Origin", "*")
-			w.Header().Set("Access-Control-Allow-Headers", "*")
-			resolverContext := &graph.ResolverContext{
-				Logger:      logger,
-				SystemCache: systemCache,
-				UserConfig:  userConfig,
-			}
-			ctx := context.WithValue(context.Background(), graph.ResolverKey, resolverContext)
-			graphqlHandler.ServeHTTP(w, r.WithContext(ctx))
-		})
+}
+
+// verifyAPIKeys checks the API key of every configured supergraph, logging the result for each graph.
+// It returns an error if any key fails verification.
+func verifyAPIKeys(userConfig *config.Config, logger *slog.Logger) error {
+	failed := 0
+	for _, supergraph := range userConfig.Supergraphs {
+		apiKey, err := supergraph.APIKey(userConfig.Uplink.DefaultApolloKey)
+		if err != nil {
+			logger.Error("API key verification failed", "graphRef", supergraph.GraphRef, "err", err)
+			failed++
+			continue
+		}
+		if err := entitlements.VerifyAPIKey(context.Background(), userConfig, logger, supergraph.GraphRef, apiKey); err != nil {
+			logger.Error("API key verification failed", "graphRef", supergraph.GraphRef, "err", err)
+			failed++
+			continue
+		}
+		logger.Info("API key verified", "graphRef", supergraph.GraphRef)
 	}
-	// Start the server and log its address.
-	server, err := proxy.StartServer(userConfig, logger)
-	if err != nil {
-		logger.Error(err.Error())
-		return nil, err
+	if failed > 0 {
+		return fmt.Errorf("%d of %d API keys failed verification", failed, len(userConfig.Supergraphs))
 	}
+	return nil
+}
+
+// reportConfigWarnings logs each warning about the configuration, and exposes them with the config warnings gauge.
+// The gauge is reset first, so warnings fixed by a reload are cleared.
+func reportConfigWarnings(userConfig *config.Config, logger *slog.Logger) {
+	metrics.ConfigWarnings.Reset()
+	for _, warning := range userConfig.Warnings() {
+		logger.Warn("Configuration warning", "warning", warning.Code, "message", warning.Message)
+		metrics.ConfigWarnings.Set(1, warning.Code)
+	}
+}
+
+// readinessProbeDuration is how long the readiness probe entry is cached for, in seconds; it's only written again once it expires.
+const readinessProbeDuration = 300
 
-	return server, nil
+// readinessProbeKey returns the cache key read by readiness checks to tell whether any cache backend is reachable, when no supergraph is read.
+// Graph refs can't contain an @ once parsed, so it never shares a prefix with a graph's entries.
+func readinessProbeKey() string {
+	return cache.KeyPrefix() + "@readiness"
+}
+
+// checkReadiness returns an error if the relay can't serve traffic yet: the supergraph of every pinned or polled graph must be cached,
+// and at least one cache backend must be reachable. Without caching, requests are proxied to uplink, so the relay is always ready.
+func checkReadiness(userConfig *config.Config, systemCache cache.Cache) error {
+	if !userConfig.Cache.Enabled {
+		return nil
+	}
+	pollsSupergraphs := userConfig.Polling.Enabled && (userConfig.Polling.Supergraph == nil || *userConfig.Polling.Supergraph) && userConfig.Cache.OperationEnabled(uplink.SupergraphQuery)
+	readSupergraph := false
+	for _, supergraph := range userConfig.Supergraphs {
+		var supergraphKey string
+		if supergraph.LaunchID != "" {
+			supergraphKey = cache.MakeCacheKey(supergraph.GraphRef, pinning.SupergraphPinned)
+		} else if pollsSupergraphs {
+			supergraphKey = cache.DefaultCacheKey(supergraph.GraphRef, uplink.SupergraphQuery)
+		} else {
+			continue
+		}
+		if _, ok := systemCache.Get(supergraphKey); !ok {
+			return fmt.Errorf("the supergraph of %s isn't cached yet", supergraph.GraphRef)
+		}
+		readSupergraph = true
+	}
+
+	// Reading a supergraph shows a cache backend is reachable; otherwise the probe entry is read, and only written when it's missing, so probes don't write every time.
+	// It's read back rather than relying on the write's error, as the tiered cache reports a failing backend even if another one was written.
+	if readSupergraph {
+		return nil
+	}
+	if _, ok := systemCache.Get(readinessProbeKey()); ok {
+		return nil
+	}
+	systemCache.Set(readinessProbeKey(), "ready", readinessProbeDuration)
+	if _, ok := systemCache.Get(readinessProbeKey()); !ok {
+		return fmt.Errorf("no cache backend is reachable")
+	}
+	return nil
+}
+
+// collectCacheItemAges updates the cache item age gauge for every artifact of the configured supergraphs, preferring pinned entries.
+func collectCacheItemAges(userConfig *config.Config, systemCache cache.Cache) {
+	metrics.CacheItemAge.Reset()
+	now := time.Now()
+	for _, supergraph := range userConfig.Supergraphs {
+		supergraphKey := cache.DefaultCacheKey(supergraph.GraphRef, uplink.SupergraphQuery)
+		if supergraph.LaunchID != "" {
+			supergraphKey = cache.MakeCacheKey(supergraph.GraphRef, pinning.SupergraphPinned)
+		}
+		cache.RecordItemAge(systemCache, supergraph.GraphRef, "supergraph", supergraphKey, now)
+
+		entitlementKey := cache.DefaultCacheKey(supergraph.GraphRef, uplink.LicenseQuery)
+		if supergraph.OfflineLicense != "" {
+			entitlementKey = cache.MakeCacheKey(supergraph.GraphRef, pinning.LicensePinned)
+		}
+		cache.RecordItemAge(systemCache, supergraph.GraphRef, "entitlement", entitlementKey, now)
+
+		persistedQueryKey := cache.DefaultCacheKey(supergraph.GraphRef, uplink.PersistedQueriesQuery)
+		if supergraph.PersistedQueryVersion != "" {
+			persistedQueryKey = cache.MakeCacheKey(supergraph.GraphRef, pinning.PersistedQueriesPinned)
+		}
+		cache.RecordItemAge(systemCache, supergraph.GraphRef, "persistedQueries", persistedQueryKey, now)
+	}
 }
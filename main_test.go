@@ -0,0 +1,287 @@
+package main
+
+import (
+	"apollosolutions/uplink-relay/cache"
+	"apollosolutions/uplink-relay/config"
+	"apollosolutions/uplink-relay/internal/relayerrors"
+	"apollosolutions/uplink-relay/logger"
+	"apollosolutions/uplink-relay/metrics"
+	"apollosolutions/uplink-relay/pinning"
+	"apollosolutions/uplink-relay/uplink"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const reloadTestConfig = `
+relay:
+  address: 127.0.0.1:0
+uplink:
+  retryCount: 1
+cache:
+  duration: %s
+managementAPI:
+  enabled: true
+  secret: s3cret
+polling:
+  enabled: false
+supergraphs:
+  - graphRef: %s
+    apolloKey: service:graph:1234
+`
+
+func TestReloadConfigMutation(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "config.yml")
+	writeConfig := func(duration string, graphRef string) {
+		content := []byte(fmt.Sprintf(reloadTestConfig, duration, graphRef))
+		if err := os.WriteFile(configPath, content, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeConfig("60", "graph@one")
+
+	pFalse := false
+	relay := newRelay(configPath, config.NewDefaultConfig(), logger.MakeLogger(&pFalse), cache.NewMemoryCache(100))
+	initialConfig, err := relay.loadConfig()
+	if err != nil {
+		t.Fatalf("Failed to load the configuration: %v", err)
+	}
+	relay.apply(initialConfig)
+	defer relay.shutdown()
+
+	type reloadResponse struct {
+		Data struct {
+			ReloadConfig struct {
+				Configuration struct {
+					Supergraphs []struct {
+						GraphRef string `json:"graphRef"`
+					} `json:"supergraphs"`
+				} `json:"configuration"`
+			} `json:"reloadConfig"`
+		} `json:"data"`
+		Errors []struct {
+			Extensions map[string]interface{} `json:"extensions"`
+		} `json:"errors"`
+	}
+	reloadConfig := func(secret string) reloadResponse {
+		relay.mu.Lock()
+		url := "http://" + relay.servers[0].Addr + "/graphql"
+		relay.mu.Unlock()
+		body, _ := json.Marshal(map[string]string{"query": "mutation { reloadConfig { configuration { supergraphs { graphRef } } } }"})
+		req, _ := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+secret)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Failed to reload the configuration: %v", err)
+		}
+		defer resp.Body.Close()
+		var response reloadResponse
+		if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+			t.Fatalf("Failed to decode the response: %v", err)
+		}
+		return response
+	}
+	currentGraphRef := func() string {
+		relay.mu.Lock()
+		defer relay.mu.Unlock()
+		return relay.config.Supergraphs[0].GraphRef
+	}
+	expectError := func(response reloadResponse, code string) {
+		t.Helper()
+		if len(response.Errors) != 1 || response.Errors[0].Extensions["code"] != code {
+			t.Errorf("Expected a %s error, got %+v", code, response.Errors)
+		}
+	}
+
+	// Reloading requires the management API secret
+	writeConfig("60", "graph@two")
+	expectError(reloadConfig("wrong"), "UNAUTHORIZED")
+
+	// An invalid configuration is rejected, keeping the current one
+	writeConfig("-5", "graph@two")
+	expectError(reloadConfig("s3cret"), "INVALID_CONFIG")
+	if graphRef := currentGraphRef(); graphRef != "graph@one" {
+		t.Errorf("Expected the current configuration to be kept, got %s", graphRef)
+	}
+
+	// A valid configuration is returned and applied
+	writeConfig("60", "graph@two")
+	response := reloadConfig("s3cret")
+	if len(response.Errors) > 0 {
+		t.Fatalf("Expected the configuration to be reloaded, got %+v", response.Errors)
+	}
+	if supergraphs := response.Data.ReloadConfig.Configuration.Supergraphs; len(supergraphs) != 1 || supergraphs[0].GraphRef != "graph@two" {
+		t.Errorf("Expected the new configuration in the response, got %+v", supergraphs)
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for currentGraphRef() != "graph@two" {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the new configuration to be applied")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestReloadFromStdinUnsupported(t *testing.T) {
+	pFalse := false
+	relay := newRelay(config.StdinConfigPath, config.NewDefaultConfig(), logger.MakeLogger(&pFalse), cache.NewMemoryCache(100))
+	if _, err := relay.reload(); !errors.Is(err, relayerrors.ErrInvalidConfig) {
+		t.Errorf("Expected reloading a configuration read from stdin to be rejected, got %v", err)
+	}
+	if _, err := relay.reloadFromAPI(); !errors.Is(err, relayerrors.ErrInvalidConfig) {
+		t.Errorf("Expected reloading a configuration read from stdin from the management API to be rejected, got %v", err)
+	}
+}
+
+func TestPinSupergraphsSkipsUnchangedPins(t *testing.T) {
+	// Mock the Studio API, counting the requests for each pinned artifact
+	var launchRequests, persistedQueryRequests int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request pinning.PinningAPIRequest
+		json.NewDecoder(r.Body).Decode(&request)
+		if request.OperationName == "UplinkRelay_GetLaunchIDSchema" {
+			launchRequests++
+			w.Write([]byte(`{"data":{"graph":{"variant":{"id":"graph@current","launch":{"completedAt":"2024-08-05T19:53:30.358994000Z","build":{"result":{"__typename":"BuildSuccess","coreSchema":{"coreDocument":"sampleSchema"}}}}}}}}`))
+			return
+		}
+		persistedQueryRequests++
+		w.Write([]byte(`{"data":{"variant":{"__typename":"GraphVariant","persistedQueryList":{"builds":{"pageInfo":{"hasNextPage":false,"endCursor":""},"edges":[{"node":{"id":"build-1","manifestChunks":[{"id":"chunk-1","json":"{}"}]}},{"node":{"id":"build-2","manifestChunks":[{"id":"chunk-2","json":"{}"}]}}]}}}}}`))
+	}))
+	defer server.Close()
+
+	userConfig := config.NewDefaultConfig()
+	userConfig.Uplink.StudioAPIURL = server.URL
+	userConfig.Uplink.SkipUnchangedPins = true
+	userConfig.Relay.PublicURL = "http://localhost:8080"
+	userConfig.Supergraphs = []config.SupergraphConfig{{
+		GraphRef:              "graph@current",
+		ApolloKey:             "service:graph:1234",
+		LaunchID:              "launch-1",
+		PersistedQueryVersion: "build-1",
+	}}
+	pFalse := false
+	log := logger.MakeLogger(&pFalse)
+	systemCache := cache.NewMemoryCache(100)
+
+	pinSupergraphs(userConfig, log, systemCache)
+	if launchRequests != 1 || persistedQueryRequests != 1 {
+		t.Fatalf("Expected the pins to be fetched once, got %d launch and %d persisted query requests", launchRequests, persistedQueryRequests)
+	}
+
+	// Reloading with the same pins doesn't fetch them again
+	pinSupergraphs(userConfig, log, systemCache)
+	if launchRequests != 1 || persistedQueryRequests != 1 {
+		t.Errorf("Expected unchanged pins not to be fetched again, got %d launch and %d persisted query requests", launchRequests, persistedQueryRequests)
+	}
+
+	// Changed pins are fetched
+	userConfig.Supergraphs[0].LaunchID = "launch-2"
+	userConfig.Supergraphs[0].PersistedQueryVersion = "build-2"
+	pinSupergraphs(userConfig, log, systemCache)
+	if launchRequests != 2 || persistedQueryRequests != 2 {
+		t.Errorf("Expected changed pins to be fetched, got %d launch and %d persisted query requests", launchRequests, persistedQueryRequests)
+	}
+
+	// Without the option, every pin is fetched again
+	userConfig.Uplink.SkipUnchangedPins = false
+	pinSupergraphs(userConfig, log, systemCache)
+	if launchRequests != 3 || persistedQueryRequests != 3 {
+		t.Errorf("Expected pins to be fetched again, got %d launch and %d persisted query requests", launchRequests, persistedQueryRequests)
+	}
+}
+
+func TestReportConfigWarnings(t *testing.T) {
+	userConfig := config.NewDefaultConfig()
+	userConfig.Cache.Duration = -1
+	userConfig.Polling.Enabled = true
+
+	var logs bytes.Buffer
+	testLogger := slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelWarn}))
+	reportConfigWarnings(userConfig, testLogger)
+
+	if !strings.Contains(logs.String(), config.WarningIndefiniteCacheWithPolling) {
+		t.Errorf("Expected the warning to be logged, got %s", logs.String())
+	}
+	if value, ok := metrics.ConfigWarnings.Get(config.WarningIndefiniteCacheWithPolling); !ok || value != 1 {
+		t.Errorf("Expected the config warnings gauge to be set, got %v", value)
+	}
+
+	// Fixing the configuration clears the warning on the next reload
+	userConfig.Cache.Duration = 300
+	reportConfigWarnings(userConfig, testLogger)
+	if _, ok := metrics.ConfigWarnings.Get(config.WarningIndefiniteCacheWithPolling); ok {
+		t.Errorf("Expected the config warnings gauge to be cleared")
+	}
+}
+
+// unreachableCache is a cache backend that can't be reached, failing every read and write.
+type unreachableCache struct {
+	cache.Cache
+}
+
+func (c unreachableCache) Get(key string) ([]byte, bool) {
+	return nil, false
+}
+
+func (c unreachableCache) Set(key string, content string, duration int) error {
+	return fmt.Errorf("connection refused")
+}
+
+func TestCheckReadiness(t *testing.T) {
+	userConfig := config.NewDefaultConfig()
+	userConfig.Polling.Enabled = true
+	userConfig.Supergraphs = []config.SupergraphConfig{{GraphRef: "graph@current", ApolloKey: "service:graph:1234"}}
+	systemCache := cache.NewMemoryCache(100)
+
+	// The caches aren't warm until the polled supergraph is cached
+	if err := checkReadiness(userConfig, systemCache); err == nil {
+		t.Errorf("Expected the relay not to be ready before the supergraph is cached")
+	}
+	systemCache.Set(cache.DefaultCacheKey("graph@current", uplink.SupergraphQuery), `{"content":"c2NoZW1h"}`, -1)
+	if err := checkReadiness(userConfig, systemCache); err != nil {
+		t.Errorf("Expected the relay to be ready once the supergraph is cached, got %v", err)
+	}
+
+	// Without polling, nothing warms the cache before routers request it
+	userConfig.Polling.Enabled = false
+	if err := checkReadiness(userConfig, cache.NewMemoryCache(100)); err != nil {
+		t.Errorf("Expected the relay to be ready without polling, got %v", err)
+	}
+
+	// At least one cache backend must be reachable
+	if err := checkReadiness(userConfig, unreachableCache{}); err == nil {
+		t.Errorf("Expected the relay not to be ready without a reachable cache backend")
+	}
+
+	// Probes don't write to the cache each time they check it
+	writes := &countingWritesCache{Cache: cache.NewMemoryCache(100)}
+	for i := 0; i < 10; i++ {
+		if err := checkReadiness(userConfig, writes); err != nil {
+			t.Fatalf("Expected the relay to be ready, got %v", err)
+		}
+	}
+	if writes.sets != 1 {
+		t.Errorf("Expected the probe entry to be written once, got %d writes", writes.sets)
+	}
+}
+
+// countingWritesCache counts the writes to the cache it wraps.
+type countingWritesCache struct {
+	cache.Cache
+	sets int
+}
+
+func (c *countingWritesCache) Set(key string, content string, duration int) error {
+	c.sets++
+	return c.Cache.Set(key, content, duration)
+}
@@ -0,0 +1,159 @@
+package metrics
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// HitRateWindow is a concurrency-safe collector of cache hits and misses over a sliding window.
+// It keeps a ring buffer with one bucket per second, so old counts expire without a background goroutine.
+type HitRateWindow struct {
+	mu      sync.Mutex
+	buckets []hitRateBucket
+}
+
+type hitRateBucket struct {
+	second int64
+	counts map[hitRateKey]*HitRate
+}
+
+type hitRateKey struct {
+	graphRef  string
+	operation string
+}
+
+// HitRate is the number of cache hits and misses for a graph, an operation, or both.
+type HitRate struct {
+	Name   string
+	Hits   int
+	Misses int
+}
+
+// Ratio returns the share of requests served from the cache, or 0 if there were no requests.
+func (h HitRate) Ratio() float64 {
+	total := h.Hits + h.Misses
+	if total == 0 {
+		return 0
+	}
+	return float64(h.Hits) / float64(total)
+}
+
+// HitRateSnapshot is the aggregated hit rates within the window.
+type HitRateSnapshot struct {
+	Window     time.Duration
+	Total      HitRate
+	Operations []HitRate // Sorted by operation name.
+	Graphs     []HitRate // Sorted by graph ref.
+}
+
+// NewHitRateWindow creates a new HitRateWindow covering the given duration, rounded up to whole seconds.
+func NewHitRateWindow(window time.Duration) *HitRateWindow {
+	h := &HitRateWindow{}
+	h.SetWindow(window)
+	return h
+}
+
+// SetWindow changes the duration covered by the window. Changing it discards the recorded hits and misses.
+func (h *HitRateWindow) SetWindow(window time.Duration) {
+	size := int((window + time.Second - 1) / time.Second)
+	if size < 1 {
+		size = 1
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.buckets) != size {
+		h.buckets = make([]hitRateBucket, size)
+	}
+}
+
+// Window returns the duration covered by the window.
+func (h *HitRateWindow) Window() time.Duration {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return time.Duration(len(h.buckets)) * time.Second
+}
+
+// Record records a cache hit or miss for the given graph and operation at the given time.
+func (h *HitRateWindow) Record(graphRef string, operation string, hit bool, now time.Time) {
+	second := now.Unix()
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	bucket := &h.buckets[second%int64(len(h.buckets))]
+	// The bucket already holds a later second, so this sample is older than the window and is dropped rather than discarding newer counts
+	if bucket.second > second {
+		return
+	}
+	// The bucket was last used a full window ago, so its counts have expired
+	if bucket.second != second || bucket.counts == nil {
+		bucket.second = second
+		bucket.counts = make(map[hitRateKey]*HitRate)
+	}
+
+	key := hitRateKey{graphRef: graphRef, operation: operation}
+	count, ok := bucket.counts[key]
+	if !ok {
+		count = &HitRate{}
+		bucket.counts[key] = count
+	}
+	if hit {
+		count.Hits++
+	} else {
+		count.Misses++
+	}
+}
+
+// Snapshot aggregates the hits and misses recorded within the window ending at the given time, per operation and per graph.
+func (h *HitRateWindow) Snapshot(now time.Time) HitRateSnapshot {
+	second := now.Unix()
+	operations := map[string]*HitRate{}
+	graphs := map[string]*HitRate{}
+
+	h.mu.Lock()
+	snapshot := HitRateSnapshot{Window: time.Duration(len(h.buckets)) * time.Second}
+	oldest := second - int64(len(h.buckets))
+	for _, bucket := range h.buckets {
+		if bucket.second <= oldest || bucket.second > second {
+			continue
+		}
+		for key, count := range bucket.counts {
+			addHitRate(operations, key.operation, count)
+			addHitRate(graphs, key.graphRef, count)
+			snapshot.Total.Hits += count.Hits
+			snapshot.Total.Misses += count.Misses
+		}
+	}
+	h.mu.Unlock()
+
+	snapshot.Operations = sortedHitRates(operations)
+	snapshot.Graphs = sortedHitRates(graphs)
+	return snapshot
+}
+
+// Reset discards the recorded hits and misses.
+func (h *HitRateWindow) Reset() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.buckets = make([]hitRateBucket, len(h.buckets))
+}
+
+func addHitRate(rates map[string]*HitRate, name string, count *HitRate) {
+	rate, ok := rates[name]
+	if !ok {
+		rate = &HitRate{Name: name}
+		rates[name] = rate
+	}
+	rate.Hits += count.Hits
+	rate.Misses += count.Misses
+}
+
+func sortedHitRates(rates map[string]*HitRate) []HitRate {
+	sorted := make([]HitRate, 0, len(rates))
+	for _, rate := range rates {
+		sorted = append(sorted, *rate)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Name < sorted[j].Name })
+	return sorted
+}
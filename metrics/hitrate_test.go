@@ -0,0 +1,148 @@
+package metrics
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestHitRateWindow(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	window := NewHitRateWindow(time.Minute)
+
+	// 3 hits and 1 miss for the supergraph, and 1 hit and 3 misses for the license, spread over two graphs
+	sequence := []struct {
+		graphRef  string
+		operation string
+		hit       bool
+	}{
+		{"graph@a", "SupergraphSdlQuery", false},
+		{"graph@a", "SupergraphSdlQuery", true},
+		{"graph@b", "SupergraphSdlQuery", true},
+		{"graph@b", "SupergraphSdlQuery", true},
+		{"graph@a", "LicenseQuery", false},
+		{"graph@a", "LicenseQuery", true},
+		{"graph@b", "LicenseQuery", false},
+		{"graph@b", "LicenseQuery", false},
+	}
+	for i, s := range sequence {
+		window.Record(s.graphRef, s.operation, s.hit, now.Add(time.Duration(i)*time.Second))
+	}
+
+	snapshot := window.Snapshot(now.Add(10 * time.Second))
+	if snapshot.Window != time.Minute {
+		t.Errorf("Expected a window of 1m, got %v", snapshot.Window)
+	}
+	if snapshot.Total.Hits != 4 || snapshot.Total.Misses != 4 || snapshot.Total.Ratio() != 0.5 {
+		t.Errorf("Expected 4 hits and 4 misses in total, got %+v", snapshot.Total)
+	}
+
+	expectedOperations := []HitRate{
+		{Name: "LicenseQuery", Hits: 1, Misses: 3},
+		{Name: "SupergraphSdlQuery", Hits: 3, Misses: 1},
+	}
+	assertHitRates(t, snapshot.Operations, expectedOperations)
+	if ratio := snapshot.Operations[1].Ratio(); ratio != 0.75 {
+		t.Errorf("Expected a supergraph hit rate of 0.75, got %v", ratio)
+	}
+
+	expectedGraphs := []HitRate{
+		{Name: "graph@a", Hits: 2, Misses: 2},
+		{Name: "graph@b", Hits: 2, Misses: 2},
+	}
+	assertHitRates(t, snapshot.Graphs, expectedGraphs)
+}
+
+func TestHitRateWindowExpires(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	window := NewHitRateWindow(10 * time.Second)
+
+	window.Record("graph@a", "SupergraphSdlQuery", false, now)
+	window.Record("graph@a", "SupergraphSdlQuery", true, now.Add(5*time.Second))
+
+	// The miss is still within the window
+	if total := window.Snapshot(now.Add(9 * time.Second)).Total; total.Hits != 1 || total.Misses != 1 {
+		t.Errorf("Expected 1 hit and 1 miss, got %+v", total)
+	}
+	// The miss has left the window, but the hit hasn't
+	if total := window.Snapshot(now.Add(10 * time.Second)).Total; total.Hits != 1 || total.Misses != 0 {
+		t.Errorf("Expected only the hit, got %+v", total)
+	}
+
+	// Recording into a reused bucket discards its expired counts
+	window.Record("graph@a", "SupergraphSdlQuery", true, now.Add(20*time.Second))
+	if total := window.Snapshot(now.Add(20 * time.Second)).Total; total.Hits != 1 || total.Misses != 0 {
+		t.Errorf("Expected only the latest hit, got %+v", total)
+	}
+
+	// Nothing recorded within the window has a hit rate of 0
+	snapshot := window.Snapshot(now.Add(time.Hour))
+	if snapshot.Total.Ratio() != 0 || len(snapshot.Operations) != 0 || len(snapshot.Graphs) != 0 {
+		t.Errorf("Expected an empty snapshot, got %+v", snapshot)
+	}
+}
+
+func TestHitRateWindowOutOfOrder(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	window := NewHitRateWindow(10 * time.Second)
+
+	// A sample a full window older maps to the same bucket, and mustn't discard the newer counts
+	window.Record("graph@a", "SupergraphSdlQuery", true, now)
+	window.Record("graph@a", "SupergraphSdlQuery", false, now.Add(-10*time.Second))
+
+	if total := window.Snapshot(now).Total; total.Hits != 1 || total.Misses != 0 {
+		t.Errorf("Expected only the newer hit, got %+v", total)
+	}
+}
+
+func TestHitRateWindowSetWindow(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	window := NewHitRateWindow(time.Minute)
+	window.Record("graph@a", "SupergraphSdlQuery", true, now)
+
+	// Keeping the same window keeps the counts
+	window.SetWindow(time.Minute)
+	if total := window.Snapshot(now).Total; total.Hits != 1 {
+		t.Errorf("Expected the hit to be kept, got %+v", total)
+	}
+
+	window.SetWindow(5 * time.Minute)
+	if window.Window() != 5*time.Minute {
+		t.Errorf("Expected a window of 5m, got %v", window.Window())
+	}
+	if total := window.Snapshot(now).Total; total.Hits != 0 {
+		t.Errorf("Expected the counts to be discarded, got %+v", total)
+	}
+}
+
+func TestHitRateWindowConcurrent(t *testing.T) {
+	now := time.Now()
+	window := NewHitRateWindow(time.Minute)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func(hit bool) {
+			defer wg.Done()
+			window.Record("graph@a", "SupergraphSdlQuery", hit, now)
+		}(i%4 != 0)
+	}
+	wg.Wait()
+
+	total := window.Snapshot(now).Total
+	if total.Hits != 75 || total.Misses != 25 || total.Ratio() != 0.75 {
+		t.Errorf("Expected 75 hits and 25 misses, got %+v", total)
+	}
+}
+
+func assertHitRates(t *testing.T, actual []HitRate, expected []HitRate) {
+	t.Helper()
+	if len(actual) != len(expected) {
+		t.Fatalf("Expected %d hit rates, got %+v", len(expected), actual)
+	}
+	for i := range expected {
+		if actual[i] != expected[i] {
+			t.Errorf("Expected %+v, got %+v", expected[i], actual[i])
+		}
+	}
+}
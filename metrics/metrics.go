@@ -0,0 +1,256 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const contentType = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+
+// GaugeVec is a gauge partitioned by a fixed set of label names.
+type GaugeVec struct {
+	name   string
+	help   string
+	labels []string
+
+	mu     sync.RWMutex
+	values map[string]sample
+}
+
+type sample struct {
+	labelValues []string
+	value       float64
+}
+
+// NewGaugeVec creates a new GaugeVec with the given name, help text and label names.
+func NewGaugeVec(name string, help string, labels ...string) *GaugeVec {
+	return &GaugeVec{name: name, help: help, labels: labels, values: make(map[string]sample)}
+}
+
+// Set sets the gauge for the given label values.
+func (g *GaugeVec) Set(value float64, labelValues ...string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.values[strings.Join(labelValues, "\xff")] = sample{labelValues: labelValues, value: value}
+}
+
+// Get returns the current gauge value for the given label values.
+func (g *GaugeVec) Get(labelValues ...string) (float64, bool) {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	s, ok := g.values[strings.Join(labelValues, "\xff")]
+	return s.value, ok
+}
+
+// Reset removes all label combinations from the gauge.
+func (g *GaugeVec) Reset() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.values = make(map[string]sample)
+}
+
+// write writes the gauge in the OpenMetrics text format.
+func (g *GaugeVec) write(w io.Writer) {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n", g.name, g.help)
+	fmt.Fprintf(w, "# TYPE %s gauge\n", g.name)
+	writeSamples(w, g.name, g.labels, g.values)
+}
+
+// CounterVec is a monotonically increasing counter partitioned by a fixed set of label names.
+type CounterVec struct {
+	name   string
+	help   string
+	labels []string
+
+	mu     sync.RWMutex
+	values map[string]sample
+}
+
+// NewCounterVec creates a new CounterVec with the given name, help text and label names.
+// The name shouldn't include the _total suffix, which is added to the samples.
+func NewCounterVec(name string, help string, labels ...string) *CounterVec {
+	return &CounterVec{name: name, help: help, labels: labels, values: make(map[string]sample)}
+}
+
+// Inc increments the counter for the given label values.
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := strings.Join(labelValues, "\xff")
+	c.values[key] = sample{labelValues: labelValues, value: c.values[key].value + 1}
+}
+
+// Get returns the current counter value for the given label values.
+func (c *CounterVec) Get(labelValues ...string) (float64, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	s, ok := c.values[strings.Join(labelValues, "\xff")]
+	return s.value, ok
+}
+
+// write writes the counter in the OpenMetrics text format.
+func (c *CounterVec) write(w io.Writer) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n", c.name, c.help)
+	fmt.Fprintf(w, "# TYPE %s counter\n", c.name)
+	writeSamples(w, c.name+"_total", c.labels, c.values)
+}
+
+// writeSamples writes the samples of a metric, sorted by their label values.
+func writeSamples(w io.Writer, name string, labels []string, values map[string]sample) {
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		s := values[k]
+		pairs := make([]string, 0, len(labels))
+		for i, label := range labels {
+			value := ""
+			if i < len(s.labelValues) {
+				value = s.labelValues[i]
+			}
+			pairs = append(pairs, fmt.Sprintf("%s=%s", label, strconv.Quote(value)))
+		}
+		if len(pairs) > 0 {
+			fmt.Fprintf(w, "%s{%s} %s\n", name, strings.Join(pairs, ","), strconv.FormatFloat(s.value, 'f', -1, 64))
+		} else {
+			fmt.Fprintf(w, "%s %s\n", name, strconv.FormatFloat(s.value, 'f', -1, 64))
+		}
+	}
+}
+
+// Metric is a metric that can be registered and written by a Registry.
+type Metric interface {
+	write(w io.Writer)
+}
+
+// Collector is called right before the metrics are written so gauges can be refreshed.
+type Collector func()
+
+// Registry holds the set of metrics exposed by the relay.
+type Registry struct {
+	mu         sync.Mutex
+	metrics    []Metric
+	collectors []Collector
+}
+
+// NewRegistry creates a new empty Registry.
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+// Register adds the given metrics to the registry.
+func (r *Registry) Register(metrics ...Metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.metrics = append(r.metrics, metrics...)
+}
+
+// SetCollectors replaces the collectors run on every scrape. This is done on startup so that reloads don't accumulate collectors.
+func (r *Registry) SetCollectors(collectors ...Collector) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.collectors = collectors
+}
+
+// Write runs the collectors and writes all registered metrics in the OpenMetrics text format.
+func (r *Registry) Write(w io.Writer) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, collect := range r.collectors {
+		collect()
+	}
+	for _, metric := range r.metrics {
+		metric.write(w)
+	}
+	fmt.Fprint(w, "# EOF\n")
+}
+
+// DefaultRegistry is the registry used by the relay's metrics endpoint.
+var DefaultRegistry = NewRegistry()
+
+// CacheItemAge is the age of each cached artifact, in seconds, based on its LastModified time.
+var CacheItemAge = NewGaugeVec("uplink_relay_cache_item_age_seconds", "Age of the cached artifact in seconds.", "graph_ref", "artifact")
+
+// NextPoll is the time until the next scheduled poll for each graph, in seconds.
+var NextPoll = NewGaugeVec("uplink_relay_next_poll_seconds", "Time until the next scheduled poll in seconds.", "graph_ref")
+
+// CacheWriteErrors is the number of failed writes to the cache, e.g. when the Redis backend is down.
+var CacheWriteErrors = NewCounterVec("uplink_relay_cache_write_errors", "Number of failed cache writes.", "artifact")
+
+// RetriesThrottled is the number of failed uplink requests that weren't retried because the retry budget was exhausted.
+var RetriesThrottled = NewCounterVec("uplink_relay_retries_throttled", "Number of uplink retries skipped by the retry budget.", "operation")
+
+// PersistedQueryChunksCached is the number of persisted query chunks cached for the latest manifest of each graph, whether downloaded from uplink or pinned.
+var PersistedQueryChunksCached = NewGaugeVec("uplink_relay_pq_chunks_cached", "Number of persisted query chunks cached for the latest manifest.", "graph_ref")
+
+// PersistedQueryChunkDownloadFailures is the number of persisted query chunks that couldn't be downloaded from uplink.
+var PersistedQueryChunkDownloadFailures = NewCounterVec("uplink_relay_pq_chunk_download_failures", "Number of failed persisted query chunk downloads.", "graph_ref")
+
+// ConnectionsRejected is the number of connections closed as soon as they were accepted because a listener was at its connection limit.
+var ConnectionsRejected = NewCounterVec("uplink_relay_connections_rejected", "Number of connections closed because the listener was at its connection limit.", "address")
+
+// ConfigWarnings is set to 1 for each warning about the current configuration, labelled by the warning's code.
+var ConfigWarnings = NewGaugeVec("uplink_relay_config_warnings", "Set to 1 for each warning about the current configuration.", "warning")
+
+// CacheHitRates is the relay's cache hits and misses over a sliding window, served by the management API's cacheStats query.
+var CacheHitRates = NewHitRateWindow(5 * time.Minute)
+
+var (
+	nextPollMu    sync.Mutex
+	nextPollTimes = map[string]time.Time{}
+)
+
+func init() {
+	DefaultRegistry.Register(CacheItemAge, NextPoll, CacheWriteErrors, RetriesThrottled, PersistedQueryChunksCached, PersistedQueryChunkDownloadFailures, ConnectionsRejected, ConfigWarnings)
+}
+
+// SetNextPoll records when the next poll for the given graph is scheduled.
+func SetNextPoll(graphRef string, next time.Time) {
+	nextPollMu.Lock()
+	defer nextPollMu.Unlock()
+	nextPollTimes[graphRef] = next
+}
+
+// ClearNextPoll removes all scheduled polls, e.g. when polling is stopped.
+func ClearNextPoll() {
+	nextPollMu.Lock()
+	defer nextPollMu.Unlock()
+	nextPollTimes = map[string]time.Time{}
+	NextPoll.Reset()
+}
+
+// CollectNextPoll updates the NextPoll gauge relative to the given time.
+func CollectNextPoll(now time.Time) {
+	nextPollMu.Lock()
+	defer nextPollMu.Unlock()
+	for graphRef, next := range nextPollTimes {
+		until := next.Sub(now).Seconds()
+		if until < 0 {
+			until = 0
+		}
+		NextPoll.Set(until, graphRef)
+	}
+}
+
+// Handler serves the metrics in the given registry.
+func Handler(registry *Registry) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", contentType)
+		registry.Write(w)
+	}
+}
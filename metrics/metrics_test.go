@@ -0,0 +1,97 @@
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGaugeVec(t *testing.T) {
+	gauge := NewGaugeVec("test_gauge", "A test gauge.", "graph_ref")
+
+	gauge.Set(1.5, "graph@variant")
+	value, ok := gauge.Get("graph@variant")
+	if !ok {
+		t.Fatalf("Expected gauge value to be set")
+	}
+	if value != 1.5 {
+		t.Errorf("Expected gauge value 1.5, got %v", value)
+	}
+
+	gauge.Reset()
+	if _, ok := gauge.Get("graph@variant"); ok {
+		t.Errorf("Expected gauge to be reset")
+	}
+}
+
+func TestCollectNextPoll(t *testing.T) {
+	defer ClearNextPoll()
+
+	now := time.Now()
+	SetNextPoll("graph@variant", now.Add(30*time.Second))
+	SetNextPoll("graph@past", now.Add(-30*time.Second))
+	CollectNextPoll(now)
+
+	value, ok := NextPoll.Get("graph@variant")
+	if !ok || value != 30 {
+		t.Errorf("Expected next poll to be 30 seconds, got %v", value)
+	}
+	value, ok = NextPoll.Get("graph@past")
+	if !ok || value != 0 {
+		t.Errorf("Expected next poll in the past to be 0 seconds, got %v", value)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	registry := NewRegistry()
+	gauge := NewGaugeVec("test_gauge", "A test gauge.", "graph_ref", "artifact")
+	registry.Register(gauge)
+	registry.SetCollectors(func() {
+		gauge.Set(42, "graph@variant", "supergraph")
+	})
+
+	rr := httptest.NewRecorder()
+	Handler(registry)(rr, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	if rr.Code != http.StatusOK {
+		t.Errorf("Expected status code 200, got %d", rr.Code)
+	}
+	if !strings.HasPrefix(rr.Header().Get("Content-Type"), "application/openmetrics-text") {
+		t.Errorf("Expected OpenMetrics content type, got %s", rr.Header().Get("Content-Type"))
+	}
+	body := rr.Body.String()
+	if !strings.Contains(body, "# TYPE test_gauge gauge\n") {
+		t.Errorf("Expected gauge type in body, got %s", body)
+	}
+	if !strings.Contains(body, `test_gauge{graph_ref="graph@variant",artifact="supergraph"} 42`) {
+		t.Errorf("Expected gauge sample in body, got %s", body)
+	}
+	if !strings.HasSuffix(body, "# EOF\n") {
+		t.Errorf("Expected body to end with EOF marker, got %s", body)
+	}
+}
+
+func TestCounterVec(t *testing.T) {
+	registry := NewRegistry()
+	counter := NewCounterVec("test_errors", "A test counter.", "artifact")
+	registry.Register(counter)
+
+	counter.Inc("supergraph")
+	counter.Inc("supergraph")
+	value, ok := counter.Get("supergraph")
+	if !ok || value != 2 {
+		t.Errorf("Expected counter value 2, got %v", value)
+	}
+
+	rr := httptest.NewRecorder()
+	Handler(registry)(rr, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body := rr.Body.String()
+	if !strings.Contains(body, "# TYPE test_errors counter\n") {
+		t.Errorf("Expected counter type in body, got %s", body)
+	}
+	if !strings.Contains(body, `test_errors_total{artifact="supergraph"} 2`) {
+		t.Errorf("Expected counter sample in body, got %s", body)
+	}
+}
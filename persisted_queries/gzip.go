@@ -0,0 +1,61 @@
+package persistedqueries
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"hash/crc32"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// acceptsGzip reports whether the request's Accept-Encoding header allows a gzip response.
+func acceptsGzip(r *http.Request) bool {
+	for _, header := range r.Header.Values("Accept-Encoding") {
+		for _, coding := range strings.Split(header, ",") {
+			name, params, _ := strings.Cut(coding, ";")
+			name = strings.ToLower(strings.TrimSpace(name))
+			if name != "gzip" && name != "x-gzip" {
+				continue
+			}
+			// A quality of 0 means the encoding isn't acceptable
+			if key, value, ok := strings.Cut(strings.TrimSpace(params), "="); ok && strings.TrimSpace(key) == "q" {
+				if q, err := strconv.ParseFloat(strings.TrimSpace(value), 64); err == nil && q == 0 {
+					return false
+				}
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// gzipHeader is a minimal gzip member header: deflate compression, no flags, no modification time and an unknown OS.
+var gzipHeader = []byte{0x1f, 0x8b, 8, 0, 0, 0, 0, 0, 0, 0xff}
+
+// zlibToGzip converts stored zlib content to gzip without recompressing it, as both wrap the same deflate stream.
+// Only the header and trailer differ, and the gzip trailer needs the CRC-32 and length of the decompressed body.
+// Content using a preset dictionary can't be converted, so the body is compressed again instead.
+func zlibToGzip(content []byte, body []byte) ([]byte, error) {
+	const zlibHeaderSize, zlibTrailerSize = 2, 4
+	if len(content) < zlibHeaderSize+zlibTrailerSize || content[0]&0x0f != 8 || content[1]&0x20 != 0 {
+		var b bytes.Buffer
+		w := gzip.NewWriter(&b)
+		if _, err := w.Write(body); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return b.Bytes(), nil
+	}
+
+	deflate := content[zlibHeaderSize : len(content)-zlibTrailerSize]
+	gzipped := make([]byte, 0, len(gzipHeader)+len(deflate)+8)
+	gzipped = append(gzipped, gzipHeader...)
+	gzipped = append(gzipped, deflate...)
+	gzipped = binary.LittleEndian.AppendUint32(gzipped, crc32.ChecksumIEEE(body))
+	gzipped = binary.LittleEndian.AppendUint32(gzipped, uint32(len(body)))
+	return gzipped, nil
+}
@@ -4,13 +4,16 @@ import (
 	"apollosolutions/uplink-relay/cache"
 	"apollosolutions/uplink-relay/config"
 	"apollosolutions/uplink-relay/internal/util"
+	"apollosolutions/uplink-relay/metrics"
 	"apollosolutions/uplink-relay/uplink"
 	"bytes"
 	"compress/zlib"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"log/slog"
+	"net"
 	"net/http"
 	"net/url"
 	"strconv"
@@ -29,6 +32,8 @@ type UplinkPersistedQueryPersistedQueries struct {
 	Typename        string                      `json:"__typename"`
 	MinDelaySeconds float64                     `json:"minDelaySeconds"`
 	Chunks          []UplinkPersistedQueryChunk `json:"chunks,omitempty"`
+	Code            string                      `json:"code,omitempty"`    // Only exists if __typename is "FetchError"
+	Message         string                      `json:"message,omitempty"` // Only exists if __typename is "FetchError"
 }
 
 type UplinkPersistedQueryChunk struct {
@@ -39,57 +44,139 @@ type UplinkPersistedQueryChunk struct {
 /*
 *
 
-	The path follows the format of /persisted-queries/{id}?i={index} where {id} is the unique identifier of the persisted query, and {index} is the index of the chunk.
-	For example, /persisted-queries/123/0 would represent the first chunk of the persisted query with ID 123.
+	The path follows the format of /persisted-queries/{id}?i={index}&g={graphRef} where {id} is the unique identifier of the persisted query, {index} is the index of the chunk,
+	and {graphRef} is the graph variant the chunk was cached for.
+	For example, /persisted-queries/123?i=0&g=graph%40current would represent the first chunk of the persisted query with ID 123 for graph@current.
 
 *
 */
 const pathPrefix = "/persisted-queries/"
 
+// maxChunkRedirects is the number of redirects followed when downloading a chunk, matching the default of net/http.
+const maxChunkRedirects = 10
+
 func PersistedQueryHandler(logger *slog.Logger, client *http.Client, systemCache cache.Cache) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		logger.Debug("Received request", "path", r.URL.Path)
+		// Routers and CDNs may check a chunk is available with HEAD before fetching it with GET
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			writeChunkError(w, r, `{"error":"Method not allowed"}`, http.StatusMethodNotAllowed)
+			return
+		}
+
 		id := strings.Split(r.URL.Path, pathPrefix)[1]
 		if id == "" {
-			w.Header().Set("Content-Type", "application/json")
-			http.Error(w, `{"error":"Invalid path format"}`, http.StatusBadRequest)
+			writeChunkError(w, r, `{"error":"Invalid path format"}`, http.StatusBadRequest)
 			return
 		}
 		logger.Debug("Received request for chunk", "path", id)
 
 		index := r.URL.Query().Get("i")
-		if index == "" {
-			w.Header().Set("Content-Type", "application/json")
-			http.Error(w, `{"error":"Invalid path format"}`, http.StatusBadRequest)
+		graphRef := r.URL.Query().Get("g")
+		if index == "" || graphRef == "" {
+			writeChunkError(w, r, `{"error":"Invalid path format"}`, http.StatusBadRequest)
 			return
 		}
 
-		logger.Debug("Received request", "id", id, "index", index, "cacheKey", MakePersistedQueryCacheKey(id, index))
-		content, ok := systemCache.Get(MakePersistedQueryCacheKey(id, index))
+		cacheKey := MakePersistedQueryCacheKey(graphRef, id, index)
+		logger.Debug("Received request", "id", id, "index", index, "graphRef", graphRef, "cacheKey", cacheKey)
+		content, ok := systemCache.Get(cacheKey)
 		if !ok {
-			// Handle cache miss error
-			w.Header().Set("Content-Type", "application/json")
-			http.Error(w, `{"error":"Manifest not found"}`, http.StatusNotFound)
+			notFound := chunkNotFound(systemCache, graphRef, id, index)
+			logger.Debug("Persisted query chunk not found", "id", id, "index", index, "graphRef", graphRef, "code", notFound.Code)
+			body, _ := json.Marshal(notFound)
+			writeChunkError(w, r, string(body), http.StatusNotFound)
 			return
 		}
 
-		// Write the content to the response
+		// Decompress the content so byte ranges can be served from it
 		reader, err := zlib.NewReader(bytes.NewReader(content))
 		if err != nil {
 			http.Error(w, "Error reading content", http.StatusInternalServerError)
 			return
 		}
 		defer reader.Close()
-		io.Copy(w, reader)
+		body, err := io.ReadAll(reader)
+		if err != nil {
+			http.Error(w, "Error reading content", http.StatusInternalServerError)
+			return
+		}
+
+		// Write the content to the response; ServeContent handles Range requests with 206 Partial Content responses and sets Accept-Ranges,
+		// sets Content-Length, omits the body for HEAD requests, and answers If-None-Match with 304 Not Modified using the ETag
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Add("Vary", "Accept-Encoding")
+		etag := util.HashString(string(body))
+
+		// Serve gzip to clients that accept it, transcoded from the stored zlib content; byte ranges are served from the plain content
+		if acceptsGzip(r) && r.Header.Get("Range") == "" {
+			gzipped, err := zlibToGzip(content, body)
+			if err != nil {
+				logger.Error("Failed to gzip persisted query chunk", "id", id, "index", index, "err", err)
+			} else {
+				// ServeContent leaves Content-Length unset for encoded content
+				w.Header().Set("Content-Encoding", "gzip")
+				w.Header().Set("Content-Length", strconv.Itoa(len(gzipped)))
+				w.Header().Set("ETag", fmt.Sprintf(`"%s-gzip"`, etag))
+				http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(gzipped))
+				return
+			}
+		}
+
+		w.Header().Set("ETag", fmt.Sprintf(`"%s"`, etag))
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(body))
 	}
 }
 
-func CachePersistedQueryChunkData(config *config.Config, logger *slog.Logger, systemCache cache.Cache, chunks []UplinkPersistedQueryChunk) ([]UplinkPersistedQueryChunk, error) {
+// Codes of the 404 responses for chunks that aren't cached.
+const (
+	chunkNotFoundCode      = "CHUNK_NOT_FOUND"       // No URL of the chunk is cached, e.g. the ID is unknown or the chunks were evicted.
+	chunkIndexNotFoundCode = "CHUNK_INDEX_NOT_FOUND" // The chunk's first URL is cached, but not the requested one.
+)
+
+// chunkNotFoundResponse is the body of 404 responses for chunks that aren't cached.
+// It tells an unknown chunk apart from a known chunk missing the requested URL index, such as a chunk partly evicted from the cache.
+type chunkNotFoundResponse struct {
+	Error string `json:"error"`
+	Code  string `json:"code"`
+	ID    string `json:"id"`
+	Index string `json:"index"`
+}
+
+// chunkNotFound builds the 404 response for a chunk URL that isn't cached, checking whether the chunk's first URL is.
+// Every chunk has a first URL, so a single lookup tells the cases apart without listing keys built from the request's parameters.
+func chunkNotFound(systemCache cache.Cache, graphRef string, id string, index string) chunkNotFoundResponse {
+	if index != "0" {
+		if _, ok := systemCache.Get(MakePersistedQueryCacheKey(graphRef, id, "0")); ok {
+			return chunkNotFoundResponse{Error: "Persisted query chunk index not found", Code: chunkIndexNotFoundCode, ID: id, Index: index}
+		}
+	}
+	return chunkNotFoundResponse{Error: "Persisted query chunk not found", Code: chunkNotFoundCode, ID: id, Index: index}
+}
+
+// writeChunkError writes a JSON error response, without a body for HEAD requests.
+func writeChunkError(w http.ResponseWriter, r *http.Request, body string, status int) {
+	// http.Error would replace the content type with text/plain
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	if r.Method != http.MethodHead {
+		fmt.Fprintln(w, body)
+	}
+}
+
+func CachePersistedQueryChunkData(ctx context.Context, config *config.Config, logger *slog.Logger, systemCache cache.Cache, graphRef string, chunks []UplinkPersistedQueryChunk) ([]UplinkPersistedQueryChunk, error) {
 	// Validate caching is disabled, but also ignore this logic altogether if there's no public URL in the config, as it's used to advertise the cached URLs.
 	if !config.Cache.Enabled || config.Relay.PublicURL == "" {
 		logger.Debug("Caching disabled, skipping", "publicURL", config.Relay.PublicURL, "cacheEnabled", config.Cache.Enabled)
 		return chunks, nil
 	}
+	// Routers fetch the chunks from the upstream URLs themselves, which saves the relay's egress
+	if !config.PersistedQueries.Rehost() {
+		logger.Debug("Chunk rehosting disabled, keeping the upstream chunk URLs", "graphRef", graphRef)
+		return chunks, nil
+	}
 	if !strings.HasPrefix(config.Relay.PublicURL, "http") {
 		logger.Error("Invalid public URL", "publicURL", config.Relay.PublicURL)
 		return nil, fmt.Errorf("invalid publicURL: %s", config.Relay.PublicURL)
@@ -98,20 +185,69 @@ func CachePersistedQueryChunkData(config *config.Config, logger *slog.Logger, sy
 	if err != nil {
 		return nil, err
 	}
+	if config.Relay.TLS.KeyFile != "" || config.Relay.TLS.CertFile != "" {
+		parsedUrl.Scheme = "https"
+	}
+	// Build the base of the advertised chunk URLs once, as JoinPath would otherwise prefix the path again for every chunk
+	baseUrl := parsedUrl.JoinPath(pathPrefix).String()
+
+	// Reject manifests with too many chunks before downloading any of them
+	chunkCount := 0
+	for _, chunk := range chunks {
+		chunkCount += len(chunk.URLs)
+	}
+	if config.PersistedQueries.MaxChunks > 0 && chunkCount > config.PersistedQueries.MaxChunks {
+		logger.Error("Persisted query manifest has too many chunks", "chunks", chunkCount, "maxChunks", config.PersistedQueries.MaxChunks)
+		return nil, fmt.Errorf("persisted query manifest has %d chunks, exceeding the limit of %d", chunkCount, config.PersistedQueries.MaxChunks)
+	}
+
+	chunkClient := chunkHTTPClient(config)
+
+	var totalBytes int64
 	for c, chunk := range chunks {
 		newUrls := []string{}
 		for u, chunkUrl := range chunk.URLs {
-			cacheKey := MakePersistedQueryCacheKey(chunk.ID, strconv.Itoa(u))
+			cacheKey := MakePersistedQueryCacheKey(graphRef, chunk.ID, strconv.Itoa(u))
+
+			// Only fetch chunks from allowed hosts, as the URLs come from the upstream response
+			if err := validateChunkURL(config, chunkUrl); err != nil {
+				logger.Error("Rejected persisted query chunk URL", "id", chunk.ID, "url", chunkUrl, "err", err)
+				return nil, err
+			}
 
 			// Fetch the content from the uplink.
-			res, err := http.Get(chunkUrl)
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, chunkUrl, nil)
 			if err != nil {
 				return nil, err
 			}
-			body, err := io.ReadAll(res.Body)
+			res, err := chunkClient.Do(req)
 			if err != nil {
+				metrics.PersistedQueryChunkDownloadFailures.Inc(graphRef)
 				return nil, err
 			}
+			// Error responses, e.g. an expired signed URL, aren't chunks, so they aren't cached
+			if res.StatusCode < 200 || res.StatusCode > 299 {
+				res.Body.Close()
+				metrics.PersistedQueryChunkDownloadFailures.Inc(graphRef)
+				logger.Error("Failed to download persisted query chunk", "id", chunk.ID, "status", res.StatusCode)
+				return nil, fmt.Errorf("failed to download persisted query chunk %s: status %d", chunk.ID, res.StatusCode)
+			}
+			// Read at most one byte more than the remaining budget to detect chunks exceeding it
+			var reader io.Reader = res.Body
+			if config.PersistedQueries.MaxChunkBytes > 0 {
+				reader = io.LimitReader(res.Body, config.PersistedQueries.MaxChunkBytes-totalBytes+1)
+			}
+			body, err := io.ReadAll(reader)
+			res.Body.Close()
+			if err != nil {
+				metrics.PersistedQueryChunkDownloadFailures.Inc(graphRef)
+				return nil, err
+			}
+			totalBytes += int64(len(body))
+			if config.PersistedQueries.MaxChunkBytes > 0 && totalBytes > config.PersistedQueries.MaxChunkBytes {
+				logger.Error("Persisted query chunks are too large", "id", chunk.ID, "maxChunkBytes", config.PersistedQueries.MaxChunkBytes)
+				return nil, fmt.Errorf("persisted query chunks exceed the limit of %d bytes", config.PersistedQueries.MaxChunkBytes)
+			}
 
 			// compress the text for reducing overall size of the cache entry
 			var b bytes.Buffer
@@ -123,30 +259,82 @@ func CachePersistedQueryChunkData(config *config.Config, logger *slog.Logger, sy
 			w.Close()
 
 			// Set the content in the cache.
-			if err := systemCache.Set(cacheKey, string(b.String()), config.Cache.Duration); err != nil {
+			if err := systemCache.Set(cacheKey, string(b.String()), config.CacheDuration()); err != nil {
 				return nil, err
 			}
 
-			protocol := parsedUrl.Scheme
-			if config.Relay.TLS.KeyFile != "" || config.Relay.TLS.CertFile != "" {
-				protocol = "https"
-			}
-			parsedUrl.Scheme = protocol
-			parsedUrl = parsedUrl.JoinPath(pathPrefix)
-			logger.Debug("Cached persisted query chunk", "id", chunk.ID, "urls", chunk.URLs, "chunks", chunks, "parsedUrl", parsedUrl.String())
+			logger.Debug("Cached persisted query chunk", "id", chunk.ID, "urls", chunk.URLs, "chunks", chunks, "baseUrl", baseUrl)
 			// Update the URL to point to the local server.
-			newUrls = append(newUrls, fmt.Sprintf("%s%s?i=%d", parsedUrl.String(), chunk.ID, u))
+			newUrls = append(newUrls, fmt.Sprintf("%s%s?i=%d&g=%s", baseUrl, chunk.ID, u, url.QueryEscape(graphRef)))
 		}
 		// Update the chunk URLs to point to the local server.
 		chunks[c].URLs = newUrls
 		logger.Debug("Cached persisted query chunk", "id", chunk.ID, "urls", newUrls, "chunks", chunks)
 
 	}
+	// Routers are only served the manifest once all of its chunks are cached, so a failed manifest leaves the count of the previous one
+	RecordCachedChunks(graphRef, chunkCount)
 	return chunks, nil
 }
 
+// RecordCachedChunks sets the metric of the number of persisted query chunks cached for graphRef to the chunks cached for its latest manifest.
+// Chunks of earlier manifests are no longer served to routers, so each manifest's chunks replace the previous count rather than add to it.
+func RecordCachedChunks(graphRef string, count int) {
+	metrics.PersistedQueryChunksCached.Set(float64(count), graphRef)
+}
+
+// validateChunkURL checks a persisted query chunk URL against the configured allowlist of hosts to prevent the relay from fetching internal URLs.
+// Entries match the host exactly, or any subdomain when prefixed with "*.". Without an allowlist, loopback, private and link-local hosts are rejected.
+func validateChunkURL(config *config.Config, chunkUrl string) error {
+	parsedUrl, err := url.Parse(chunkUrl)
+	if err != nil {
+		return fmt.Errorf("invalid chunk URL: %w", err)
+	}
+	if parsedUrl.Scheme != "http" && parsedUrl.Scheme != "https" {
+		return fmt.Errorf(`chunk URL scheme "%s" is not allowed; must be one of "http" or "https"`, parsedUrl.Scheme)
+	}
+	host := strings.ToLower(parsedUrl.Hostname())
+	if host == "" {
+		return fmt.Errorf("chunk URL %s has no host", chunkUrl)
+	}
+
+	if len(config.PersistedQueries.ChunkAllowedHosts) > 0 {
+		for _, allowed := range config.PersistedQueries.ChunkAllowedHosts {
+			allowed = strings.ToLower(allowed)
+			if host == allowed || (strings.HasPrefix(allowed, "*.") && strings.HasSuffix(host, allowed[1:])) {
+				return nil
+			}
+		}
+		return fmt.Errorf("chunk URL host %s is not in the allowed hosts", host)
+	}
+
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return fmt.Errorf("chunk URL host %s is not allowed", host)
+	}
+	if ip := net.ParseIP(host); ip != nil && util.IsInternalIP(ip) {
+		return fmt.Errorf("chunk URL host %s is not allowed", host)
+	}
+	return nil
+}
+
+// chunkHTTPClient returns the client downloading persisted query chunks, which validates every redirect like the chunk URLs themselves.
+// Without an allowlist, it also refuses to connect to internal addresses, e.g. hostnames resolving to a loopback or private address.
+func chunkHTTPClient(config *config.Config) *http.Client {
+	client := util.NewHTTPClient(config)
+	if len(config.PersistedQueries.ChunkAllowedHosts) == 0 {
+		client = util.NewPublicHTTPClient(config)
+	}
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if len(via) >= maxChunkRedirects {
+			return fmt.Errorf("stopped after %d redirects", maxChunkRedirects)
+		}
+		return validateChunkURL(config, req.URL.String())
+	}
+	return client
+}
+
 // FetchPQManifest fetches the persisted query (PQ) manifest for the specified graph.
-func FetchPQManifest(userConfig *config.Config, systemCache cache.Cache, logger *slog.Logger, graphRef string, ifAfterId string) error {
+func FetchPQManifest(ctx context.Context, userConfig *config.Config, systemCache cache.Cache, logger *slog.Logger, graphRef string, ifAfterId string) error {
 	supergraphConfig, err := config.FindSupergraphConfigFromGraphRef(graphRef, userConfig)
 	if err != nil {
 		return err
@@ -155,10 +343,14 @@ func FetchPQManifest(userConfig *config.Config, systemCache cache.Cache, logger
 	if supergraphConfig.PersistedQueryVersion != "" {
 		return nil
 	}
+	apiKey, err := supergraphConfig.APIKey(userConfig.Uplink.DefaultApolloKey)
+	if err != nil {
+		return err
+	}
 
 	// Define the request body
 	variables := map[string]interface{}{
-		"apiKey":    supergraphConfig.ApolloKey,
+		"apiKey":    apiKey,
 		"graph_ref": graphRef,
 		"ifAfterId": ifAfterId,
 	}
@@ -185,20 +377,21 @@ func FetchPQManifest(userConfig *config.Config, systemCache cache.Cache, logger
 		}`
 	operationName := "PersistedQueriesManifestQuery"
 
-	resp, err := util.UplinkRequest(userConfig, logger, query, variables, operationName)
+	resp, err := util.UplinkRequest(ctx, userConfig, logger, query, variables, operationName)
 	if err != nil {
 		return err
 	}
 
 	// Unmarshal the response body into the LicenseQueryResponse struct
 	var response UplinkPersistedQueryResponse
-	err = json.Unmarshal(resp, &response)
+	err = util.DecodeUplinkResponse(resp, &response, userConfig.Uplink.StrictDecode)
 	if err != nil {
+		logger.Error("Failed to decode uplink response", "graphRef", graphRef, "err", err)
 		return err
 	}
 
 	if userConfig.Cache.Enabled {
-		chunks, err := CachePersistedQueryChunkData(userConfig, logger, systemCache, response.Data.PersistedQueries.Chunks)
+		chunks, err := CachePersistedQueryChunkData(ctx, userConfig, logger, systemCache, graphRef, response.Data.PersistedQueries.Chunks)
 		if err != nil {
 			return err
 		}
@@ -211,18 +404,18 @@ func FetchPQManifest(userConfig *config.Config, systemCache cache.Cache, logger
 
 		cacheItem := cache.CacheItem{
 			Content:      resp,
-			Expiration:   cache.ExpirationTime(userConfig.Cache.Duration),
+			Expiration:   cache.ExpirationTime(userConfig.CacheDuration()),
 			Hash:         util.HashString(string(resp)),
 			LastModified: time.Now(),
 			ID:           response.Data.PersistedQueries.ID,
 		}
 
-		cacheBytes, err := json.Marshal(cacheItem)
+		cacheBytes, err := cache.EncodeItem(cacheItem)
 		if err != nil {
 			return err
 		}
 		// Cache the response
-		return cachePersistedQueries(systemCache, logger, graphRef, cacheBytes, userConfig.Cache.Duration)
+		return cachePersistedQueries(systemCache, logger, graphRef, cacheBytes, userConfig.CacheDuration())
 	}
 	return nil
 }
@@ -240,8 +433,14 @@ func DecodeID(id string) (string, int) {
 	return parts[0], version
 }
 
-func MakePersistedQueryCacheKey(id string, index string) string {
-	return fmt.Sprintf("pq:%s:%s", id, index)
+// MakePersistedQueryCacheKey returns the cache key of a persisted query chunk, namespaced by graphRef so variants with the same chunk IDs don't overwrite each other.
+func MakePersistedQueryCacheKey(graphRef string, id string, index string) string {
+	return fmt.Sprintf("%s%s:%s", MakePersistedQueryCachePrefix(graphRef), id, index)
+}
+
+// MakePersistedQueryCachePrefix returns the prefix of the cache keys of every persisted query chunk cached for graphRef.
+func MakePersistedQueryCachePrefix(graphRef string) string {
+	return fmt.Sprintf("%spq:%s:", cache.KeyPrefix(), graphRef)
 }
 
 func cachePersistedQueries(systemCache cache.Cache, logger *slog.Logger, graphRef string, response []byte, duration int) error {
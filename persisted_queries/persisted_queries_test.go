@@ -4,8 +4,16 @@ import (
 	"apollosolutions/uplink-relay/cache"
 	"apollosolutions/uplink-relay/config"
 	"apollosolutions/uplink-relay/logger"
+	"apollosolutions/uplink-relay/metrics"
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
 	"strings"
 	"testing"
 )
@@ -16,6 +24,8 @@ func TestPersistedQueryHandler(t *testing.T) {
 	mockCache := cache.NewMemoryCache(1000)
 	mockConfig := config.NewDefaultConfig()
 	mockConfig.Relay.PublicURL = "http://example.com/"
+	// The mock server is local, so it has to be allowed explicitly
+	mockConfig.PersistedQueries.ChunkAllowedHosts = []string{"127.0.0.1"}
 
 	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte(`{"data":{"persistedQueries":{"id":"123","__typename":"","minDelaySeconds":0,"chunks":null}}}`))
@@ -23,7 +33,7 @@ func TestPersistedQueryHandler(t *testing.T) {
 	defer mockServer.Close()
 
 	// Prefill cache with test data
-	_, err := CachePersistedQueryChunkData(mockConfig, log, mockCache, []UplinkPersistedQueryChunk{{
+	_, err := CachePersistedQueryChunkData(context.Background(), mockConfig, log, mockCache, "graph@current", []UplinkPersistedQueryChunk{{
 		ID:   "123",
 		URLs: []string{mockServer.URL},
 	}})
@@ -32,7 +42,7 @@ func TestPersistedQueryHandler(t *testing.T) {
 	}
 
 	// Test case 1: Valid request with existing persisted query
-	req1, err := http.NewRequest("GET", "/persisted-queries/123?i=0", nil)
+	req1, err := http.NewRequest("GET", "/persisted-queries/123?i=0&g=graph%40current", nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -48,7 +58,7 @@ func TestPersistedQueryHandler(t *testing.T) {
 	}
 
 	// Test case 2: Invalid request with non-existent persisted query
-	req2, err := http.NewRequest("GET", "/persisted-queries/456?i=0", nil)
+	req2, err := http.NewRequest("GET", "/persisted-queries/456?i=0&g=graph%40current", nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -58,7 +68,7 @@ func TestPersistedQueryHandler(t *testing.T) {
 	if status := rr2.Code; status != http.StatusNotFound {
 		t.Errorf("Handler returned wrong status code: got %v, want %v", status, http.StatusNotFound)
 	}
-	expectedResponse2 := `{"error":"Manifest not found"}`
+	expectedResponse2 := `{"error":"Persisted query chunk not found","code":"CHUNK_NOT_FOUND","id":"456","index":"0"}`
 	if strings.TrimSpace(rr2.Body.String()) != expectedResponse2 {
 		t.Errorf("Handler returned unexpected body: got %v, want %v", rr2.Body.String(), expectedResponse2)
 	}
@@ -82,14 +92,14 @@ func TestPersistedQueryHandler(t *testing.T) {
 	// Test case 4: check if the publicURL has an existing path (e.g. example.com/pq/) whether that'll also work
 	mockConfig.Relay.PublicURL = "http://example.com/pq/"
 	// Prefill cache with test data
-	_, err = CachePersistedQueryChunkData(mockConfig, log, mockCache, []UplinkPersistedQueryChunk{{
+	_, err = CachePersistedQueryChunkData(context.Background(), mockConfig, log, mockCache, "graph@current", []UplinkPersistedQueryChunk{{
 		ID:   "123",
 		URLs: []string{mockServer.URL},
 	}})
 	if err != nil {
 		t.Fatal(err)
 	}
-	req4, err := http.NewRequest("GET", "/pq/persisted-queries/123?i=0", nil)
+	req4, err := http.NewRequest("GET", "/pq/persisted-queries/123?i=0&g=graph%40current", nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -105,7 +115,7 @@ func TestPersistedQueryHandler(t *testing.T) {
 	// Reset cache
 	mockCache = cache.NewMemoryCache(1000)
 	// Attempt to prefill cache with test data
-	_, err = CachePersistedQueryChunkData(mockConfig, log, mockCache, []UplinkPersistedQueryChunk{{
+	_, err = CachePersistedQueryChunkData(context.Background(), mockConfig, log, mockCache, "graph@current", []UplinkPersistedQueryChunk{{
 		ID:   "123",
 		URLs: []string{mockServer.URL},
 	}})
@@ -114,7 +124,7 @@ func TestPersistedQueryHandler(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	req5, err := http.NewRequest("GET", "/persisted-queries/123?i=0", nil)
+	req5, err := http.NewRequest("GET", "/persisted-queries/123?i=0&g=graph%40current", nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -125,17 +135,316 @@ func TestPersistedQueryHandler(t *testing.T) {
 	if status := rr5.Code; status != http.StatusNotFound {
 		t.Errorf("Handler returned wrong status code: got %v, want %v", status, http.StatusNotFound)
 	}
-	_, found := mockCache.Get("pq:123:0")
+	_, found := mockCache.Get("pq:graph@current:123:0")
 	if found {
 		t.Errorf("Expected item to not be found in cache")
 	}
 }
 
+func TestPersistedQueryHandlerNotFound(t *testing.T) {
+	log := logger.MakeLogger(nil)
+	mockCache := cache.NewMemoryCache(1000)
+	mockConfig := config.NewDefaultConfig()
+	mockConfig.Relay.PublicURL = "http://example.com"
+	mockConfig.PersistedQueries.ChunkAllowedHosts = []string{"127.0.0.1"}
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{}`))
+	}))
+	defer mockServer.Close()
+
+	// The chunk has two URLs, the second of which is evicted
+	chunks := []UplinkPersistedQueryChunk{{ID: "graph/1", URLs: []string{mockServer.URL + "/a", mockServer.URL + "/b"}}}
+	if _, err := CachePersistedQueryChunkData(context.Background(), mockConfig, log, mockCache, "graph@current", chunks); err != nil {
+		t.Fatal(err)
+	}
+	mockCache.Set(MakePersistedQueryCacheKey("graph@current", "graph/1", "1"), "", 0)
+
+	tests := []struct {
+		name string
+		path string
+		body string
+	}{
+		{
+			name: "unknown ID",
+			path: "/persisted-queries/graph/2?i=0&g=graph%40current",
+			body: `{"error":"Persisted query chunk not found","code":"CHUNK_NOT_FOUND","id":"graph/2","index":"0"}`,
+		},
+		{
+			name: "known ID with a missing index",
+			path: "/persisted-queries/graph/1?i=1&g=graph%40current",
+			body: `{"error":"Persisted query chunk index not found","code":"CHUNK_INDEX_NOT_FOUND","id":"graph/1","index":"1"}`,
+		},
+		{
+			name: "known ID of another graph",
+			path: "/persisted-queries/graph/1?i=0&g=graph%40staging",
+			body: `{"error":"Persisted query chunk not found","code":"CHUNK_NOT_FOUND","id":"graph/1","index":"0"}`,
+		},
+		{
+			name: "glob characters in the graph ref",
+			path: "/persisted-queries/graph/1?i=1&g=%2A",
+			body: `{"error":"Persisted query chunk not found","code":"CHUNK_NOT_FOUND","id":"graph/1","index":"1"}`,
+		},
+	}
+	// Keys aren't listed to answer requests, as listing them is slow with Redis
+	handler := PersistedQueryHandler(log, http.DefaultClient, unlistableCache{mockCache, t})
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, tt.path, nil))
+			if rr.Code != http.StatusNotFound {
+				t.Errorf("Expected status code 404, got %d", rr.Code)
+			}
+			if contentType := rr.Header().Get("Content-Type"); contentType != "application/json" {
+				t.Errorf("Expected a JSON response, got %s", contentType)
+			}
+			if body := strings.TrimSpace(rr.Body.String()); body != tt.body {
+				t.Errorf("Expected body %s, got %s", tt.body, body)
+			}
+		})
+	}
+
+	// The cached index is still served
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/persisted-queries/graph/1?i=0&g=graph%40current", nil))
+	if rr.Code != http.StatusOK {
+		t.Errorf("Expected the cached index to be served, got %d", rr.Code)
+	}
+}
+
+// unlistableCache fails the test when keys are listed.
+type unlistableCache struct {
+	cache.Cache
+	t *testing.T
+}
+
+func (c unlistableCache) KeysWithPrefix(prefix string) ([]string, error) {
+	c.t.Errorf("Expected keys not to be listed, got a listing of %s", prefix)
+	return c.Cache.KeysWithPrefix(prefix)
+}
+
+func TestPersistedQueryHandlerRange(t *testing.T) {
+	log := logger.MakeLogger(nil)
+	mockCache := cache.NewMemoryCache(1000)
+
+	manifest := `{"format":"apollo-persisted-query-manifest","version":1,"operations":[]}`
+	var b bytes.Buffer
+	w := zlib.NewWriter(&b)
+	w.Write([]byte(manifest))
+	w.Close()
+	mockCache.Set(MakePersistedQueryCacheKey("graph@current", "123", "0"), b.String(), 60)
+
+	handler := http.HandlerFunc(PersistedQueryHandler(log, http.DefaultClient, mockCache))
+	request := func(rangeHeader string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/persisted-queries/123?i=0&g=graph%40current", nil)
+		if rangeHeader != "" {
+			req.Header.Set("Range", rangeHeader)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// Without a range, the whole chunk is served
+	rr := request("")
+	if rr.Code != http.StatusOK || rr.Body.String() != manifest {
+		t.Errorf("Expected the full manifest, got %v %v", rr.Code, rr.Body.String())
+	}
+	if rr.Header().Get("Accept-Ranges") != "bytes" {
+		t.Errorf("Expected Accept-Ranges bytes, got %v", rr.Header().Get("Accept-Ranges"))
+	}
+
+	// A byte range is served as partial content
+	rr = request("bytes=0-9")
+	if rr.Code != http.StatusPartialContent {
+		t.Errorf("Handler returned wrong status code: got %v, want %v", rr.Code, http.StatusPartialContent)
+	}
+	if rr.Body.String() != manifest[0:10] {
+		t.Errorf("Handler returned unexpected body: got %v, want %v", rr.Body.String(), manifest[0:10])
+	}
+	expectedRange := fmt.Sprintf("bytes 0-9/%d", len(manifest))
+	if rr.Header().Get("Content-Range") != expectedRange {
+		t.Errorf("Handler returned unexpected Content-Range: got %v, want %v", rr.Header().Get("Content-Range"), expectedRange)
+	}
+
+	// A suffix range resumes from the end
+	rr = request("bytes=-4")
+	if rr.Code != http.StatusPartialContent || rr.Body.String() != manifest[len(manifest)-4:] {
+		t.Errorf("Expected the last 4 bytes, got %v %v", rr.Code, rr.Body.String())
+	}
+
+	// A range past the end can't be satisfied
+	rr = request(fmt.Sprintf("bytes=%d-", len(manifest)+10))
+	if rr.Code != http.StatusRequestedRangeNotSatisfiable {
+		t.Errorf("Handler returned wrong status code: got %v, want %v", rr.Code, http.StatusRequestedRangeNotSatisfiable)
+	}
+}
+
+func TestPersistedQueryHandlerHead(t *testing.T) {
+	log := logger.MakeLogger(nil)
+	mockCache := cache.NewMemoryCache(1000)
+
+	manifest := `{"format":"apollo-persisted-query-manifest","version":1,"operations":[]}`
+	var b bytes.Buffer
+	w := zlib.NewWriter(&b)
+	w.Write([]byte(manifest))
+	w.Close()
+	mockCache.Set(MakePersistedQueryCacheKey("graph@current", "123", "0"), b.String(), 60)
+
+	handler := http.HandlerFunc(PersistedQueryHandler(log, http.DefaultClient, mockCache))
+	request := func(method string, path string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest(method, path, nil))
+		return rr
+	}
+
+	// A HEAD hit returns the headers of the GET response without the body
+	get := request("GET", "/persisted-queries/123?i=0&g=graph%40current")
+	rr := request("HEAD", "/persisted-queries/123?i=0&g=graph%40current")
+	if rr.Code != http.StatusOK {
+		t.Errorf("Handler returned wrong status code: got %v, want %v", rr.Code, http.StatusOK)
+	}
+	if rr.Body.Len() != 0 {
+		t.Errorf("Expected no body, got %v", rr.Body.String())
+	}
+	if rr.Header().Get("Content-Length") != fmt.Sprintf("%d", len(manifest)) {
+		t.Errorf("Handler returned unexpected Content-Length: got %v, want %v", rr.Header().Get("Content-Length"), len(manifest))
+	}
+	if rr.Header().Get("ETag") == "" || rr.Header().Get("ETag") != get.Header().Get("ETag") {
+		t.Errorf("Expected the ETag of the GET response, got %v and %v", rr.Header().Get("ETag"), get.Header().Get("ETag"))
+	}
+
+	// A HEAD miss returns 404 without a body
+	rr = request("HEAD", "/persisted-queries/456?i=0&g=graph%40current")
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("Handler returned wrong status code: got %v, want %v", rr.Code, http.StatusNotFound)
+	}
+	if rr.Body.Len() != 0 {
+		t.Errorf("Expected no body, got %v", rr.Body.String())
+	}
+
+	// A matching ETag is answered with 304
+	req := httptest.NewRequest("GET", "/persisted-queries/123?i=0&g=graph%40current", nil)
+	req.Header.Set("If-None-Match", get.Header().Get("ETag"))
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusNotModified {
+		t.Errorf("Handler returned wrong status code: got %v, want %v", rr.Code, http.StatusNotModified)
+	}
+
+	// Other methods aren't allowed
+	rr = request("POST", "/persisted-queries/123?i=0&g=graph%40current")
+	if rr.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Handler returned wrong status code: got %v, want %v", rr.Code, http.StatusMethodNotAllowed)
+	}
+	if rr.Header().Get("Allow") != "GET, HEAD" {
+		t.Errorf("Handler returned unexpected Allow header: got %v", rr.Header().Get("Allow"))
+	}
+}
+
+func TestPersistedQueryHandlerGzip(t *testing.T) {
+	log := logger.MakeLogger(nil)
+	mockCache := cache.NewMemoryCache(1000)
+
+	manifest := `{"format":"apollo-persisted-query-manifest","version":1,"operations":[` + strings.Repeat(`{"id":"1","body":"query { a }","name":"A","type":"query"},`, 50) + `{"id":"2","body":"query { b }","name":"B","type":"query"}]}`
+	var b bytes.Buffer
+	w := zlib.NewWriter(&b)
+	w.Write([]byte(manifest))
+	w.Close()
+	mockCache.Set(MakePersistedQueryCacheKey("graph@current", "123", "0"), b.String(), 60)
+
+	handler := http.HandlerFunc(PersistedQueryHandler(log, http.DefaultClient, mockCache))
+	request := func(method string, headers map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/persisted-queries/123?i=0&g=graph%40current", nil)
+		for key, value := range headers {
+			req.Header.Set(key, value)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// A gzip-accepting client gets the chunk gzipped
+	rr := request("GET", map[string]string{"Accept-Encoding": "br, gzip;q=0.8"})
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Handler returned wrong status code: got %v, want %v", rr.Code, http.StatusOK)
+	}
+	if rr.Header().Get("Content-Encoding") != "gzip" {
+		t.Errorf("Expected Content-Encoding gzip, got %q", rr.Header().Get("Content-Encoding"))
+	}
+	if rr.Header().Get("Vary") != "Accept-Encoding" {
+		t.Errorf("Expected Vary Accept-Encoding, got %q", rr.Header().Get("Vary"))
+	}
+	if rr.Body.Len() >= len(manifest) {
+		t.Errorf("Expected the gzipped body to be smaller than the manifest, got %d bytes", rr.Body.Len())
+	}
+	if rr.Header().Get("Content-Length") != fmt.Sprintf("%d", rr.Body.Len()) {
+		t.Errorf("Expected the Content-Length of the gzipped body, got %v", rr.Header().Get("Content-Length"))
+	}
+	reader, err := gzip.NewReader(rr.Body)
+	if err != nil {
+		t.Fatalf("Expected a gzip body: %v", err)
+	}
+	body, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("Expected a valid gzip body: %v", err)
+	}
+	if string(body) != manifest {
+		t.Errorf("Expected the gzipped body to be the manifest, got %v", string(body))
+	}
+
+	// The gzipped chunk has its own ETag, which is revalidated like the plain one
+	etag := rr.Header().Get("ETag")
+	plain := request("GET", nil)
+	if etag == "" || etag == plain.Header().Get("ETag") {
+		t.Errorf("Expected a distinct ETag for the gzipped chunk, got %v and %v", etag, plain.Header().Get("ETag"))
+	}
+	if rr := request("GET", map[string]string{"Accept-Encoding": "gzip", "If-None-Match": etag}); rr.Code != http.StatusNotModified {
+		t.Errorf("Handler returned wrong status code: got %v, want %v", rr.Code, http.StatusNotModified)
+	}
+
+	// Clients that don't accept gzip, and byte ranges, are served the plain chunk
+	for _, headers := range []map[string]string{nil, {"Accept-Encoding": "gzip;q=0"}, {"Accept-Encoding": "gzip", "Range": "bytes=0-9"}} {
+		rr := request("GET", headers)
+		if rr.Header().Get("Content-Encoding") != "" {
+			t.Errorf("Expected no Content-Encoding for %v, got %q", headers, rr.Header().Get("Content-Encoding"))
+		}
+		if !strings.HasPrefix(manifest, rr.Body.String()) || rr.Body.Len() == 0 {
+			t.Errorf("Expected the plain manifest for %v, got %v", headers, rr.Body.String())
+		}
+	}
+}
+
+func TestZlibToGzipWithDictionary(t *testing.T) {
+	manifest := []byte(`{"format":"apollo-persisted-query-manifest","version":1,"operations":[]}`)
+	var b bytes.Buffer
+	w, err := zlib.NewWriterLevelDict(&b, zlib.DefaultCompression, []byte("apollo-persisted-query-manifest"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write(manifest)
+	w.Close()
+
+	// Content compressed with a dictionary can't be transcoded, so it's compressed again
+	gzipped, err := zlibToGzip(b.Bytes(), manifest)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	reader, err := gzip.NewReader(bytes.NewReader(gzipped))
+	if err != nil {
+		t.Fatalf("Expected a gzip body: %v", err)
+	}
+	body, _ := io.ReadAll(reader)
+	if !bytes.Equal(body, manifest) {
+		t.Errorf("Expected the manifest, got %v", string(body))
+	}
+}
+
 func TestCachePersistedQueryChunkData(t *testing.T) {
 	log := logger.MakeLogger(nil)
 	mockCache := cache.NewMemoryCache(1000)
 	mockConfig := config.NewDefaultConfig()
 	mockConfig.Relay.PublicURL = "http://example.com"
+	mockConfig.PersistedQueries.ChunkAllowedHosts = []string{"127.0.0.1"}
 	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte(`{"format":"apollo-persisted-query-manifest","version":1,"operations":[{"id":"1234","body":"query{__typename}"}]}`))
 	}))
@@ -144,7 +453,7 @@ func TestCachePersistedQueryChunkData(t *testing.T) {
 		ID:   "456",
 		URLs: []string{mockServer.URL},
 	}}
-	cachedChunks, err := CachePersistedQueryChunkData(mockConfig, log, mockCache, chunks)
+	cachedChunks, err := CachePersistedQueryChunkData(context.Background(), mockConfig, log, mockCache, "graph@current", chunks)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -172,39 +481,406 @@ func TestCachePersistedQueryChunkData(t *testing.T) {
 		ID:   "789",
 		URLs: []string{mockServer.URL},
 	}}
-	_, err = CachePersistedQueryChunkData(mockConfig, log, mockCache, chunks)
+	_, err = CachePersistedQueryChunkData(context.Background(), mockConfig, log, mockCache, "graph@current", chunks)
+	if err == nil {
+		t.Errorf("Expected error, got nil")
+	}
+}
+
+func TestCachePersistedQueryChunkDataPublicURLPath(t *testing.T) {
+	pFalse := false
+	log := logger.MakeLogger(&pFalse)
+	mockConfig := config.NewDefaultConfig()
+	mockConfig.Relay.PublicURL = "http://example.com/relay"
+	mockConfig.PersistedQueries.ChunkAllowedHosts = []string{"127.0.0.1"}
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"format":"apollo-persisted-query-manifest","version":1,"operations":[]}`))
+	}))
+	defer mockServer.Close()
+
+	chunks := []UplinkPersistedQueryChunk{
+		{ID: "1", URLs: []string{mockServer.URL, mockServer.URL}},
+		{ID: "2", URLs: []string{mockServer.URL}},
+	}
+	cachedChunks, err := CachePersistedQueryChunkData(context.Background(), mockConfig, log, cache.NewMemoryCache(1000), "graph@current", chunks)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Each chunk URL is built from the public URL once, however many chunks precede it
+	expected := [][]string{
+		{"http://example.com/relay/persisted-queries/1?i=0&g=graph%40current", "http://example.com/relay/persisted-queries/1?i=1&g=graph%40current"},
+		{"http://example.com/relay/persisted-queries/2?i=0&g=graph%40current"},
+	}
+	for i, chunk := range cachedChunks {
+		if !reflect.DeepEqual(chunk.URLs, expected[i]) {
+			t.Errorf("Expected chunk %s URLs %v, got %v", chunk.ID, expected[i], chunk.URLs)
+		}
+	}
+}
+
+func TestCachePersistedQueryChunkDataVariants(t *testing.T) {
+	pFalse := false
+	log := logger.MakeLogger(&pFalse)
+	mockCache := cache.NewMemoryCache(1000)
+	mockConfig := config.NewDefaultConfig()
+	mockConfig.Relay.PublicURL = "http://example.com"
+	mockConfig.PersistedQueries.ChunkAllowedHosts = []string{"127.0.0.1"}
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer mockServer.Close()
+
+	// Both variants have a chunk with the same ID, but different contents
+	for _, variant := range []string{"current", "staging"} {
+		chunks := []UplinkPersistedQueryChunk{{ID: "graph/1/1", URLs: []string{mockServer.URL + "/" + variant}}}
+		if _, err := CachePersistedQueryChunkData(context.Background(), mockConfig, log, mockCache, "graph@"+variant, chunks); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	handler := PersistedQueryHandler(log, http.DefaultClient, mockCache)
+	for _, variant := range []string{"current", "staging"} {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest("GET", "/persisted-queries/graph/1/1?i=0&g=graph%40"+variant, nil))
+		if rr.Code != http.StatusOK || rr.Body.String() != "/"+variant {
+			t.Errorf("Expected the chunk of graph@%s, got %d %s", variant, rr.Code, rr.Body.String())
+		}
+	}
+
+	// Deleting one variant's chunks leaves the other's
+	mockCache.DeleteWithPrefix(MakePersistedQueryCachePrefix("graph@current"))
+	if _, ok := mockCache.Get(MakePersistedQueryCacheKey("graph@current", "graph/1/1", "0")); ok {
+		t.Errorf("Expected the chunk of graph@current to be deleted")
+	}
+	if _, ok := mockCache.Get(MakePersistedQueryCacheKey("graph@staging", "graph/1/1", "0")); !ok {
+		t.Errorf("Expected the chunk of graph@staging to be kept")
+	}
+}
+
+func TestCachePersistedQueryChunkDataMetrics(t *testing.T) {
+	log := logger.MakeLogger(nil)
+	mockCache := cache.NewMemoryCache(1000)
+	mockConfig := config.NewDefaultConfig()
+	mockConfig.Relay.PublicURL = "http://example.com"
+	mockConfig.PersistedQueries.ChunkAllowedHosts = []string{"127.0.0.1"}
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{}`))
+	}))
+	graphRef := "metrics@current"
+
+	// The chunks in the cache are counted
+	chunks := []UplinkPersistedQueryChunk{{ID: "1", URLs: []string{mockServer.URL + "/1a", mockServer.URL + "/1b"}}, {ID: "2", URLs: []string{mockServer.URL + "/2"}}}
+	if _, err := CachePersistedQueryChunkData(context.Background(), mockConfig, log, mockCache, graphRef, chunks); err != nil {
+		t.Fatal(err)
+	}
+	if cached, _ := metrics.PersistedQueryChunksCached.Get(graphRef); cached != 3 {
+		t.Errorf("Expected 3 cached chunks to be counted, got %v", cached)
+	}
+	if failures, _ := metrics.PersistedQueryChunkDownloadFailures.Get(graphRef); failures != 0 {
+		t.Errorf("Expected no download failures to be counted, got %v", failures)
+	}
+
+	// Chunks that can't be downloaded are counted as failures, and not as cached
+	mockServer.Close()
+	chunks = []UplinkPersistedQueryChunk{{ID: "3", URLs: []string{mockServer.URL + "/3"}}}
+	if _, err := CachePersistedQueryChunkData(context.Background(), mockConfig, log, mockCache, graphRef, chunks); err == nil {
+		t.Fatalf("Expected an error when the chunk can't be downloaded")
+	}
+	if failures, _ := metrics.PersistedQueryChunkDownloadFailures.Get(graphRef); failures != 1 {
+		t.Errorf("Expected 1 download failure to be counted, got %v", failures)
+	}
+	if cached, _ := metrics.PersistedQueryChunksCached.Get(graphRef); cached != 3 {
+		t.Errorf("Expected the failed chunk not to be counted as cached, got %v", cached)
+	}
+
+	// Error responses are counted as failures, and not cached as chunks
+	forbiddenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+	}))
+	defer forbiddenServer.Close()
+	chunks = []UplinkPersistedQueryChunk{{ID: "4", URLs: []string{forbiddenServer.URL + "/4"}}}
+	if _, err := CachePersistedQueryChunkData(context.Background(), mockConfig, log, mockCache, graphRef, chunks); err == nil {
+		t.Fatalf("Expected an error when the chunk download is forbidden")
+	}
+	if failures, _ := metrics.PersistedQueryChunkDownloadFailures.Get(graphRef); failures != 2 {
+		t.Errorf("Expected 2 download failures to be counted, got %v", failures)
+	}
+	if _, ok := mockCache.Get(MakePersistedQueryCacheKey(graphRef, "4", "0")); ok {
+		t.Errorf("Expected the error response not to be cached")
+	}
+	if cached, _ := metrics.PersistedQueryChunksCached.Get(graphRef); cached != 3 {
+		t.Errorf("Expected the error response not to be counted as cached, got %v", cached)
+	}
+}
+
+func TestCachePersistedQueryChunkDataMetricsSuccessiveManifests(t *testing.T) {
+	log := logger.MakeLogger(nil)
+	mockCache := cache.NewMemoryCache(1000)
+	mockConfig := config.NewDefaultConfig()
+	mockConfig.Relay.PublicURL = "http://example.com"
+	mockConfig.PersistedQueries.ChunkAllowedHosts = []string{"127.0.0.1"}
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{}`))
+	}))
+	defer mockServer.Close()
+	graphRef := "manifests@current"
+
+	first := []UplinkPersistedQueryChunk{{ID: "1", URLs: []string{mockServer.URL + "/1a", mockServer.URL + "/1b"}}, {ID: "2", URLs: []string{mockServer.URL + "/2"}}}
+	if _, err := CachePersistedQueryChunkData(context.Background(), mockConfig, log, mockCache, graphRef, first); err != nil {
+		t.Fatal(err)
+	}
+	// The next manifest's chunks replace the count of the previous one's, which are still cached until they expire
+	second := []UplinkPersistedQueryChunk{{ID: "3", URLs: []string{mockServer.URL + "/3"}}}
+	if _, err := CachePersistedQueryChunkData(context.Background(), mockConfig, log, mockCache, graphRef, second); err != nil {
+		t.Fatal(err)
+	}
+	if cached, _ := metrics.PersistedQueryChunksCached.Get(graphRef); cached != 1 {
+		t.Errorf("Expected only the chunks of the second manifest to be counted, got %v", cached)
+	}
+}
+
+func TestCachePersistedQueryChunkDataRehost(t *testing.T) {
+	log := logger.MakeLogger(nil)
+	downloads := 0
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		downloads++
+		w.Write([]byte(`{}`))
+	}))
+	defer mockServer.Close()
+
+	pTrue, pFalse := true, false
+	tests := []struct {
+		name      string
+		rehost    *bool
+		urls      []string
+		downloads int
+	}{
+		{name: "default", rehost: nil, urls: []string{"http://relay.example.com/persisted-queries/graph/1?i=0&g=graph%40current"}, downloads: 1},
+		{name: "rehosted", rehost: &pTrue, urls: []string{"http://relay.example.com/persisted-queries/graph/1?i=0&g=graph%40current"}, downloads: 1},
+		{name: "upstream", rehost: &pFalse, urls: []string{mockServer.URL + "/graph/1"}, downloads: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			downloads = 0
+			mockCache := cache.NewMemoryCache(1000)
+			mockConfig := config.NewDefaultConfig()
+			mockConfig.Relay.PublicURL = "http://relay.example.com"
+			mockConfig.PersistedQueries.ChunkAllowedHosts = []string{"127.0.0.1"}
+			mockConfig.PersistedQueries.RehostChunks = tt.rehost
+
+			chunks := []UplinkPersistedQueryChunk{{ID: "graph/1", URLs: []string{mockServer.URL + "/graph/1"}}}
+			cachedChunks, err := CachePersistedQueryChunkData(context.Background(), mockConfig, log, mockCache, "graph@current", chunks)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(cachedChunks[0].URLs, tt.urls) {
+				t.Errorf("Expected chunk URLs %v, got %v", tt.urls, cachedChunks[0].URLs)
+			}
+			if downloads != tt.downloads {
+				t.Errorf("Expected %d chunk downloads, got %d", tt.downloads, downloads)
+			}
+			_, cached := mockCache.Get(MakePersistedQueryCacheKey("graph@current", "graph/1", "0"))
+			if cached != (tt.downloads > 0) {
+				t.Errorf("Expected the chunk to be cached only when rehosted, got %v", cached)
+			}
+		})
+	}
+}
+
+func TestCachePersistedQueryChunkDataDisallowedURL(t *testing.T) {
+	log := logger.MakeLogger(nil)
+	mockCache := cache.NewMemoryCache(1000)
+	mockConfig := config.NewDefaultConfig()
+	mockConfig.Relay.PublicURL = "http://example.com"
+
+	fetched := false
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetched = true
+		w.Write([]byte(`{}`))
+	}))
+	defer mockServer.Close()
+
+	// Local chunk URLs are rejected without an allowlist
+	_, err := CachePersistedQueryChunkData(context.Background(), mockConfig, log, mockCache, "graph@current", []UplinkPersistedQueryChunk{{
+		ID:   "123",
+		URLs: []string{mockServer.URL},
+	}})
+	if err == nil {
+		t.Errorf("Expected error, got nil")
+	}
+
+	// ...and hosts outside the allowlist are rejected
+	mockConfig.PersistedQueries.ChunkAllowedHosts = []string{"*.apollographql.com"}
+	_, err = CachePersistedQueryChunkData(context.Background(), mockConfig, log, mockCache, "graph@current", []UplinkPersistedQueryChunk{{
+		ID:   "123",
+		URLs: []string{mockServer.URL},
+	}})
+	if err == nil {
+		t.Errorf("Expected error, got nil")
+	}
+	if fetched {
+		t.Errorf("Expected the disallowed chunk URL not to be fetched")
+	}
+}
+
+func TestCachePersistedQueryChunkDataDisallowedRedirect(t *testing.T) {
+	log := logger.MakeLogger(nil)
+	mockCache := cache.NewMemoryCache(1000)
+	mockConfig := config.NewDefaultConfig()
+	mockConfig.Relay.PublicURL = "http://example.com"
+
+	fetched := false
+	internalServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetched = true
+		w.Write([]byte(`{}`))
+	}))
+	defer internalServer.Close()
+	// The allowed host redirects to an internal address, which must be validated like the chunk URL itself
+	redirectServer := httptest.NewServer(http.RedirectHandler(internalServer.URL, http.StatusFound))
+	defer redirectServer.Close()
+	mockConfig.PersistedQueries.ChunkAllowedHosts = []string{"localhost"}
+
+	_, err := CachePersistedQueryChunkData(context.Background(), mockConfig, log, mockCache, "graph@current", []UplinkPersistedQueryChunk{{
+		ID:   "123",
+		URLs: []string{strings.Replace(redirectServer.URL, "127.0.0.1", "localhost", 1)},
+	}})
+	if err == nil {
+		t.Errorf("Expected error, got nil")
+	}
+	if fetched {
+		t.Errorf("Expected the redirect to 127.0.0.1 not to be followed")
+	}
+	if _, ok := mockCache.Get(MakePersistedQueryCacheKey("graph@current", "123", "0")); ok {
+		t.Errorf("Expected the chunk not to be cached")
+	}
+}
+
+func TestCachePersistedQueryChunkDataLimits(t *testing.T) {
+	log := logger.MakeLogger(nil)
+	mockCache := cache.NewMemoryCache(1000)
+	mockConfig := config.NewDefaultConfig()
+	mockConfig.Relay.PublicURL = "http://example.com"
+	mockConfig.PersistedQueries.ChunkAllowedHosts = []string{"127.0.0.1"}
+	mockConfig.PersistedQueries.MaxChunks = 3
+	mockConfig.PersistedQueries.MaxChunkBytes = 10
+
+	fetches := 0
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches++
+		w.Write([]byte(`{"a":1}`))
+	}))
+	defer mockServer.Close()
+
+	// A manifest with too many chunks is rejected before anything is downloaded
+	chunks := []UplinkPersistedQueryChunk{
+		{ID: "1", URLs: []string{mockServer.URL, mockServer.URL}},
+		{ID: "2", URLs: []string{mockServer.URL, mockServer.URL}},
+	}
+	_, err := CachePersistedQueryChunkData(context.Background(), mockConfig, log, mockCache, "graph@current", chunks)
+	if err == nil {
+		t.Errorf("Expected error, got nil")
+	}
+	if fetches != 0 {
+		t.Errorf("Expected no chunks to be fetched, but got %d", fetches)
+	}
+
+	// A manifest within the chunk limit but exceeding the total size is rejected
+	chunks = []UplinkPersistedQueryChunk{
+		{ID: "3", URLs: []string{mockServer.URL}},
+		{ID: "4", URLs: []string{mockServer.URL}},
+	}
+	_, err = CachePersistedQueryChunkData(context.Background(), mockConfig, log, mockCache, "graph@current", chunks)
 	if err == nil {
 		t.Errorf("Expected error, got nil")
 	}
+
+	// A manifest within both limits is cached
+	chunks = []UplinkPersistedQueryChunk{{ID: "5", URLs: []string{mockServer.URL}}}
+	if _, err = CachePersistedQueryChunkData(context.Background(), mockConfig, log, mockCache, "graph@current", chunks); err != nil {
+		t.Errorf("Expected no error, got %v", err)
+	}
+}
+
+func TestValidateChunkURL(t *testing.T) {
+	mockConfig := config.NewDefaultConfig()
+	for chunkUrl, allowed := range map[string]bool{
+		"https://chunks.example.com/graph/1":  true,
+		"http://93.184.216.34/graph/1":        true,
+		"https://localhost/graph/1":           false,
+		"http://127.0.0.1:8080/graph/1":       false,
+		"http://10.0.0.1/graph/1":             false,
+		"http://192.168.1.1/graph/1":          false,
+		"http://169.254.169.254/latest/meta":  false,
+		"http://[::1]/graph/1":                false,
+		"file:///etc/passwd":                  false,
+		"gopher://chunks.example.com/graph/1": false,
+	} {
+		err := validateChunkURL(mockConfig, chunkUrl)
+		if allowed && err != nil {
+			t.Errorf("Expected %s to be allowed, got %v", chunkUrl, err)
+		} else if !allowed && err == nil {
+			t.Errorf("Expected %s to be rejected", chunkUrl)
+		}
+	}
+
+	mockConfig.PersistedQueries.ChunkAllowedHosts = []string{"*.apollographql.com", "internal.example.com"}
+	for chunkUrl, allowed := range map[string]bool{
+		"https://storage.apollographql.com/graph/1": true,
+		"https://internal.example.com/graph/1":      true,
+		"https://apollographql.com.evil.com/1":      false,
+		"https://evilapollographql.com/graph/1":     false,
+		"https://chunks.example.com/graph/1":        false,
+	} {
+		err := validateChunkURL(mockConfig, chunkUrl)
+		if allowed && err != nil {
+			t.Errorf("Expected %s to be allowed, got %v", chunkUrl, err)
+		} else if !allowed && err == nil {
+			t.Errorf("Expected %s to be rejected", chunkUrl)
+		}
+	}
 }
 
 func TestMakePersistedQueryCacheKey(t *testing.T) {
 	// Test case 1: Valid input
+	graphRef := "graph@current"
 	id := "123"
 	index := "0"
-	expectedKey := "pq:123:0"
-	result := MakePersistedQueryCacheKey(id, index)
+	expectedKey := "pq:graph@current:123:0"
+	result := MakePersistedQueryCacheKey(graphRef, id, index)
 	if result != expectedKey {
 		t.Errorf("Unexpected cache key: got %v, want %v", result, expectedKey)
 	}
 
 	// Test case 2: Empty input
+	graphRef = ""
 	id = ""
 	index = ""
-	expectedKey = "pq::"
-	result = MakePersistedQueryCacheKey(id, index)
+	expectedKey = "pq:::"
+	result = MakePersistedQueryCacheKey(graphRef, id, index)
 	if result != expectedKey {
 		t.Errorf("Unexpected cache key: got %v, want %v", result, expectedKey)
 	}
 
 	// Test case 3: Input with special characters
+	graphRef = "graph@current"
 	id = "abc!@#$%^&*()"
 	index = "1"
-	expectedKey = "pq:abc!@#$%^&*():1"
-	result = MakePersistedQueryCacheKey(id, index)
+	expectedKey = "pq:graph@current:abc!@#$%^&*():1"
+	result = MakePersistedQueryCacheKey(graphRef, id, index)
 	if result != expectedKey {
 		t.Errorf("Unexpected cache key: got %v, want %v", result, expectedKey)
 	}
+
+	// Test case 4: The keys of different variants don't collide, and only share the prefix of their own variant
+	current := MakePersistedQueryCacheKey("graph@current", "graph/1/1", "0")
+	staging := MakePersistedQueryCacheKey("graph@staging", "graph/1/1", "0")
+	if current == staging {
+		t.Errorf("Expected the cache keys of different variants to differ, got %v", current)
+	}
+	if !strings.HasPrefix(current, MakePersistedQueryCachePrefix("graph@current")) || strings.HasPrefix(staging, MakePersistedQueryCachePrefix("graph@current")) {
+		t.Errorf("Expected each key to only have its own variant's prefix, got %v and %v", current, staging)
+	}
 }
 func TestFetchPQManifest(t *testing.T) {
 	log := logger.MakeLogger(nil)
@@ -223,20 +899,20 @@ func TestFetchPQManifest(t *testing.T) {
 	}}
 
 	// Test case 1: Fetch PQ manifest successfully
-	err := FetchPQManifest(mockConfig, mockCache, log, "graph@variant", "")
+	err := FetchPQManifest(context.Background(), mockConfig, mockCache, log, "graph@variant", "")
 	if err != nil {
 		t.Errorf("Unexpected error: %v", err)
 	}
 
 	// Test case 2: Fetch PQ manifest with invalid graph reference
-	err = FetchPQManifest(mockConfig, mockCache, log, "", "")
+	err = FetchPQManifest(context.Background(), mockConfig, mockCache, log, "", "")
 	if err == nil {
 		t.Error("Expected error, got nil")
 	}
 
 	// Test case 3: Fetch PQ manifest with non-existent manifest URL
 	mockConfig.Relay.PublicURL = "http://example.com/non-existent"
-	err = FetchPQManifest(mockConfig, mockCache, log, "graph1", "")
+	err = FetchPQManifest(context.Background(), mockConfig, mockCache, log, "graph1", "")
 	if err == nil {
 		t.Error("Expected error, got nil")
 	}
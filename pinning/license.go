@@ -5,35 +5,79 @@ import (
 	"apollosolutions/uplink-relay/config"
 	"apollosolutions/uplink-relay/internal/util"
 	"encoding/json"
+	"fmt"
 	"log/slog"
 	"time"
 
 	"github.com/go-jose/go-jose"
+	"github.com/go-jose/go-jose/jwt"
 )
 
-// This isn't a complete set of the payload, but we only need WarnAt for now
+// This isn't a complete set of the payload, but we only need WarnAt and HaltAt for now; the registered claims are verified separately
 type LicenseJWTPayload struct {
 	WarnAt int64 `json:"warnAt"`
+	HaltAt int64 `json:"haltAt"`
 }
 
-// PinOfflineLicense stores the license in the cache
-func PinOfflineLicense(userConfig *config.Config, logger *slog.Logger, systemCache cache.Cache, license string, graphRef string) error {
-	logger.Debug("Pinning license", "graphRef", graphRef)
-
-	// Parse the JWT and extract the warnAt timestamp and subtract 30 days for the modified time
-	// This just ensures the modifiedAt is properly in the past and statically set to avoid new pods creating new license entries for the same license
+// ParseLicenseClaims extracts the claims from a license JWT without verifying its signature.
+func ParseLicenseClaims(license string) (*LicenseJWTPayload, error) {
 	token, err := jose.ParseSigned(license)
 	if err != nil {
-		logger.Error("Failed to parse license", "error", err)
-		return err
+		return nil, err
 	}
 
 	var claims LicenseJWTPayload
-
 	payload := token.UnsafePayloadWithoutVerification()
 	if err := json.Unmarshal(payload, &claims); err != nil {
-		logger.Error("Failed to unmarshal license claims", "error", err)
-		return err
+		return nil, err
+	}
+	return &claims, nil
+}
+
+// VerifyLicenseClaims verifies the signature of a license JWT with the configured public key, and its issuer, audience and expiry, before extracting its claims.
+// Without a public key, the claims are extracted without verification, as with ParseLicenseClaims.
+func VerifyLicenseClaims(license string, licenseConfig config.OfflineLicenseConfig, now time.Time) (*LicenseJWTPayload, error) {
+	key, err := licenseConfig.VerificationKey()
+	if err != nil {
+		return nil, err
+	}
+	if key == nil {
+		return ParseLicenseClaims(license)
+	}
+
+	token, err := jwt.ParseSigned(license)
+	if err != nil {
+		return nil, err
+	}
+	var registeredClaims jwt.Claims
+	var claims LicenseJWTPayload
+	if err := token.Claims(key, &registeredClaims, &claims); err != nil {
+		return nil, fmt.Errorf("invalid license signature: %w", err)
+	}
+	expected := jwt.Expected{Issuer: licenseConfig.Issuer, Time: now}
+	if licenseConfig.Audience != "" {
+		expected.Audience = jwt.Audience{licenseConfig.Audience}
+	}
+	if err := registeredClaims.ValidateWithLeeway(expected, 0); err != nil {
+		return nil, fmt.Errorf("invalid license claims: %w", err)
+	}
+	// Licenses stop working at haltAt rather than at a standard exp claim
+	if claims.HaltAt != 0 && !now.Before(time.Unix(claims.HaltAt, 0)) {
+		return nil, fmt.Errorf("license expired at %s", time.Unix(claims.HaltAt, 0).UTC().Format(time.RFC3339))
+	}
+	return &claims, nil
+}
+
+// PinOfflineLicense stores the license in the cache
+func PinOfflineLicense(userConfig *config.Config, logger *slog.Logger, systemCache cache.Cache, license string, graphRef string) error {
+	logger.Debug("Pinning license", "graphRef", graphRef)
+
+	// Verify the JWT and extract the warnAt timestamp and subtract 30 days for the modified time
+	// This just ensures the modifiedAt is properly in the past and statically set to avoid new pods creating new license entries for the same license
+	claims, err := VerifyLicenseClaims(license, userConfig.OfflineLicenses, time.Now())
+	if err != nil {
+		logger.Error("Failed to verify license", "graphRef", graphRef, "error", err)
+		return fmt.Errorf("invalid offline license for %s: %w", graphRef, err)
 	}
 	warnAt := time.Unix(claims.WarnAt, 0).UTC()
 	modifiedTime := warnAt.AddDate(0, 0, -30)
@@ -47,13 +91,13 @@ func PinOfflineLicense(userConfig *config.Config, logger *slog.Logger, systemCac
 			Content:      []byte(license),
 			LastModified: time.Now(),
 		}
-		cacheString, err := json.Marshal(cacheEntry)
+		cacheString, err := cache.EncodeItem(cacheEntry)
 		if err != nil {
 			logger.Error("Failed to marshal cache entry", "error", err)
 			return err
 		}
 		cacheKey := cache.MakeCacheKey(graphRef, LicensePinned)
-		insertPinnedCacheEntry(logger, systemCache, cacheKey, string(cacheString[:]), modifiedTime.Format(time.RFC3339), modifiedTime)
+		insertPinnedCacheEntry(logger, systemCache, cacheKey, string(cacheString[:]), modifiedTime.Format(time.RFC3339), "", modifiedTime)
 	}
 	return nil
 }
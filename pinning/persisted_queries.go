@@ -1,14 +1,16 @@
 package pinning
 
 import (
+	"apollosolutions/uplink-relay/audit"
 	"apollosolutions/uplink-relay/cache"
 	"apollosolutions/uplink-relay/config"
+	"apollosolutions/uplink-relay/internal/util"
 	persistedqueries "apollosolutions/uplink-relay/persisted_queries"
 	"bytes"
 	"compress/zlib"
+	"context"
 	"encoding/json"
 	"fmt"
-	"io"
 	"log/slog"
 	"net/http"
 	"net/url"
@@ -38,9 +40,31 @@ type PersistedQueryQueryList struct {
 }
 
 type PersistedQueryQueryBuilds struct {
-	Edges []PersistedQueryQueryEdge `json:"edges"`
+	PageInfo PersistedQueryQueryPageInfo `json:"pageInfo"`
+	Edges    []PersistedQueryQueryEdge   `json:"edges"`
 }
 
+type PersistedQueryQueryPageInfo struct {
+	HasNextPage bool    `json:"hasNextPage"`
+	EndCursor   *string `json:"endCursor"`
+}
+
+// PersistedQueryListError is returned when the Studio API can't return the persisted query list for a variant.
+// The message comes from the Studio API and is never used as a format string.
+type PersistedQueryListError struct {
+	GraphRef string // GraphRef being pinned.
+	Version  string // Persisted query version being pinned.
+	Typename string // Typename returned by the Studio API, e.g. InvalidRefFormat or Error.
+	Message  string // Message returned by the Studio API.
+}
+
+func (e *PersistedQueryListError) Error() string {
+	return fmt.Sprintf("failed to get persisted query list for %s (version %s): %s: %s", e.GraphRef, e.Version, e.Typename, e.Message)
+}
+
+// persistedQueryBuildsPageSize is the number of persisted query list builds requested per page from the Studio API.
+const persistedQueryBuildsPageSize = 20
+
 type PersistedQueryQueryEdge struct {
 	Node PersistedQueryQueryNode `json:"node"`
 }
@@ -57,10 +81,8 @@ type PersistedQueryQueryManifestChunks struct {
 
 func PinPersistedQueries(userConfig *config.Config, logger *slog.Logger, systemCache cache.Cache, graphRef string, persistedQueryVersion string) error {
 	logger.Debug("Pinning PQ version", "version", persistedQueryVersion, "graphRef", graphRef)
-	// Configure the HTTP client with a timeout.
-	httpClient := &http.Client{
-		Timeout: time.Duration(userConfig.Uplink.Timeout) * time.Second,
-	}
+	// Configure the HTTP client with the uplink timeouts.
+	httpClient := util.NewHTTPClient(userConfig)
 
 	apiKey, err := findAPIKey(userConfig, graphRef)
 	if err != nil {
@@ -68,82 +90,14 @@ func PinPersistedQueries(userConfig *config.Config, logger *slog.Logger, systemC
 		return err
 	}
 
-	requestBody, err := json.Marshal(&PinningAPIRequest{
-		Query: `
-		query UplinkRelay_PinPersistedQueries($ref: ID!){
-			variant(ref: $ref) {
-				__typename
-				... on InvalidRefFormat {
-					message
-				}
-				... on Error {
-					message
-				}
-				... on GraphVariant {
-					persistedQueryList {
-						builds {
-							edges {
-								node {
-									id
-									manifestChunks {
-										id
-										json
-									}
-								}
-							}
-						}
-					}
-				}
-			}
-		}
-		`,
-		Variables: map[string]interface{}{
-			"ref": graphRef,
-		},
-		OperationName: "UplinkRelay_PinPersistedQueries",
-	})
-	if err != nil {
-		logger.Error("Error preparing request body", "err", err)
-		return err
-	}
-
-	req, err := http.NewRequest("POST", userConfig.Uplink.StudioAPIURL, bytes.NewBuffer(requestBody))
-	if err != nil {
-		logger.Error("Error creating request", "err", err)
-		return err
-	}
-	req = defaultHeaders(req, apiKey)
-
-	resp, err := httpClient.Do(req)
-	if err != nil {
-		logger.Error("Error sending request", "err", err)
-		return err
-	}
-	defer resp.Body.Close()
-	// Read the response body
-	bodyBytes, _ := io.ReadAll(resp.Body)
-
-	var apiResponse PersistedQueryQueryResponse
-	err = json.Unmarshal(bodyBytes, &apiResponse)
-	if err != nil {
-		logger.Error("Error unmarshalling response", "err", err)
-		return err
-	}
-
-	if apiResponse.Data.Variant.Typename != "GraphVariant" {
-		logger.Error("Failed to get persisted query list", "graphRef", graphRef, "version", persistedQueryVersion, "message", apiResponse.Data.Variant.Message)
-		return fmt.Errorf(apiResponse.Data.Variant.Message)
-	}
-	// Find the matching edge for the persisted query version
-	node, err := findMatchingNode(apiResponse.Data.Variant.PersistedQueryQueryList.Builds.Edges, persistedQueryVersion)
+	node, err := fetchPersistedQueryNode(userConfig, logger, httpClient, apiKey, graphRef, persistedQueryVersion)
 	if err != nil {
-		logger.Error("Failed to find persisted query version", "graphRef", graphRef, "version", persistedQueryVersion)
 		return err
 	}
 
 	if userConfig.Cache.Enabled {
 		// Insert the pinned cache entry
-		chunks, err := cachePinnedChunks(userConfig, logger, systemCache, node)
+		chunks, err := cachePinnedChunks(userConfig, logger, systemCache, graphRef, node)
 		if err != nil {
 			logger.Error("Failed to cache pinned chunks", "graphRef", graphRef, "version", persistedQueryVersion)
 			return err
@@ -170,7 +124,7 @@ func PinPersistedQueries(userConfig *config.Config, logger *slog.Logger, systemC
 			return err
 		}
 		logger.Debug("Caching persisted query version", "graphRef", graphRef, "version", persistedQueryVersion, "response", fakeResponse)
-		insertPinnedCacheEntry(logger, systemCache, cache.MakeCacheKey(graphRef, PersistedQueriesPinned), string(respBytes[:]), node.ID, time.Now())
+		insertPinnedCacheEntry(logger, systemCache, cache.MakeCacheKey(graphRef, PersistedQueriesPinned), string(respBytes[:]), node.ID, persistedQueryVersion, time.Now())
 	}
 
 	// now finally update the config to the new pinned version to handle the case where the management API updated the PQ ID
@@ -185,16 +139,137 @@ func PinPersistedQueries(userConfig *config.Config, logger *slog.Logger, systemC
 	return nil
 }
 
+// fetchPersistedQueryNode pages through the persisted query list builds for the graph until the build matching the given version is found.
+func fetchPersistedQueryNode(userConfig *config.Config, logger *slog.Logger, httpClient *http.Client, apiKey string, graphRef string, persistedQueryVersion string) (*PersistedQueryQueryNode, error) {
+	var after *string
+	for page := 1; ; page++ {
+		requestBody, err := json.Marshal(&PinningAPIRequest{
+			Query: `
+			query UplinkRelay_PinPersistedQueries($ref: ID!, $first: Int, $after: String){
+				variant(ref: $ref) {
+					__typename
+					... on InvalidRefFormat {
+						message
+					}
+					... on Error {
+						message
+					}
+					... on GraphVariant {
+						persistedQueryList {
+							builds(first: $first, after: $after) {
+								pageInfo {
+									hasNextPage
+									endCursor
+								}
+								edges {
+									node {
+										id
+										manifestChunks {
+											id
+											json
+										}
+									}
+								}
+							}
+						}
+					}
+				}
+			}
+			`,
+			Variables: map[string]interface{}{
+				"ref":   graphRef,
+				"first": persistedQueryBuildsPageSize,
+				"after": after,
+			},
+			OperationName: "UplinkRelay_PinPersistedQueries",
+		})
+		if err != nil {
+			logger.Error("Error preparing request body", "err", err)
+			return nil, err
+		}
+
+		bodyBytes, err := studioRequest(audit.WithCall(context.Background(), graphRef, "UplinkRelay_PinPersistedQueries"), userConfig, logger, httpClient, apiKey, requestBody)
+		if err != nil {
+			logger.Error("Error sending request", "err", err)
+			return nil, err
+		}
+
+		var apiResponse PersistedQueryQueryResponse
+		err = json.Unmarshal(bodyBytes, &apiResponse)
+		if err != nil {
+			logger.Error("Error unmarshalling response", "err", err)
+			return nil, err
+		}
+
+		if apiResponse.Data.Variant.Typename != "GraphVariant" {
+			logger.Error("Failed to get persisted query list", "graphRef", graphRef, "version", persistedQueryVersion, "message", apiResponse.Data.Variant.Message)
+			return nil, &PersistedQueryListError{
+				GraphRef: graphRef,
+				Version:  persistedQueryVersion,
+				Typename: apiResponse.Data.Variant.Typename,
+				Message:  apiResponse.Data.Variant.Message,
+			}
+		}
+		if apiResponse.Data.Variant.PersistedQueryQueryList == nil {
+			logger.Error("No persisted query list linked to the variant", "graphRef", graphRef, "version", persistedQueryVersion)
+			return nil, fmt.Errorf("%w: no persisted query list found for graphRef %s", ErrStudioNotFound, graphRef)
+		}
+
+		// Find the matching edge for the persisted query version
+		builds := apiResponse.Data.Variant.PersistedQueryQueryList.Builds
+		node, err := findMatchingNode(builds.Edges, persistedQueryVersion)
+		if err == nil {
+			return node, nil
+		}
+
+		// Stop once the pages are exhausted, or if the cursor doesn't advance to avoid looping forever
+		pageInfo := builds.PageInfo
+		if !pageInfo.HasNextPage || pageInfo.EndCursor == nil || (after != nil && *after == *pageInfo.EndCursor) {
+			logger.Error("Failed to find persisted query version", "graphRef", graphRef, "version", persistedQueryVersion, "pages", page)
+			return nil, err
+		}
+		logger.Debug("Persisted query version not found in page, fetching next page", "graphRef", graphRef, "version", persistedQueryVersion, "page", page)
+		after = pageInfo.EndCursor
+	}
+}
+
+// IsPersistedQueryVersionCached reports whether the given persisted query version is already pinned for the graph, with every chunk still cached,
+// so it doesn't need to be fetched from Studio again.
+func IsPersistedQueryVersionCached(systemCache cache.Cache, graphRef string, persistedQueryVersion string) bool {
+	entry, ok := cachedPinnedEntry(systemCache, graphRef, PersistedQueriesPinned, persistedQueryVersion)
+	if !ok {
+		return false
+	}
+
+	var response persistedqueries.UplinkPersistedQueryResponse
+	if err := json.Unmarshal(entry.Content, &response); err != nil {
+		return false
+	}
+	// Chunks are cached separately, so the manifest is only usable if none were evicted
+	for _, chunk := range response.Data.PersistedQueries.Chunks {
+		for _, chunkURL := range chunk.URLs {
+			parsedURL, err := url.Parse(chunkURL)
+			if err != nil {
+				return false
+			}
+			if _, ok := systemCache.Get(persistedqueries.MakePersistedQueryCacheKey(graphRef, chunk.ID, parsedURL.Query().Get("i"))); !ok {
+				return false
+			}
+		}
+	}
+	return true
+}
+
 func findMatchingNode(edges []PersistedQueryQueryEdge, persistedQueryVersion string) (*PersistedQueryQueryNode, error) {
 	for _, edge := range edges {
 		if edge.Node.ID == persistedQueryVersion {
 			return &edge.Node, nil
 		}
 	}
-	return nil, fmt.Errorf("failed to find matching edge for persisted query version %s", persistedQueryVersion)
+	return nil, fmt.Errorf("%w: failed to find matching edge for persisted query version %s", ErrStudioNotFound, persistedQueryVersion)
 }
 
-func cachePinnedChunks(userConfig *config.Config, logger *slog.Logger, systemCache cache.Cache, node *PersistedQueryQueryNode) ([]persistedqueries.UplinkPersistedQueryChunk, error) {
+func cachePinnedChunks(userConfig *config.Config, logger *slog.Logger, systemCache cache.Cache, graphRef string, node *PersistedQueryQueryNode) ([]persistedqueries.UplinkPersistedQueryChunk, error) {
 	if userConfig.Relay.PublicURL == "" {
 		logger.Error("Public URL not set")
 		return nil, fmt.Errorf("public URL not set")
@@ -209,7 +284,7 @@ func cachePinnedChunks(userConfig *config.Config, logger *slog.Logger, systemCac
 
 	for index, chunk := range *node.ManifestChunks {
 		// insertPinnedCacheEntry(logger, systemCache, chunk.ID, chunk.JSON, chunk.ID, time.Now())
-		cacheKey := persistedqueries.MakePersistedQueryCacheKey(chunk.ID, strconv.Itoa(index))
+		cacheKey := persistedqueries.MakePersistedQueryCacheKey(graphRef, chunk.ID, strconv.Itoa(index))
 		var b bytes.Buffer
 		w := zlib.NewWriter(&b)
 		_, err = w.Write([]byte(chunk.JSON))
@@ -226,6 +301,7 @@ func cachePinnedChunks(userConfig *config.Config, logger *slog.Logger, systemCac
 		chunkURL := publicURL.JoinPath(fmt.Sprintf("/%s", chunk.ID))
 		q := chunkURL.Query()
 		q.Add("i", strconv.Itoa(index))
+		q.Add("g", graphRef)
 		chunkURL.RawQuery = q.Encode()
 		chunks[index] = persistedqueries.UplinkPersistedQueryChunk{
 			ID:   chunk.ID,
@@ -233,5 +309,6 @@ func cachePinnedChunks(userConfig *config.Config, logger *slog.Logger, systemCac
 		}
 		logger.Debug("Cached persisted query chunk", "id", chunk.ID)
 	}
+	persistedqueries.RecordCachedChunks(graphRef, len(chunks))
 	return chunks, nil
 }
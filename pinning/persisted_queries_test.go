@@ -0,0 +1,140 @@
+package pinning
+
+import (
+	"apollosolutions/uplink-relay/cache"
+	"apollosolutions/uplink-relay/config"
+	"apollosolutions/uplink-relay/logger"
+	"apollosolutions/uplink-relay/metrics"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPinPersistedQueriesPagination(t *testing.T) {
+	userConfig := config.NewDefaultConfig()
+	userConfig.Relay.PublicURL = "http://localhost:8080"
+	userConfig.Supergraphs = []config.SupergraphConfig{
+		{
+			GraphRef:  "graphID@variantID",
+			ApolloKey: "1234",
+		},
+	}
+
+	// Create a new test server to mock the Platform API, returning one build per page
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		var request PinningAPIRequest
+		json.NewDecoder(r.Body).Decode(&request)
+
+		page := 1
+		if after, ok := request.Variables["after"].(string); ok {
+			fmt.Sscanf(after, "cursor-%d", &page)
+			page++
+		}
+		hasNextPage := page < 3
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, `{"data":{"variant":{"__typename":"GraphVariant","persistedQueryList":{"builds":{"pageInfo":{"hasNextPage":%t,"endCursor":"cursor-%d"},"edges":[{"node":{"id":"build-%d","manifestChunks":[{"id":"chunk-%d","json":"{}"}]}}]}}}}}`, hasNextPage, page, page, page)
+	}))
+	defer server.Close()
+
+	userConfig.Uplink.StudioAPIURL = server.URL
+
+	logger := logger.MakeLogger(nil)
+	systemCache := cache.NewMemoryCache(10)
+
+	// Test case 1: The build is found on the last page
+	err := PinPersistedQueries(userConfig, logger, systemCache, "graphID@variantID", "build-3")
+	if err != nil {
+		t.Errorf("PinPersistedQueries returned an error: %v", err)
+	}
+	if requests != 3 {
+		t.Errorf("Expected 3 requests to the Studio API, got %d", requests)
+	}
+	if _, ok := systemCache.Get(cache.MakeCacheKey("graphID@variantID", PersistedQueriesPinned)); !ok {
+		t.Errorf("Expected pinned persisted queries to be cached")
+	}
+	if cached, _ := metrics.PersistedQueryChunksCached.Get("graphID@variantID"); cached != 1 {
+		t.Errorf("Expected the pinned chunk to be counted as cached, got %v", cached)
+	}
+
+	// Test case 2: The build doesn't exist in any page
+	requests = 0
+	err = PinPersistedQueries(userConfig, logger, systemCache, "graphID@variantID", "build-4")
+	if err == nil {
+		t.Errorf("Expected an error when the build isn't found")
+	}
+	if requests != 3 {
+		t.Errorf("Expected 3 requests to the Studio API, got %d", requests)
+	}
+}
+
+func TestPinPersistedQueriesStudioError(t *testing.T) {
+	userConfig := config.NewDefaultConfig()
+	userConfig.Relay.PublicURL = "http://localhost:8080"
+	userConfig.Supergraphs = []config.SupergraphConfig{
+		{
+			GraphRef:  "graphID@variantID",
+			ApolloKey: "1234",
+		},
+	}
+
+	// Return a message containing format verbs to ensure it isn't used as a format string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`{"data":{"variant":{"__typename":"InvalidRefFormat","message":"invalid ref %s %d"}}}`))
+	}))
+	defer server.Close()
+	userConfig.Uplink.StudioAPIURL = server.URL
+
+	err := PinPersistedQueries(userConfig, logger.MakeLogger(nil), cache.NewMemoryCache(10), "graphID@variantID", "build-1")
+
+	var listErr *PersistedQueryListError
+	if !errors.As(err, &listErr) {
+		t.Fatalf("Expected a PersistedQueryListError, got %v", err)
+	}
+	if listErr.Message != "invalid ref %s %d" {
+		t.Errorf("Expected the Studio message to be preserved, got %s", listErr.Message)
+	}
+	if listErr.GraphRef != "graphID@variantID" || listErr.Version != "build-1" {
+		t.Errorf("Expected the error to carry the graphRef and version, got %+v", listErr)
+	}
+	if !strings.Contains(err.Error(), "invalid ref %s %d") || strings.Contains(err.Error(), "%!") {
+		t.Errorf("Expected no formatting corruption, got %s", err.Error())
+	}
+}
+
+func TestIsPersistedQueryVersionCached(t *testing.T) {
+	userConfig := config.NewDefaultConfig()
+	userConfig.Relay.PublicURL = "http://localhost:8080"
+	userConfig.Supergraphs = []config.SupergraphConfig{{GraphRef: "graphID@variantID", ApolloKey: "1234"}}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"data":{"variant":{"__typename":"GraphVariant","persistedQueryList":{"builds":{"pageInfo":{"hasNextPage":false,"endCursor":""},"edges":[{"node":{"id":"build-1","manifestChunks":[{"id":"chunk-1","json":"{}"},{"id":"chunk-2","json":"{}"}]}}]}}}}}`))
+	}))
+	defer server.Close()
+	userConfig.Uplink.StudioAPIURL = server.URL
+	systemCache := cache.NewMemoryCache(10)
+
+	if IsPersistedQueryVersionCached(systemCache, "graphID@variantID", "build-1") {
+		t.Errorf("Expected the version not to be cached before pinning")
+	}
+	if err := PinPersistedQueries(userConfig, logger.MakeLogger(nil), systemCache, "graphID@variantID", "build-1"); err != nil {
+		t.Fatalf("PinPersistedQueries returned an error: %v", err)
+	}
+	if !IsPersistedQueryVersionCached(systemCache, "graphID@variantID", "build-1") {
+		t.Errorf("Expected the pinned version to be cached")
+	}
+	if IsPersistedQueryVersionCached(systemCache, "graphID@variantID", "build-2") {
+		t.Errorf("Expected a different version not to be cached")
+	}
+
+	// A manifest with an evicted chunk has to be pinned again
+	systemCache.DeleteWithPrefix("pq:graphID@variantID:chunk-2:")
+	if IsPersistedQueryVersionCached(systemCache, "graphID@variantID", "build-1") {
+		t.Errorf("Expected the version not to be cached once a chunk is evicted")
+	}
+}
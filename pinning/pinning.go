@@ -5,8 +5,12 @@ import (
 	"apollosolutions/uplink-relay/config"
 	"apollosolutions/uplink-relay/internal/util"
 	"apollosolutions/uplink-relay/uplink"
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log/slog"
 	"net/http"
 	"time"
@@ -34,6 +38,100 @@ var OperationMapping = map[string]string{
 	uplink.PersistedQueriesQuery: PersistedQueriesPinned,
 }
 
+// Classes of Studio API failures, so callers can tell auth failures apart from transient ones.
+var (
+	ErrStudioUnauthorized = errors.New("studio API rejected the API key")
+	ErrStudioNotFound     = errors.New("not found in studio")
+	ErrStudioTransient    = errors.New("transient studio API failure")
+)
+
+// studioRetryBackoff is the initial backoff between Studio API retries; it doubles on every attempt.
+var studioRetryBackoff = 500 * time.Millisecond
+
+type studioErrorResponse struct {
+	Errors []struct {
+		Message    string `json:"message"`
+		Extensions struct {
+			Code string `json:"code"`
+		} `json:"extensions"`
+	} `json:"errors"`
+}
+
+// studioRequest sends the request body to the Studio API, retrying transient failures with exponential backoff until the context is done.
+// The context identifies the graph and operation for the audit trail, see audit.WithCall.
+// Errors are wrapped with ErrStudioUnauthorized, ErrStudioNotFound or ErrStudioTransient.
+func studioRequest(ctx context.Context, userConfig *config.Config, logger *slog.Logger, httpClient *http.Client, apiKey string, requestBody []byte) ([]byte, error) {
+	backoff := studioRetryBackoff
+	var err error
+	for attempt := 0; attempt <= *userConfig.Uplink.StudioRetryCount; attempt++ {
+		if attempt > 0 {
+			logger.Warn("Retrying Studio API request", "attempt", attempt, "backoff", backoff, "err", err)
+			// Stop retrying as soon as the request is cancelled, rather than sleeping through the backoff
+			timer := time.NewTimer(backoff)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return nil, fmt.Errorf("%w: %w", ErrStudioTransient, ctx.Err())
+			case <-timer.C:
+			}
+			backoff *= 2
+		}
+
+		var body []byte
+		body, err = doStudioRequest(ctx, userConfig, httpClient, apiKey, requestBody)
+		if err == nil {
+			return body, nil
+		}
+		if !errors.Is(err, ErrStudioTransient) {
+			return nil, err
+		}
+	}
+	return nil, err
+}
+
+// doStudioRequest sends a single request to the Studio API and classifies any failure.
+func doStudioRequest(ctx context.Context, userConfig *config.Config, httpClient *http.Client, apiKey string, requestBody []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", userConfig.Uplink.StudioAPIURL, bytes.NewBuffer(requestBody))
+	if err != nil {
+		return nil, err
+	}
+	req = defaultHeaders(req, apiKey)
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrStudioTransient, err)
+	}
+	defer resp.Body.Close()
+
+	bodyBytes, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrStudioTransient, err)
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		return nil, fmt.Errorf("%w: status %d", ErrStudioUnauthorized, resp.StatusCode)
+	case resp.StatusCode == http.StatusNotFound:
+		return nil, fmt.Errorf("%w: status %d", ErrStudioNotFound, resp.StatusCode)
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return nil, fmt.Errorf("%w: status %d", ErrStudioTransient, resp.StatusCode)
+	case resp.StatusCode >= 300 || resp.StatusCode < 200:
+		return nil, fmt.Errorf("studio API request failed with status %d", resp.StatusCode)
+	}
+
+	// GraphQL errors are returned with a 200, so check the error codes for authentication failures
+	var errorResponse studioErrorResponse
+	if err := json.Unmarshal(bodyBytes, &errorResponse); err == nil {
+		for _, e := range errorResponse.Errors {
+			switch e.Extensions.Code {
+			case "UNAUTHENTICATED", "FORBIDDEN":
+				return nil, fmt.Errorf("%w: %s", ErrStudioUnauthorized, e.Message)
+			}
+		}
+	}
+	return bodyBytes, nil
+}
+
 func defaultHeaders(req *http.Request, apiKey string) *http.Request {
 	req.Header.Set("apollo-client-name", "UplinkRelay")
 	req.Header.Set("apollo-client-version", "1.0")
@@ -43,25 +141,26 @@ func defaultHeaders(req *http.Request, apiKey string) *http.Request {
 	return req
 }
 
+// findAPIKey returns the API key configured for the graph, or an error wrapping relayerrors.ErrGraphNotFound or relayerrors.ErrAPIKeyMissing.
 func findAPIKey(userConfig *config.Config, graphRef string) (string, error) {
-	for _, supergraph := range userConfig.Supergraphs {
-		if supergraph.GraphRef == graphRef {
-			return supergraph.ApolloKey, nil
-		}
+	supergraphConfig, err := config.FindSupergraphConfigFromGraphRef(graphRef, userConfig)
+	if err != nil {
+		return "", err
 	}
-	return "", fmt.Errorf("API key not found for graphRef %s", graphRef)
+	return supergraphConfig.APIKey(userConfig.Uplink.DefaultApolloKey)
 }
 
-func insertPinnedCacheEntry(logger *slog.Logger, systemCache cache.Cache, key string, value string, id string, modifiedTime time.Time) {
+func insertPinnedCacheEntry(logger *slog.Logger, systemCache cache.Cache, key string, value string, id string, version string, modifiedTime time.Time) {
 	content := cache.CacheItem{
 		LastModified: modifiedTime,
 		Content:      []byte(value),
 		Hash:         util.HashString(value),
 		Expiration:   cache.ExpirationTime(-1),
 		ID:           id,
+		Version:      version,
 	}
 
-	cacheEntry, err := json.Marshal(content)
+	cacheEntry, err := cache.EncodeItem(content)
 	if err != nil {
 		logger.Error("Failed to create pinned cache entry", "key", key, "value", value)
 		return
@@ -69,10 +168,30 @@ func insertPinnedCacheEntry(logger *slog.Logger, systemCache cache.Cache, key st
 	systemCache.Set(key, string(cacheEntry[:]), -1)
 }
 
+// cachedPinnedEntry returns the pinned cache entry for the given graph if it was cached for the given version.
+func cachedPinnedEntry(systemCache cache.Cache, graphRef string, pinnedOperation string, version string) (*cache.CacheItem, bool) {
+	rawEntry, ok := systemCache.Get(cache.MakeCacheKey(graphRef, pinnedOperation))
+	if !ok {
+		return nil, false
+	}
+
+	var entry cache.CacheItem
+	if err := cache.DecodeItem(rawEntry, &entry); err != nil || len(entry.Content) == 0 || entry.Version != version {
+		return nil, false
+	}
+	return &entry, true
+}
+
+// IsLaunchIDCached reports whether the given launch ID is already pinned and cached for the graph, so it doesn't need to be fetched from Studio again.
+func IsLaunchIDCached(systemCache cache.Cache, graphRef string, launchID string) bool {
+	_, ok := cachedPinnedEntry(systemCache, graphRef, SupergraphPinned, launchID)
+	return ok
+}
+
 // handlePinnedEntry is a helper function that retrieves the pinned cache entry for the given operation name if it exists, otherwise returns true on the second param
 // to indicate it is not newer than the given ifAfterId
 // Return arguments are effectively: content, unchanged
-func HandlePinnedEntry(logger *slog.Logger, systemCache cache.Cache, graphID, variantID, operationName string, ifAfterID string) (*cache.CacheItem, error) {
+func HandlePinnedEntry(logger *slog.Logger, systemCache cache.Cache, graphID, variantID, operationName string, ifAfterID string, clockSkew time.Duration) (*cache.CacheItem, error) {
 	rawEntry, ok := systemCache.Get(cache.MakeCacheKey(fmt.Sprintf("%s@%s", graphID, variantID), OperationMapping[operationName]))
 	if !ok {
 		logger.Debug("No pinned cache entry found", "operationName", operationName)
@@ -80,7 +199,7 @@ func HandlePinnedEntry(logger *slog.Logger, systemCache cache.Cache, graphID, va
 	}
 
 	var entry cache.CacheItem
-	err := json.Unmarshal([]byte(rawEntry), &entry)
+	err := cache.DecodeItem(rawEntry, &entry)
 	if err != nil {
 		logger.Error("Failed to unmarshal pinned cache entry", "operationName", operationName)
 		return nil, err
@@ -97,7 +216,7 @@ func HandlePinnedEntry(logger *slog.Logger, systemCache cache.Cache, graphID, va
 		return &entry, nil
 	}
 
-	ifAfterIDTime, err := time.Parse("2006-01-02T15:04:05Z0700", ifAfterID)
+	ifAfterIDTime, err := util.ParseUplinkTimestamp(ifAfterID)
 	if err != nil {
 		logger.Error("Failed to parse ifAfterId time", "operationName", operationName)
 		return nil, err
@@ -109,7 +228,8 @@ func HandlePinnedEntry(logger *slog.Logger, systemCache cache.Cache, graphID, va
 
 	// The entry's last modified time is newer than the ifAfterId time, return the entry in it's entirety
 	// ifAfterId indicates the last time the client has seen the data, and as such, a newly modified entry indicates the client should receive the new data
-	if entry.LastModified.After(ifAfterIDTime) {
+	// The clocks of the relay and the router may differ slightly, so entries modified within the skew before the ifAfterId time count as newer
+	if entry.LastModified.After(ifAfterIDTime.Add(-clockSkew)) {
 		return &entry, nil
 	}
 
@@ -3,9 +3,13 @@ package pinning
 import (
 	"apollosolutions/uplink-relay/cache"
 	"apollosolutions/uplink-relay/config"
+	"apollosolutions/uplink-relay/internal/relayerrors"
 	"apollosolutions/uplink-relay/logger"
 	"apollosolutions/uplink-relay/uplink"
+	"context"
+	"errors"
 	"net/http"
+	"net/http/httptest"
 	"testing"
 	"time"
 
@@ -28,7 +32,7 @@ func TestHandlePinnedEntry(t *testing.T) {
 	systemCache.Set(cache.MakeCacheKey("sampleGraphID@sampleVariantID", SupergraphPinned), string(sampleEntryBytes[:]), -1)
 
 	// Call the HandlePinnedEntry function
-	cacheItem, err := HandlePinnedEntry(logger, systemCache, "sampleGraphID", "sampleVariantID", uplink.SupergraphQuery, "")
+	cacheItem, err := HandlePinnedEntry(logger, systemCache, "sampleGraphID", "sampleVariantID", uplink.SupergraphQuery, "", 0)
 	if err != nil {
 		t.Errorf("HandlePinnedEntry returned an error: %v", err)
 	}
@@ -49,7 +53,7 @@ func TestHandlePinnedEntry(t *testing.T) {
 	}
 
 	// Call with an ifAfterId set to ensure it returns the correct values
-	cacheItem, err = HandlePinnedEntry(logger, systemCache, "sampleGraphID", "sampleVariantID", uplink.SupergraphQuery, time.Now().UTC().Add(time.Hour*2).Format("2006-01-02T15:04:05.000Z"))
+	cacheItem, err = HandlePinnedEntry(logger, systemCache, "sampleGraphID", "sampleVariantID", uplink.SupergraphQuery, time.Now().UTC().Add(time.Hour*2).Format("2006-01-02T15:04:05.000Z"), 0)
 	if err != nil {
 		t.Errorf("HandlePinnedEntry returned an error: %v", err)
 	}
@@ -63,7 +67,7 @@ func TestHandlePinnedEntry(t *testing.T) {
 
 	// test the logic for PQs
 	systemCache.Set(cache.MakeCacheKey("sampleGraphID@sampleVariantID", PersistedQueriesPinned), string(sampleEntryBytes[:]), -1)
-	cacheItem, err = HandlePinnedEntry(logger, systemCache, "sampleGraphID", "sampleVariantID", uplink.PersistedQueriesQuery, time.Now().UTC().Add(time.Hour*2).Format("2006-01-02T15:04:05.000Z"))
+	cacheItem, err = HandlePinnedEntry(logger, systemCache, "sampleGraphID", "sampleVariantID", uplink.PersistedQueriesQuery, time.Now().UTC().Add(time.Hour*2).Format("2006-01-02T15:04:05.000Z"), 0)
 	if err != nil {
 		t.Errorf("HandlePinnedEntry returned an error: %v", err)
 	}
@@ -85,7 +89,7 @@ func TestHandlePinnedEntry(t *testing.T) {
 	sampleEntryBytes, _ = json.Marshal(sampleEntry)
 	systemCache.Set(cache.MakeCacheKey("sampleGraphID@sampleVariantID", PersistedQueriesPinned), string(sampleEntryBytes[:]), -1)
 
-	cacheItem, err = HandlePinnedEntry(logger, systemCache, "sampleGraphID", "sampleVariantID", uplink.PersistedQueriesQuery, time.Now().UTC().Format("2006-01-02T15:04:05.000Z"))
+	cacheItem, err = HandlePinnedEntry(logger, systemCache, "sampleGraphID", "sampleVariantID", uplink.PersistedQueriesQuery, time.Now().UTC().Format("2006-01-02T15:04:05.000Z"), 0)
 	if err != nil {
 		t.Errorf("HandlePinnedEntry returned an error: %v", err)
 	}
@@ -95,6 +99,39 @@ func TestHandlePinnedEntry(t *testing.T) {
 		t.Errorf("HandlePinnedEntry returned an empty cache item")
 	}
 }
+func TestHandlePinnedEntryClockSkew(t *testing.T) {
+	logger := logger.MakeLogger(nil)
+	systemCache := cache.NewMemoryCache(10)
+	pinnedAt := time.Date(2024, 2, 9, 19, 34, 43, 0, time.UTC)
+	entry, _ := json.Marshal(cache.CacheItem{LastModified: pinnedAt, Content: []byte("pinned"), ID: "launch", Expiration: cache.IndefiniteTimestamp})
+	systemCache.Set(cache.MakeCacheKey("graph@current", SupergraphPinned), string(entry), -1)
+
+	tests := []struct {
+		name      string
+		ifAfterID string
+		clockSkew time.Duration
+		full      bool // Whether the pinned entry is served in full rather than as unchanged.
+	}{
+		{name: "fractional seconds before", ifAfterID: "2024-02-09T19:34:42.322688Z", full: true},
+		{name: "fractional seconds after", ifAfterID: "2024-02-09T19:34:43.322688000Z", full: false},
+		{name: "skewed within tolerance", ifAfterID: "2024-02-09T19:34:45.5+00:00", clockSkew: 5 * time.Second, full: true},
+		{name: "skewed without tolerance", ifAfterID: "2024-02-09T19:34:45.5+00:00", full: false},
+		{name: "skewed offset without colon", ifAfterID: "2024-02-09T19:34:47+0000", clockSkew: 5 * time.Second, full: true},
+		{name: "beyond tolerance", ifAfterID: "2024-02-09T19:34:49.000000001Z", clockSkew: 5 * time.Second, full: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cacheItem, err := HandlePinnedEntry(logger, systemCache, "graph", "current", uplink.SupergraphQuery, tt.ifAfterID, tt.clockSkew)
+			if err != nil {
+				t.Fatalf("Unexpected error for ifAfterId %s: %v", tt.ifAfterID, err)
+			}
+			if full := cacheItem.Content != nil; full != tt.full {
+				t.Errorf("Expected the entry to be served in full: %v, got %v", tt.full, full)
+			}
+		})
+	}
+}
+
 func TestInsertPinnedCacheEntry(t *testing.T) {
 	logger := logger.MakeLogger(nil)
 	systemCache := cache.NewMemoryCache(10)
@@ -103,7 +140,7 @@ func TestInsertPinnedCacheEntry(t *testing.T) {
 	key := "sampleKey"
 	value := "sampleValue"
 	id := "sampleID"
-	insertPinnedCacheEntry(logger, systemCache, key, value, id, time.Now())
+	insertPinnedCacheEntry(logger, systemCache, key, value, id, "", time.Now())
 
 	// Retrieve the cache item
 	cacheItemBytes, ok := systemCache.Get(key)
@@ -142,6 +179,9 @@ func TestFindAPIKey(t *testing.T) {
 				GraphRef:  "graph3",
 				ApolloKey: "key3",
 			},
+			{
+				GraphRef: "graph5",
+			},
 		},
 	}
 
@@ -161,8 +201,23 @@ func TestFindAPIKey(t *testing.T) {
 	// Call with an invalid graph reference
 	graphRef = "graph4"
 	_, err = findAPIKey(userConfig, graphRef)
-	if err == nil {
-		t.Errorf("Expected error when finding API key with invalid graph reference")
+	if !errors.Is(err, relayerrors.ErrGraphNotFound) {
+		t.Errorf("Expected ErrGraphNotFound when finding API key with invalid graph reference, got %v", err)
+	}
+
+	// Call with a graph without an API key
+	_, err = findAPIKey(userConfig, "graph5")
+	if !errors.Is(err, relayerrors.ErrAPIKeyMissing) {
+		t.Errorf("Expected ErrAPIKeyMissing when finding API key for a graph without one, got %v", err)
+	}
+
+	// A graph without an API key falls back to the default key, while a graph's own key overrides it
+	userConfig.Uplink.DefaultApolloKey = "defaultKey"
+	if apiKey, err := findAPIKey(userConfig, "graph5"); err != nil || apiKey != "defaultKey" {
+		t.Errorf("Expected the default API key for a graph without one, got %s (%v)", apiKey, err)
+	}
+	if apiKey, err := findAPIKey(userConfig, "graph2"); err != nil || apiKey != "key2" {
+		t.Errorf("Expected the graph's own API key to override the default, got %s (%v)", apiKey, err)
 	}
 }
 
@@ -192,3 +247,132 @@ func TestDefaultHeaders(t *testing.T) {
 		t.Errorf("Incorrect Content-Type header. Expected: %s, Got: %s", expectedContentTypeHeader, contentTypeHeader)
 	}
 }
+
+func TestStudioRequestRetries(t *testing.T) {
+	studioRetryBackoff = time.Millisecond
+	userConfig := config.NewDefaultConfig()
+	logger := logger.MakeLogger(nil)
+
+	// Create a flaky test server that fails the first two requests
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests <= 2 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`{"data":{}}`))
+	}))
+	defer server.Close()
+	userConfig.Uplink.StudioAPIURL = server.URL
+
+	// Test case 1: Transient failures are retried
+	_, err := studioRequest(context.Background(), userConfig, logger, http.DefaultClient, "key", []byte(`{}`))
+	if err != nil {
+		t.Errorf("Expected the request to succeed after retries, got %v", err)
+	}
+	if requests != 3 {
+		t.Errorf("Expected 3 requests, got %d", requests)
+	}
+
+	// Test case 2: Retries are exhausted
+	requests = -10
+	_, err = studioRequest(context.Background(), userConfig, logger, http.DefaultClient, "key", []byte(`{}`))
+	if !errors.Is(err, ErrStudioTransient) {
+		t.Errorf("Expected a transient error, got %v", err)
+	}
+	if requests != -10+*userConfig.Uplink.StudioRetryCount+1 {
+		t.Errorf("Expected %d requests, got %d", *userConfig.Uplink.StudioRetryCount+1, requests+10)
+	}
+}
+
+func TestStudioRequestCancelledBackoff(t *testing.T) {
+	studioRetryBackoff = time.Hour
+	defer func() { studioRetryBackoff = time.Millisecond }()
+	userConfig := config.NewDefaultConfig()
+	logger := logger.MakeLogger(nil)
+
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+	userConfig.Uplink.StudioAPIURL = server.URL
+
+	// The backoff is cut short once the request is cancelled, rather than sleeping through it
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := studioRequest(ctx, userConfig, logger, http.DefaultClient, "key", []byte(`{}`))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected the request to be cancelled, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Expected the backoff to stop once cancelled, but it took %s", elapsed)
+	}
+	if requests != 1 {
+		t.Errorf("Expected 1 request before the backoff, got %d", requests)
+	}
+}
+
+func TestStudioRequestNoRetries(t *testing.T) {
+	studioRetryBackoff = time.Millisecond
+	userConfig := config.NewDefaultConfig()
+	noRetries := 0
+	userConfig.Uplink.StudioRetryCount = &noRetries
+
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+	userConfig.Uplink.StudioAPIURL = server.URL
+
+	// A studioRetryCount of 0 sends the request once
+	if _, err := studioRequest(context.Background(), userConfig, logger.MakeLogger(nil), http.DefaultClient, "key", []byte(`{}`)); !errors.Is(err, ErrStudioTransient) {
+		t.Errorf("Expected a transient error, got %v", err)
+	}
+	if requests != 1 {
+		t.Errorf("Expected 1 request, got %d", requests)
+	}
+}
+
+func TestStudioRequestClassification(t *testing.T) {
+	studioRetryBackoff = time.Millisecond
+	userConfig := config.NewDefaultConfig()
+	logger := logger.MakeLogger(nil)
+
+	tests := []struct {
+		status   int
+		body     string
+		expected error
+	}{
+		{status: http.StatusUnauthorized, expected: ErrStudioUnauthorized},
+		{status: http.StatusForbidden, expected: ErrStudioUnauthorized},
+		{status: http.StatusNotFound, expected: ErrStudioNotFound},
+		{status: http.StatusOK, body: `{"errors":[{"message":"invalid key","extensions":{"code":"UNAUTHENTICATED"}}]}`, expected: ErrStudioUnauthorized},
+	}
+
+	for _, test := range tests {
+		requests := 0
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests++
+			w.WriteHeader(test.status)
+			w.Write([]byte(test.body))
+		}))
+		userConfig.Uplink.StudioAPIURL = server.URL
+
+		_, err := studioRequest(context.Background(), userConfig, logger, http.DefaultClient, "key", []byte(`{}`))
+		if !errors.Is(err, test.expected) {
+			t.Errorf("Expected %v for status %d, got %v", test.expected, test.status, err)
+		}
+		// Non-transient failures shouldn't be retried
+		if requests != 1 {
+			t.Errorf("Expected 1 request for status %d, got %d", test.status, requests)
+		}
+		server.Close()
+	}
+}
@@ -1,16 +1,14 @@
 package pinning
 
 import (
+	"apollosolutions/uplink-relay/audit"
 	"apollosolutions/uplink-relay/cache"
 	"apollosolutions/uplink-relay/config"
 	"apollosolutions/uplink-relay/internal/util"
-	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
-	"io"
 	"log/slog"
-	"net/http"
-	"time"
 )
 
 type LaunchQueryResponse struct {
@@ -47,10 +45,8 @@ type LaunchQueryVariantLaunch struct {
 
 func PinLaunchID(userConfig *config.Config, logger *slog.Logger, systemCache cache.Cache, launchID string, graphRef string) error {
 	logger.Debug("Pinning launch ID", "launchID", launchID, "graphRef", graphRef)
-	// Configure the HTTP client with a timeout.
-	httpClient := &http.Client{
-		Timeout: time.Duration(userConfig.Uplink.Timeout) * time.Second,
-	}
+	// Configure the HTTP client with the uplink timeouts.
+	httpClient := util.NewHTTPClient(userConfig)
 
 	graphID, variantID, err := util.ParseGraphRef(graphRef)
 	if err != nil {
@@ -104,21 +100,11 @@ func PinLaunchID(userConfig *config.Config, logger *slog.Logger, systemCache cac
 		return err
 	}
 
-	req, err := http.NewRequest("POST", userConfig.Uplink.StudioAPIURL, bytes.NewBuffer(requestBody))
-	if err != nil {
-		logger.Error("Error creating request", "err", err)
-		return err
-	}
-	req = defaultHeaders(req, apiKey)
-
-	resp, err := httpClient.Do(req)
+	bodyBytes, err := studioRequest(audit.WithCall(context.Background(), graphRef, "UplinkRelay_GetLaunchIDSchema"), userConfig, logger, httpClient, apiKey, requestBody)
 	if err != nil {
 		logger.Error("Error sending request", "err", err)
 		return err
 	}
-	defer resp.Body.Close()
-	// Read the response body
-	bodyBytes, _ := io.ReadAll(resp.Body)
 
 	var apiResponse LaunchQueryResponse
 	err = json.Unmarshal(bodyBytes, &apiResponse)
@@ -129,7 +115,7 @@ func PinLaunchID(userConfig *config.Config, logger *slog.Logger, systemCache cac
 
 	if apiResponse.Data.Graph == nil {
 		logger.Error("Failed to get launch ID schema", "graphRef", graphRef, "launchID", launchID)
-		return fmt.Errorf("failed to get launch ID schema")
+		return fmt.Errorf("%w: failed to get launch ID schema", ErrStudioNotFound)
 	}
 
 	if apiResponse.Data.Graph.Variant.Launch.Build.Result.Typename == "BuildFailure" {
@@ -137,7 +123,7 @@ func PinLaunchID(userConfig *config.Config, logger *slog.Logger, systemCache cac
 		return fmt.Errorf("failed to get launch ID schema")
 	}
 
-	modifiedAt, err := time.Parse(time.RFC3339, apiResponse.Data.Graph.Variant.Launch.CompletedAt)
+	modifiedAt, err := util.ParseUplinkTimestamp(apiResponse.Data.Graph.Variant.Launch.CompletedAt)
 	if err != nil {
 		logger.Error("Failed to parse completedAt", "completedAt", apiResponse.Data.Graph.Variant.Launch.CompletedAt)
 		return err
@@ -146,7 +132,7 @@ func PinLaunchID(userConfig *config.Config, logger *slog.Logger, systemCache cac
 	// Store the core schema in the cache
 	if userConfig.Cache.Enabled {
 		cacheKey := cache.MakeCacheKey(graphRef, SupergraphPinned)
-		insertPinnedCacheEntry(logger, systemCache, cacheKey, apiResponse.Data.Graph.Variant.Launch.Build.Result.CoreSchema.CoreDocument, apiResponse.Data.Graph.Variant.ID, modifiedAt)
+		insertPinnedCacheEntry(logger, systemCache, cacheKey, apiResponse.Data.Graph.Variant.Launch.Build.Result.CoreSchema.CoreDocument, apiResponse.Data.Graph.Variant.ID, launchID, modifiedAt)
 	}
 	// now finally update the config to the new pinned version to handle the case where the management API updated the launchID
 	configs := []config.SupergraphConfig{}
@@ -159,3 +145,129 @@ func PinLaunchID(userConfig *config.Config, logger *slog.Logger, systemCache cac
 	userConfig.Supergraphs = configs
 	return nil
 }
+
+type LaunchHistoryQueryResponse struct {
+	Data struct {
+		Graph *struct {
+			Variant *struct {
+				LaunchHistory []LaunchHistoryQueryLaunch `json:"launchHistory"`
+			} `json:"variant"`
+		} `json:"graph"`
+	} `json:"data"`
+}
+
+type LaunchHistoryQueryLaunch struct {
+	ID    string `json:"id"`
+	Build *struct {
+		Result *struct {
+			Typename string `json:"__typename"`
+			// Only exists if __typename is "BuildSuccess"
+			CoreSchema struct {
+				CoreHash string `json:"coreHash"`
+			} `json:"coreSchema"`
+		} `json:"result"`
+	} `json:"build"`
+}
+
+// launchHistoryLimit is the number of recent launches searched when resolving a schema hash to a launch.
+const launchHistoryLimit = 100
+
+// PinSchemaByHash resolves the launch that built the schema with the given core schema hash and pins it, the same as PinLaunchID.
+// If a raw SDL document is provided instead of a hash, the hash is calculated from the document.
+func PinSchemaByHash(userConfig *config.Config, logger *slog.Logger, systemCache cache.Cache, hash string, sdl string, graphRef string) error {
+	if hash == "" && sdl == "" {
+		return fmt.Errorf("either a schema hash or SDL document is required")
+	}
+	if hash == "" {
+		hash = util.HashString(sdl)
+	}
+	logger.Debug("Pinning schema hash", "hash", hash, "graphRef", graphRef)
+
+	launchID, err := findLaunchIDByHash(userConfig, logger, hash, graphRef)
+	if err != nil {
+		return err
+	}
+	logger.Debug("Resolved schema hash to launch ID", "hash", hash, "launchID", launchID, "graphRef", graphRef)
+	return PinLaunchID(userConfig, logger, systemCache, launchID, graphRef)
+}
+
+// findLaunchIDByHash searches the variant's recent launches for a successful build with the given core schema hash.
+func findLaunchIDByHash(userConfig *config.Config, logger *slog.Logger, hash string, graphRef string) (string, error) {
+	// Configure the HTTP client with the uplink timeouts.
+	httpClient := util.NewHTTPClient(userConfig)
+
+	graphID, variantID, err := util.ParseGraphRef(graphRef)
+	if err != nil {
+		logger.Error("Failed to parse GraphRef", "graphRef", graphRef)
+		return "", err
+	}
+
+	apiKey, err := findAPIKey(userConfig, graphRef)
+	if err != nil {
+		logger.Error("Failed to find API key", "graphRef", graphRef)
+		return "", err
+	}
+
+	requestBody, err := json.Marshal(&PinningAPIRequest{
+		Query: `
+		query UplinkRelay_GetLaunchHistory($graphId: ID!, $name: String!, $limit: Int) {
+			graph(id: $graphId) {
+				variant(name: $name) {
+					launchHistory(limit: $limit) {
+						id
+						build {
+							result {
+								__typename
+								... on BuildSuccess {
+									coreSchema {
+										coreHash
+									}
+								}
+							}
+						}
+					}
+				}
+			}
+		}
+		`,
+		Variables: map[string]interface{}{
+			"graphId": graphID,
+			"name":    variantID,
+			"limit":   launchHistoryLimit,
+		},
+		OperationName: "UplinkRelay_GetLaunchHistory",
+	})
+	if err != nil {
+		logger.Error("Error preparing request body", "err", err)
+		return "", err
+	}
+
+	bodyBytes, err := studioRequest(audit.WithCall(context.Background(), graphRef, "UplinkRelay_GetLaunchHistory"), userConfig, logger, httpClient, apiKey, requestBody)
+	if err != nil {
+		logger.Error("Error sending request", "err", err)
+		return "", err
+	}
+
+	var apiResponse LaunchHistoryQueryResponse
+	err = json.Unmarshal(bodyBytes, &apiResponse)
+	if err != nil {
+		logger.Error("Error unmarshalling response", "err", err)
+		return "", err
+	}
+
+	if apiResponse.Data.Graph == nil || apiResponse.Data.Graph.Variant == nil {
+		logger.Error("Failed to get launch history", "graphRef", graphRef)
+		return "", fmt.Errorf("%w: failed to get launch history for %s", ErrStudioNotFound, graphRef)
+	}
+
+	for _, launch := range apiResponse.Data.Graph.Variant.LaunchHistory {
+		if launch.Build == nil || launch.Build.Result == nil || launch.Build.Result.Typename != "BuildSuccess" {
+			continue
+		}
+		if launch.Build.Result.CoreSchema.CoreHash == hash {
+			return launch.ID, nil
+		}
+	}
+	logger.Error("Failed to find launch for schema hash", "graphRef", graphRef, "hash", hash)
+	return "", fmt.Errorf("%w: no launch found for schema hash %s in the last %d launches", ErrStudioNotFound, hash, launchHistoryLimit)
+}
@@ -3,7 +3,10 @@ package pinning
 import (
 	"apollosolutions/uplink-relay/cache"
 	"apollosolutions/uplink-relay/config"
+	"apollosolutions/uplink-relay/internal/util"
 	"apollosolutions/uplink-relay/logger"
+	"encoding/json"
+	"errors"
 	"net/http"
 	"net/http/httptest"
 	"testing"
@@ -43,3 +46,97 @@ func TestPinLaunchID(t *testing.T) {
 		t.Errorf("PinLaunchID returned an error: %v", err)
 	}
 }
+
+func TestPinSchemaByHash(t *testing.T) {
+	userConfig := config.NewDefaultConfig()
+	userConfig.Supergraphs = []config.SupergraphConfig{
+		{
+			GraphRef:  "graphID@variantID",
+			ApolloKey: "1234",
+		},
+	}
+
+	sdl := "sampleSchema"
+	hash := util.HashString(sdl)
+
+	// Mock the Platform API, returning the launch history or the launch's schema depending on the operation
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request PinningAPIRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			t.Fatalf("Failed to decode request: %v", err)
+		}
+		w.WriteHeader(http.StatusOK)
+		switch request.OperationName {
+		case "UplinkRelay_GetLaunchHistory":
+			w.Write([]byte(`{"data":{"graph":{"variant":{"launchHistory":[` +
+				`{"id":"failed","build":{"result":{"__typename":"BuildFailure"}}},` +
+				`{"id":"other","build":{"result":{"__typename":"BuildSuccess","coreSchema":{"coreHash":"abc"}}}},` +
+				`{"id":"12345","build":{"result":{"__typename":"BuildSuccess","coreSchema":{"coreHash":"` + hash + `"}}}}` +
+				`]}}}}`))
+		default:
+			if request.Variables["launchId"] != "12345" {
+				t.Errorf("Expected launch ID 12345, got %v", request.Variables["launchId"])
+			}
+			w.Write([]byte(`{"data":{"graph":{"variant":{"id":"graphID@variantID","launch":{"completedAt":"2024-08-05T19:53:30.358994000Z","build":{"result":{"__typename":"BuildSuccess","coreSchema":{"coreDocument":"sampleSchema"}}}}}}}}`))
+		}
+	}))
+	defer server.Close()
+
+	userConfig.Uplink.StudioAPIURL = server.URL
+
+	logger := logger.MakeLogger(nil)
+	systemCache := cache.NewMemoryCache(10)
+	graphRef := "graphID@variantID"
+
+	// Pinning by hash and by SDL should both resolve to the same launch
+	if err := PinSchemaByHash(userConfig, logger, systemCache, hash, "", graphRef); err != nil {
+		t.Fatalf("PinSchemaByHash returned an error: %v", err)
+	}
+	if err := PinSchemaByHash(userConfig, logger, systemCache, "", sdl, graphRef); err != nil {
+		t.Fatalf("PinSchemaByHash returned an error: %v", err)
+	}
+
+	if _, ok := systemCache.Get(cache.MakeCacheKey(graphRef, SupergraphPinned)); !ok {
+		t.Errorf("Expected the pinned supergraph to be cached")
+	}
+	if userConfig.Supergraphs[0].LaunchID != "12345" {
+		t.Errorf("Expected launch ID 12345 to be pinned, got %s", userConfig.Supergraphs[0].LaunchID)
+	}
+
+	// An unknown hash isn't pinned
+	err := PinSchemaByHash(userConfig, logger, systemCache, "unknown", "", graphRef)
+	if !errors.Is(err, ErrStudioNotFound) {
+		t.Errorf("Expected ErrStudioNotFound, got %v", err)
+	}
+
+	if err := PinSchemaByHash(userConfig, logger, systemCache, "", "", graphRef); err == nil {
+		t.Errorf("Expected an error when neither a hash nor SDL is provided")
+	}
+}
+
+func TestIsLaunchIDCached(t *testing.T) {
+	userConfig := config.NewDefaultConfig()
+	userConfig.Supergraphs = []config.SupergraphConfig{{GraphRef: "graphID@variantID", ApolloKey: "1234"}}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"data":{"graph":{"variant":{"id":"graphID@variantID","launch":{"completedAt":"2024-08-05T19:53:30.358994000Z","build":{"result":{"__typename":"BuildSuccess","coreSchema":{"coreDocument":"sampleSchema"}}}}}}}}`))
+	}))
+	defer server.Close()
+	userConfig.Uplink.StudioAPIURL = server.URL
+	systemCache := cache.NewMemoryCache(10)
+
+	if IsLaunchIDCached(systemCache, "graphID@variantID", "12345") {
+		t.Errorf("Expected the launch ID not to be cached before pinning")
+	}
+	if err := PinLaunchID(userConfig, logger.MakeLogger(nil), systemCache, "12345", "graphID@variantID"); err != nil {
+		t.Fatalf("PinLaunchID returned an error: %v", err)
+	}
+	if !IsLaunchIDCached(systemCache, "graphID@variantID", "12345") {
+		t.Errorf("Expected the pinned launch ID to be cached")
+	}
+	if IsLaunchIDCached(systemCache, "graphID@variantID", "67890") {
+		t.Errorf("Expected a different launch ID not to be cached")
+	}
+	if IsLaunchIDCached(systemCache, "graphID@otherVariant", "12345") {
+		t.Errorf("Expected the launch ID not to be cached for another graph")
+	}
+}
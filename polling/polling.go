@@ -1,19 +1,24 @@
 package polling
 
 import (
+	"apollosolutions/uplink-relay/audit"
 	"apollosolutions/uplink-relay/cache"
 	"apollosolutions/uplink-relay/config"
 	"apollosolutions/uplink-relay/entitlements"
 	"apollosolutions/uplink-relay/internal/util"
+	"apollosolutions/uplink-relay/metrics"
 	persistedqueries "apollosolutions/uplink-relay/persisted_queries"
 	"apollosolutions/uplink-relay/schema"
 	"apollosolutions/uplink-relay/uplink"
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"io"
 	"log/slog"
 	"net/http"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/robfig/cron/v3"
@@ -28,24 +33,39 @@ func StartPolling(userConfig *config.Config, systemCache cache.Cache, httpClient
 		return
 	}
 
+	// Cancel in-flight fetches as soon as polling is stopped, rather than waiting for them to time out
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-stopPolling:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
 	// immediately poll for updates
-	pollForUpdates(userConfig, systemCache, httpClient, logger)
+	pollForUpdates(ctx, userConfig, systemCache, httpClient, logger)
 
 	if userConfig.Polling.Interval > 0 {
+		interval := time.Duration(userConfig.Polling.Interval) * time.Second
 		// Create a new ticker with the polling interval
-		ticker := time.NewTicker(time.Duration(userConfig.Polling.Interval) * time.Second)
+		ticker := time.NewTicker(interval)
 		// Stop the ticker when the function returns
 		defer ticker.Stop()
+		publishSchedule(userConfig, time.Now().Add(interval))
 
 		for {
 			select {
-			case <-stopPolling:
+			case <-ctx.Done():
 				logger.Debug("Polling stopped")
 				// Stop the ticker as it'll be restarted on the next call to StartPolling
 				ticker.Stop()
+				metrics.ClearNextPoll()
 				return
 			case <-ticker.C:
-				pollForUpdates(userConfig, systemCache, httpClient, logger)
+				publishSchedule(userConfig, time.Now().Add(interval))
+				pollForUpdates(ctx, userConfig, systemCache, httpClient, logger)
 			}
 		}
 	}
@@ -61,22 +81,42 @@ func StartPolling(userConfig *config.Config, systemCache cache.Cache, httpClient
 
 			// Add a new cron job to poll for updates
 			crons.AddFunc(expression, func() {
-				pollForUpdates(userConfig, systemCache, httpClient, logger)
+				publishSchedule(userConfig, nextCronRun(crons))
+				pollForUpdates(ctx, userConfig, systemCache, httpClient, logger)
 			})
 		}
 		// Start the cron schedule
 		crons.Start()
+		publishSchedule(userConfig, nextCronRun(crons))
 
-		for range stopPolling {
-			logger.Debug("Polling stopped")
-			crons.Stop()
-			return
-		}
+		<-ctx.Done()
+		logger.Debug("Polling stopped")
+		crons.Stop()
+		metrics.ClearNextPoll()
+	}
+
+}
+
+// publishSchedule records the next scheduled poll for every configured graph.
+func publishSchedule(userConfig *config.Config, next time.Time) {
+	for _, supergraphConfig := range userConfig.Supergraphs {
+		metrics.SetNextPoll(supergraphConfig.GraphRef, next)
 	}
+}
 
+// nextCronRun returns the earliest next run across all cron entries.
+func nextCronRun(crons *cron.Cron) time.Time {
+	var next time.Time
+	for _, entry := range crons.Entries() {
+		// the entry currently running has already advanced its Next to the following run
+		if next.IsZero() || (!entry.Next.IsZero() && entry.Next.Before(next)) {
+			next = entry.Next
+		}
+	}
+	return next
 }
 
-func pollForUpdates(userConfig *config.Config, systemCache cache.Cache, httpClient *http.Client, logger *slog.Logger) {
+func pollForUpdates(ctx context.Context, userConfig *config.Config, systemCache cache.Cache, httpClient *http.Client, logger *slog.Logger) {
 	if !userConfig.Polling.Enabled {
 		logger.Debug("Polling is disabled for graph")
 		return
@@ -87,74 +127,168 @@ func pollForUpdates(userConfig *config.Config, systemCache cache.Cache, httpClie
 		return
 	}
 
-	for _, supergraphConfig := range userConfig.Supergraphs {
-		// Poll for the graph
-		success := false
-		for i := 0; i < userConfig.Polling.RetryCount && !success; i++ {
-			logger.Debug("Polling for graph", "graphRef", supergraphConfig.GraphRef)
-			logger.Debug("Options enabled", "supergraph", *userConfig.Polling.Supergraph, "entitlements", *userConfig.Polling.Entitlements, "persistedQueries", *userConfig.Polling.PersistedQueries)
-			// Split the graph into GraphID and VariantID
-			parts := strings.Split(supergraphConfig.GraphRef, "@")
-			if len(parts) != 2 {
-				logger.Error("Invalid GraphRef", "graphRef", supergraphConfig.GraphRef)
+	// Bound the whole cycle, so graphs that hang can't make it overrun the polling interval and pile up
+	if userConfig.Polling.CycleTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(userConfig.Polling.CycleTimeout)*time.Second)
+		defer cancel()
+	}
+
+	// Poll the graphs concurrently, bounded by the concurrency limit, so one slow graph doesn't delay the rest
+	concurrency := userConfig.Polling.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	workers := make(chan struct{}, concurrency)
+	var mu sync.Mutex
+	results := make(map[int]bool, len(userConfig.Supergraphs)) // Results of the graphs polled so far, by index.
+	var wg sync.WaitGroup
+	for i, supergraphConfig := range userConfig.Supergraphs {
+		// Graphs that haven't started once the cycle is over are skipped
+		if !acquireWorker(ctx, workers) {
+			break
+		}
+		wg.Add(1)
+		go func(i int, supergraphConfig config.SupergraphConfig) {
+			defer wg.Done()
+			defer func() { <-workers }()
+			success := pollGraph(ctx, userConfig, systemCache, httpClient, logger, supergraphConfig)
+			mu.Lock()
+			results[i] = success
+			mu.Unlock()
+		}(i, supergraphConfig)
+	}
+	finished := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(finished)
+	}()
+	// In-flight fetches are cancelled with the context, but graphs that don't return promptly are abandoned rather than waited for
+	select {
+	case <-finished:
+	case <-ctx.Done():
+	}
+
+	// Aggregate the per-graph results
+	mu.Lock()
+	defer mu.Unlock()
+	failed := []string{}
+	skipped := []string{}
+	for i, supergraphConfig := range userConfig.Supergraphs {
+		success, polled := results[i]
+		if !polled {
+			skipped = append(skipped, supergraphConfig.GraphRef)
+		} else if !success {
+			failed = append(failed, supergraphConfig.GraphRef)
+		}
+	}
+	if len(skipped) > 0 && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		logger.Warn("Polling cycle timed out, skipping the remaining graphs", "cycleTimeout", userConfig.Polling.CycleTimeout, "skipped", len(skipped), "skippedGraphRefs", skipped)
+	} else if len(skipped) > 0 {
+		logger.Debug("Polling stopped, skipping the remaining graphs", "skippedGraphRefs", skipped)
+	}
+	succeeded := len(results) - len(failed)
+	if len(failed) > 0 {
+		logger.Warn("Polling completed with failures", "succeeded", succeeded, "failed", len(failed), "failedGraphRefs", failed)
+	} else {
+		logger.Debug("Polling completed", "succeeded", succeeded)
+	}
+}
+
+// acquireWorker waits for a free worker slot, returning false without taking one if the context is done first.
+func acquireWorker(ctx context.Context, workers chan struct{}) bool {
+	select {
+	case workers <- struct{}{}:
+		// Both cases may be ready at once, so don't start a graph once the context is done
+		if ctx.Err() != nil {
+			<-workers
+			return false
+		}
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// pollGraph polls uplink for the enabled artifacts of a single graph, retrying on failure. It returns whether polling succeeded.
+func pollGraph(ctx context.Context, userConfig *config.Config, systemCache cache.Cache, httpClient *http.Client, logger *slog.Logger, supergraphConfig config.SupergraphConfig) bool {
+	// Poll for the graph
+	success := false
+	for i := 0; i < userConfig.Polling.RetryCount && !success && ctx.Err() == nil; i++ {
+		logger.Debug("Polling for graph", "graphRef", supergraphConfig.GraphRef)
+		logger.Debug("Options enabled", "supergraph", *userConfig.Polling.Supergraph, "entitlements", *userConfig.Polling.Entitlements, "persistedQueries", *userConfig.Polling.PersistedQueries)
+		// Split the graph into GraphID and VariantID
+		parts := strings.Split(supergraphConfig.GraphRef, "@")
+		if len(parts) != 2 {
+			logger.Error("Invalid GraphRef", "graphRef", supergraphConfig.GraphRef)
+			break
+		}
+
+		// Fetch the schema for the graph if enabled and the launch ID is not set as launchID implies a static schema
+		if *userConfig.Polling.Supergraph && supergraphConfig.LaunchID == "" {
+			logger.Debug("Polling for supergraph", "graphRef", supergraphConfig.GraphRef)
+			// Only download the supergraph if it changed since the cached one
+			ifAfterId := ""
+			if *userConfig.Polling.OnlyChanged {
+				ifAfterId = schema.CachedSchemaID(systemCache, supergraphConfig.GraphRef)
+			}
+			err := schema.FetchSchema(ctx, userConfig, systemCache, logger, supergraphConfig.GraphRef, ifAfterId)
+			if err != nil {
+				logger.Error("Failed to fetch schema", "graphRef", supergraphConfig.GraphRef, "err", err)
 				break
 			}
+		}
 
-			// Fetch the schema for the graph if enabled and the launch ID is not set as launchID implies a static schema
-			if *userConfig.Polling.Supergraph && supergraphConfig.LaunchID == "" {
-				logger.Debug("Polling for supergraph", "graphRef", supergraphConfig.GraphRef)
-				err := schema.FetchSchema(userConfig, systemCache, logger, supergraphConfig.GraphRef)
-				if err != nil {
-					logger.Error("Failed to fetch schema", "graphRef", supergraphConfig.GraphRef, "err", err)
-					break
-				}
+		// Fetch the router license if enabled and the offline license is not set
+		if *userConfig.Polling.Entitlements && supergraphConfig.OfflineLicense == "" {
+			logger.Debug("Polling for router license", "graphRef", supergraphConfig.GraphRef)
+			err := entitlements.FetchRouterLicense(ctx, userConfig, systemCache, logger, supergraphConfig.GraphRef)
+			if err != nil {
+				logger.Error("Failed to fetch router license", "graphRef", supergraphConfig.GraphRef, "err", err)
+				break
 			}
+		}
 
-			// Fetch the router license if enabled and the offline license is not set
-			if *userConfig.Polling.Entitlements && supergraphConfig.OfflineLicense == "" {
-				logger.Debug("Polling for router license", "graphRef", supergraphConfig.GraphRef)
-				err := entitlements.FetchRouterLicense(userConfig, systemCache, logger, supergraphConfig.GraphRef)
-				if err != nil {
-					logger.Error("Failed to fetch router license", "graphRef", supergraphConfig.GraphRef, "err", err)
-					break
-				}
+		// Fetch the persisted queries manifest if enabled and the persisted query version is not set
+		if *userConfig.Polling.PersistedQueries && supergraphConfig.PersistedQueryVersion == "" {
+			logger.Debug("Polling for persisted query manifest", "graphRef", supergraphConfig.GraphRef)
+			apiKey, err := supergraphConfig.APIKey(userConfig.Uplink.DefaultApolloKey)
+			if err != nil {
+				logger.Error("Failed to fetch persisted query manifest", "graphRef", supergraphConfig.GraphRef, "err", err)
+				break
+			}
+			persistedQueryManifest, err := FetchPQManifest(ctx, userConfig, httpClient, supergraphConfig.GraphRef, apiKey, "", logger)
+			if err != nil {
+				logger.Error("Failed to fetch persisted query manifest", "graphRef", supergraphConfig.GraphRef, "err", err)
+				break
 			}
 
-			// Fetch the persisted queries manifest if enabled and the persisted query version is not set
-			if *userConfig.Polling.PersistedQueries && supergraphConfig.PersistedQueryVersion == "" {
-				logger.Debug("Polling for persisted query manifest", "graphRef", supergraphConfig.GraphRef)
-				persistedQueryManifest, err := FetchPQManifest(userConfig, httpClient, supergraphConfig.GraphRef, supergraphConfig.ApolloKey, "", logger)
-				if err != nil {
-					logger.Error("Failed to fetch persisted query manifest", "graphRef", supergraphConfig.GraphRef, "err", err)
-					break
-				}
-
-				pqManifest, err := json.Marshal(persistedQueryManifest)
-				if err != nil {
-					logger.Error("Failed to marshal PQ manifest", "graphRef", supergraphConfig.GraphRef, "err", err)
-					break
-				}
-
-				// Update the cache
-				cacheKey := cache.MakeCacheKey(supergraphConfig.GraphRef, uplink.PersistedQueriesQuery, map[string]interface{}{"graph_ref": supergraphConfig.GraphRef, "ifAfterId": ""})
-
-				// Set the cache using the fetched license
-				logger.Debug("Updating persisted query manifest for GraphRef", "graphRef", supergraphConfig.GraphRef)
-				systemCache.Set(cacheKey, string(pqManifest[:]), userConfig.Cache.Duration)
+			pqManifest, err := json.Marshal(persistedQueryManifest)
+			if err != nil {
+				logger.Error("Failed to marshal PQ manifest", "graphRef", supergraphConfig.GraphRef, "err", err)
+				break
 			}
 
-			// If successful, log the success
-			logger.Info("Successfully polled for graph", "graphRef", supergraphConfig.GraphRef)
-			success = true
-		}
-		if !success {
-			logger.Error("Failed to poll uplink for graph", "graphRef", supergraphConfig.GraphRef, "retries", userConfig.Polling.RetryCount)
+			// Update the cache
+			cacheKey := cache.MakeCacheKey(supergraphConfig.GraphRef, uplink.PersistedQueriesQuery, map[string]interface{}{"graph_ref": supergraphConfig.GraphRef, "ifAfterId": ""})
+
+			// Set the cache using the fetched license
+			logger.Debug("Updating persisted query manifest for GraphRef", "graphRef", supergraphConfig.GraphRef)
+			systemCache.Set(cacheKey, string(pqManifest[:]), userConfig.CacheDuration())
 		}
+
+		// If successful, log the success
+		logger.Info("Successfully polled for graph", "graphRef", supergraphConfig.GraphRef)
+		success = true
+	}
+	if !success {
+		logger.Error("Failed to poll uplink for graph", "graphRef", supergraphConfig.GraphRef, "retries", userConfig.Polling.RetryCount)
 	}
+	return success
 }
 
 // FetchPQManifest fetches the persisted query (PQ) manifest for the specified graph.
-func FetchPQManifest(userConfig *config.Config, httpClient *http.Client, graphRef string, apiKey string, ifAfterId string, logger *slog.Logger) (*persistedqueries.UplinkPersistedQueryResponse, error) {
+func FetchPQManifest(ctx context.Context, userConfig *config.Config, httpClient *http.Client, graphRef string, apiKey string, ifAfterId string, logger *slog.Logger) (*persistedqueries.UplinkPersistedQueryResponse, error) {
 	// Define the request body
 	requestBody, err := json.Marshal(util.UplinkRelayRequest{
 		Variables: map[string]interface{}{
@@ -183,18 +317,18 @@ func FetchPQManifest(userConfig *config.Config, httpClient *http.Client, graphRe
 				}
 			}
 		}`,
-		OperationName: "PersistedQueriesManifestQuery",
+		OperationName: uplink.PersistedQueriesQuery,
 	})
 	if err != nil {
 		return nil, err
 	}
 
-	// Select the next uplink URL
-	selector := uplink.NewRoundRobinSelector(userConfig.Uplink.URLs)
+	// Select the next uplink URL, using the graph's own uplink URLs if it has them
+	selector := uplink.NewRoundRobinSelector(userConfig.UplinkURLsForGraph(graphRef))
 	uplinkURL := selector.Next()
 
-	// Create a new request using http
-	req, err := http.NewRequest("POST", uplinkURL, bytes.NewBuffer(requestBody))
+	// Create a new request using http, identifying the graph and operation for the audit trail
+	req, err := http.NewRequestWithContext(audit.WithCall(ctx, graphRef, uplink.PersistedQueriesQuery), "POST", uplinkURL, bytes.NewBuffer(requestBody))
 	if err != nil {
 		logger.Error("Error creating request", "err", err)
 		return nil, err
@@ -212,14 +346,16 @@ func FetchPQManifest(userConfig *config.Config, httpClient *http.Client, graphRe
 		logger.Error("Error on response", "err", err)
 		return nil, err
 	}
+	defer resp.Body.Close()
 
 	// Read the response body
 	bodyBytes, _ := io.ReadAll(resp.Body)
 
 	// Unmarshal the response body into the LicenseQueryResponse struct
 	var response persistedqueries.UplinkPersistedQueryResponse
-	err = json.Unmarshal(bodyBytes, &response)
+	err = util.DecodeUplinkResponse(bodyBytes, &response, userConfig.Uplink.StrictDecode)
 	if err != nil {
+		logger.Error("Failed to decode uplink response", "graphRef", graphRef, "err", err)
 		return nil, err
 	}
 
@@ -0,0 +1,327 @@
+package polling
+
+import (
+	"apollosolutions/uplink-relay/audit"
+	"apollosolutions/uplink-relay/cache"
+	"apollosolutions/uplink-relay/config"
+	"apollosolutions/uplink-relay/internal/util"
+	"apollosolutions/uplink-relay/logger"
+	"apollosolutions/uplink-relay/schema"
+	"apollosolutions/uplink-relay/uplink"
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPollForUpdatesConcurrency(t *testing.T) {
+	slowGraphRef := "slow@current"
+	slowDelay := 500 * time.Millisecond
+
+	var mu sync.Mutex
+	completed := map[string]time.Duration{}
+	start := time.Now()
+
+	// Mock uplink, where one graph takes much longer to respond than the others
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request util.UplinkRelayRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			t.Errorf("Failed to decode request: %v", err)
+			return
+		}
+		graphRef := request.Variables["graph_ref"].(string)
+		if graphRef == slowGraphRef {
+			time.Sleep(slowDelay)
+		}
+		w.Write([]byte(`{"data":{"routerConfig":{"__typename":"RouterConfigResult","id":"2024-02-09T19:34:43.322688000Z","supergraphSdl":"sdl","minDelaySeconds":30}}}`))
+
+		mu.Lock()
+		completed[graphRef] = time.Since(start)
+		mu.Unlock()
+	}))
+	defer server.Close()
+
+	pFalse := false
+	userConfig := config.NewDefaultConfig()
+	userConfig.Uplink.URLs = []string{server.URL}
+	userConfig.Polling.Enabled = true
+	userConfig.Polling.RetryCount = 1
+	userConfig.Polling.Entitlements = &pFalse
+	userConfig.Polling.Concurrency = 2
+	userConfig.Supergraphs = []config.SupergraphConfig{
+		{GraphRef: slowGraphRef, ApolloKey: "1234"},
+		{GraphRef: "fast1@current", ApolloKey: "1234"},
+		{GraphRef: "fast2@current", ApolloKey: "1234"},
+		{GraphRef: "fast3@current", ApolloKey: "1234"},
+	}
+
+	systemCache := cache.NewMemoryCache(100)
+	pollForUpdates(context.Background(), userConfig, systemCache, &http.Client{}, logger.MakeLogger(&pFalse))
+
+	// The fast graphs should complete while the slow graph is still being polled
+	for _, supergraph := range userConfig.Supergraphs {
+		elapsed, ok := completed[supergraph.GraphRef]
+		if !ok {
+			t.Errorf("Expected %s to be polled", supergraph.GraphRef)
+			continue
+		}
+		if supergraph.GraphRef != slowGraphRef && elapsed >= slowDelay {
+			t.Errorf("Expected %s to complete before the slow graph, but it took %s", supergraph.GraphRef, elapsed)
+		}
+
+		cacheKey := cache.MakeCacheKey(supergraph.GraphRef, uplink.SupergraphQuery, map[string]interface{}{"graph_ref": supergraph.GraphRef, "ifAfterId": ""})
+		if _, ok := systemCache.Get(cacheKey); !ok {
+			t.Errorf("Expected the schema for %s to be cached", supergraph.GraphRef)
+		}
+	}
+}
+
+func TestPollGraphOnlyChanged(t *testing.T) {
+	graphRef := "graph@current"
+	cachedID := "2024-02-09T19:34:43.322688000Z"
+
+	var receivedIfAfterId interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request util.UplinkRelayRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			t.Errorf("Failed to decode request: %v", err)
+			return
+		}
+		receivedIfAfterId = request.Variables["ifAfterId"]
+		w.Write([]byte(`{"data":{"routerConfig":{"__typename":"Unchanged","id":"2024-02-09T19:34:43.322688000Z","minDelaySeconds":30}}}`))
+	}))
+	defer server.Close()
+
+	pFalse := false
+	userConfig := config.NewDefaultConfig()
+	userConfig.Uplink.URLs = []string{server.URL}
+	userConfig.Polling.Enabled = true
+	userConfig.Polling.RetryCount = 1
+	userConfig.Polling.Entitlements = &pFalse
+	userConfig.Supergraphs = []config.SupergraphConfig{{GraphRef: graphRef, ApolloKey: "1234"}}
+
+	// Cache the current supergraph as if it was fetched by a previous poll
+	systemCache := cache.NewMemoryCache(100)
+	if err := schema.CacheSchema(systemCache, logger.MakeLogger(&pFalse), graphRef, "sdl", cachedID, "", 30, nil, userConfig.Cache.Duration); err != nil {
+		t.Fatalf("Failed to cache schema: %v", err)
+	}
+	cacheKey := cache.DefaultCacheKey(graphRef, uplink.SupergraphQuery)
+	cachedBefore, _ := systemCache.Get(cacheKey)
+
+	var logs bytes.Buffer
+	testLogger := slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelWarn}))
+	if !pollGraph(context.Background(), userConfig, systemCache, &http.Client{}, testLogger, userConfig.Supergraphs[0]) {
+		t.Fatalf("Expected polling to succeed")
+	}
+
+	if receivedIfAfterId != cachedID {
+		t.Errorf("Expected ifAfterId %s, got %v", cachedID, receivedIfAfterId)
+	}
+	cachedAfter, _ := systemCache.Get(cacheKey)
+	if !bytes.Equal(cachedBefore, cachedAfter) {
+		t.Errorf("Expected the cached supergraph to be left as-is, got %s", string(cachedAfter))
+	}
+	if logs.Len() > 0 {
+		t.Errorf("Expected no warnings or errors to be logged, got %s", logs.String())
+	}
+
+	// Without onlyChanged, the full supergraph is requested
+	userConfig.Polling.OnlyChanged = &pFalse
+	pollGraph(context.Background(), userConfig, systemCache, &http.Client{}, testLogger, userConfig.Supergraphs[0])
+	if receivedIfAfterId != "" {
+		t.Errorf("Expected an empty ifAfterId, got %v", receivedIfAfterId)
+	}
+}
+
+func TestStartPollingStopCancelsFetch(t *testing.T) {
+	// Uplink never responds within the test, so the poll can only end by being cancelled
+	requested := make(chan struct{}, 1)
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested <- struct{}{}
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer server.Close()
+	defer close(release)
+
+	pFalse := false
+	userConfig := config.NewDefaultConfig()
+	userConfig.Uplink.URLs = []string{server.URL}
+	userConfig.Uplink.Timeout = 30
+	userConfig.Polling.Enabled = true
+	userConfig.Polling.Interval = 60
+	userConfig.Polling.RetryCount = 3
+	userConfig.Polling.Entitlements = &pFalse
+	userConfig.Supergraphs = []config.SupergraphConfig{{GraphRef: "graph@current", ApolloKey: "1234"}}
+
+	stopPolling := make(chan bool, 1)
+	stopped := make(chan struct{})
+	go func() {
+		StartPolling(userConfig, cache.NewMemoryCache(10), &http.Client{}, logger.MakeLogger(&pFalse), stopPolling)
+		close(stopped)
+	}()
+
+	// Stop polling while the first fetch is in flight
+	select {
+	case <-requested:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected polling to fetch the supergraph")
+	}
+	stopPolling <- true
+
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("Expected polling to stop promptly, without waiting for the in-flight fetch to time out")
+	}
+	// The cancelled fetch isn't retried
+	select {
+	case <-requested:
+		t.Errorf("Expected the cancelled fetch not to be retried")
+	default:
+	}
+}
+
+func TestPollForUpdatesCycleTimeout(t *testing.T) {
+	hangingGraphRef := "hanging@current"
+
+	// Mock uplink, where one graph never responds within the test
+	var mu sync.Mutex
+	requested := map[string]bool{}
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request util.UplinkRelayRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			t.Errorf("Failed to decode request: %v", err)
+			return
+		}
+		graphRef := request.Variables["graph_ref"].(string)
+		mu.Lock()
+		requested[graphRef] = true
+		mu.Unlock()
+		if graphRef == hangingGraphRef {
+			select {
+			case <-release:
+			case <-r.Context().Done():
+			}
+			return
+		}
+		w.Write([]byte(`{"data":{"routerConfig":{"__typename":"RouterConfigResult","id":"2024-02-09T19:34:43.322688000Z","supergraphSdl":"sdl","minDelaySeconds":30}}}`))
+	}))
+	defer server.Close()
+	defer close(release)
+
+	pFalse := false
+	userConfig := config.NewDefaultConfig()
+	userConfig.Uplink.URLs = []string{server.URL}
+	userConfig.Uplink.Timeout = 30
+	userConfig.Polling.Enabled = true
+	userConfig.Polling.RetryCount = 3
+	userConfig.Polling.Entitlements = &pFalse
+	userConfig.Polling.Concurrency = 1
+	userConfig.Polling.CycleTimeout = 1
+	userConfig.Supergraphs = []config.SupergraphConfig{
+		{GraphRef: "first@current", ApolloKey: "1234"},
+		{GraphRef: hangingGraphRef, ApolloKey: "1234"},
+		{GraphRef: "skipped@current", ApolloKey: "1234"},
+	}
+
+	// The abandoned graph may still log after the cycle returns
+	logs := &syncBuffer{}
+	testLogger := slog.New(slog.NewTextHandler(logs, &slog.HandlerOptions{Level: slog.LevelWarn}))
+	start := time.Now()
+	pollForUpdates(context.Background(), userConfig, cache.NewMemoryCache(100), &http.Client{}, testLogger)
+
+	// The cycle returns once the timeout is reached rather than waiting for the uplink timeout
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("Expected the polling cycle to return within its timeout, but it took %s", elapsed)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if !requested["first@current"] || !requested[hangingGraphRef] {
+		t.Errorf("Expected the graphs before the timeout to be polled, got %v", requested)
+	}
+	if requested["skipped@current"] {
+		t.Errorf("Expected the graph after the hanging one to be skipped")
+	}
+	// The hanging graph is either abandoned in flight or fails as its fetch is cancelled, depending on which is first
+	if output := logs.String(); !strings.Contains(output, "Polling cycle timed out") || !strings.Contains(output, "skipped@current]") {
+		t.Errorf("Expected the skipped graph to be logged, got %s", output)
+	}
+
+	// Wait for the abandoned fetch to fail as it's cancelled, so it doesn't audit or log into the tests run after this one
+	deadline := time.Now().Add(5 * time.Second)
+	for !strings.Contains(logs.String(), `msg="Failed to fetch schema" graphRef=`+hangingGraphRef) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the abandoned fetch to fail once the cycle timed out, got %s", logs.String())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// syncBuffer is a buffer that can be written to and read from concurrently.
+type syncBuffer struct {
+	mu     sync.Mutex
+	buffer bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buffer.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buffer.String()
+}
+
+func TestFetchPQManifestAudited(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"data":{"persistedQueries":{"__typename":"Unchanged","id":"1","minDelaySeconds":60}}}`))
+	}))
+	defer server.Close()
+	auditFile := filepath.Join(t.TempDir(), "audit.log")
+	if err := audit.Configure(config.AuditConfig{Enabled: true, Path: auditFile}); err != nil {
+		t.Fatalf("Failed to configure auditing: %v", err)
+	}
+	defer audit.Configure(config.AuditConfig{})
+
+	userConfig := config.NewDefaultConfig()
+	userConfig.Uplink.URLs = []string{server.URL}
+	pFalse := false
+	if _, err := FetchPQManifest(context.Background(), userConfig, util.NewHTTPClient(userConfig), "graph@current", "key", "", logger.MakeLogger(&pFalse)); err != nil {
+		t.Fatalf("Failed to fetch the manifest: %v", err)
+	}
+
+	content, err := os.ReadFile(auditFile)
+	if err != nil {
+		t.Fatalf("Failed to read audit file: %v", err)
+	}
+	// Only the records of this graph are checked, as fetches of other tests may still be auditing
+	var record map[string]interface{}
+	for _, line := range bytes.Split(bytes.TrimSpace(content), []byte("\n")) {
+		var candidate map[string]interface{}
+		if err := json.Unmarshal(line, &candidate); err != nil {
+			t.Fatalf("Failed to unmarshal audit record %s: %v", line, err)
+		}
+		if candidate["graphRef"] == "graph@current" {
+			record = candidate
+		}
+	}
+	if record == nil || record["operationName"] != uplink.PersistedQueriesQuery {
+		t.Errorf("Expected the polled manifest fetch to be audited with its graph and operation, got %s", content)
+	}
+}
@@ -0,0 +1,58 @@
+package proxy
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+
+	"apollosolutions/uplink-relay/config"
+	"apollosolutions/uplink-relay/internal/relayerrors"
+	"apollosolutions/uplink-relay/internal/util"
+)
+
+// ClientAllowlistHandler wraps a handler so only clients within the relay's allowed CIDR ranges reach it; others get a 403.
+// Behind a trusted proxy, the client is identified from the forwarding headers, see util.ClientIP.
+// Clients connecting over a Unix socket have no IP and aren't checked, as access to the socket is controlled by its file permissions.
+// The handler is returned unchanged if no CIDR ranges are configured.
+func ClientAllowlistHandler(relayConfig config.RelayConfig, logger *slog.Logger, next http.HandlerFunc) http.HandlerFunc {
+	prefixes, err := relayConfig.AllowedPrefixes()
+	if err != nil {
+		// The configuration is validated on load, so this only happens when it's built by hand; fail closed
+		logger.Error("Invalid client allowlist, rejecting all clients", "err", err)
+	} else if len(prefixes) == 0 {
+		return next
+	}
+	trustedProxies := trustedProxyPrefixes(relayConfig, logger)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if unixSocketRequest(r) {
+			next(w, r)
+			return
+		}
+		addr, ok := util.ClientIP(r, trustedProxies)
+		if !ok || !util.PrefixesContain(prefixes, addr) {
+			logger.Warn("Rejected request from client", "remoteAddr", r.RemoteAddr, "clientIP", addr, "path", r.URL.Path)
+			writeError(w, fmt.Errorf("%w: %s", relayerrors.ErrClientNotAllowed, r.RemoteAddr))
+			return
+		}
+		next(w, r)
+	}
+}
+
+// unixSocketRequest reports whether the request was received on a Unix socket listener, e.g. with a unix: relay address.
+func unixSocketRequest(r *http.Request) bool {
+	_, ok := r.Context().Value(http.LocalAddrContextKey).(*net.UnixAddr)
+	return ok
+}
+
+// trustedProxyPrefixes parses the relay's trusted proxies, trusting none if they're invalid so forwarding headers are ignored.
+func trustedProxyPrefixes(relayConfig config.RelayConfig, logger *slog.Logger) []netip.Prefix {
+	trustedProxies, err := relayConfig.TrustedProxyPrefixes()
+	if err != nil {
+		logger.Error("Invalid trusted proxies, ignoring forwarding headers", "err", err)
+		return nil
+	}
+	return trustedProxies
+}
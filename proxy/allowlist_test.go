@@ -0,0 +1,105 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"apollosolutions/uplink-relay/config"
+	"apollosolutions/uplink-relay/logger"
+)
+
+func TestClientAllowlistHandler(t *testing.T) {
+	pFalse := false
+	next := func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	tests := []struct {
+		name           string
+		allowedCIDRs   []string
+		trustedProxies []string
+		remoteAddr     string
+		forwardedFor   []string
+		expectedStatus int
+	}{
+		{"no allowlist allows any client", nil, nil, "203.0.113.5:1234", nil, http.StatusOK},
+		{"client within a CIDR range", []string{"10.0.0.0/8"}, nil, "10.1.2.3:1234", nil, http.StatusOK},
+		{"client outside the CIDR ranges", []string{"10.0.0.0/8", "192.168.0.0/16"}, nil, "203.0.113.5:1234", nil, http.StatusForbidden},
+		{"bare IP allows only that address", []string{"192.168.1.20"}, nil, "192.168.1.20:1234", nil, http.StatusOK},
+		{"bare IP rejects its neighbours", []string{"192.168.1.20"}, nil, "192.168.1.21:1234", nil, http.StatusForbidden},
+		{"IPv6 client", []string{"fd00::/8"}, nil, "[fd00::1]:1234", nil, http.StatusOK},
+		{"IPv4-mapped IPv6 client", []string{"10.0.0.0/8"}, nil, "[::ffff:10.1.2.3]:1234", nil, http.StatusOK},
+		{"unparseable remote address", []string{"10.0.0.0/8"}, nil, "@", nil, http.StatusForbidden},
+		{"invalid allowlist rejects every client", []string{"not-a-cidr"}, nil, "10.1.2.3:1234", nil, http.StatusForbidden},
+		// X-Forwarded-For is ignored unless the peer is a trusted proxy, so a client can't claim an allowed address
+		{"untrusted X-Forwarded-For can't grant access", []string{"10.0.0.0/8"}, nil, "203.0.113.5:1234", []string{"10.1.2.3"}, http.StatusForbidden},
+		{"untrusted X-Forwarded-For can't deny access", []string{"10.0.0.0/8"}, nil, "10.1.2.3:1234", []string{"203.0.113.5"}, http.StatusOK},
+		// Behind a trusted proxy, the address it appended is used
+		{"trusted X-Forwarded-For client within range", []string{"10.0.0.0/8"}, []string{"172.16.0.0/12"}, "172.16.0.1:1234", []string{"10.1.2.3"}, http.StatusOK},
+		{"trusted X-Forwarded-For client outside range", []string{"10.0.0.0/8"}, []string{"172.16.0.0/12"}, "172.16.0.1:1234", []string{"203.0.113.5"}, http.StatusForbidden},
+		{"spoofed X-Forwarded-For prefix is ignored", []string{"10.0.0.0/8"}, []string{"172.16.0.0/12"}, "172.16.0.1:1234", []string{"10.1.2.3, 203.0.113.5"}, http.StatusForbidden},
+		{"spoofed X-Forwarded-For header is ignored", []string{"10.0.0.0/8"}, []string{"172.16.0.0/12"}, "172.16.0.1:1234", []string{"10.1.2.3", "203.0.113.5"}, http.StatusForbidden},
+		{"trusted proxy appends an allowed address", []string{"10.0.0.0/8"}, []string{"172.16.0.0/12"}, "172.16.0.1:1234", []string{"203.0.113.5, 10.1.2.3"}, http.StatusOK},
+		{"unparseable X-Forwarded-For", []string{"10.0.0.0/8"}, []string{"172.16.0.0/12"}, "172.16.0.1:1234", []string{"unknown"}, http.StatusForbidden},
+		{"trusted proxy without X-Forwarded-For is the client", []string{"172.16.0.0/12"}, []string{"172.16.0.0/12"}, "172.16.0.1:1234", nil, http.StatusOK},
+		{"X-Forwarded-For from an untrusted peer in the allowlist is ignored", []string{"10.0.0.0/8"}, []string{"172.16.0.0/12"}, "10.1.2.3:1234", []string{"203.0.113.5"}, http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			relayConfig := config.NewDefaultConfig().Relay
+			relayConfig.AllowedCIDRs = tt.allowedCIDRs
+			relayConfig.TrustedProxies = tt.trustedProxies
+			handler := ClientAllowlistHandler(relayConfig, logger.MakeLogger(&pFalse), next)
+
+			req := httptest.NewRequest(http.MethodPost, "/", nil)
+			req.RemoteAddr = tt.remoteAddr
+			for _, forwardedFor := range tt.forwardedFor {
+				req.Header.Add("X-Forwarded-For", forwardedFor)
+			}
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+
+			if rr.Code != tt.expectedStatus {
+				t.Errorf("Expected status code %d, but got %d", tt.expectedStatus, rr.Code)
+			}
+		})
+	}
+}
+
+func TestClientAllowlistHandlerUnixSocket(t *testing.T) {
+	pFalse := false
+	relayConfig := config.NewDefaultConfig().Relay
+	relayConfig.AllowedCIDRs = []string{"10.0.0.0/8"}
+	handler := ClientAllowlistHandler(relayConfig, logger.MakeLogger(&pFalse), func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	socketPath := filepath.Join(t.TempDir(), "relay.sock")
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatalf("Failed to listen on the Unix socket: %v", err)
+	}
+	server := &http.Server{Handler: handler}
+	go server.Serve(listener)
+	defer server.Close()
+
+	// Clients on the Unix socket have no IP to check against the allowlist, so they're allowed
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", socketPath)
+		},
+	}}
+	resp, err := client.Post("http://relay/", "application/json", nil)
+	if err != nil {
+		t.Fatalf("Failed to send the request: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected status code %d for a Unix socket client, but got %d", http.StatusOK, resp.StatusCode)
+	}
+}
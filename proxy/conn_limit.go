@@ -0,0 +1,57 @@
+package proxy
+
+import (
+	"log/slog"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"apollosolutions/uplink-relay/metrics"
+)
+
+// limitedListener caps the number of connections a listener keeps open, so a fleet of routers restarting at once, or idle clients,
+// can't exhaust the relay's file descriptors. Connections beyond the limit are closed as soon as they're accepted, rather than queued,
+// so routers retry later instead of holding a connection open. Rejected connections are logged and counted by the connections rejected metric.
+type limitedListener struct {
+	net.Listener
+	limit  int64
+	active atomic.Int64 // Number of admitted connections that are still open.
+	logger *slog.Logger
+}
+
+// limitConnections limits the connections accepted by the listener that are open at once to maxConnections.
+func limitConnections(listener net.Listener, maxConnections int, logger *slog.Logger) net.Listener {
+	return &limitedListener{Listener: listener, limit: int64(maxConnections), logger: logger}
+}
+
+// Accept waits for the next connection within the limit, closing and recording the connections accepted beyond it.
+func (l *limitedListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if l.active.Add(1) > l.limit {
+			l.active.Add(-1)
+			address := l.Addr().String()
+			l.logger.Warn("Rejected connection beyond the connection limit", "address", address, "remoteAddr", conn.RemoteAddr().String(), "maxConcurrentConnections", l.limit)
+			metrics.ConnectionsRejected.Inc(address)
+			conn.Close()
+			continue
+		}
+		return &limitedConn{Conn: conn, release: func() { l.active.Add(-1) }}, nil
+	}
+}
+
+// limitedConn is an admitted connection, releasing its slot once it's closed, including after it's hijacked.
+type limitedConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *limitedConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.release)
+	return err
+}
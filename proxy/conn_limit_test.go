@@ -0,0 +1,108 @@
+package proxy
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"apollosolutions/uplink-relay/config"
+	"apollosolutions/uplink-relay/logger"
+	"apollosolutions/uplink-relay/metrics"
+)
+
+func TestStartServerMaxConcurrentConnections(t *testing.T) {
+	mockConfig := config.NewDefaultConfig()
+	mockConfig.Relay.Address = "127.0.0.1:0"
+	mockConfig.Relay.MaxConcurrentConnections = 2
+
+	pFalse := false
+	mockLogger := logger.MakeLogger(&pFalse)
+
+	DeregisterHandlers()
+	defer DeregisterHandlers()
+	RegisterHandlers("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("relay"))
+	})
+
+	servers, err := StartServer(mockConfig, mockLogger)
+	if err != nil {
+		t.Fatalf("StartServer returned an error: %v", err)
+	}
+	defer ShutdownServer(servers, mockLogger)
+	address := servers[0].Addr
+
+	dial := func() net.Conn {
+		conn, err := net.Dial("tcp", address)
+		if err != nil {
+			t.Fatalf("Failed to connect: %v", err)
+		}
+		return conn
+	}
+	// get sends a request on the connection, returning an error if the server closed it
+	get := func(conn net.Conn) (*http.Response, error) {
+		req, _ := http.NewRequest(http.MethodGet, "http://"+address+"/", nil)
+		if err := req.Write(conn); err != nil {
+			return nil, err
+		}
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+		if err != nil {
+			return nil, err
+		}
+		resp.Body.Close()
+		return resp, nil
+	}
+	// closedByServer reports whether the server closed the connection without sending anything
+	closedByServer := func(conn net.Conn) bool {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		_, err := conn.Read(make([]byte, 1))
+		return err != nil && !isTimeout(err)
+	}
+
+	// Idle connections that never send a request take up the slots
+	idle := []net.Conn{dial(), dial()}
+	defer idle[1].Close()
+
+	// Connections beyond the limit are closed right after they're accepted, without waiting for a request
+	for i := 0; i < 3; i++ {
+		rejected := dial()
+		if !closedByServer(rejected) {
+			t.Errorf("Expected the idle connection beyond the limit to be closed by the server")
+		}
+		rejected.Close()
+	}
+	// Rejected connections are counted per listener
+	if rejected, _ := metrics.ConnectionsRejected.Get(address); rejected != 3 {
+		t.Errorf("Expected 3 rejected connections to be counted, got %v", rejected)
+	}
+	// Admitted idle connections are kept open
+	if closedByServer(idle[0]) {
+		t.Errorf("Expected the admitted idle connection to be kept open")
+	}
+	if resp, err := get(idle[0]); err != nil || resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected the admitted connection to be served, got %v (%v)", resp, err)
+	}
+
+	// Closing a connection frees its slot
+	idle[0].Close()
+	deadline := time.Now().Add(time.Second)
+	for {
+		conn := dial()
+		resp, err := get(conn)
+		conn.Close()
+		if err == nil && resp.StatusCode == http.StatusOK {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected a connection to be served once one closed, got %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func isTimeout(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
@@ -0,0 +1,55 @@
+package proxy
+
+import (
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"apollosolutions/uplink-relay/config"
+)
+
+// CORSHandler wraps a handler with CORS support for browsers calling the relay directly, e.g. Apollo Sandbox.
+// Preflight OPTIONS requests are answered with 204 rather than reaching the handler; methods lists the methods the handler accepts.
+// The handler is returned unchanged if CORS is disabled.
+func CORSHandler(corsConfig config.CORSConfig, methods []string, next http.HandlerFunc) http.HandlerFunc {
+	if !corsConfig.Enabled {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		allowed := origin != "" && corsOriginAllowed(corsConfig.AllowedOrigins, origin)
+		if allowed {
+			if slices.Contains(corsConfig.AllowedOrigins, "*") {
+				w.Header().Set("Access-Control-Allow-Origin", "*")
+			} else {
+				w.Header().Set("Access-Control-Allow-Origin", origin)
+				w.Header().Add("Vary", "Origin")
+			}
+		}
+
+		if r.Method != http.MethodOptions {
+			next(w, r)
+			return
+		}
+
+		// Answer the preflight request; browsers block the actual request if the origin isn't allowed
+		w.Header().Set("Allow", strings.Join(append(slices.Clone(methods), http.MethodOptions), ", "))
+		if allowed && r.Header.Get("Access-Control-Request-Method") != "" {
+			w.Header().Set("Access-Control-Allow-Methods", strings.Join(methods, ", "))
+			w.Header().Set("Access-Control-Allow-Headers", strings.Join(corsConfig.AllowedHeaders, ", "))
+			w.Header().Set("Access-Control-Max-Age", strconv.Itoa(corsConfig.MaxAge))
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// corsOriginAllowed returns whether the origin matches one of the allowed origins, where "*" allows any origin.
+func corsOriginAllowed(allowedOrigins []string, origin string) bool {
+	for _, allowed := range allowedOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,103 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"apollosolutions/uplink-relay/cache"
+	"apollosolutions/uplink-relay/config"
+	"apollosolutions/uplink-relay/logger"
+	"apollosolutions/uplink-relay/uplink"
+)
+
+func TestCORSHandlerPreflight(t *testing.T) {
+	pFalse := false
+	mockConfig := config.NewDefaultConfig()
+	mockConfig.Relay.CORS.Enabled = true
+	mockConfig.Relay.CORS.AllowedOrigins = []string{"https://studio.apollographql.com"}
+	relayHandler := RelayHandler(mockConfig, cache.NewMemoryCache(100), uplink.NewRoundRobinSelector([]string{"http://localhost:1"}), &http.Client{}, logger.MakeLogger(&pFalse))
+	handler := CORSHandler(mockConfig.Relay.CORS, []string{http.MethodPost}, relayHandler)
+
+	preflight := func(origin string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodOptions, "/", nil)
+		req.Header.Set("Origin", origin)
+		req.Header.Set("Access-Control-Request-Method", http.MethodPost)
+		req.Header.Set("Access-Control-Request-Headers", "content-type")
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// An allowed origin gets the CORS headers, without the request reaching the relay handler
+	rr := preflight("https://studio.apollographql.com")
+	if rr.Code != http.StatusNoContent {
+		t.Errorf("Expected status code 204, but got %d", rr.Code)
+	}
+	expected := map[string]string{
+		"Access-Control-Allow-Origin":  "https://studio.apollographql.com",
+		"Access-Control-Allow-Methods": "POST",
+		"Access-Control-Allow-Headers": strings.Join(mockConfig.Relay.CORS.AllowedHeaders, ", "),
+		"Access-Control-Max-Age":       "600",
+		"Vary":                         "Origin",
+	}
+	for header, value := range expected {
+		if rr.Header().Get(header) != value {
+			t.Errorf("Expected %s to be %q, got %q", header, value, rr.Header().Get(header))
+		}
+	}
+
+	// Other origins get no CORS headers, so the browser blocks the request
+	rr = preflight("https://example.com")
+	if rr.Code != http.StatusNoContent {
+		t.Errorf("Expected status code 204, but got %d", rr.Code)
+	}
+	if rr.Header().Get("Access-Control-Allow-Origin") != "" || rr.Header().Get("Access-Control-Allow-Methods") != "" {
+		t.Errorf("Expected no CORS headers, got %v", rr.Header())
+	}
+
+	// Any origin is allowed with "*"
+	mockConfig.Relay.CORS.AllowedOrigins = []string{"*"}
+	handler = CORSHandler(mockConfig.Relay.CORS, []string{http.MethodPost}, relayHandler)
+	if rr := preflight("https://example.com"); rr.Header().Get("Access-Control-Allow-Origin") != "*" {
+		t.Errorf("Expected any origin to be allowed, got %q", rr.Header().Get("Access-Control-Allow-Origin"))
+	}
+}
+
+func TestCORSHandlerRequest(t *testing.T) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(supergraphResponse))
+	}))
+	defer mockServer.Close()
+
+	pFalse := false
+	mockConfig := config.NewDefaultConfig()
+	mockConfig.Uplink.RetryCount = 1
+	mockConfig.Relay.CORS.Enabled = true
+	relayHandler := RelayHandler(mockConfig, cache.NewMemoryCache(100), uplink.NewRoundRobinSelector([]string{mockServer.URL}), &http.Client{}, logger.MakeLogger(&pFalse))
+	handler := CORSHandler(mockConfig.Relay.CORS, []string{http.MethodPost}, relayHandler)
+
+	// Actual requests are passed to the handler with the CORS headers set
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(supergraphQuery))
+	req.Header.Set("Origin", "https://studio.apollographql.com")
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), "mock supergraph sdl") {
+		t.Errorf("Expected the supergraph, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if rr.Header().Get("Access-Control-Allow-Origin") != "*" {
+		t.Errorf("Expected Access-Control-Allow-Origin to be *, got %q", rr.Header().Get("Access-Control-Allow-Origin"))
+	}
+
+	// When disabled, preflight requests reach the handler as before
+	mockConfig.Relay.CORS.Enabled = false
+	handler = CORSHandler(mockConfig.Relay.CORS, []string{http.MethodPost}, relayHandler)
+	req = httptest.NewRequest(http.MethodOptions, "/", nil)
+	req.Header.Set("Origin", "https://studio.apollographql.com")
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code == http.StatusNoContent || rr.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Errorf("Expected the preflight request to reach the handler, got %d", rr.Code)
+	}
+}
@@ -0,0 +1,125 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"apollosolutions/uplink-relay/config"
+	"apollosolutions/uplink-relay/schema"
+	"apollosolutions/uplink-relay/uplink"
+)
+
+// serveFallback serves the supergraph's fallback schema file, if it has one, once uplink has failed and the request won't be retried.
+// It reports whether the fallback was served; if not, nothing is written, so the caller writes uplink's failure instead.
+func serveFallback(w http.ResponseWriter, userConfig *config.Config, graphRef string, operationName string, ifAfterId string, uplinkErr error, logger *slog.Logger) bool {
+	fallbackSchemaFile := fallbackSchemaFileFor(userConfig, graphRef, operationName)
+	if fallbackSchemaFile == "" {
+		return false
+	}
+
+	if err := serveFallbackSchema(w, fallbackSchemaFile, ifAfterId, userConfig.Relay.ErrorMinDelaySeconds); err != nil {
+		logger.Error("Failed to serve fallback schema", "graphRef", graphRef, "file", fallbackSchemaFile, "err", err)
+		return false
+	}
+	logger.Warn("Uplink failed, served fallback schema", "graphRef", graphRef, "file", fallbackSchemaFile, "err", uplinkErr)
+	return true
+}
+
+// fallbackSchemaFileFor returns the fallback schema file of the supergraph, if the operation fetches its supergraph.
+func fallbackSchemaFileFor(userConfig *config.Config, graphRef string, operationName string) string {
+	if operationName != uplink.SupergraphQuery {
+		return ""
+	}
+	supergraphConfig, err := config.FindSupergraphConfigFromGraphRef(graphRef, userConfig)
+	if err != nil {
+		return ""
+	}
+	return supergraphConfig.FallbackSchemaFile
+}
+
+// serveFallbackSchema serves the supergraph SDL in the file as a RouterConfigResult, or as Unchanged if the router already has it.
+// The file's modification time is used as the ID, so routers polling with it aren't sent the same schema again.
+func serveFallbackSchema(w http.ResponseWriter, fallbackSchemaFile string, ifAfterId string, minDelaySeconds int) error {
+	info, err := os.Stat(fallbackSchemaFile)
+	if err != nil {
+		return err
+	}
+	sdl, err := os.ReadFile(fallbackSchemaFile)
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(string(sdl)) == "" {
+		return fmt.Errorf("fallback schema file is empty")
+	}
+
+	routerConfig := schema.UplinkRouterConfig{
+		ID:              info.ModTime().UTC().Format(time.RFC3339Nano),
+		Typename:        "RouterConfigResult",
+		SupergraphSdl:   string(sdl),
+		MinDelaySeconds: float64(minDelaySeconds),
+	}
+	if routerConfig.ID == ifAfterId {
+		routerConfig.Typename = "Unchanged"
+		routerConfig.SupergraphSdl = ""
+	}
+	responseBody, err := json.Marshal(&schema.UplinkSupergraphSdlResponse{
+		Data: struct {
+			RouterConfig schema.UplinkRouterConfig `json:"routerConfig"`
+		}{RouterConfig: routerConfig},
+	})
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set(CacheSourceHeader, cacheSourceFallback)
+	w.Header().Set("Content-Type", "application/json")
+	_, err = w.Write(responseBody)
+	return err
+}
+
+// bufferedResponseWriter is a ResponseWriter that holds the response, so it can be replaced before it's written to the client.
+type bufferedResponseWriter struct {
+	header     http.Header
+	statusCode int
+	body       bytes.Buffer
+}
+
+func (b *bufferedResponseWriter) Header() http.Header {
+	return b.header
+}
+
+func (b *bufferedResponseWriter) Write(p []byte) (int, error) {
+	if b.statusCode == 0 {
+		b.statusCode = http.StatusOK
+	}
+	return b.body.Write(p)
+}
+
+func (b *bufferedResponseWriter) WriteHeader(statusCode int) {
+	if b.statusCode == 0 {
+		b.statusCode = statusCode
+	}
+}
+
+// status returns the status code of the response, which is 200 OK if nothing was written.
+func (b *bufferedResponseWriter) status() int {
+	if b.statusCode == 0 {
+		return http.StatusOK
+	}
+	return b.statusCode
+}
+
+// writeTo writes the buffered response to the given ResponseWriter.
+func (b *bufferedResponseWriter) writeTo(w http.ResponseWriter) {
+	for key, values := range b.header {
+		w.Header()[key] = values
+	}
+	w.WriteHeader(b.status())
+	w.Write(b.body.Bytes())
+}
@@ -0,0 +1,189 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"apollosolutions/uplink-relay/cache"
+	"apollosolutions/uplink-relay/config"
+	"apollosolutions/uplink-relay/logger"
+	"apollosolutions/uplink-relay/uplink"
+)
+
+func TestRelayHandlerFallbackSchema(t *testing.T) {
+	fallbackSDL := "fallback supergraph sdl"
+	fallbackFile := filepath.Join(t.TempDir(), "supergraph.graphql")
+	if err := os.WriteFile(fallbackFile, []byte(fallbackSDL), 0600); err != nil {
+		t.Fatalf("Failed to write fallback schema: %v", err)
+	}
+	modTime := time.Date(2024, 2, 9, 12, 0, 0, 0, time.UTC)
+	if err := os.Chtimes(fallbackFile, modTime, modTime); err != nil {
+		t.Fatalf("Failed to set the fallback schema's modification time: %v", err)
+	}
+
+	okServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(supergraphResponse))
+	}))
+	defer okServer.Close()
+	unavailableServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+	}))
+	defer unavailableServer.Close()
+	closedServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	closedServer.Close()
+
+	tests := []struct {
+		name             string
+		uplinkURL        string
+		fallbackFile     string
+		body             string
+		expectedStatus   int
+		expectedSource   string
+		expectedTypename string
+		expectedSDL      string
+	}{
+		{"upstream unreachable", closedServer.URL, fallbackFile, supergraphQuery, http.StatusOK, cacheSourceFallback, "RouterConfigResult", fallbackSDL},
+		{"upstream error", unavailableServer.URL, fallbackFile, supergraphQuery, http.StatusOK, cacheSourceFallback, "RouterConfigResult", fallbackSDL},
+		{"router already has the fallback", closedServer.URL, fallbackFile, strings.Replace(supergraphQuery, `"ifAfterId":null`, `"ifAfterId":"2024-02-09T12:00:00Z"`, 1), http.StatusOK, cacheSourceFallback, "Unchanged", ""},
+		{"upstream available", okServer.URL, fallbackFile, supergraphQuery, http.StatusOK, cacheSourceUpstream, "RouterConfigResult", "mock supergraph sdl"},
+		{"without a fallback", closedServer.URL, "", supergraphQuery, http.StatusBadGateway, cacheSourceUpstream, "FetchError", ""},
+		{"unreadable fallback", closedServer.URL, filepath.Join(t.TempDir(), "missing.graphql"), supergraphQuery, http.StatusBadGateway, cacheSourceUpstream, "FetchError", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockConfig := config.NewDefaultConfig()
+			mockConfig.Uplink.RetryCount = 1
+			mockConfig.Supergraphs = []config.SupergraphConfig{{GraphRef: "graph@local", FallbackSchemaFile: tt.fallbackFile}}
+			pFalse := false
+			// The cache is empty, so the request goes to uplink
+			handler := RelayHandler(mockConfig, cache.NewMemoryCache(10), uplink.NewRoundRobinSelector([]string{tt.uplinkURL}), &http.Client{}, logger.MakeLogger(&pFalse))
+
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(tt.body)))
+			if rr.Code != tt.expectedStatus {
+				t.Errorf("Expected status code %d, but got %d: %s", tt.expectedStatus, rr.Code, rr.Body.String())
+			}
+			if source := rr.Header().Get(CacheSourceHeader); source != tt.expectedSource {
+				t.Errorf("Expected source %s, but got %s", tt.expectedSource, source)
+			}
+
+			var response struct {
+				Data struct {
+					RouterConfig struct {
+						Typename        string  `json:"__typename"`
+						ID              string  `json:"id"`
+						SupergraphSdl   string  `json:"supergraphSdl"`
+						MinDelaySeconds float64 `json:"minDelaySeconds"`
+					} `json:"routerConfig"`
+				} `json:"data"`
+			}
+			if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+				t.Fatalf("Failed to unmarshal response %q: %v", rr.Body.String(), err)
+			}
+			routerConfig := response.Data.RouterConfig
+			if routerConfig.Typename != tt.expectedTypename {
+				t.Errorf("Expected %s, but got %s", tt.expectedTypename, routerConfig.Typename)
+			}
+			if routerConfig.SupergraphSdl != tt.expectedSDL {
+				t.Errorf("Expected supergraph SDL %q, but got %q", tt.expectedSDL, routerConfig.SupergraphSdl)
+			}
+			if tt.expectedSource == cacheSourceFallback {
+				if routerConfig.ID != "2024-02-09T12:00:00Z" {
+					t.Errorf("Expected the fallback schema's modification time as the ID, but got %s", routerConfig.ID)
+				}
+				if routerConfig.MinDelaySeconds != float64(mockConfig.Relay.ErrorMinDelaySeconds) {
+					t.Errorf("Expected minDelaySeconds of %d, but got %v", mockConfig.Relay.ErrorMinDelaySeconds, routerConfig.MinDelaySeconds)
+				}
+			}
+		})
+	}
+}
+
+func TestRelayHandlerFallbackSchemaOnlyForSupergraph(t *testing.T) {
+	fallbackFile := filepath.Join(t.TempDir(), "supergraph.graphql")
+	if err := os.WriteFile(fallbackFile, []byte("fallback supergraph sdl"), 0600); err != nil {
+		t.Fatalf("Failed to write fallback schema: %v", err)
+	}
+	closedServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	closedServer.Close()
+
+	mockConfig := config.NewDefaultConfig()
+	mockConfig.Uplink.RetryCount = 1
+	mockConfig.Supergraphs = []config.SupergraphConfig{{GraphRef: "graph@local", FallbackSchemaFile: fallbackFile}}
+	pFalse := false
+	handler := RelayHandler(mockConfig, cache.NewMemoryCache(10), uplink.NewRoundRobinSelector([]string{closedServer.URL}), &http.Client{}, logger.MakeLogger(&pFalse))
+
+	// Other artifacts still return uplink's failure
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(licenseQuery)))
+	if rr.Code != http.StatusBadGateway {
+		t.Errorf("Expected status code %d, but got %d", http.StatusBadGateway, rr.Code)
+	}
+	if strings.Contains(rr.Body.String(), "fallback supergraph sdl") {
+		t.Errorf("Expected the fallback schema not to be served for a license request, got %s", rr.Body.String())
+	}
+}
+
+func TestRelayHandlerFallbackSchemaAfterRetries(t *testing.T) {
+	fallbackFile := filepath.Join(t.TempDir(), "supergraph.graphql")
+	if err := os.WriteFile(fallbackFile, []byte("fallback supergraph sdl"), 0600); err != nil {
+		t.Fatalf("Failed to write fallback schema: %v", err)
+	}
+	var calls atomic.Int32
+	failures := int32(0)
+	uplinkServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) <= failures {
+			http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(supergraphResponse))
+	}))
+	defer uplinkServer.Close()
+
+	tests := []struct {
+		name           string
+		failures       int32
+		budget         config.RetryBudgetConfig
+		expectedSource string
+		expectedCalls  int32
+	}{
+		// Uplink recovers on a retry, so its schema is served rather than the fallback
+		{name: "uplink recovers", failures: 1, expectedSource: cacheSourceUpstream, expectedCalls: 2},
+		// The fallback is only served once every retry failed
+		{name: "retries exhausted", failures: 10, expectedSource: cacheSourceFallback, expectedCalls: 3},
+		// Or once the retry budget doesn't allow retrying
+		{name: "retry budget exhausted", failures: 10, budget: config.RetryBudgetConfig{Enabled: true, MaxTokens: 1, TokenRatio: 0.5}, expectedSource: cacheSourceFallback, expectedCalls: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls.Store(0)
+			failures = tt.failures
+			mockConfig := config.NewDefaultConfig()
+			mockConfig.Uplink.RetryCount = 2
+			mockConfig.Uplink.RetryBudget = tt.budget
+			mockConfig.Supergraphs = []config.SupergraphConfig{{GraphRef: "graph@local", FallbackSchemaFile: fallbackFile}}
+			pFalse := false
+			handler := RelayHandler(mockConfig, cache.NewMemoryCache(10), uplink.NewRoundRobinSelector([]string{uplinkServer.URL}), &http.Client{}, logger.MakeLogger(&pFalse))
+
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(supergraphQuery)))
+			if rr.Code != http.StatusOK {
+				t.Errorf("Expected status code 200, but got %d: %s", rr.Code, rr.Body.String())
+			}
+			if source := rr.Header().Get(CacheSourceHeader); source != tt.expectedSource {
+				t.Errorf("Expected source %s, but got %s", tt.expectedSource, source)
+			}
+			if got := calls.Load(); got != tt.expectedCalls {
+				t.Errorf("Expected %d requests to uplink, got %d", tt.expectedCalls, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,386 @@
+//go:build integration
+
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"apollosolutions/uplink-relay/cache"
+	"apollosolutions/uplink-relay/config"
+	"apollosolutions/uplink-relay/logger"
+	persistedqueries "apollosolutions/uplink-relay/persisted_queries"
+	"apollosolutions/uplink-relay/uplink"
+)
+
+// The integration tests run the relay on a real listener in front of a fake uplink that implements the uplink protocol,
+// and make the same requests a router makes, following the ifAfterId flow between polls.
+// Run them with: go test -tags integration ./proxy/
+
+const (
+	integrationGraphRef     = "graph@current"
+	integrationSupergraphID = "2024-02-09T19:34:43.322688000Z"
+	integrationLicenseID    = "2030-08-02T12:00:00Z"
+	integrationManifestID   = "manifest:1"
+	integrationChunk        = `{"format":"apollo-persisted-query-manifest","version":1,"operations":[]}`
+)
+
+// The queries the router sends to uplink.
+const (
+	routerSupergraphQuery = `query SupergraphSdlQuery($apiKey: String!, $graph_ref: String!, $ifAfterId: ID) { routerConfig(ref: $graph_ref, apiKey: $apiKey, ifAfterId: $ifAfterId) { __typename ... on RouterConfigResult { id supergraphSdl: supergraphSDL minDelaySeconds } ... on Unchanged { id minDelaySeconds } ... on FetchError { code message } } }`
+	routerLicenseQuery    = `query LicenseQuery($apiKey: String!, $graph_ref: String!, $ifAfterId: ID) { routerEntitlements(ifAfterId: $ifAfterId, apiKey: $apiKey, ref: $graph_ref) { __typename ... on RouterEntitlementsResult { id minDelaySeconds entitlement { jwt } } ... on Unchanged { id minDelaySeconds } ... on FetchError { code message } } }`
+	routerPQQuery         = `query PersistedQueriesManifestQuery($apiKey: String!, $graph_ref: String!, $ifAfterId: ID) { persistedQueries(ref: $graph_ref, apiKey: $apiKey, ifAfterId: $ifAfterId) { __typename ... on PersistedQueriesResult { id minDelaySeconds chunks { id urls } } ... on Unchanged { id minDelaySeconds } ... on FetchError { code message } } }`
+)
+
+// fakeUplink implements the uplink protocol for a single graph: a result is returned unless the ifAfterId shows the router already has the current version.
+func fakeUplink(t *testing.T) *httptest.Server {
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/chunks/") {
+			w.Write([]byte(integrationChunk))
+			return
+		}
+
+		var request struct {
+			Variables     map[string]interface{} `json:"variables"`
+			OperationName string                 `json:"operationName"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			t.Errorf("Uplink received an invalid request: %v", err)
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+		if request.Variables["graph_ref"] != integrationGraphRef || request.Variables["apiKey"] == "" {
+			w.Write([]byte(fmt.Sprintf(`{"data":{"%s":{"__typename":"FetchError","code":"AUTHENTICATION_FAILED","message":"invalid API key"}}}`, rootField(request.OperationName))))
+			return
+		}
+		ifAfterId, _ := request.Variables["ifAfterId"].(string)
+
+		switch request.OperationName {
+		case uplink.SupergraphQuery:
+			// Supergraph IDs are timestamps, so anything at or after the current ID is up to date
+			if after, err := time.Parse(time.RFC3339, ifAfterId); err == nil && !after.Before(mustParseTime(t, integrationSupergraphID)) {
+				fmt.Fprintf(w, `{"data":{"routerConfig":{"__typename":"Unchanged","id":"%s","minDelaySeconds":30}}}`, integrationSupergraphID)
+				return
+			}
+			fmt.Fprintf(w, `{"data":{"routerConfig":{"__typename":"RouterConfigResult","id":"%s","supergraphSdl":"type Query { hello: String }","minDelaySeconds":30}}}`, integrationSupergraphID)
+		case uplink.LicenseQuery:
+			if ifAfterId == integrationLicenseID {
+				fmt.Fprintf(w, `{"data":{"routerEntitlements":{"__typename":"Unchanged","id":"%s","minDelaySeconds":60}}}`, integrationLicenseID)
+				return
+			}
+			fmt.Fprintf(w, `{"data":{"routerEntitlements":{"__typename":"RouterEntitlementsResult","id":"%s","minDelaySeconds":60,"entitlement":{"jwt":"header.payload.signature"}}}}`, integrationLicenseID)
+		case uplink.PersistedQueriesQuery:
+			if ifAfterId == integrationManifestID {
+				fmt.Fprintf(w, `{"data":{"persistedQueries":{"__typename":"Unchanged","id":"%s","minDelaySeconds":60}}}`, integrationManifestID)
+				return
+			}
+			fmt.Fprintf(w, `{"data":{"persistedQueries":{"__typename":"PersistedQueriesResult","id":"%s","minDelaySeconds":60,"chunks":[{"id":"graph/chunk1","urls":["%s/chunks/chunk1"]}]}}}`, integrationManifestID, server.URL)
+		default:
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+		}
+	}))
+	return server
+}
+
+func mustParseTime(t *testing.T, value string) time.Time {
+	parsed, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		t.Fatalf("Failed to parse %s: %v", value, err)
+	}
+	return parsed
+}
+
+// rootField returns the response field for an uplink operation.
+func rootField(operationName string) string {
+	switch operationName {
+	case uplink.LicenseQuery:
+		return "routerEntitlements"
+	case uplink.PersistedQueriesQuery:
+		return "persistedQueries"
+	default:
+		return "routerConfig"
+	}
+}
+
+// startIntegrationRelay starts the relay on an ephemeral port in front of the fake uplink and returns its URL.
+func startIntegrationRelay(t *testing.T, uplinkURL string) string {
+	pFalse := false
+	testLogger := logger.MakeLogger(&pFalse)
+	relayConfig := config.NewDefaultConfig()
+	relayConfig.Relay.Address = "127.0.0.1:0"
+	relayConfig.Uplink.URLs = []string{uplinkURL}
+	relayConfig.Uplink.RetryCount = 1
+	relayConfig.PersistedQueries.ChunkAllowedHosts = []string{"127.0.0.1"}
+	relayConfig.Supergraphs = []config.SupergraphConfig{{GraphRef: integrationGraphRef, ApolloKey: "service:graph:key"}}
+
+	systemCache := cache.NewMemoryCache(100)
+	DeregisterHandlers()
+	RegisterRelayHandler(relayConfig.Relay.Path, RelayHandler(relayConfig, systemCache, uplink.NewRoundRobinSelector(relayConfig.Uplink.URLs), &http.Client{}, testLogger))
+	RegisterHandlers("/persisted-queries/", persistedqueries.PersistedQueryHandler(testLogger, &http.Client{}, systemCache))
+
+	servers, err := StartServer(relayConfig, testLogger)
+	if err != nil {
+		t.Fatalf("Failed to start the relay: %v", err)
+	}
+	t.Cleanup(func() {
+		ShutdownServer(servers, testLogger)
+		DeregisterHandlers()
+	})
+
+	// Chunk URLs are rewritten to the relay's public URL, which is only known once it's listening
+	relayConfig.Relay.PublicURL = "http://" + servers[0].Addr
+	return relayConfig.Relay.PublicURL
+}
+
+// fetch makes an uplink request to the relay like a router would, returning the operation's result object.
+func fetch(t *testing.T, relayURL string, query string, operationName string, ifAfterId interface{}) map[string]interface{} {
+	body, _ := json.Marshal(map[string]interface{}{
+		"query":         query,
+		"operationName": operationName,
+		"variables":     map[string]interface{}{"apiKey": "service:graph:key", "graph_ref": integrationGraphRef, "ifAfterId": ifAfterId},
+	})
+	resp, err := http.Post(relayURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("Request to the relay failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status code 200, got %d", resp.StatusCode)
+	}
+
+	var response struct {
+		Data map[string]map[string]interface{} `json:"data"`
+	}
+	responseBody, _ := io.ReadAll(resp.Body)
+	if err := json.Unmarshal(responseBody, &response); err != nil {
+		t.Fatalf("Relay returned invalid JSON: %v: %s", err, responseBody)
+	}
+	result, ok := response.Data[rootField(operationName)]
+	if !ok {
+		t.Fatalf("Relay response is missing data.%s: %s", rootField(operationName), responseBody)
+	}
+	assertConforms(t, operationName, result)
+	return result
+}
+
+// assertConforms checks a result has the fields the uplink schema requires for its __typename.
+func assertConforms(t *testing.T, operationName string, result map[string]interface{}) {
+	t.Helper()
+	results := map[string]string{
+		uplink.SupergraphQuery:       "RouterConfigResult",
+		uplink.LicenseQuery:          "RouterEntitlementsResult",
+		uplink.PersistedQueriesQuery: "PersistedQueriesResult",
+	}
+	typename, _ := result["__typename"].(string)
+	if typename != results[operationName] && typename != "Unchanged" && typename != "FetchError" {
+		t.Fatalf("Unexpected __typename %q for %s", typename, operationName)
+	}
+
+	if typename == "FetchError" {
+		if code, _ := result["code"].(string); code == "" {
+			t.Errorf("FetchError is missing a code: %v", result)
+		}
+		if message, _ := result["message"].(string); message == "" {
+			t.Errorf("FetchError is missing a message: %v", result)
+		}
+		return
+	}
+
+	if id, _ := result["id"].(string); id == "" {
+		t.Errorf("%s is missing an id: %v", typename, result)
+	}
+	if minDelaySeconds, ok := result["minDelaySeconds"].(float64); !ok || minDelaySeconds <= 0 {
+		t.Errorf("%s has an invalid minDelaySeconds: %v", typename, result["minDelaySeconds"])
+	}
+
+	switch typename {
+	case "RouterConfigResult":
+		if sdl, _ := result["supergraphSdl"].(string); sdl == "" {
+			t.Errorf("RouterConfigResult is missing the supergraphSdl: %v", result)
+		}
+	case "RouterEntitlementsResult":
+		if _, ok := result["entitlement"]; !ok {
+			t.Errorf("RouterEntitlementsResult is missing the entitlement: %v", result)
+		}
+	case "PersistedQueriesResult":
+		chunks, ok := result["chunks"].([]interface{})
+		if !ok {
+			t.Fatalf("PersistedQueriesResult is missing the chunks: %v", result)
+		}
+		for _, chunk := range chunks {
+			chunk, _ := chunk.(map[string]interface{})
+			if id, _ := chunk["id"].(string); id == "" {
+				t.Errorf("Chunk is missing an id: %v", chunk)
+			}
+			if urls, _ := chunk["urls"].([]interface{}); len(urls) == 0 {
+				t.Errorf("Chunk is missing urls: %v", chunk)
+			}
+		}
+	case "Unchanged":
+		for _, field := range []string{"supergraphSdl", "entitlement", "chunks"} {
+			if value, ok := result[field]; ok && value != nil {
+				t.Errorf("Unchanged has an unexpected %s: %v", field, value)
+			}
+		}
+	}
+}
+
+func TestIntegrationSupergraph(t *testing.T) {
+	fakeServer := fakeUplink(t)
+	defer fakeServer.Close()
+	relayURL := startIntegrationRelay(t, fakeServer.URL)
+
+	// The first poll has no ifAfterId and gets the supergraph
+	result := fetch(t, relayURL, routerSupergraphQuery, uplink.SupergraphQuery, nil)
+	if result["__typename"] != "RouterConfigResult" {
+		t.Fatalf("Expected RouterConfigResult, got %v", result["__typename"])
+	}
+
+	// Polls are repeated, and served from the cache
+	if repeated := fetch(t, relayURL, routerSupergraphQuery, uplink.SupergraphQuery, nil); repeated["supergraphSdl"] != result["supergraphSdl"] {
+		t.Errorf("Expected the same supergraph, got %v", repeated["supergraphSdl"])
+	}
+
+	// The next polls send the returned ID, and the supergraph is unchanged
+	for i := 0; i < 2; i++ {
+		if unchanged := fetch(t, relayURL, routerSupergraphQuery, uplink.SupergraphQuery, result["id"]); unchanged["__typename"] != "Unchanged" {
+			t.Errorf("Expected Unchanged, got %v", unchanged["__typename"])
+		}
+	}
+}
+
+func TestIntegrationLicense(t *testing.T) {
+	fakeServer := fakeUplink(t)
+	defer fakeServer.Close()
+	relayURL := startIntegrationRelay(t, fakeServer.URL)
+
+	result := fetch(t, relayURL, routerLicenseQuery, uplink.LicenseQuery, nil)
+	if result["__typename"] != "RouterEntitlementsResult" {
+		t.Fatalf("Expected RouterEntitlementsResult, got %v", result["__typename"])
+	}
+	if entitlement, _ := result["entitlement"].(map[string]interface{}); entitlement["jwt"] != "header.payload.signature" {
+		t.Errorf("Expected the license JWT, got %v", result["entitlement"])
+	}
+	if result["id"] != integrationLicenseID {
+		t.Errorf("Expected the license ID %s, got %v", integrationLicenseID, result["id"])
+	}
+
+	for i := 0; i < 2; i++ {
+		if unchanged := fetch(t, relayURL, routerLicenseQuery, uplink.LicenseQuery, result["id"]); unchanged["__typename"] != "Unchanged" {
+			t.Errorf("Expected Unchanged, got %v", unchanged["__typename"])
+		}
+	}
+}
+
+func TestIntegrationPersistedQueries(t *testing.T) {
+	fakeServer := fakeUplink(t)
+	defer fakeServer.Close()
+	relayURL := startIntegrationRelay(t, fakeServer.URL)
+
+	result := fetch(t, relayURL, routerPQQuery, uplink.PersistedQueriesQuery, nil)
+	if result["__typename"] != "PersistedQueriesResult" {
+		t.Fatalf("Expected PersistedQueriesResult, got %v", result["__typename"])
+	}
+
+	// The chunks are served by the relay rather than uplink
+	chunks, _ := result["chunks"].([]interface{})
+	if len(chunks) != 1 {
+		t.Fatalf("Expected 1 chunk, got %v", result["chunks"])
+	}
+	urls, _ := chunks[0].(map[string]interface{})["urls"].([]interface{})
+	chunkURL, _ := urls[0].(string)
+	if !strings.HasPrefix(chunkURL, relayURL) {
+		t.Fatalf("Expected the chunk to be served by the relay, got %s", chunkURL)
+	}
+	resp, err := http.Get(chunkURL)
+	if err != nil {
+		t.Fatalf("Failed to fetch the chunk: %v", err)
+	}
+	defer resp.Body.Close()
+	if chunk, _ := io.ReadAll(resp.Body); resp.StatusCode != http.StatusOK || string(chunk) != integrationChunk {
+		t.Errorf("Expected the chunk contents, got %d %s", resp.StatusCode, chunk)
+	}
+
+	for i := 0; i < 2; i++ {
+		if unchanged := fetch(t, relayURL, routerPQQuery, uplink.PersistedQueriesQuery, result["id"]); unchanged["__typename"] != "Unchanged" {
+			t.Errorf("Expected Unchanged, got %v", unchanged["__typename"])
+		}
+	}
+}
+
+func TestIntegrationFetchError(t *testing.T) {
+	fakeServer := fakeUplink(t)
+	defer fakeServer.Close()
+	relayURL := startIntegrationRelay(t, fakeServer.URL)
+
+	// Uplink errors for unknown graphs are passed through in the uplink format
+	body, _ := json.Marshal(map[string]interface{}{
+		"query":         routerSupergraphQuery,
+		"operationName": uplink.SupergraphQuery,
+		"variables":     map[string]interface{}{"apiKey": "service:graph:key", "graph_ref": "unknown@current", "ifAfterId": nil},
+	})
+	resp, err := http.Post(relayURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("Request to the relay failed: %v", err)
+	}
+	defer resp.Body.Close()
+	var response struct {
+		Data map[string]map[string]interface{} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		t.Fatalf("Relay returned invalid JSON: %v", err)
+	}
+	result := response.Data["routerConfig"]
+	if result["__typename"] != "FetchError" {
+		t.Fatalf("Expected FetchError, got %v", result)
+	}
+	assertConforms(t, uplink.SupergraphQuery, result)
+}
+
+func TestIntegrationFetchErrorNotCached(t *testing.T) {
+	fakeServer := fakeUplink(t)
+	defer fakeServer.Close()
+	var uplinkRequests atomic.Int32
+	countingServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		uplinkRequests.Add(1)
+		fakeServer.Config.Handler.ServeHTTP(w, r)
+	}))
+	defer countingServer.Close()
+	relayURL := startIntegrationRelay(t, countingServer.URL)
+
+	// A router with an invalid key keeps getting the error from uplink, rather than a cached error replayed as Unchanged
+	body, _ := json.Marshal(map[string]interface{}{
+		"query":         routerSupergraphQuery,
+		"operationName": uplink.SupergraphQuery,
+		"variables":     map[string]interface{}{"apiKey": "service:graph:key", "graph_ref": "unknown@current", "ifAfterId": nil},
+	})
+	for i := 1; i <= 2; i++ {
+		resp, err := http.Post(relayURL, "application/json", bytes.NewReader(body))
+		if err != nil {
+			t.Fatalf("Request to the relay failed: %v", err)
+		}
+		var response struct {
+			Data map[string]map[string]interface{} `json:"data"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&response)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("Relay returned invalid JSON: %v", err)
+		}
+		if result := response.Data["routerConfig"]; result["__typename"] != "FetchError" {
+			t.Fatalf("Expected FetchError on request %d, got %v", i, result)
+		}
+		if got := uplinkRequests.Load(); got != int32(i) {
+			t.Fatalf("Expected request %d to go to uplink, uplink received %d requests", i, got)
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package proxy
+
+import (
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+)
+
+// shuttingDown is set as soon as the servers start shutting down, so probes fail while in-flight requests drain,
+// and cleared once servers are started again, e.g. after a reload.
+var shuttingDown atomic.Bool
+
+// LivenessHandler responds with 200 OK while the process is up, and 503 Service Unavailable once the servers are shutting down.
+func LivenessHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if shuttingDown.Load() {
+			http.Error(w, "shutting down", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok"))
+	}
+}
+
+// ReadinessHandler responds with 200 OK when the check reports the relay can serve traffic, and 503 Service Unavailable otherwise.
+// It fails as soon as the servers start shutting down, so load balancers stop sending traffic while in-flight requests drain.
+func ReadinessHandler(logger *slog.Logger, check func() error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if shuttingDown.Load() {
+			http.Error(w, "shutting down", http.StatusServiceUnavailable)
+			return
+		}
+		if err := check(); err != nil {
+			logger.Debug("Not ready", "err", err)
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok"))
+	}
+}
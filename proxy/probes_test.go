@@ -0,0 +1,120 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"apollosolutions/uplink-relay/config"
+	"apollosolutions/uplink-relay/logger"
+)
+
+func TestReadinessHandler(t *testing.T) {
+	// Servers shut down by other tests leave the relay shutting down
+	shuttingDown.Store(false)
+	pFalse := false
+	var checkErr error
+	handler := ReadinessHandler(logger.MakeLogger(&pFalse), func() error { return checkErr })
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if rr.Code != http.StatusOK {
+		t.Errorf("Expected status code 200, but got %d", rr.Code)
+	}
+
+	checkErr = fmt.Errorf("the supergraph of graph@local isn't cached yet")
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected status code 503 when the check fails, but got %d", rr.Code)
+	}
+}
+
+func TestReadinessDuringShutdown(t *testing.T) {
+	mockConfig := config.NewDefaultConfig()
+	mockConfig.Relay.Address = "127.0.0.1:0"
+	pFalse := false
+	mockLogger := logger.MakeLogger(&pFalse)
+
+	// A request that stays in flight until released, holding up the shutdown
+	started := make(chan struct{})
+	release := make(chan struct{})
+	DeregisterHandlers()
+	defer DeregisterHandlers()
+	RegisterHandlers("/", func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		w.Write([]byte("relay"))
+	})
+	readiness := ReadinessHandler(mockLogger, func() error { return nil })
+	liveness := LivenessHandler()
+	probe := func(handler http.HandlerFunc) int {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/", nil))
+		return rr.Code
+	}
+
+	servers, err := StartServer(mockConfig, mockLogger)
+	if err != nil {
+		t.Fatalf("StartServer returned an error: %v", err)
+	}
+	if code := probe(readiness); code != http.StatusOK {
+		t.Fatalf("Expected the relay to be ready once started, but got %d", code)
+	}
+	if code := probe(liveness); code != http.StatusOK {
+		t.Fatalf("Expected the relay to be live once started, but got %d", code)
+	}
+
+	inFlight := make(chan int)
+	go func() {
+		resp, err := http.Get("http://" + servers[0].Addr + "/")
+		if err != nil {
+			inFlight <- 0
+			return
+		}
+		resp.Body.Close()
+		inFlight <- resp.StatusCode
+	}()
+	<-started
+
+	shutdown := make(chan struct{})
+	go func() {
+		ShutdownServer(servers, mockLogger)
+		close(shutdown)
+	}()
+
+	// Readiness fails as soon as the shutdown starts, while the in-flight request is still draining
+	deadline := time.Now().Add(time.Second)
+	for probe(readiness) != http.StatusServiceUnavailable {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the relay not to be ready while shutting down")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	select {
+	case <-shutdown:
+		t.Fatalf("Expected the shutdown to wait for the in-flight request")
+	default:
+	}
+	if code := probe(liveness); code != http.StatusServiceUnavailable {
+		t.Errorf("Expected the relay not to be live while shutting down, but got %d", code)
+	}
+
+	close(release)
+	if code := <-inFlight; code != http.StatusOK {
+		t.Errorf("Expected the in-flight request to complete, but got %d", code)
+	}
+	<-shutdown
+
+	// Starting the servers again, e.g. on reload, makes the relay ready again
+	servers, err = StartServer(mockConfig, mockLogger)
+	if err != nil {
+		t.Fatalf("StartServer returned an error: %v", err)
+	}
+	defer ShutdownServer(servers, mockLogger)
+	if code := probe(readiness); code != http.StatusOK {
+		t.Errorf("Expected the relay to be ready once restarted, but got %d", code)
+	}
+}
@@ -5,117 +5,315 @@ import (
 	"compress/gzip"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
 	"os"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"apollosolutions/uplink-relay/audit"
 	"apollosolutions/uplink-relay/cache"
 	"apollosolutions/uplink-relay/config"
 	"apollosolutions/uplink-relay/entitlements"
+	"apollosolutions/uplink-relay/internal/relayerrors"
 	"apollosolutions/uplink-relay/internal/util"
+	"apollosolutions/uplink-relay/metrics"
 	persistedqueries "apollosolutions/uplink-relay/persisted_queries"
 	"apollosolutions/uplink-relay/pinning"
 	"apollosolutions/uplink-relay/schema"
 	"apollosolutions/uplink-relay/uplink"
 )
 
+// listenerMuxes holds the handlers for routes served on a dedicated address rather than the relay address, keyed by address.
+var listenerMuxes = map[string]*http.ServeMux{}
+
 // Register handlers for proxy routes.
 func RegisterHandlers(route string, handler http.HandlerFunc) {
 	http.HandleFunc(route, handler)
 }
 
+// RegisterRelayHandler registers the relay handler for every request under the given path, e.g. "/" or "/uplink".
+// Handlers registered on more specific routes, such as the webhook or persisted query routes, take precedence.
+func RegisterRelayHandler(path string, handler http.HandlerFunc) {
+	path = "/" + strings.Trim(path, "/")
+	if path == "/" {
+		RegisterHandlers("/", handler)
+		return
+	}
+	// Routers are configured with the path itself, so it's registered alongside the subtree rather than redirected to it
+	RegisterHandlers(path, handler)
+	RegisterHandlers(path+"/", handler)
+}
+
+// RegisterHandlersOn registers a handler on a dedicated listener for the given address.
+// An empty address, or one matching a relay address, registers the handler on the relay's servers, the same as RegisterHandlers.
+func RegisterHandlersOn(config *config.Config, address string, route string, handler http.HandlerFunc) {
+	if address == "" || slices.Contains(config.Relay.ListenAddresses(), address) {
+		RegisterHandlers(route, handler)
+		return
+	}
+	mux, ok := listenerMuxes[address]
+	if !ok {
+		mux = http.NewServeMux()
+		listenerMuxes[address] = mux
+	}
+	mux.HandleFunc(route, handler)
+}
+
 // Deregister all handlers for proxy routes (for reload purposes)
 func DeregisterHandlers() {
 	http.DefaultServeMux = http.NewServeMux()
+	listenerMuxes = map[string]*http.ServeMux{}
+}
+
+// StartServer starts an HTTP server on every relay address, sharing the same handlers, plus an additional server for every dedicated listener address.
+// Each address is bound before returning so that a port conflict is reported as an error.
+func StartServer(config *config.Config, logger *slog.Logger) ([]*http.Server, error) {
+	var servers []*http.Server
+	for _, address := range config.Relay.ListenAddresses() {
+		logger.Info("Starting Uplink Relay  🛰  ", "address", address)
+		server, err := startListener(config, logger, address, http.DefaultServeMux)
+		if err != nil {
+			ShutdownServer(servers, logger)
+			return nil, err
+		}
+		servers = append(servers, server)
+	}
+
+	for listenerAddress, mux := range listenerMuxes {
+		logger.Info("Starting dedicated listener", "address", listenerAddress)
+		server, err := startListener(config, logger, listenerAddress, mux)
+		if err != nil {
+			ShutdownServer(servers, logger)
+			return nil, err
+		}
+		servers = append(servers, server)
+	}
+	shuttingDown.Store(false)
+	return servers, nil
 }
 
-// StartServer starts the HTTP server with the given address and handler.
-func StartServer(config *config.Config, logger *slog.Logger) (*http.Server, error) {
-	address := config.Relay.Address
-	logger.Info("Starting Uplink Relay  🛰  ", "address", address)
-	server := &http.Server{Addr: address, Handler: http.DefaultServeMux}
+// startListener binds the given address and serves the handler on it in the background.
+func startListener(config *config.Config, logger *slog.Logger, address string, handler http.Handler) (*http.Server, error) {
+	listener, err := listen(config, address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %w", address, err)
+	}
+	if config.Relay.MaxConcurrentConnections > 0 {
+		listener = limitConnections(listener, config.Relay.MaxConcurrentConnections, logger)
+	}
+	// Use the bound address so an ephemeral port (":0") is reported correctly
+	server := &http.Server{Addr: listener.Addr().String(), Handler: handler}
 	go func() {
 		var err error
 		if config.Relay.TLS.CertFile != "" && config.Relay.TLS.KeyFile != "" {
-			err = server.ListenAndServeTLS(config.Relay.TLS.CertFile, config.Relay.TLS.KeyFile)
+			err = server.ServeTLS(listener, config.Relay.TLS.CertFile, config.Relay.TLS.KeyFile)
 		} else {
-			err = server.ListenAndServe()
+			err = server.Serve(listener)
 		}
 		if err != nil && err != http.ErrServerClosed {
-			logger.Error("ListenAndServe error", "err", err)
+			logger.Error("ListenAndServe error", "address", address, "err", err)
 			os.Exit(1)
 		}
 	}()
 	return server, nil
 }
 
-// Shut down the server with a context that times out after 5 seconds.
-func ShutdownServer(server *http.Server, logger *slog.Logger) {
+// listen binds a TCP address, or a Unix domain socket for addresses of the form unix:/path/to.sock.
+// The socket file is removed when the listener is closed on shutdown.
+func listen(config *config.Config, address string) (net.Listener, error) {
+	socketPath, ok := strings.CutPrefix(address, "unix:")
+	if !ok {
+		return net.Listen("tcp", address)
+	}
+
+	// Remove a socket file left behind by a relay that didn't shut down cleanly
+	if info, err := os.Stat(socketPath); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(socketPath); err != nil {
+			return nil, err
+		}
+	}
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return nil, err
+	}
+	if config.Relay.SocketMode != "" {
+		mode, err := strconv.ParseUint(config.Relay.SocketMode, 8, 32)
+		if err == nil {
+			err = os.Chmod(socketPath, os.FileMode(mode))
+		}
+		if err != nil {
+			listener.Close()
+			return nil, fmt.Errorf("failed to set socket mode: %w", err)
+		}
+	}
+	return listener, nil
+}
+
+// Shut down the servers with a context that times out after 5 seconds, draining them concurrently.
+// Liveness and readiness probes fail from the start, while in-flight requests drain.
+func ShutdownServer(servers []*http.Server, logger *slog.Logger) {
+	shuttingDown.Store(true)
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
-	if err := server.Shutdown(ctx); err != nil {
-		logger.Error("Uplink Relay Shutdown", "err", err)
-	} else {
-		logger.Info("Uplink Relay shut down properly")
+	var wg sync.WaitGroup
+	for _, server := range servers {
+		wg.Add(1)
+		go func(server *http.Server) {
+			defer wg.Done()
+			if err := server.Shutdown(ctx); err != nil {
+				logger.Error("Uplink Relay Shutdown", "address", server.Addr, "err", err)
+			} else {
+				logger.Info("Uplink Relay shut down properly", "address", server.Addr)
+			}
+		}(server)
+	}
+	wg.Wait()
+}
+
+// maxPooledRequestBuffer is the largest request buffer returned to the pool, so an unusually large request doesn't pin its buffer.
+const maxPooledRequestBuffer = 64 * 1024
+
+// requestBuffers pools the buffers request bodies are read into, as every relay request is read in full before it's handled.
+var requestBuffers = sync.Pool{New: func() interface{} { return new(bytes.Buffer) }}
+
+func putRequestBuffer(buffer *bytes.Buffer) {
+	if buffer.Cap() <= maxPooledRequestBuffer {
+		requestBuffers.Put(buffer)
 	}
 }
 
 // parseRequest parses and validates the request.
 func parseRequest(r *http.Request) (util.UplinkRelayRequest, error) {
 	var requestBody util.UplinkRelayRequest
-	body, err := io.ReadAll(r.Body)
+	buffer := requestBuffers.Get().(*bytes.Buffer)
+	buffer.Reset()
+	defer putRequestBuffer(buffer)
+	_, err := buffer.ReadFrom(r.Body)
 	if err != nil {
-		err := fmt.Errorf("failed to read request body: %w", err)
+		err := fmt.Errorf("%w: failed to read request body: %w", relayerrors.ErrInvalidRequest, err)
 		return requestBody, err
 	}
-	err = json.Unmarshal(body, &requestBody)
+	err = json.Unmarshal(buffer.Bytes(), &requestBody)
 	if err != nil {
-		err := fmt.Errorf("failed to unmarshal request body: %w", err)
+		err := fmt.Errorf("%w: failed to unmarshal request body: %w", relayerrors.ErrInvalidRequest, err)
 		return requestBody, err
 	}
 
-	// Replace the body so it can be read again later
-	r.Body = io.NopCloser(bytes.NewBuffer(body))
+	// Replace the body so it can be read again later; the buffer goes back to the pool, so the body is copied
+	r.Body = io.NopCloser(bytes.NewReader(bytes.Clone(buffer.Bytes())))
 
 	return requestBody, nil
 }
 
-// Logs the request headers if debug mode is enabled.
-func debugRequestHeaders(logger *slog.Logger, r *http.Request) {
-	for name, values := range r.Header {
+// graphRefFromVariables returns the graph_ref variable of an uplink request.
+// If the graph and variant are sent separately as graphId and variant, the graph_ref is reconstructed from them and replaces them in the variables, so the cache key matches.
+func graphRefFromVariables(variables map[string]interface{}) (string, error) {
+	if rawGraphRef, ok := variables["graph_ref"]; ok && rawGraphRef != nil {
+		graphRef, ok := rawGraphRef.(string)
+		if !ok {
+			return "", fmt.Errorf("%w: graph_ref must be a string, got %T", relayerrors.ErrInvalidRequest, rawGraphRef)
+		}
+		return graphRef, nil
+	}
+
+	graphID, graphIDOk := variables["graphId"].(string)
+	variantID, variantOk := variables["variant"].(string)
+	if !graphIDOk || !variantOk || graphID == "" || variantID == "" {
+		return "", fmt.Errorf("%w: missing graph_ref", relayerrors.ErrInvalidRequest)
+	}
+	graphRef := fmt.Sprintf("%s@%s", graphID, variantID)
+	variables["graph_ref"] = graphRef
+	delete(variables, "graphId")
+	delete(variables, "variant")
+	return graphRef, nil
+}
+
+// ifAfterIdFromVariables returns the ifAfterId variable of an uplink request, setting it to an empty string if it's not set.
+func ifAfterIdFromVariables(variables map[string]interface{}) (string, error) {
+	rawIfAfterId, ok := variables["ifAfterId"]
+	if !ok || rawIfAfterId == nil {
+		if variables != nil {
+			variables["ifAfterId"] = ""
+		}
+		return "", nil
+	}
+	ifAfterId, ok := rawIfAfterId.(string)
+	if !ok {
+		return "", fmt.Errorf("%w: ifAfterId must be a string, got %T", relayerrors.ErrInvalidRequest, rawIfAfterId)
+	}
+	return ifAfterId, nil
+}
+
+// checkGraphAccess returns an error if the relay can't serve the graph: ErrGraphNotAllowed if graphs are restricted to the configured ones,
+// or ErrGraphNotFound if it isn't configured and the request has no API key to proxy it with.
+func checkGraphAccess(userConfig *config.Config, graphRef string, variables map[string]interface{}) error {
+	_, err := config.FindSupergraphConfigFromGraphRef(graphRef, userConfig)
+	if err == nil {
+		return nil
+	}
+	if userConfig.Relay.RestrictGraphs {
+		return fmt.Errorf("%w: %s isn't configured", relayerrors.ErrGraphNotAllowed, graphRef)
+	}
+	if apiKey, _ := variables["apiKey"].(string); apiKey == "" {
+		return err
+	}
+	return nil
+}
+
+// writeError writes the HTTP status for the class of the error, e.g. 400 for invalid requests or 404 for unknown graphs.
+func writeError(w http.ResponseWriter, err error) {
+	status := relayerrors.HTTPStatus(err)
+	http.Error(w, http.StatusText(status), status)
+}
+
+// Logs the request headers if debug mode is enabled, redacting the values of the given headers, such as credentials.
+func debugRequestHeaders(logger *slog.Logger, r *http.Request, redactedHeaders []string) {
+	if !logger.Enabled(r.Context(), slog.LevelDebug) {
+		return
+	}
+	for name, values := range redactHeaders(r.Header, redactedHeaders) {
 		for _, value := range values {
-			logger.Debug("Request header: %s = %s\n", name, value)
+			logger.Debug("Request header", "name", name, "value", value)
 		}
 	}
 }
 
-// Reads and logs the request body if debug mode is enabled.
+// Reads and logs the request body if debug mode is enabled, redacting the values of the given variables, such as the router's API key.
 // It replaces the request body with a new buffer so it can be read again later.
-func debugRequestBody(logger *slog.Logger, r *http.Request) {
-	if r.Body == nil {
+func debugRequestBody(logger *slog.Logger, r *http.Request, redactedVariables []string) {
+	// Skip reading the body when it wouldn't be logged
+	if r.Body == nil || !logger.Enabled(r.Context(), slog.LevelDebug) {
 		return
 	}
 	bodyBytes, err := io.ReadAll(r.Body)
 	if err != nil {
 		logger.Error("Failed to read request body", "err", err)
 	}
-	logger.Debug("Request body", "body", bodyBytes)
+	if redacted, ok := redactBody(bodyBytes, redactedVariables); ok {
+		logger.Debug("Request body", "body", redacted)
+	} else {
+		logger.Debug("Request body isn't JSON, not logging it", "size", len(bodyBytes))
+	}
 
 	// Replace the body so it can be read again later
 	r.Body = io.NopCloser(bytes.NewBuffer(bodyBytes))
 }
 
-// Logs the response headers if debug mode is enabled.
-func debugResponseHeaders(logger *slog.Logger, headers http.Header) {
-	for name, values := range headers {
+// Logs the response headers if debug mode is enabled, redacting the values of the given headers, such as cookies.
+func debugResponseHeaders(logger *slog.Logger, headers http.Header, redactedHeaders []string) {
+	for name, values := range redactHeaders(headers, redactedHeaders) {
 		for _, value := range values {
-			logger.Debug("Response header: %s = %s\n", name, value)
+			logger.Debug("Response header", "name", name, "value", value)
 		}
 	}
 }
@@ -133,11 +331,17 @@ func debugResponseBody(logger *slog.Logger, r *http.Response) {
 	r.Body = io.NopCloser(bytes.NewBuffer(bodyBytes))
 }
 
+// cacheableRouterConfig reports whether a routerConfig result should be cached: a RouterConfigResult with a supergraph,
+// or Unchanged, which is cached for the router's ifAfterId so webhooks and polling can replace it with a newer supergraph.
+func cacheableRouterConfig(typename string, supergraph string) bool {
+	return (typename == "RouterConfigResult" && supergraph != "") || typename == "Unchanged"
+}
+
 // Modifies the proxied response before it is returned to the client.
 func modifyProxiedResponse(config *config.Config, systemCache cache.Cache, cacheKey string, uplinkRequest util.UplinkRelayRequest, logger *slog.Logger) func(*http.Response) error {
 	return func(resp *http.Response) error {
 		// Debug log the response headers
-		debugResponseHeaders(logger, resp.Header)
+		debugResponseHeaders(logger, resp.Header, config.Relay.RedactedHeaders)
 
 		// Debug log the response body
 		debugResponseBody(logger, resp)
@@ -175,13 +379,15 @@ func modifyProxiedResponse(config *config.Config, systemCache cache.Cache, cache
 		err := json.Unmarshal(responseBody, &responseStruct)
 		if err != nil {
 			logger.Error("Failed to unmarshal response body", "err", err, "responseBody", string(responseBody[:]))
+			// Pass the response through as-is, e.g. an error page from a load balancer in front of uplink
+			resp.Body = io.NopCloser(bytes.NewBuffer(responseBody))
 			return nil
 		}
 		// Cache the response based on the operation name
 		if uplinkRequest.OperationName == uplink.SupergraphQuery {
 			var uplinkResponse schema.UplinkSupergraphSdlResponse
 
-			err := json.Unmarshal(responseBody, &uplinkResponse)
+			err := util.DecodeUplinkResponse(responseBody, &uplinkResponse, config.Uplink.StrictDecode)
 			if err != nil {
 				logger.Error("Failed to unmarshal response body", "err", err, "responseBody", string(responseBody[:]))
 				return nil
@@ -189,32 +395,35 @@ func modifyProxiedResponse(config *config.Config, systemCache cache.Cache, cache
 
 			// Extract the schema from the UplinkResponse
 			supergraph := uplinkResponse.Data.RouterConfig.SupergraphSdl
+			if uplinkResponse.Data.RouterConfig.Typename == "Unchanged" {
+				schema.MarkConfirmed(uplinkRequest.Variables["graph_ref"].(string), time.Now())
+			}
 
 			// Log the UplinkResponse
 			logger.Debug("SupergraphSdlQuery response", "response", uplinkResponse)
 
-			id, err := time.Parse(time.RFC3339, uplinkResponse.Data.RouterConfig.ID)
-			if err != nil {
-				logger.Error("Failed to parse license expiration", "graphRef", uplinkRequest.Variables["graph_ref"], "err", err)
-				return err
-			}
-			if uplinkRequest.Variables["ifAfterId"] == nil {
-				uplinkRequest.Variables["ifAfterId"] = ""
-			}
 			// Cache the response for future requests.
-			if config.Cache.Enabled {
+			// Errors and results without a supergraph aren't cached, as cached entries are replayed to routers as Unchanged.
+			if config.Cache.OperationEnabled(uplink.SupergraphQuery) && cacheableRouterConfig(uplinkResponse.Data.RouterConfig.Typename, supergraph) {
+				supergraphID := util.UplinkIDOrNow(logger, uplinkResponse.Data.RouterConfig.ID, "graphRef", uplinkRequest.Variables["graph_ref"])
+				// Keep fields the relay doesn't model, e.g. those requested by newer routers, so they're replayed on cache hits
+				extraFields, err := schema.ExtraRouterConfigFields(responseBody)
+				if err != nil {
+					logger.Error("Failed to unmarshal response body", "err", err, "responseBody", string(responseBody[:]))
+					return nil
+				}
 				logger.Debug("Caching schema", "key", cacheKey)
-				err = schema.CacheSchema(systemCache, logger, uplinkRequest.Variables["graph_ref"].(string), supergraph, id, uplinkRequest.Variables["ifAfterId"].(string), config.Cache.Duration)
+				ifAfterId, _ := ifAfterIdFromVariables(uplinkRequest.Variables)
+				err = schema.CacheSchema(systemCache, logger, uplinkRequest.Variables["graph_ref"].(string), supergraph, supergraphID, ifAfterId, uplinkResponse.Data.RouterConfig.MinDelaySeconds, extraFields, config.CacheDuration())
 				if err != nil {
-					logger.Error("Failed to cache schema", "err", err)
-					return err
+					recordCacheWriteError(logger, "supergraph", cacheKey, err)
 				}
 			}
 		} else if uplinkRequest.OperationName == uplink.LicenseQuery {
 			// Assert the type of the response
 			var uplinkResponse entitlements.UplinkLicenseResponse
 
-			err := json.Unmarshal(responseBody, &uplinkResponse)
+			err := util.DecodeUplinkResponse(responseBody, &uplinkResponse, config.Uplink.StrictDecode)
 			if err != nil {
 				logger.Error("Failed to unmarshal response body", "err", err, "responseBody", string(responseBody[:]))
 				return nil
@@ -222,34 +431,23 @@ func modifyProxiedResponse(config *config.Config, systemCache cache.Cache, cache
 			// Log the LicenseQueryResponse
 			logger.Debug("LicenseQuery response", "response", uplinkResponse)
 
-			jwt := ""
-			if uplinkResponse.Data.RouterEntitlements.Entitlement != nil {
-				jwt = uplinkResponse.Data.RouterEntitlements.Entitlement.Jwt
-			}
+			typename, jwt := entitlements.CachedEntitlement(uplinkResponse.Data.RouterEntitlements, config.Cache.MissingEntitlement)
 
 			// TODO: Add user docs on the time format supported
-			expiration, err := time.Parse(time.RFC3339, uplinkResponse.Data.RouterEntitlements.ID)
-			if err != nil {
-				logger.Error("Failed to parse license expiration", "graphRef", uplinkRequest.Variables["graph_ref"], "err", err)
-				return err
-			}
+			expiration := util.ParseUplinkTimestampOrNow(logger, uplinkResponse.Data.RouterEntitlements.ID, "graphRef", uplinkRequest.Variables["graph_ref"])
 			// Cache the response for future requests, if caching is enabled
-			if config.Cache.Enabled {
+			if config.Cache.OperationEnabled(uplink.LicenseQuery) {
 				logger.Debug("Caching JWT", "key", cacheKey)
-				ifAfterId := ""
-				if uplinkRequest.Variables["ifAfterId"] != nil {
-					ifAfterId = uplinkRequest.Variables["ifAfterId"].(string)
-				}
-				err = entitlements.CacheLicense(systemCache, logger, uplinkRequest.Variables["graph_ref"].(string), jwt, expiration, config.Cache.Duration, ifAfterId)
+				ifAfterId, _ := ifAfterIdFromVariables(uplinkRequest.Variables)
+				err = entitlements.CacheLicense(systemCache, logger, uplinkRequest.Variables["graph_ref"].(string), typename, jwt, uplinkResponse.Data.RouterEntitlements.ID, expiration, uplinkResponse.Data.RouterEntitlements.MinDelaySeconds, config.CacheDuration(), ifAfterId)
 				if err != nil {
-					logger.Error("Failed to cache license", "err", err)
-					// do nothing to avoid returning an error
+					recordCacheWriteError(logger, "entitlement", cacheKey, err)
 				}
 			}
 		} else if uplinkRequest.OperationName == uplink.PersistedQueriesQuery {
 			var uplinkResponse persistedqueries.UplinkPersistedQueryResponse
 
-			err := json.Unmarshal(responseBody, &uplinkResponse)
+			err := util.DecodeUplinkResponse(responseBody, &uplinkResponse, config.Uplink.StrictDecode)
 			if err != nil {
 				logger.Error("Failed to unmarshal response body", "err", err, "responseBody", string(responseBody[:]))
 				return nil
@@ -259,12 +457,14 @@ func modifyProxiedResponse(config *config.Config, systemCache cache.Cache, cache
 			logger.Debug("PersistedQuery response", "response", uplinkResponse)
 
 			// Cache the response for future requests, if caching is enabled
-			if config.Cache.Enabled {
+			if config.Cache.OperationEnabled(uplink.PersistedQueriesQuery) {
 				logger.Debug("Caching PersistedQuery", "key", cacheKey)
-				chunks, err := persistedqueries.CachePersistedQueryChunkData(config, logger, systemCache, uplinkResponse.Data.PersistedQueries.Chunks)
+				chunks, err := persistedqueries.CachePersistedQueryChunkData(resp.Request.Context(), config, logger, systemCache, uplinkRequest.Variables["graph_ref"].(string), uplinkResponse.Data.PersistedQueries.Chunks)
 				if err != nil {
-					logger.Error("Failed to cache PersistedQuery chunks", "err", err)
-					return err
+					// Serve the upstream response, with the chunks still pointing at uplink, rather than failing the request
+					recordCacheWriteError(logger, "persistedQueries", cacheKey, err)
+					resp.Body = io.NopCloser(bytes.NewBuffer(responseBody))
+					return nil
 				}
 				uplinkResponse.Data.PersistedQueries.Chunks = chunks
 
@@ -280,24 +480,24 @@ func modifyProxiedResponse(config *config.Config, systemCache cache.Cache, cache
 				cacheEntry := cache.CacheItem{
 					ID:           uplinkResponse.Data.PersistedQueries.ID,
 					Content:      responseBody,
-					Expiration:   cache.ExpirationTime(config.Cache.Duration),
+					Expiration:   cache.ExpirationTime(config.CacheDuration()),
 					Hash:         util.HashString(string(responseBody[:])),
 					LastModified: time.Now(),
 				}
 
-				cacheEntryBytes, err := json.Marshal(cacheEntry)
+				cacheEntryBytes, err := cache.EncodeItem(cacheEntry)
 				if err != nil {
 					logger.Error("Failed to marshal PersistedQuery chunks", "err", err)
 					return err
 				}
 
 				// Cache the response
-				err = systemCache.Set(cacheKey, string(cacheEntryBytes[:]), config.Cache.Duration)
+				err = systemCache.Set(cacheKey, string(cacheEntryBytes[:]), config.CacheDuration())
 				if err != nil {
-					logger.Error("Failed to cache response", "err", err)
+					recordCacheWriteError(logger, "persistedQueries", cacheKey, err)
+				} else if err := cache.UpdateNewest(systemCache, logger, uplinkRequest.Variables["graph_ref"].(string), uplink.PersistedQueriesQuery, cacheEntry); err != nil {
+					recordCacheWriteError(logger, "persistedQueries", cacheKey, err)
 				}
-
-				cache.UpdateNewest(systemCache, logger, uplinkRequest.Variables["graph_ref"].(string), uplink.PersistedQueriesQuery, cacheEntry)
 			}
 		} else {
 			logger.Warn("Unknown operation name", "operationName", uplinkRequest.OperationName)
@@ -317,9 +517,17 @@ func modifyProxiedResponse(config *config.Config, systemCache cache.Cache, cache
 	}
 }
 
+// recordCacheWriteError logs a failed cache write and counts it, without failing the request.
+// A degraded cache backend should degrade caching, not the availability of the relay.
+func recordCacheWriteError(logger *slog.Logger, artifact string, cacheKey string, err error) {
+	logger.Error("Failed to write to cache, serving the upstream response", "artifact", artifact, "cacheKey", cacheKey, "err", err)
+	metrics.CacheWriteErrors.Inc(artifact)
+}
+
 // Creates a reverse proxy to the target URL.
-func makeProxy(config *config.Config, cache cache.Cache, httpClient *http.Client, logger *slog.Logger) func(*url.URL, string, util.UplinkRelayRequest) *httputil.ReverseProxy {
-	return func(targetURL *url.URL, cacheKey string, uplinkRequest util.UplinkRelayRequest) *httputil.ReverseProxy {
+// The release function is called once the proxied response completes, either successfully or with an error.
+func makeProxy(config *config.Config, cache cache.Cache, httpClient *http.Client, logger *slog.Logger) func(*url.URL, string, util.UplinkRelayRequest, func()) *httputil.ReverseProxy {
+	return func(targetURL *url.URL, cacheKey string, uplinkRequest util.UplinkRelayRequest, release func()) *httputil.ReverseProxy {
 		proxy := &httputil.ReverseProxy{
 			Rewrite: func(pr *httputil.ProxyRequest) {
 				pr.Out.URL = targetURL
@@ -329,13 +537,60 @@ func makeProxy(config *config.Config, cache cache.Cache, httpClient *http.Client
 		}
 		proxy.Transport = httpClient.Transport
 		proxy.ErrorHandler = func(rw http.ResponseWriter, req *http.Request, err error) {
+			release()
 			logger.Error("HTTP proxy error", "err", err)
+			writeFetchError(rw, logger, relayerrors.HTTPStatus(relayerrors.Upstream(err)), uplinkRequest.OperationName, fetchErrorRetryLater, "Uplink could not be reached", config.Relay.ErrorMinDelaySeconds)
+		}
+		modifyResponse := modifyProxiedResponse(config, cache, cacheKey, uplinkRequest, logger)
+		proxy.ModifyResponse = func(resp *http.Response) error {
+			release()
+			return modifyResponse(resp)
 		}
-		proxy.ModifyResponse = modifyProxiedResponse(config, cache, cacheKey, uplinkRequest, logger)
 		return proxy
 	}
 }
 
+// fetchErrorRetryLater is the FetchError code uplink uses to tell routers to retry after minDelaySeconds.
+const fetchErrorRetryLater = "RETRY_LATER"
+
+// fetchErrorFields maps each uplink operation to the field its result is returned on.
+var fetchErrorFields = map[string]string{
+	uplink.SupergraphQuery:       "routerConfig",
+	uplink.LicenseQuery:          "routerEntitlements",
+	uplink.PersistedQueriesQuery: "persistedQueries",
+}
+
+// writeFetchError writes an uplink FetchError response for the given operation with the given status, so routers back off by minDelaySeconds rather than failing to parse the response.
+func writeFetchError(w http.ResponseWriter, logger *slog.Logger, status int, operationName string, code string, message string, minDelaySeconds int) {
+	field, ok := fetchErrorFields[operationName]
+	if !ok {
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+
+	responseBody, err := json.Marshal(map[string]interface{}{
+		"data": map[string]interface{}{
+			field: map[string]interface{}{
+				"__typename":      "FetchError",
+				"code":            code,
+				"message":         message,
+				"minDelaySeconds": minDelaySeconds,
+			},
+		},
+	})
+	if err != nil {
+		logger.Error("Failed to marshal FetchError response", "err", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if _, err := w.Write(responseBody); err != nil {
+		logger.Error("Failed to write response", "err", err)
+	}
+}
+
 // Parses the target URL.
 func parseUrl(target string) (*url.URL, error) {
 	proxyUrl, err := url.Parse(target)
@@ -345,41 +600,92 @@ func parseUrl(target string) (*url.URL, error) {
 	return proxyUrl, nil
 }
 
+// cachedMinDelaySeconds returns the minDelaySeconds stored with the cache item, or the default for entries cached without it.
+func cachedMinDelaySeconds(cacheItem *cache.CacheItem, defaultMinDelaySeconds float64) float64 {
+	if cacheItem.MinDelaySeconds > 0 {
+		return cacheItem.MinDelaySeconds
+	}
+	return defaultMinDelaySeconds
+}
+
 // Handles a cache hit by returning the cached response.
-func handleCacheHit(cacheKey string, cacheItem *cache.CacheItem, logger *slog.Logger, cacheDuration time.Duration, ifAfterId string) func(w http.ResponseWriter, r *http.Request) error {
+// When emitCacheHeaders is set, Cache-Control and Age headers are added based on the minDelaySeconds and the cached item's LastModified time.
+func handleCacheHit(cacheKey string, cacheItem *cache.CacheItem, logger *slog.Logger, cacheDuration time.Duration, emitCacheHeaders bool, ifAfterId string) func(w http.ResponseWriter, r *http.Request) error {
 	return func(w http.ResponseWriter, r *http.Request) error {
-		var response interface{}
+		responseBody, minDelaySeconds, err := cacheHitResponse(cacheKey, cacheItem, logger, cacheDuration, ifAfterId)
+		if err != nil {
+			logger.Error("Failed to build cached response", "err", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return nil
+		}
+		writeCacheHit(w, logger, cacheItem, responseBody, minDelaySeconds, emitCacheHeaders)
+		return nil
+	}
+}
 
-		// Format the response body based on operation name
-		if strings.Contains(cacheKey, uplink.SupergraphQuery) {
-			typename := "RouterConfigResult"
-			if len(cacheItem.Content) == 0 {
-				typename = "Unchanged"
-			}
-			// round the timestamp to help with cache hits
-			timestamp := time.Now().UTC().Round(cacheDuration).Format(time.RFC3339)
+// cacheHitResponse builds the uplink response body for a cache hit, returning it with the minDelaySeconds it contains.
+func cacheHitResponse(cacheKey string, cacheItem *cache.CacheItem, logger *slog.Logger, cacheDuration time.Duration, ifAfterId string) ([]byte, float64, error) {
+	var response interface{}
+	var minDelaySeconds float64
+
+	// Format the response body based on operation name
+	if strings.Contains(cacheKey, uplink.SupergraphQuery) {
+		typename := "RouterConfigResult"
+		if len(cacheItem.Content) == 0 {
+			typename = "Unchanged"
+		}
+		// Replay uplink's ID if it was stored; pinned entries store the launch ID instead, so fall back to a
+		// timestamp rounded to help with cache hits
+		timestamp := cacheItem.ID
+		if _, err := util.ParseUplinkTimestamp(timestamp); err != nil {
+			timestamp = time.Now().UTC().Round(cacheDuration).Format(time.RFC3339)
+		}
+		minDelaySeconds = cachedMinDelaySeconds(cacheItem, 30)
 
+		routerConfig := schema.UplinkRouterConfig{
+			ID:              timestamp,
+			Typename:        typename,
+			SupergraphSdl:   string(cacheItem.Content[:]),
+			MinDelaySeconds: minDelaySeconds,
+		}
+		if len(cacheItem.ExtraFields) > 0 {
+			// Replay the fields uplink returned that the relay doesn't model
+			fields, err := routerConfig.WithExtraFields(cacheItem.ExtraFields)
+			if err != nil {
+				return nil, 0, err
+			}
+			response = map[string]interface{}{"data": map[string]interface{}{"routerConfig": fields}}
+		} else {
 			response = &schema.UplinkSupergraphSdlResponse{
 				Data: struct {
 					RouterConfig schema.UplinkRouterConfig `json:"routerConfig"`
 				}{
-					RouterConfig: schema.UplinkRouterConfig{
-						ID:              timestamp,
-						Typename:        typename,
-						SupergraphSdl:   string(cacheItem.Content[:]),
-						MinDelaySeconds: 30,
-					},
+					RouterConfig: routerConfig,
 				},
 			}
-		} else if strings.Contains(cacheKey, uplink.LicenseQuery) {
-			typename := "RouterEntitlementsResult"
-
-			jwtEntitlement := &entitlements.Jwt{Jwt: string(cacheItem.Content[:])}
-			if len(cacheItem.Content) == 0 {
+		}
+	} else if strings.Contains(cacheKey, uplink.LicenseQuery) {
+		typename := "RouterEntitlementsResult"
+
+		jwtEntitlement := &entitlements.Jwt{Jwt: string(cacheItem.Content[:])}
+		if len(cacheItem.Content) == 0 {
+			jwtEntitlement = nil
+			// Results without an entitlement are replayed as such; Unchanged responses, and items cached without a typename, are Unchanged
+			if cacheItem.Typename != typename {
 				typename = "Unchanged"
-				jwtEntitlement = nil
 			}
-
+		}
+		minDelaySeconds = cachedMinDelaySeconds(cacheItem, 60)
+
+		if jwtEntitlement == nil && typename == "RouterEntitlementsResult" {
+			// Uplink sends an explicit null entitlement, which the struct would omit
+			response = map[string]interface{}{"data": map[string]interface{}{"routerEntitlements": map[string]interface{}{
+				"__typename":      typename,
+				"id":              cacheItem.ID,
+				"minDelaySeconds": minDelaySeconds,
+				"entitlement":     nil,
+			}}}
+		} else {
 			response = &entitlements.UplinkLicenseResponse{
 				Data: struct {
 					RouterEntitlements entitlements.UplinkRouterEntitlements `json:"routerEntitlements"`
@@ -387,134 +693,466 @@ func handleCacheHit(cacheKey string, cacheItem *cache.CacheItem, logger *slog.Lo
 					RouterEntitlements: entitlements.UplinkRouterEntitlements{
 						ID:              cacheItem.ID,
 						Typename:        typename,
-						MinDelaySeconds: 60,
+						MinDelaySeconds: minDelaySeconds,
 						Entitlement:     jwtEntitlement,
 					},
 				},
 			}
-		} else if strings.Contains(cacheKey, uplink.PersistedQueriesQuery) {
-			var cachedResponse persistedqueries.UplinkPersistedQueryResponse
-			// This shouldn't happen but provide a default cachedResponse and fill out below
-			if len(cacheItem.Content) == 0 {
-				cachedResponse = persistedqueries.UplinkPersistedQueryResponse{
-					Data: struct {
-						PersistedQueries persistedqueries.UplinkPersistedQueryPersistedQueries "json:\"persistedQueries\""
-					}{
-						PersistedQueries: persistedqueries.UplinkPersistedQueryPersistedQueries{
-							ID:              cacheItem.ID,
-							Typename:        "Unchanged",
-							MinDelaySeconds: 60,
-							Chunks:          nil,
-						},
+		}
+	} else if strings.Contains(cacheKey, uplink.PersistedQueriesQuery) {
+		var cachedResponse persistedqueries.UplinkPersistedQueryResponse
+		// This shouldn't happen but provide a default cachedResponse and fill out below
+		if len(cacheItem.Content) == 0 {
+			cachedResponse = persistedqueries.UplinkPersistedQueryResponse{
+				Data: struct {
+					PersistedQueries persistedqueries.UplinkPersistedQueryPersistedQueries "json:\"persistedQueries\""
+				}{
+					PersistedQueries: persistedqueries.UplinkPersistedQueryPersistedQueries{
+						ID:              cacheItem.ID,
+						Typename:        "Unchanged",
+						MinDelaySeconds: 60,
+						Chunks:          nil,
 					},
-				}
-			} else {
-				err := json.Unmarshal(cacheItem.Content, &cachedResponse)
-				if err != nil {
-					logger.Error("Failed to unmarshal PersistedQuery chunks", "err", err)
-					http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-					return nil
-				}
+				},
 			}
-
-			typename := "PersistedQueriesResult"
-
-			cachedID, cachedVersion := persistedqueries.DecodeID(cachedResponse.Data.PersistedQueries.ID)
-			afterID, afterVersion := persistedqueries.DecodeID(ifAfterId)
-			logger.Info("Cache hit", "cachedID", cachedID, "cachedVersion", cachedVersion, "afterID", afterID, "afterVersion", afterVersion)
-			// If the cached ID is the same as the after ID and the after version is greater than or equal to the cached version, return Unchanged
-			// e.g. given abc:1 as the cached version, and an ifAfterId of abc:1, return Unchanged
-			// e.g. given abc:1 as the cached version, and an ifAfterId of abc:2, return Unchanged (since the after version is greater)
-			// e.g. given abc:1 as the cached version, and an ifAfterId of abc:0, return the persisted query (since the after version is earlier)
-			if cachedID == afterID && afterVersion >= cachedVersion {
-				typename = "Unchanged"
-				cachedResponse.Data.PersistedQueries.Chunks = nil
-				cachedResponse.Data.PersistedQueries.Typename = typename
+		} else {
+			err := json.Unmarshal(cacheItem.Content, &cachedResponse)
+			if err != nil {
+				return nil, 0, fmt.Errorf("failed to unmarshal PersistedQuery chunks: %w", err)
 			}
-
-			response = cachedResponse
 		}
 
-		// Convert the response to JSON
-		responseBody, err := json.Marshal(response)
-		if err != nil {
-			logger.Error("Failed to marshal response", "err", err)
-			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-			return nil
+		typename := "PersistedQueriesResult"
+
+		cachedID, cachedVersion := persistedqueries.DecodeID(cachedResponse.Data.PersistedQueries.ID)
+		afterID, afterVersion := persistedqueries.DecodeID(ifAfterId)
+		logger.Info("Cache hit", "cachedID", cachedID, "cachedVersion", cachedVersion, "afterID", afterID, "afterVersion", afterVersion)
+		// If the cached ID is the same as the after ID and the after version is greater than or equal to the cached version, return Unchanged
+		// e.g. given abc:1 as the cached version, and an ifAfterId of abc:1, return Unchanged
+		// e.g. given abc:1 as the cached version, and an ifAfterId of abc:2, return Unchanged (since the after version is greater)
+		// e.g. given abc:1 as the cached version, and an ifAfterId of abc:0, return the persisted query (since the after version is earlier)
+		if cachedID == afterID && afterVersion >= cachedVersion {
+			typename = "Unchanged"
+			cachedResponse.Data.PersistedQueries.Chunks = nil
+			cachedResponse.Data.PersistedQueries.Typename = typename
 		}
-		// Set the appropriate headers
-		w.Header().Add("X-Cache-Hit", "true")
 
-		// Write the cached content to the response
-		_, err = w.Write(responseBody)
-		if err != nil {
-			logger.Error("Failed to write response", "err", err)
-			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-			return nil
-		}
+		minDelaySeconds = cachedResponse.Data.PersistedQueries.MinDelaySeconds
+		response = cachedResponse
+	}
 
-		// Log the response
-		logger.Debug("Cached Response", "response", responseBody)
+	// Convert the response to JSON
+	responseBody, err := json.Marshal(response)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to marshal response: %w", err)
+	}
+	return responseBody, minDelaySeconds, nil
+}
 
-		return nil
+// writeCacheHit writes a cache hit's response body, with the cache headers if emitCacheHeaders is set.
+func writeCacheHit(w http.ResponseWriter, logger *slog.Logger, cacheItem *cache.CacheItem, responseBody []byte, minDelaySeconds float64, emitCacheHeaders bool) {
+	// Set the appropriate headers
+	w.Header().Add("X-Cache-Hit", "true")
+	if emitCacheHeaders {
+		setCacheHeaders(w, cacheItem, minDelaySeconds, time.Now())
 	}
+
+	// Write the cached content to the response
+	if _, err := w.Write(responseBody); err != nil {
+		logger.Error("Failed to write response", "err", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	// Log the response
+	logger.Debug("Cached Response", "response", responseBody)
+}
+
+// setCacheHeaders sets the Cache-Control header from the minDelaySeconds, and the Age header from the cached item's LastModified time if known.
+func setCacheHeaders(w http.ResponseWriter, cacheItem *cache.CacheItem, minDelaySeconds float64, now time.Time) {
+	w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", int64(minDelaySeconds)))
+	if cacheItem.LastModified.IsZero() {
+		return
+	}
+	age := int64(now.Sub(cacheItem.LastModified).Seconds())
+	if age < 0 {
+		age = 0
+	}
+	w.Header().Set("Age", fmt.Sprintf("%d", age))
 }
 
 // Handles a cache miss by proxying the request to the uplink service.
-func handleCacheMiss(config *config.Config, cache cache.Cache, httpClient *http.Client, rrSelector *uplink.RoundRobinSelector, cacheKey string, uplinkRequest util.UplinkRelayRequest, logger *slog.Logger) func(w http.ResponseWriter, r *http.Request) error {
+// Transport errors and 5xx responses from uplink are returned, after the response is written to w, so callers can retry them;
+// callers that retry pass a buffered writer, so only one response reaches the router.
+func handleCacheMiss(config *config.Config, cache cache.Cache, httpClient *http.Client, selector uplink.Selector, cacheKey string, uplinkRequest util.UplinkRelayRequest, logger *slog.Logger) func(w http.ResponseWriter, r *http.Request) error {
 	return func(w http.ResponseWriter, r *http.Request) error {
 		// Configure the reverse proxy for the chosen uplink.
-		rrUrl := rrSelector.Next()
-		uplinkUrl, uplinkUrlErr := parseUrl(rrUrl)
+		selectedUrl := selector.Next()
+		// Release the uplink once the proxied response completes; the deferred call covers paths where neither proxy hook runs
+		var releaseOnce sync.Once
+		release := func() {
+			releaseOnce.Do(func() { selector.Release(selectedUrl) })
+		}
+		defer release()
+
+		uplinkUrl, uplinkUrlErr := parseUrl(selectedUrl)
 		if uplinkUrlErr != nil {
 			logger.Error("Failed to parse URL", "url", uplinkUrl)
-			http.Error(w, "Uplink Service Unavailable", http.StatusServiceUnavailable)
+			writeFetchError(w, logger, http.StatusInternalServerError, uplinkRequest.OperationName, fetchErrorRetryLater, "Uplink Service Unavailable", config.Relay.ErrorMinDelaySeconds)
 			return uplinkUrlErr
 		}
 
-		// Create a new reverse proxy to uplink
-		proxy := makeProxy(config, cache, httpClient, logger)(uplinkUrl, cacheKey, uplinkRequest)
+		// Create a new reverse proxy to uplink, keeping track of how the request to uplink went
+		proxy := makeProxy(config, cache, httpClient, logger)(uplinkUrl, cacheKey, uplinkRequest, release)
+		var proxyErr error
+		errorHandler := proxy.ErrorHandler
+		proxy.ErrorHandler = func(rw http.ResponseWriter, req *http.Request, err error) {
+			proxyErr = err
+			errorHandler(rw, req, err)
+		}
+		upstreamStatus := 0
+		modifyResponse := proxy.ModifyResponse
+		proxy.ModifyResponse = func(resp *http.Response) error {
+			upstreamStatus = resp.StatusCode
+			return modifyResponse(resp)
+		}
 
-		// Serve the proxied request
-		proxy.ServeHTTP(w, r)
+		// Serve the proxied request, identifying the graph and operation for the audit trail
+		graphRef, _ := uplinkRequest.Variables["graph_ref"].(string)
+		proxy.ServeHTTP(w, r.WithContext(audit.WithCall(r.Context(), graphRef, uplinkRequest.OperationName)))
 
+		if proxyErr != nil {
+			return relayerrors.Upstream(proxyErr)
+		}
+		if upstreamStatus >= http.StatusInternalServerError {
+			return relayerrors.Upstream(fmt.Errorf("uplink responded with status %d", upstreamStatus))
+		}
 		return nil
 	}
 }
 
+// CacheSourceHeader is the response header indicating where the relay's response came from.
+const CacheSourceHeader = "X-Cache-Source"
+
+// Sources of a relay response, reported in the CacheSourceHeader and the "source" log field.
+const (
+	cacheSourcePinned   = "pinned"   // A pinned launch, license or persisted query version.
+	cacheSourceLive     = "live"     // The cache populated from uplink by polling, webhooks or earlier requests.
+	cacheSourceStale    = "stale"    // An expired cache entry within the stale grace period, served while it's refreshed.
+	cacheSourceUpstream = "upstream" // Proxied to uplink on a cache miss.
+	cacheSourceFallback = "fallback" // A supergraph's fallback schema file, served when uplink fails on a cache miss.
+)
+
+// setCacheSource reports the source of the response in a response header and a log line, and records it as a cache hit or miss.
+func setCacheSource(w http.ResponseWriter, logger *slog.Logger, source string, graphRef string, operationName string, cacheKey string) {
+	w.Header().Set(CacheSourceHeader, source)
+	logger.Info("Serving response", "source", source, "operationName", operationName, "cacheKey", cacheKey)
+	metrics.CacheHitRates.Record(graphRef, operationName, source != cacheSourceUpstream, time.Now())
+}
+
+// maxCacheHitResponses bounds the number of response bodies kept for cache hits.
+const maxCacheHitResponses = 100
+
+// cacheHitResponseKey identifies a cache hit's response body by the cache entry's hash and the other fields the body is built from,
+// so an entry that changes never matches a body built for its previous content.
+type cacheHitResponseKey struct {
+	operationName   string
+	hash            string
+	id              string
+	minDelaySeconds float64
+	extraFields     string
+	typename        string
+	ifAfterId       string
+}
+
+// cacheHitBody is a response body built for a cache hit, with the minDelaySeconds it contains.
+type cacheHitBody struct {
+	body            []byte
+	minDelaySeconds float64
+}
+
+// cacheHitResponses keeps the response bodies built for cache hits, so repeated hits on an unchanged entry
+// reuse the body rather than decoding the entry's content and encoding the response again.
+type cacheHitResponses struct {
+	mu     sync.RWMutex
+	bodies map[cacheHitResponseKey]cacheHitBody
+}
+
+// responseKey returns the key of the response body for the cache entry, or false if the body can't be reused,
+// e.g. a supergraph entry without an uplink ID, whose response ID depends on the current time.
+func (c *cacheHitResponses) responseKey(cacheKey string, cacheItem *cache.CacheItem, ifAfterId string) (cacheHitResponseKey, bool) {
+	key := cacheHitResponseKey{hash: cacheItem.Hash, id: cacheItem.ID, minDelaySeconds: cacheItem.MinDelaySeconds, extraFields: string(cacheItem.ExtraFields), typename: cacheItem.Typename}
+	if key.hash == "" {
+		return key, false
+	}
+	// Match the operations in the same order as cacheHitResponse
+	if strings.Contains(cacheKey, uplink.SupergraphQuery) {
+		if _, err := util.ParseUplinkTimestamp(cacheItem.ID); err != nil {
+			return key, false
+		}
+		key.operationName = uplink.SupergraphQuery
+	} else if strings.Contains(cacheKey, uplink.LicenseQuery) {
+		key.operationName = uplink.LicenseQuery
+	} else if strings.Contains(cacheKey, uplink.PersistedQueriesQuery) {
+		// Persisted query responses are Unchanged depending on the router's ifAfterId
+		key.operationName = uplink.PersistedQueriesQuery
+		key.ifAfterId = ifAfterId
+	} else {
+		return key, false
+	}
+	return key, true
+}
+
+func (c *cacheHitResponses) get(key cacheHitResponseKey) (cacheHitBody, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	body, ok := c.bodies[key]
+	return body, ok
+}
+
+func (c *cacheHitResponses) set(key cacheHitResponseKey, body cacheHitBody) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// Evict an arbitrary body when full; bodies for replaced entries are never hit again, so they're evicted over time
+	if len(c.bodies) >= maxCacheHitResponses {
+		for k := range c.bodies {
+			delete(c.bodies, k)
+			break
+		}
+	}
+	c.bodies[key] = body
+}
+
+// graphSelectors holds the uplink URL selectors for graphs with their own uplinkURLs, keyed by graphRef.
+type graphSelectors map[string]uplink.Selector
+
+// newGraphSelectors creates a selector with the uplink strategy for each graph with its own uplinkURLs.
+func newGraphSelectors(userConfig *config.Config) graphSelectors {
+	selectors := make(graphSelectors)
+	for _, supergraph := range userConfig.Supergraphs {
+		if len(supergraph.UplinkURLs) > 0 {
+			selectors[supergraph.GraphRef] = uplink.NewSelector(userConfig.Uplink.Strategy, supergraph.UplinkURLs)
+		}
+	}
+	return selectors
+}
+
+// forGraph returns the selector for the graph's own uplinkURLs, or the default selector if it has none.
+func (s graphSelectors) forGraph(graphRef string, defaultSelector uplink.Selector) uplink.Selector {
+	if selector, ok := s[graphRef]; ok {
+		return selector
+	}
+	return defaultSelector
+}
+
+// exceedsMaxServeAge returns whether the cached item was last modified more than maxServeAge seconds ago; 0 disables the check.
+// Items that can't be decoded, or without a last modified time, are left to the cache hit handling.
+func exceedsMaxServeAge(cacheContent []byte, maxServeAge int, now time.Time) bool {
+	if maxServeAge <= 0 {
+		return false
+	}
+	cacheItem, err := cache.DecodeMetadata(cacheContent)
+	if err != nil || cacheItem.LastModified.IsZero() {
+		return false
+	}
+	return now.Sub(cacheItem.LastModified) > time.Duration(maxServeAge)*time.Second
+}
+
+// serveCacheContent serves a cache entry read from the live cache.
+// It returns whether the entry was stale, i.e. past the cache duration but still within the stale grace period.
+func serveCacheContent(w http.ResponseWriter, r *http.Request, userConfig *config.Config, logger *slog.Logger, responses *cacheHitResponses, cacheContent []byte, graphRef string, operationName string, cacheKey string, ifAfterId string) bool {
+	// Only the metadata is needed to check staleness and find a response body built for an earlier hit
+	cacheItem, err := cache.DecodeMetadata(cacheContent)
+	if err != nil {
+		logger.Error("Failed to unmarshal cache content", "err", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+	stale := userConfig.Cache.StaleGrace > 0 && cache.IsStale(cacheItem, userConfig.CacheDuration(), time.Now())
+	if stale {
+		setCacheSource(w, logger, cacheSourceStale, graphRef, operationName, cacheKey)
+	} else {
+		setCacheSource(w, logger, cacheSourceLive, graphRef, operationName, cacheKey)
+	}
+
+	responseKey, reusable := responses.responseKey(cacheKey, cacheItem, ifAfterId)
+	if reusable {
+		if body, ok := responses.get(responseKey); ok {
+			writeCacheHit(w, logger, cacheItem, body.body, body.minDelaySeconds, userConfig.Relay.EmitCacheHeaders)
+			return stale
+		}
+	}
+
+	if err := cache.DecodeItem(cacheContent, cacheItem); err != nil {
+		logger.Error("Failed to unmarshal cache content", "err", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+	responseBody, minDelaySeconds, err := cacheHitResponse(cacheKey, cacheItem, logger, time.Duration(userConfig.CacheDuration())*time.Second, ifAfterId)
+	if err != nil {
+		logger.Error("Failed to build cached response", "err", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return false
+	}
+	if reusable {
+		responses.set(responseKey, cacheHitBody{body: responseBody, minDelaySeconds: minDelaySeconds})
+	}
+	writeCacheHit(w, logger, cacheItem, responseBody, minDelaySeconds, userConfig.Relay.EmitCacheHeaders)
+	return stale
+}
+
+// refreshInBackground refreshes a stale cache entry from uplink without blocking the request it was served to.
+// Only one refresh runs per cache key, and cache misses for the key wait for it rather than proxying to uplink themselves.
+func refreshInBackground(userConfig *config.Config, loadingCache *cache.LoadingCache, httpClient *http.Client, selector uplink.Selector, cacheKey string, uplinkRequest util.UplinkRelayRequest, r *http.Request, logger *slog.Logger) {
+	// The request body is needed as-is, as the api key was removed from the parsed variables
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		logger.Error("Failed to read request body for refresh", "key", cacheKey, "err", err)
+		return
+	}
+
+	refreshing := loadingCache.Refresh(cacheKey, func() ([]byte, error) {
+		// The refresh outlives the request, so it's bounded by the uplink timeout instead
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), time.Duration(userConfig.Uplink.Timeout)*time.Second)
+		defer cancel()
+		refreshRequest := r.Clone(ctx)
+		refreshRequest.Body = io.NopCloser(bytes.NewReader(body))
+		refreshRequest.ContentLength = int64(len(body))
+
+		if err := handleCacheMiss(userConfig, loadingCache, httpClient, selector, cacheKey, uplinkRequest, logger)(&discardResponseWriter{header: http.Header{}}, refreshRequest); err != nil {
+			logger.Error("Failed to refresh stale cache entry", "key", cacheKey, "err", err)
+			return nil, err
+		}
+		return cachedContent(loadingCache, cacheKey)
+	})
+	if !refreshing {
+		logger.Debug("Stale cache entry is already being refreshed", "key", cacheKey)
+		return
+	}
+	logger.Debug("Refreshing stale cache entry", "key", cacheKey)
+}
+
+// errNotCached is returned by loads whose response from uplink wasn't cached, such as errors, so callers waiting for them fetch the response themselves.
+var errNotCached = errors.New("response was not cached")
+
+// cachedContent returns the content cached for the key once it was loaded from uplink.
+func cachedContent(systemCache cache.Cache, cacheKey string) ([]byte, error) {
+	if content, ok := systemCache.Get(cacheKey); ok {
+		return content, nil
+	}
+	return nil, errNotCached
+}
+
+// discardResponseWriter is a ResponseWriter for background refreshes, which only need the response to be cached.
+type discardResponseWriter struct {
+	header http.Header
+}
+
+func (d *discardResponseWriter) Header() http.Header {
+	return d.header
+}
+
+func (d *discardResponseWriter) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func (d *discardResponseWriter) WriteHeader(statusCode int) {}
+
+// isHealthPing returns whether the request is a health ping to the relay path, such as a load balancer's: a GET or HEAD request without a body.
+func isHealthPing(r *http.Request, relayPath string) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	return r.ContentLength == 0 && strings.Trim(r.URL.Path, "/") == strings.Trim(relayPath, "/")
+}
+
 // Handles requests to the relay endpoint.
-func RelayHandler(userConfig *config.Config, currentCache cache.Cache, rrSelector *uplink.RoundRobinSelector, httpClient *http.Client, logger *slog.Logger) http.HandlerFunc {
+// Requests are proxied to uplink URLs chosen by the selector, except for graphs with their own uplinkURLs, which have a selector each.
+func RelayHandler(userConfig *config.Config, currentCache cache.Cache, selector uplink.Selector, httpClient *http.Client, logger *slog.Logger) http.HandlerFunc {
+	loadingCache := cache.NewLoadingCache(currentCache)
+	responses := &cacheHitResponses{bodies: make(map[cacheHitResponseKey]cacheHitBody)}
+	selectors := newGraphSelectors(userConfig)
+	budget := newRetryBudget(userConfig.Uplink.RetryBudget)
+	trustedProxies := trustedProxyPrefixes(userConfig.Relay, logger)
+	healthPing := userConfig.Relay.HealthPing.Enabled == nil || *userConfig.Relay.HealthPing.Enabled
 	return func(w http.ResponseWriter, r *http.Request) {
+		// Accept the request ID from the router or generate one, and correlate every log line for this request with it
+		requestID := r.Header.Get(util.RequestIDHeader)
+		if requestID == "" {
+			requestID = util.NewRequestID()
+		}
+		clientIP, _ := util.ClientIP(r, trustedProxies)
+		logger := logger.With("requestID", requestID, "clientIP", clientIP)
+		// Echo the request ID back to the router and forward it upstream
+		w.Header().Set(util.RequestIDHeader, requestID)
+		r.Header.Set(util.RequestIDHeader, requestID)
+
+		// Load balancers pinging the relay aren't sending uplink requests, so they're answered without parsing them,
+		// failing like the readiness probe once the servers are shutting down so traffic drains away from the relay
+		if healthPing && isHealthPing(r, userConfig.Relay.Path) {
+			if shuttingDown.Load() {
+				http.Error(w, "shutting down", http.StatusServiceUnavailable)
+				return
+			}
+			w.Write([]byte(userConfig.Relay.HealthPing.Body))
+			return
+		}
+
+		// Uplink requests are always POSTs, so other methods are rejected rather than failing to parse as one
+		if r.Method != http.MethodPost {
+			logger.Warn("Method not allowed", "method", r.Method, "path", r.URL.Path)
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+
 		// Debug log the request
-		logger.Debug("Received request", "method", r.Method, "path", r.URL.Path, "header", r.Header)
+		logger.Debug("Received request", "method", r.Method, "path", r.URL.Path, "header", redactHeaders(r.Header, userConfig.Relay.RedactedHeaders))
 
 		// Debug log the request heaaders
-		debugRequestHeaders(logger, r)
+		debugRequestHeaders(logger, r, userConfig.Relay.RedactedHeaders)
 
 		// Debug log the request body
-		debugRequestBody(logger, r)
+		debugRequestBody(logger, r, userConfig.Relay.RedactedVariables)
 
 		// Parse the uplink request body
 		uplinkRequest, uplinkRequestErr := parseRequest(r)
 		if uplinkRequestErr != nil {
 			logger.Error("Failed to parse request body", "err", uplinkRequestErr)
-			http.Error(w, "Bad Request", http.StatusBadRequest)
+			writeError(w, uplinkRequestErr)
 			return
 		}
 
-		if uplinkRequest.Variables["graph_ref"] == nil {
-			logger.Error("Missing graph_ref in request body")
-			http.Error(w, "Bad Request", http.StatusBadRequest)
+		// Alternate operation names sent by some router versions are handled as the uplink operation they alias
+		uplinkRequest.OperationName = userConfig.Relay.CanonicalOperationName(uplinkRequest.OperationName)
+
+		// In strict mode, only the known uplink operations are handled rather than proxying anything to uplink
+		if userConfig.Relay.StrictOperations && !slices.Contains(uplink.Operations, uplinkRequest.OperationName) {
+			logger.Error("Unknown operation name", "operationName", uplinkRequest.OperationName)
+			writeError(w, relayerrors.ErrInvalidRequest)
 			return
 		}
 
 		// Parse the GraphRef from the request
-		graphID, variantID, graphRefErr := util.ParseGraphRef(uplinkRequest.Variables["graph_ref"].(string))
+		graphRef, graphRefErr := graphRefFromVariables(uplinkRequest.Variables)
+		if graphRefErr != nil {
+			logger.Error("Invalid graph_ref in request body", "err", graphRefErr)
+			writeError(w, graphRefErr)
+			return
+		}
+		graphID, variantID, graphRefErr := util.ParseGraphRef(graphRef)
 		if graphRefErr != nil {
 			logger.Error("Failed to parse GraphRef from request body")
-			http.Error(w, "Bad Request", http.StatusBadRequest)
+			writeError(w, relayerrors.ErrInvalidRequest)
+			return
+		}
+		if err := checkGraphAccess(userConfig, graphRef, uplinkRequest.Variables); err != nil {
+			logger.Error("Rejected request for graph", "graphRef", graphRef, "err", err)
+			writeError(w, err)
 			return
 		}
+		// Graphs with their own uplink URLs are proxied only to them
+		selector := selectors.forGraph(graphRef, selector)
 
 		// Get the operation name from the request
 		operationName := uplinkRequest.OperationName
@@ -522,87 +1160,167 @@ func RelayHandler(userConfig *config.Config, currentCache cache.Cache, rrSelecto
 		// Remove the api key from cache calculation to avoid uplink-relay having a different key making polling not work
 		delete(uplinkRequest.Variables, "apiKey")
 
-		// ensure that the ifAfterId is set to an empty string if it is nil to avoid panics
-		if uplinkRequest.Variables["ifAfterId"] == nil {
-			uplinkRequest.Variables["ifAfterId"] = ""
+		// Ensure that the ifAfterId is a string, defaulting to an empty string if it's not set
+		ifAfterId, ifAfterIdErr := ifAfterIdFromVariables(uplinkRequest.Variables)
+		if ifAfterIdErr != nil {
+			logger.Error("Invalid ifAfterId in request body", "err", ifAfterIdErr)
+			writeError(w, ifAfterIdErr)
+			return
 		}
 
 		// Make the cache key using the graphID, variantID, and operationName
-		cacheKey := cache.MakeCacheKey(uplinkRequest.Variables["graph_ref"].(string), operationName, uplinkRequest.Variables)
+		cacheKey := cache.MakeCacheKey(graphRef, operationName, uplinkRequest.Variables)
+		// A negative skew disables the tolerance for clock differences
+		pinnedClockSkew := max(time.Duration(userConfig.Relay.PinnedClockSkew)*time.Second, 0)
+		// Operations with caching disabled are always proxied to uplink, although pinned entries are still served
+		cacheOperation := userConfig.Cache.OperationEnabled(operationName)
+
+		// fetchFromUplink proxies the request to the uplink service, caching the response for future requests, and retries failed requests.
+		// The final attempt's response is returned buffered, so callers decide what to write when uplink fails.
+		fetchFromUplink := func(r *http.Request) (*bufferedResponseWriter, error) {
+			response := &bufferedResponseWriter{header: http.Header{}}
+			// Each attempt sends the request body again
+			body, err := io.ReadAll(r.Body)
+			if err != nil {
+				logger.Error("Failed to read request body", "err", err)
+				writeError(response, relayerrors.ErrInvalidRequest)
+				return response, err
+			}
+
+			for attempt := 0; ; attempt++ {
+				// Each attempt's response is buffered, so a failed attempt can be retried and only the final response is written
+				r.Body = io.NopCloser(bytes.NewReader(body))
+				response = &bufferedResponseWriter{header: http.Header{}}
+				err := handleCacheMiss(userConfig, currentCache, httpClient, selector, cacheKey, uplinkRequest, logger)(response, r)
+				if err == nil {
+					budget.onSuccess()
+					logger.Info("Successfully proxied request", "cacheKey", cacheKey)
+					return response, nil
+				}
+				logger.Error("Request to uplink failed", "attempt", attempt, "err", err)
+				retryAllowed := budget.onFailure()
+				if attempt < userConfig.Uplink.RetryCount && retryAllowed {
+					logger.Warn("Retrying request", "operationName", operationName)
+					continue
+				}
+				if attempt >= userConfig.Uplink.RetryCount {
+					logger.Error("Failed to proxy request", "attempts", attempt+1, "err", err)
+				} else {
+					// Most requests to uplink are failing, so stop retrying rather than adding to the load
+					logger.Warn("Retry budget exhausted, not retrying request", "operationName", operationName, "attempts", attempt+1)
+					metrics.RetriesThrottled.Inc(operationName)
+				}
+				return response, err
+			}
+		}
+
+		// proxyToUplink serves the request from uplink on a cache miss.
+		proxyToUplink := func(w http.ResponseWriter, r *http.Request) error {
+			logger.Debug("Cache miss", "key", cacheKey)
+			setCacheSource(w, logger, cacheSourceUpstream, graphRef, operationName, cacheKey)
+
+			response, err := fetchFromUplink(r)
+			// The request won't be retried, so the supergraph's fallback schema is served in place of the failure, if it has one
+			if err != nil && serveFallback(w, userConfig, graphRef, operationName, ifAfterId, err, logger) {
+				return nil
+			}
+			response.writeTo(w)
+			return err
+		}
+
 		// If cache is enabled, attempt to retrieve the response from the cache
 		if userConfig.Cache.Enabled {
 			// Check if the response is cached and return it if found
-			if cacheContent, keyFound := currentCache.Get(cacheKey); keyFound {
-				// Handle the cache hit
-				logger.Debug("Cache hit", "key", cacheKey, "operationName", operationName)
-				var cacheItem *cache.CacheItem
-				err := json.Unmarshal(cacheContent, &cacheItem)
-				if err != nil {
-					logger.Error("Failed to unmarshal cache content", "err", err)
-					http.Error(w, err.Error(), http.StatusInternalServerError)
+			if cacheOperation {
+				if cacheContent, keyFound := currentCache.Get(cacheKey); keyFound {
+					// Items older than the max serve age are fetched again, whatever their duration, and only served if uplink fails
+					if exceedsMaxServeAge(cacheContent, userConfig.Cache.MaxServeAge, time.Now()) {
+						logger.Info("Cached item exceeds the max serve age, fetching it", "key", cacheKey, "operationName", operationName, "maxServeAge", userConfig.Cache.MaxServeAge)
+						// Requests for the item while it's fetched wait for the fetch rather than fetching it themselves
+						fetched := false
+						var fresh *bufferedResponseWriter
+						var fetchErr error
+						content, err := loadingCache.Load(r.Context(), cacheKey, func() ([]byte, error) {
+							fetched = true
+							if fresh, fetchErr = fetchFromUplink(r); fetchErr != nil {
+								return nil, fetchErr
+							}
+							return cachedContent(currentCache, cacheKey)
+						})
+						switch {
+						case fetched && fetchErr == nil:
+							setCacheSource(w, logger, cacheSourceUpstream, graphRef, operationName, cacheKey)
+							fresh.writeTo(w)
+						case !fetched && err == nil:
+							serveCacheContent(w, r, userConfig, logger, responses, content, graphRef, operationName, cacheKey, ifAfterId)
+						default:
+							logger.Warn("Failed to fetch cached item exceeding the max serve age, serving it", "key", cacheKey, "operationName", operationName, "err", err)
+							serveCacheContent(w, r, userConfig, logger, responses, cacheContent, graphRef, operationName, cacheKey, ifAfterId)
+						}
+						return
+					}
+					// Handle the cache hit
+					logger.Debug("Cache hit", "key", cacheKey, "operationName", operationName)
+					if serveCacheContent(w, r, userConfig, logger, responses, cacheContent, graphRef, operationName, cacheKey, ifAfterId) {
+						refreshInBackground(userConfig, loadingCache, httpClient, selector, cacheKey, uplinkRequest, r, logger)
+					}
 					return
 				}
-				handleCacheHit(cacheKey, cacheItem, logger, time.Duration(userConfig.Cache.Duration)*time.Second, uplinkRequest.Variables["ifAfterId"].(string))(w, r)
-				return
-			}
-
-			// Set it to an empty string if it is nil to avoid panics
-			if uplinkRequest.Variables["ifAfterId"] == nil {
-				uplinkRequest.Variables["ifAfterId"] = ""
+			} else {
+				logger.Debug("Caching disabled for operation", "operationName", operationName)
 			}
 
 			// suppress the error since in this case we just need to check if the supergraphcConfig is not nil
-			supergraphConfig, _ := config.FindSupergraphConfigFromGraphRef(uplinkRequest.Variables["graph_ref"].(string), userConfig)
+			supergraphConfig, _ := config.FindSupergraphConfigFromGraphRef(graphRef, userConfig)
 
 			// ...because if so, we can then double check that the supergraph isn't pinned
 			if supergraphConfig != nil {
 				if operationName == uplink.SupergraphQuery && supergraphConfig.LaunchID != "" {
-					s, err := pinning.HandlePinnedEntry(logger, currentCache, graphID, variantID, operationName, uplinkRequest.Variables["ifAfterId"].(string))
+					s, err := pinning.HandlePinnedEntry(logger, currentCache, graphID, variantID, operationName, ifAfterId, pinnedClockSkew)
 					if err != nil || s == nil {
 						logger.Error("Failed to handle pinned entry", "operationName", operationName)
 						http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 						return
 					}
-					handleCacheHit(cacheKey, s, logger, time.Duration(userConfig.Cache.Duration)*time.Second, uplinkRequest.Variables["ifAfterId"].(string))(w, r)
+					setCacheSource(w, logger, cacheSourcePinned, graphRef, operationName, cacheKey)
+					handleCacheHit(cacheKey, s, logger, time.Duration(userConfig.CacheDuration())*time.Second, userConfig.Relay.EmitCacheHeaders, ifAfterId)(w, r)
 					return
 				} else if operationName == uplink.LicenseQuery && supergraphConfig.OfflineLicense != "" {
-					s, _ := pinning.HandlePinnedEntry(logger, currentCache, graphID, variantID, operationName, uplinkRequest.Variables["ifAfterId"].(string))
-					handleCacheHit(cacheKey, s, logger, time.Duration(userConfig.Cache.Duration)*time.Second, uplinkRequest.Variables["ifAfterId"].(string))(w, r)
+					s, _ := pinning.HandlePinnedEntry(logger, currentCache, graphID, variantID, operationName, ifAfterId, pinnedClockSkew)
+					setCacheSource(w, logger, cacheSourcePinned, graphRef, operationName, cacheKey)
+					handleCacheHit(cacheKey, s, logger, time.Duration(userConfig.CacheDuration())*time.Second, userConfig.Relay.EmitCacheHeaders, ifAfterId)(w, r)
 					return
 				} else if operationName == uplink.PersistedQueriesQuery && supergraphConfig.PersistedQueryVersion != "" {
-					s, _ := pinning.HandlePinnedEntry(logger, currentCache, graphID, variantID, operationName, uplinkRequest.Variables["ifAfterId"].(string))
-					handleCacheHit(cacheKey, s, logger, time.Duration(userConfig.Cache.Duration)*time.Second, uplinkRequest.Variables["ifAfterId"].(string))(w, r)
+					s, _ := pinning.HandlePinnedEntry(logger, currentCache, graphID, variantID, operationName, ifAfterId, pinnedClockSkew)
+					setCacheSource(w, logger, cacheSourcePinned, graphRef, operationName, cacheKey)
+					handleCacheHit(cacheKey, s, logger, time.Duration(userConfig.CacheDuration())*time.Second, userConfig.Relay.EmitCacheHeaders, ifAfterId)(w, r)
 					return
 				}
 			}
 
-		}
-
-		// If the response is not cached, proxy the request to the uplink service
-		// and cache the response for future requests
-		logger.Debug("Cache miss", "key", cacheKey)
-
-		success := false
-		for attempt := 0; attempt <= userConfig.Uplink.RetryCount && !success; attempt++ {
-			err := handleCacheMiss(userConfig, currentCache, httpClient, rrSelector, cacheKey, uplinkRequest, logger)(w, r)
-			if err != nil {
-				logger.Error("Request to uplink failed", "attempt", attempt, "err", err)
-				if attempt == userConfig.Uplink.RetryCount {
-					logger.Error("Failed to proxy request", "attempts", userConfig.Uplink.RetryCount, "err", err)
-					http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			// Only one request per cache key goes to uplink at a time; the others wait for it to populate the cache,
+			// which bounds the load on uplink when many routers miss the cache at once, e.g. while the cache backend is down
+			if cacheOperation {
+				fetched := false
+				cacheContent, err := loadingCache.GetOrLoad(r.Context(), cacheKey, func() ([]byte, error) {
+					fetched = true
+					if err := proxyToUplink(w, r); err != nil {
+						return nil, err
+					}
+					return cachedContent(currentCache, cacheKey)
+				})
+				if fetched || r.Context().Err() != nil {
 					return
 				}
-				logger.Warn("Retrying request", "operationName", operationName)
-			} else {
-				logger.Info("Successfully proxied request", "cacheKey", cacheKey)
-				success = true
-				break
+				if err == nil {
+					serveCacheContent(w, r, userConfig, logger, responses, cacheContent, graphRef, operationName, cacheKey, ifAfterId)
+					return
+				}
+				// The in-flight request failed or couldn't be cached, so fetch the response ourselves
+				logger.Debug("In-flight request failed, fetching the response", "key", cacheKey, "err", err)
 			}
 		}
-		if !success {
-			logger.Error("Failed to proxy request", "operationName", operationName)
-			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-			return
-		}
+
+		proxyToUplink(w, r)
 	}
 }
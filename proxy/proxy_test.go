@@ -1,15 +1,30 @@
 package proxy
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"apollosolutions/uplink-relay/audit"
 	"apollosolutions/uplink-relay/cache"
 	"apollosolutions/uplink-relay/config"
+	"apollosolutions/uplink-relay/internal/util"
 	"apollosolutions/uplink-relay/logger"
+	"apollosolutions/uplink-relay/metrics"
+	"apollosolutions/uplink-relay/pinning"
 	"apollosolutions/uplink-relay/uplink"
 )
 
@@ -152,7 +167,7 @@ func TestHandleCacheHit(t *testing.T) {
 	rr := httptest.NewRecorder()
 
 	// Call the handleCacheHit function
-	err := handleCacheHit(cache.MakeCacheKey("graph@local", uplink.LicenseQuery), &cache.CacheItem{Content: []byte(licenseResponse)}, mockLogger, time.Duration(mockConfig.Cache.Duration)*time.Second, "")(rr, req)
+	err := handleCacheHit(cache.MakeCacheKey("graph@local", uplink.LicenseQuery), &cache.CacheItem{Content: []byte(licenseResponse)}, mockLogger, time.Duration(mockConfig.Cache.Duration)*time.Second, false, "")(rr, req)
 	if err != nil {
 		t.Errorf("Expected no error, but got %v", err)
 	}
@@ -170,7 +185,7 @@ func TestHandleCacheHit(t *testing.T) {
 	cacheItem := &cache.CacheItem{
 		Content: []byte("1234"),
 	}
-	err = handleCacheHit(cache.MakeCacheKey("graph@local", uplink.SupergraphQuery), cacheItem, mockLogger, time.Duration(mockConfig.Cache.Duration)*time.Second, "")(rr, req)
+	err = handleCacheHit(cache.MakeCacheKey("graph@local", uplink.SupergraphQuery), cacheItem, mockLogger, time.Duration(mockConfig.Cache.Duration)*time.Second, false, "")(rr, req)
 	if err != nil {
 		t.Errorf("Expected no error, but got %v", err)
 	}
@@ -187,7 +202,7 @@ func TestHandleCacheHit(t *testing.T) {
 	// Call the handleCacheHit again for the PersistedQueriesManifestQuery
 	err = handleCacheHit(cache.MakeCacheKey("graph@local", uplink.PersistedQueriesQuery), &cache.CacheItem{
 		Content: []byte(persistedQueriesResponse),
-	}, mockLogger, time.Duration(mockConfig.Cache.Duration)*time.Second, "")(rr, req)
+	}, mockLogger, time.Duration(mockConfig.Cache.Duration)*time.Second, false, "")(rr, req)
 	if err != nil {
 		t.Errorf("Expected no error, but got %v", err)
 	}
@@ -197,3 +212,1639 @@ func TestHandleCacheHit(t *testing.T) {
 		t.Errorf("Expected status code 200, but got %d", rr.Code)
 	}
 }
+
+func TestHandleCacheHitCacheHeaders(t *testing.T) {
+	pFalse := false
+	mockLogger := logger.MakeLogger(&pFalse)
+
+	cacheItem := &cache.CacheItem{
+		Content:      []byte("1234"),
+		LastModified: time.Now().Add(-90 * time.Second),
+	}
+
+	// Headers are opt-in
+	rr := httptest.NewRecorder()
+	err := handleCacheHit(cache.MakeCacheKey("graph@local", uplink.SupergraphQuery), cacheItem, mockLogger, 10*time.Second, false, "")(rr, httptest.NewRequest(http.MethodPost, "/", nil))
+	if err != nil {
+		t.Errorf("Expected no error, but got %v", err)
+	}
+	if rr.Header().Get("Cache-Control") != "" || rr.Header().Get("Age") != "" {
+		t.Errorf("Expected no cache headers, but got Cache-Control %q and Age %q", rr.Header().Get("Cache-Control"), rr.Header().Get("Age"))
+	}
+
+	rr = httptest.NewRecorder()
+	err = handleCacheHit(cache.MakeCacheKey("graph@local", uplink.SupergraphQuery), cacheItem, mockLogger, 10*time.Second, true, "")(rr, httptest.NewRequest(http.MethodPost, "/", nil))
+	if err != nil {
+		t.Errorf("Expected no error, but got %v", err)
+	}
+	if cacheControl := rr.Header().Get("Cache-Control"); cacheControl != "max-age=30" {
+		t.Errorf("Expected Cache-Control max-age=30, but got %q", cacheControl)
+	}
+	// Allow for a slow test run when comparing the age
+	if age := rr.Header().Get("Age"); age != "90" && age != "91" {
+		t.Errorf("Expected Age of 90 seconds, but got %q", age)
+	}
+
+	// The license minDelaySeconds is used for entitlements
+	rr = httptest.NewRecorder()
+	err = handleCacheHit(cache.MakeCacheKey("graph@local", uplink.LicenseQuery), cacheItem, mockLogger, 10*time.Second, true, "")(rr, httptest.NewRequest(http.MethodPost, "/", nil))
+	if err != nil {
+		t.Errorf("Expected no error, but got %v", err)
+	}
+	if cacheControl := rr.Header().Get("Cache-Control"); cacheControl != "max-age=60" {
+		t.Errorf("Expected Cache-Control max-age=60, but got %q", cacheControl)
+	}
+
+	// Items without a LastModified time have no Age
+	rr = httptest.NewRecorder()
+	setCacheHeaders(rr, &cache.CacheItem{}, 30, time.Now())
+	if age := rr.Header().Get("Age"); age != "" {
+		t.Errorf("Expected no Age header, but got %q", age)
+	}
+}
+
+func TestRelayHandlerFetchErrorMinDelay(t *testing.T) {
+	// Point the relay at a closed server so the uplink request fails
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	mockServer.Close()
+
+	mockConfig := config.NewDefaultConfig()
+	mockConfig.Uplink.RetryCount = 1
+	mockConfig.Relay.ErrorMinDelaySeconds = 120
+	mockConfig.Supergraphs = []config.SupergraphConfig{{GraphRef: "graph@local"}}
+	pFalse := false
+	mockLogger := logger.MakeLogger(&pFalse)
+
+	selector := uplink.NewRoundRobinSelector([]string{mockServer.URL})
+	handler := RelayHandler(mockConfig, cache.NewMemoryCache(10), selector, &http.Client{}, mockLogger)
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(licenseQuery)))
+
+	var response struct {
+		Data struct {
+			RouterEntitlements struct {
+				Typename        string  `json:"__typename"`
+				Code            string  `json:"code"`
+				MinDelaySeconds float64 `json:"minDelaySeconds"`
+			} `json:"routerEntitlements"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Failed to unmarshal response %q: %v", rr.Body.String(), err)
+	}
+	if response.Data.RouterEntitlements.Typename != "FetchError" {
+		t.Errorf("Expected a FetchError, but got %q", response.Data.RouterEntitlements.Typename)
+	}
+	if response.Data.RouterEntitlements.MinDelaySeconds != 120 {
+		t.Errorf("Expected minDelaySeconds of 120, but got %v", response.Data.RouterEntitlements.MinDelaySeconds)
+	}
+}
+
+func TestRelayHandlerCacheSource(t *testing.T) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(supergraphResponse))
+	}))
+	defer mockServer.Close()
+
+	mockConfig := config.NewDefaultConfig()
+	mockConfig.Cache.Duration = 60
+	mockConfig.Uplink.RetryCount = 1
+	mockConfig.Supergraphs = []config.SupergraphConfig{{GraphRef: "graph@local"}}
+	pFalse := false
+	mockLogger := logger.MakeLogger(&pFalse)
+	mockCache := cache.NewMemoryCache(10)
+
+	handler := RelayHandler(mockConfig, mockCache, uplink.NewRoundRobinSelector([]string{mockServer.URL}), &http.Client{}, mockLogger)
+
+	// The first request is proxied to uplink, and the second is served from the cache it populated
+	for _, expected := range []string{cacheSourceUpstream, cacheSourceLive} {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(supergraphQuery)))
+		if rr.Code != http.StatusOK {
+			t.Errorf("Expected status code 200, but got %d", rr.Code)
+		}
+		if source := rr.Header().Get(CacheSourceHeader); source != expected {
+			t.Errorf("Expected source %s, but got %s", expected, source)
+		}
+	}
+
+	// A pinned launch is served from its pinned entry
+	pinnedConfig := config.NewDefaultConfig()
+	pinnedConfig.Supergraphs = []config.SupergraphConfig{{GraphRef: "graph@local", LaunchID: "1234"}}
+	pinnedCache := cache.NewMemoryCache(10)
+	pinnedEntry, _ := json.Marshal(cache.CacheItem{Content: []byte("pinned sdl"), LastModified: time.Now(), ID: "1234"})
+	pinnedCache.Set(cache.MakeCacheKey("graph@local", pinning.SupergraphPinned), string(pinnedEntry), -1)
+
+	handler = RelayHandler(pinnedConfig, pinnedCache, uplink.NewRoundRobinSelector([]string{mockServer.URL}), &http.Client{}, mockLogger)
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(supergraphQuery)))
+	if rr.Code != http.StatusOK {
+		t.Errorf("Expected status code 200, but got %d", rr.Code)
+	}
+	if source := rr.Header().Get(CacheSourceHeader); source != cacheSourcePinned {
+		t.Errorf("Expected source %s, but got %s", cacheSourcePinned, source)
+	}
+	if !strings.Contains(rr.Body.String(), "pinned sdl") {
+		t.Errorf("Expected the pinned schema, but got %s", rr.Body.String())
+	}
+}
+
+func TestRelayHandlerGraphRefVariables(t *testing.T) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(supergraphResponse))
+	}))
+	defer mockServer.Close()
+
+	mockConfig := config.NewDefaultConfig()
+	mockConfig.Uplink.RetryCount = 1
+	mockConfig.Supergraphs = []config.SupergraphConfig{{GraphRef: "graph@local"}}
+	pFalse := false
+	mockLogger := logger.MakeLogger(&pFalse)
+	mockCache := cache.NewMemoryCache(10)
+	handler := RelayHandler(mockConfig, mockCache, uplink.NewRoundRobinSelector([]string{mockServer.URL}), &http.Client{}, mockLogger)
+
+	// A non-string graph_ref is rejected rather than panicking
+	for _, body := range []string{
+		`{"operationName":"SupergraphSdlQuery","variables":{"graph_ref":1234}}`,
+		`{"operationName":"SupergraphSdlQuery","variables":{"graph_ref":{"graph":"graph"}}}`,
+		`{"operationName":"SupergraphSdlQuery","variables":{"graphId":"graph"}}`,
+		`{"operationName":"SupergraphSdlQuery"}`,
+	} {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body)))
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("Expected status code 400 for %s, but got %d", body, rr.Code)
+		}
+	}
+
+	// A split graph and variant is reconstructed into the graph_ref
+	rr := httptest.NewRecorder()
+	body := `{"operationName":"SupergraphSdlQuery","variables":{"apiKey":"service:graph:1234","graphId":"graph","variant":"local","ifAfterId":null}}`
+	handler.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body)))
+	if rr.Code != http.StatusOK {
+		t.Errorf("Expected status code 200, but got %d", rr.Code)
+	}
+	cacheKey := cache.MakeCacheKey("graph@local", uplink.SupergraphQuery, map[string]interface{}{"graph_ref": "graph@local", "ifAfterId": ""})
+	if _, ok := mockCache.Get(cacheKey); !ok {
+		t.Errorf("Expected the response to be cached under the reconstructed graph_ref")
+	}
+}
+
+func TestRelayHandlerNonStringIfAfterId(t *testing.T) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(supergraphResponse))
+	}))
+	defer mockServer.Close()
+
+	mockConfig := config.NewDefaultConfig()
+	mockConfig.Uplink.RetryCount = 1
+	mockConfig.Supergraphs = []config.SupergraphConfig{{GraphRef: "graph@local"}}
+	pFalse := false
+	mockLogger := logger.MakeLogger(&pFalse)
+	handler := RelayHandler(mockConfig, cache.NewMemoryCache(10), uplink.NewRoundRobinSelector([]string{mockServer.URL}), &http.Client{}, mockLogger)
+
+	for _, ifAfterId := range []string{`1234`, `true`, `["id"]`} {
+		rr := httptest.NewRecorder()
+		body := `{"operationName":"SupergraphSdlQuery","variables":{"graph_ref":"graph@local","ifAfterId":` + ifAfterId + `}}`
+		handler.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body)))
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("Expected status code 400 for ifAfterId %s, but got %d", ifAfterId, rr.Code)
+		}
+	}
+
+	// A missing ifAfterId defaults to an empty string
+	variables := map[string]interface{}{}
+	if ifAfterId, err := ifAfterIdFromVariables(variables); err != nil || ifAfterId != "" || variables["ifAfterId"] != "" {
+		t.Errorf("Expected an empty ifAfterId, but got %q (%v)", ifAfterId, err)
+	}
+}
+
+func TestRelayHandlerStrictOperations(t *testing.T) {
+	proxied := false
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = true
+		w.Write([]byte(`{"data":{}}`))
+	}))
+	defer mockServer.Close()
+
+	mockConfig := config.NewDefaultConfig()
+	mockConfig.Uplink.RetryCount = 1
+	mockConfig.Supergraphs = []config.SupergraphConfig{{GraphRef: "graph@local"}}
+	pFalse := false
+	mockLogger := logger.MakeLogger(&pFalse)
+	body := `{"operationName":"BogusQuery","query":"query BogusQuery { __typename }","variables":{"graph_ref":"graph@local"}}`
+
+	// Unknown operations are proxied by default
+	handler := RelayHandler(mockConfig, cache.NewMemoryCache(10), uplink.NewRoundRobinSelector([]string{mockServer.URL}), &http.Client{}, mockLogger)
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body)))
+	if !proxied {
+		t.Errorf("Expected the unknown operation to be proxied")
+	}
+
+	// ...and rejected in strict mode before reaching uplink
+	proxied = false
+	mockConfig.Relay.StrictOperations = true
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body)))
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected status code 400, but got %d", rr.Code)
+	}
+	if proxied {
+		t.Errorf("Expected the unknown operation not to be proxied")
+	}
+
+	// Known operations are still handled in strict mode
+	mockServer.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(supergraphResponse))
+	})
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(supergraphQuery)))
+	if rr.Code != http.StatusOK {
+		t.Errorf("Expected status code 200, but got %d", rr.Code)
+	}
+}
+
+func TestGraphRefFromVariables(t *testing.T) {
+	variables := map[string]interface{}{"graphId": "graph", "variant": "current"}
+	graphRef, err := graphRefFromVariables(variables)
+	if err != nil || graphRef != "graph@current" {
+		t.Errorf("Expected graph@current, but got %s (%v)", graphRef, err)
+	}
+	if variables["graph_ref"] != "graph@current" || variables["graphId"] != nil || variables["variant"] != nil {
+		t.Errorf("Expected the split variables to be replaced by graph_ref, but got %v", variables)
+	}
+
+	if _, err := graphRefFromVariables(map[string]interface{}{"graph_ref": 1.5}); err == nil {
+		t.Errorf("Expected an error for a non-string graph_ref")
+	}
+	if _, err := graphRefFromVariables(nil); err == nil {
+		t.Errorf("Expected an error for missing variables")
+	}
+}
+
+func TestRelayHandlerReleasesSelector(t *testing.T) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(licenseResponse))
+	}))
+	defer mockServer.Close()
+
+	mockConfig := config.NewDefaultConfig()
+	mockConfig.Uplink.RetryCount = 1
+	mockConfig.Supergraphs = []config.SupergraphConfig{{GraphRef: "graph@local"}}
+	pFalse := false
+	mockLogger := logger.MakeLogger(&pFalse)
+
+	selector := uplink.NewLeastLoadedSelector([]string{mockServer.URL})
+	handler := RelayHandler(mockConfig, cache.NewMemoryCache(10), selector, &http.Client{}, mockLogger)
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(licenseQuery)))
+	if rr.Code != http.StatusOK {
+		t.Errorf("Expected status code 200, but got %d", rr.Code)
+	}
+
+	// The in-flight counter should be released once the proxied response completes
+	if inFlight := selector.InFlight(mockServer.URL); inFlight != 0 {
+		t.Errorf("Expected no in-flight requests, but got %d", inFlight)
+	}
+}
+
+func TestRelayHandlerGraphUplinkURLs(t *testing.T) {
+	var globalCalls, mirrorCalls atomic.Int32
+	globalServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		globalCalls.Add(1)
+		w.Write([]byte(supergraphResponse))
+	}))
+	defer globalServer.Close()
+	mirrorServers := make([]*httptest.Server, 2)
+	mirrorURLs := make([]string, len(mirrorServers))
+	for i := range mirrorServers {
+		mirrorServers[i] = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mirrorCalls.Add(1)
+			w.Write([]byte(supergraphResponse))
+		}))
+		defer mirrorServers[i].Close()
+		mirrorURLs[i] = mirrorServers[i].URL
+	}
+
+	mockConfig := config.NewDefaultConfig()
+	mockConfig.Uplink.RetryCount = 1
+	// Every request is proxied to uplink
+	mockConfig.Cache.Enabled = false
+	mockConfig.Supergraphs = []config.SupergraphConfig{{GraphRef: "graph@local"}, {GraphRef: "graph@mirror", UplinkURLs: mirrorURLs}}
+	pFalse := false
+	handler := RelayHandler(mockConfig, cache.NewMemoryCache(100), uplink.NewRoundRobinSelector([]string{globalServer.URL}), &http.Client{}, logger.MakeLogger(&pFalse))
+
+	serve := func(graphRef string) {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(strings.Replace(supergraphQuery, "graph@local", graphRef, 1))))
+		if rr.Code != http.StatusOK {
+			t.Fatalf("Expected status code 200 for %s, but got %d", graphRef, rr.Code)
+		}
+	}
+	for i := 0; i < 4; i++ {
+		serve("graph@mirror")
+	}
+	if calls := mirrorCalls.Load(); calls != 4 {
+		t.Errorf("Expected 4 requests to the graph's uplink URLs, got %d", calls)
+	}
+	if calls := globalCalls.Load(); calls != 0 {
+		t.Errorf("Expected no requests to the uplink URLs for a graph with its own, got %d", calls)
+	}
+
+	// Other graphs still use the shared selector
+	serve("graph@local")
+	if calls := globalCalls.Load(); calls != 1 {
+		t.Errorf("Expected 1 request to the uplink URLs, got %d", calls)
+	}
+	if calls := mirrorCalls.Load(); calls != 4 {
+		t.Errorf("Expected no further requests to the graph's uplink URLs, got %d", calls)
+	}
+}
+
+func TestRelayHandlerRequestID(t *testing.T) {
+	var upstreamRequestID string
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamRequestID = r.Header.Get(util.RequestIDHeader)
+		w.Write([]byte(licenseResponse))
+	}))
+	defer mockServer.Close()
+
+	mockConfig := config.NewDefaultConfig()
+	mockConfig.Uplink.RetryCount = 1
+	mockConfig.Supergraphs = []config.SupergraphConfig{{GraphRef: "graph@local"}}
+	pFalse := false
+	mockLogger := logger.MakeLogger(&pFalse)
+	handler := RelayHandler(mockConfig, cache.NewMemoryCache(10), uplink.NewRoundRobinSelector([]string{mockServer.URL}), &http.Client{}, mockLogger)
+
+	// The incoming request ID should be echoed back and propagated upstream
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(licenseQuery))
+	req.Header.Set(util.RequestIDHeader, "router-request-1")
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	if rr.Header().Get(util.RequestIDHeader) != "router-request-1" {
+		t.Errorf("Expected request ID 'router-request-1' to be echoed, but got '%s'", rr.Header().Get(util.RequestIDHeader))
+	}
+	if upstreamRequestID != "router-request-1" {
+		t.Errorf("Expected request ID 'router-request-1' to be propagated upstream, but got '%s'", upstreamRequestID)
+	}
+
+	// A request ID should be generated when the router doesn't send one
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(licenseQuery)))
+	if rr.Header().Get(util.RequestIDHeader) == "" {
+		t.Errorf("Expected a generated request ID in the response")
+	}
+}
+
+func TestRelayHandlerAudit(t *testing.T) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(supergraphResponse))
+	}))
+	defer mockServer.Close()
+
+	auditFile := filepath.Join(t.TempDir(), "audit.log")
+	if err := audit.Configure(config.AuditConfig{Enabled: true, Path: auditFile}); err != nil {
+		t.Fatalf("Failed to configure auditing: %v", err)
+	}
+	defer audit.Configure(config.AuditConfig{})
+
+	mockConfig := config.NewDefaultConfig()
+	mockConfig.Uplink.RetryCount = 1
+	mockConfig.Supergraphs = []config.SupergraphConfig{{GraphRef: "graph@local"}}
+	pFalse := false
+	// Audit records are written through the uplink client's transport, whatever the level of the operational logs
+	handler := RelayHandler(mockConfig, cache.NewMemoryCache(100), uplink.NewRoundRobinSelector([]string{mockServer.URL}), util.NewHTTPClient(mockConfig), logger.MakeLogger(&pFalse))
+
+	// Only the first request is proxied to uplink; the second is a cache hit
+	for i := 0; i < 2; i++ {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(supergraphQuery)))
+		if rr.Code != http.StatusOK {
+			t.Fatalf("Expected status code 200, but got %d", rr.Code)
+		}
+	}
+
+	content, err := os.ReadFile(auditFile)
+	if err != nil {
+		t.Fatalf("Failed to read audit file: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("Expected 1 audit record, got %d: %s", len(lines), content)
+	}
+	var record map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[0]), &record); err != nil {
+		t.Fatalf("Failed to unmarshal audit record: %v", err)
+	}
+	expected := map[string]interface{}{
+		"graphRef":      "graph@local",
+		"operationName": uplink.SupergraphQuery,
+		"url":           mockServer.URL,
+		"status":        float64(http.StatusOK),
+	}
+	for key, value := range expected {
+		if record[key] != value {
+			t.Errorf("Expected %s %v, got %v", key, value, record[key])
+		}
+	}
+}
+
+func TestStartServerDedicatedListener(t *testing.T) {
+	// Reserve a free port for the dedicated management listener
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to reserve a port: %v", err)
+	}
+	managementAddress := listener.Addr().String()
+	listener.Close()
+
+	mockConfig := config.NewDefaultConfig()
+	mockConfig.Relay.Address = "127.0.0.1:0"
+	mockConfig.ManagementAPI.Address = managementAddress
+
+	pFalse := false
+	mockLogger := logger.MakeLogger(&pFalse)
+
+	DeregisterHandlers()
+	defer DeregisterHandlers()
+	RegisterHandlers("/", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("relay"))
+	})
+	RegisterHandlersOn(mockConfig, mockConfig.ManagementAPI.Address, mockConfig.ManagementAPI.Path, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("management"))
+	})
+
+	servers, err := StartServer(mockConfig, mockLogger)
+	if err != nil {
+		t.Fatalf("StartServer returned an error: %v", err)
+	}
+	defer ShutdownServer(servers, mockLogger)
+
+	if len(servers) != 2 {
+		t.Fatalf("Expected 2 servers, but got %d", len(servers))
+	}
+
+	get := func(address string) (int, string) {
+		resp, err := http.Get("http://" + address + mockConfig.ManagementAPI.Path)
+		if err != nil {
+			t.Fatalf("Request to %s failed: %v", address, err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	// The management API is only served on its dedicated listener
+	if code, body := get(servers[0].Addr); code != http.StatusNotFound || body != "relay" {
+		t.Errorf("Expected the relay listener not to serve the management API, but got %d %q", code, body)
+	}
+	if code, body := get(managementAddress); code != http.StatusOK || body != "management" {
+		t.Errorf("Expected the management API on its dedicated listener, but got %d %q", code, body)
+	}
+
+	ShutdownServer(servers, mockLogger)
+	if _, err := http.Get("http://" + managementAddress + mockConfig.ManagementAPI.Path); err == nil {
+		t.Errorf("Expected the dedicated listener to be shut down")
+	}
+}
+
+func TestStartServerMultipleAddresses(t *testing.T) {
+	// Bind an IPv6 loopback address alongside the IPv4 one, or a second IPv4 port where IPv6 isn't available
+	secondAddress := "[::1]:0"
+	if listener, err := net.Listen("tcp", secondAddress); err != nil {
+		secondAddress = "localhost:0"
+	} else {
+		listener.Close()
+	}
+
+	mockConfig := config.NewDefaultConfig()
+	mockConfig.Relay.Address = "127.0.0.1:0"
+	mockConfig.Relay.Addresses = []string{secondAddress}
+
+	pFalse := false
+	mockLogger := logger.MakeLogger(&pFalse)
+
+	DeregisterHandlers()
+	defer DeregisterHandlers()
+	RegisterHandlers("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("relay"))
+	})
+
+	servers, err := StartServer(mockConfig, mockLogger)
+	if err != nil {
+		t.Fatalf("StartServer returned an error: %v", err)
+	}
+	defer ShutdownServer(servers, mockLogger)
+
+	if len(servers) != 2 {
+		t.Fatalf("Expected 2 servers, but got %d", len(servers))
+	}
+	// Every address serves the same handlers
+	for _, server := range servers {
+		resp, err := http.Get("http://" + server.Addr + "/")
+		if err != nil {
+			t.Fatalf("Request to %s failed: %v", server.Addr, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != "relay" {
+			t.Errorf("Expected the relay on %s, but got %q", server.Addr, body)
+		}
+	}
+
+	// Every address is drained on shutdown
+	ShutdownServer(servers, mockLogger)
+	for _, server := range servers {
+		if _, err := http.Get("http://" + server.Addr + "/"); err == nil {
+			t.Errorf("Expected the listener on %s to be shut down", server.Addr)
+		}
+	}
+}
+
+// failingCache is a cache whose writes always fail, e.g. a Redis backend that is down.
+type failingCache struct{}
+
+func (c *failingCache) Get(key string) ([]byte, bool) { return nil, false }
+func (c *failingCache) Set(key string, content string, duration int) error {
+	return errors.New("connection refused")
+}
+func (c *failingCache) DeleteWithPrefix(prefix string) error { return errors.New("connection refused") }
+func (c *failingCache) KeysWithPrefix(prefix string) ([]string, error) {
+	return nil, errors.New("connection refused")
+}
+func (c *failingCache) TTL(key string) (int, bool) { return 0, false }
+func (c *failingCache) Name() string               { return "Failing" }
+
+func TestRelayHandlerCacheWriteFailure(t *testing.T) {
+	tests := []struct {
+		artifact string
+		query    string
+		response string
+		expected string
+	}{
+		{"supergraph", supergraphQuery, supergraphResponse, "mock supergraph sdl"},
+		{"entitlement", licenseQuery, licenseResponse, "bob"},
+		{"persistedQueries", persistedQueriesQuery, `{"data":{"persistedQueries":{"id":"id1","__typename":"PersistedQueriesResult","minDelaySeconds":60,"chunks":[]}}}`, "id1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.artifact, func(t *testing.T) {
+			mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(tt.response))
+			}))
+			defer mockServer.Close()
+
+			mockConfig := config.NewDefaultConfig()
+			mockConfig.Uplink.RetryCount = 1
+			mockConfig.Supergraphs = []config.SupergraphConfig{{GraphRef: "graph@local"}}
+			pFalse := false
+			handler := RelayHandler(mockConfig, &failingCache{}, uplink.NewRoundRobinSelector([]string{mockServer.URL}), &http.Client{}, logger.MakeLogger(&pFalse))
+
+			before, _ := metrics.CacheWriteErrors.Get(tt.artifact)
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(tt.query)))
+
+			if rr.Code != http.StatusOK {
+				t.Errorf("Expected status code 200, but got %d", rr.Code)
+			}
+			if !strings.Contains(rr.Body.String(), tt.expected) {
+				t.Errorf("Expected the upstream response, but got %s", rr.Body.String())
+			}
+			if after, _ := metrics.CacheWriteErrors.Get(tt.artifact); after <= before {
+				t.Errorf("Expected the cache write error to be counted")
+			}
+		})
+	}
+}
+
+func TestRelayHandlerCacheUnavailable(t *testing.T) {
+	// A slow uplink keeps the first request in flight while the others arrive
+	var upstreamCalls atomic.Int32
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamCalls.Add(1)
+		time.Sleep(100 * time.Millisecond)
+		w.Write([]byte(supergraphResponse))
+	}))
+	defer mockServer.Close()
+
+	mockConfig := config.NewDefaultConfig()
+	mockConfig.Uplink.RetryCount = 1
+	mockConfig.Supergraphs = []config.SupergraphConfig{{GraphRef: "graph@local"}}
+	pFalse := false
+	fallbackCache := cache.NewFallbackCache(&failingCache{}, logger.MakeLogger(&pFalse), mockConfig.Cache.MaxSize, mockConfig.Cache.FallbackDuration)
+	handler := RelayHandler(mockConfig, fallbackCache, uplink.NewRoundRobinSelector([]string{mockServer.URL}), &http.Client{}, logger.MakeLogger(&pFalse))
+
+	serve := func() *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(supergraphQuery)))
+		return rr
+	}
+
+	// Concurrent cache misses share a single upstream request
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if rr := serve(); rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), "mock supergraph sdl") {
+				t.Errorf("Expected the supergraph, got %d: %s", rr.Code, rr.Body.String())
+			}
+		}()
+	}
+	wg.Wait()
+	if calls := upstreamCalls.Load(); calls != 1 {
+		t.Errorf("Expected 1 upstream request, got %d", calls)
+	}
+
+	// Later requests are served from the fallback cache while the backend is down
+	for i := 0; i < 5; i++ {
+		if rr := serve(); rr.Header().Get(CacheSourceHeader) != cacheSourceLive {
+			t.Errorf("Expected a cache hit, got source %q", rr.Header().Get(CacheSourceHeader))
+		}
+	}
+	if calls := upstreamCalls.Load(); calls != 1 {
+		t.Errorf("Expected 1 upstream request, got %d", calls)
+	}
+}
+
+func TestRelayHandlerCacheOperationDisabled(t *testing.T) {
+	var upstreamCalls sync.Map
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		uplinkRequest, _ := parseRequest(r)
+		calls, _ := upstreamCalls.LoadOrStore(uplinkRequest.OperationName, new(atomic.Int32))
+		calls.(*atomic.Int32).Add(1)
+		if uplinkRequest.OperationName == uplink.PersistedQueriesQuery {
+			w.Write([]byte(`{"data":{"persistedQueries":{"id":"id1","__typename":"PersistedQueriesResult","minDelaySeconds":60,"chunks":[]}}}`))
+			return
+		}
+		w.Write([]byte(supergraphResponse))
+	}))
+	defer mockServer.Close()
+
+	pFalse := false
+	mockConfig := config.NewDefaultConfig()
+	mockConfig.Uplink.RetryCount = 1
+	mockConfig.Supergraphs = []config.SupergraphConfig{{GraphRef: "graph@local"}}
+	mockConfig.Cache.Operations.PersistedQueries = &pFalse
+	handler := RelayHandler(mockConfig, cache.NewMemoryCache(100), uplink.NewRoundRobinSelector([]string{mockServer.URL}), &http.Client{}, logger.MakeLogger(&pFalse))
+
+	tests := []struct {
+		operationName string
+		query         string
+		source        string
+		upstreamCalls int32
+	}{
+		{uplink.SupergraphQuery, supergraphQuery, cacheSourceLive, 1},
+		{uplink.PersistedQueriesQuery, persistedQueriesQuery, cacheSourceUpstream, 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.operationName, func(t *testing.T) {
+			for i := 0; i < 2; i++ {
+				rr := httptest.NewRecorder()
+				handler.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(tt.query)))
+				if rr.Code != http.StatusOK {
+					t.Fatalf("Expected status code 200, but got %d", rr.Code)
+				}
+				// Only the second request can be served from the cache
+				if i == 1 && rr.Header().Get(CacheSourceHeader) != tt.source {
+					t.Errorf("Expected source %q, got %q", tt.source, rr.Header().Get(CacheSourceHeader))
+				}
+			}
+			calls, _ := upstreamCalls.Load(tt.operationName)
+			if calls.(*atomic.Int32).Load() != tt.upstreamCalls {
+				t.Errorf("Expected %d upstream requests, got %d", tt.upstreamCalls, calls.(*atomic.Int32).Load())
+			}
+		})
+	}
+}
+
+func TestStartServerUnixSocket(t *testing.T) {
+	socketPath := filepath.Join(t.TempDir(), "relay.sock")
+
+	mockConfig := config.NewDefaultConfig()
+	mockConfig.Relay.Address = "unix:" + socketPath
+	mockConfig.Relay.SocketMode = "0600"
+
+	pFalse := false
+	mockLogger := logger.MakeLogger(&pFalse)
+
+	DeregisterHandlers()
+	defer DeregisterHandlers()
+	RegisterHandlers("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("relay"))
+	})
+
+	servers, err := StartServer(mockConfig, mockLogger)
+	if err != nil {
+		t.Fatalf("StartServer returned an error: %v", err)
+	}
+
+	info, err := os.Stat(socketPath)
+	if err != nil {
+		t.Fatalf("Expected the socket file to exist: %v", err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("Expected socket mode 0600, but got %o", info.Mode().Perm())
+	}
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", socketPath)
+		},
+	}}
+	resp, err := client.Get("http://relay/")
+	if err != nil {
+		t.Fatalf("Request over the Unix socket failed: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "relay" {
+		t.Errorf("Expected the relay response, but got %s", string(body))
+	}
+
+	// The socket file is removed on shutdown
+	ShutdownServer(servers, mockLogger)
+	if _, err := os.Stat(socketPath); !os.IsNotExist(err) {
+		t.Errorf("Expected the socket file to be removed on shutdown, but got %v", err)
+	}
+}
+
+func TestRelayHandlerReplaysExtraFields(t *testing.T) {
+	// Newer routers may request fields the relay doesn't model
+	upstreamResponse := `{"data":{"routerConfig":{"__typename":"RouterConfigResult","id":"2024-02-09T19:34:43.322688000Z","supergraphSdl":"mock supergraph sdl","minDelaySeconds":30,"comments":["first","second"],"identity":{"graphRef":"graph@local","launchId":"1234"}}}}`
+	upstreamCalls := 0
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamCalls++
+		w.Write([]byte(upstreamResponse))
+	}))
+	defer mockServer.Close()
+
+	mockConfig := config.NewDefaultConfig()
+	mockConfig.Uplink.RetryCount = 1
+	mockConfig.Supergraphs = []config.SupergraphConfig{{GraphRef: "graph@local"}}
+	pFalse := false
+	handler := RelayHandler(mockConfig, cache.NewMemoryCache(100), uplink.NewRoundRobinSelector([]string{mockServer.URL}), &http.Client{}, logger.MakeLogger(&pFalse))
+
+	var expected interface{}
+	if err := json.Unmarshal([]byte(upstreamResponse), &expected); err != nil {
+		t.Fatal(err)
+	}
+	// The first request is proxied and the others are served from the cache, which should match uplink's response field for field
+	for i := 0; i < 3; i++ {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(supergraphQuery)))
+		if rr.Code != http.StatusOK {
+			t.Fatalf("Expected status code 200, but got %d", rr.Code)
+		}
+		var actual interface{}
+		if err := json.Unmarshal(rr.Body.Bytes(), &actual); err != nil {
+			t.Fatalf("Failed to unmarshal response %s: %v", rr.Body.String(), err)
+		}
+		if !reflect.DeepEqual(actual, expected) {
+			t.Errorf("Request %d: expected %v, but got %v", i+1, expected, actual)
+		}
+	}
+	if upstreamCalls != 1 {
+		t.Errorf("Expected 1 upstream call, but got %d", upstreamCalls)
+	}
+}
+
+// jsonEqual reports whether two JSON documents are equal, regardless of the order of their fields.
+func jsonEqual(t *testing.T, a string, b string) bool {
+	t.Helper()
+	var decodedA, decodedB interface{}
+	if err := json.Unmarshal([]byte(a), &decodedA); err != nil {
+		t.Fatalf("Failed to unmarshal %s: %v", a, err)
+	}
+	if err := json.Unmarshal([]byte(b), &decodedB); err != nil {
+		t.Fatalf("Failed to unmarshal %s: %v", b, err)
+	}
+	return reflect.DeepEqual(decodedA, decodedB)
+}
+
+func TestRelayHandlerMissingEntitlement(t *testing.T) {
+	upstreamResponse := `{"data":{"routerEntitlements":{"__typename":"RouterEntitlementsResult","id":"2024-08-02T12:00:00Z","minDelaySeconds":60,"entitlement":null}}}`
+	tests := []struct {
+		missingEntitlement string
+		expected           string
+	}{
+		// Uplink's result is replayed as-is, so routers know the graph has no entitlement
+		{config.MissingEntitlementNone, upstreamResponse},
+		{config.MissingEntitlementUnchanged, `{"data":{"routerEntitlements":{"__typename":"Unchanged","id":"2024-08-02T12:00:00Z","minDelaySeconds":60}}}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.missingEntitlement, func(t *testing.T) {
+			upstreamCalls := 0
+			mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				upstreamCalls++
+				w.Write([]byte(upstreamResponse))
+			}))
+			defer mockServer.Close()
+
+			mockConfig := config.NewDefaultConfig()
+			mockConfig.Uplink.RetryCount = 1
+			mockConfig.Cache.MissingEntitlement = tt.missingEntitlement
+			mockConfig.Supergraphs = []config.SupergraphConfig{{GraphRef: "graph@local"}}
+			pFalse := false
+			handler := RelayHandler(mockConfig, cache.NewMemoryCache(100), uplink.NewRoundRobinSelector([]string{mockServer.URL}), &http.Client{}, logger.MakeLogger(&pFalse))
+
+			// The first request is proxied, storing the response without an entitlement, and the second is served from the cache
+			serve := func() string {
+				rr := httptest.NewRecorder()
+				handler.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(licenseQuery)))
+				if rr.Code != http.StatusOK {
+					t.Fatalf("Expected status code 200, but got %d", rr.Code)
+				}
+				return rr.Body.String()
+			}
+			if body := serve(); !jsonEqual(t, body, upstreamResponse) {
+				t.Errorf("Expected uplink's response, got %s", body)
+			}
+			if body := serve(); !jsonEqual(t, body, tt.expected) {
+				t.Errorf("Expected %s from the cache, got %s", tt.expected, body)
+			}
+			if upstreamCalls != 1 {
+				t.Errorf("Expected 1 upstream call, but got %d", upstreamCalls)
+			}
+		})
+	}
+
+	// Entries cached without a typename are replayed as Unchanged, as before
+	rr := httptest.NewRecorder()
+	err := handleCacheHit(cache.MakeCacheKey("graph@local", uplink.LicenseQuery), &cache.CacheItem{ID: "2024-08-02T12:00:00Z", Content: []byte{}}, logger.MakeLogger(nil), time.Minute, false, "")(rr, httptest.NewRequest(http.MethodPost, "/", nil))
+	if err != nil || !strings.Contains(rr.Body.String(), `"__typename":"Unchanged"`) {
+		t.Errorf("Expected Unchanged for an entry without a typename, got %s, %v", rr.Body.String(), err)
+	}
+}
+
+func TestRelayHandlerUnparseableID(t *testing.T) {
+	tests := []struct {
+		name     string
+		query    string
+		response string
+		expected string
+	}{
+		{"supergraph", supergraphQuery, `{"data":{"routerConfig":{"__typename":"RouterConfigResult","id":"not-a-timestamp","supergraphSdl":"mock supergraph sdl","minDelaySeconds":30}}}`, "mock supergraph sdl"},
+		{"entitlement", licenseQuery, `{"data":{"routerEntitlements":{"__typename":"RouterEntitlementsResult","id":"not-a-timestamp","minDelaySeconds":60.0,"entitlement":{"jwt":"bob"}}}}`, "bob"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(tt.response))
+			}))
+			defer mockServer.Close()
+
+			mockConfig := config.NewDefaultConfig()
+			mockConfig.Uplink.RetryCount = 1
+			mockConfig.Supergraphs = []config.SupergraphConfig{{GraphRef: "graph@local"}}
+			pFalse := false
+			systemCache := cache.NewMemoryCache(100)
+			handler := RelayHandler(mockConfig, systemCache, uplink.NewRoundRobinSelector([]string{mockServer.URL}), &http.Client{}, logger.MakeLogger(&pFalse))
+
+			// An unparseable ID is logged rather than failing the request, and the response is still cached
+			for i := 0; i < 2; i++ {
+				rr := httptest.NewRecorder()
+				handler.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(tt.query)))
+				if rr.Code != http.StatusOK {
+					t.Fatalf("Expected status code 200, but got %d", rr.Code)
+				}
+				if !strings.Contains(rr.Body.String(), tt.expected) {
+					t.Errorf("Expected the upstream response, but got %s", rr.Body.String())
+				}
+			}
+			if keys, _ := systemCache.KeysWithPrefix("graph:local:"); len(keys) == 0 {
+				t.Errorf("Expected the response to be cached")
+			}
+		})
+	}
+}
+
+func TestRegisterRelayHandler(t *testing.T) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(supergraphResponse))
+	}))
+	defer mockServer.Close()
+
+	pFalse := false
+	mockConfig := config.NewDefaultConfig()
+	mockConfig.Uplink.RetryCount = 1
+	relayHandler := RelayHandler(mockConfig, cache.NewMemoryCache(100), uplink.NewRoundRobinSelector([]string{mockServer.URL}), &http.Client{}, logger.MakeLogger(&pFalse))
+
+	tests := []struct {
+		relayPath string
+		routes    map[string]string // Expected body prefix for each request path; an empty string expects a 404.
+	}{
+		{"/", map[string]string{
+			"/":                       "{",
+			"/anything":               "{",
+			"/webhook":                "webhook",
+			"/persisted-queries/123":  "persisted-queries",
+			"/persisted-queries/123/": "persisted-queries",
+		}},
+		{"/uplink", map[string]string{
+			"/uplink":                "{",
+			"/uplink/":               "{",
+			"/webhook":               "webhook",
+			"/persisted-queries/123": "persisted-queries",
+			"/":                      "",
+			"/other":                 "",
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.relayPath, func(t *testing.T) {
+			DeregisterHandlers()
+			defer DeregisterHandlers()
+			RegisterRelayHandler(tt.relayPath, relayHandler)
+			RegisterHandlers("/persisted-queries/", func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("persisted-queries")) })
+			RegisterHandlers("/webhook", func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("webhook")) })
+
+			for path, expected := range tt.routes {
+				rr := httptest.NewRecorder()
+				http.DefaultServeMux.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, path, strings.NewReader(supergraphQuery)))
+				if expected == "" {
+					if rr.Code != http.StatusNotFound {
+						t.Errorf("Expected %s to be 404, got %d", path, rr.Code)
+					}
+					continue
+				}
+				if rr.Code != http.StatusOK || !strings.HasPrefix(rr.Body.String(), expected) {
+					t.Errorf("Expected %s to be routed to %q, got %d %q", path, expected, rr.Code, rr.Body.String())
+				}
+			}
+		})
+	}
+}
+
+func TestRelayHandlerReplaysUpstreamResponse(t *testing.T) {
+	tests := []struct {
+		name     string
+		query    string
+		response string
+		field    string
+	}{
+		{"supergraph", supergraphQuery, `{"data":{"routerConfig":{"__typename":"RouterConfigResult","id":"2024-02-09T19:34:43.322688000Z","supergraphSdl":"mock supergraph sdl","minDelaySeconds":45}}}`, "routerConfig"},
+		{"entitlement", licenseQuery, `{"data":{"routerEntitlements":{"__typename":"RouterEntitlementsResult","id":"2024-02-09T19:34:43.322688000Z","minDelaySeconds":90,"entitlement":{"jwt":"bob"}}}}`, "routerEntitlements"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstreamCalls := 0
+			mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				upstreamCalls++
+				w.Write([]byte(tt.response))
+			}))
+			defer mockServer.Close()
+
+			mockConfig := config.NewDefaultConfig()
+			mockConfig.Uplink.RetryCount = 1
+			mockConfig.Supergraphs = []config.SupergraphConfig{{GraphRef: "graph@local"}}
+			pFalse := false
+			handler := RelayHandler(mockConfig, cache.NewMemoryCache(100), uplink.NewRoundRobinSelector([]string{mockServer.URL}), &http.Client{}, logger.MakeLogger(&pFalse))
+
+			var upstream map[string]map[string]map[string]interface{}
+			if err := json.Unmarshal([]byte(tt.response), &upstream); err != nil {
+				t.Fatal(err)
+			}
+			expected := upstream["data"][tt.field]
+
+			// The second request is served from the cache, and should replay the upstream id and minDelaySeconds
+			for i := 0; i < 2; i++ {
+				rr := httptest.NewRecorder()
+				handler.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(tt.query)))
+				if rr.Code != http.StatusOK {
+					t.Fatalf("Expected status code 200, but got %d", rr.Code)
+				}
+				var response map[string]map[string]map[string]interface{}
+				if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+					t.Fatalf("Failed to unmarshal response %s: %v", rr.Body.String(), err)
+				}
+				actual := response["data"][tt.field]
+				for _, key := range []string{"id", "minDelaySeconds"} {
+					if actual[key] != expected[key] {
+						t.Errorf("Request %d: expected %s %v, but got %v", i+1, key, expected[key], actual[key])
+					}
+				}
+			}
+			if upstreamCalls != 1 {
+				t.Errorf("Expected 1 upstream call, but got %d", upstreamCalls)
+			}
+		})
+	}
+}
+
+func TestRelayHandlerStaleGrace(t *testing.T) {
+	// Uplink returns a new supergraph once the first has been cached, and blocks refreshes until released
+	var upstreamCalls atomic.Int32
+	release := make(chan struct{})
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if upstreamCalls.Add(1) == 1 {
+			w.Write([]byte(supergraphResponse))
+			return
+		}
+		<-release
+		w.Write([]byte(strings.Replace(supergraphResponse, "mock supergraph sdl", "refreshed supergraph sdl", 1)))
+	}))
+	defer mockServer.Close()
+
+	mockConfig := config.NewDefaultConfig()
+	mockConfig.Uplink.RetryCount = 1
+	mockConfig.Cache.Duration = 1
+	mockConfig.Cache.StaleGrace = 60
+	mockConfig.Supergraphs = []config.SupergraphConfig{{GraphRef: "graph@local"}}
+	pFalse := false
+	systemCache := cache.NewStaleCache(cache.NewMemoryCache(100), mockConfig.Cache.StaleGrace)
+	handler := RelayHandler(mockConfig, systemCache, uplink.NewRoundRobinSelector([]string{mockServer.URL}), &http.Client{}, logger.MakeLogger(&pFalse))
+
+	serve := func() *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(supergraphQuery)))
+		return rr
+	}
+	if rr := serve(); rr.Code != http.StatusOK {
+		t.Fatalf("Expected status code 200, but got %d", rr.Code)
+	}
+
+	// Age the cached entry past the cache duration
+	cacheKey := cache.DefaultCacheKey("graph@local", uplink.SupergraphQuery)
+	content, ok := systemCache.Get(cacheKey)
+	if !ok {
+		t.Fatalf("Expected the supergraph to be cached")
+	}
+	var cacheItem cache.CacheItem
+	if err := json.Unmarshal(content, &cacheItem); err != nil {
+		t.Fatal(err)
+	}
+	cacheItem.LastModified = time.Now().Add(-2 * time.Second)
+	content, _ = json.Marshal(cacheItem)
+	systemCache.Set(cacheKey, string(content), mockConfig.Cache.Duration)
+
+	// Stale entries are served immediately while a single refresh runs
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rr := serve()
+			if rr.Header().Get(CacheSourceHeader) != cacheSourceStale || !strings.Contains(rr.Body.String(), "mock supergraph sdl") {
+				t.Errorf("Expected the stale supergraph, got source %q: %s", rr.Header().Get(CacheSourceHeader), rr.Body.String())
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Once the refresh completes, the refreshed supergraph is served from the cache
+	close(release)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		rr := serve()
+		if strings.Contains(rr.Body.String(), "refreshed supergraph sdl") {
+			if source := rr.Header().Get(CacheSourceHeader); source != cacheSourceLive {
+				t.Errorf("Expected a live cache hit, got source %q", source)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the refreshed supergraph, got %s", rr.Body.String())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// The initial request and a single refresh
+	if calls := upstreamCalls.Load(); calls != 2 {
+		t.Errorf("Expected 2 upstream requests, got %d", calls)
+	}
+}
+
+func TestRelayHandlerReusesCacheHitResponses(t *testing.T) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(supergraphResponse))
+	}))
+	defer mockServer.Close()
+
+	mockConfig := config.NewDefaultConfig()
+	mockConfig.Uplink.RetryCount = 1
+	mockConfig.Supergraphs = []config.SupergraphConfig{{GraphRef: "graph@local"}}
+	pFalse := false
+	systemCache := cache.NewMemoryCache(100)
+	handler := RelayHandler(mockConfig, systemCache, uplink.NewRoundRobinSelector([]string{mockServer.URL}), &http.Client{}, logger.MakeLogger(&pFalse))
+
+	serve := func() *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(supergraphQuery)))
+		return rr
+	}
+	// Populate the cache, then build and reuse the cache hit's response
+	serve()
+	first, second := serve(), serve()
+	if first.Header().Get(CacheSourceHeader) != cacheSourceLive || second.Header().Get(CacheSourceHeader) != cacheSourceLive {
+		t.Fatalf("Expected cache hits, got %q and %q", first.Header().Get(CacheSourceHeader), second.Header().Get(CacheSourceHeader))
+	}
+	if first.Body.String() != second.Body.String() {
+		t.Errorf("Expected the same response for an unchanged entry, got %s and %s", first.Body.String(), second.Body.String())
+	}
+
+	// Replace the entry's content without changing its ID, e.g. a webhook update
+	cacheKey := cache.DefaultCacheKey("graph@local", uplink.SupergraphQuery)
+	content, ok := systemCache.Get(cacheKey)
+	if !ok {
+		t.Fatalf("Expected the supergraph to be cached")
+	}
+	var cacheItem cache.CacheItem
+	if err := json.Unmarshal(content, &cacheItem); err != nil {
+		t.Fatal(err)
+	}
+	cacheItem.Content = []byte("updated supergraph sdl")
+	cacheItem.Hash = util.HashString(string(cacheItem.Content))
+	content, _ = json.Marshal(cacheItem)
+	systemCache.Set(cacheKey, string(content), mockConfig.Cache.Duration)
+
+	// The response built for the previous content isn't reused
+	if rr := serve(); !strings.Contains(rr.Body.String(), "updated supergraph sdl") {
+		t.Errorf("Expected the updated supergraph, got %s", rr.Body.String())
+	}
+}
+
+func TestRelayHandlerErrorStatus(t *testing.T) {
+	okServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(supergraphResponse))
+	}))
+	defer okServer.Close()
+	slowServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(500 * time.Millisecond)
+		w.Write([]byte(supergraphResponse))
+	}))
+	defer slowServer.Close()
+	closedServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	closedServer.Close()
+
+	unconfiguredQuery := strings.Replace(supergraphQuery, "graph@local", "other@local", 1)
+	unconfiguredQueryWithoutKey := strings.Replace(unconfiguredQuery, `"apiKey":"service:graph:1234",`, "", 1)
+
+	tests := []struct {
+		name           string
+		uplinkURL      string
+		supergraph     config.SupergraphConfig
+		restrictGraphs bool
+		body           string
+		expected       int
+	}{
+		{"success", okServer.URL, config.SupergraphConfig{GraphRef: "graph@local"}, false, supergraphQuery, http.StatusOK},
+		{"malformed request", okServer.URL, config.SupergraphConfig{GraphRef: "graph@local"}, false, `{"variables":`, http.StatusBadRequest},
+		{"missing graph_ref", okServer.URL, config.SupergraphConfig{GraphRef: "graph@local"}, false, `{"operationName":"SupergraphSdlQuery","variables":{}}`, http.StatusBadRequest},
+		{"unconfigured graph", okServer.URL, config.SupergraphConfig{GraphRef: "graph@local"}, false, unconfiguredQuery, http.StatusOK},
+		{"unconfigured graph without an API key", okServer.URL, config.SupergraphConfig{GraphRef: "graph@local"}, false, unconfiguredQueryWithoutKey, http.StatusNotFound},
+		{"restricted graph", okServer.URL, config.SupergraphConfig{GraphRef: "graph@local"}, true, unconfiguredQuery, http.StatusForbidden},
+		{"upstream unreachable", closedServer.URL, config.SupergraphConfig{GraphRef: "graph@local"}, false, supergraphQuery, http.StatusBadGateway},
+		{"upstream timeout", slowServer.URL, config.SupergraphConfig{GraphRef: "graph@local"}, false, supergraphQuery, http.StatusGatewayTimeout},
+		{"missing pinned entry", okServer.URL, config.SupergraphConfig{GraphRef: "graph@local", LaunchID: "launch"}, false, supergraphQuery, http.StatusInternalServerError},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockConfig := config.NewDefaultConfig()
+			mockConfig.Uplink.RetryCount = 1
+			mockConfig.Relay.RestrictGraphs = tt.restrictGraphs
+			mockConfig.Supergraphs = []config.SupergraphConfig{tt.supergraph}
+			pFalse := false
+			httpClient := &http.Client{Transport: &http.Transport{ResponseHeaderTimeout: 100 * time.Millisecond}}
+			handler := RelayHandler(mockConfig, cache.NewMemoryCache(10), uplink.NewRoundRobinSelector([]string{tt.uplinkURL}), httpClient, logger.MakeLogger(&pFalse))
+
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(tt.body)))
+			if rr.Code != tt.expected {
+				t.Errorf("Expected status code %d, but got %d: %s", tt.expected, rr.Code, rr.Body.String())
+			}
+		})
+	}
+}
+
+func TestRelayHandlerRecordsCacheHitRates(t *testing.T) {
+	metrics.CacheHitRates.Reset()
+	defer metrics.CacheHitRates.Reset()
+
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if strings.Contains(string(body), uplink.LicenseQuery) {
+			w.Write([]byte(licenseResponse))
+			return
+		}
+		w.Write([]byte(supergraphResponse))
+	}))
+	defer mockServer.Close()
+
+	mockConfig := config.NewDefaultConfig()
+	mockConfig.Uplink.RetryCount = 1
+	mockConfig.Cache.Operations.Entitlement = new(bool)
+	pFalse := false
+	handler := RelayHandler(mockConfig, cache.NewMemoryCache(100), uplink.NewRoundRobinSelector([]string{mockServer.URL}), &http.Client{}, logger.MakeLogger(&pFalse))
+
+	// The first supergraph request misses the cache and the next three hit it, while every license request is proxied
+	for _, query := range []string{supergraphQuery, supergraphQuery, supergraphQuery, supergraphQuery, licenseQuery, licenseQuery} {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(query)))
+		if rr.Code != http.StatusOK {
+			t.Fatalf("Expected status code 200, but got %d", rr.Code)
+		}
+	}
+
+	snapshot := metrics.CacheHitRates.Snapshot(time.Now())
+	if snapshot.Total.Hits != 3 || snapshot.Total.Misses != 3 || snapshot.Total.Ratio() != 0.5 {
+		t.Errorf("Expected 3 hits and 3 misses in total, got %+v", snapshot.Total)
+	}
+	expectedOperations := []metrics.HitRate{
+		{Name: uplink.LicenseQuery, Hits: 0, Misses: 2},
+		{Name: uplink.SupergraphQuery, Hits: 3, Misses: 1},
+	}
+	if len(snapshot.Operations) != len(expectedOperations) {
+		t.Fatalf("Expected %d operations, got %+v", len(expectedOperations), snapshot.Operations)
+	}
+	for i, expected := range expectedOperations {
+		if snapshot.Operations[i] != expected {
+			t.Errorf("Expected %+v, got %+v", expected, snapshot.Operations[i])
+		}
+	}
+	if len(snapshot.Graphs) != 1 || snapshot.Graphs[0].Name != "graph@local" || snapshot.Graphs[0].Ratio() != 0.5 {
+		t.Errorf("Expected a hit rate of 0.5 for graph@local, got %+v", snapshot.Graphs)
+	}
+}
+
+// BenchmarkRelayHandlerCacheHit measures serving a supergraph from the live cache, e.g.
+// go test -run xxx -bench BenchmarkRelayHandlerCacheHit -benchmem ./proxy/
+func BenchmarkRelayHandlerCacheHit(b *testing.B) {
+	// A realistically sized supergraph, as the SDL dominates the size of the cached entry and the response
+	sdl := strings.Repeat("type Query { field: String }\n", 5000)
+	upstreamResponse, _ := json.Marshal(map[string]interface{}{
+		"data": map[string]interface{}{
+			"routerConfig": map[string]interface{}{"__typename": "RouterConfigResult", "id": "2024-02-09T19:34:43.322688000Z", "supergraphSdl": sdl, "minDelaySeconds": 30},
+		},
+	})
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(upstreamResponse)
+	}))
+	defer mockServer.Close()
+
+	mockConfig := config.NewDefaultConfig()
+	mockConfig.Cache.Duration = 60
+	mockConfig.Uplink.RetryCount = 1
+	mockConfig.Supergraphs = []config.SupergraphConfig{{GraphRef: "graph@local"}}
+	discardLogger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	handler := RelayHandler(mockConfig, cache.NewMemoryCache(10), uplink.NewRoundRobinSelector([]string{mockServer.URL}), &http.Client{}, discardLogger)
+
+	// The first request populates the cache from uplink
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(supergraphQuery)))
+	if rr.Header().Get(CacheSourceHeader) != cacheSourceUpstream {
+		b.Fatalf("Expected the first request to be proxied to uplink")
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(supergraphQuery)))
+		if rr.Header().Get(CacheSourceHeader) != cacheSourceLive {
+			b.Fatalf("Expected a cache hit, got %s", rr.Header().Get(CacheSourceHeader))
+		}
+	}
+}
+
+func TestRelayHandlerUpdatesDefaultEntry(t *testing.T) {
+	tests := []struct {
+		name          string
+		query         string
+		response      string
+		operationName string
+	}{
+		{"supergraph", supergraphQuery, supergraphResponse, uplink.SupergraphQuery},
+		{"entitlement", licenseQuery, licenseResponse, uplink.LicenseQuery},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(tt.response))
+			}))
+			defer mockServer.Close()
+
+			mockConfig := config.NewDefaultConfig()
+			mockConfig.Uplink.RetryCount = 1
+			mockConfig.Supergraphs = []config.SupergraphConfig{{GraphRef: "graph@local"}}
+			systemCache := cache.NewMemoryCache(100)
+			pFalse := false
+			handler := RelayHandler(mockConfig, systemCache, uplink.NewRoundRobinSelector([]string{mockServer.URL}), &http.Client{}, logger.MakeLogger(&pFalse))
+
+			// A router with an outdated artifact misses the cache, so the relay fetches the artifact from uplink
+			query := strings.Replace(tt.query, `"ifAfterId":null`, `"ifAfterId":"outdated"`, 1)
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(query)))
+			if rr.Code != http.StatusOK {
+				t.Fatalf("Expected status code 200, but got %d", rr.Code)
+			}
+
+			read := func(key string) cache.CacheItem {
+				entry, ok := systemCache.Get(key)
+				if !ok {
+					t.Fatalf("Expected an entry at %s", key)
+				}
+				var item cache.CacheItem
+				if err := json.Unmarshal(entry, &item); err != nil {
+					t.Fatal(err)
+				}
+				return item
+			}
+			variant := read(cache.MakeCacheKey("graph@local", tt.operationName, map[string]interface{}{"graph_ref": "graph@local", "ifAfterId": "outdated"}))
+			base := read(cache.DefaultCacheKey("graph@local", tt.operationName))
+			if base.ID != variant.ID || base.Hash != variant.Hash || string(base.Content) != string(variant.Content) {
+				t.Errorf("Expected the default entry to match the fetched one, got %+v and %+v", base, variant)
+			}
+		})
+	}
+}
+
+func TestRelayHandlerMaxServeAge(t *testing.T) {
+	tests := []struct {
+		name           string
+		age            time.Duration
+		upstreamStatus int
+		upstreamCalls  int32
+		expectedSdl    string
+		expectedSource string
+	}{
+		{"under the max serve age", 59 * time.Minute, http.StatusOK, 0, "cached supergraph sdl", cacheSourceLive},
+		{"over the max serve age", 61 * time.Minute, http.StatusOK, 1, "mock supergraph sdl", cacheSourceUpstream},
+		// The failed fetch is retried once before the cached item is served
+		{"over the max serve age with uplink failing", 61 * time.Minute, http.StatusInternalServerError, 2, "cached supergraph sdl", cacheSourceLive},
+	}
+	defer metrics.CacheHitRates.Reset()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			metrics.CacheHitRates.Reset()
+			var upstreamCalls atomic.Int32
+			mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				upstreamCalls.Add(1)
+				w.WriteHeader(tt.upstreamStatus)
+				w.Write([]byte(supergraphResponse))
+			}))
+			defer mockServer.Close()
+
+			mockConfig := config.NewDefaultConfig()
+			mockConfig.Uplink.RetryCount = 1
+			mockConfig.Cache.Duration = -1
+			mockConfig.Cache.MaxServeAge = 3600
+			mockConfig.Supergraphs = []config.SupergraphConfig{{GraphRef: "graph@local"}}
+			systemCache := cache.NewMemoryCache(100)
+			pFalse := false
+			handler := RelayHandler(mockConfig, systemCache, uplink.NewRoundRobinSelector([]string{mockServer.URL}), &http.Client{}, logger.MakeLogger(&pFalse))
+
+			// An item cached indefinitely, last modified the given time ago
+			content, _ := json.Marshal(cache.CacheItem{
+				ID:           "2024-01-01T00:00:00Z",
+				Hash:         util.HashString("cached supergraph sdl"),
+				Expiration:   cache.IndefiniteTimestamp,
+				LastModified: time.Now().Add(-tt.age),
+				Content:      []byte("cached supergraph sdl"),
+			})
+			systemCache.Set(cache.DefaultCacheKey("graph@local", uplink.SupergraphQuery), string(content), -1)
+
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(supergraphQuery)))
+			if rr.Code != http.StatusOK {
+				t.Fatalf("Expected status code 200, but got %d: %s", rr.Code, rr.Body.String())
+			}
+			if !strings.Contains(rr.Body.String(), tt.expectedSdl) {
+				t.Errorf("Expected the response to contain %q, got %s", tt.expectedSdl, rr.Body.String())
+			}
+			if calls := upstreamCalls.Load(); calls != tt.upstreamCalls {
+				t.Errorf("Expected %d upstream requests, got %d", tt.upstreamCalls, calls)
+			}
+			// The response's source is reported, and recorded as a hit or miss, once
+			if source := rr.Header().Get(CacheSourceHeader); source != tt.expectedSource {
+				t.Errorf("Expected source %s, got %s", tt.expectedSource, source)
+			}
+			if total := metrics.CacheHitRates.Snapshot(time.Now()).Total; total.Hits+total.Misses != 1 {
+				t.Errorf("Expected the request to be recorded once, got %+v", total)
+			}
+		})
+	}
+}
+
+func TestRelayHandlerOperationAliases(t *testing.T) {
+	var upstreamCalls atomic.Int32
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamCalls.Add(1)
+		w.Write([]byte(persistedQueriesResponse))
+	}))
+	defer mockServer.Close()
+
+	mockConfig := config.NewDefaultConfig()
+	mockConfig.Uplink.RetryCount = 1
+	mockConfig.Relay.StrictOperations = true
+	mockConfig.Relay.OperationAliases = map[string]string{"PersistedQueriesQuery": uplink.PersistedQueriesQuery}
+	mockConfig.Supergraphs = []config.SupergraphConfig{{GraphRef: "graph@local"}}
+	systemCache := cache.NewMemoryCache(100)
+	pFalse := false
+	handler := RelayHandler(mockConfig, systemCache, uplink.NewRoundRobinSelector([]string{mockServer.URL}), &http.Client{}, logger.MakeLogger(&pFalse))
+
+	serve := func(body string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body)))
+		if rr.Code != http.StatusOK {
+			t.Fatalf("Expected status code 200, but got %d: %s", rr.Code, rr.Body.String())
+		}
+		return rr
+	}
+
+	// The aliased operation name is accepted in strict mode, and cached as the persisted query manifest
+	aliasedQuery := strings.Replace(persistedQueriesQuery, `"operationName":"PersistedQueriesManifestQuery"`, `"operationName":"PersistedQueriesQuery"`, 1)
+	serve(aliasedQuery)
+	if _, ok := systemCache.Get(cache.DefaultCacheKey("graph@local", uplink.PersistedQueriesQuery)); !ok {
+		t.Fatalf("Expected the manifest to be cached under the persisted queries operation")
+	}
+
+	// Requests with either operation name are then served from the same cache entry
+	for _, body := range []string{aliasedQuery, persistedQueriesQuery} {
+		if rr := serve(body); rr.Header().Get(CacheSourceHeader) != cacheSourceLive {
+			t.Errorf("Expected a cache hit, got source %q", rr.Header().Get(CacheSourceHeader))
+		}
+	}
+	if calls := upstreamCalls.Load(); calls != 1 {
+		t.Errorf("Expected 1 upstream request, got %d", calls)
+	}
+}
+
+func TestRelayHandlerHealthPing(t *testing.T) {
+	// Servers shut down by other tests leave the relay shutting down
+	shuttingDown.Store(false)
+	proxied := false
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = true
+		w.Write([]byte(supergraphResponse))
+	}))
+	defer mockServer.Close()
+
+	mockConfig := config.NewDefaultConfig()
+	mockConfig.Uplink.RetryCount = 1
+	mockConfig.Supergraphs = []config.SupergraphConfig{{GraphRef: "graph@local"}}
+	pFalse := false
+	handler := RelayHandler(mockConfig, cache.NewMemoryCache(10), uplink.NewRoundRobinSelector([]string{mockServer.URL}), &http.Client{}, logger.MakeLogger(&pFalse))
+
+	// A bodyless GET to the relay path is answered with the health response rather than parsed as an uplink request
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rr.Code != http.StatusOK || rr.Body.String() != "OK" {
+		t.Errorf("Expected a 200 health response, but got %d: %s", rr.Code, rr.Body.String())
+	}
+	if proxied {
+		t.Errorf("Expected the health ping not to be proxied to uplink")
+	}
+
+	// Pings fail once the servers are shutting down
+	shuttingDown.Store(true)
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/", nil))
+	shuttingDown.Store(false)
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected status code 503 while shutting down, but got %d", rr.Code)
+	}
+
+	// Uplink requests are still handled
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(supergraphQuery)))
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), "mock supergraph sdl") {
+		t.Errorf("Expected the supergraph, but got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	// The response is configurable, and pings are rejected like other GETs when disabled
+	mockConfig.Relay.HealthPing.Body = "healthy"
+	handler = RelayHandler(mockConfig, cache.NewMemoryCache(10), uplink.NewRoundRobinSelector([]string{mockServer.URL}), &http.Client{}, logger.MakeLogger(&pFalse))
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rr.Code != http.StatusOK || rr.Body.String() != "healthy" {
+		t.Errorf("Expected the configured health response, but got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	disabled := false
+	mockConfig.Relay.HealthPing.Enabled = &disabled
+	handler = RelayHandler(mockConfig, cache.NewMemoryCache(10), uplink.NewRoundRobinSelector([]string{mockServer.URL}), &http.Client{}, logger.MakeLogger(&pFalse))
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rr.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected status code 405 with health pings disabled, but got %d", rr.Code)
+	}
+}
+
+func TestRelayHandlerMethodNotAllowed(t *testing.T) {
+	proxied := false
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = true
+		w.Write([]byte(supergraphResponse))
+	}))
+	defer mockServer.Close()
+
+	mockConfig := config.NewDefaultConfig()
+	mockConfig.Uplink.RetryCount = 1
+	mockConfig.Supergraphs = []config.SupergraphConfig{{GraphRef: "graph@local"}}
+	pFalse := false
+	handler := RelayHandler(mockConfig, cache.NewMemoryCache(10), uplink.NewRoundRobinSelector([]string{mockServer.URL}), &http.Client{}, logger.MakeLogger(&pFalse))
+
+	for _, method := range []string{http.MethodGet, http.MethodPut, http.MethodDelete} {
+		t.Run(method, func(t *testing.T) {
+			// Requests with a body aren't health pings, even if they're GETs
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, httptest.NewRequest(method, "/", strings.NewReader(supergraphQuery)))
+			if rr.Code != http.StatusMethodNotAllowed {
+				t.Errorf("Expected status code 405, but got %d", rr.Code)
+			}
+			if allow := rr.Header().Get("Allow"); allow != http.MethodPost {
+				t.Errorf("Expected the Allow header to be POST, got %q", allow)
+			}
+		})
+	}
+	if proxied {
+		t.Errorf("Expected requests with other methods not to be proxied to uplink")
+	}
+}
+
+func TestRelayHandlerRetriesUpstreamFailures(t *testing.T) {
+	closedServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	closedServer.Close()
+	var unavailableCalls atomic.Int32
+	unavailableServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		unavailableCalls.Add(1)
+		http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+	}))
+	defer unavailableServer.Close()
+	var flakyCalls atomic.Int32
+	flakyServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The request body is sent again on each attempt
+		if body, _ := io.ReadAll(r.Body); !strings.Contains(string(body), "SupergraphSdlQuery") {
+			t.Errorf("Expected the request body to be proxied, got %q", body)
+		}
+		if flakyCalls.Add(1) == 1 {
+			http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(supergraphResponse))
+	}))
+	defer flakyServer.Close()
+
+	tests := []struct {
+		name           string
+		uplinkURL      string
+		budget         config.RetryBudgetConfig
+		requests       int
+		expectedStatus int
+		expectedBody   string
+		attempts       int32
+	}{
+		// Each request is attempted retryCount+1 times before the last failure is returned, once
+		{name: "upstream unreachable", uplinkURL: closedServer.URL, requests: 1, expectedStatus: http.StatusBadGateway, attempts: 3},
+		{name: "upstream unavailable", uplinkURL: unavailableServer.URL, requests: 1, expectedStatus: http.StatusServiceUnavailable, expectedBody: "Service Unavailable\n", attempts: 3},
+		{name: "upstream recovers", uplinkURL: flakyServer.URL, requests: 1, expectedStatus: http.StatusOK, expectedBody: supergraphResponse, attempts: 2},
+		// The first request is retried once, then the budget is exhausted and no other request is retried
+		{name: "retry budget", uplinkURL: unavailableServer.URL, budget: config.RetryBudgetConfig{Enabled: true, MaxTokens: 4, TokenRatio: 0.5}, requests: 5, expectedStatus: http.StatusServiceUnavailable, expectedBody: "Service Unavailable\n", attempts: 6},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			unavailableCalls.Store(0)
+			flakyCalls.Store(0)
+			mockConfig := config.NewDefaultConfig()
+			mockConfig.Uplink.RetryCount = 2
+			mockConfig.Uplink.RetryBudget = tt.budget
+			mockConfig.Cache.Enabled = false
+			mockConfig.Supergraphs = []config.SupergraphConfig{{GraphRef: "graph@local"}}
+			selector := &countingSelector{Selector: uplink.NewRoundRobinSelector([]string{tt.uplinkURL})}
+			pFalse := false
+			handler := RelayHandler(mockConfig, cache.NewMemoryCache(100), selector, &http.Client{}, logger.MakeLogger(&pFalse))
+
+			for i := 0; i < tt.requests; i++ {
+				rr := httptest.NewRecorder()
+				handler.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(supergraphQuery)))
+				if rr.Code != tt.expectedStatus {
+					t.Fatalf("Expected status code %d, but got %d", tt.expectedStatus, rr.Code)
+				}
+				if tt.expectedBody != "" && rr.Body.String() != tt.expectedBody {
+					t.Errorf("Expected the final response to be written once, got %q", rr.Body.String())
+				}
+				if tt.expectedBody == "" {
+					// The FetchError is written once, so the body is a single JSON document
+					var response map[string]map[string]map[string]interface{}
+					if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil || response["data"]["routerConfig"]["__typename"] != "FetchError" {
+						t.Errorf("Expected a single FetchError response, got %q", rr.Body.String())
+					}
+				}
+			}
+			if calls := selector.calls.Load(); calls != tt.attempts {
+				t.Errorf("Expected %d attempts to reach uplink, got %d", tt.attempts, calls)
+			}
+		})
+	}
+}
@@ -0,0 +1,49 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// redactedValue replaces the values of sensitive variables and headers in debug logs.
+const redactedValue = "****"
+
+// redactHeaders returns a copy of the headers with the values of the given headers redacted, for logging.
+// Header names are matched case-insensitively.
+func redactHeaders(headers http.Header, redactedHeaders []string) http.Header {
+	redacted := headers.Clone()
+	for _, name := range redactedHeaders {
+		if values, ok := redacted[http.CanonicalHeaderKey(name)]; ok {
+			for i := range values {
+				values[i] = redactedValue
+			}
+		}
+	}
+	return redacted
+}
+
+// redactBody returns a copy of a GraphQL request body with the values of the given variables redacted, for logging.
+// Variable names are matched case-insensitively. It returns false if the body isn't a JSON object,
+// in which case it can't tell where the variables are and the body mustn't be logged.
+func redactBody(body []byte, variables []string) ([]byte, bool) {
+	var request map[string]interface{}
+	if err := json.Unmarshal(body, &request); err != nil {
+		return nil, false
+	}
+	if requestVariables, ok := request["variables"].(map[string]interface{}); ok {
+		for name := range requestVariables {
+			for _, variable := range variables {
+				if strings.EqualFold(name, variable) {
+					requestVariables[name] = redactedValue
+					break
+				}
+			}
+		}
+	}
+	redacted, err := json.Marshal(request)
+	if err != nil {
+		return nil, false
+	}
+	return redacted, true
+}
@@ -0,0 +1,117 @@
+package proxy
+
+import (
+	"bytes"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"apollosolutions/uplink-relay/cache"
+	"apollosolutions/uplink-relay/config"
+	"apollosolutions/uplink-relay/uplink"
+)
+
+func TestRelayHandlerRedactsDebugLogs(t *testing.T) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(licenseResponse))
+	}))
+	defer mockServer.Close()
+
+	tests := []struct {
+		name              string
+		redactedVariables []string
+		redacted          []string // Values that mustn't appear in the logs.
+		logged            []string // Values that must appear in the logs.
+	}{
+		{name: "default", redactedVariables: nil, redacted: []string{"service:graph:1234"}, logged: []string{"graph@local"}},
+		{name: "custom variables", redactedVariables: []string{"APIKEY", "graph_ref"}, redacted: []string{"service:graph:1234", "graph@local"}},
+		{name: "no variables", redactedVariables: []string{}, logged: []string{"service:graph:1234"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var logs bytes.Buffer
+			testLogger := slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug}))
+
+			mockConfig := config.MergeWithDefaultConfig(config.NewDefaultConfig(), &config.Config{
+				Relay:       config.RelayConfig{RedactedVariables: tt.redactedVariables},
+				Uplink:      config.UplinkConfig{RetryCount: 1},
+				Supergraphs: []config.SupergraphConfig{{GraphRef: "graph@local"}},
+			}, nil, testLogger)
+			logs.Reset()
+			selector := uplink.NewRoundRobinSelector([]string{mockServer.URL})
+			handler := RelayHandler(mockConfig, cache.NewMemoryCache(10), selector, &http.Client{}, testLogger)
+
+			req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(licenseQuery))
+			req.Header.Set("Authorization", "Bearer secret-token")
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+			if rr.Code != http.StatusOK {
+				t.Fatalf("Expected status code %d, got %d", http.StatusOK, rr.Code)
+			}
+
+			output := logs.String()
+			if !strings.Contains(output, "Request body") {
+				t.Fatalf("Expected the request body to be logged, got %s", output)
+			}
+			for _, value := range append(tt.redacted, "secret-token") {
+				if strings.Contains(output, value) {
+					t.Errorf("Expected %q to be redacted from the logs, got %s", value, output)
+				}
+			}
+			for _, value := range tt.logged {
+				if !strings.Contains(output, value) {
+					t.Errorf("Expected %q to be logged, got %s", value, output)
+				}
+			}
+		})
+	}
+}
+
+func TestRedactBody(t *testing.T) {
+	redacted, ok := redactBody([]byte(`{"variables":{"apiKey":"key","graph_ref":"graph@local"},"operationName":"LicenseQuery"}`), []string{"apiKey"})
+	if !ok || string(redacted) != `{"operationName":"LicenseQuery","variables":{"apiKey":"****","graph_ref":"graph@local"}}` {
+		t.Errorf("Expected the apiKey variable to be redacted, got %s", redacted)
+	}
+
+	// Bodies that can't be parsed aren't logged at all
+	if redacted, ok := redactBody([]byte(`apiKey=key`), []string{"apiKey"}); ok {
+		t.Errorf("Expected a body that isn't JSON not to be logged, got %s", redacted)
+	}
+}
+
+func TestDebugHeadersRedacted(t *testing.T) {
+	var logs bytes.Buffer
+	testLogger := slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	redactedHeaders := config.NewDefaultConfig().Relay.RedactedHeaders
+
+	req := httptest.NewRequest(http.MethodPost, "/", nil)
+	req.Header.Set("x-api-key", "service:graph:1234")
+	req.Header.Set("Authorization", "Bearer secret-token")
+	req.Header.Set("X-Apollo-Signature", "sha256=signature")
+	req.Header.Set("apollo-client-name", "router")
+	debugRequestHeaders(testLogger, req, redactedHeaders)
+	debugResponseHeaders(testLogger, http.Header{"Set-Cookie": {"session=cookie"}}, redactedHeaders)
+
+	output := logs.String()
+	for _, value := range []string{"service:graph:1234", "secret-token", "sha256=signature", "session=cookie"} {
+		if strings.Contains(output, value) {
+			t.Errorf("Expected %q to be redacted from the logs, got %s", value, output)
+		}
+	}
+	if !strings.Contains(output, "router") || !strings.Contains(output, "****") {
+		t.Errorf("Expected other headers to be logged and sensitive ones masked, got %s", output)
+	}
+	// Headers are logged as attributes rather than format arguments
+	if !strings.Contains(output, `msg="Request header" name=Apollo-Client-Name value=router`) || !strings.Contains(output, `msg="Response header" name=Set-Cookie`) {
+		t.Errorf("Expected the header names and values as attributes, got %s", output)
+	}
+
+	// Custom lists replace the default one
+	logs.Reset()
+	debugRequestHeaders(testLogger, req, []string{"Apollo-Client-Name"})
+	if output := logs.String(); strings.Contains(output, "router") || !strings.Contains(output, "secret-token") {
+		t.Errorf("Expected only the configured headers to be redacted, got %s", output)
+	}
+}
@@ -0,0 +1,47 @@
+package proxy
+
+import (
+	"sync"
+
+	"apollosolutions/uplink-relay/config"
+)
+
+// retryBudget limits retries to uplink across all requests, like gRPC retry throttling, so a broad outage isn't amplified by every request
+// retrying retryCount times. Each failed request spends a token, each successful request earns back tokenRatio of one,
+// and failed requests are only retried while more than half of the tokens remain.
+type retryBudget struct {
+	mu         sync.Mutex
+	tokens     float64 // Tokens currently in the budget.
+	maxTokens  float64 // Size of the budget, which starts full.
+	tokenRatio float64 // Tokens earned back by each successful request.
+}
+
+// newRetryBudget creates a full retry budget from the configuration, or returns nil when the budget is disabled so every retry is allowed.
+func newRetryBudget(budgetConfig config.RetryBudgetConfig) *retryBudget {
+	if !budgetConfig.Enabled {
+		return nil
+	}
+	maxTokens := float64(budgetConfig.MaxTokens)
+	return &retryBudget{tokens: maxTokens, maxTokens: maxTokens, tokenRatio: budgetConfig.TokenRatio}
+}
+
+// onFailure spends a token for a failed request and reports whether it may be retried.
+func (b *retryBudget) onFailure() bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.tokens = max(b.tokens-1, 0)
+	return b.tokens > b.maxTokens/2
+}
+
+// onSuccess earns back part of a token for a successful request.
+func (b *retryBudget) onSuccess() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.tokens = min(b.tokens+b.tokenRatio, b.maxTokens)
+}
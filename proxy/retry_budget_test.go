@@ -0,0 +1,111 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"apollosolutions/uplink-relay/cache"
+	"apollosolutions/uplink-relay/config"
+	"apollosolutions/uplink-relay/logger"
+	"apollosolutions/uplink-relay/metrics"
+	"apollosolutions/uplink-relay/uplink"
+)
+
+func TestRetryBudget(t *testing.T) {
+	budget := newRetryBudget(config.RetryBudgetConfig{Enabled: true, MaxTokens: 10, TokenRatio: 0.5})
+
+	// Retries are allowed while more than half of the tokens remain
+	for i := 0; i < 4; i++ {
+		if !budget.onFailure() {
+			t.Fatalf("Expected failure %d to be retried", i+1)
+		}
+	}
+	if budget.onFailure() {
+		t.Errorf("Expected retries to be throttled once half of the tokens are spent")
+	}
+
+	// Successes earn tokens back, a fraction at a time
+	budget.onSuccess()
+	if budget.onFailure() {
+		t.Errorf("Expected retries to stay throttled after a single success")
+	}
+	for i := 0; i < 10; i++ {
+		budget.onSuccess()
+	}
+	if !budget.onFailure() {
+		t.Errorf("Expected retries to be allowed once enough requests succeed")
+	}
+
+	// The budget never exceeds its size
+	for i := 0; i < 100; i++ {
+		budget.onSuccess()
+	}
+	if budget.tokens != 10 {
+		t.Errorf("Expected the budget to be capped at 10 tokens, got %v", budget.tokens)
+	}
+
+	// Without a budget, every retry is allowed
+	disabled := newRetryBudget(config.RetryBudgetConfig{MaxTokens: 10, TokenRatio: 0.5})
+	for i := 0; i < 20; i++ {
+		if !disabled.onFailure() {
+			t.Fatalf("Expected every retry to be allowed without a budget")
+		}
+	}
+}
+
+// countingSelector counts the attempts to reach uplink.
+type countingSelector struct {
+	uplink.Selector
+	calls atomic.Int32
+}
+
+func (s *countingSelector) Next() string {
+	s.calls.Add(1)
+	return s.Selector.Next()
+}
+
+func TestRelayHandlerRetryBudget(t *testing.T) {
+	tests := []struct {
+		name     string
+		budget   config.RetryBudgetConfig
+		attempts int32
+	}{
+		// Every request is attempted retryCount+1 times
+		{name: "disabled", budget: config.RetryBudgetConfig{MaxTokens: 4, TokenRatio: 0.5}, attempts: 20},
+		// The first request is retried once, then the budget is exhausted and no other request is retried
+		{name: "enabled", budget: config.RetryBudgetConfig{Enabled: true, MaxTokens: 4, TokenRatio: 0.5}, attempts: 6},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockConfig := config.NewDefaultConfig()
+			mockConfig.Uplink.RetryCount = 3
+			mockConfig.Uplink.RetryBudget = tt.budget
+			mockConfig.Cache.Enabled = false
+			mockConfig.Supergraphs = []config.SupergraphConfig{{GraphRef: "graph@local"}}
+			// The uplink URL can't be parsed, so every attempt fails
+			selector := &countingSelector{Selector: uplink.NewRoundRobinSelector([]string{"http://%zz"})}
+			pFalse := false
+			handler := RelayHandler(mockConfig, cache.NewMemoryCache(100), selector, &http.Client{}, logger.MakeLogger(&pFalse))
+
+			throttled, _ := metrics.RetriesThrottled.Get(uplink.SupergraphQuery)
+			for i := 0; i < 5; i++ {
+				rr := httptest.NewRecorder()
+				handler.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(supergraphQuery)))
+				if rr.Code != http.StatusInternalServerError {
+					t.Fatalf("Expected status code 500, but got %d", rr.Code)
+				}
+			}
+			if calls := selector.calls.Load(); calls != tt.attempts {
+				t.Errorf("Expected %d attempts to reach uplink, got %d", tt.attempts, calls)
+			}
+			if tt.budget.Enabled {
+				if after, _ := metrics.RetriesThrottled.Get(uplink.SupergraphQuery); after-throttled != 5 {
+					t.Errorf("Expected 5 throttled retries to be counted, got %v", after-throttled)
+				}
+			}
+		})
+	}
+}
@@ -2,6 +2,8 @@ package redis
 
 import (
 	"fmt"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/go-redis/redis"
@@ -42,7 +44,10 @@ func (c *RedisCache) Set(key string, content string, duration int) error {
 func (c *RedisCache) DeleteWithPrefix(prefix string) error {
 	// Delete all keys with the given prefix from the cache.
 	// Redis provides no way to delete multiple keys at once, so we have to first get all keys with the given prefix
-	keys := c.client.Keys(prefix + "*").Val()
+	keys, err := c.scanKeys(prefix)
+	if err != nil {
+		return fmt.Errorf("failed to delete keys with prefix %s: %v", prefix, err)
+	}
 
 	// If there are no keys with the given prefix, we can return early
 	if len(keys) == 0 {
@@ -57,6 +62,43 @@ func (c *RedisCache) DeleteWithPrefix(prefix string) error {
 	return nil
 }
 
+func (c *RedisCache) KeysWithPrefix(prefix string) ([]string, error) {
+	keys, err := c.scanKeys(prefix)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list keys with prefix %s: %v", prefix, err)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// scanKeys lists the keys with the given prefix with SCAN, which, unlike KEYS, doesn't block the server while iterating over every key.
+func (c *RedisCache) scanKeys(prefix string) ([]string, error) {
+	var keys []string
+	iter := c.client.Scan(0, globEscaper.Replace(prefix)+"*", scanCount).Iterator()
+	for iter.Next() {
+		keys = append(keys, iter.Val())
+	}
+	return keys, iter.Err()
+}
+
+// scanCount is the number of keys SCAN is hinted to check per call.
+const scanCount = 1000
+
+// globEscaper escapes the characters Redis treats as glob patterns, so prefixes match literally.
+var globEscaper = strings.NewReplacer(`\`, `\\`, "*", `\*`, "?", `\?`, "[", `\[`, "]", `\]`)
+
+func (c *RedisCache) TTL(key string) (int, bool) {
+	// Redis reports -2 for missing keys and -1 for keys without an expiration time
+	ttl, err := c.client.TTL(key).Result()
+	if err != nil || ttl == -2*time.Second {
+		return 0, false
+	}
+	if ttl < 0 {
+		return -1, true
+	}
+	return int(ttl.Seconds()), true
+}
+
 func (c *RedisCache) Name() string {
 	return "Redis"
 }
@@ -1,6 +1,7 @@
 package redis
 
 import (
+	"reflect"
 	"testing"
 
 	"github.com/alicebob/miniredis/v2"
@@ -117,3 +118,89 @@ func TestRedisCacheDeleteWithPrefix(t *testing.T) {
 		t.Errorf("Expected key 'other_key' to be present in Redis cache")
 	}
 }
+
+func TestRedisCacheKeysWithPrefix(t *testing.T) {
+	// Create a test Redis server
+	server := miniredis.RunT(t)
+
+	// Create a Redis client for testing
+	client := redis.NewClient(&redis.Options{
+		Addr: server.Addr(),
+	})
+
+	// Create a RedisCache instance
+	cache := NewRedisCache(client)
+
+	// Set test key-value pairs in Redis
+	for _, key := range []string{"test_key_2", "test_key_1", "other_key"} {
+		if err := client.Set(key, "test_value", 0).Err(); err != nil {
+			t.Fatalf("Failed to set test data in Redis: %v", err)
+		}
+	}
+
+	// Test KeysWithPrefix method
+	keys, err := cache.KeysWithPrefix("test_key")
+	if err != nil {
+		t.Fatalf("Failed to list keys with prefix: %v", err)
+	}
+	if !reflect.DeepEqual(keys, []string{"test_key_1", "test_key_2"}) {
+		t.Errorf("Expected the keys with prefix test_key, got %v", keys)
+	}
+}
+
+func TestRedisCacheTTL(t *testing.T) {
+	server := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{
+		Addr: server.Addr(),
+	})
+	cache := NewRedisCache(client)
+
+	cache.Set("expiring", "content", 60)
+	cache.Set("indefinite", "content", -1)
+
+	if ttl, ok := cache.TTL("expiring"); !ok || ttl != 60 {
+		t.Errorf("Expected a TTL of 60, got %d, %v", ttl, ok)
+	}
+	if ttl, ok := cache.TTL("indefinite"); !ok || ttl != -1 {
+		t.Errorf("Expected keys without an expiration to have a TTL of -1, got %d, %v", ttl, ok)
+	}
+	if _, ok := cache.TTL("missing"); ok {
+		t.Errorf("Expected missing keys not to have a TTL")
+	}
+}
+
+func TestRedisCacheKeysWithPrefixGlob(t *testing.T) {
+	server := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{
+		Addr: server.Addr(),
+	})
+	cache := NewRedisCache(client)
+
+	for _, key := range []string{"pq:graph@current:1", "pq:graph@staging:1", "pq:[g]*:1"} {
+		if err := client.Set(key, "test_value", 0).Err(); err != nil {
+			t.Fatalf("Failed to set test data in Redis: %v", err)
+		}
+	}
+
+	// Glob characters in the prefix match literally
+	for prefix, expected := range map[string][]string{
+		"pq:*":    nil,
+		"pq:[g]*": {"pq:[g]*:1"},
+		"pq:g":    {"pq:graph@current:1", "pq:graph@staging:1"},
+	} {
+		keys, err := cache.KeysWithPrefix(prefix)
+		if err != nil {
+			t.Fatalf("Failed to list keys with prefix: %v", err)
+		}
+		if !reflect.DeepEqual(keys, expected) {
+			t.Errorf("Expected the keys with prefix %s to be %v, got %v", prefix, expected, keys)
+		}
+	}
+
+	if err := cache.DeleteWithPrefix("pq:*"); err != nil {
+		t.Fatalf("Failed to delete keys with prefix: %v", err)
+	}
+	if keys := server.Keys(); len(keys) != 3 {
+		t.Errorf("Expected no key to be deleted, got %v", keys)
+	}
+}
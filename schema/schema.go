@@ -6,9 +6,11 @@ import (
 	"apollosolutions/uplink-relay/internal/util"
 	"apollosolutions/uplink-relay/pinning"
 	"apollosolutions/uplink-relay/uplink"
+	"context"
 	"encoding/json"
 	"fmt"
 	"log/slog"
+	"sync"
 	"time"
 )
 
@@ -18,6 +20,49 @@ type UplinkRouterConfig struct {
 	ID              string  `json:"id"`
 	SupergraphSdl   string  `json:"supergraphSdl,omitempty"`
 	MinDelaySeconds float64 `json:"minDelaySeconds"`
+	Code            string  `json:"code,omitempty"`    // Only exists if __typename is "FetchError"
+	Message         string  `json:"message,omitempty"` // Only exists if __typename is "FetchError"
+}
+
+// routerConfigFields are the routerConfig fields modeled by UplinkRouterConfig.
+var routerConfigFields = []string{"__typename", "id", "supergraphSdl", "minDelaySeconds", "code", "message"}
+
+// ExtraRouterConfigFields returns the routerConfig fields of an uplink response that UplinkRouterConfig doesn't model, or nil if there are none.
+// Routers may request fields the relay doesn't know about, so they're kept to be replayed on cache hits.
+func ExtraRouterConfigFields(body []byte) (json.RawMessage, error) {
+	var response struct {
+		Data struct {
+			RouterConfig map[string]json.RawMessage `json:"routerConfig"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(body, &response); err != nil {
+		return nil, err
+	}
+	fields := response.Data.RouterConfig
+	for _, field := range routerConfigFields {
+		delete(fields, field)
+	}
+	if len(fields) == 0 {
+		return nil, nil
+	}
+	return json.Marshal(fields)
+}
+
+// WithExtraFields returns the routerConfig with the fields from ExtraRouterConfigFields added.
+// The modeled fields take precedence over extra fields of the same name.
+func (c UplinkRouterConfig) WithExtraFields(extraFields json.RawMessage) (map[string]json.RawMessage, error) {
+	fields := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(extraFields, &fields); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal extra routerConfig fields: %w", err)
+	}
+	modeled, err := json.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(modeled, &fields); err != nil {
+		return nil, err
+	}
+	return fields, nil
 }
 
 // SupergraphSdlQueryResponse struct
@@ -27,7 +72,9 @@ type UplinkSupergraphSdlResponse struct {
 	} `json:"data"`
 }
 
-func FetchSchema(userConfig *config.Config, systemCache cache.Cache, logger *slog.Logger, graphRef string) error {
+// FetchSchema fetches the supergraph for the specified graph and caches it.
+// Passing the ID of the cached supergraph as ifAfterId lets uplink respond with Unchanged, in which case the cache is left as-is.
+func FetchSchema(ctx context.Context, userConfig *config.Config, systemCache cache.Cache, logger *slog.Logger, graphRef string, ifAfterId string) error {
 	supergraphConfig, err := config.FindSupergraphConfigFromGraphRef(graphRef, userConfig)
 	if err != nil {
 		return err
@@ -36,11 +83,15 @@ func FetchSchema(userConfig *config.Config, systemCache cache.Cache, logger *slo
 	if supergraphConfig.LaunchID != "" {
 		return pinning.PinLaunchID(userConfig, logger, systemCache, supergraphConfig.LaunchID, graphRef)
 	}
+	apiKey, err := supergraphConfig.APIKey(userConfig.Uplink.DefaultApolloKey)
+	if err != nil {
+		return err
+	}
 
 	variables := map[string]interface{}{
-		"apiKey":    supergraphConfig.ApolloKey,
+		"apiKey":    apiKey,
 		"graph_ref": graphRef,
-		"ifAfterId": "",
+		"ifAfterId": ifAfterId,
 	}
 
 	query := `query SupergraphSdlQuery($apiKey: String!, $graph_ref: String!, $ifAfterId: ID) {
@@ -64,7 +115,7 @@ func FetchSchema(userConfig *config.Config, systemCache cache.Cache, logger *slo
 
 	operationName := "SupergraphSdlQuery"
 
-	resp, err := util.UplinkRequest(userConfig, logger, query, variables, operationName)
+	resp, err := util.UplinkRequest(ctx, userConfig, logger, query, variables, operationName)
 	if err != nil {
 		return err
 	}
@@ -74,32 +125,58 @@ func FetchSchema(userConfig *config.Config, systemCache cache.Cache, logger *slo
 
 	// Decode the response body
 	var response UplinkSupergraphSdlResponse
-	decodeErr := json.Unmarshal(resp, &response)
+	decodeErr := util.DecodeUplinkResponse(resp, &response, userConfig.Uplink.StrictDecode)
 	if decodeErr != nil {
+		logger.Error("Failed to decode uplink response", "graphRef", graphRef, "err", decodeErr)
 		return fmt.Errorf("failed to decode response body: %w", decodeErr)
 	}
-	id, err := time.Parse(time.RFC3339, response.Data.RouterConfig.ID)
-	if err != nil {
-		logger.Error("Failed to parse license expiration", "graphRef", variables["graph_ref"], "err", err)
-		return err
+	// The cached supergraph is still current, so there's nothing to update
+	if response.Data.RouterConfig.Typename == "Unchanged" {
+		logger.Debug("Supergraph unchanged", "graphRef", graphRef, "id", response.Data.RouterConfig.ID)
+		MarkConfirmed(graphRef, time.Now())
+		return nil
 	}
+
+	supergraphID := util.UplinkIDOrNow(logger, response.Data.RouterConfig.ID, "graphRef", graphRef)
 	if userConfig.Cache.Enabled {
 		// Cache the schema
-		return CacheSchema(systemCache, logger, graphRef, response.Data.RouterConfig.SupergraphSdl, id, "", userConfig.Cache.Duration)
+		return CacheSchema(systemCache, logger, graphRef, response.Data.RouterConfig.SupergraphSdl, supergraphID, "", response.Data.RouterConfig.MinDelaySeconds, nil, userConfig.CacheDuration())
 	}
 	// Return the response
 	return nil
 }
 
-func CacheSchema(systemCache cache.Cache, logger *slog.Logger, graphRef string, schema string, id time.Time, ifAfterID string, duration int) error {
+// confirmedAt holds the last time uplink confirmed each graph's cached supergraph was current, keyed by graphRef.
+var confirmedAt sync.Map
+
+// MarkConfirmed records that uplink responded that the graph's cached supergraph was unchanged.
+func MarkConfirmed(graphRef string, now time.Time) {
+	confirmedAt.Store(graphRef, now)
+}
+
+// ConfirmedAt returns the last time uplink responded that the graph's cached supergraph was unchanged.
+// The cached item's LastModified isn't updated then, so this tells an unchanged supergraph apart from one that's no longer being fetched.
+func ConfirmedAt(graphRef string) (time.Time, bool) {
+	confirmed, ok := confirmedAt.Load(graphRef)
+	if !ok {
+		return time.Time{}, false
+	}
+	return confirmed.(time.Time), true
+}
+
+// CacheSchema caches the supergraph for the specified graph, keeping uplink's ID so it can later be sent as ifAfterId,
+// and any routerConfig fields the relay doesn't model so they're replayed to routers.
+func CacheSchema(systemCache cache.Cache, logger *slog.Logger, graphRef string, schema string, id string, ifAfterID string, minDelaySeconds float64, extraFields json.RawMessage, duration int) error {
 	cacheItem := cache.CacheItem{
-		ID:           id.Format(time.RFC3339),
-		Hash:         util.HashString(schema),
-		Expiration:   cache.ExpirationTime(duration),
-		LastModified: time.Now(),
-		Content:      []byte(schema),
+		ID:              id,
+		MinDelaySeconds: minDelaySeconds,
+		ExtraFields:     extraFields,
+		Hash:            util.HashString(schema),
+		Expiration:      cache.ExpirationTime(duration),
+		LastModified:    time.Now(),
+		Content:         []byte(schema),
 	}
-	cacheBytes, err := json.Marshal(cacheItem)
+	cacheBytes, err := cache.EncodeItem(cacheItem)
 	if err != nil {
 		return err
 	}
@@ -107,10 +184,25 @@ func CacheSchema(systemCache cache.Cache, logger *slog.Logger, graphRef string,
 	// Store the schema in the cache
 	cacheKey := cache.MakeCacheKey(graphRef, uplink.SupergraphQuery, map[string]interface{}{"graph_ref": graphRef, "ifAfterId": ifAfterID})
 
-	if cacheItem.Content != nil {
-		cache.UpdateNewest(systemCache, logger, graphRef, uplink.SupergraphQuery, cacheItem)
+	// Keep the default entry, read by the management API and new routers, in line with the entries routers request with their ifAfterId
+	if err := cache.UpdateNewest(systemCache, logger, graphRef, uplink.SupergraphQuery, cacheItem); err != nil {
+		logger.Error("Failed to update the default supergraph cache entry", "graphRef", graphRef, "err", err)
 	}
 
 	logger.Debug("Caching schema", "graphRef", graphRef, "cacheKey", cacheKey)
 	return systemCache.Set(cacheKey, string(cacheBytes[:]), duration)
 }
+
+// CachedSchemaID returns the uplink ID of the latest cached supergraph for the specified graph, or an empty string if none is cached.
+func CachedSchemaID(systemCache cache.Cache, graphRef string) string {
+	cacheBytes, ok := systemCache.Get(cache.DefaultCacheKey(graphRef, uplink.SupergraphQuery))
+	if !ok {
+		return ""
+	}
+
+	var cacheItem cache.CacheItem
+	if err := cache.DecodeItem(cacheBytes, &cacheItem); err != nil || len(cacheItem.Content) == 0 {
+		return ""
+	}
+	return cacheItem.ID
+}
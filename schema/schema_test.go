@@ -3,10 +3,15 @@ package schema
 import (
 	"apollosolutions/uplink-relay/cache"
 	"apollosolutions/uplink-relay/config"
+	"apollosolutions/uplink-relay/internal/util"
 	"apollosolutions/uplink-relay/logger"
+	"context"
+	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
 	"testing"
+	"time"
 )
 
 func TestFetchSchema(t *testing.T) {
@@ -33,10 +38,127 @@ func TestFetchSchema(t *testing.T) {
 	graphRef := "example-graph@variant"
 
 	// Call the FetchSchema function
-	err := FetchSchema(userConfig, systemCache, logger, graphRef)
+	err := FetchSchema(context.Background(), userConfig, systemCache, logger, graphRef, "")
 
 	// Check if an error occurred
 	if err != nil {
 		t.Errorf("FetchSchema returned an error: %v", err)
 	}
 }
+
+func TestFetchSchemaStrictDecode(t *testing.T) {
+	// Mock uplink, adding a field the relay doesn't expect
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"data":{"routerConfig":{"__typename":"RouterConfigResult","id":"2024-08-05T19:53:29.140664000Z","supergraphSdl":"schema","minDelaySeconds":30,"newField":true}}}`))
+	}))
+	defer server.Close()
+
+	userConfig := config.NewDefaultConfig()
+	userConfig.Uplink.URLs = []string{server.URL}
+	userConfig.Supergraphs = []config.SupergraphConfig{{GraphRef: "example-graph@variant", ApolloKey: "1234"}}
+	pFalse := false
+	logger := logger.MakeLogger(&pFalse)
+
+	// Lenient decoding, the default, ignores the unexpected field
+	if err := FetchSchema(context.Background(), userConfig, cache.NewMemoryCache(10), logger, "example-graph@variant", ""); err != nil {
+		t.Errorf("Expected no error with lenient decoding, got %v", err)
+	}
+
+	userConfig.Uplink.StrictDecode = true
+	if err := FetchSchema(context.Background(), userConfig, cache.NewMemoryCache(10), logger, "example-graph@variant", ""); err == nil {
+		t.Errorf("Expected an error with strict decoding")
+	}
+}
+
+func TestFetchSchemaDefaultAPIKey(t *testing.T) {
+	receivedKeys := map[string]interface{}{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request util.UplinkRelayRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			t.Errorf("Failed to decode request: %v", err)
+			return
+		}
+		receivedKeys[request.Variables["graph_ref"].(string)] = request.Variables["apiKey"]
+		w.Write([]byte(`{"data":{"routerConfig":{"__typename":"RouterConfigResult","id":"2024-08-05T19:53:29.140664000Z","supergraphSdl":"schema","minDelaySeconds":30}}}`))
+	}))
+	defer server.Close()
+
+	userConfig := config.NewDefaultConfig()
+	userConfig.Uplink.URLs = []string{server.URL}
+	userConfig.Uplink.RetryCount = 1
+	userConfig.Uplink.DefaultApolloKey = "default-key"
+	userConfig.Supergraphs = []config.SupergraphConfig{
+		{GraphRef: "shared@variant"},
+		{GraphRef: "own@variant", ApolloKey: "own-key"},
+	}
+
+	systemCache := cache.NewMemoryCache(10)
+	for _, supergraph := range userConfig.Supergraphs {
+		if err := FetchSchema(context.Background(), userConfig, systemCache, logger.MakeLogger(nil), supergraph.GraphRef, ""); err != nil {
+			t.Fatalf("FetchSchema returned an error for %s: %v", supergraph.GraphRef, err)
+		}
+	}
+
+	if receivedKeys["shared@variant"] != "default-key" {
+		t.Errorf("Expected the default API key for a graph without one, got %v", receivedKeys["shared@variant"])
+	}
+	if receivedKeys["own@variant"] != "own-key" {
+		t.Errorf("Expected the graph's own API key to override the default, got %v", receivedKeys["own@variant"])
+	}
+}
+
+func TestExtraRouterConfigFields(t *testing.T) {
+	body := []byte(`{"data":{"routerConfig":{"__typename":"RouterConfigResult","id":"1","supergraphSdl":"sdl","minDelaySeconds":30,"comments":["a"],"identity":{"launchId":"1234"}}}}`)
+	extraFields, err := ExtraRouterConfigFields(body)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if string(extraFields) != `{"comments":["a"],"identity":{"launchId":"1234"}}` {
+		t.Errorf("Expected only the unmodeled fields, got %s", extraFields)
+	}
+
+	// Responses with only the modeled fields have no extra fields
+	extraFields, err = ExtraRouterConfigFields([]byte(`{"data":{"routerConfig":{"__typename":"Unchanged","id":"1","minDelaySeconds":30}}}`))
+	if err != nil || extraFields != nil {
+		t.Errorf("Expected no extra fields, got %s, %v", extraFields, err)
+	}
+
+	// The modeled fields take precedence when the fields are replayed
+	routerConfig := UplinkRouterConfig{Typename: "RouterConfigResult", ID: "2", SupergraphSdl: "sdl", MinDelaySeconds: 30}
+	fields, err := routerConfig.WithExtraFields(json.RawMessage(`{"comments":["a"],"id":"stale"}`))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected := map[string]json.RawMessage{
+		"__typename":      json.RawMessage(`"RouterConfigResult"`),
+		"id":              json.RawMessage(`"2"`),
+		"supergraphSdl":   json.RawMessage(`"sdl"`),
+		"minDelaySeconds": json.RawMessage(`30`),
+		"comments":        json.RawMessage(`["a"]`),
+	}
+	if !reflect.DeepEqual(fields, expected) {
+		t.Errorf("Expected %s, got %s", expected, fields)
+	}
+}
+
+func TestFetchSchemaUnchangedConfirms(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"data":{"routerConfig":{"__typename":"Unchanged","id":"2024-08-05T19:53:29.140664000Z","minDelaySeconds":30}}}`))
+	}))
+	defer server.Close()
+
+	userConfig := config.NewDefaultConfig()
+	userConfig.Uplink.URLs = []string{server.URL}
+	userConfig.Supergraphs = []config.SupergraphConfig{{GraphRef: "unchanged@variant", ApolloKey: "1234"}}
+
+	if _, ok := ConfirmedAt("unchanged@variant"); ok {
+		t.Fatalf("Expected the supergraph not to be confirmed before fetching it")
+	}
+	before := time.Now()
+	if err := FetchSchema(context.Background(), userConfig, cache.NewMemoryCache(10), logger.MakeLogger(nil), "unchanged@variant", "2024-08-05T19:53:29.140664000Z"); err != nil {
+		t.Fatalf("FetchSchema returned an error: %v", err)
+	}
+	if confirmed, ok := ConfirmedAt("unchanged@variant"); !ok || confirmed.Before(before) {
+		t.Errorf("Expected the supergraph to be confirmed after an Unchanged response, got %v", confirmed)
+	}
+}
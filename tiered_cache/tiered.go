@@ -2,59 +2,118 @@ package tiered_cache
 
 import (
 	"apollosolutions/uplink-relay/cache"
+	"errors"
+	"fmt"
 	"log/slog"
+	"sort"
 )
 
 const PERMISSIONS = 0644
 
+// TierMode is the access mode of a cache in the tiered cache.
+type TierMode string
+
+const (
+	TierReadWrite TierMode = "readWrite" // Content is looked up in the cache and written to it.
+	TierReadOnly  TierMode = "readOnly"  // Content is looked up in the cache, but never written to or deleted from it.
+	TierWriteOnly TierMode = "writeOnly" // Content is written to and deleted from the cache, but never looked up in it.
+)
+
+// Tier is a cache of the tiered cache with its access mode.
+type Tier struct {
+	Cache cache.Cache
+	Mode  TierMode
+}
+
 type TieredCache struct {
 	caches   []cache.Cache
 	logger   *slog.Logger
 	duration int
+	modes    []TierMode // Access mode of each cache; caches are read and written if nil.
 }
 
+// NewTieredCache creates a tiered cache looking up content in the caches in the order they're provided, and writing it to all of them.
 func NewTieredCache(caches []cache.Cache, logger *slog.Logger, duration int) (*TieredCache, error) {
-	return &TieredCache{caches, logger, duration}, nil
+	return &TieredCache{caches: caches, logger: logger, duration: duration}, nil
+}
+
+// NewTieredCacheWithTiers creates a tiered cache looking up content in the readable tiers in the order they're provided, and writing it to the writable ones.
+func NewTieredCacheWithTiers(tiers []Tier, logger *slog.Logger, duration int) (*TieredCache, error) {
+	caches := make([]cache.Cache, len(tiers))
+	modes := make([]TierMode, len(tiers))
+	for i, tier := range tiers {
+		switch tier.Mode {
+		case TierReadWrite, TierReadOnly, TierWriteOnly:
+		default:
+			return nil, fmt.Errorf("invalid mode %q for the %s cache tier", tier.Mode, tier.Cache.Name())
+		}
+		caches[i] = tier.Cache
+		modes[i] = tier.Mode
+	}
+	return &TieredCache{caches: caches, logger: logger, duration: duration, modes: modes}, nil
+}
+
+// readable returns whether content is looked up in the cache at the given index.
+func (c *TieredCache) readable(i int) bool {
+	return c.modes == nil || c.modes[i] != TierWriteOnly
+}
+
+// writable returns whether content is written to and deleted from the cache at the given index.
+func (c *TieredCache) writable(i int) bool {
+	return c.modes == nil || c.modes[i] != TierReadOnly
 }
 
 func (c *TieredCache) Get(key string) ([]byte, bool) {
-	/// Attempt to get the content from each cache in the order they were provided
-	/// If the content is found in any cache, return it
+	/// Attempt to get the content from each readable cache in the order they were provided
+	/// If the content is found in any cache, return it, backfilling the writable caches that missed it in the background
 	/// If the content is not found in any cache, return false
 	missedCaches := []cache.Cache{}
-	var updateContent []byte
-	for index, cache := range c.caches {
+	for i, cache := range c.caches {
+		if !c.readable(i) {
+			continue
+		}
 		content, ok := cache.Get(key)
 		c.logger.Debug("Got content from cache", "content", content, "ok", ok, "cache", cache.Name())
 		if ok {
-			if index > 0 {
-				updateContent = content
+			if len(missedCaches) > 0 && len(content) > 0 {
+				go c.backfill(cache, missedCaches, key, content)
 			}
 			return content, true
-		} else {
+		}
+		if c.writable(i) {
 			missedCaches = append(missedCaches, cache)
 		}
 	}
-	if len(missedCaches) > 0 && len(updateContent) > 0 {
-		go func() {
-			for _, cache := range missedCaches {
-				c.logger.Debug("Setting content into missed cache", "cache", cache, "cache", cache.Name())
-				err := cache.Set(key, string(updateContent), c.duration)
-				if err != nil {
-					c.logger.Error("Failed to set content in cache", "err", err, "cache", cache.Name())
-				}
-			}
-		}()
-	}
 	return nil, false
 }
 
+// backfill sets the content into the caches that missed it, for the time left on the entry of the cache that was hit, so backfilled entries don't outlive it.
+// The time is taken from the hit cache rather than the content, which may be compressed or not be a cache item, such as persisted query chunks.
+func (c *TieredCache) backfill(hitCache cache.Cache, missedCaches []cache.Cache, key string, content []byte) {
+	duration, ok := hitCache.TTL(key)
+	if !ok || duration == 0 {
+		c.logger.Debug("Not backfilling expired content", "key", key)
+		return
+	}
+	for _, cache := range missedCaches {
+		c.logger.Debug("Setting content into missed cache", "cache", cache.Name(), "duration", duration)
+		err := cache.Set(key, string(content), duration)
+		if err != nil {
+			c.logger.Error("Failed to set content in cache", "err", err, "cache", cache.Name())
+		}
+	}
+}
+
 func (c *TieredCache) Set(key string, content string, duration int) error {
 	/// Set the content in each cache in the order they were provided
 	/// If an error occurs while setting the content in any cache, return the error after trying each cache
 	/// This ensures that the content is set in all caches if possible instead of stopping at the first error
+	/// Read-only caches are skipped
 	var err error
-	for _, cache := range c.caches {
+	for i, cache := range c.caches {
+		if !c.writable(i) {
+			continue
+		}
 		err = cache.Set(key, content, duration)
 		if err != nil {
 			c.logger.Error("Failed to set content in cache", "err", err, "cache", cache.Name())
@@ -64,12 +123,58 @@ func (c *TieredCache) Set(key string, content string, duration int) error {
 }
 
 func (c *TieredCache) DeleteWithPrefix(prefix string) error {
+	/// Delete the content from each writable cache, returning the errors of every cache that failed after trying each cache
+	var errs []error
+	for i, cache := range c.caches {
+		if !c.writable(i) {
+			continue
+		}
+		if err := cache.DeleteWithPrefix(prefix); err != nil {
+			c.logger.Error("Failed to delete content from cache", "err", err, "cache", cache.Name())
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (c *TieredCache) KeysWithPrefix(prefix string) ([]string, error) {
+	/// List the keys in each readable cache, returning the union of all keys
+	/// If an error occurs while listing the keys of any cache, return the error after trying each cache
 	var err error
-	for _, cache := range c.caches {
-		err = cache.DeleteWithPrefix(prefix)
-		c.logger.Error("Failed to delete content from cache", "err", err, "cache", cache.Name())
+	seen := map[string]bool{}
+	keys := make([]string, 0)
+	for i, cache := range c.caches {
+		if !c.readable(i) {
+			continue
+		}
+		cacheKeys, cacheErr := cache.KeysWithPrefix(prefix)
+		if cacheErr != nil {
+			c.logger.Error("Failed to list keys in cache", "err", cacheErr, "cache", cache.Name())
+			err = cacheErr
+			continue
+		}
+		for _, key := range cacheKeys {
+			if !seen[key] {
+				seen[key] = true
+				keys = append(keys, key)
+			}
+		}
 	}
-	return err
+	sort.Strings(keys)
+	return keys, err
+}
+
+func (c *TieredCache) TTL(key string) (int, bool) {
+	/// Return the time left on the item in the first readable cache that has it, like Get
+	for i, cache := range c.caches {
+		if !c.readable(i) {
+			continue
+		}
+		if ttl, ok := cache.TTL(key); ok {
+			return ttl, true
+		}
+	}
+	return 0, false
 }
 
 func (c *TieredCache) Name() string {
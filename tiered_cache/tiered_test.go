@@ -4,7 +4,14 @@ import (
 	"apollosolutions/uplink-relay/cache"
 	"apollosolutions/uplink-relay/logger"
 	apolloredis "apollosolutions/uplink-relay/redis"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/alicebob/miniredis/v2"
 	"github.com/go-redis/redis"
@@ -78,6 +85,138 @@ func TestTieredCache_Get(t *testing.T) {
 	}
 }
 
+// recordingCache records the duration of each item set into it.
+type recordingCache struct {
+	*cache.MemoryCache
+	durations chan int
+}
+
+func (c *recordingCache) Set(key string, content string, duration int) error {
+	c.durations <- duration
+	return c.MemoryCache.Set(key, content, duration)
+}
+
+func TestTieredCache_GetBackfill(t *testing.T) {
+	logger := logger.MakeLogger(nil)
+	encode := func(expiration time.Time) string {
+		content, _ := json.Marshal(cache.CacheItem{Content: []byte("schema"), Expiration: expiration})
+		return string(content)
+	}
+
+	tests := []struct {
+		name        string
+		content     string
+		duration    int
+		minDuration int
+		maxDuration int
+	}{
+		{name: "short-lived item", content: encode(time.Now().Add(30 * time.Second)), duration: 30, minDuration: 29, maxDuration: 30},
+		{name: "indefinite item", content: encode(cache.IndefiniteTimestamp), duration: -1, minDuration: -1, maxDuration: -1},
+		{name: "raw content", content: "chunk", duration: 3600, minDuration: 3599, maxDuration: 3600},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lagging := &recordingCache{MemoryCache: cache.NewMemoryCache(100), durations: make(chan int, 1)}
+			hit := cache.NewMemoryCache(100)
+			hit.Set("key", tt.content, tt.duration)
+			tc, _ := NewTieredCache([]cache.Cache{lagging, hit}, logger, 3600)
+
+			if content, found := tc.Get("key"); !found || string(content) != tt.content {
+				t.Fatalf("Expected the content of the lower tier, got %s", content)
+			}
+			select {
+			case duration := <-lagging.durations:
+				if duration < tt.minDuration || duration > tt.maxDuration {
+					t.Errorf("Expected the backfill duration to be between %d and %d, got %d", tt.minDuration, tt.maxDuration, duration)
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("Expected the missed tier to be backfilled")
+			}
+			if _, found := lagging.Get("key"); !found {
+				t.Errorf("Expected the backfilled content in the missed tier")
+			}
+		})
+	}
+}
+
+func TestTieredCache_GetBackfillCompressed(t *testing.T) {
+	logger := logger.MakeLogger(nil)
+	lagging := &recordingCache{MemoryCache: cache.NewMemoryCache(100), durations: make(chan int, 1)}
+	hit := cache.NewMemoryCache(100)
+	tc, _ := NewTieredCache([]cache.Cache{lagging, hit}, logger, 3600)
+	compressed := cache.NewCompressedCache(tc, 10)
+
+	// Large items reach the tiers compressed, so their expiration can't be read from the content
+	content, _ := json.Marshal(cache.CacheItem{Content: []byte(strings.Repeat("type Query { field: String } ", 100)), Expiration: time.Now().Add(30 * time.Second)})
+	if err := cache.NewCompressedCache(hit, 10).Set("key", string(content), 30); err != nil {
+		t.Fatalf("Failed to set content: %v", err)
+	}
+	if got, found := compressed.Get("key"); !found || !bytes.Equal(got, content) {
+		t.Fatalf("Expected the content of the lower tier, got %s", got)
+	}
+	select {
+	case duration := <-lagging.durations:
+		if duration < 29 || duration > 30 {
+			t.Errorf("Expected the compressed item to be backfilled for the rest of its lifetime, got %d", duration)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Expected the missed tier to be backfilled")
+	}
+}
+
+func TestTieredCache_Tiers(t *testing.T) {
+	logger := logger.MakeLogger(nil)
+	memory := cache.NewMemoryCache(100)
+	filesystem := cache.NewMemoryCache(100)
+	redis := cache.NewMemoryCache(100)
+	memory.Set("key", "memory", 60)
+	filesystem.Set("key", "filesystem", 60)
+	redis.Set("key", "redis", 60)
+
+	// The configured lookup order is honored, whatever the order the caches were created in
+	tc, err := NewTieredCacheWithTiers([]Tier{{filesystem, TierReadWrite}, {redis, TierReadOnly}, {memory, TierWriteOnly}}, logger, 60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if content, found := tc.Get("key"); !found || string(content) != "filesystem" {
+		t.Errorf("Expected the content of the first tier, got %s", content)
+	}
+	filesystem.DeleteWithPrefix("")
+	filesystem.Set("other", "filesystem", 60)
+	if content, found := tc.Get("key"); !found || string(content) != "redis" {
+		t.Errorf("Expected the content of the second tier, got %s", content)
+	}
+
+	// Write-only tiers aren't looked up, even when they have the content
+	redis.DeleteWithPrefix("")
+	if content, found := tc.Get("key"); found {
+		t.Errorf("Expected the write-only tier not to be looked up, got %s", content)
+	}
+	if keys, _ := tc.KeysWithPrefix(""); !reflect.DeepEqual(keys, []string{"other"}) {
+		t.Errorf("Expected only the keys of readable tiers, got %v", keys)
+	}
+
+	// Read-only tiers aren't written to or deleted from
+	tc.Set("new", "content", 60)
+	if _, found := redis.Get("new"); found {
+		t.Errorf("Expected the read-only tier not to be written to")
+	}
+	for _, written := range []cache.Cache{filesystem, memory} {
+		if content, found := written.Get("new"); !found || string(content) != "content" {
+			t.Errorf("Expected the writable tiers to be written to, got %s", content)
+		}
+	}
+	redis.Set("other", "redis", 60)
+	tc.DeleteWithPrefix("ot")
+	if _, found := redis.Get("other"); !found {
+		t.Errorf("Expected the read-only tier not to be deleted from")
+	}
+
+	if _, err := NewTieredCacheWithTiers([]Tier{{memory, "readwrite"}}, logger, 60); err == nil {
+		t.Errorf("Expected an error for an invalid mode")
+	}
+}
+
 func TestTieredCache_Set(t *testing.T) {
 	// Create a mock logger
 	logger := logger.MakeLogger(nil)
@@ -128,6 +267,75 @@ func TestTieredCache_DeleteWithPrefix(t *testing.T) {
 	}
 }
 
+// failingCache fails to delete any content.
+type failingCache struct {
+	*cache.MemoryCache
+	err error
+}
+
+func (c *failingCache) DeleteWithPrefix(prefix string) error {
+	return c.err
+}
+
+func TestTieredCache_DeleteWithPrefixErrors(t *testing.T) {
+	var logs bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&logs, nil))
+
+	// No error is logged when every tier deletes the content
+	cache1 := cache.NewMemoryCache(100)
+	cache2 := cache.NewMemoryCache(100)
+	tc, _ := NewTieredCache([]cache.Cache{cache1, cache2}, logger, 60)
+	if err := tc.DeleteWithPrefix("prefix"); err != nil {
+		t.Errorf("Failed to delete values: %v", err)
+	}
+	if strings.Contains(logs.String(), "level=ERROR") {
+		t.Errorf("Expected no error to be logged, got %s", logs.String())
+	}
+
+	// The errors of every failing tier are logged and returned, and the other tiers are still deleted from
+	errFirst := errors.New("first tier down")
+	errLast := errors.New("last tier down")
+	cache2.Set("prefix_key", "value", 60)
+	tc, _ = NewTieredCache([]cache.Cache{&failingCache{cache.NewMemoryCache(100), errFirst}, cache2, &failingCache{cache.NewMemoryCache(100), errLast}}, logger, 60)
+	err := tc.DeleteWithPrefix("prefix")
+	if !errors.Is(err, errFirst) || !errors.Is(err, errLast) {
+		t.Errorf("Expected the errors of both failing tiers, got %v", err)
+	}
+	if count := strings.Count(logs.String(), "level=ERROR"); count != 2 {
+		t.Errorf("Expected 2 errors to be logged, got %d", count)
+	}
+	if _, found := cache2.Get("prefix_key"); found {
+		t.Errorf("Expected 'prefix_key' to be deleted from the healthy tier")
+	}
+}
+
+func TestTieredCache_KeysWithPrefix(t *testing.T) {
+	// Create a mock logger
+	logger := logger.MakeLogger(nil)
+
+	// Create mock caches
+	cache1 := cache.NewMemoryCache(100)
+	cache2 := cache.NewMemoryCache(100)
+
+	// Create a new TieredCache
+	tc, _ := NewTieredCache([]cache.Cache{cache1, cache2}, logger, 60)
+
+	// Set values in the caches, with one key in both
+	cache1.Set("prefix1_key1", "value1", 60)
+	cache2.Set("prefix1_key1", "value1", 60)
+	cache2.Set("prefix1_key2", "value2", 60)
+	cache2.Set("prefix2_key", "value3", 60)
+
+	// Verify that the keys of all caches are listed once
+	keys, err := tc.KeysWithPrefix("prefix1_")
+	if err != nil {
+		t.Errorf("Failed to list keys: %v", err)
+	}
+	if !reflect.DeepEqual(keys, []string{"prefix1_key1", "prefix1_key2"}) {
+		t.Errorf("Expected the keys with prefix1_, got %v", keys)
+	}
+}
+
 func TestTieredCache_Name(t *testing.T) {
 	// Create a mock logger
 	logger := logger.MakeLogger(nil)
@@ -1,6 +1,9 @@
 package uplink
 
-import "sync"
+import (
+	"math/rand/v2"
+	"sync"
+)
 
 // operation name mappings
 const (
@@ -9,6 +12,37 @@ const (
 	PersistedQueriesQuery = "PersistedQueriesManifestQuery"
 )
 
+// Operations lists the uplink operations handled by the relay.
+var Operations = []string{SupergraphQuery, LicenseQuery, PersistedQueriesQuery}
+
+// selection strategies
+const (
+	RoundRobinStrategy  = "roundrobin"
+	RandomStrategy      = "random"
+	LeastLoadedStrategy = "leastloaded"
+)
+
+// Strategies lists the supported uplink selection strategies.
+var Strategies = []string{RoundRobinStrategy, RandomStrategy, LeastLoadedStrategy}
+
+// Selector picks the uplink URL to use for a proxied request.
+type Selector interface {
+	Next() string       // Next returns the URL to use for the next request.
+	Release(url string) // Release marks a request to the given URL, as returned by Next, as completed.
+}
+
+// NewSelector initializes a Selector for the given strategy, defaulting to round-robin.
+func NewSelector(strategy string, urls []string) Selector {
+	switch strategy {
+	case RandomStrategy:
+		return NewRandomSelector(urls)
+	case LeastLoadedStrategy:
+		return NewLeastLoadedSelector(urls)
+	default:
+		return NewRoundRobinSelector(urls)
+	}
+}
+
 // RoundRobinSelector manages rotating through uplink URLs in a round-robin fashion.
 type RoundRobinSelector struct {
 	urls      []string   // List of URLs to cycle through.
@@ -25,9 +59,11 @@ func NewRoundRobinSelector(urls []string) *RoundRobinSelector {
 }
 
 // Next returns the next URL in the round-robin sequence.
+// It is safe to call from concurrent requests as nextIndex is guarded by the mutex.
 func (rr *RoundRobinSelector) Next() string {
 	rr.mu.Lock()
 	defer rr.mu.Unlock()
+
 	if len(rr.urls) == 0 {
 		return ""
 	}
@@ -35,3 +71,82 @@ func (rr *RoundRobinSelector) Next() string {
 	rr.nextIndex = (rr.nextIndex + 1) % len(rr.urls)
 	return url
 }
+
+// Release is a no-op as round-robin selection doesn't track in-flight requests.
+func (rr *RoundRobinSelector) Release(url string) {}
+
+// RandomSelector picks a uniformly random uplink URL.
+type RandomSelector struct {
+	urls []string // List of URLs to pick from.
+}
+
+// NewRandomSelector initializes a new RandomSelector with the given URLs.
+func NewRandomSelector(urls []string) *RandomSelector {
+	return &RandomSelector{urls: urls}
+}
+
+// Next returns a random URL.
+func (r *RandomSelector) Next() string {
+	if len(r.urls) == 0 {
+		return ""
+	}
+	return r.urls[rand.IntN(len(r.urls))]
+}
+
+// Release is a no-op as random selection doesn't track in-flight requests.
+func (r *RandomSelector) Release(url string) {}
+
+// LeastLoadedSelector picks the uplink URL with the fewest in-flight requests.
+type LeastLoadedSelector struct {
+	urls      []string       // List of URLs to pick from.
+	mu        sync.Mutex     // Mutex for thread-safe operation.
+	inFlight  map[string]int // Number of in-flight requests per URL.
+	nextIndex int            // Index to start searching from, so ties are broken in a round-robin fashion.
+}
+
+// NewLeastLoadedSelector initializes a new LeastLoadedSelector with the given URLs.
+func NewLeastLoadedSelector(urls []string) *LeastLoadedSelector {
+	return &LeastLoadedSelector{
+		urls:     urls,
+		inFlight: make(map[string]int),
+	}
+}
+
+// Next returns the URL with the fewest in-flight requests and counts the request against it until Release is called.
+func (ll *LeastLoadedSelector) Next() string {
+	ll.mu.Lock()
+	defer ll.mu.Unlock()
+
+	if len(ll.urls) == 0 {
+		return ""
+	}
+	best := ll.nextIndex
+	for i := 1; i < len(ll.urls); i++ {
+		index := (ll.nextIndex + i) % len(ll.urls)
+		if ll.inFlight[ll.urls[index]] < ll.inFlight[ll.urls[best]] {
+			best = index
+		}
+	}
+	ll.nextIndex = (best + 1) % len(ll.urls)
+	url := ll.urls[best]
+	ll.inFlight[url]++
+	return url
+}
+
+// Release decrements the in-flight counter for the given URL.
+func (ll *LeastLoadedSelector) Release(url string) {
+	ll.mu.Lock()
+	defer ll.mu.Unlock()
+
+	if ll.inFlight[url] > 0 {
+		ll.inFlight[url]--
+	}
+}
+
+// InFlight returns the number of in-flight requests for the given URL.
+func (ll *LeastLoadedSelector) InFlight(url string) int {
+	ll.mu.Lock()
+	defer ll.mu.Unlock()
+
+	return ll.inFlight[url]
+}
@@ -1,6 +1,10 @@
 package uplink
 
-import "testing"
+import (
+	"sync"
+	"testing"
+	"time"
+)
 
 var urls = []string{"http://example.com", "http://example.org", "http://example.net"}
 
@@ -39,3 +43,146 @@ func TestRoundRobinSelectorEmpty(t *testing.T) {
 		t.Errorf("Expected empty URL, but got %s", next)
 	}
 }
+
+func TestRoundRobinSelectorConcurrent(t *testing.T) {
+	rr := NewRoundRobinSelector(urls)
+
+	// Run with -race to validate Next is safe to call from concurrent requests
+	goroutines := 50
+	callsPerGoroutine := 30
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	counts := map[string]int{}
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < callsPerGoroutine; j++ {
+				url := rr.Next()
+				mu.Lock()
+				counts[url]++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Every URL should be selected an equal number of times
+	expected := goroutines * callsPerGoroutine / len(urls)
+	for _, url := range urls {
+		if counts[url] != expected {
+			t.Errorf("Expected URL %s to be selected %d times, but got %d", url, expected, counts[url])
+		}
+	}
+}
+
+func TestNewSelector(t *testing.T) {
+	if _, ok := NewSelector(RoundRobinStrategy, urls).(*RoundRobinSelector); !ok {
+		t.Errorf("Expected a RoundRobinSelector for the %s strategy", RoundRobinStrategy)
+	}
+	if _, ok := NewSelector(RandomStrategy, urls).(*RandomSelector); !ok {
+		t.Errorf("Expected a RandomSelector for the %s strategy", RandomStrategy)
+	}
+	if _, ok := NewSelector(LeastLoadedStrategy, urls).(*LeastLoadedSelector); !ok {
+		t.Errorf("Expected a LeastLoadedSelector for the %s strategy", LeastLoadedStrategy)
+	}
+	if _, ok := NewSelector("", urls).(*RoundRobinSelector); !ok {
+		t.Errorf("Expected a RoundRobinSelector when no strategy is set")
+	}
+}
+
+func TestRandomSelectorNext(t *testing.T) {
+	r := NewRandomSelector(urls)
+	for i := 0; i < 10; i++ {
+		next := r.Next()
+		found := false
+		for _, url := range urls {
+			if url == next {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("Expected a configured URL, but got %s", next)
+		}
+	}
+
+	if next := NewRandomSelector([]string{}).Next(); next != "" {
+		t.Errorf("Expected empty URL, but got %s", next)
+	}
+}
+
+func TestLeastLoadedSelectorNext(t *testing.T) {
+	ll := NewLeastLoadedSelector(urls)
+
+	// With no requests in flight, ties are broken in a round-robin fashion
+	first := ll.Next()
+	second := ll.Next()
+	if first == second {
+		t.Errorf("Expected different URLs when there's no load, but got %s twice", first)
+	}
+
+	// The third URL is now the only one without an in-flight request
+	if next := ll.Next(); next != urls[2] {
+		t.Errorf("Expected %s, but got %s", urls[2], next)
+	}
+
+	ll.Release(first)
+	if ll.InFlight(first) != 0 {
+		t.Errorf("Expected no in-flight requests for %s, but got %d", first, ll.InFlight(first))
+	}
+	if next := ll.Next(); next != first {
+		t.Errorf("Expected released URL %s, but got %s", first, next)
+	}
+
+	// Releasing more than acquired shouldn't go negative
+	ll.Release(second)
+	ll.Release(second)
+	if ll.InFlight(second) != 0 {
+		t.Errorf("Expected no in-flight requests for %s, but got %d", second, ll.InFlight(second))
+	}
+}
+
+func TestLeastLoadedSelectorUnevenLatency(t *testing.T) {
+	fast := "http://fast.example.com"
+	slow := "http://slow.example.com"
+	latency := map[string]time.Duration{
+		fast: time.Millisecond,
+		slow: 20 * time.Millisecond,
+	}
+
+	// Simulate concurrent workers sending requests that take longer on the slow uplink
+	run := func(selector Selector) map[string]int {
+		var wg sync.WaitGroup
+		var mu sync.Mutex
+		counts := map[string]int{}
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				deadline := time.Now().Add(200 * time.Millisecond)
+				for time.Now().Before(deadline) {
+					url := selector.Next()
+					mu.Lock()
+					counts[url]++
+					mu.Unlock()
+					time.Sleep(latency[url])
+					selector.Release(url)
+				}
+			}()
+		}
+		wg.Wait()
+		return counts
+	}
+
+	leastLoaded := run(NewLeastLoadedSelector([]string{fast, slow}))
+	roundRobin := run(NewRoundRobinSelector([]string{fast, slow}))
+
+	leastLoadedShare := float64(leastLoaded[fast]) / float64(leastLoaded[fast]+leastLoaded[slow])
+	roundRobinShare := float64(roundRobin[fast]) / float64(roundRobin[fast]+roundRobin[slow])
+	if leastLoadedShare <= roundRobinShare {
+		t.Errorf("Expected least loaded to send a larger share to the fast uplink, got %.2f vs round-robin %.2f", leastLoadedShare, roundRobinShare)
+	}
+	if leastLoaded[fast] <= leastLoaded[slow] {
+		t.Errorf("Expected the fast uplink to receive more requests, got fast=%d slow=%d", leastLoaded[fast], leastLoaded[slow])
+	}
+}
@@ -0,0 +1,41 @@
+// Package version exposes the build information of the relay, set at build time via ldflags, e.g.
+//
+//	go build -ldflags "-X apollosolutions/uplink-relay/version.Version=v1.0.0 -X apollosolutions/uplink-relay/version.Commit=$(git rev-parse HEAD)"
+package version
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+var (
+	Version   = "dev"     // Version of the relay, e.g. a release tag.
+	Commit    = "unknown" // Commit the relay was built from.
+	BuildDate = "unknown" // Date the relay was built.
+)
+
+// Info describes the build of the running relay.
+type Info struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildDate string `json:"buildDate"`
+}
+
+// Get returns the build information of the running relay.
+func Get() Info {
+	return Info{Version: Version, Commit: Commit, BuildDate: BuildDate}
+}
+
+// String returns the build information in a human-readable format.
+func (i Info) String() string {
+	return fmt.Sprintf("uplink-relay %s (commit %s, built %s)", i.Version, i.Commit, i.BuildDate)
+}
+
+// Handler serves the build information as JSON.
+func Handler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(Get())
+	}
+}
@@ -0,0 +1,36 @@
+package version
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHandler(t *testing.T) {
+	Version, Commit, BuildDate = "v1.2.3", "abc123", "2024-01-01T00:00:00Z"
+	defer func() { Version, Commit, BuildDate = "dev", "unknown", "unknown" }()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/version", Handler())
+
+	req := httptest.NewRequest(http.MethodGet, "/version", nil)
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d", http.StatusOK, rr.Code)
+	}
+	if contentType := rr.Header().Get("Content-Type"); contentType != "application/json" {
+		t.Errorf("Expected content type application/json, got %s", contentType)
+	}
+
+	var info Info
+	if err := json.Unmarshal(rr.Body.Bytes(), &info); err != nil {
+		t.Fatalf("Failed to unmarshal response: %v", err)
+	}
+	expected := Info{Version: "v1.2.3", Commit: "abc123", BuildDate: "2024-01-01T00:00:00Z"}
+	if info != expected {
+		t.Errorf("Expected %+v, got %+v", expected, info)
+	}
+}
@@ -4,17 +4,23 @@ import (
 	"bytes"
 	"crypto/hmac"
 	"crypto/sha256"
+	"crypto/sha512"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"hash"
 	"io"
 	"log/slog"
 	"net/http"
+	"regexp"
+	"slices"
 	"strings"
 	"time"
 
 	"apollosolutions/uplink-relay/cache"
 	"apollosolutions/uplink-relay/config"
+	"apollosolutions/uplink-relay/schema"
+	"apollosolutions/uplink-relay/uplink"
 )
 
 type SchemaChange struct {
@@ -32,7 +38,27 @@ type WebhookData struct {
 	Timestamp          time.Time      `json:"timestamp"`
 }
 
+// signatureHashes maps the algorithms of webhook signatures, as in sha256=<signature>, to the hash their HMAC is computed with.
+var signatureHashes = map[string]func() hash.Hash{
+	"sha256": sha256.New,
+	"sha384": sha512.New384,
+	"sha512": sha512.New,
+}
+
+// acceptedAlgorithms returns the configured signature algorithms, defaulting to sha256, which Apollo signs webhooks with.
+func acceptedAlgorithms(algorithms []string) []string {
+	if len(algorithms) == 0 {
+		return []string{"sha256"}
+	}
+	return algorithms
+}
+
 func WebhookHandler(userConfig *config.Config, systemCache cache.Cache, httpClient *http.Client, logger *slog.Logger) http.HandlerFunc {
+	ignoredChanges, err := userConfig.Webhook.IgnoredChangePatterns()
+	if err != nil {
+		// The configuration is validated on load, so this only happens when it's built by hand; act on every change
+		logger.Error("Invalid webhook ignoreChanges, acting on every change", "err", err)
+	}
 	return func(w http.ResponseWriter, r *http.Request) {
 		// Verify the request signature
 		signatureHeader := r.Header.Get("x-apollo-signature")
@@ -43,14 +69,19 @@ func WebhookHandler(userConfig *config.Config, systemCache cache.Cache, httpClie
 
 		// Extract the signature algorithm and value
 		parts := strings.SplitN(signatureHeader, "=", 2)
-		if len(parts) != 2 || parts[0] != "sha256" {
+		if len(parts) != 2 {
 			http.Error(w, "Invalid signature", http.StatusBadRequest)
 			return
 		}
+		newHash, ok := signatureHashes[parts[0]]
+		if !ok || !slices.Contains(acceptedAlgorithms(userConfig.Webhook.Algorithms), parts[0]) {
+			http.Error(w, fmt.Sprintf("Unsupported signature algorithm %s", parts[0]), http.StatusBadRequest)
+			return
+		}
 
 		// Verify the signature
-		secret := userConfig.Webhook.Secret
-		if secret == "" {
+		secrets := userConfig.Webhook.AcceptedSecrets()
+		if len(secrets) == 0 {
 			http.Error(w, "Webhook secret not configured", http.StatusBadRequest)
 			return
 		}
@@ -62,17 +93,23 @@ func WebhookHandler(userConfig *config.Config, systemCache cache.Cache, httpClie
 			return
 		}
 
-		// Read the request body and compute the HMAC
-		mac := hmac.New(sha256.New, []byte(secret))
-		_, err = io.Copy(mac, bytes.NewReader(body))
-		if err != nil {
-			http.Error(w, fmt.Sprintf("Failed to read request body: %v", err), http.StatusInternalServerError)
-			return
-		}
+		// Compare the signature with the HMAC computed with each accepted secret, so the secret can be rotated without downtime
+		verified := false
+		for _, secret := range secrets {
+			mac := hmac.New(newHash, []byte(secret))
+			_, err = io.Copy(mac, bytes.NewReader(body))
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Failed to read request body: %v", err), http.StatusInternalServerError)
+				return
+			}
 
-		// Compare the computed HMAC with the expected HMAC
-		expectedMAC := hex.EncodeToString(mac.Sum(nil))
-		if !hmac.Equal([]byte(parts[1]), []byte(expectedMAC)) {
+			expectedMAC := hex.EncodeToString(mac.Sum(nil))
+			if hmac.Equal([]byte(parts[1]), []byte(expectedMAC)) {
+				verified = true
+				break
+			}
+		}
+		if !verified {
 			http.Error(w, "Invalid signature", http.StatusBadRequest)
 			return
 		}
@@ -92,6 +129,14 @@ func WebhookHandler(userConfig *config.Config, systemCache cache.Cache, httpClie
 			return
 		}
 
+		// Acknowledge events without significant changes without refetching the schema, so trivial changes don't churn the cache
+		if !significantChanges(data.Changes, ignoredChanges) {
+			logger.Info("Ignoring webhook without significant changes", "graphRef", data.VariantID, "eventID", data.EventID, "changes", len(data.Changes))
+			w.WriteHeader(http.StatusOK)
+			fmt.Fprint(w, "Webhook ignored: no significant changes")
+			return
+		}
+
 		// Fetch the schema using the SchemaURL from the webhook data
 		resp, err := httpClient.Get(data.SchemaURL)
 		if err != nil {
@@ -99,6 +144,12 @@ func WebhookHandler(userConfig *config.Config, systemCache cache.Cache, httpClie
 			return
 		}
 		defer resp.Body.Close()
+		// Error bodies, e.g. of an expired schema URL, mustn't be cached as the supergraph served to routers
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			logger.Error("Failed to fetch schema", "graphRef", data.VariantID, "status", resp.StatusCode)
+			http.Error(w, fmt.Sprintf("Failed to fetch schema: status %d", resp.StatusCode), http.StatusBadGateway)
+			return
+		}
 
 		// Parse the fetched schema
 		response, err := io.ReadAll(resp.Body)
@@ -106,19 +157,29 @@ func WebhookHandler(userConfig *config.Config, systemCache cache.Cache, httpClie
 			http.Error(w, fmt.Sprintf("Failed to read schema: %v", err), http.StatusInternalServerError)
 			return
 		}
+		if len(bytes.TrimSpace(response)) == 0 {
+			logger.Error("Fetched schema is empty", "graphRef", data.VariantID)
+			http.Error(w, "Failed to fetch schema: empty schema", http.StatusBadGateway)
+			return
+		}
 		// Convert the schema to a string
-		schema := string(response)
-
-		if userConfig.Cache.Enabled {
-			// Create a cache key using the GraphID, VariantID
-			cacheKey := cache.MakeCacheKey(data.VariantID, "SupergraphSdlQuery")
-			if cacheKey == "" {
-				logger.Error("Failed to create cache key", "graphRef", data.VariantID)
-				http.Error(w, "Failed to create cache key", http.StatusInternalServerError)
+		supergraph := string(response)
+
+		if userConfig.Cache.OperationEnabled(uplink.SupergraphQuery) {
+			// Cache the schema like one fetched from uplink, so it's served to routers and listed by the management API.
+			// Uplink's ID for the launch isn't known, so the event's timestamp stands in for it.
+			id := data.Timestamp.UTC().Format(time.RFC3339)
+			if data.Timestamp.IsZero() {
+				id = time.Now().UTC().Format(time.RFC3339)
+			}
+			if err := schema.CacheSchema(systemCache, logger, data.VariantID, supergraph, id, "", 0, nil, userConfig.CacheDuration()); err != nil {
+				logger.Error("Failed to cache schema", "graphRef", data.VariantID, "err", err)
+				http.Error(w, "Failed to cache schema", http.StatusInternalServerError)
 				return
 			}
-			// Update the cache using the fetched schema
-			systemCache.Set(cacheKey, schema, userConfig.Cache.Duration)
+			if err := updateCachedSchemas(systemCache, data.VariantID, userConfig.CacheDuration()); err != nil {
+				logger.Error("Failed to update cached schemas", "graphRef", data.VariantID, "err", err)
+			}
 		} else {
 			logger.Debug("Cache is disabled, skipping cache update for GraphID", "graphRef", data.VariantID)
 		}
@@ -129,6 +190,47 @@ func WebhookHandler(userConfig *config.Config, systemCache cache.Cache, httpClie
 	}
 }
 
+// updateCachedSchemas replaces every cached supergraph of the graph with the default entry, which holds the schema the webhook just cached.
+// Routers request the supergraph with the ID of the one they have, so they'd otherwise keep being served the entries cached
+// for their ID, e.g. Unchanged, until those expire. The history of the graph's supergraphs is kept as-is.
+func updateCachedSchemas(systemCache cache.Cache, graphRef string, duration int) error {
+	defaultKey := cache.DefaultCacheKey(graphRef, uplink.SupergraphQuery)
+	content, ok := systemCache.Get(defaultKey)
+	if !ok {
+		return fmt.Errorf("no cached schema for %s", graphRef)
+	}
+	keys, err := systemCache.KeysWithPrefix(cache.MakeCachePrefix(graphRef, uplink.SupergraphQuery) + ":")
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if key == defaultKey || key == cache.HistoryKey(graphRef, uplink.SupergraphQuery) {
+			continue
+		}
+		if err := systemCache.Set(key, string(content), duration); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// significantChanges reports whether any of the changes doesn't match one of the ignored change patterns.
+// Events without any change, or when no pattern is configured, are always significant, as there's nothing to tell them apart by.
+func significantChanges(changes []SchemaChange, ignoredChanges []*regexp.Regexp) bool {
+	if len(changes) == 0 || len(ignoredChanges) == 0 {
+		return true
+	}
+	for _, change := range changes {
+		ignored := slices.ContainsFunc(ignoredChanges, func(pattern *regexp.Regexp) bool {
+			return pattern.MatchString(change.Description)
+		})
+		if !ignored {
+			return true
+		}
+	}
+	return false
+}
+
 // Helper function to check if a configs contains variantID
 func containsGraph(configs []config.SupergraphConfig, variantID string) bool {
 	for _, item := range configs {
@@ -4,6 +4,15 @@ import (
 	"apollosolutions/uplink-relay/cache"
 	"apollosolutions/uplink-relay/config"
 	"apollosolutions/uplink-relay/logger"
+	"apollosolutions/uplink-relay/proxy"
+	"apollosolutions/uplink-relay/uplink"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
 	"net/http"
 	"net/http/httptest"
 	"strings"
@@ -16,15 +25,23 @@ func TestWebhookHandler(t *testing.T) {
 	logger := logger.MakeLogger(&truePointer)
 
 	// Create a new test cache
-	cache := cache.NewMemoryCache(10)
+	systemCache := cache.NewMemoryCache(10)
 
 	// Create a new test HTTP client
 	httpClient := http.DefaultClient
 
-	// Create a new test request
-	req := httptest.NewRequest(http.MethodPost, "/webhook", strings.NewReader(`{"eventType":"schema-change","eventID":"1234","changes":[{"description":"Type User added"}],"schemaURL":"https://example.com/schema","schemaURLExpiresAt":"2022-01-01T00:00:00Z","graphID":"1234","variantID":"1234@default","timestamp":"2022-01-01T00:00:00Z"}`))
+	// Mock the schema URL so the webhook doesn't depend on the network
+	schemaServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("schema"))
+	}))
+	defer schemaServer.Close()
 
-	req.Header.Set("x-apollo-signature", "sha256=16dcf032fab9acbadf14ecd2ff8beed88da151aa7f0e2c145377a892db5b2945")
+	// Create a new test request
+	body := fmt.Sprintf(`{"eventType":"schema-change","eventID":"1234","changes":[{"description":"Type User added"}],"schemaURL":"%s","schemaURLExpiresAt":"2022-01-01T00:00:00Z","graphID":"1234","variantID":"1234@default","timestamp":"2022-01-01T00:00:00Z"}`, schemaServer.URL)
+	req := httptest.NewRequest(http.MethodPost, "/webhook", strings.NewReader(body))
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write([]byte(body))
+	req.Header.Set("x-apollo-signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
 
 	// Create a new test response recorder
 	w := httptest.NewRecorder()
@@ -48,14 +65,351 @@ func TestWebhookHandler(t *testing.T) {
 	}
 
 	// Call the webhook handler
-	handler := WebhookHandler(config, cache, httpClient, logger)
+	handler := WebhookHandler(config, systemCache, httpClient, logger)
 	handler(w, req)
 	// Check that the response status code is 200
 	if w.Code != http.StatusOK {
 		t.Errorf("Expected status code 200, got %d", w.Code)
 	}
-	// Check that the cache was updated
-	if _, ok := cache.Get("1234:default:SupergraphSdlQuery"); !ok {
-		t.Errorf("Expected cache key 1234:default:SupergraphSdlQuery to be set")
+	// Check that the cache was updated with a cache item, like schemas fetched from uplink
+	entry, ok := systemCache.Get(cache.DefaultCacheKey("1234@default", "SupergraphSdlQuery"))
+	if !ok {
+		t.Fatalf("Expected the schema to be cached")
+	}
+	var item cache.CacheItem
+	if err := json.Unmarshal(entry, &item); err != nil {
+		t.Fatalf("Expected the schema to be cached as a cache item, got %s: %v", entry, err)
+	}
+	if string(item.Content) != "schema" || item.ID != "2022-01-01T00:00:00Z" || item.Hash == "" || item.LastModified.IsZero() || !item.Expiration.Equal(cache.IndefiniteTimestamp) {
+		t.Errorf("Expected the schema with its metadata, got %+v", item)
+	}
+}
+
+func TestWebhookCachedSchemaServed(t *testing.T) {
+	pFalse := false
+	logger := logger.MakeLogger(&pFalse)
+	schemaServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("webhook schema"))
+	}))
+	defer schemaServer.Close()
+	uplinkServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("Expected the schema to be served from the cache, not uplink")
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer uplinkServer.Close()
+
+	userConfig := config.NewDefaultConfig()
+	userConfig.Uplink.RetryCount = 1
+	userConfig.Webhook.Secret = "secret"
+	userConfig.Supergraphs = []config.SupergraphConfig{{GraphRef: "1234@default", ApolloKey: "key"}}
+	systemCache := cache.NewMemoryCache(10)
+
+	body := fmt.Sprintf(`{"eventType":"schema-change","eventID":"1234","changes":[],"schemaURL":"%s","graphID":"1234","variantID":"1234@default","timestamp":"2024-02-09T19:34:43Z"}`, schemaServer.URL)
+	req := httptest.NewRequest(http.MethodPost, "/webhook", strings.NewReader(body))
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write([]byte(body))
+	req.Header.Set("x-apollo-signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	w := httptest.NewRecorder()
+	WebhookHandler(userConfig, systemCache, http.DefaultClient, logger)(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status code 200, got %d", w.Code)
+	}
+
+	// A router fetching the supergraph is served the schema cached by the webhook
+	query := `{"query":"query SupergraphSdlQuery($apiKey: String!, $graph_ref: String!, $ifAfterId: ID) { routerConfig(ref: $graph_ref, apiKey: $apiKey, ifAfterId: $ifAfterId) { __typename ... on RouterConfigResult { id supergraphSdl: supergraphSDL minDelaySeconds } ... on Unchanged { id minDelaySeconds } ... on FetchError { code message } } }","operationName":"SupergraphSdlQuery","variables":{"apiKey":"key","graph_ref":"1234@default","ifAfterId":null}}`
+	relayHandler := proxy.RelayHandler(userConfig, systemCache, uplink.NewRoundRobinSelector([]string{uplinkServer.URL}), http.DefaultClient, logger)
+	rr := httptest.NewRecorder()
+	relayHandler.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(query)))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status code 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	var response struct {
+		Data struct {
+			RouterConfig struct {
+				Typename      string `json:"__typename"`
+				ID            string `json:"id"`
+				SupergraphSdl string `json:"supergraphSdl"`
+			} `json:"routerConfig"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Failed to unmarshal response %s: %v", rr.Body.String(), err)
+	}
+	if routerConfig := response.Data.RouterConfig; routerConfig.Typename != "RouterConfigResult" || routerConfig.SupergraphSdl != "webhook schema" || routerConfig.ID != "2024-02-09T19:34:43Z" {
+		t.Errorf("Expected the webhook schema to be served, got %+v", routerConfig)
+	}
+}
+
+func TestWebhookHandlerMultipleSecrets(t *testing.T) {
+	pFalse := false
+	logger := logger.MakeLogger(&pFalse)
+
+	// Mock the schema URL so the webhook doesn't depend on the network
+	schemaServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("schema"))
+	}))
+	defer schemaServer.Close()
+
+	body := fmt.Sprintf(`{"eventType":"schema-change","eventID":"1234","changes":[],"schemaURL":"%s","schemaURLExpiresAt":"2022-01-01T00:00:00Z","graphID":"1234","variantID":"1234@default","timestamp":"2022-01-01T00:00:00Z"}`, schemaServer.URL)
+	sign := func(secret string) string {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write([]byte(body))
+		return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	}
+
+	config := &config.Config{
+		Webhook: config.WebhookConfig{
+			Secret:  "old-secret",
+			Secrets: []string{"new-secret"},
+		},
+		Cache: config.CacheConfig{
+			Enabled:  true,
+			MaxSize:  10,
+			Duration: -1,
+		},
+		Supergraphs: []config.SupergraphConfig{
+			{
+				GraphRef:  "1234@default",
+				ApolloKey: "key",
+			},
+		},
+	}
+
+	tests := []struct {
+		secret   string
+		expected int
+	}{
+		{"old-secret", http.StatusOK},
+		{"new-secret", http.StatusOK},
+		{"other-secret", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodPost, "/webhook", strings.NewReader(body))
+		req.Header.Set("x-apollo-signature", sign(tt.secret))
+		w := httptest.NewRecorder()
+
+		WebhookHandler(config, cache.NewMemoryCache(10), http.DefaultClient, logger)(w, req)
+		if w.Code != tt.expected {
+			t.Errorf("Expected status code %d for a payload signed with %s, got %d", tt.expected, tt.secret, w.Code)
+		}
+	}
+}
+
+func TestWebhookHandlerAlgorithms(t *testing.T) {
+	pFalse := false
+	logger := logger.MakeLogger(&pFalse)
+
+	// Mock the schema URL so the webhook doesn't depend on the network
+	schemaServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("schema"))
+	}))
+	defer schemaServer.Close()
+
+	body := fmt.Sprintf(`{"eventType":"schema-change","eventID":"1234","changes":[],"schemaURL":"%s","graphID":"1234","variantID":"1234@default","timestamp":"2022-01-01T00:00:00Z"}`, schemaServer.URL)
+	sign := func(algorithm string, newHash func() hash.Hash) string {
+		mac := hmac.New(newHash, []byte("secret"))
+		mac.Write([]byte(body))
+		return algorithm + "=" + hex.EncodeToString(mac.Sum(nil))
+	}
+
+	tests := []struct {
+		name       string
+		algorithms []string
+		signature  string
+		expected   int
+	}{
+		{"default sha256", nil, sign("sha256", sha256.New), http.StatusOK},
+		{"unconfigured sha512", nil, sign("sha512", sha512.New), http.StatusBadRequest},
+		{"configured sha512", []string{"sha256", "sha512"}, sign("sha512", sha512.New), http.StatusOK},
+		{"configured sha256 alongside sha512", []string{"sha256", "sha512"}, sign("sha256", sha256.New), http.StatusOK},
+		{"sha256 not configured", []string{"sha512"}, sign("sha256", sha256.New), http.StatusBadRequest},
+		{"mismatched algorithm", []string{"sha256", "sha512"}, "sha512=" + strings.TrimPrefix(sign("sha256", sha256.New), "sha256="), http.StatusBadRequest},
+		{"unknown algorithm", []string{"sha256"}, "md5=" + strings.TrimPrefix(sign("sha256", sha256.New), "sha256="), http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			userConfig := config.NewDefaultConfig()
+			userConfig.Webhook.Secret = "secret"
+			userConfig.Webhook.Algorithms = tt.algorithms
+			userConfig.Supergraphs = []config.SupergraphConfig{{GraphRef: "1234@default", ApolloKey: "key"}}
+
+			req := httptest.NewRequest(http.MethodPost, "/webhook", strings.NewReader(body))
+			req.Header.Set("x-apollo-signature", tt.signature)
+			w := httptest.NewRecorder()
+			WebhookHandler(userConfig, cache.NewMemoryCache(10), http.DefaultClient, logger)(w, req)
+			if w.Code != tt.expected {
+				t.Errorf("Expected status code %d, got %d: %s", tt.expected, w.Code, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestWebhookHandlerIgnoreChanges(t *testing.T) {
+	pFalse := false
+	logger := logger.MakeLogger(&pFalse)
+
+	fetches := 0
+	schemaServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches++
+		w.Write([]byte("schema"))
+	}))
+	defer schemaServer.Close()
+
+	tests := []struct {
+		name          string
+		ignoreChanges []string
+		changes       string
+		expectedFetch bool
+	}{
+		{"no filter", nil, `[{"description":"Description for field Query.user was changed"}]`, true},
+		{"insignificant changes", []string{"^Description"}, `[{"description":"Description for field Query.user was changed"},{"description":"Description added to type User"}]`, false},
+		{"significant change", []string{"^Description"}, `[{"description":"Description for field Query.user was changed"},{"description":"Type User added"}]`, true},
+		{"no changes", []string{"^Description"}, `[]`, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fetches = 0
+			body := fmt.Sprintf(`{"eventType":"schema-change","eventID":"1234","changes":%s,"schemaURL":"%s","schemaURLExpiresAt":"2022-01-01T00:00:00Z","graphID":"1234","variantID":"1234@default","timestamp":"2022-01-01T00:00:00Z"}`, tt.changes, schemaServer.URL)
+			mac := hmac.New(sha256.New, []byte("secret"))
+			mac.Write([]byte(body))
+
+			config := &config.Config{
+				Webhook: config.WebhookConfig{
+					Secret:        "secret",
+					IgnoreChanges: tt.ignoreChanges,
+				},
+				Cache: config.CacheConfig{
+					Enabled:  true,
+					MaxSize:  10,
+					Duration: -1,
+				},
+				Supergraphs: []config.SupergraphConfig{{GraphRef: "1234@default", ApolloKey: "key"}},
+			}
+			systemCache := cache.NewMemoryCache(10)
+			req := httptest.NewRequest(http.MethodPost, "/webhook", strings.NewReader(body))
+			req.Header.Set("x-apollo-signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+			w := httptest.NewRecorder()
+
+			WebhookHandler(config, systemCache, http.DefaultClient, logger)(w, req)
+			if w.Code != http.StatusOK {
+				t.Fatalf("Expected status code 200, got %d", w.Code)
+			}
+			if fetched := fetches == 1; fetched != tt.expectedFetch {
+				t.Errorf("Expected the schema to be fetched: %v, got %d fetches", tt.expectedFetch, fetches)
+			}
+			if _, cached := systemCache.Get(cache.DefaultCacheKey("1234@default", "SupergraphSdlQuery")); cached != tt.expectedFetch {
+				t.Errorf("Expected the schema to be cached: %v, got %v", tt.expectedFetch, cached)
+			}
+		})
+	}
+}
+
+func TestWebhookUpdatesRoutersWithSchema(t *testing.T) {
+	pFalse := false
+	logger := logger.MakeLogger(&pFalse)
+	schemaServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("webhook schema"))
+	}))
+	defer schemaServer.Close()
+	uplinkCalls := 0
+	uplinkServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		uplinkCalls++
+		w.Write([]byte(`{"data":{"routerConfig":{"__typename":"Unchanged","id":"2024-01-01T00:00:00Z","minDelaySeconds":30}}}`))
+	}))
+	defer uplinkServer.Close()
+
+	userConfig := config.NewDefaultConfig()
+	userConfig.Uplink.RetryCount = 1
+	userConfig.Webhook.Secret = "secret"
+	userConfig.Supergraphs = []config.SupergraphConfig{{GraphRef: "1234@default", ApolloKey: "key"}}
+	systemCache := cache.NewMemoryCache(10)
+	relayHandler := proxy.RelayHandler(userConfig, systemCache, uplink.NewRoundRobinSelector([]string{uplinkServer.URL}), http.DefaultClient, logger)
+	fetchSupergraph := func() (string, string) {
+		query := `{"query":"query SupergraphSdlQuery($apiKey: String!, $graph_ref: String!, $ifAfterId: ID) { routerConfig(ref: $graph_ref, apiKey: $apiKey, ifAfterId: $ifAfterId) { __typename ... on RouterConfigResult { id supergraphSdl: supergraphSDL minDelaySeconds } ... on Unchanged { id minDelaySeconds } ... on FetchError { code message } } }","operationName":"SupergraphSdlQuery","variables":{"apiKey":"key","graph_ref":"1234@default","ifAfterId":"2024-01-01T00:00:00Z"}}`
+		rr := httptest.NewRecorder()
+		relayHandler.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(query)))
+		var response struct {
+			Data struct {
+				RouterConfig struct {
+					Typename      string `json:"__typename"`
+					SupergraphSdl string `json:"supergraphSdl"`
+				} `json:"routerConfig"`
+			} `json:"data"`
+		}
+		if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+			t.Fatalf("Failed to unmarshal response %s: %v", rr.Body.String(), err)
+		}
+		return response.Data.RouterConfig.Typename, response.Data.RouterConfig.SupergraphSdl
+	}
+
+	// A router with the current schema is told it's unchanged, which is cached for its ID
+	if typename, _ := fetchSupergraph(); typename != "Unchanged" {
+		t.Fatalf("Expected the schema to be unchanged, got %s", typename)
+	}
+
+	body := fmt.Sprintf(`{"eventType":"schema-change","eventID":"1234","changes":[],"schemaURL":"%s","graphID":"1234","variantID":"1234@default","timestamp":"2024-02-09T19:34:43Z"}`, schemaServer.URL)
+	req := httptest.NewRequest(http.MethodPost, "/webhook", strings.NewReader(body))
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write([]byte(body))
+	req.Header.Set("x-apollo-signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	w := httptest.NewRecorder()
+	WebhookHandler(userConfig, systemCache, http.DefaultClient, logger)(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status code 200, got %d", w.Code)
+	}
+
+	// The router's next request is served the webhook's schema from the cache
+	if typename, sdl := fetchSupergraph(); typename != "RouterConfigResult" || sdl != "webhook schema" {
+		t.Errorf("Expected the webhook schema to be served, got %s %q", typename, sdl)
+	}
+	if uplinkCalls != 1 {
+		t.Errorf("Expected 1 uplink call, got %d", uplinkCalls)
+	}
+}
+
+func TestWebhookHandlerSchemaFetchFailure(t *testing.T) {
+	pFalse := false
+	logger := logger.MakeLogger(&pFalse)
+
+	tests := []struct {
+		name   string
+		status int
+		body   string
+	}{
+		{"Forbidden", http.StatusForbidden, "<Error><Code>AccessDenied</Code><Message>Request has expired</Message></Error>"},
+		{"ServerError", http.StatusInternalServerError, "internal error"},
+		{"Empty", http.StatusOK, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			schemaServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+				w.Write([]byte(tt.body))
+			}))
+			defer schemaServer.Close()
+
+			userConfig := config.NewDefaultConfig()
+			userConfig.Webhook.Secret = "secret"
+			userConfig.Supergraphs = []config.SupergraphConfig{{GraphRef: "1234@default", ApolloKey: "key"}}
+			systemCache := cache.NewMemoryCache(10)
+			defaultKey := cache.DefaultCacheKey("1234@default", "SupergraphSdlQuery")
+			if err := systemCache.Set(defaultKey, "cached schema", -1); err != nil {
+				t.Fatalf("Failed to set cache: %v", err)
+			}
+
+			body := fmt.Sprintf(`{"eventType":"schema-change","eventID":"1234","changes":[],"schemaURL":"%s","graphID":"1234","variantID":"1234@default","timestamp":"2024-02-09T19:34:43Z"}`, schemaServer.URL)
+			req := httptest.NewRequest(http.MethodPost, "/webhook", strings.NewReader(body))
+			mac := hmac.New(sha256.New, []byte("secret"))
+			mac.Write([]byte(body))
+			req.Header.Set("x-apollo-signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+			w := httptest.NewRecorder()
+			WebhookHandler(userConfig, systemCache, http.DefaultClient, logger)(w, req)
+			if w.Code != http.StatusBadGateway {
+				t.Errorf("Expected status code 502, got %d", w.Code)
+			}
+			if cached, _ := systemCache.Get(defaultKey); string(cached) != "cached schema" {
+				t.Errorf("Expected the cached schema to be unchanged, got %s", cached)
+			}
+		})
 	}
 }